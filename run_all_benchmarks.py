@@ -98,11 +98,12 @@ finally:
             subprocess.run(["go", "version"], capture_output=True, check=True)
 
             # Build Go benchmark
-            build_cmd = ["go", "build", "-o", "build/go_ringbuf", "src/golang/ringbuf_throughput.go", "src/golang/common.go"]
+            build_cmd = ["go", "build", "-o", "../../build/ebpf-bench", "."]
             self.log("Building Go benchmark...")
 
             result = subprocess.run(
                 build_cmd,
+                cwd="src/golang",
                 capture_output=True,
                 text=True,
                 timeout=60
@@ -114,7 +115,7 @@ finally:
                 return None
 
             # Run Go benchmark
-            run_cmd = ["./build/go_ringbuf", "-d", str(self.duration), "-o", f"{self.output_dir}/go_result.json"]
+            run_cmd = ["./build/ebpf-bench", "ringbuf", "-d", str(self.duration), "-o", f"{self.output_dir}/go_result.json"]
             if self.verbose:
                 run_cmd.append("-v")
 
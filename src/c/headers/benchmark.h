@@ -24,6 +24,58 @@ struct event {
     __u32 data;           /* Generic data field */
 };
 
+/* TLV event encoding: each field is a one-byte type, a one-byte length
+ * and the value, so consumers can skip fields they do not know. */
+struct tlv_hdr {
+    __u8 type;
+    __u8 len;
+};
+
+#define TLV_TIMESTAMP 1   /* __u64 */
+#define TLV_PID 2         /* __u32 */
+#define TLV_CPU 3         /* __u32 */
+#define TLV_EVENT_TYPE 4  /* __u32 */
+#define TLV_DATA 5        /* __u32 */
+
+/* Size of a TLV event carrying the five fields of struct event */
+#define TLV_EVENT_SIZE (5 * sizeof(struct tlv_hdr) + 8 + 4 * 4)
+
+/* Record a packet program emits per parsed packet */
+struct pkt_event {
+    __u64 sent;           /* Generator's timestamp from the UDP payload */
+    __u64 seen;           /* bpf_ktime_get_ns when the program ran */
+    __u32 ifindex;        /* Receiving interface */
+    __u32 verdict;        /* Action returned */
+};
+
+/* Slots of the packet programs' per-CPU counters */
+#define PKT_COUNT_PACKETS 0
+#define PKT_COUNT_BYTES 1
+#define PKT_COUNT_PARSE_ERRORS 2
+#define PKT_COUNT_RING_FULL 3  /* Records the ring buffer had no room for */
+#define PKT_COUNT_CT_LOOKUPS 4 /* Flow table lookups */
+#define PKT_COUNT_CT_HITS 5    /* Lookups that found the flow */
+#define PKT_COUNT_CT_INSERTS 6 /* New flows inserted */
+#define PKT_COUNT_CT_FAILED 7  /* New flows the table had no room for */
+#define PKT_COUNT_SLOTS 8
+
+/* Flow table key: the 5-tuple, IPv4 addresses in the first four bytes */
+struct ct_key {
+    __u8 src[16];
+    __u8 dst[16];
+    __u16 sport;
+    __u16 dport;
+    __u8 proto;
+    __u8 pad[3];
+};
+
+/* Flow table value */
+struct ct_entry {
+    __u64 packets;
+    __u64 bytes;
+    __u64 last_seen;      /* bpf_ktime_get_ns */
+};
+
 /* Statistics structure for hash maps */
 struct stats {
     __u64 count;          /* Event count */
@@ -37,6 +89,42 @@ struct stats {
 #define PERF_MAP_NAME "perf_events"
 #define STATS_MAP_NAME "stats"
 #define COUNTER_MAP_NAME "counters"
+#define CONFIG_MAP_NAME "config"
+#define EMIT_COST_MAP_NAME "emit_cost"
+#define PKT_RINGBUF_SIZE (256 * 1024)
+
+/* Slots of the counters map, an array of __u64 the ring buffer programs
+ * add to atomically: one per program's emits, then the shared failures */
+#define RING_COUNT_KPROBE 0
+#define RING_COUNT_TRACEPOINT 1
+#define RING_COUNT_RAW_TP 2
+#define RING_COUNT_TLV 3
+#define RING_COUNT_OUTPUT 4
+#define RING_COUNT_FULL 5 /* Emits the ring buffer had no room for */
+#define RING_COUNT_GATED 6 /* Events held back until the reader was ready */
+#define RING_COUNT_STARTUP_DROPS 7 /* Emits lost to a full ring before it was */
+#define RING_COUNT_SEQ 8  /* Records submitted by the batch wakeup strategy */
+#define RING_COUNT_SLOTS 10
+
+/* Record size of the getpid variants, a multiple of 8 of at most 256 so
+ * an output record fits on the stack; ringbuf-output builds them for -size */
+#ifndef RING_RECORD_SIZE
+#define RING_RECORD_SIZE 64
+#endif
+
+/* Slots of the config map, an array of __u64 shared with userspace */
+#define CONFIG_PHASE 0    /* Pipeline phase */
+#define CONFIG_READY 1    /* Set to 1 by userspace once its reader is draining */
+#define CONFIG_SELF_TIME 2 /* Set to 1 by userspace to have the program time its emits */
+
+/* Slots of the emit cost map, a per-CPU array of __u64 the program fills
+ * when self-timing. Bucket 0 counts emits of 0 ns and bucket i those of
+ * [2^(i-1), 2^i) ns, the last one open-ended; the totals follow. */
+#define EMIT_COST_BUCKETS 32
+#define EMIT_COST_COUNT (EMIT_COST_BUCKETS + 0) /* Emits timed */
+#define EMIT_COST_SUM (EMIT_COST_BUCKETS + 1)   /* Their total time in ns */
+#define EMIT_COST_CLOCK (EMIT_COST_BUCKETS + 2) /* Cheapest back-to-back bpf_ktime_get_ns pair */
+#define EMIT_COST_SLOTS (EMIT_COST_BUCKETS + 3)
 
 /* Event types */
 #define EVENT_TYPE_KPROBE 1
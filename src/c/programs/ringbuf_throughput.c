@@ -11,20 +11,158 @@
 #include <bpf/bpf_tracing.h>  /* For PT_REGS_PARM macros */
 #include "../headers/benchmark.h"
 
+/* getpid(2)'s number, which vmlinux.h does not carry */
+#ifndef __NR_getpid
+#if defined(__TARGET_ARCH_arm64)
+#define __NR_getpid 172
+#else
+#define __NR_getpid 39
+#endif
+#endif
+
 /* Ring buffer map for event submission */
 struct {
     __uint(type, BPF_MAP_TYPE_RINGBUF);
     __uint(max_entries, 256 * 1024);
 } ringbuf_events SEC(".maps");
 
-/* Simple counter for statistics */
+/* Simple counter for statistics; see RING_COUNT_* */
 struct {
     __uint(type, BPF_MAP_TYPE_ARRAY);
     __type(key, __u32);
     __type(value, __u64);
-    __uint(max_entries, 10);
+    __uint(max_entries, RING_COUNT_SLOTS);
 } counters SEC(".maps");
 
+/* Process whose getpid(2) calls fire the raw_tp getpid variants, set by
+ * userspace before loading */
+const volatile __u32 target_tgid = 0;
+
+/* getpid_reserve's bpf_ringbuf_submit flags, for ringbuf-wakeup's
+ * strategies; a wakeup_batch above zero forces a wakeup on every
+ * wakeup_batch-th record and suppresses the others */
+const volatile __u64 submit_flags = 0;
+const volatile __u64 wakeup_batch = 0;
+
+/* Whether getpid_reserve waits for reader_ready, counting what it holds
+ * back in RING_COUNT_GATED; either way, what it loses to a full ring
+ * before the reader is ready is counted in RING_COUNT_STARTUP_DROPS */
+const volatile __u8 handshake = 1;
+
+/* Flags set by userspace; see CONFIG_* */
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __type(key, __u32);
+    __type(value, __u64);
+    __uint(max_entries, 3);
+} config SEC(".maps");
+
+/* The program's own timing of reserve to submit; see EMIT_COST_* */
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __type(key, __u32);
+    __type(value, __u64);
+    __uint(max_entries, EMIT_COST_SLOTS);
+} emit_cost SEC(".maps");
+
+/**
+ * reader_ready - Whether userspace is draining the ring buffer yet
+ *
+ * Until it is, events would only fill the ring and be dropped, a burst
+ * that would count against short runs
+ */
+static __always_inline int reader_ready(void)
+{
+    __u32 key = CONFIG_READY;
+    __u64 *ready = bpf_map_lookup_elem(&config, &key);
+
+    return ready && *ready;
+}
+
+/**
+ * emit_start - Start timing an emit, if userspace asked for it
+ *
+ * Returns the start time, or 0 when the program is not self-timing
+ */
+static __always_inline __u64 emit_start(void)
+{
+    __u32 key = CONFIG_SELF_TIME;
+    __u64 *self_time = bpf_map_lookup_elem(&config, &key);
+
+    if (!self_time || !*self_time)
+        return 0;
+    return bpf_ktime_get_ns();
+}
+
+/* Floor of the base-2 logarithm of v, for v > 0, without loops */
+static __always_inline __u32 log2_u64(__u64 v)
+{
+    __u32 r = 0, shift;
+
+    shift = (v > 0xffffffffULL) << 5;
+    v >>= shift;
+    r |= shift;
+    shift = (v > 0xffff) << 4;
+    v >>= shift;
+    r |= shift;
+    shift = (v > 0xff) << 3;
+    v >>= shift;
+    r |= shift;
+    shift = (v > 0xf) << 2;
+    v >>= shift;
+    r |= shift;
+    shift = (v > 0x3) << 1;
+    v >>= shift;
+    r |= shift;
+    return r | (v >> 1);
+}
+
+/* Add one to an emit cost slot, or n to a total */
+static __always_inline void emit_cost_add(__u32 key, __u64 n)
+{
+    __u64 *slot = bpf_map_lookup_elem(&emit_cost, &key);
+
+    if (slot)
+        *slot += n;
+}
+
+/**
+ * emit_done - Record the cost of an emit started by emit_start
+ *
+ * The map is per-CPU, so plain adds suffice. Every 1024th emit on a CPU
+ * also times two back-to-back clock reads, so userspace can take the
+ * clock's own cost out of the measured times.
+ */
+static __always_inline void emit_done(__u64 start)
+{
+    __u32 key = EMIT_COST_COUNT;
+    __u64 *count, *clock;
+    __u64 d, a;
+    __u32 bucket = 0;
+
+    if (!start)
+        return;
+    d = bpf_ktime_get_ns() - start;
+    if (d)
+        bucket = log2_u64(d) + 1;
+    if (bucket >= EMIT_COST_BUCKETS)
+        bucket = EMIT_COST_BUCKETS - 1;
+    emit_cost_add(bucket, 1);
+    emit_cost_add(EMIT_COST_SUM, d);
+
+    count = bpf_map_lookup_elem(&emit_cost, &key);
+    if (!count || (*count)++ % 1024)
+        return;
+    key = EMIT_COST_CLOCK;
+    clock = bpf_map_lookup_elem(&emit_cost, &key);
+    if (!clock)
+        return;
+    a = bpf_ktime_get_ns();
+    d = bpf_ktime_get_ns() - a;
+    if (!*clock || d < *clock)
+        *clock = d;
+}
+
 /**
  * kprobe_handler - Trace sys_enter_openat syscall
  *
@@ -36,7 +174,12 @@ int kprobe_openat(struct pt_regs *ctx)
 {
     struct event *e;
     __u32 zero = 0;
+    __u64 start;
+
+    if (!reader_ready())
+        return 0;
 
+    start = emit_start();
     /* Reserve space in ring buffer */
     e = bpf_ringbuf_reserve(&ringbuf_events, sizeof(*e), 0);
     if (!e)
@@ -52,6 +195,7 @@ int kprobe_openat(struct pt_regs *ctx)
 
     /* Submit event */
     bpf_ringbuf_submit(e, 0);
+    emit_done(start);
 
     /* Update counter */
     __u64 *counter = bpf_map_lookup_elem(&counters, &zero);
@@ -72,7 +216,12 @@ int tracepoint_openat(struct trace_event_raw_sys_enter *ctx)
 {
     struct event *e;
     __u32 one = 1;
+    __u64 start;
 
+    if (!reader_ready())
+        return 0;
+
+    start = emit_start();
     /* Reserve space in ring buffer */
     e = bpf_ringbuf_reserve(&ringbuf_events, sizeof(*e), 0);
     if (!e)
@@ -87,6 +236,7 @@ int tracepoint_openat(struct trace_event_raw_sys_enter *ctx)
 
     /* Submit event */
     bpf_ringbuf_submit(e, 0);
+    emit_done(start);
 
     /* Update counter */
     __u64 *counter = bpf_map_lookup_elem(&counters, &one);
@@ -96,6 +246,95 @@ int tracepoint_openat(struct trace_event_raw_sys_enter *ctx)
     return 0;
 }
 
+/**
+ * tracepoint_openat_output - sys_enter_openat through bpf_ringbuf_output
+ *
+ * Same event as tracepoint_openat, but built on the stack and copied into
+ * the ring buffer by bpf_ringbuf_output instead of being filled in place
+ * after bpf_ringbuf_reserve, for measuring what the copy costs
+ */
+SEC("tp/syscalls/sys_enter_openat")
+int tracepoint_openat_output(struct trace_event_raw_sys_enter *ctx)
+{
+    struct event e = {};
+    __u32 four = 4;
+    __u64 start;
+
+    if (!reader_ready())
+        return 0;
+
+    start = emit_start();
+    e.timestamp = bpf_ktime_get_ns();
+    e.pid = bpf_get_current_uid_gid() >> 32;
+    e.cpu_id = bpf_get_smp_processor_id();
+    e.event_type = EVENT_TYPE_TRACEPOINT;
+    e.data = ctx->args[1]; /* Flags argument */
+
+    /* Reserve, copy and submit in one call */
+    if (bpf_ringbuf_output(&ringbuf_events, &e, sizeof(e), 0))
+        return 1;
+    emit_done(start);
+
+    __u64 *counter = bpf_map_lookup_elem(&counters, &four);
+    if (counter)
+        __sync_fetch_and_add(counter, 1);
+
+    return 0;
+}
+
+/* Write one TLV field at offset off and advance it */
+#define TLV_PUT(buf, off, t, val)                                           \
+    do {                                                                    \
+        struct tlv_hdr *h = (struct tlv_hdr *)((buf) + (off));              \
+        h->type = (t);                                                      \
+        h->len = sizeof(val);                                               \
+        __builtin_memcpy((buf) + (off) + sizeof(*h), &(val), sizeof(val));  \
+        (off) += sizeof(*h) + sizeof(val);                                  \
+    } while (0)
+
+/**
+ * tracepoint_openat_tlv - sys_enter_openat with TLV-encoded events
+ *
+ * Same fields as tracepoint_openat, but each one written as type, length
+ * and value, for measuring the cost of an extensible event format
+ */
+SEC("tp/syscalls/sys_enter_openat")
+int tracepoint_openat_tlv(struct trace_event_raw_sys_enter *ctx)
+{
+    __u8 *buf;
+    __u32 off = 0;
+    __u32 three = 3;
+    __u64 start;
+
+    if (!reader_ready())
+        return 0;
+
+    start = emit_start();
+    buf = bpf_ringbuf_reserve(&ringbuf_events, TLV_EVENT_SIZE, 0);
+    if (!buf)
+        return 1;
+
+    __u64 ts = bpf_ktime_get_ns();
+    __u32 pid = bpf_get_current_uid_gid() >> 32;
+    __u32 cpu = bpf_get_smp_processor_id();
+    __u32 type = EVENT_TYPE_TRACEPOINT;
+    __u32 data = ctx->args[1];
+    TLV_PUT(buf, off, TLV_TIMESTAMP, ts);
+    TLV_PUT(buf, off, TLV_PID, pid);
+    TLV_PUT(buf, off, TLV_CPU, cpu);
+    TLV_PUT(buf, off, TLV_EVENT_TYPE, type);
+    TLV_PUT(buf, off, TLV_DATA, data);
+
+    bpf_ringbuf_submit(buf, 0);
+    emit_done(start);
+
+    __u64 *counter = bpf_map_lookup_elem(&counters, &three);
+    if (counter)
+        __sync_fetch_and_add(counter, 1);
+
+    return 0;
+}
+
 /**
  * raw_tracepoint_handler - Raw tracepoint version
  *
@@ -107,7 +346,12 @@ int raw_tracepoint_handler(struct bpf_raw_tracepoint_args *ctx)
 {
     struct event *e;
     __u32 two = 2;
+    __u64 start;
+
+    if (!reader_ready())
+        return 0;
 
+    start = emit_start();
     /* Reserve space in ring buffer */
     e = bpf_ringbuf_reserve(&ringbuf_events, sizeof(*e), 0);
     if (!e)
@@ -122,6 +366,7 @@ int raw_tracepoint_handler(struct bpf_raw_tracepoint_args *ctx)
 
     /* Submit event */
     bpf_ringbuf_submit(e, 0);
+    emit_done(start);
 
     /* Update counter */
     __u64 *counter = bpf_map_lookup_elem(&counters, &two);
@@ -131,4 +376,107 @@ int raw_tracepoint_handler(struct bpf_raw_tracepoint_args *ctx)
     return 0;
 }
 
+/* An event padded to the record size of the getpid variants */
+struct sized_event {
+    struct event e;
+    __u8 pad[RING_RECORD_SIZE - sizeof(struct event)];
+};
+
+/* Add one to a counter */
+static __always_inline void count(__u32 key)
+{
+    __u64 *counter = bpf_map_lookup_elem(&counters, &key);
+
+    if (counter)
+        __sync_fetch_and_add(counter, 1);
+}
+
+/* Whether the syscall entering is a getpid(2) of target_tgid */
+static __always_inline int is_target_getpid(struct bpf_raw_tracepoint_args *ctx)
+{
+    return (bpf_get_current_pid_tgid() >> 32) == target_tgid &&
+           ctx->args[1] == __NR_getpid;
+}
+
+/**
+ * getpid_reserve - tracepoint_openat's emit, fired by getpid(2)
+ *
+ * The reserve half of ringbuf-output's pair: the producers call getpid(2)
+ * at the rate they want events, so this and getpid_output see the same
+ * load. What the ring has no room for is counted in RING_COUNT_FULL.
+ * ringbuf-wakeup loads it with its strategy's submit flags.
+ */
+SEC("raw_tp/sys_enter")
+int getpid_reserve(struct bpf_raw_tracepoint_args *ctx)
+{
+    struct sized_event *e;
+    __u64 flags = submit_flags;
+    __u64 start;
+    int ready;
+
+    if (!is_target_getpid(ctx))
+        return 0;
+    ready = reader_ready();
+    if (handshake && !ready) {
+        count(RING_COUNT_GATED);
+        return 0;
+    }
+
+    start = emit_start();
+    e = bpf_ringbuf_reserve(&ringbuf_events, sizeof(*e), 0);
+    if (!e) {
+        count(RING_COUNT_FULL);
+        if (!ready)
+            count(RING_COUNT_STARTUP_DROPS);
+        return 1;
+    }
+    __builtin_memset(e->pad, 0, sizeof(e->pad));
+    e->e.timestamp = bpf_ktime_get_ns();
+    e->e.pid = bpf_get_current_uid_gid() >> 32;
+    e->e.cpu_id = bpf_get_smp_processor_id();
+    e->e.event_type = EVENT_TYPE_TRACEPOINT;
+    e->e.data = ctx->args[1];
+    if (wakeup_batch) {
+        __u32 key = RING_COUNT_SEQ;
+        __u64 *seq = bpf_map_lookup_elem(&counters, &key);
+
+        flags = BPF_RB_NO_WAKEUP;
+        if (seq && (__sync_fetch_and_add(seq, 1) + 1) % wakeup_batch == 0)
+            flags = BPF_RB_FORCE_WAKEUP;
+    }
+    bpf_ringbuf_submit(e, flags);
+    emit_done(start);
+
+    count(RING_COUNT_TRACEPOINT);
+    return 0;
+}
+
+/**
+ * getpid_output - tracepoint_openat_output's emit, fired by getpid(2)
+ *
+ * The output half of ringbuf-output's pair: the same record, built on the
+ * stack and copied in by bpf_ringbuf_output
+ */
+SEC("raw_tp/sys_enter")
+int getpid_output(struct bpf_raw_tracepoint_args *ctx)
+{
+    struct sized_event e = {};
+
+    if (!is_target_getpid(ctx))
+        return 0;
+
+    e.e.timestamp = bpf_ktime_get_ns();
+    e.e.pid = bpf_get_current_uid_gid() >> 32;
+    e.e.cpu_id = bpf_get_smp_processor_id();
+    e.e.event_type = EVENT_TYPE_TRACEPOINT;
+    e.e.data = ctx->args[1];
+    if (bpf_ringbuf_output(&ringbuf_events, &e, sizeof(e), 0)) {
+        count(RING_COUNT_FULL);
+        return 1;
+    }
+
+    count(RING_COUNT_OUTPUT);
+    return 0;
+}
+
 char LICENSE[] SEC("license") = "Dual BSD/GPL";
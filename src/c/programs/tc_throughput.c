@@ -0,0 +1,114 @@
+/* SPDX-License-Identifier: (LGPL-2.1 OR BSD-2-Clause) */
+/*
+ * TC (clsact) Classifier Throughput Benchmark
+ *
+ * This eBPF program is attached to the clsact ingress or egress hook of a
+ * test interface. It parses Ethernet/IPv4/UDP headers, counts packets per
+ * CPU and returns a configurable TC action (pass, drop or redirect) so
+ * results can be compared with the XDP benchmark on the same traffic.
+ * Every parsed packet is reported as a struct pkt_event, as
+ * xdp_throughput.c reports it.
+ */
+
+#include "vmlinux.h"
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_endian.h>
+#include "../headers/benchmark.h"
+
+#define ETH_P_IP 0x0800
+#define IPPROTO_UDP 17
+#define TC_ACT_OK 0
+#define TC_ACT_SHOT 2
+#define TC_ACT_REDIRECT 7
+
+/* Per-CPU packet counters, PKT_COUNT_* up to the ring buffer's */
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __type(key, __u32);
+    __type(value, __u64);
+    __uint(max_entries, PKT_COUNT_SLOTS);
+} tc_counters SEC(".maps");
+
+/* Configuration written by userspace: 0=TC action, 1=redirect ifindex */
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __type(key, __u32);
+    __type(value, __u32);
+    __uint(max_entries, 2);
+} tc_config SEC(".maps");
+
+/* One struct pkt_event per parsed packet */
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, PKT_RINGBUF_SIZE);
+} tc_events SEC(".maps");
+
+static __always_inline void count(__u32 idx, __u64 value)
+{
+    __u64 *counter = bpf_map_lookup_elem(&tc_counters, &idx);
+    if (counter)
+        *counter += value; /* Per-CPU, no atomics needed */
+}
+
+/**
+ * tc_benchmark - Parse and count every packet on the clsact hook
+ */
+SEC("tc")
+int tc_benchmark(struct __sk_buff *skb)
+{
+    void *data = (void *)(long)skb->data;
+    void *data_end = (void *)(long)skb->data_end;
+    struct ethhdr *eth = data;
+    struct iphdr *ip;
+    struct udphdr *udp;
+    struct pkt_event e = {};
+    __u32 action_key = 0, ifindex_key = 1;
+    __u32 action = TC_ACT_OK;
+
+    __u32 *cfg = bpf_map_lookup_elem(&tc_config, &action_key);
+    if (cfg)
+        action = *cfg;
+
+    if ((void *)(eth + 1) > data_end)
+        goto parse_error;
+    if (eth->h_proto != bpf_htons(ETH_P_IP))
+        goto parse_error;
+
+    ip = (void *)(eth + 1);
+    if ((void *)(ip + 1) > data_end)
+        goto parse_error;
+    if (ip->protocol != IPPROTO_UDP)
+        goto parse_error;
+
+    udp = (void *)ip + ip->ihl * 4;
+    if ((void *)(udp + 1) > data_end)
+        goto parse_error;
+
+    /* The generator's timestamp leads the payload */
+    if ((void *)(udp + 1) + sizeof(__u64) <= data_end)
+        e.sent = *(__u64 *)(udp + 1);
+
+    count(PKT_COUNT_PACKETS, 1);
+    count(PKT_COUNT_BYTES, skb->len);
+
+    if (action == TC_ACT_REDIRECT) {
+        __u32 *ifindex = bpf_map_lookup_elem(&tc_config, &ifindex_key);
+        if (ifindex && *ifindex)
+            action = bpf_redirect(*ifindex, 0);
+        else
+            action = TC_ACT_OK;
+    }
+
+    e.seen = bpf_ktime_get_ns();
+    e.ifindex = skb->ifindex;
+    e.verdict = action;
+    if (bpf_ringbuf_output(&tc_events, &e, sizeof(e), 0))
+        count(PKT_COUNT_RING_FULL, 1);
+    return action;
+
+parse_error:
+    count(PKT_COUNT_PARSE_ERRORS, 1);
+    return TC_ACT_OK;
+}
+
+char LICENSE[] SEC("license") = "Dual BSD/GPL";
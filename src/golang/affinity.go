@@ -0,0 +1,320 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// AffinityStats records where a benchmark's threads were pinned and how
+// often the consumer was still seen to change CPUs
+type AffinityStats struct {
+	ConsumerCPUs  []int // CPUs the consumer threads were pinned to
+	GeneratorCPUs []int // CPUs the load generator threads were pinned to, if pinned
+	NUMANode      *int  // Node the CPUs were taken from, if selected
+	CPUsSeen      []int // CPUs the consumer threads were observed on
+	Migrations    int64 // CPU changes observed between samples of a consumer thread
+	Samples       int64 // Times the consumer threads' CPU was sampled
+	PinErrors     int64 // Threads that could not be pinned
+}
+
+// affinitySampleEvery is how many events a per-event consumer loop handles
+// between samples of its CPU; tick-driven loops sample every tick
+const affinitySampleEvery = 4096
+
+// affinityFlagSet holds the -cpu-affinity, -numa-node and, for benchmarks
+// with a load generator thread, -generator-affinity flags
+type affinityFlagSet struct {
+	cpus      *string
+	numaNode  *int
+	generator *string // nil when the generator shares the consumer's thread
+}
+
+// addAffinityFlags registers -cpu-affinity and -numa-node, and
+// -generator-affinity when the benchmark has a load generator thread
+func addAffinityFlags(fs *flag.FlagSet, generator bool) *affinityFlagSet {
+	f := &affinityFlagSet{
+		cpus:     fs.String("cpu-affinity", "", "Pin the consumer threads to these CPUs (e.g. 2-3) with sched_setaffinity; empty leaves them to the scheduler"),
+		numaNode: fs.Int("numa-node", -1, "Pin to this NUMA node's CPUs, isolated ones first and CPU 0 avoided, or check -cpu-affinity is on it (-1 for any)"),
+	}
+	if generator {
+		f.generator = fs.String("generator-affinity", "", "Pin the load generator threads to these CPUs; empty leaves them, or with -numa-node keeps them on the node")
+	}
+	return f
+}
+
+// pinning validates the flags and returns the CPUs to pin to, or nil when
+// nothing is pinned
+func (f *affinityFlagSet) pinning() (*cpuPinning, error) {
+	generator := ""
+	if f.generator != nil {
+		generator = *f.generator
+	}
+	if *f.cpus == "" && *f.numaNode < 0 && generator == "" {
+		return nil, nil
+	}
+	allowed := readAllowedCPUs()
+	p := &cpuPinning{allowed: allowed}
+	check := func(flagName string, cpus []int) error {
+		if len(allowed) == 0 {
+			return nil // Unknown; sched_setaffinity will tell
+		}
+		set := make(map[int]bool, len(allowed))
+		for _, cpu := range allowed {
+			set[cpu] = true
+		}
+		for _, cpu := range cpus {
+			if !set[cpu] {
+				return fmt.Errorf("-%s: CPU %d is not one this process may run on (%s)", flagName, cpu, FormatCPUList(allowed))
+			}
+		}
+		return nil
+	}
+	var err error
+	if *f.cpus != "" {
+		if p.consumer, err = ParseCPUList(*f.cpus); err != nil {
+			return nil, fmt.Errorf("invalid -cpu-affinity: %w", err)
+		}
+	}
+	if generator != "" {
+		if p.generator, err = ParseCPUList(generator); err != nil {
+			return nil, fmt.Errorf("invalid -generator-affinity: %w", err)
+		}
+	}
+	if node := *f.numaNode; node >= 0 {
+		nodeCPUs, err := readCPUListFile(fmt.Sprintf("/sys/devices/system/node/node%d/cpulist", node))
+		if err != nil || len(nodeCPUs) == 0 {
+			return nil, fmt.Errorf("-numa-node %d: no such node with CPUs", node)
+		}
+		p.node = &node
+		if len(p.consumer) == 0 {
+			// Pick among the node's CPUs as doctor suggests pinning
+			// targets: isolated ones first, CPU 0 last
+			host := CollectHostInfo()
+			host.OnlineCPUs, host.AllowedCPUs = nodeCPUs, onNodeOnly(host.AllowedCPUs, nodeCPUs)
+			p.consumer = SelectPinningCPUs(host, len(nodeCPUs))
+		}
+		if p.consumer, err = onNode("cpu-affinity", p.consumer, nodeCPUs, node); err != nil {
+			return nil, err
+		}
+		if f.generator != nil {
+			if p.generator, err = onNode("generator-affinity", p.generator, nodeCPUs, node); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := check("cpu-affinity", p.consumer); err != nil {
+		return nil, err
+	}
+	if err := check("generator-affinity", p.generator); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// onNode returns cpus, which must all be on the node, or the node's CPUs
+// when cpus is empty
+func onNode(flagName string, cpus, nodeCPUs []int, node int) ([]int, error) {
+	if len(cpus) == 0 {
+		return nodeCPUs, nil
+	}
+	set := make(map[int]bool, len(nodeCPUs))
+	for _, cpu := range nodeCPUs {
+		set[cpu] = true
+	}
+	for _, cpu := range cpus {
+		if !set[cpu] {
+			return nil, fmt.Errorf("-%s: CPU %d is not on NUMA node %d (%s)", flagName, cpu, node, FormatCPUList(nodeCPUs))
+		}
+	}
+	return cpus, nil
+}
+
+// onNodeOnly returns those of cpus on the node
+func onNodeOnly(cpus, nodeCPUs []int) []int {
+	set := make(map[int]bool, len(nodeCPUs))
+	for _, cpu := range nodeCPUs {
+		set[cpu] = true
+	}
+	var out []int
+	for _, cpu := range cpus {
+		if set[cpu] {
+			out = append(out, cpu)
+		}
+	}
+	return out
+}
+
+// cpuPinning pins the consumer and load generator threads of a run, and
+// counts what it observes once started with newRun. A nil pinning pins
+// nothing.
+type cpuPinning struct {
+	consumer  []int // Empty leaves consumers unpinned
+	generator []int // Empty leaves the generator unpinned
+	node      *int
+	allowed   []int // Restored when a thread is released
+
+	mu         sync.Mutex
+	lastCPU    map[*pinnedThread]int
+	seen       map[int]bool
+	migrations int64
+	samples    int64
+	pinErrors  int64
+}
+
+// newRun returns a pinning to the same CPUs with fresh counters, for one
+// run of a benchmark
+func (p *cpuPinning) newRun() *cpuPinning {
+	if p == nil {
+		return nil
+	}
+	return &cpuPinning{
+		consumer:  p.consumer,
+		generator: p.generator,
+		node:      p.node,
+		allowed:   p.allowed,
+		lastCPU:   make(map[*pinnedThread]int),
+		seen:      make(map[int]bool),
+	}
+}
+
+// pinnedThread is one thread pinned by a cpuPinning
+type pinnedThread struct {
+	p      *cpuPinning
+	pinned bool
+}
+
+// pinConsumer pins the calling thread to the consumer CPUs and returns it
+// for sampling. The caller must hold runtime.LockOSThread until it calls
+// release.
+func (p *cpuPinning) pinConsumer() *pinnedThread {
+	if p == nil {
+		return nil
+	}
+	return p.pin(p.consumer, true)
+}
+
+// pinGenerator pins the calling thread to the generator CPUs. The caller
+// must hold runtime.LockOSThread until it calls release.
+func (p *cpuPinning) pinGenerator() *pinnedThread {
+	if p == nil {
+		return nil
+	}
+	return p.pin(p.generator, false)
+}
+
+func (p *cpuPinning) pin(cpus []int, consumer bool) *pinnedThread {
+	t := &pinnedThread{p: p}
+	if len(cpus) > 0 {
+		if err := setThreadAffinity(cpus); err != nil {
+			p.mu.Lock()
+			p.pinErrors++
+			p.mu.Unlock()
+		} else {
+			t.pinned = true
+		}
+	}
+	if consumer {
+		p.mu.Lock()
+		p.lastCPU[t] = -1
+		p.mu.Unlock()
+		t.observe()
+	}
+	return t
+}
+
+// observe samples the CPU a consumer thread runs on, counting a migration
+// when it changed since the last sample
+func (t *pinnedThread) observe() {
+	if t == nil {
+		return
+	}
+	cpu, ok := currentCPU()
+	if !ok {
+		return
+	}
+	p := t.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	last, consumer := p.lastCPU[t]
+	if !consumer {
+		return
+	}
+	if last >= 0 && last != cpu {
+		p.migrations++
+	}
+	p.lastCPU[t] = cpu
+	p.seen[cpu] = true
+	p.samples++
+}
+
+// release restores the thread's affinity to every allowed CPU, so the
+// runtime can reuse it once unlocked
+func (t *pinnedThread) release() {
+	if t == nil || !t.pinned || len(t.p.allowed) == 0 {
+		return
+	}
+	setThreadAffinity(t.p.allowed)
+}
+
+// stats returns the pinning and what was observed, or nil when nothing
+// was pinned
+func (p *cpuPinning) stats() *AffinityStats {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := &AffinityStats{
+		ConsumerCPUs:  p.consumer,
+		GeneratorCPUs: p.generator,
+		NUMANode:      p.node,
+		Migrations:    p.migrations,
+		Samples:       p.samples,
+		PinErrors:     p.pinErrors,
+	}
+	for cpu := range p.seen {
+		s.CPUsSeen = append(s.CPUsSeen, cpu)
+	}
+	sort.Ints(s.CPUsSeen)
+	return s
+}
+
+// currentCPU returns the CPU the calling thread runs on
+func currentCPU() (int, bool) {
+	nr := sysGetcpu // A variable, so -1 still compiles
+	if nr < 0 {
+		return 0, false
+	}
+	var cpu uint32
+	_, _, errno := syscall.RawSyscall(uintptr(nr), uintptr(unsafe.Pointer(&cpu)), 0, 0)
+	return int(cpu), errno == 0
+}
+
+// formatAffinity renders the CPU pinning, if any
+func (r *BenchmarkResult) formatAffinity() string {
+	a := r.Affinity
+	if a == nil {
+		return ""
+	}
+	var parts []string
+	if len(a.ConsumerCPUs) > 0 {
+		parts = append(parts, "consumer on "+FormatCPUList(a.ConsumerCPUs))
+	}
+	if len(a.GeneratorCPUs) > 0 {
+		parts = append(parts, "generator on "+FormatCPUList(a.GeneratorCPUs))
+	}
+	if a.NUMANode != nil {
+		parts = append(parts, fmt.Sprintf("NUMA node %d", *a.NUMANode))
+	}
+	s := fmt.Sprintf("Affinity:        %s; %d migrations over %d samples, seen on %s\n",
+		strings.Join(parts, ", "), a.Migrations, a.Samples, orNone(FormatCPUList(a.CPUsSeen)))
+	if a.PinErrors > 0 {
+		s += fmt.Sprintf("                 %d thread(s) could not be pinned\n", a.PinErrors)
+	}
+	return s
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AggregateStats summarises one metric across iterations
+type AggregateStats struct {
+	Mean   float64
+	Median float64
+	StdDev float64 // Sample standard deviation
+	CV     float64 // StdDev over Mean, in percent
+	Min    float64
+	Max    float64
+}
+
+// newAggregateStats summarises values, which must not be empty
+func newAggregateStats(values []float64) AggregateStats {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	s := AggregateStats{
+		Mean: meanOf(sorted),
+		Min:  sorted[0],
+		Max:  sorted[len(sorted)-1],
+	}
+	if n := len(sorted); n%2 == 1 {
+		s.Median = sorted[n/2]
+	} else {
+		s.Median = (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+	if len(sorted) > 1 {
+		var ss float64
+		for _, v := range sorted {
+			ss += (v - s.Mean) * (v - s.Mean)
+		}
+		s.StdDev = math.Sqrt(ss / float64(len(sorted)-1))
+	}
+	if s.Mean != 0 {
+		s.CV = s.StdDev / math.Abs(s.Mean) * 100
+	}
+	return s
+}
+
+// AggregateResult summarises the iterations of one benchmark configuration
+type AggregateResult struct {
+	Benchmark     string
+	Name          string // resultKey of the iterations
+	Iterations    int
+	Throughput    AggregateStats
+	LatencyP50Ns  *AggregateStats // nil when the iterations computed no percentiles
+	LatencyP99Ns  *AggregateStats
+	CPUPerEventUs AggregateStats
+	DropRate      AggregateStats
+	EventTypes    map[string]AggregateStats // Throughput per event type, when types shared the buffer
+}
+
+// eventTypeThroughput summarises the throughput of each event type across
+// the runs that broke their events down by type. A type missing from one
+// of those runs delivered nothing in it, so counts as zero.
+func eventTypeThroughput(runs []*BenchmarkResult) map[string]AggregateStats {
+	var broken []map[string]float64
+	names := make(map[string]bool)
+	for _, r := range runs {
+		if len(r.EventTypes) == 0 {
+			continue
+		}
+		byName := make(map[string]float64, len(r.EventTypes))
+		for _, t := range r.EventTypes {
+			byName[t.Name] = t.Throughput
+			names[t.Name] = true
+		}
+		broken = append(broken, byName)
+	}
+	if len(broken) == 0 {
+		return nil
+	}
+	stats := make(map[string]AggregateStats, len(names))
+	for name := range names {
+		values := make([]float64, len(broken))
+		for i, byName := range broken {
+			values[i] = byName[name]
+		}
+		stats[name] = newAggregateStats(values)
+	}
+	return stats
+}
+
+// aggregateResults groups results by benchmark configuration and
+// summarises each group that has more than one iteration
+func aggregateResults(results []*BenchmarkResult) []AggregateResult {
+	keys, groups := groupResults(results)
+	var out []AggregateResult
+	for _, k := range keys {
+		runs := groups[k]
+		if len(runs) < 2 {
+			continue
+		}
+		metric := func(value func(r *BenchmarkResult) (float64, bool)) *AggregateStats {
+			var values []float64
+			for _, r := range runs {
+				if v, ok := value(r); ok {
+					values = append(values, v)
+				}
+			}
+			if len(values) == 0 {
+				return nil
+			}
+			s := newAggregateStats(values)
+			return &s
+		}
+		always := func(value func(r *BenchmarkResult) float64) AggregateStats {
+			return *metric(func(r *BenchmarkResult) (float64, bool) { return value(r), true })
+		}
+		out = append(out, AggregateResult{
+			Benchmark:     runs[0].Benchmark,
+			Name:          k,
+			Iterations:    len(runs),
+			Throughput:    always(func(r *BenchmarkResult) float64 { return r.Throughput }),
+			LatencyP50Ns:  metric(latencyPercentile(0.5)),
+			LatencyP99Ns:  metric(latencyPercentile(0.99)),
+			CPUPerEventUs: always(func(r *BenchmarkResult) float64 { return r.CPUBudget.CPUPerEventUs }),
+			DropRate:      always(func(r *BenchmarkResult) float64 { return r.DropRate }),
+			EventTypes:    eventTypeThroughput(runs),
+		})
+	}
+	return out
+}
+
+// runIterations runs a benchmark as many times as its -iterations flag
+// asks, numbering the results of each run. An interrupt ends the loop
+// with the iterations completed so far. Its logger, benchLog(ctx), tags
+// each record with name, and each result gets its BenchmarkIdentity.
+func runIterations(ctx context.Context, name string, run benchmarkFunc, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	ctx = withBenchmark(ctx, name)
+	identify := func(results []*BenchmarkResult, params map[string]string) {
+		for _, r := range results {
+			r.Benchmark = name
+			r.Identity = newBenchmarkIdentity(r, params)
+		}
+	}
+	timed := func() ([]*BenchmarkResult, benchOptions, error) {
+		ctx, clock := withPhaseClock(ctx)
+		gc := startGCMonitor()
+		results, opts, err := run(ctx, args)
+		clock.record(results, time.Now())
+		gc.finish()
+		gc.record(results)
+		recordPerfCounters(results)
+		recordGoTrace(name, results)
+		recordProfiles(name, results)
+		recordSnapshots(name, results)
+		return results, opts, err
+	}
+	results, opts, err := timed()
+	identify(results, opts.Params)
+	if err != nil || opts.Iterations <= 1 {
+		return results, opts, err
+	}
+	for _, r := range results {
+		r.Iteration = 1
+	}
+	for i := 2; i <= opts.Iterations && ctx.Err() == nil; i++ {
+		benchLog(ctx).Info("Starting iteration", "iteration", i, "of", opts.Iterations)
+		more, _, err := timed()
+		if err != nil {
+			return nil, opts, fmt.Errorf("iteration %d: %w", i, err)
+		}
+		identify(more, opts.Params)
+		for _, r := range more {
+			r.Iteration = i
+		}
+		results = append(results, more...)
+	}
+	return results, opts, nil
+}
+
+// aggregatePath is where the aggregates of results saved to output go
+func aggregatePath(output string) string {
+	return strings.TrimSuffix(output, filepath.Ext(output)) + "_aggregate.json"
+}
+
+// emitAggregates prints and saves the aggregates of results, if any
+// configuration ran more than once
+func emitAggregates(results []*BenchmarkResult, opts benchOptions) {
+	aggs := aggregateResults(results)
+	if len(aggs) == 0 {
+		return
+	}
+	printAggregateTable(aggs, opts.LatencyUnit)
+	data, err := json.MarshalIndent(aggs, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(aggregatePath(opts.Output), data)
+	}
+	if err != nil {
+		slog.Warn("Failed to save aggregates", "output", aggregatePath(opts.Output), "err", err)
+	} else {
+		slog.Info("Aggregates saved", "output", aggregatePath(opts.Output))
+	}
+}
+
+// printAggregateTable prints one line per aggregated configuration
+func printAggregateTable(aggs []AggregateResult, unit LatencyUnit) {
+	latency := func(s *AggregateStats) string {
+		if s == nil {
+			return "-"
+		}
+		return unit.Format(s.Median)
+	}
+	fmt.Printf("%-48s %5s %14s %14s %8s %12s %12s %10s\n",
+		"Benchmark", "Runs", "Thru mean", "Thru median", "Thru CV", "p50 median", "p99 median", "CPU/Event")
+	for _, a := range aggs {
+		fmt.Printf("%-48s %5d %14.0f %14.0f %7.2f%% %12s %12s %8.3fµs\n",
+			a.Name, a.Iterations, a.Throughput.Mean, a.Throughput.Median, a.Throughput.CV,
+			latency(a.LatencyP50Ns), latency(a.LatencyP99Ns), a.CPUPerEventUs.Median)
+		names := make([]string, 0, len(a.EventTypes))
+		for name := range a.EventTypes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			t := a.EventTypes[name]
+			fmt.Printf("  %-46s %5s %14.0f %14.0f %7.2f%%\n", name, "", t.Mean, t.Median, t.CV)
+		}
+	}
+	PrintSeparator()
+}
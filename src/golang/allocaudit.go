@@ -0,0 +1,331 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// allocPath is a per-event consumer path checked by alloc-audit. setup
+// builds its state outside the measurement; run consumes one batch and
+// returns the events it handled.
+type allocPath struct {
+	name        string
+	description string
+	setup       func(events int) (run func(batch []Event) int, done func())
+}
+
+// auditBatch is the number of events handed to a path at a time
+const auditBatch = 256
+
+var allocPaths = []allocPath{
+	{"buffer", "EventBuffer.Add into a preallocated buffer", func(events int) (func([]Event) int, func()) {
+		eb := NewEventBuffer(events)
+		eb.Start()
+		return addAll(eb), nil
+	}},
+	{"buffer-drop-old", "EventBuffer.Add overwriting the oldest events", func(int) (func([]Event) int, func()) {
+		eb := NewEventBuffer(4096)
+		eb.SetDropPolicy(DropOldest, time.Second)
+		eb.Start()
+		return addAll(eb), nil
+	}},
+	{"streaming", "EventBuffer.Add computing statistics online", func(int) (func([]Event) int, func()) {
+		eb := NewStreamingEventBuffer()
+		eb.Start()
+		return addAll(eb), nil
+	}},
+	{"sampling", "EventBuffer.Add with a reservoir sample", func(events int) (func([]Event) int, func()) {
+		eb := NewEventBuffer(events)
+		eb.SetSampling(1000, 1)
+		eb.Start()
+		return addAll(eb), nil
+	}},
+	{"codec-fixed", "Fixed-layout ring records, encoded and decoded", func(events int) (func([]Event) int, func()) {
+		return codecPath(rawFraming{}, events), nil
+	}},
+	{"codec-tlv", "TLV ring records, encoded and decoded", func(events int) (func([]Event) int, func()) {
+		return codecPath(tlvFraming{}, events), nil
+	}},
+	{"archive", "Delta-encoded gzip archive of delivered events", func(int) (func([]Event) int, func()) {
+		a, err := createEventArchive(os.DevNull, 1, artifactPolicy{fsync: fsyncNever})
+		if err != nil {
+			return func([]Event) int { return 0 }, nil
+		}
+		return func(batch []Event) int {
+			a.write(batch)
+			return len(batch)
+		}, func() { a.Close() }
+	}},
+	{"ringbuf", "The ringbuf benchmark's simulated consumer tick", func(events int) (func([]Event) int, func()) {
+		b := NewRingBufferBenchmark(time.Second, false)
+		b.eventBuffer = NewEventBuffer(events)
+		b.eventBuffer.Start()
+		return func([]Event) int {
+			added := 0
+			for _, e := range b.produce(nil, true) {
+				if b.deliver(e) {
+					added++
+				}
+			}
+			b.flushArchive()
+			return added
+		}, nil
+	}},
+}
+
+func addAll(eb *EventBuffer) func([]Event) int {
+	return func(batch []Event) int {
+		for _, e := range batch {
+			eb.Add(e)
+		}
+		return len(batch)
+	}
+}
+
+func codecPath(framing eventFraming, events int) func([]Event) int {
+	c := newRecordCodec(framing)
+	eb := NewEventBuffer(events)
+	eb.Start()
+	deliver := func(e Event) { eb.Add(e) }
+	return func(batch []Event) int {
+		c.roundTrip(batch, true, deliver)
+		return len(batch)
+	}
+}
+
+// AllocSite is a place in this program that allocated during an audit
+type AllocSite struct {
+	Function string // First frame outside the runtime
+	Location string // Its file:line
+	Via      string // Runtime entry point, e.g. runtime.growslice
+	Objects  int64
+	Bytes    int64
+}
+
+// AllocAudit is the allocation count of one path over an audit
+type AllocAudit struct {
+	Path           string
+	Events         int64
+	Allocs         int64 // Heap objects allocated over Events
+	AllocsPerEvent float64
+	BytesPerEvent  float64
+	Sites          []AllocSite
+	Pass           bool
+}
+
+// memProfile returns the allocation profile by stack. The runtime
+// publishes allocations up to two GC cycles late, so it runs two first.
+func memProfile() map[[32]uintptr]runtime.MemProfileRecord {
+	runtime.GC()
+	runtime.GC()
+	var records []runtime.MemProfileRecord
+	n, _ := runtime.MemProfile(nil, true)
+	for {
+		records = make([]runtime.MemProfileRecord, n+50)
+		var ok bool
+		if n, ok = runtime.MemProfile(records, true); ok {
+			break
+		}
+	}
+	profile := make(map[[32]uintptr]runtime.MemProfileRecord, n)
+	for _, r := range records[:n] {
+		profile[r.Stack0] = r
+	}
+	return profile
+}
+
+// allocSites returns the stacks that allocated between two profiles,
+// most objects first, attributed to the first frame outside the runtime
+func allocSites(before, after map[[32]uintptr]runtime.MemProfileRecord) []AllocSite {
+	bySite := make(map[string]*AllocSite)
+	for stack, r := range after {
+		objects := r.AllocObjects - before[stack].AllocObjects
+		if objects <= 0 {
+			continue
+		}
+		var site AllocSite
+		frames := runtime.CallersFrames(r.Stack())
+		for {
+			f, more := frames.Next()
+			if f.Function == "main.memProfile" {
+				site.Function = "" // The audit's own bookkeeping
+				break
+			}
+			if strings.HasPrefix(f.Function, "runtime.") || strings.HasPrefix(f.Function, "internal/runtime/") {
+				site.Via = f.Function
+			} else if f.Function != "" {
+				site.Function = strings.TrimPrefix(f.Function, "main.")
+				site.Location = fmt.Sprintf("%s:%d", shortPath(f.File), f.Line)
+				break
+			}
+			if !more {
+				break
+			}
+		}
+		if site.Function == "" {
+			continue
+		}
+		key := site.Function + " " + site.Location
+		if s, ok := bySite[key]; ok {
+			site = *s
+		}
+		site.Objects += objects
+		site.Bytes += r.AllocBytes - before[stack].AllocBytes
+		bySite[key] = &site
+	}
+	sites := make([]AllocSite, 0, len(bySite))
+	for _, s := range bySite {
+		sites = append(sites, *s)
+	}
+	sort.Slice(sites, func(i, j int) bool { return sites[i].Objects > sites[j].Objects })
+	return sites
+}
+
+// shortPath keeps the last directory and file name of path
+func shortPath(path string) string {
+	parts := strings.Split(path, "/")
+	if len(parts) > 2 {
+		parts = parts[len(parts)-2:]
+	}
+	return strings.Join(parts, "/")
+}
+
+// auditPath runs p for warmup events, which may allocate while its state
+// grows, then counts the allocations of the next events
+func auditPath(p allocPath, warmup, events int, pool []Event) AllocAudit {
+	run, done := p.setup(warmup + events)
+	if done != nil {
+		defer done()
+	}
+	batch := make([]Event, auditBatch)
+	next := 0
+	feed := func(target int) int64 {
+		var handled int64
+		for handled < int64(target) {
+			now := nowNs()
+			for i := range batch {
+				batch[i] = pool[next]
+				batch[i].Timestamp = now
+				next = (next + 1) % len(pool)
+			}
+			n := run(batch)
+			if n == 0 {
+				break
+			}
+			handled += int64(n)
+		}
+		return handled
+	}
+	feed(warmup)
+
+	before := memProfile()
+	handled := feed(events)
+	after := memProfile()
+
+	a := AllocAudit{Path: p.name, Events: handled, Sites: allocSites(before, after)}
+	var bytes int64
+	for _, s := range a.Sites {
+		a.Allocs += s.Objects
+		bytes += s.Bytes
+	}
+	if handled > 0 {
+		a.AllocsPerEvent = float64(a.Allocs) / float64(handled)
+		a.BytesPerEvent = float64(bytes) / float64(handled)
+	}
+	return a
+}
+
+// runAllocAudit checks that the per-event consumer paths do not allocate
+// once warmed up, and fails listing the allocation sites if one does
+func runAllocAudit(args []string) error {
+	fs := flag.NewFlagSet("alloc-audit", flag.ExitOnError)
+	var names []string
+	for _, p := range allocPaths {
+		names = append(names, p.name)
+	}
+	pathsFlag := fs.String("paths", strings.Join(names, ","), "Comma-separated hot paths to audit")
+	events := fs.Int("events", 1000000, "Events to count allocations over, per path")
+	warmup := fs.Int("warmup-events", 200000, "Events run first, while buffers and maps reach their steady size")
+	maxAllocs := fs.Float64("max-allocs", 0, "Allocations per event allowed before a path fails")
+	maxSites := fs.Int("sites", 5, "Allocation sites listed per failing path")
+	list := fs.Bool("list", false, "List the hot paths and exit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *list {
+		for _, p := range allocPaths {
+			fmt.Printf("  %-16s %s\n", p.name, p.description)
+		}
+		return nil
+	}
+	if *events <= 0 || *warmup < 0 {
+		return fmt.Errorf("-events must be positive and -warmup-events not negative")
+	}
+	var selected []allocPath
+	for _, name := range splitList(*pathsFlag) {
+		found := false
+		for _, p := range allocPaths {
+			if p.name == name {
+				selected = append(selected, p)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown path %q (see -list)", name)
+		}
+	}
+
+	// Profile every allocation from here on. This is exact where the
+	// runtime/metrics heap counters, updated per span, are not.
+	defer func(rate int) { runtime.MemProfileRate = rate }(runtime.MemProfileRate)
+	runtime.MemProfileRate = 1
+	mix, err := parseEventMix("tracepoint:3,kprobe:1")
+	if err != nil {
+		return err
+	}
+	payload, err := NewPayloadGenerator("syscall", 1)
+	if err != nil {
+		return err
+	}
+	pool := newReencodeEvents(4096, payload, mix)
+
+	PrintBenchmarkHeader("Hot Path Allocation Audit")
+	fmt.Printf("%d events per path after %d warm-up events, %s\n\n", *events, *warmup, runtime.Version())
+	var failed []string
+	for _, p := range selected {
+		a := auditPath(p, *warmup, *events, pool)
+		a.Pass = a.Events > 0 && a.AllocsPerEvent <= *maxAllocs
+		mark := "✓"
+		if !a.Pass {
+			mark = "✗"
+			failed = append(failed, a.Path)
+		}
+		fmt.Printf("%s %-16s %9d allocs %10.4f/event %10.1f B/event\n", mark, a.Path, a.Allocs, a.AllocsPerEvent, a.BytesPerEvent)
+		if a.Pass {
+			continue
+		}
+		if a.Events == 0 {
+			fmt.Println("    handled no events")
+		}
+		for i, s := range a.Sites {
+			if i == *maxSites {
+				fmt.Printf("    ... %d more sites\n", len(a.Sites)-i)
+				break
+			}
+			via := ""
+			if s.Via != "" {
+				via = " via " + s.Via
+			}
+			fmt.Printf("    %8d objects %10d B  %s (%s)%s\n", s.Objects, s.Bytes, s.Function, s.Location, via)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d hot paths allocate: %s", len(failed), len(selected), strings.Join(failed, ", "))
+	}
+	return nil
+}
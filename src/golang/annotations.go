@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultControlSocket is where annotate sends notes unless told otherwise
+const defaultControlSocket = "/tmp/ebpf-bench.sock"
+
+// Annotation is an operator's note on the run timeline, such as a kernel
+// compile started on the host or a governor switch
+type Annotation struct {
+	Time time.Time
+	Note string
+}
+
+// annotationLog holds the notes received by the control server. Results
+// pick up the ones that fall between their start and end when emitted.
+var annotationLog struct {
+	sync.Mutex
+	notes []Annotation
+}
+
+// addAnnotation records a note at t
+func addAnnotation(t time.Time, note string) Annotation {
+	a := Annotation{Time: t, Note: note}
+	annotationLog.Lock()
+	annotationLog.notes = append(annotationLog.notes, a)
+	annotationLog.Unlock()
+	return a
+}
+
+// annotationsBetween returns the notes taken from start to end, in order
+func annotationsBetween(start, end time.Time) []Annotation {
+	annotationLog.Lock()
+	defer annotationLog.Unlock()
+	var notes []Annotation
+	for _, a := range annotationLog.notes {
+		if !a.Time.Before(start) && !a.Time.After(end) {
+			notes = append(notes, a)
+		}
+	}
+	return notes
+}
+
+// formatAnnotations renders the run's notes relative to its start
+func (r *BenchmarkResult) formatAnnotations() string {
+	if len(r.Annotations) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("Annotations:\n")
+	for _, a := range r.Annotations {
+		fmt.Fprintf(&sb, "  +%-10s %s\n", a.Time.Sub(r.StartTime).Round(time.Millisecond), a.Note)
+	}
+	return sb.String()
+}
+
+// controlNetwork returns the network of a -control address: a path is a
+// Unix socket, anything else host:port
+func controlNetwork(addr string) string {
+	if strings.Contains(addr, "/") {
+		return "unix"
+	}
+	return "tcp"
+}
+
+var controlOnce struct {
+	sync.Once
+	err error
+}
+
+// startControlServer accepts annotations on addr in the background. Only
+// the first call starts a listener, so a suite and its benchmarks share
+// one. A socket left behind by a run that is gone is replaced.
+func startControlServer(addr string) error {
+	controlOnce.Do(func() {
+		network := controlNetwork(addr)
+		if network == "unix" {
+			if conn, err := net.Dial(network, addr); err == nil {
+				conn.Close()
+				controlOnce.err = fmt.Errorf("control socket %s is in use by another run", addr)
+				return
+			}
+			os.Remove(addr)
+		}
+		ln, err := net.Listen(network, addr)
+		if err != nil {
+			controlOnce.err = fmt.Errorf("control listener: %w", err)
+			return
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/annotations", serveAnnotations)
+		go http.Serve(ln, mux)
+	})
+	return controlOnce.err
+}
+
+// serveAnnotations records a note POSTed as {"Note": ..., "Time": ...},
+// where Time defaults to now, and lists the notes so far on GET
+func serveAnnotations(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		annotationLog.Lock()
+		notes := append([]Annotation{}, annotationLog.notes...)
+		annotationLog.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(notes)
+	case http.MethodPost:
+		var a Annotation
+		if err := json.NewDecoder(io.LimitReader(req.Body, 64<<10)).Decode(&a); err != nil {
+			http.Error(w, "invalid annotation: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if a.Note = strings.TrimSpace(a.Note); a.Note == "" {
+			http.Error(w, "annotation has no note", http.StatusBadRequest)
+			return
+		}
+		if a.Time.IsZero() {
+			a.Time = time.Now()
+		}
+		a = addAnnotation(a.Time, a.Note)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(a)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// runAnnotate is the entry point of the annotate subcommand. It sends a
+// note to the control server of a running benchmark or suite.
+func runAnnotate(args []string) error {
+	fs := flag.NewFlagSet("annotate", flag.ExitOnError)
+	control := fs.String("control", defaultControlSocket, "Control address of the run: its -control Unix socket or host:port")
+	at := fs.String("time", "", "When the event happened, as an RFC 3339 time (default now)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: annotate [flags] note...\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	note := strings.TrimSpace(strings.Join(fs.Args(), " "))
+	if note == "" {
+		fs.Usage()
+		return fmt.Errorf("no note given")
+	}
+	a := Annotation{Time: time.Now(), Note: note}
+	if *at != "" {
+		t, err := time.Parse(time.RFC3339Nano, *at)
+		if err != nil {
+			return fmt.Errorf("invalid -time: %w", err)
+		}
+		a.Time = t
+	}
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	network, addr := controlNetwork(*control), *control
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}},
+	}
+	resp, err := client.Post("http://ebpf-bench/annotations", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("no run listening on %s: %w", *control, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("annotation rejected: %s", strings.TrimSpace(string(msg)))
+	}
+	fmt.Printf("Annotated %s at %s: %s\n", *control, a.Time.Format(time.RFC3339), note)
+	return nil
+}
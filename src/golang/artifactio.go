@@ -0,0 +1,408 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ArtifactIOStats describe how an artifact file was written: on the
+// consumer's thread, or handed to a writer thread with its own CPU and IO
+// priority, rate limit and fsync policy, and what that cost
+type ArtifactIOStats struct {
+	Thread      bool    // Written by a separate writer thread
+	Nice        int     `json:",omitempty"` // Writer thread niceness
+	IOPriority  string  `json:",omitempty"` // Writer thread ioprio, e.g. idle or best-effort:7
+	RateLimit   int64   `json:",omitempty"` // Bytes per second; 0 is unlimited
+	Fsync       string  // never, close, or the interval between fsyncs
+	Fsyncs      int64   // fsync calls made
+	FsyncNs     float64 // Mean time of an fsync
+	ThrottledNs float64 // Time the rate limit held the writer back
+	QueueStalls int64   // Writes the consumer waited on a full queue for
+	StallNs     float64 // Total time the consumer waited
+	Error       string  `json:",omitempty"` // Priority that could not be set
+}
+
+// Artifact writer settings
+const (
+	artifactChunkSize  = 64 * 1024 // Bytes per queued write
+	artifactQueueDepth = 64        // Queued chunks before the consumer waits
+	fsyncNever         = "never"
+	fsyncClose         = "close"
+	ioprioClassShift   = 13 // IOPRIO_CLASS_SHIFT
+	ioprioWhoProcess   = 1  // IOPRIO_WHO_PROCESS; a thread ID selects the thread
+)
+
+// ioprioClasses are the -artifact-ionice classes, by ioprio class number.
+// Realtime is left out: it would compete with the benchmark, not yield.
+var ioprioClasses = map[string]int{"best-effort": 2, "idle": 3}
+
+// artifactPolicy is how a run writes its artifacts
+type artifactPolicy struct {
+	thread     bool
+	nice       int
+	ioClass    int // 0 leaves the IO priority as inherited
+	ioLevel    int
+	rate       int64
+	fsync      string
+	fsyncEvery time.Duration
+}
+
+// artifactFlagSet are the flags setting the artifactPolicy
+type artifactFlagSet struct {
+	thread *bool
+	nice   *int
+	ionice *string
+	rate   *string
+	fsync  *string
+}
+
+// addArtifactFlags registers the flags of how artifact files are written
+func addArtifactFlags(fs *flag.FlagSet) *artifactFlagSet {
+	return &artifactFlagSet{
+		thread: fs.Bool("artifact-thread", false, "Write artifact files from a separate writer thread instead of the consumer's (implied by the other -artifact flags)"),
+		nice:   fs.Int("artifact-nice", 0, "Niceness of the artifact writer thread (1 to 19)"),
+		ionice: fs.String("artifact-ionice", "", "IO priority of the artifact writer thread: idle, or best-effort:LEVEL (0 highest to 7 lowest)"),
+		rate:   fs.String("artifact-rate", "", "Limit artifact writes to this many bytes per second, e.g. 64MiB (default unlimited)"),
+		fsync:  fs.String("artifact-fsync", fsyncClose, "When artifact files are fsynced: never, close, or every interval such as 1s"),
+	}
+}
+
+// policy validates the flags
+func (f *artifactFlagSet) policy() (artifactPolicy, error) {
+	p := artifactPolicy{thread: *f.thread, nice: *f.nice}
+	if p.nice < 0 || p.nice > 19 {
+		return p, fmt.Errorf("-artifact-nice must be 0 to 19; raising the writer above the consumer defeats it")
+	}
+	if s := *f.ionice; s != "" {
+		class, level, _ := strings.Cut(s, ":")
+		var ok bool
+		if p.ioClass, ok = ioprioClasses[class]; !ok {
+			return p, fmt.Errorf("invalid -artifact-ionice %q (want idle or best-effort:LEVEL)", s)
+		}
+		if level != "" {
+			v, err := strconv.Atoi(level)
+			if err != nil || v < 0 || v > 7 {
+				return p, fmt.Errorf("invalid -artifact-ionice level %q (want 0 to 7)", level)
+			}
+			p.ioLevel = v
+		}
+	}
+	if *f.rate != "" {
+		v, err := parseByteSize(strings.TrimSuffix(*f.rate, "/s"))
+		if err != nil || v == 0 {
+			return p, fmt.Errorf("invalid -artifact-rate %q (e.g. 64MiB)", *f.rate)
+		}
+		p.rate = v
+	}
+	switch s := *f.fsync; s {
+	case fsyncNever, fsyncClose:
+		p.fsync = s
+	default:
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return p, fmt.Errorf("invalid -artifact-fsync %q (want never, close or an interval such as 1s)", s)
+		}
+		p.fsync, p.fsyncEvery = d.String(), d
+	}
+	p.thread = p.thread || p.nice > 0 || p.ioClass > 0 || p.rate > 0
+	return p, nil
+}
+
+// ioPriority renders the IO priority of the policy
+func (p artifactPolicy) ioPriority() string {
+	switch p.ioClass {
+	case ioprioClasses["idle"]:
+		return "idle"
+	case ioprioClasses["best-effort"]:
+		return fmt.Sprintf("best-effort:%d", p.ioLevel)
+	}
+	return ""
+}
+
+// artifactFile writes an artifact under a policy. On the consumer's thread
+// it writes straight through; with a writer thread, writes are copied to
+// a queue that thread drains, and the consumer only waits when the queue
+// is full. Errors of queued writes surface on a later Write or Close.
+type artifactFile struct {
+	file   *os.File
+	policy artifactPolicy
+	stats  ArtifactIOStats
+
+	pending []byte // Chunk being filled for the writer thread
+	queue   chan []byte
+	free    chan []byte // Spent chunks for reuse
+	done    chan struct{}
+
+	mu        sync.Mutex
+	err       error
+	lastSync  time.Time
+	fsyncTime time.Duration
+	throttled time.Duration
+	stalled   time.Duration
+}
+
+// createArtifactFile creates path to be written under policy
+func createArtifactFile(path string, policy artifactPolicy) (*artifactFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &artifactFile{file: f, policy: policy, lastSync: time.Now()}
+	a.stats = ArtifactIOStats{
+		Thread:     policy.thread,
+		Nice:       policy.nice,
+		IOPriority: policy.ioPriority(),
+		RateLimit:  policy.rate,
+		Fsync:      policy.fsync,
+	}
+	if policy.thread {
+		a.queue = make(chan []byte, artifactQueueDepth)
+		a.free = make(chan []byte, artifactQueueDepth+1)
+		a.done = make(chan struct{})
+		ready := make(chan struct{})
+		go a.writer(ready)
+		<-ready
+	}
+	return a, nil
+}
+
+// Write writes p, or adds it to the chunk queued for the writer thread
+// once full
+func (a *artifactFile) Write(p []byte) (int, error) {
+	if err := a.failed(); err != nil {
+		return 0, err
+	}
+	if !a.policy.thread {
+		n, err := a.file.Write(p)
+		if err == nil {
+			err = a.maybeSync()
+		}
+		return n, err
+	}
+	if a.pending == nil {
+		select {
+		case chunk := <-a.free:
+			a.pending = chunk[:0]
+		default:
+			a.pending = make([]byte, 0, artifactChunkSize)
+		}
+	}
+	a.pending = append(a.pending, p...)
+	if len(a.pending) >= artifactChunkSize {
+		a.enqueue()
+	}
+	return len(p), nil
+}
+
+// enqueue hands the pending chunk to the writer thread, waiting if the
+// queue is full
+func (a *artifactFile) enqueue() {
+	chunk := a.pending
+	a.pending = nil
+	select {
+	case a.queue <- chunk:
+	default:
+		start := time.Now()
+		a.queue <- chunk
+		a.mu.Lock()
+		a.stats.QueueStalls++
+		a.stalled += time.Since(start)
+		a.mu.Unlock()
+	}
+}
+
+// WriteAt writes p at off once everything queued before it is written
+func (a *artifactFile) WriteAt(p []byte, off int64) (int, error) {
+	if a.policy.thread {
+		a.drain()
+	}
+	if err := a.failed(); err != nil {
+		return 0, err
+	}
+	return a.file.WriteAt(p, off)
+}
+
+// Close writes what is queued, fsyncs unless the policy is never, and
+// closes the file
+func (a *artifactFile) Close() error {
+	if a.policy.thread {
+		a.drain()
+	}
+	if a.policy.fsync != fsyncNever {
+		a.sync()
+	}
+	err := a.file.Close()
+	if e := a.failed(); e != nil {
+		err = e
+	}
+	return err
+}
+
+// Stats returns the statistics of the writes so far
+func (a *artifactFile) Stats() *ArtifactIOStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.stats
+	if s.Fsyncs > 0 {
+		s.FsyncNs = float64(a.fsyncTime.Nanoseconds()) / float64(s.Fsyncs)
+	}
+	s.ThrottledNs = float64(a.throttled.Nanoseconds())
+	s.StallNs = float64(a.stalled.Nanoseconds())
+	return &s
+}
+
+// drain stops the writer thread once it has written the queue
+func (a *artifactFile) drain() {
+	if a.queue == nil {
+		return
+	}
+	if len(a.pending) > 0 {
+		a.enqueue()
+	}
+	close(a.queue)
+	<-a.done
+	a.queue = nil
+	a.policy.thread = false
+}
+
+// writer is the writer thread: it takes on the policy's priorities and
+// writes queued chunks, paced to the rate limit
+func (a *artifactFile) writer(ready chan<- struct{}) {
+	defer close(a.done)
+	runtime.LockOSThread() // The priorities stay with this thread, which then exits
+	a.setPriorities()
+	close(ready)
+	start := time.Now()
+	var written int64
+	for chunk := range a.queue {
+		if a.policy.rate > 0 {
+			due := start.Add(time.Duration(float64(written) / float64(a.policy.rate) * float64(time.Second)))
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+				a.mu.Lock()
+				a.throttled += wait
+				a.mu.Unlock()
+			}
+		}
+		if a.failed() == nil {
+			_, err := a.file.Write(chunk)
+			if err == nil {
+				err = a.maybeSync()
+			}
+			a.fail(err)
+		}
+		written += int64(len(chunk))
+		select {
+		case a.free <- chunk:
+		default:
+		}
+	}
+}
+
+// setPriorities applies the policy's niceness and IO priority to the
+// calling thread. Failures are noted, not fatal: the artifact is still
+// written, only less politely.
+func (a *artifactFile) setPriorities() {
+	tid := syscall.Gettid()
+	var errs []error
+	if a.policy.nice > 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, a.policy.nice); err != nil {
+			errs = append(errs, fmt.Errorf("setpriority: %w", err))
+		}
+	}
+	if a.policy.ioClass > 0 {
+		prio := a.policy.ioClass<<ioprioClassShift | a.policy.ioLevel
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(prio)); errno != 0 {
+			errs = append(errs, fmt.Errorf("ioprio_set: %w", errno))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		a.mu.Lock()
+		a.stats.Error = err.Error()
+		a.mu.Unlock()
+	}
+}
+
+// maybeSync fsyncs when the policy's interval has passed
+func (a *artifactFile) maybeSync() error {
+	if a.policy.fsyncEvery == 0 || time.Since(a.lastSync) < a.policy.fsyncEvery {
+		return nil
+	}
+	return a.sync()
+}
+
+// sync fsyncs the file and counts it
+func (a *artifactFile) sync() error {
+	start := time.Now()
+	err := a.file.Sync()
+	a.mu.Lock()
+	a.stats.Fsyncs++
+	a.fsyncTime += time.Since(start)
+	a.mu.Unlock()
+	a.lastSync = time.Now()
+	a.fail(err)
+	return err
+}
+
+// fail records the first write error
+func (a *artifactFile) fail(err error) {
+	if err == nil {
+		return
+	}
+	a.mu.Lock()
+	if a.err == nil {
+		a.err = err
+	}
+	a.mu.Unlock()
+}
+
+// failed returns the first write error
+func (a *artifactFile) failed() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+// formatArtifactIO renders how an artifact was written, as a continuation
+// line of its section
+func formatArtifactIO(s *ArtifactIOStats, unit LatencyUnit) string {
+	if s == nil {
+		return ""
+	}
+	var parts []string
+	if s.Thread {
+		w := "writer thread"
+		if s.Nice > 0 {
+			w += fmt.Sprintf(" nice %d", s.Nice)
+		}
+		if s.IOPriority != "" {
+			w += ", ionice " + s.IOPriority
+		}
+		parts = append(parts, w)
+	} else {
+		parts = append(parts, "consumer thread")
+	}
+	if s.RateLimit > 0 {
+		parts = append(parts, fmt.Sprintf("limited to %s/s (held back %s)", formatBytes(uint64(s.RateLimit)), unit.Format(s.ThrottledNs)))
+	}
+	fsync := "fsync " + s.Fsync
+	if s.Fsyncs > 0 {
+		fsync += fmt.Sprintf(" (%d, %s each)", s.Fsyncs, unit.Format(s.FsyncNs))
+	}
+	parts = append(parts, fsync)
+	if s.Thread {
+		parts = append(parts, fmt.Sprintf("%d queue stalls (%s)", s.QueueStalls, unit.Format(s.StallNs)))
+	}
+	if s.Error != "" {
+		parts = append(parts, "priority not set: "+s.Error)
+	}
+	return "                 " + strings.Join(parts, ", ") + "\n"
+}
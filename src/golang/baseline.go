@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// baselineTag marks the stored run that is the official baseline of its
+// benchmark, mechanism and host
+const baselineTag = "baseline"
+
+// baselineKey identifies the runs that share a baseline: the same
+// benchmark configuration and data mechanism on the same host
+func baselineKey(r *BenchmarkResult) string {
+	return r.Benchmark + "|" + resultKey(r) + "|" + r.DataMechanism + "|" + r.Host.Hostname
+}
+
+// isBaseline reports whether a stored run is a promoted baseline
+func isBaseline(run StoredRun) bool {
+	return hasAnyTag(run, []string{baselineTag})
+}
+
+// storedBaselines returns the promoted baseline of each current result,
+// and the keys of the results that have none
+func storedBaselines(store *ResultStore, current []*BenchmarkResult) ([]*BenchmarkResult, []string, error) {
+	runs, err := store.Load()
+	if err != nil {
+		return nil, nil, err
+	}
+	byKey := make(map[string]*BenchmarkResult)
+	for _, run := range runs {
+		if isBaseline(run) {
+			byKey[baselineKey(run.Result)] = run.Result
+		}
+	}
+	var baselines []*BenchmarkResult
+	var missing []string
+	seen := make(map[string]bool)
+	for _, r := range current {
+		k := baselineKey(r)
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		if b := byKey[k]; b != nil {
+			baselines = append(baselines, b)
+		} else {
+			missing = append(missing, resultKey(r))
+		}
+	}
+	return baselines, missing, nil
+}
+
+// runBaseline is the entry point of the baseline subcommand
+func runBaseline(args []string) error {
+	fs := flag.NewFlagSet("baseline", flag.ExitOnError)
+	storePath := fs.String("store", defaultStorePath, "History store holding the runs")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: baseline [flags] promote <run-id>\n       baseline [flags] list\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	store := OpenResultStore(*storePath)
+	switch fs.Arg(0) {
+	case "promote":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			return fmt.Errorf("want a run ID to promote")
+		}
+		return promoteBaseline(store, fs.Arg(1))
+	case "list":
+		return listBaselines(store)
+	default:
+		fs.Usage()
+		return fmt.Errorf("want promote or list")
+	}
+}
+
+// promoteBaseline tags a run as the baseline of its key, untagging the
+// baseline it replaces
+func promoteBaseline(store *ResultStore, id string) error {
+	runs, err := store.Load()
+	if err != nil {
+		return err
+	}
+	target := -1
+	for i, run := range runs {
+		if run.ID == id {
+			target = i
+			break
+		}
+	}
+	if target < 0 {
+		return fmt.Errorf("no run with ID %s in %s", id, store)
+	}
+	if invalidRun(runs[target]) {
+		return fmt.Errorf("run %s is invalid and cannot be a baseline", id)
+	}
+
+	key := baselineKey(runs[target].Result)
+	for i := range runs {
+		if i == target || !isBaseline(runs[i]) || baselineKey(runs[i].Result) != key {
+			continue
+		}
+		runs[i].Tags = removeTag(runs[i].Tags, baselineTag)
+		fmt.Printf("Demoted %s\n", runs[i].ID)
+	}
+	if !isBaseline(runs[target]) {
+		runs[target].Tags = append(runs[target].Tags, baselineTag)
+	}
+	if err := store.Replace(runs, nil); err != nil {
+		return err
+	}
+	r := runs[target].Result
+	fmt.Printf("Promoted %s as baseline of %s (%s) on %s\n", id, resultKey(r), r.DataMechanism, hostLabel(r))
+	return nil
+}
+
+// listBaselines prints the promoted baselines
+func listBaselines(store *ResultStore) error {
+	runs, err := store.Load()
+	if err != nil {
+		return err
+	}
+	PrintSeparator()
+	fmt.Printf("%-16s %-20s %-40s %-14s %s\n", "ID", "Started", "Benchmark", "Mechanism", "Host")
+	for _, run := range runs {
+		if !isBaseline(run) {
+			continue
+		}
+		r := run.Result
+		fmt.Printf("%-16s %-20s %-40s %-14s %s\n", run.ID, formatResultTime(r.StartTime),
+			resultKey(r), r.DataMechanism, hostLabel(r))
+	}
+	PrintSeparator()
+	return nil
+}
+
+// hostLabel names the host of a result for display
+func hostLabel(r *BenchmarkResult) string {
+	if r.Host.Hostname == "" {
+		return "(unknown host)"
+	}
+	return r.Host.Hostname
+}
+
+// removeTag returns tags without tag
+func removeTag(tags []string, tag string) []string {
+	var out []string
+	for _, t := range tags {
+		if t != tag {
+			out = append(out, t)
+		}
+	}
+	return out
+}
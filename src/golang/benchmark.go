@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Benchmark is a benchmark that runs in the background. Start launches it
+// under ctx; cancelling ctx or calling Stop ends it early. Wait blocks
+// until it has finished and returns its result, which after an early stop
+// covers the partial run and carries QualityInterrupted.
+type Benchmark interface {
+	Start(ctx context.Context) error
+	Stop()
+	Wait() (*BenchmarkResult, error)
+}
+
+var errAlreadyStarted = errors.New("benchmark already started")
+
+// benchRunner implements the Start/Stop/Wait lifecycle around a blocking
+// Run(ctx) method, for embedding in benchmark types
+type benchRunner struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// start runs run in a goroutine under a cancellable child of ctx
+func (br *benchRunner) start(ctx context.Context, run func(ctx context.Context) error) error {
+	if br.done != nil {
+		return errAlreadyStarted
+	}
+	ctx, br.cancel = context.WithCancel(ctx)
+	br.done = make(chan struct{})
+	go func() {
+		defer close(br.done)
+		defer br.cancel()
+		br.err = run(ctx)
+	}()
+	return nil
+}
+
+// Stop ends the benchmark early. It is safe to call at any time.
+func (br *benchRunner) Stop() {
+	if br.cancel != nil {
+		br.cancel()
+	}
+}
+
+// wait blocks until run has returned
+func (br *benchRunner) wait() error {
+	if br.done == nil {
+		return errors.New("benchmark not started")
+	}
+	<-br.done
+	return br.err
+}
+
+// signalContext returns a context cancelled by SIGINT or SIGTERM, so an
+// interrupted benchmark still saves its partial results
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// markInterrupted flags r when ctx ended the run early
+func markInterrupted(ctx context.Context, r *BenchmarkResult) {
+	if ctx.Err() != nil {
+		r.Quality.Flag(QualityInterrupted)
+	}
+}
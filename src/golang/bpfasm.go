@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// BPF helpers called by the packet and ring buffer programs, after
+// enum bpf_func_id
+const (
+	bpfFuncKtimeGetNs        = 5
+	bpfFuncGetSmpProcessorID = 8
+	bpfFuncGetCurrentPidTgid = 14
+	bpfFuncGetCurrentUIDGID  = 15
+	bpfFuncRedirect          = 23
+	bpfFuncRingbufOutput     = 130
+	bpfFuncRingbufReserve    = 131
+	bpfFuncRingbufSubmit     = 132
+)
+
+// bpf(2) commands, map and program types and flags of the packet and ring
+// buffer programs
+const (
+	bpfMapGetNextKey      = 4
+	bpfMapTypePercpuArray = 6
+	bpfProgTypeSchedCls   = 3
+	bpfProgTypeXDP        = 6
+	bpfNoExist            = 1  // BPF_NOEXIST: insert only
+	bpfObjNameLen         = 16 // BPF_OBJ_NAME_LEN
+)
+
+// bpfAsm assembles a program whose jumps name their targets, so programs
+// longer than a few instructions need not count offsets by hand. Labels
+// may be used before they are placed.
+type bpfAsm struct {
+	insns  []uint64
+	labels map[string]int
+	jumps  map[int]string // Instruction index to the label it jumps to
+}
+
+func newBPFAsm() *bpfAsm {
+	return &bpfAsm{labels: make(map[string]int), jumps: make(map[int]string)}
+}
+
+// emit appends instructions as they are
+func (a *bpfAsm) emit(insns ...uint64) *bpfAsm {
+	a.insns = append(a.insns, insns...)
+	return a
+}
+
+// label places name at the next instruction
+func (a *bpfAsm) label(name string) *bpfAsm {
+	a.labels[name] = len(a.insns)
+	return a
+}
+
+// jump appends a jump with op to the label target; dst, src and imm are
+// those of the comparison, and op 0x05 is an unconditional ja
+func (a *bpfAsm) jump(op uint8, dst, src uint8, imm int32, target string) *bpfAsm {
+	a.jumps[len(a.insns)] = target
+	return a.emit(bpfInsn(op, dst, src, 0, imm))
+}
+
+// call appends a call of helper
+func (a *bpfAsm) call(helper int32) *bpfAsm {
+	return a.emit(bpfInsn(0x85, 0, 0, 0, helper))
+}
+
+// loadMap appends reg = the map fd, a two-slot ld_imm64
+func (a *bpfAsm) loadMap(reg uint8, fd int) *bpfAsm {
+	return a.emit(bpfInsn(0x18, reg, bpfPseudoMapFD, 0, int32(fd)), 0)
+}
+
+// stackPtr appends reg = fp + off
+func (a *bpfAsm) stackPtr(reg uint8, off int32) *bpfAsm {
+	return a.emit(bpfInsn(0xbf, reg, 10, 0, 0), bpfInsn(0x07, reg, 0, 0, off))
+}
+
+// lookup appends r0 = bpf_map_lookup_elem(map, &u32 key), with the key
+// stored at fp + off; r1 to r5 are clobbered
+func (a *bpfAsm) lookup(fd int, key uint32, off int16) *bpfAsm {
+	a.emit(bpfInsn(0x62, 10, 0, off, int32(key))) // *(u32 *)(fp + off) = key
+	a.loadMap(1, fd)
+	a.stackPtr(2, int32(off))
+	return a.call(bpfFuncMapLookupElem)
+}
+
+// program resolves the jumps. An unplaced label is a bug in the program's
+// assembly, so it panics.
+func (a *bpfAsm) program() []uint64 {
+	p := append([]uint64(nil), a.insns...)
+	for at, target := range a.jumps {
+		to, ok := a.labels[target]
+		if !ok {
+			panic(fmt.Sprintf("bpfAsm: jump to unplaced label %q", target))
+		}
+		off := uint64(uint16(int16(to - at - 1)))
+		p[at] = p[at]&^(0xffff<<16) | off<<16
+	}
+	return p
+}
+
+// createBPFMap creates a map for a program to use, named so that bpftool
+// shows which benchmark it belongs to
+func createBPFMap(name string, mapType, keySize, valueSize, maxEntries, flags uint32) (int, error) {
+	create := struct {
+		mapType, keySize, valueSize, maxEntries, mapFlags, innerMapFD, numaNode uint32
+		mapName                                                                 [bpfObjNameLen]byte
+	}{mapType: mapType, keySize: keySize, valueSize: valueSize, maxEntries: maxEntries, mapFlags: flags}
+	copy(create.mapName[:bpfObjNameLen-1], name)
+	fd, err := bpfSyscall(bpfMapCreate, unsafe.Pointer(&create), unsafe.Sizeof(create))
+	if err != nil {
+		return -1, fmt.Errorf("create %s map: %w", name, err)
+	}
+	return int(fd), nil
+}
+
+// mapElem issues a BPF_MAP_*_ELEM command; value is the next key for
+// BPF_MAP_GET_NEXT_KEY
+func mapElem(cmd int, fd int, key, value unsafe.Pointer, flags uint64) error {
+	attr := elemAttr{mapFD: uint32(fd), key: uint64(uintptr(key)), value: uint64(uintptr(value)), flags: flags}
+	_, err := bpfSyscall(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// setArraySlot stores v in slot of an array map of uint64
+func setArraySlot(fd int, slot uint32, v uint64) error {
+	return mapElem(bpfMapUpdateElem, fd, unsafe.Pointer(&slot), unsafe.Pointer(&v), 0)
+}
+
+// arraySlot reads slot of an array map of uint64
+func arraySlot(fd int, slot uint32) (uint64, error) {
+	var v uint64
+	err := mapElem(bpfMapLookupElem, fd, unsafe.Pointer(&slot), unsafe.Pointer(&v), 0)
+	return v, err
+}
+
+// perCPUSlots reads slots 0 to n-1 of a per-CPU array map of uint64,
+// each one's values by CPU
+func perCPUSlots(fd int, n int) ([][]uint64, error) {
+	cpus := possibleCPUs()
+	out := make([][]uint64, n)
+	for slot := uint32(0); slot < uint32(n); slot++ {
+		values := make([]uint64, cpus)
+		if err := mapElem(bpfMapLookupElem, fd, unsafe.Pointer(&slot), unsafe.Pointer(&values[0]), 0); err != nil {
+			return nil, err
+		}
+		out[slot] = values
+	}
+	return out, nil
+}
+
+// sumPerCPU adds up the CPUs of each slot read by perCPUSlots
+func sumPerCPU(slots [][]uint64) []uint64 {
+	sums := make([]uint64, len(slots))
+	for i, values := range slots {
+		for _, v := range values {
+			sums[i] += v
+		}
+	}
+	return sums
+}
@@ -0,0 +1,705 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// bpf(2) command, attach type and XDP flags of the packet programs
+const (
+	bpfLinkCreate   = 28
+	bpfAttachXDP    = 37 // BPF_XDP
+	xdpFlagsSKBMode = 2  // XDP_FLAGS_SKB_MODE: generic XDP, after the skb is built
+	xdpFlagsDrvMode = 4  // XDP_FLAGS_DRV_MODE: native XDP in the driver
+)
+
+// Slots of the packet programs' per-CPU counters, after xdp_counters and
+// tc_counters. The conntrack slots are used with a flow table only.
+const (
+	pktCountPackets     = iota // Packets parsed
+	pktCountBytes              // Their bytes
+	pktCountParseErrors        // Packets that were not Ethernet/IPv4/UDP
+	pktCountRingFull           // Packet records the ring buffer had no room for
+	pktCountCTLookups          // Flow table lookups
+	pktCountCTHits             // Lookups that found the flow
+	pktCountCTInserts          // New flows inserted
+	pktCountCTFailed           // New flows the table had no room for
+	pktCountSlots
+)
+
+// Slots of the packet programs' config map, after xdp_config and tc_config
+const (
+	pktConfigAction   = 0 // Verdict to return
+	pktConfigRedirect = 1 // TC redirect target ifindex
+	pktConfigSlots    = 2
+)
+
+// pktEventSize is the size of struct pkt_event, the record a packet
+// program emits per packet: the generator's timestamp from the payload,
+// bpf_ktime_get_ns when the program ran, the ifindex and the verdict
+const pktEventSize = 24
+
+// Stack layout of the packet programs
+const (
+	pktRecordOff = -24 // struct pkt_event
+	pktCTKeyOff  = -64 // Flow key, 40 bytes
+	pktCTValOff  = -88 // Flow entry, 24 bytes
+	pktKeyOff    = -92 // u32 key of array lookups
+	pktCTKeySize = 40
+	pktCTValSize = 24
+)
+
+// packetHook describes the context a packet program runs in
+type packetHook struct {
+	name          string
+	progType      uint32
+	attachType    uint32 // expected_attach_type
+	data, dataEnd int16  // Offsets of the packet pointers in the context
+	length        int16  // Offset of skb->len, or -1 to count data_end - data
+	ifindex       int16  // Offset of the receiving ifindex
+	pass          int32  // Verdict on a parse error
+	redirect      int32  // Verdict that takes its target from the config map, or -1
+}
+
+var (
+	// xdpHook is struct xdp_md
+	xdpHook = packetHook{name: "xdp", progType: bpfProgTypeXDP, attachType: bpfAttachXDP,
+		data: 0, dataEnd: 4, length: -1, ifindex: 12, pass: int32(xdpPass), redirect: -1}
+	// tcHook is struct __sk_buff
+	tcHook = packetHook{name: "tc", progType: bpfProgTypeSchedCls,
+		data: 76, dataEnd: 80, length: 0, ifindex: 40, pass: int32(tcActOK), redirect: int32(tcActRedirect)}
+)
+
+// packetMaps are the maps a packet program uses; ct is -1 without a flow
+// table
+type packetMaps struct {
+	counters, config, ring, ct int
+}
+
+// perCPUAdd appends counters[slot] += reg, or += 1 when reg is 0, on a
+// per-CPU array of uint64. r0 to r5 are clobbered.
+func (a *bpfAsm) perCPUAdd(fd int, slot uint32, reg uint8, keyOff int16) *bpfAsm {
+	a.lookup(fd, slot, keyOff)
+	add := bpfInsn(0x07, 1, 0, 0, 1)
+	if reg != 0 {
+		add = bpfInsn(0x0f, 1, reg, 0, 0)
+	}
+	return a.emit(
+		bpfInsn(0x15, 0, 0, 3, 0), // if r0 == 0 skip the add
+		bpfInsn(0x79, 1, 0, 0, 0), // r1 = *(u64 *)(r0 + 0)
+		add,
+		bpfInsn(0x7b, 0, 1, 0, 0)) // *(u64 *)(r0 + 0) = r1
+}
+
+// packetInsns assembles xdp_throughput.c or tc_throughput.c for hook: it
+// parses Ethernet/IPv4/UDP, counts the packet and its bytes per CPU, and
+// returns the configured verdict, or h.pass on a parse error. A parsed
+// packet is reported to the ring buffer as a struct pkt_event and, with a
+// flow table, tracked in it by 5-tuple.
+//
+// r6 holds the context, r7 the verdict, r8 the packet's bytes and r9 its
+// generation timestamp, then the flow entry.
+func packetInsns(h packetHook, m packetMaps) []uint64 {
+	a := newBPFAsm()
+	a.emit(bpfInsn(0xbf, 6, 1, 0, 0)) // r6 = ctx
+	a.lookup(m.config, pktConfigAction, pktKeyOff)
+	a.emit(bpfInsn(0xb7, 7, 0, 0, h.pass))
+	a.jump(0x15, 0, 0, 0, "parse")
+	a.emit(bpfInsn(0x61, 7, 0, 0, 0)) // r7 = configured verdict
+
+	// Every packet access comes before the first helper call, which
+	// clobbers r2 to r5
+	a.label("parse")
+	a.emit(
+		bpfInsn(0x61, 2, 6, h.data, 0),    // r2 = data
+		bpfInsn(0x61, 3, 6, h.dataEnd, 0), // r3 = data_end
+		bpfInsn(0xbf, 4, 2, 0, 0), bpfInsn(0x07, 4, 0, 0, ethHeaderLen))
+	a.jump(0x2d, 4, 3, 0, "parse_error")
+	a.emit(bpfInsn(0x69, 5, 2, 12, 0))        // r5 = eth->h_proto
+	a.jump(0x55, 5, 0, 0x0008, "parse_error") // != htons(ETH_P_IP)
+	a.emit(bpfInsn(0xbf, 4, 2, 0, 0), bpfInsn(0x07, 4, 0, 0, ethHeaderLen+ipv4HeaderLen))
+	a.jump(0x2d, 4, 3, 0, "parse_error")
+	a.emit(bpfInsn(0x71, 5, 2, ethHeaderLen+9, 0)) // r5 = ip->protocol
+	a.jump(0x55, 5, 0, ipProtoUDP, "parse_error")
+	a.emit(
+		bpfInsn(0x71, 5, 2, ethHeaderLen, 0), // r5 = ip->ihl * 4
+		bpfInsn(0x57, 5, 0, 0, 0x0f),
+		bpfInsn(0x67, 5, 0, 0, 2),
+		bpfInsn(0xbf, 4, 2, 0, 0), bpfInsn(0x07, 4, 0, 0, ethHeaderLen),
+		bpfInsn(0x0f, 4, 5, 0, 0), // r4 = udp
+		bpfInsn(0xbf, 5, 4, 0, 0), bpfInsn(0x07, 5, 0, 0, udpHeaderLen))
+	a.jump(0x2d, 5, 3, 0, "parse_error")
+
+	if h.length < 0 {
+		a.emit(bpfInsn(0xbf, 8, 3, 0, 0), bpfInsn(0x1f, 8, 2, 0, 0)) // r8 = data_end - data
+	} else {
+		a.emit(bpfInsn(0x61, 8, 6, h.length, 0)) // r8 = skb->len
+	}
+	a.emit(
+		bpfInsn(0xb7, 9, 0, 0, 0),
+		bpfInsn(0xbf, 5, 4, 0, 0), bpfInsn(0x07, 5, 0, 0, udpHeaderLen+pktTimestampLen))
+	a.jump(0x2d, 5, 3, 0, "stamped")
+	a.emit(bpfInsn(0x79, 9, 4, udpHeaderLen, 0)) // r9 = the generator's timestamp
+	a.label("stamped")
+	a.emit(bpfInsn(0x7b, 10, 9, pktRecordOff, 0)) // e.sent = r9
+
+	if m.ct >= 0 {
+		// The flow key, IPv4 addresses in the first four bytes of each
+		// address, as ctTable keys flows
+		a.emit(bpfInsn(0xb7, 1, 0, 0, 0))
+		for off := int16(0); off < pktCTKeySize; off += 8 {
+			a.emit(bpfInsn(0x7b, 10, 1, pktCTKeyOff+off, 0))
+		}
+		a.emit(
+			bpfInsn(0x61, 1, 2, ethHeaderLen+12, 0), bpfInsn(0x63, 10, 1, pktCTKeyOff, 0), // saddr
+			bpfInsn(0x61, 1, 2, ethHeaderLen+16, 0), bpfInsn(0x63, 10, 1, pktCTKeyOff+16, 0), // daddr
+			bpfInsn(0x69, 1, 4, 0, 0), bpfInsn(0x6b, 10, 1, pktCTKeyOff+32, 0), // source port
+			bpfInsn(0x69, 1, 4, 2, 0), bpfInsn(0x6b, 10, 1, pktCTKeyOff+34, 0), // dest port
+			bpfInsn(0x72, 10, 0, pktCTKeyOff+36, ipProtoUDP))
+	}
+
+	a.perCPUAdd(m.counters, pktCountPackets, 0, pktKeyOff)
+	a.perCPUAdd(m.counters, pktCountBytes, 8, pktKeyOff)
+
+	if m.ct >= 0 {
+		// Update the flow in place, or insert it
+		a.perCPUAdd(m.counters, pktCountCTLookups, 0, pktKeyOff)
+		a.loadMap(1, m.ct).stackPtr(2, pktCTKeyOff).call(bpfFuncMapLookupElem)
+		a.jump(0x15, 0, 0, 0, "ct_insert")
+		a.emit(
+			bpfInsn(0xbf, 9, 0, 0, 0),
+			bpfInsn(0xb7, 1, 0, 0, 1),
+			bpfInsn(0xdb, 9, 1, 0, 0), // lock entry->packets += 1
+			bpfInsn(0xdb, 9, 8, 8, 0)) // lock entry->bytes += r8
+		a.call(bpfFuncKtimeGetNs)
+		a.emit(bpfInsn(0x7b, 9, 0, 16, 0)) // entry->last_seen = now
+		a.perCPUAdd(m.counters, pktCountCTHits, 0, pktKeyOff)
+		a.jump(0x05, 0, 0, 0, "ct_done")
+
+		a.label("ct_insert")
+		a.call(bpfFuncKtimeGetNs)
+		a.emit(
+			bpfInsn(0x7b, 10, 0, pktCTValOff+16, 0),
+			bpfInsn(0xb7, 1, 0, 0, 1),
+			bpfInsn(0x7b, 10, 1, pktCTValOff, 0),
+			bpfInsn(0x7b, 10, 8, pktCTValOff+8, 0))
+		a.loadMap(1, m.ct).stackPtr(2, pktCTKeyOff).stackPtr(3, pktCTValOff)
+		a.emit(bpfInsn(0xb7, 4, 0, 0, bpfNoExist))
+		a.call(bpfFuncMapUpdateElem)
+		a.jump(0x55, 0, 0, 0, "ct_failed")
+		a.perCPUAdd(m.counters, pktCountCTInserts, 0, pktKeyOff)
+		a.jump(0x05, 0, 0, 0, "ct_done")
+		a.label("ct_failed")
+		a.perCPUAdd(m.counters, pktCountCTFailed, 0, pktKeyOff)
+		a.label("ct_done")
+	}
+
+	if h.redirect >= 0 {
+		a.jump(0x55, 7, 0, h.redirect, "emit")
+		a.lookup(m.config, pktConfigRedirect, pktKeyOff)
+		a.emit(bpfInsn(0xb7, 7, 0, 0, h.pass)) // No target configured
+		a.jump(0x15, 0, 0, 0, "emit")
+		a.emit(bpfInsn(0x61, 1, 0, 0, 0))
+		a.jump(0x15, 1, 0, 0, "emit")
+		a.emit(bpfInsn(0xb7, 2, 0, 0, 0))
+		a.call(bpfFuncRedirect)
+		a.emit(bpfInsn(0xbf, 7, 0, 0, 0))
+	}
+
+	a.label("emit")
+	a.call(bpfFuncKtimeGetNs)
+	a.emit(
+		bpfInsn(0x7b, 10, 0, pktRecordOff+8, 0), // e.seen
+		bpfInsn(0x61, 1, 6, h.ifindex, 0),
+		bpfInsn(0x63, 10, 1, pktRecordOff+16, 0), // e.ifindex
+		bpfInsn(0x63, 10, 7, pktRecordOff+20, 0)) // e.verdict
+	a.loadMap(1, m.ring).stackPtr(2, pktRecordOff)
+	a.emit(bpfInsn(0xb7, 3, 0, 0, pktEventSize), bpfInsn(0xb7, 4, 0, 0, 0))
+	a.call(bpfFuncRingbufOutput)
+	a.jump(0x15, 0, 0, 0, "out")
+	a.perCPUAdd(m.counters, pktCountRingFull, 0, pktKeyOff)
+	a.label("out")
+	a.emit(bpfInsn(0xbf, 0, 7, 0, 0), insnExit)
+
+	a.label("parse_error")
+	a.perCPUAdd(m.counters, pktCountParseErrors, 0, pktKeyOff)
+	a.emit(bpfInsn(0xb7, 0, 0, 0, h.pass), insnExit)
+	return a.program()
+}
+
+// pktEvent is a decoded struct pkt_event
+type pktEvent struct {
+	sent, seen       uint64
+	ifindex, verdict uint32
+}
+
+func decodePktEvent(rec []byte) pktEvent {
+	return pktEvent{
+		sent:    binary.LittleEndian.Uint64(rec[0:]),
+		seen:    binary.LittleEndian.Uint64(rec[8:]),
+		ifindex: binary.LittleEndian.Uint32(rec[16:]),
+		verdict: binary.LittleEndian.Uint32(rec[20:]),
+	}
+}
+
+// packetAttach is where one attach point's packets enter and are
+// processed: frames written to send cross the pair to the hook on dev
+type packetAttach struct {
+	name    string // Attach point, as xdpAttachPoints names it
+	dev     int    // ifindex the program runs on
+	send    int    // AF_PACKET socket the generator writes to
+	link    int    // XDP link, or -1
+	sendDev int    // ifindex of the sending end
+}
+
+// bpfPacketPath is a packet program loaded with bpf(2) and attached to
+// real veth pairs. Generators write frames to an AF_PACKET socket on one
+// end; the program runs on the other end's XDP hook, or on a clsact hook,
+// and reports every packet it parses through a ring buffer the consumer
+// reads.
+type bpfPacketPath struct {
+	hook    packetHook
+	veths   []*vethPair
+	points  []packetAttach
+	prog    int
+	maps    packetMaps
+	ring    *bpfRingBuf
+	mode    string // How the program is attached, for ReaderStrategy
+	flowMap string // Flow table type, if any
+}
+
+// packetPathRingSize is the packet records' ring buffer, 256K as the
+// other ring buffer programs use
+const packetPathRingSize = 256 * 1024
+
+// maxBPFFrameSize is the largest frame a veth at its default MTU carries
+const maxBPFFrameSize = 1500 + ethHeaderLen
+
+// bpfPacketOptions configure a packet path
+type bpfPacketOptions struct {
+	points      []string // Attach points, veth%da or veth%db
+	egress      bool     // tc: clsact egress of the attach point instead of ingress
+	verdict     uint32
+	ctMap       string // Flow table map type, or empty
+	ctEntries   int
+	frameSize   int
+	unsupported error // Why the run needs the userspace model, if it does
+}
+
+// openBPFPacketPath creates the veth pairs of the attach points, loads the
+// program for hook and attaches it to every attach point
+func openBPFPacketPath(hook packetHook, o bpfPacketOptions) (p *bpfPacketPath, err error) {
+	if o.unsupported != nil {
+		return nil, o.unsupported
+	}
+	if o.frameSize > maxBPFFrameSize {
+		return nil, fmt.Errorf("-size %d exceeds the %d-byte frames of a veth at its default MTU", o.frameSize, maxBPFFrameSize)
+	}
+	p = &bpfPacketPath{hook: hook, prog: -1, maps: packetMaps{counters: -1, config: -1, ring: -1, ct: -1}}
+	defer func() {
+		if err != nil {
+			p.Close()
+		}
+	}()
+	if p.maps.counters, err = createBPFMap(hook.name+"_counters", bpfMapTypePercpuArray, 4, 8, pktCountSlots, 0); err != nil {
+		return nil, err
+	}
+	if p.maps.config, err = createBPFMap(hook.name+"_config", bpfMapTypeArray, 4, 4, pktConfigSlots, 0); err != nil {
+		return nil, err
+	}
+	if p.ring, err = newBPFRingBuf(hook.name+"_events", packetPathRingSize); err != nil {
+		return nil, err
+	}
+	p.maps.ring = p.ring.fd
+	if o.ctMap != "" {
+		typ := uint32(bpfMapTypeHash)
+		if o.ctMap == mapTypeLRUHash {
+			typ = bpfMapTypeLRUHash
+		}
+		if p.maps.ct, err = createBPFMap("conntrack", typ, pktCTKeySize, pktCTValSize, uint32(o.ctEntries), 0); err != nil {
+			return nil, err
+		}
+		p.flowMap = o.ctMap
+	}
+	verdict := o.verdict
+	if err := mapElem(bpfMapUpdateElem, p.maps.config, unsafe.Pointer(&[]uint32{pktConfigAction}[0]), unsafe.Pointer(&verdict), 0); err != nil {
+		return nil, fmt.Errorf("configure verdict: %w", err)
+	}
+
+	log := make([]byte, 64*1024)
+	insns := packetInsns(hook, p.maps)
+	if p.prog, err = loadInsns(progLoadAttr{progType: hook.progType, expectedAttachType: hook.attachType}, insns, log); err != nil {
+		return nil, fmt.Errorf("%s program: %w: %s", hook.name, err, strings.TrimRight(string(log), "\x00"))
+	}
+
+	// Each attach point's pair is created once, even with both ends attached
+	pairs := make(map[string]*vethPair)
+	for _, name := range o.points {
+		base, end := name[:len(name)-1], name[len(name)-1]
+		v := pairs[base]
+		if v == nil {
+			if v, err = createVethPair(base+"a", base+"b"); err != nil {
+				return nil, err
+			}
+			pairs[base] = v
+			p.veths = append(p.veths, v)
+		}
+		at, peer := v.ifindex[0], v.ifindex[1]
+		if end == 'b' {
+			at, peer = peer, at
+		}
+		pt := packetAttach{name: name, dev: at, sendDev: peer, send: -1, link: -1}
+		if hook.progType == bpfProgTypeXDP {
+			if pt.link, p.mode, err = xdpLinkCreate(p.prog, at); err != nil {
+				return nil, fmt.Errorf("attach to %s: %w", name, err)
+			}
+		} else {
+			p.mode = tcIngress
+			if o.egress {
+				p.mode, pt.sendDev = tcEgress, at
+			}
+			if err := attachClsact(at, o.egress, p.prog, "tc_benchmark"); err != nil {
+				return nil, fmt.Errorf("attach to %s: %w", name, err)
+			}
+			// A redirect leaves through the end the generator does not
+			// write to, so it cannot loop back into the hook
+			target := uint32(at)
+			if o.egress {
+				target = uint32(peer)
+			}
+			if err := mapElem(bpfMapUpdateElem, p.maps.config, unsafe.Pointer(&[]uint32{pktConfigRedirect}[0]), unsafe.Pointer(&target), 0); err != nil {
+				return nil, fmt.Errorf("configure redirect: %w", err)
+			}
+		}
+		if pt.send, err = openPacketSocket(pt.sendDev); err != nil {
+			return nil, err
+		}
+		p.points = append(p.points, pt)
+	}
+	return p, nil
+}
+
+// openPacketBackend selects the packet path of an XDP or TC run: the
+// program attached to real veth pairs, or nil for its userspace model.
+// auto falls back to the model when the program cannot be loaded or
+// attached, or the run's options need the model.
+func openPacketBackend(backend string, hook packetHook, o bpfPacketOptions) (*bpfPacketPath, error) {
+	switch backend {
+	case probeBackendSim:
+		return nil, nil
+	case probeBackendBPF, probeBackendAuto:
+		p, err := openBPFPacketPath(hook, o)
+		if err == nil {
+			return p, nil
+		}
+		if backend == probeBackendBPF {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown backend %q (want auto, bpf or sim)", backend)
+}
+
+// recordBPFPacketCounters adds what only the attached program sees to a
+// packet result: packet records the ring buffer had no room for, and the
+// frames the generators wrote, so packets lost on the veth show
+func recordBPFPacketCounters(r *BenchmarkResult, stats pipelineStats, c bpfPipelineCounters) {
+	drops := r.Drops
+	drops.ReserveFailed = c.ringFull
+	r.RecordDrops(drops)
+	op := OperationResult{Name: "sent", Count: stats.sent, Duration: r.Duration}
+	if r.Duration > 0 {
+		op.Throughput = float64(stats.sent) / r.Duration
+	}
+	r.Operations = append(r.Operations, op)
+}
+
+// xdpLinkCreate attaches an XDP program to ifindex through BPF_LINK_CREATE,
+// natively when the driver supports it and generically otherwise, and
+// returns the link and the mode
+func xdpLinkCreate(prog, ifindex int) (int, string, error) {
+	var err error
+	for _, mode := range []struct {
+		name  string
+		flags uint32
+	}{{"native", xdpFlagsDrvMode}, {"generic", xdpFlagsSKBMode}} {
+		attr := struct {
+			progFD, targetIfindex, attachType, flags uint32
+		}{uint32(prog), uint32(ifindex), bpfAttachXDP, mode.flags}
+		var fd uintptr
+		if fd, err = bpfSyscall(bpfLinkCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err == nil {
+			return int(fd), mode.name, nil
+		}
+	}
+	return -1, "", fmt.Errorf("link create: %w", err)
+}
+
+// openPacketSocket opens an AF_PACKET socket that writes whole frames out
+// of ifindex and receives nothing
+func openPacketSocket(ifindex int) (int, error) {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("packet socket: %w", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Ifindex: ifindex}); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("bind packet socket: %w", err)
+	}
+	return fd, nil
+}
+
+// counters sums the program's per-CPU counters
+func (p *bpfPacketPath) counters() ([]uint64, error) {
+	slots, err := perCPUSlots(p.maps.counters, pktCountSlots)
+	if err != nil {
+		return nil, fmt.Errorf("read counters: %w", err)
+	}
+	return sumPerCPU(slots), nil
+}
+
+// flowTableStats reports the flow table over the whole run, from the
+// program's counters and the entries left in the map. The kernel evicts
+// from a full lru_hash without telling anyone, so evictions are the
+// inserts the entries do not account for.
+func (p *bpfPacketPath) flowTableStats(maxEntries int) (*FlowTableStats, error) {
+	c, err := p.counters()
+	if err != nil {
+		return nil, err
+	}
+	s := &FlowTableStats{
+		MapType:    p.flowMap,
+		MaxEntries: maxEntries,
+		Entries:    p.flowEntries(),
+		Lookups:    int64(c[pktCountCTLookups]),
+		Hits:       int64(c[pktCountCTHits]),
+		Inserts:    int64(c[pktCountCTInserts]),
+		Failed:     int64(c[pktCountCTFailed]),
+	}
+	s.Occupancy = float64(s.Entries) / float64(maxEntries)
+	if p.flowMap == mapTypeLRUHash && s.Inserts > int64(s.Entries) {
+		s.Evictions = s.Inserts - int64(s.Entries)
+	}
+	if s.Lookups > 0 {
+		s.HitRate = float64(s.Hits) / float64(s.Lookups)
+	}
+	return s, nil
+}
+
+// flowEntries counts the flows in the table by walking its keys
+func (p *bpfPacketPath) flowEntries() int {
+	var key, next [pktCTKeySize]byte
+	n := 0
+	for err := mapElem(bpfMapGetNextKey, p.maps.ct, nil, unsafe.Pointer(&next), 0); err == nil; n++ {
+		key = next
+		err = mapElem(bpfMapGetNextKey, p.maps.ct, unsafe.Pointer(&key), unsafe.Pointer(&next), 0)
+	}
+	return n
+}
+
+// Close detaches the program, deletes the veth pairs and releases the maps
+func (p *bpfPacketPath) Close() error {
+	for _, pt := range p.points {
+		if pt.link >= 0 {
+			syscall.Close(pt.link)
+		}
+		if pt.send >= 0 {
+			syscall.Close(pt.send)
+		}
+	}
+	var err error
+	for _, v := range p.veths {
+		if closeErr := v.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if p.ring != nil {
+		p.ring.Close()
+	}
+	for _, fd := range []int{p.prog, p.maps.counters, p.maps.config, p.maps.ct} {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}
+	p.points, p.veths, p.ring, p.prog = nil, nil, nil, -1
+	return err
+}
+
+// bpfPipelineCounters are the program's counters over the measured window
+type bpfPipelineCounters struct {
+	parseErrors, ringFull                  int64
+	ctLookups, ctHits, ctInserts, ctFailed int64
+}
+
+// runBPFPacketPipeline drives generated packets through path, one
+// generator per attach point writing as fast as its socket takes them,
+// for the given duration or until ctx is done. It follows
+// runPacketPipeline otherwise: every packet the program reports in the
+// measured phase is recorded in its attach point's buffer as an Event of
+// eventType, with the latency from generation to the program's run. The
+// phase is read once per drained batch. It returns each attach point's
+// statistics and the program's counters over the measured window.
+func runBPFPacketPipeline(ctx context.Context, phases Phases, coord *coordination, pin *cpuPinning, duration time.Duration,
+	path *bpfPacketPath, gens []*PacketGenerator, maxSamples int, eventType uint32, buffers []*EventBuffer) ([]pipelineStats, bpfPipelineCounters) {
+
+	if pin != nil {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+	consumer := pin.pinConsumer()
+	defer consumer.release()
+
+	n := len(path.points)
+	all := make([]pipelineStats, n)
+	index := make(map[uint32]int, n)
+	for i, pt := range path.points {
+		all[i] = pipelineStats{samples: make([]uint64, 0, 1024), verdicts: make(map[uint32]int64)}
+		index[uint32(pt.dev)] = i
+	}
+	genPhase, phase := coord.markers()
+	if phases.Warmup <= 0 {
+		phase.Store(phaseMeasure)
+	} else {
+		phase.Store(phaseWarmup)
+	}
+
+	stop := make(chan struct{})
+	var generators sync.WaitGroup
+	for i := range path.points {
+		generators.Add(1)
+		go func(i int) {
+			defer generators.Done()
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			defer pin.pinGenerator().release()
+			frame := make([]byte, gens[i].Size())
+			usage := newGeneratorUsage(genPhase.Load())
+			defer func() { all[i].generator = usage.usage(uint64(len(frame))) }()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				usage.observe(genPhase.Load())
+				// A frame a tc egress program drops fails the write with
+				// ENOBUFS, after the program has seen it
+				_, err := syscall.Write(path.points[i].send, gens[i].Next(frame))
+				if (err == nil || err == syscall.ENOBUFS) && usage.seen == phaseMeasure {
+					all[i].sent++
+				}
+			}
+		}(i)
+	}
+
+	var counters bpfPipelineCounters
+	var before []uint64
+	startMeasuring := func(d time.Duration) <-chan time.Time {
+		before, _ = path.counters()
+		start, _ := TakeResourceSnapshot()
+		for i := range all {
+			all[i].start = start
+			buffers[i].Start()
+		}
+		phase.Store(phaseMeasure)
+		return time.After(d)
+	}
+	stopMeasuring := func() {
+		for _, b := range buffers {
+			b.End()
+		}
+		end, _ := TakeResourceSnapshot()
+		for i := range all {
+			all[i].end = end
+		}
+		phase.Store(phaseCooldown)
+		if after, err := path.counters(); err == nil && before != nil {
+			delta := func(slot int) int64 { return int64(after[slot] - before[slot]) }
+			counters = bpfPipelineCounters{
+				parseErrors: delta(pktCountParseErrors),
+				ringFull:    delta(pktCountRingFull),
+				ctLookups:   delta(pktCountCTLookups),
+				ctHits:      delta(pktCountCTHits),
+				ctInserts:   delta(pktCountCTInserts),
+				ctFailed:    delta(pktCountCTFailed),
+			}
+		}
+	}
+	halt := func() {
+		close(stop)
+		generators.Wait()
+	}
+
+	offset := ktimeWallOffset()
+	var deadline <-chan time.Time
+	if phase.Load() == phaseMeasure {
+		deadline = startMeasuring(duration)
+	} else {
+		deadline = time.After(phases.Warmup)
+	}
+	running := true
+	for {
+		if running {
+			select {
+			case <-deadline:
+				switch phase.Load() {
+				case phaseWarmup:
+					deadline = startMeasuring(duration)
+				case phaseMeasure:
+					stopMeasuring()
+					deadline = time.After(phases.Cooldown)
+				case phaseCooldown:
+					running = false
+					halt()
+				}
+			case <-ctx.Done():
+				if phase.Load() == phaseMeasure {
+					stopMeasuring()
+				}
+				for i := range all {
+					all[i].interrupted = true
+				}
+				running = false
+				halt()
+			default:
+			}
+		}
+
+		measuring := running && phase.Load() == phaseMeasure
+		read := path.ring.read(0, func(rec []byte) {
+			e := decodePktEvent(rec)
+			i, ok := index[e.ifindex]
+			if !ok || !measuring || e.sent == 0 {
+				return
+			}
+			s := &all[i]
+			s.received++
+			s.verdicts[e.verdict]++
+			if seen := e.seen + offset; seen >= e.sent {
+				s.latency.Record(seen - e.sent)
+				if len(s.samples) < maxSamples/n {
+					s.samples = append(s.samples, seen-e.sent)
+				}
+			}
+			buffers[i].Add(Event{Timestamp: e.sent, EventType: eventType, Data: e.verdict})
+		})
+		if read > 0 && consumer != nil {
+			consumer.observe()
+		}
+		if read == 0 {
+			if !running {
+				break
+			}
+			path.ring.wait(time.Millisecond)
+		}
+	}
+
+	all[0].coordination = coord.stats()
+	return all, counters
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// bpf(2) commands, flags and program types of the benchmarks that load their own
+// programs
+const (
+	bpfProgLoad          = 5
+	bpfObjGetInfoByFD    = 15
+	bpfRawTracepointOpen = 17
+	bpfLogStats          = 4 // log_level BPF_LOG_STATS
+
+	bpfProgTypeSocketFilter  = 1
+	bpfProgTypeTracepoint    = 5
+	bpfProgTypeRawTracepoint = 17
+	bpfProgTypeTracing       = 26
+)
+
+// emptyProgram is r0 = 0; exit: the cheapest program a hook can call, so
+// the measured overhead is the attach mechanism's own
+var emptyProgram = [2]uint64{0xb7, 0x95} // BPF_ALU64|BPF_MOV|BPF_K, BPF_JMP|BPF_EXIT
+
+// progLoadAttr is the BPF_PROG_LOAD prefix of union bpf_attr, up to
+// attach_prog_fd
+type progLoadAttr struct {
+	progType           uint32
+	insnCnt            uint32
+	insns              uint64
+	license            uint64
+	logLevel           uint32
+	logSize            uint32
+	logBuf             uint64
+	kernVersion        uint32
+	progFlags          uint32
+	progName           [16]byte
+	progIfindex        uint32
+	expectedAttachType uint32
+	progBTFFD          uint32
+	funcInfoRecSize    uint32
+	funcInfo           uint64
+	funcInfoCnt        uint32
+	lineInfoRecSize    uint32
+	lineInfo           uint64
+	lineInfoCnt        uint32
+	attachBTFID        uint32
+	attachProgFD       uint32
+}
+
+// loadBPFProgram loads emptyProgram as progType; attachType and btfID
+// name the attach point of tracing programs and are zero otherwise
+func loadBPFProgram(progType, attachType, btfID uint32) (int, error) {
+	return loadInsns(progLoadAttr{progType: progType, expectedAttachType: attachType, attachBTFID: btfID}, emptyProgram[:], nil)
+}
+
+// loadInsns loads insns with the program type and attach point of load.
+// A non-nil log receives the verifier log at BPF_LOG_STATS level.
+func loadInsns(load progLoadAttr, insns []uint64, log []byte) (int, error) {
+	license := []byte("GPL\x00") // Trampolines and most helpers need a GPL-compatible program
+	load.insnCnt = uint32(len(insns))
+	load.insns = uint64(uintptr(unsafe.Pointer(&insns[0])))
+	load.license = uint64(uintptr(unsafe.Pointer(&license[0])))
+	if len(log) > 0 {
+		load.logLevel = bpfLogStats
+		load.logSize = uint32(len(log))
+		load.logBuf = uint64(uintptr(unsafe.Pointer(&log[0])))
+	}
+	copy(load.progName[:], "ebpf_bench")
+	fd, err := bpfSyscall(bpfProgLoad, unsafe.Pointer(&load), unsafe.Sizeof(load))
+	runtime.KeepAlive(license)
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(log)
+	if err != nil {
+		return -1, fmt.Errorf("load program: %w", err)
+	}
+	return int(fd), nil
+}
+
+// rawTracepointOpen attaches prog to the raw tracepoint name, or a tracing
+// program to its own attach point when name is empty, returning the link
+func rawTracepointOpen(name string, prog int) (int, error) {
+	var namePtr *byte
+	if name != "" {
+		var err error
+		if namePtr, err = syscall.BytePtrFromString(name); err != nil {
+			return -1, err
+		}
+	}
+	open := struct {
+		name   uint64
+		progFD uint32
+		_      uint32
+	}{uint64(uintptr(unsafe.Pointer(namePtr))), uint32(prog), 0}
+	fd, err := bpfSyscall(bpfRawTracepointOpen, unsafe.Pointer(&open), unsafe.Sizeof(open))
+	runtime.KeepAlive(namePtr)
+	if err != nil {
+		return -1, fmt.Errorf("attach program: %w", err)
+	}
+	return int(fd), nil
+}
+
+// bpfAttachment is a loaded program and the link or perf event attaching
+// it; either is -1 when not open
+type bpfAttachment struct {
+	prog, link int
+}
+
+func newBPFAttachment() bpfAttachment {
+	return bpfAttachment{prog: -1, link: -1}
+}
+
+// close detaches the program and unloads it
+func (a *bpfAttachment) close() error {
+	var err error
+	if a.link >= 0 {
+		err = syscall.Close(a.link)
+	}
+	if a.prog >= 0 {
+		if closeErr := syscall.Close(a.prog); err == nil {
+			err = closeErr
+		}
+	}
+	a.prog, a.link = -1, -1
+	return err
+}
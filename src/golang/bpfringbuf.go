@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Ring buffer record header bits and size, after BPF_RINGBUF_*
+const (
+	ringbufBusyBit    = 1 << 31
+	ringbufDiscardBit = 1 << 30
+	ringbufHdrSize    = 8
+)
+
+// clockMonotonic is CLOCK_MONOTONIC, the clock of bpf_ktime_get_ns
+const clockMonotonic = 1
+
+// bpfRingBuf is a BPF_MAP_TYPE_RINGBUF map read through its mmap'd pages,
+// as libbpf's ring_buffer__consume reads it. The consumer position page
+// is writable; the producer position page and the data area after it,
+// mapped twice over so no record wraps, are read-only.
+type bpfRingBuf struct {
+	fd       int
+	epfd     int
+	size     uint64
+	stride   uint64 // Space a record takes, when records are of one size
+	consumer []byte
+	producer []byte
+	data     []byte // The data area, twice
+}
+
+// newBPFRingBuf creates a ring buffer map of size bytes, a power of two
+// and a multiple of the page size, and maps it
+func newBPFRingBuf(name string, size int) (*bpfRingBuf, error) {
+	page := os.Getpagesize()
+	if size < page || size&(size-1) != 0 {
+		return nil, fmt.Errorf("ring buffer size %d must be a power of two of at least %d", size, page)
+	}
+	fd, err := createBPFMap(name, bpfMapTypeRingBuf, 0, 0, uint32(size), 0)
+	if err != nil {
+		return nil, err
+	}
+	r := &bpfRingBuf{fd: fd, epfd: -1, size: uint64(size)}
+	if r.consumer, err = syscall.Mmap(fd, 0, page, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("mmap %s consumer page: %w", name, err)
+	}
+	if r.producer, err = syscall.Mmap(fd, int64(page), page+2*size, syscall.PROT_READ, syscall.MAP_SHARED); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("mmap %s data: %w", name, err)
+	}
+	r.data = r.producer[page:]
+	if r.epfd, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("epoll_create1: %w", err)
+	}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+	if err := syscall.EpollCtl(r.epfd, syscall.EPOLL_CTL_ADD, fd, &ev); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("epoll_ctl: %w", err)
+	}
+	return r, nil
+}
+
+func (r *bpfRingBuf) consPos() *uint64 { return (*uint64)(unsafe.Pointer(&r.consumer[0])) }
+func (r *bpfRingBuf) prodPos() *uint64 { return (*uint64)(unsafe.Pointer(&r.producer[0])) }
+
+// pending reports whether committed or in-progress records are unread
+func (r *bpfRingBuf) pending() bool {
+	return atomic.LoadUint64(r.consPos()) < atomic.LoadUint64(r.prodPos())
+}
+
+// read hands up to max committed records to fn, or every one available
+// when max is 0, releasing each one's space as it goes. It stops at a
+// record still being written and returns the records read; discarded
+// records are skipped without counting.
+func (r *bpfRingBuf) read(max int, fn func(rec []byte)) int {
+	cons := atomic.LoadUint64(r.consPos())
+	n := 0
+	for max == 0 || n < max {
+		if cons >= atomic.LoadUint64(r.prodPos()) {
+			break
+		}
+		off := cons & (r.size - 1)
+		hdr := atomic.LoadUint32((*uint32)(unsafe.Pointer(&r.data[off])))
+		if hdr&ringbufBusyBit != 0 {
+			break
+		}
+		length := uint64(hdr &^ (ringbufBusyBit | ringbufDiscardBit))
+		if hdr&ringbufDiscardBit == 0 {
+			fn(r.data[off+ringbufHdrSize : off+ringbufHdrSize+length])
+			n++
+		}
+		cons += (length + ringbufHdrSize + 7) &^ 7
+		atomic.StoreUint64(r.consPos(), cons)
+	}
+	return n
+}
+
+// wait blocks in epoll_wait until the kernel notifies the ring or timeout
+// passes, reporting whether it was notified
+func (r *bpfRingBuf) wait(timeout time.Duration) (bool, error) {
+	events := make([]syscall.EpollEvent, 1)
+	n, err := syscall.EpollWait(r.epfd, events, int(timeout/time.Millisecond))
+	if err != nil && err != syscall.EINTR {
+		return false, fmt.Errorf("epoll_wait: %w", err)
+	}
+	return n > 0, nil
+}
+
+// query reads the positions from the mapped pages, the same fields
+// bpf_ringbuf_query reports. They are in records when the records are of
+// one size, as the stall monitor counts them, and in bytes otherwise.
+func (r *bpfRingBuf) query() ringQuery {
+	c := atomic.LoadUint64(r.consPos())
+	p := atomic.LoadUint64(r.prodPos())
+	q := ringQuery{availData: p - c, ringSize: r.size, consPos: c, prodPos: p}
+	if r.stride > 0 {
+		q = ringQuery{availData: q.availData / r.stride, ringSize: q.ringSize / r.stride, consPos: c / r.stride, prodPos: p / r.stride}
+	}
+	return q
+}
+
+func (r *bpfRingBuf) Close() error {
+	if r.producer != nil {
+		syscall.Munmap(r.producer)
+	}
+	if r.consumer != nil {
+		syscall.Munmap(r.consumer)
+	}
+	if r.epfd >= 0 {
+		syscall.Close(r.epfd)
+	}
+	r.producer, r.consumer, r.data, r.epfd = nil, nil, nil, -1
+	return syscall.Close(r.fd)
+}
+
+// ktimeWallOffset is what to add to a bpf_ktime_get_ns timestamp to put
+// it on the wall clock that userspace stamps and receives events by
+func ktimeWallOffset() uint64 {
+	var ts syscall.Timespec
+	syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&ts)), 0)
+	return uint64(time.Now().UnixNano() - ts.Nano())
+}
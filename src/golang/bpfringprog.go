@@ -0,0 +1,441 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// Slots of ringbuf_throughput's counters map, RING_COUNT_* in
+// benchmark.h
+const (
+	ringCountKprobe       = 0
+	ringCountTracepoint   = 1
+	ringCountRawTP        = 2
+	ringCountTLV          = 3
+	ringCountOutput       = 4
+	ringCountFull         = 5 // Emits the ring buffer had no room for
+	ringCountGated        = 6 // Events held back until the reader was ready
+	ringCountStartupDrops = 7 // Emits lost to a full ring before the reader was ready
+	ringCountSeq          = 8 // Records submitted by the batch strategy, numbering its wakeups
+	ringCountSlots        = 10
+)
+
+// Slots of ringbuf_throughput's config map, CONFIG_* in benchmark.h. The
+// ready slot is the coordination map's, so the program can read a pinned
+// one instead.
+const (
+	configReady    = coordSlotReady
+	configSelfTime = 2
+	configSlots    = 3
+)
+
+// bpf_ringbuf_submit flags
+const (
+	bpfRBNoWakeup    = 1 // BPF_RB_NO_WAKEUP
+	bpfRBForceWakeup = 2 // BPF_RB_FORCE_WAKEUP
+)
+
+// eventTypeTracepointImm is EVENT_TYPE_TRACEPOINT as the programs store it
+const eventTypeTracepointImm = 2
+
+// maxBPFRecordSize bounds the records of the ring buffer programs: an
+// output record is built on the 512-byte BPF stack
+const maxBPFRecordSize = 256
+
+// ringProgOptions select the variant of ringbuf_throughput.c to assemble
+type ringProgOptions struct {
+	api        string    // apiReserve or apiOutput
+	recordSize int       // A multiple of 8, at least the 24 of struct event
+	ringBytes  int       // Ring buffer size, a power of two of at least a page
+	wakeup     string    // Notification strategy of the reserve variant's submit; "" is adaptive
+	batch      int       // Records per forced wakeup of wakeupBatch
+	readiness  bool      // Read the ready slot, counting the drops before it is set
+	handshake  bool      // Also hold events back until it is set
+	coord      *coordMap // Pinned map whose ready slot is read instead of the config map's
+	selfTime   bool      // Time the reserve variant's emits into the emit_cost map
+}
+
+// Stack layout of the ring buffer programs
+const (
+	ringKeyOff   = -4  // u32 key of array lookups
+	ringReadyOff = -16 // u64 ready flag, as read on entry
+)
+
+// bpfRingProgram is ringbuf_throughput.c's getpid_reserve or getpid_output
+// loaded with bpf(2). It emits one struct event, padded to the
+// record size, for every getpid(2) of this process, so producers drive it
+// at whatever rate they call trigger.
+type bpfRingProgram struct {
+	ring     *bpfRingBuf
+	counters int
+	config   int
+	emitCost int // Per-CPU emit_cost map, with selfTime
+	prog     int
+	link     int
+	slot     uint32 // Counter of the variant's emits
+}
+
+// ringProgInsns assembles the variant: getpid_reserve's reserve, fill and
+// submit, or getpid_output's fill on the stack and bpf_ringbuf_output.
+// r6 holds the context, r7 the start of a timed emit, r8 the reserved
+// record and r9 its submit flags. ready is the map holding the ready
+// slot, config's or the pinned coordination map.
+func ringProgInsns(o ringProgOptions, ring, counters, config, ready, emitCost int, slot uint32) []uint64 {
+	a := newBPFAsm()
+	a.emit(bpfInsn(0xbf, 6, 1, 0, 0)) // r6 = ctx
+	a.call(bpfFuncGetCurrentPidTgid)
+	a.emit(bpfInsn(0x77, 0, 0, 0, 32)) // r0 = tgid
+	a.jump(0x55, 0, 0, int32(os.Getpid()), "out")
+	a.emit(bpfInsn(0x79, 1, 6, 8, 0)) // r1 = ctx->args[1], the syscall number
+	a.jump(0x55, 1, 0, syscall.SYS_GETPID, "out")
+	if o.readiness {
+		a.readReady(ready)
+	}
+	if o.handshake {
+		a.jump(0x55, 1, 0, 0, "ready")
+		a.atomicInc(counters, ringCountGated)
+		a.jump(0x05, 0, 0, 0, "out")
+		a.label("ready")
+	}
+
+	recordOff := int16(ringReadyOff) - int16(o.recordSize)
+	if o.api == apiOutput {
+		a.ringFill(10, recordOff, o.recordSize)
+		a.loadMap(1, ring).stackPtr(2, int32(recordOff))
+		a.emit(bpfInsn(0xb7, 3, 0, 0, int32(o.recordSize)), bpfInsn(0xb7, 4, 0, 0, 0))
+		a.call(bpfFuncRingbufOutput)
+		a.jump(0x55, 0, 0, 0, "full")
+	} else {
+		if o.selfTime {
+			a.emitStart(config)
+		}
+		a.loadMap(1, ring)
+		a.emit(bpfInsn(0xb7, 2, 0, 0, int32(o.recordSize)), bpfInsn(0xb7, 3, 0, 0, 0))
+		a.call(bpfFuncRingbufReserve)
+		a.jump(0x15, 0, 0, 0, "full")
+		a.emit(bpfInsn(0xbf, 8, 0, 0, 0))
+		a.submitFlags(o, counters)
+		a.ringFill(8, 0, o.recordSize)
+		a.emit(bpfInsn(0xbf, 1, 8, 0, 0), bpfInsn(0xbf, 2, 9, 0, 0))
+		a.call(bpfFuncRingbufSubmit)
+		if o.selfTime {
+			a.emitDone(emitCost)
+		}
+	}
+	a.atomicInc(counters, slot)
+	a.label("out")
+	a.emit(insnReturn0, insnExit)
+
+	a.label("full")
+	a.atomicInc(counters, ringCountFull)
+	if o.readiness {
+		a.emit(bpfInsn(0x79, 1, 10, ringReadyOff, 0))
+		a.jump(0x55, 1, 0, 0, "fail")
+		a.atomicInc(counters, ringCountStartupDrops)
+	}
+	a.label("fail")
+	a.emit(bpfInsn(0xb7, 0, 0, 0, 1), insnExit)
+	return a.program()
+}
+
+// readReady appends reader_ready: r1 and the stack's ready flag are the
+// config map's ready slot, or 0 when the lookup fails
+func (a *bpfAsm) readReady(config int) *bpfAsm {
+	a.lookup(config, configReady, ringKeyOff)
+	a.emit(bpfInsn(0xb7, 1, 0, 0, 0))
+	a.jump(0x15, 0, 0, 0, "stored")
+	a.emit(bpfInsn(0x79, 1, 0, 0, 0))
+	a.label("stored")
+	return a.emit(bpfInsn(0x7b, 10, 1, ringReadyOff, 0))
+}
+
+// emitStart appends emit_start: r7 is the time, or 0 when the config
+// map's self-time slot is not set
+func (a *bpfAsm) emitStart(config int) *bpfAsm {
+	a.emit(bpfInsn(0xb7, 7, 0, 0, 0))
+	a.lookup(config, configSelfTime, ringKeyOff)
+	a.jump(0x15, 0, 0, 0, "untimed")
+	a.emit(bpfInsn(0x79, 1, 0, 0, 0))
+	a.jump(0x15, 1, 0, 0, "untimed")
+	a.call(bpfFuncKtimeGetNs)
+	a.emit(bpfInsn(0xbf, 7, 0, 0, 0))
+	return a.label("untimed")
+}
+
+// emitDone appends emit_done for the start in r7: the log2 bucket and
+// sum of the time since, the count, and on every emitCostClockEvery-th
+// emit the cheapest back-to-back clock pair. The submitted record is gone,
+// so r8 is free.
+func (a *bpfAsm) emitDone(emitCost int) *bpfAsm {
+	a.jump(0x15, 7, 0, 0, "timed")
+	a.call(bpfFuncKtimeGetNs)
+	a.emit(bpfInsn(0x1f, 0, 7, 0, 0), bpfInsn(0xbf, 7, 0, 0, 0)) // r7 = d
+
+	// r1 = bits.Len64(d), as log2_u64(d) + 1, capped to the last bucket
+	a.emit(bpfInsn(0xb7, 1, 0, 0, 0))
+	a.jump(0x15, 7, 0, 0, "bucket")
+	a.emit(bpfInsn(0xbf, 2, 7, 0, 0))
+	for _, shift := range []int32{32, 16, 8, 4, 2, 1} {
+		next := fmt.Sprintf("shift%d", shift)
+		a.emit(bpfInsn(0xbf, 3, 2, 0, 0), bpfInsn(0x77, 3, 0, 0, shift))
+		a.jump(0x15, 3, 0, 0, next)
+		a.emit(bpfInsn(0xbf, 2, 3, 0, 0), bpfInsn(0x07, 1, 0, 0, shift))
+		a.label(next)
+	}
+	a.emit(bpfInsn(0x07, 1, 0, 0, 1))
+	a.jump(0xb5, 1, 0, emitCostBuckets-1, "bucket") // if r1 <= 31
+	a.emit(bpfInsn(0xb7, 1, 0, 0, emitCostBuckets-1))
+	a.label("bucket")
+
+	a.emit(bpfInsn(0x63, 10, 1, ringKeyOff, 0))
+	a.loadMap(1, emitCost).stackPtr(2, ringKeyOff)
+	a.call(bpfFuncMapLookupElem)
+	a.perCPUAddReg(-1)
+	a.lookup(emitCost, emitCostSum, ringKeyOff)
+	a.perCPUAddReg(7)
+
+	a.lookup(emitCost, emitCostCount, ringKeyOff)
+	a.jump(0x15, 0, 0, 0, "timed")
+	a.emit(
+		bpfInsn(0x79, 1, 0, 0, 0),
+		bpfInsn(0xbf, 2, 1, 0, 0),
+		bpfInsn(0x07, 2, 0, 0, 1),
+		bpfInsn(0x7b, 0, 2, 0, 0),
+		bpfInsn(0x57, 1, 0, 0, emitCostClockEvery-1))
+	a.jump(0x55, 1, 0, 0, "timed")
+	a.lookup(emitCost, emitCostClock, ringKeyOff)
+	a.jump(0x15, 0, 0, 0, "timed")
+	a.emit(bpfInsn(0xbf, 8, 0, 0, 0))
+	a.call(bpfFuncKtimeGetNs)
+	a.emit(bpfInsn(0xbf, 7, 0, 0, 0))
+	a.call(bpfFuncKtimeGetNs)
+	a.emit(bpfInsn(0x1f, 0, 7, 0, 0), bpfInsn(0x79, 1, 8, 0, 0))
+	a.jump(0x15, 1, 0, 0, "clock")
+	a.jump(0x3d, 0, 1, 0, "timed") // if r0 >= r1
+	a.label("clock")
+	a.emit(bpfInsn(0x7b, 8, 0, 0, 0))
+	return a.label("timed")
+}
+
+// perCPUAddReg appends emit_cost_add on the slot r0 looked up: one, for a
+// negative reg, or reg's value. Per-CPU slots need no atomics.
+func (a *bpfAsm) perCPUAddReg(reg int) *bpfAsm {
+	skip := fmt.Sprintf("added%d", len(a.insns))
+	a.jump(0x15, 0, 0, 0, skip)
+	a.emit(bpfInsn(0x79, 1, 0, 0, 0))
+	if reg < 0 {
+		a.emit(bpfInsn(0x07, 1, 0, 0, 1))
+	} else {
+		a.emit(bpfInsn(0x0f, 1, uint8(reg), 0, 0))
+	}
+	a.emit(bpfInsn(0x7b, 0, 1, 0, 0))
+	return a.label(skip)
+}
+
+// submitFlags appends the choice of r9, the submit flags of the wakeup
+// strategy. The batch strategy numbers its records in ringCountSeq and
+// forces a wakeup on every batch-th, as (p+1) % batch == 0 does in the
+// simulation.
+func (a *bpfAsm) submitFlags(o ringProgOptions, counters int) *bpfAsm {
+	switch o.wakeup {
+	case wakeupNone:
+		return a.emit(bpfInsn(0xb7, 9, 0, 0, bpfRBNoWakeup))
+	case wakeupForce:
+		return a.emit(bpfInsn(0xb7, 9, 0, 0, bpfRBForceWakeup))
+	case wakeupBatch:
+		a.emit(bpfInsn(0xb7, 9, 0, 0, bpfRBNoWakeup))
+		a.lookup(counters, ringCountSeq, ringKeyOff)
+		a.jump(0x15, 0, 0, 0, "flags")
+		a.emit(
+			bpfInsn(0xb7, 1, 0, 0, 1),
+			bpfInsn(0xdb, 0, 1, 0, 0x01), // r1 = atomic_fetch_add((u64 *)(r0 + 0), r1)
+			bpfInsn(0x07, 1, 0, 0, 1),
+			bpfInsn(0x97, 1, 0, 0, int32(o.batch))) // r1 %= batch
+		a.jump(0x55, 1, 0, 0, "flags")
+		a.emit(bpfInsn(0xb7, 9, 0, 0, bpfRBForceWakeup))
+		return a.label("flags")
+	}
+	return a.emit(bpfInsn(0xb7, 9, 0, 0, 0))
+}
+
+// ringFill appends the filling of a struct event at base + off, as the
+// programs fill it, and zeroes the rest of a size-byte record
+func (a *bpfAsm) ringFill(base uint8, off int16, size int) *bpfAsm {
+	a.call(bpfFuncKtimeGetNs)
+	a.emit(bpfInsn(0x7b, base, 0, off, 0)) // e->timestamp
+	a.call(bpfFuncGetCurrentUIDGID)
+	a.emit(bpfInsn(0x77, 0, 0, 0, 32), bpfInsn(0x63, base, 0, off+8, 0)) // e->pid
+	a.call(bpfFuncGetSmpProcessorID)
+	a.emit(
+		bpfInsn(0x63, base, 0, off+12, 0),                      // e->cpu_id
+		bpfInsn(0x62, base, 0, off+16, eventTypeTracepointImm), // e->event_type
+		bpfInsn(0x79, 1, 6, 8, 0),
+		bpfInsn(0x63, base, 1, off+20, 0)) // e->data
+	for o := int16(24); o < int16(size); o += 8 {
+		a.emit(bpfInsn(0x7a, base, 0, off+o, 0))
+	}
+	return a
+}
+
+// atomicInc appends __sync_fetch_and_add(&counters[slot], 1)
+func (a *bpfAsm) atomicInc(fd int, slot uint32) *bpfAsm {
+	a.lookup(fd, slot, ringKeyOff)
+	return a.emit(
+		bpfInsn(0x15, 0, 0, 2, 0), // if r0 == 0 skip the add
+		bpfInsn(0xb7, 1, 0, 0, 1),
+		bpfInsn(0xdb, 0, 1, 0, 0)) // lock *(u64 *)(r0 + 0) += r1
+}
+
+// ringBytesFor is the smallest ring buffer map holding records of
+// recordSize, a power of two of at least a page
+func ringBytesFor(records, recordSize int) int {
+	n := os.Getpagesize()
+	for n < records*ringStride(recordSize) {
+		n <<= 1
+	}
+	return n
+}
+
+// ringStride is the space a record takes in a ring buffer map: its
+// header and the record, rounded up to 8 bytes
+func ringStride(recordSize int) int {
+	return (recordSize + ringbufHdrSize + 7) &^ 7
+}
+
+// openBPFRingProgram creates the ring buffer and counters, loads the
+// variant and attaches it to sys_enter
+func openBPFRingProgram(o ringProgOptions) (p *bpfRingProgram, err error) {
+	if o.recordSize > maxBPFRecordSize {
+		return nil, fmt.Errorf("records of %d bytes exceed the %d a program builds on its stack", o.recordSize, maxBPFRecordSize)
+	}
+	p = &bpfRingProgram{counters: -1, config: -1, emitCost: -1, prog: -1, link: -1, slot: ringCountTracepoint}
+	if o.api == apiOutput {
+		p.slot = ringCountOutput
+	}
+	defer func() {
+		if err != nil {
+			p.Close()
+		}
+	}()
+	if p.ring, err = newBPFRingBuf("ringbuf_events", o.ringBytes); err != nil {
+		return nil, err
+	}
+	p.ring.stride = uint64(ringStride(o.recordSize))
+	if p.counters, err = createBPFMap("counters", bpfMapTypeArray, 4, 8, ringCountSlots, 0); err != nil {
+		return nil, err
+	}
+	if p.config, err = createBPFMap("config", bpfMapTypeArray, 4, 8, configSlots, 0); err != nil {
+		return nil, err
+	}
+	ready := p.config
+	if o.coord != nil {
+		ready = o.coord.fd
+	}
+	if o.selfTime {
+		if p.emitCost, err = createBPFMap("emit_cost", bpfMapTypePercpuArray, 4, 8, emitCostSlots, 0); err != nil {
+			return nil, err
+		}
+		if err = setArraySlot(p.config, configSelfTime, 1); err != nil {
+			return nil, fmt.Errorf("set self-time: %w", err)
+		}
+	}
+	log := make([]byte, 64*1024)
+	insns := ringProgInsns(o, p.ring.fd, p.counters, p.config, ready, p.emitCost, p.slot)
+	if p.prog, err = loadInsns(progLoadAttr{progType: bpfProgTypeRawTracepoint}, insns, log); err != nil {
+		return nil, fmt.Errorf("ring buffer program: %w: %s", err, strings.TrimRight(string(log), "\x00"))
+	}
+	if p.link, err = rawTracepointOpen(callTracepointRawTP, p.prog); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// trigger fires the program once from the calling thread
+func (p *bpfRingProgram) trigger() {
+	syscall.Getpid()
+}
+
+// count reads one of the counters
+func (p *bpfRingProgram) count(slot uint32) int64 {
+	v, _ := arraySlot(p.counters, slot)
+	return int64(v)
+}
+
+func (p *bpfRingProgram) Close() error {
+	for _, fd := range []int{p.link, p.prog, p.counters, p.config, p.emitCost} {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}
+	if p.ring != nil {
+		p.ring.Close()
+	}
+	p.link, p.prog, p.counters, p.config, p.emitCost, p.ring = -1, -1, -1, -1, -1, nil
+	return nil
+}
+
+// emitCosts reads the emit_cost map, one emitCostMap per CPU
+func (p *bpfRingProgram) emitCosts() ([]emitCostMap, error) {
+	slots, err := perCPUSlots(p.emitCost, emitCostSlots)
+	if err != nil {
+		return nil, fmt.Errorf("read emit_cost: %w", err)
+	}
+	cpus := make([]emitCostMap, len(slots[0]))
+	for slot, values := range slots {
+		for cpu, v := range values {
+			cpus[cpu][slot] = v
+		}
+	}
+	return cpus, nil
+}
+
+// readiness returns the ready flag the program reads: the config map's
+// slot, or the pinned coordination map's when the program was given one
+func (p *bpfRingProgram) readiness(coord *coordMap) phaseMarker {
+	if coord == nil {
+		coord = &coordMap{fd: p.config}
+	}
+	return &mapPhaseMarker{m: coord, slot: configReady}
+}
+
+// startRingConsumer drains a ring buffer map on its own OS thread, as
+// startThreadConsumer drains an mpscRing: records go to deliver until stop
+// is set, and are counted as read after the window until producersDone is
+// set and the ring is empty. An empty ring is waited on with epoll.
+func startRingConsumer(ring *bpfRingBuf, stop, producersDone *atomic.Bool, deliver func(rec []byte)) *threadConsumer {
+	c := &threadConsumer{done: make(chan struct{})}
+	ready := make(chan struct{})
+	go func() {
+		defer close(c.done)
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		discard := func([]byte) { c.postWindow++ }
+		c.start, _ = TakeThreadResourceSnapshot()
+		close(ready)
+		measuring := true
+		for {
+			done := producersDone.Load()
+			read := deliver
+			if stop.Load() {
+				if measuring {
+					c.end, _ = TakeThreadResourceSnapshot()
+					measuring = false
+				}
+				read = discard
+			}
+			if ring.read(0, read) > 0 {
+				continue
+			}
+			if done {
+				return
+			}
+			ring.wait(latencyFilterPoll)
+		}
+	}()
+	<-ready
+	return c
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// vmlinuxBTF is the kernel's own type information
+const vmlinuxBTF = "/sys/kernel/btf/vmlinux"
+
+// BTF kinds this package needs to walk the type section; see
+// include/uapi/linux/btf.h
+const (
+	btfMagic         = 0xeb9f
+	btfKindInt       = 1
+	btfKindArray     = 3
+	btfKindStruct    = 4
+	btfKindUnion     = 5
+	btfKindEnum      = 6
+	btfKindFunc      = 12
+	btfKindFuncProto = 13
+	btfKindVar       = 14
+	btfKindDatasec   = 15
+	btfKindDeclTag   = 17
+	btfKindEnum64    = 19
+	btfTypeLen       = 12 // struct btf_type
+)
+
+// btfFuncID returns the BTF type ID of the kernel function name, which
+// fentry and fexit programs name as their attach point
+func btfFuncID(path, name string) (uint32, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("read BTF: %w", err)
+	}
+	var hdr struct {
+		Magic   uint16
+		Version uint8
+		Flags   uint8
+		HdrLen  uint32
+		TypeOff uint32
+		TypeLen uint32
+		StrOff  uint32
+		StrLen  uint32
+	}
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &hdr); err != nil || hdr.Magic != btfMagic {
+		return 0, fmt.Errorf("%s is not little-endian BTF", path)
+	}
+	typeStart, strStart := int(hdr.HdrLen+hdr.TypeOff), int(hdr.HdrLen+hdr.StrOff)
+	if typeStart+int(hdr.TypeLen) > len(data) || strStart+int(hdr.StrLen) > len(data) {
+		return 0, fmt.Errorf("%s is truncated", path)
+	}
+	types := data[typeStart : typeStart+int(hdr.TypeLen)]
+	strs := data[strStart : strStart+int(hdr.StrLen)]
+
+	for id, off := uint32(1), 0; off+btfTypeLen <= len(types); id++ {
+		nameOff := binary.LittleEndian.Uint32(types[off:])
+		info := binary.LittleEndian.Uint32(types[off+4:])
+		kind, vlen := int(info>>24&0x1f), int(info&0xffff)
+		if kind == btfKindFunc && int(nameOff) < len(strs) {
+			s := strs[nameOff:]
+			if end := bytes.IndexByte(s, 0); end == len(name) && string(s[:end]) == name {
+				return id, nil
+			}
+		}
+		off += btfTypeLen
+		switch kind {
+		case btfKindInt, btfKindVar, btfKindDeclTag:
+			off += 4
+		case btfKindArray:
+			off += 12
+		case btfKindStruct, btfKindUnion, btfKindDatasec, btfKindEnum64:
+			off += 12 * vlen
+		case btfKindEnum, btfKindFuncProto:
+			off += 8 * vlen
+		}
+	}
+	return 0, fmt.Errorf("function %s not found in %s", name, path)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// calibrationName is the result name of the calibrate benchmark, which
+// report looks for to print the harness floor
+const calibrationName = "Harness Calibration"
+
+// Reference channels of the calibrate benchmark
+var calibrationChannels = []string{"pipe", "eventfd"}
+
+// calibrationChannel is a pair of one-directional blocking channels
+// between two threads: ping carries requests, pong the replies
+type calibrationChannel struct {
+	name         string
+	pingR, pingW int
+	pongR, pongW int
+	msg          []byte // 1 byte for pipes, the 8-byte counter for eventfd
+}
+
+func newCalibrationChannel(name string) (*calibrationChannel, error) {
+	c := &calibrationChannel{name: name}
+	switch name {
+	case "pipe":
+		var ping, pong [2]int
+		if err := syscall.Pipe2(ping[:], syscall.O_CLOEXEC); err != nil {
+			return nil, fmt.Errorf("pipe2: %w", err)
+		}
+		if err := syscall.Pipe2(pong[:], syscall.O_CLOEXEC); err != nil {
+			syscall.Close(ping[0])
+			syscall.Close(ping[1])
+			return nil, fmt.Errorf("pipe2: %w", err)
+		}
+		c.pingR, c.pingW, c.pongR, c.pongW = ping[0], ping[1], pong[0], pong[1]
+		c.msg = make([]byte, 1)
+	case "eventfd":
+		var fds [2]int
+		for i := range fds {
+			fd, _, errno := syscall.Syscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC, 0)
+			if errno != 0 {
+				for _, open := range fds[:i] {
+					syscall.Close(open)
+				}
+				return nil, fmt.Errorf("eventfd: %w", errno)
+			}
+			fds[i] = int(fd)
+		}
+		c.pingR, c.pingW, c.pongR, c.pongW = fds[0], fds[0], fds[1], fds[1]
+		c.msg = []byte{1, 0, 0, 0, 0, 0, 0, 0}
+	default:
+		return nil, fmt.Errorf("unknown channel %q (want pipe or eventfd)", name)
+	}
+	return c, nil
+}
+
+func (c *calibrationChannel) Close() {
+	syscall.Close(c.pingR)
+	syscall.Close(c.pongR)
+	if c.pingW != c.pingR { // An eventfd is both ends of its channel
+		syscall.Close(c.pingW)
+		syscall.Close(c.pongW)
+	}
+}
+
+// transfer writes one message to w and waits for one on r
+func (c *calibrationChannel) transfer(w, r int, buf []byte) error {
+	if _, err := syscall.Write(w, c.msg); err != nil {
+		return err
+	}
+	_, err := syscall.Read(r, buf)
+	return err
+}
+
+// CalibrationBenchmark measures the harness's own timing floor: the
+// latency of handing a timestamped message to another thread over a
+// pure-userspace kernel channel and back. No eBPF is involved, so event
+// latencies close to this floor are dominated by the harness, not by the
+// mechanism under test.
+type CalibrationBenchmark struct {
+	duration   time.Duration
+	channels   []string
+	maxSamples int
+	verbose    bool
+}
+
+// clockReadNs estimates the cost of one time.Now call, the other part of
+// every latency the harness reports
+func clockReadNs() float64 {
+	const reads = 100000
+	start := time.Now()
+	for i := 0; i < reads; i++ {
+		_ = time.Now()
+	}
+	return float64(time.Since(start).Nanoseconds()) / reads
+}
+
+// runOne ping-pongs over one channel. The reported latency is half the
+// round trip, the one-way handoff a consumer thread would see.
+func (b *CalibrationBenchmark) runOne(ctx context.Context, name string) (*BenchmarkResult, error) {
+	ch, err := newCalibrationChannel(name)
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Close()
+
+	r := &BenchmarkResult{
+		Name:           calibrationName,
+		Language:       "Go",
+		ProgramType:    "none",
+		DataMechanism:  name,
+		ReaderStrategy: "round-trip/2",
+		Host:           CollectHostInfo(),
+		Errors:         []string{},
+	}
+	benchLog(ctx).Info("Calibrating", "round_trips", name, "duration", b.duration)
+
+	// Echo thread: replies to every request until stop is set
+	var stop atomic.Bool
+	echoErr := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		buf := make([]byte, 8)
+		for {
+			if _, err := syscall.Read(ch.pingR, buf); err != nil {
+				echoErr <- err
+				return
+			}
+			if stop.Load() {
+				echoErr <- nil
+				return
+			}
+			if _, err := syscall.Write(ch.pongW, ch.msg); err != nil {
+				echoErr <- err
+				return
+			}
+		}
+	}()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	var latency StreamingLatency
+	samples := make([]uint64, 0, 1024)
+	var trips int64
+	buf := make([]byte, 8)
+
+	startUsage, _ := TakeThreadResourceSnapshot()
+	r.StartTime = time.Now()
+	deadline := r.StartTime.Add(b.duration)
+	var runErr error
+	for ctx.Err() == nil {
+		t0 := time.Now()
+		if !t0.Before(deadline) {
+			break
+		}
+		if runErr = ch.transfer(ch.pingW, ch.pongR, buf); runErr != nil {
+			break
+		}
+		oneWay := uint64(time.Since(t0).Nanoseconds()) / 2
+		latency.Record(oneWay)
+		if len(samples) < b.maxSamples {
+			samples = append(samples, oneWay)
+		}
+		trips++
+	}
+	r.EndTime = time.Now()
+	endUsage, _ := TakeThreadResourceSnapshot()
+	markInterrupted(ctx, r)
+
+	stop.Store(true)
+	syscall.Write(ch.pingW, ch.msg) // Release the echo thread
+	if err := <-echoErr; err != nil && runErr == nil {
+		runErr = err
+	}
+	if runErr != nil {
+		return nil, fmt.Errorf("%s: %w", name, runErr)
+	}
+
+	wall := r.EndTime.Sub(r.StartTime)
+	r.Duration = wall.Seconds()
+	r.EventCount = trips
+	if r.Duration > 0 {
+		r.Throughput = float64(trips) / r.Duration
+	}
+	r.Latency = latency.Stats()
+	r.Latency.Percentiles = computeLatencyStats(samples, DefaultQuantiles).Percentiles
+	r.CPUBudget = NewCPUBudget(startUsage, endUsage, trips)
+	r.CPUUsage = r.CPUBudget.CPUPercent(wall)
+	r.OverheadNs = clockReadNs()
+	r.Operations = []OperationResult{NewOperationResult("round_trip", trips, wall)}
+	return r, nil
+}
+
+// Run calibrates with every channel in turn
+func (b *CalibrationBenchmark) Run(ctx context.Context) ([]*BenchmarkResult, error) {
+	if b.verbose {
+		PrintBenchmarkHeader("Harness Calibration (Go)")
+	}
+	var results []*BenchmarkResult
+	for _, name := range b.channels {
+		if ctx.Err() != nil {
+			break
+		}
+		r, err := b.runOne(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// runCalibrateBenchmark is the entry point of the calibrate subcommand
+func runCalibrateBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("calibrate", flag.ExitOnError)
+	common := addBenchFlags(fs, "calibrate_result.json", true)
+	channels := fs.String("channels", "pipe,eventfd", "Comma-separated reference channels (pipe, eventfd)")
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+	list := splitList(*channels)
+	if len(list) == 0 {
+		return nil, opts, fmt.Errorf("-channels must name at least one channel")
+	}
+	for _, c := range list {
+		if !containsString(calibrationChannels, c) {
+			return nil, opts, fmt.Errorf("unknown channel %q (want pipe or eventfd)", c)
+		}
+	}
+
+	bench := &CalibrationBenchmark{
+		duration:   opts.Duration,
+		channels:   list,
+		maxSamples: 100000,
+		verbose:    opts.Verbose,
+	}
+	results, err := bench.Run(ctx)
+	if err != nil {
+		return nil, opts, err
+	}
+	return results, opts, nil
+}
+
+// printHarnessFloor prints the calibration results among results, if any,
+// as the latency floor the other results should be read against
+func printHarnessFloor(results []*BenchmarkResult, unit LatencyUnit) {
+	for _, r := range results {
+		if r.Name != calibrationName {
+			continue
+		}
+		p50, p99 := "-", "-"
+		if v, ok := r.Latency.Percentile(0.5); ok {
+			p50 = unit.Format(float64(v))
+		}
+		if v, ok := r.Latency.Percentile(0.99); ok {
+			p99 = unit.Format(float64(v))
+		}
+		fmt.Printf("Harness floor (%s handoff): p50 %s, p99 %s, clock read %.0f ns\n",
+			r.DataMechanism, p50, p99, r.OverheadNs)
+	}
+}
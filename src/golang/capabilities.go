@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Capability bits of CapEff in /proc/self/status
+const (
+	capNetAdmin = 12
+	capSysAdmin = 21
+	capPerfmon  = 38
+	capBPF      = 39
+)
+
+// bpf(2) command and map types used by the feature probes
+const (
+	bpfMapCreate = 0
+
+	bpfMapTypeHash           = 1
+	bpfMapTypeArray          = 2
+	bpfMapTypePerfEventArray = 4
+	bpfMapTypePercpuHash     = 5
+	bpfMapTypeLRUHash        = 9
+	bpfMapTypeRingBuf        = 27
+)
+
+// Feature probe outcomes
+const (
+	featureSupported   = "supported"
+	featureUnsupported = "unsupported"
+	featureAssumed     = "assumed" // Probe not permitted; inferred from the kernel version
+	featureUnknown     = "unknown" // Probe not permitted and the kernel version does not decide
+)
+
+// mapFeature is a map type probed by creating a small map of it
+type mapFeature struct {
+	name       string
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	since      [2]int // Kernel version that added it, for the fallback guess
+}
+
+var mapFeatures = []mapFeature{
+	{"hash", bpfMapTypeHash, 4, 8, 1, [2]int{3, 19}},
+	{"array", bpfMapTypeArray, 4, 8, 1, [2]int{3, 19}},
+	{"perf_event_array", bpfMapTypePerfEventArray, 4, 4, 1, [2]int{4, 3}},
+	{"percpu_hash", bpfMapTypePercpuHash, 4, 8, 1, [2]int{4, 6}},
+	{"lru_hash", bpfMapTypeLRUHash, 4, 8, 1, [2]int{4, 10}},
+	{"ringbuf", bpfMapTypeRingBuf, 0, 0, 4096, [2]int{5, 8}},
+}
+
+// Capabilities is what the host lets the benchmarks do
+type Capabilities struct {
+	KernelRelease   string
+	KernelVersion   [3]int
+	BTF             bool   // /sys/kernel/btf/vmlinux is present, so CO-RE programs can load
+	Tracefs         string // Mount point, empty when not mounted
+	KprobeEvents    bool
+	UprobeEvents    bool
+	MapTypes        map[string]string // Map type -> feature probe outcome
+	CapBPF          bool
+	CapPerfmon      bool
+	CapSysAdmin     bool
+	CapNetAdmin     bool
+	UnprivilegedBPF string // kernel.unprivileged_bpf_disabled
+	JITEnabled      string // net.core.bpf_jit_enable
+}
+
+// ProbeCapabilities inspects the running kernel and process privileges.
+// Probes that fail are recorded as such, never returned as errors.
+func ProbeCapabilities() *Capabilities {
+	c := &Capabilities{KernelRelease: kernelRelease(), MapTypes: make(map[string]string)}
+	c.KernelVersion = parseKernelVersion(c.KernelRelease)
+	_, err := os.Stat("/sys/kernel/btf/vmlinux")
+	c.BTF = err == nil
+	if root, err := findTracefs(); err == nil {
+		c.Tracefs = root
+		_, err = os.Stat(filepath.Join(root, "kprobe_events"))
+		c.KprobeEvents = err == nil
+		_, err = os.Stat(filepath.Join(root, "uprobe_events"))
+		c.UprobeEvents = err == nil
+	}
+
+	caps := readEffectiveCaps()
+	c.CapBPF = caps&(1<<capBPF) != 0
+	c.CapPerfmon = caps&(1<<capPerfmon) != 0
+	c.CapSysAdmin = caps&(1<<capSysAdmin) != 0
+	c.CapNetAdmin = caps&(1<<capNetAdmin) != 0
+	c.UnprivilegedBPF = readSysctl("/proc/sys/kernel/unprivileged_bpf_disabled")
+	c.JITEnabled = readSysctl("/proc/sys/net/core/bpf_jit_enable")
+
+	for _, f := range mapFeatures {
+		c.MapTypes[f.name] = c.probeMap(f)
+	}
+	return c
+}
+
+var (
+	hostCapsOnce sync.Once
+	hostCaps     *Capabilities
+)
+
+// hostCapabilities probes the host once per process
+func hostCapabilities() *Capabilities {
+	hostCapsOnce.Do(func() { hostCaps = ProbeCapabilities() })
+	return hostCaps
+}
+
+// probeMap creates and closes a map of the feature's type. When the probe
+// is not permitted, the kernel version decides.
+func (c *Capabilities) probeMap(f mapFeature) string {
+	errno := syscall.ENOSYS
+	if sysBPF >= 0 {
+		attr := make([]byte, 72) // union bpf_attr, BPF_MAP_CREATE prefix; the rest zero
+		for i, v := range []uint32{f.mapType, f.keySize, f.valueSize, f.maxEntries} {
+			*(*uint32)(unsafe.Pointer(&attr[i*4])) = v
+		}
+		fd, err := bpfSyscall(bpfMapCreate, unsafe.Pointer(&attr[0]), uintptr(len(attr)))
+		if err == nil {
+			syscall.Close(int(fd))
+			return featureSupported
+		}
+		errors.As(err, &errno)
+	}
+	switch errno {
+	case syscall.EINVAL:
+		return featureUnsupported
+	case syscall.EPERM, syscall.EACCES, syscall.ENOSYS:
+		if c.KernelVersion == [3]int{} {
+			return featureUnknown
+		}
+		if c.atLeast(f.since[0], f.since[1]) {
+			return featureAssumed
+		}
+		return featureUnsupported
+	}
+	return featureUnknown
+}
+
+// atLeast reports whether the kernel is major.minor or newer
+func (c *Capabilities) atLeast(major, minor int) bool {
+	v := c.KernelVersion
+	return v[0] > major || v[0] == major && v[1] >= minor
+}
+
+// HasMapType reports whether map type name is supported or assumed to be
+func (c *Capabilities) HasMapType(name string) bool {
+	s := c.MapTypes[name]
+	return s == featureSupported || s == featureAssumed
+}
+
+// CanLoadBPF reports whether the process may load BPF programs and maps
+func (c *Capabilities) CanLoadBPF() bool {
+	return c.CapBPF || c.CapSysAdmin
+}
+
+// CanTrace reports whether the process may create tracefs probes and
+// attach perf events
+func (c *Capabilities) CanTrace() bool {
+	return c.CapPerfmon || c.CapSysAdmin
+}
+
+// parseKernelVersion reads major.minor.patch from a release string such
+// as 6.1.0-18-amd64; missing parts are zero
+func parseKernelVersion(release string) [3]int {
+	var v [3]int
+	fields := strings.SplitN(release, ".", 3)
+	for i, f := range fields {
+		end := strings.IndexFunc(f, func(r rune) bool { return r < '0' || r > '9' })
+		if end >= 0 {
+			f = f[:end]
+		}
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			break
+		}
+		v[i] = n
+	}
+	return v
+}
+
+// readEffectiveCaps returns the CapEff bitmask of the current process
+func readEffectiveCaps() uint64 {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if v, ok := strings.CutPrefix(scanner.Text(), "CapEff:"); ok {
+			caps, _ := strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+			return caps
+		}
+	}
+	return 0
+}
+
+// readSysctl returns a /proc/sys value, or "" when it cannot be read
+func readSysctl(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// requirement is a host capability a benchmark's real backend needs
+type requirement struct {
+	description string
+	met         func(c *Capabilities) bool
+	flag        string   // Backend flag; when given explicitly the user's choice stands
+	fallback    []string // Arguments selecting a backend the host can run; nil skips the benchmark
+	simulated   bool     // There is no real backend yet: the benchmark always simulates what description names
+}
+
+// benchmarkRequirements are checked before a benchmark runs. Benchmarks
+// without an entry need nothing of the host; those whose only entry is
+// simulated model a BPF mechanism in userspace, whatever the host.
+var benchmarkRequirements = map[string][]requirement{
+	"kprobe": {{
+		description: "tracefs kprobe_events and CAP_PERFMON or CAP_SYS_ADMIN",
+		met:         func(c *Capabilities) bool { return c.KprobeEvents && c.CanTrace() },
+		flag:        "backend",
+		fallback:    []string{"-backend", probeBackendSim},
+	}},
+	"fentry": {{
+		description: "BTF, kernel 5.5 or newer and CAP_BPF with CAP_PERFMON or CAP_SYS_ADMIN",
+		met:         func(c *Capabilities) bool { return c.BTF && c.atLeast(5, 5) && c.CanLoadBPF() && c.CanTrace() },
+		flag:        "backend",
+		fallback:    []string{"-backend", probeBackendSim},
+	}},
+	"loader": {{
+		description: "CAP_BPF or CAP_SYS_ADMIN",
+		met:         func(c *Capabilities) bool { return c.CanLoadBPF() },
+		flag:        "backend",
+		fallback:    []string{"-backend", probeBackendSim},
+	}},
+	"map-contention": {{
+		description: "CAP_BPF with CAP_PERFMON or CAP_SYS_ADMIN",
+		met:         func(c *Capabilities) bool { return c.CanLoadBPF() && c.CanTrace() },
+		flag:        "backend",
+		fallback:    []string{"-backend", probeBackendSim},
+	}},
+	"rawtp": {{
+		description: "tracefs and CAP_BPF with CAP_PERFMON or CAP_SYS_ADMIN",
+		met:         func(c *Capabilities) bool { return c.Tracefs != "" && c.CanLoadBPF() && c.CanTrace() },
+		flag:        "backend",
+		fallback:    []string{"-backend", probeBackendSim},
+	}},
+	"ringbuf-output": {{
+		description: "kernel 5.8 or newer and CAP_BPF with CAP_PERFMON or CAP_SYS_ADMIN",
+		met:         func(c *Capabilities) bool { return c.atLeast(5, 8) && c.CanLoadBPF() && c.CanTrace() },
+		flag:        "backend",
+		fallback:    []string{"-backend", probeBackendSim},
+	}},
+	"ringbuf-wakeup": {{
+		description: "kernel 5.8 or newer and CAP_BPF with CAP_PERFMON or CAP_SYS_ADMIN",
+		met:         func(c *Capabilities) bool { return c.atLeast(5, 8) && c.CanLoadBPF() && c.CanTrace() },
+		flag:        "backend",
+		fallback:    []string{"-backend", probeBackendSim},
+	}},
+	"latency-threshold": {{
+		description: "sys_enter and sys_exit programs filtering on a start-time map",
+		simulated:   true,
+	}},
+	"pairing": {{
+		description: "sys_enter and sys_exit programs pairing in a hash map",
+		simulated:   true,
+	}},
+	"ringbuf-consumers": {{
+		description: "programs filling ring and perf buffers for several consumers",
+		simulated:   true,
+	}},
+	"ringbuf-contention": {{
+		description: "a ring buffer program reserving on every CPU at once",
+		simulated:   true,
+	}},
+	"ringbuf-percpu": {{
+		description: "a BPF_MAP_TYPE_ARRAY_OF_MAPS of ring buffers",
+		simulated:   true,
+	}},
+	"tailcall": {{
+		description: "CAP_BPF with CAP_PERFMON or CAP_SYS_ADMIN",
+		met:         func(c *Capabilities) bool { return c.CanLoadBPF() && c.CanTrace() },
+		flag:        "backend",
+		fallback:    []string{"-backend", probeBackendSim},
+	}},
+	"tc": {{
+		description: "CAP_BPF or CAP_SYS_ADMIN with CAP_NET_ADMIN",
+		met:         func(c *Capabilities) bool { return c.CanLoadBPF() && c.CapNetAdmin },
+		flag:        "backend",
+		fallback:    []string{"-backend", probeBackendSim},
+	}},
+	"xdp": {{
+		description: "kernel 5.9 or newer and CAP_BPF or CAP_SYS_ADMIN with CAP_NET_ADMIN",
+		met:         func(c *Capabilities) bool { return c.atLeast(5, 9) && c.CanLoadBPF() && c.CapNetAdmin },
+		flag:        "backend",
+		fallback:    []string{"-backend", probeBackendSim},
+	}},
+	"uprobe": {{
+		description: "tracefs uprobe_events and CAP_PERFMON or CAP_SYS_ADMIN",
+		met:         func(c *Capabilities) bool { return c.UprobeEvents && c.CanTrace() },
+		flag:        "backend",
+		fallback:    []string{"-backend", probeBackendSim},
+	}},
+}
+
+// adaptToHost checks a benchmark's requirements against the host. It
+// returns the arguments to run it with, downgraded where needed, and a
+// note per downgrade. skip is set when the host cannot run it at all.
+func adaptToHost(name string, args []string, c *Capabilities) (out []string, notes []string, skip bool) {
+	out = args
+	for _, req := range benchmarkRequirements[name] {
+		if req.simulated {
+			notes = append(notes, "simulated in userspace: no backend loads "+req.description)
+			continue
+		}
+		if req.met(c) || req.flag != "" && hasFlag(args, req.flag) {
+			continue
+		}
+		if req.fallback == nil {
+			return nil, []string{"skipped: needs " + req.description}, true
+		}
+		out = append(append([]string(nil), out...), req.fallback...)
+		notes = append(notes, fmt.Sprintf("host lacks %s; running with %s", req.description, strings.Join(req.fallback, " ")))
+	}
+	return out, notes, false
+}
+
+// hasFlag reports whether args set the named flag
+func hasFlag(args []string, name string) bool {
+	for _, a := range args {
+		a = strings.TrimLeft(a, "-")
+		if a == name || strings.HasPrefix(a, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// runCapabilities is the entry point of the capabilities subcommand
+func runCapabilities(args []string) error {
+	fs := flag.NewFlagSet("capabilities", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the capabilities as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c := ProbeCapabilities()
+	if *asJSON {
+		data, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	yesNo := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	PrintBenchmarkHeader("Host Capabilities")
+	fmt.Printf("Kernel:          %s\n", orNone(c.KernelRelease))
+	fmt.Printf("BTF (CO-RE):     %s\n", yesNo(c.BTF))
+	fmt.Printf("Tracefs:         %s (kprobes %s, uprobes %s)\n", orNone(c.Tracefs), yesNo(c.KprobeEvents), yesNo(c.UprobeEvents))
+	fmt.Printf("CAP_BPF:         %s\n", yesNo(c.CapBPF))
+	fmt.Printf("CAP_PERFMON:     %s\n", yesNo(c.CapPerfmon))
+	fmt.Printf("CAP_SYS_ADMIN:   %s\n", yesNo(c.CapSysAdmin))
+	fmt.Printf("CAP_NET_ADMIN:   %s\n", yesNo(c.CapNetAdmin))
+	fmt.Printf("Unpriv. BPF:     %s\n", orNone(c.UnprivilegedBPF))
+	fmt.Printf("BPF JIT:         %s\n", orNone(c.JITEnabled))
+	fmt.Println("Map types:")
+	for _, f := range mapFeatures {
+		fmt.Printf("  %-18s %s\n", f.name, c.MapTypes[f.name])
+	}
+	fmt.Println()
+
+	names := make([]string, 0, len(benchmarks))
+	for name := range benchmarks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		status := "✓ real backend"
+		if reqs := benchmarkRequirements[name]; len(reqs) == 0 {
+			status = "✓ no requirements"
+		} else if reqs[0].simulated {
+			_, notes, _ := adaptToHost(name, nil, c)
+			status = "~ " + strings.Join(notes, "; ")
+		} else if _, notes, skip := adaptToHost(name, nil, c); skip {
+			status = "✗ " + strings.Join(notes, "; ")
+		} else if len(notes) > 0 {
+			status = "↓ " + strings.Join(notes, "; ")
+		}
+		fmt.Printf("%-18s %s\n", name, status)
+	}
+	return nil
+}
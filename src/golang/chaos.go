@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// chaosFlagSet holds the flags of the consumer chaos mode
+type chaosFlagSet struct {
+	enabled  *bool
+	every    *time.Duration
+	maxPause *time.Duration
+	migrate  *bool
+	seed     *uint64
+}
+
+// addChaosFlags registers the chaos flags on fs
+func addChaosFlags(fs *flag.FlagSet) *chaosFlagSet {
+	return &chaosFlagSet{
+		enabled:  fs.Bool("chaos", false, "Disrupt the consumer at random: pause it and migrate its thread between CPUs"),
+		every:    fs.Duration("chaos-every", 250*time.Millisecond, "Mean time between chaos disruptions"),
+		maxPause: fs.Duration("chaos-pause", 20*time.Millisecond, "Longest consumer pause; pauses are uniform up to it (0 disables pauses)"),
+		migrate:  fs.Bool("chaos-migrate", true, "Also move the consumer thread to a random allowed CPU at each disruption"),
+		seed:     fs.Uint64("chaos-seed", 1, "Chaos schedule seed"),
+	}
+}
+
+// monkey validates the flags and returns a fresh chaos schedule, or nil
+// when chaos is off. Every run gets its own so each sees the same
+// disruptions.
+func (f *chaosFlagSet) monkey() (*chaosMonkey, error) {
+	if !*f.enabled {
+		return nil, nil
+	}
+	if *f.every <= 0 {
+		return nil, fmt.Errorf("-chaos-every must be positive")
+	}
+	if *f.maxPause < 0 {
+		return nil, fmt.Errorf("-chaos-pause must not be negative")
+	}
+	if *f.maxPause == 0 && !*f.migrate {
+		return nil, fmt.Errorf("-chaos with no pauses and no migrations does nothing")
+	}
+	return &chaosMonkey{
+		every:    *f.every,
+		maxPause: *f.maxPause,
+		migrate:  *f.migrate,
+		rng:      randomPayload{state: *f.seed | 1},
+		cpus:     readAllowedCPUs(),
+	}, nil
+}
+
+// ChaosStats describe the disruptions a consumer went through
+type ChaosStats struct {
+	MeanInterval      float64 // Configured mean seconds between disruptions
+	Pauses            int64
+	PausedSeconds     float64 // Total time the consumer was paused
+	MaxPauseMs        float64 // Longest single pause
+	Migrations        int64
+	MigrationFailures int64
+	CPUsVisited       int // Distinct CPUs the consumer was moved to
+}
+
+// chaosMonkey disrupts a consumer at exponentially distributed intervals.
+// It is driven from the consumer's own loop, so migrations move the
+// consumer's thread, which must be locked with runtime.LockOSThread.
+type chaosMonkey struct {
+	every    time.Duration
+	maxPause time.Duration
+	migrate  bool
+	rng      randomPayload
+	cpus     []int // Allowed CPUs, restored when the run ends
+	next     time.Time
+	stats    ChaosStats
+	visited  map[int]bool
+}
+
+// interval draws the time to the next disruption
+func (c *chaosMonkey) interval() time.Duration {
+	u := (float64(c.rng.next()>>11) + 0.5) / (1 << 53)
+	return time.Duration(-math.Log(u) * float64(c.every))
+}
+
+// start schedules the first disruption; disruptions begin with the
+// measured window
+func (c *chaosMonkey) start() {
+	if c == nil {
+		return
+	}
+	c.next = time.Now().Add(c.interval())
+	c.visited = make(map[int]bool)
+}
+
+// due reports whether a disruption is due at now; a nil monkey never is
+func (c *chaosMonkey) due(now time.Time) bool {
+	return c != nil && !c.next.IsZero() && !now.Before(c.next)
+}
+
+// disrupt migrates the calling thread if enabled, and returns how long the
+// consumer should now stay paused. The caller sleeps or skips its reads
+// for that long, so pauses are counted when they are handed out.
+func (c *chaosMonkey) disrupt(now time.Time) time.Duration {
+	c.next = now.Add(c.interval())
+	if c.migrate && len(c.cpus) > 1 {
+		cpu := c.cpus[c.rng.next()%uint64(len(c.cpus))]
+		if err := pinThread(cpu); err != nil {
+			c.stats.MigrationFailures++
+		} else {
+			c.stats.Migrations++
+			c.visited[cpu] = true
+		}
+	}
+	if c.maxPause <= 0 {
+		return 0
+	}
+	pause := time.Duration(c.rng.next() % uint64(c.maxPause+1))
+	c.stats.Pauses++
+	c.stats.PausedSeconds += pause.Seconds()
+	c.stats.MaxPauseMs = math.Max(c.stats.MaxPauseMs, float64(pause)/1e6)
+	c.next = c.next.Add(pause) // The consumer is not disrupted while paused
+	return pause
+}
+
+// stop restores the thread's CPU affinity and returns the counters. It
+// must run on the consumer's thread, before it is unlocked.
+func (c *chaosMonkey) stop() *ChaosStats {
+	if c == nil {
+		return nil
+	}
+	if c.stats.Migrations > 0 {
+		setThreadAffinity(c.cpus)
+	}
+	c.next = time.Time{}
+	s := c.stats
+	s.MeanInterval = c.every.Seconds()
+	s.CPUsVisited = len(c.visited)
+	return &s
+}
+
+// formatChaos renders the disruptions of a chaos run, if it was one
+func (r *BenchmarkResult) formatChaos() string {
+	s := r.Chaos
+	if s == nil {
+		return ""
+	}
+	parts := []string{fmt.Sprintf("every %.0fms on average", s.MeanInterval*1000)}
+	if s.Pauses > 0 {
+		parts = append(parts, fmt.Sprintf("%d pauses (%.3fs total, longest %.1fms)", s.Pauses, s.PausedSeconds, s.MaxPauseMs))
+	}
+	if s.Migrations > 0 || s.MigrationFailures > 0 {
+		parts = append(parts, fmt.Sprintf("%d migrations over %d CPUs", s.Migrations, s.CPUsVisited))
+	}
+	if s.MigrationFailures > 0 {
+		parts = append(parts, fmt.Sprintf("%d failed", s.MigrationFailures))
+	}
+	return "Chaos:           " + strings.Join(parts, ", ") + "\n"
+}
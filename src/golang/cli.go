@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// processSettingsHeld is set while a parallel suite runs its benchmarks:
+// the suite has installed the log handler and GC settings they share, and
+// their own options leave those alone rather than race to replace them
+var processSettingsHeld atomic.Bool
+
+// benchFlags are the flags shared by every benchmark subcommand
+type benchFlags struct {
+	fs          *flag.FlagSet
+	shared      map[string]bool // Names of the shared flags, left out of the identity
+	duration    *durationFlag   // nil for benchmarks sized by operation count
+	verbose     *bool
+	logLevel    *string
+	logFormat   *string
+	output      *string
+	pretty      *bool
+	latencyUnit *string
+	metricsAddr *string
+	influx      *string
+	otlp        *string
+	control     *string
+	tui         *bool
+	diskCheck   *string
+	format      *string
+	store       *string
+	tags        *string
+	iterations  *int
+	gogc        *string
+	gomemlimit  *string
+	goTrace     *string
+	goTraceWin  *time.Duration
+	goTraceWait *time.Duration
+	pprof       *string
+	perfCount   *bool
+	snapshotPct *float64
+}
+
+// durationFlag is a flag.Value accepting Go durations. Plain numbers are
+// read as seconds so existing "-d 10" invocations keep working.
+type durationFlag struct {
+	d time.Duration
+}
+
+func (f *durationFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.d.String()
+}
+
+func (f *durationFlag) Set(s string) error {
+	d, err := parseDuration(s)
+	if err != nil {
+		return err
+	}
+	f.d = d
+	return nil
+}
+
+// parseDuration parses a Go duration, or a number of seconds
+func parseDuration(s string) (time.Duration, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q (e.g. 10, 500ms, 2m30s)", s)
+	}
+	return d, nil
+}
+
+// benchOptions are the parsed shared flags
+type benchOptions struct {
+	Duration    time.Duration
+	Verbose     bool
+	Output      string
+	Pretty      bool
+	Format      string   // Empty to infer from Output
+	Store       string   // History store to append to, if any
+	Influx      string   // InfluxDB write URL or line protocol file, if any
+	OTLP        string   // OTLP/HTTP collector endpoint or JSON lines file, if any
+	Tags        []string // Tags of stored results
+	Iterations  int      // Times to run the benchmark
+	DiskCheck   string   // What to do when artifacts will not fit: refuse, warn or off
+	LogLevel    string   // As given; empty to follow Verbose
+	LogFormat   string
+	LatencyUnit LatencyUnit
+	Params      map[string]string // Benchmark-specific flag values; see BenchmarkIdentity
+}
+
+// addBenchFlags registers the shared flags on fs. Timed benchmarks also get
+// -d; the others run a fixed number of operations.
+func addBenchFlags(fs *flag.FlagSet, defaultOutput string, timed bool) *benchFlags {
+	before := make(map[string]bool)
+	fs.VisitAll(func(fl *flag.Flag) { before[fl.Name] = true })
+	f := &benchFlags{
+		fs:          fs,
+		verbose:     fs.Bool("v", false, "Verbose output (same as -log-level info)"),
+		logLevel:    fs.String("log-level", "", "Log records at or above this level: debug, info, warn or error (default info with -v, else warn)"),
+		logFormat:   fs.String("log-format", logFormatText, "Log format: text status lines, or json records on stderr for machine parsing"),
+		output:      fs.String("o", defaultOutput, "Output file"),
+		format:      fs.String("format", "", "Output format: json, jsonl or csv (default from the -o extension, else json)"),
+		pretty:      fs.Bool("pretty", true, "Pretty-print JSON output"),
+		latencyUnit: fs.String("latency-unit", "us", "Latency display unit (ns, us, ms)"),
+		metricsAddr: fs.String("metrics-addr", "", "Serve live Prometheus metrics on this address (e.g. :9100)"),
+		influx:      fs.String("influx", "", "Push results and per-second series as InfluxDB line protocol to this write URL (e.g. http://localhost:8086/api/v2/write?org=O&bucket=B) or file"),
+		otlp:        fs.String("otlp", "", "Export results as OpenTelemetry phase spans and metrics to this OTLP/HTTP endpoint (e.g. http://localhost:4318) or JSON lines file"),
+		control:     fs.String("control", "", "Accept annotate notes on this Unix socket or host:port (e.g. "+defaultControlSocket+")"),
+		tui:         fs.Bool("tui", false, "Show a live terminal dashboard of throughput, drops, per-CPU events and latency while collecting (replaces -v)"),
+		store:       fs.String("store", "", "Also append results to this history store (e.g. "+defaultStorePath+", or sqlite:FILE)"),
+		tags:        fs.String("tags", "", "Comma-separated tags for stored results (tagged runs survive prune)"),
+		iterations:  fs.Int("iterations", 1, "Run the benchmark this many times and report aggregate statistics"),
+		diskCheck:   fs.String("disk-check", diskCheckRefuse, "When the estimated result files and event dumps exceed the free disk space: refuse, warn or off"),
+		gogc:        fs.String("gogc", "", "Go GC percent for the run, or off (default from GOGC)"),
+		gomemlimit:  fs.String("gomemlimit", "", "Go soft memory limit for the run, e.g. 512MiB, or off (default from GOMEMLIMIT)"),
+		goTrace:     fs.String("go-trace", "", "Write a Go execution trace of the consumer to this file and correlate throughput dips with scheduler latency, GC and blocking"),
+		goTraceWin:  fs.Duration("go-trace-window", 2*time.Second, "Length of the -go-trace window"),
+		goTraceWait: fs.Duration("go-trace-delay", 0, "Start -go-trace this long after collection starts"),
+		pprof:       fs.String("pprof", "", "Profile the consumer over the measured window: cpu, heap or cpu,heap, saved next to -o as NAME_cpu.pprof and NAME_heap.pprof"),
+		perfCount:   fs.Bool("perf-counters", false, "Count cycles, instructions, cache misses and context switches of the process with perf_event_open and report IPC and cache-miss rate"),
+		snapshotPct: fs.Float64("snapshot-on-drop", 0, "Save the top CPU consumers, interrupt counts, buffer occupancy and GC stats next to -o as NAME_snapshot_N.json when throughput falls by more than this percent from one second to the next (0 disables)"),
+	}
+	if timed {
+		f.duration = &durationFlag{10 * time.Second}
+		fs.Var(f.duration, "d", "Benchmark duration (Go duration such as 500ms or 2m30s; plain numbers are seconds)")
+	}
+	f.shared = make(map[string]bool)
+	fs.VisitAll(func(fl *flag.Flag) {
+		if !before[fl.Name] {
+			f.shared[fl.Name] = true
+		}
+	})
+	return f
+}
+
+// applyProcessSettings installs the log handler and GC settings of the
+// flags, which are process-wide, and reports whether info records are
+// logged
+func (f *benchFlags) applyProcessSettings() (bool, error) {
+	verbose, err := configureLogging(*f.logLevel, *f.logFormat, *f.verbose)
+	if err != nil {
+		return verbose, err
+	}
+	return verbose, applyGCSettings(*f.gogc, *f.gomemlimit)
+}
+
+// options validates and returns the parsed shared flags, starting the
+// metrics exporter, control server and dashboard if requested
+func (f *benchFlags) options() (benchOptions, error) {
+	opts := benchOptions{
+		Verbose:    *f.verbose,
+		Output:     *f.output,
+		Pretty:     *f.pretty,
+		Format:     *f.format,
+		Store:      *f.store,
+		Influx:     *f.influx,
+		OTLP:       *f.otlp,
+		Tags:       splitList(*f.tags),
+		Iterations: *f.iterations,
+		DiskCheck:  *f.diskCheck,
+		LogLevel:   *f.logLevel,
+		LogFormat:  *f.logFormat,
+		Params:     benchmarkParams(f.fs, f.shared),
+	}
+	if processSettingsHeld.Load() {
+		opts.Verbose = logLevel.Level() <= slog.LevelInfo
+	} else {
+		verbose, err := f.applyProcessSettings()
+		if err != nil {
+			return opts, err
+		}
+		opts.Verbose = verbose
+	}
+	if opts.Iterations < 1 {
+		return opts, fmt.Errorf("-iterations must be at least 1")
+	}
+	if f.duration != nil {
+		if f.duration.d <= 0 {
+			return opts, fmt.Errorf("-d must be positive")
+		}
+		opts.Duration = f.duration.d
+	}
+	unit, err := ParseLatencyUnit(*f.latencyUnit)
+	if err != nil {
+		return opts, fmt.Errorf("invalid -latency-unit: %w", err)
+	}
+	opts.LatencyUnit = unit
+	if _, err := NewResultWriter(opts.Format, opts.Output, opts.Pretty); err != nil {
+		return opts, fmt.Errorf("invalid -format: %w", err)
+	}
+	switch opts.DiskCheck {
+	case diskCheckRefuse, diskCheckWarn, diskCheckOff:
+	default:
+		return opts, fmt.Errorf("invalid -disk-check %q (want refuse, warn or off)", opts.DiskCheck)
+	}
+	if *f.goTraceWin <= 0 {
+		return opts, fmt.Errorf("-go-trace-window must be positive")
+	}
+	if *f.goTraceWait < 0 {
+		return opts, fmt.Errorf("-go-trace-delay must not be negative")
+	}
+	artifacts := opts.resultArtifacts(0)
+	if *f.goTrace != "" {
+		artifacts = append(artifacts, artifact{*f.goTrace, uint64(f.goTraceWin.Seconds() * goTraceBytesPerSec), "Go trace"})
+	}
+	if err := opts.checkDisk(artifacts...); err != nil {
+		return opts, err
+	}
+	if *f.metricsAddr != "" {
+		if err := startMetricsServer(*f.metricsAddr); err != nil {
+			return opts, err
+		}
+	}
+	if opts.Influx != "" {
+		startSeriesRecorder()
+	}
+	profiles, err := parseProfileKinds(*f.pprof)
+	if err != nil {
+		return opts, err
+	}
+	if len(profiles) > 0 {
+		startProfiler(profiles, opts.Output)
+	}
+	if *f.snapshotPct < 0 || *f.snapshotPct >= 100 {
+		return opts, fmt.Errorf("-snapshot-on-drop must be a percentage from 0 to below 100")
+	}
+	if *f.snapshotPct > 0 {
+		startSnapshots(*f.snapshotPct, opts.Output)
+	}
+	if *f.perfCount {
+		if err := startPerfCounters(); err != nil {
+			return opts, err
+		}
+	}
+	if *f.goTrace != "" {
+		startGoTrace(*f.goTrace, *f.goTraceWin, *f.goTraceWait)
+	}
+	if *f.control != "" {
+		if err := startControlServer(*f.control); err != nil {
+			return opts, err
+		}
+	}
+	if *f.tui {
+		opts.Verbose = false // Status lines would scroll the dashboard away
+		logLevel.Set(max(logLevel.Level(), slog.LevelWarn))
+		startDashboard(os.Stdout, unit)
+	}
+	slog.Debug("Options", "duration", opts.Duration, "output", opts.Output, "format", opts.Format,
+		"store", opts.Store, "iterations", opts.Iterations, "disk_check", opts.DiskCheck)
+	return opts, nil
+}
+
+// benchmarkFunc parses a benchmark subcommand's flags and runs it until it
+// finishes or ctx is cancelled
+type benchmarkFunc func(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error)
+
+// benchmark is a benchmark subcommand, also runnable from a suite
+type benchmark struct {
+	run         benchmarkFunc
+	timed       bool // Accepts the shared -d flag
+	description string
+}
+
+// benchmarks are the benchmark subcommands. They are registered in
+// commands by init and can be run together by the suite subcommand.
+var benchmarks = map[string]benchmark{
+	"calibrate":          {runCalibrateBenchmark, true, "Harness latency floor from pipe and eventfd round trips"},
+	"fentry":             {runFentryOverhead, false, "fentry/fexit attach latency and per-call overhead beside the kprobe on the same function"},
+	"kprobe":             {runKprobeOverhead, false, "Kprobe attach/detach latency and per-call overhead"},
+	"latency-threshold":  {runLatencyFilterBenchmark, true, "Syscall latency tracer emitting only exits above an in-kernel threshold: event volume and consumer load by threshold"},
+	"loader":             {runLoaderBenchmark, false, "BPF program verification, JIT and load time by program size"},
+	"map-contention":     {runMapContentionBenchmark, true, "BPF_MAP_TYPE_HASH vs PERCPU_HASH update throughput and lock contention as producer CPUs are added"},
+	"maps":               {runMapsBenchmark, false, "BPF map update/lookup/delete throughput"},
+	"mock":               {runMockBenchmark, false, "Scripted events, losses and timing through the statistics and reporting pipeline, checked against the script"},
+	"pairing":            {runPairingBenchmark, true, "sys_enter/sys_exit paired in the kernel through a hash map by tid, against emitting both raw events: map churn cost and pairing accuracy"},
+	"perfbuf":            {runPerfBufBenchmark, true, "Perf event array throughput"},
+	"rawtp":              {runRawTracepointBenchmark, false, "raw_tracepoint against tracepoint attach latency and per-call overhead on the same event"},
+	"reencode":           {runReencodeBenchmark, true, "Re-encoding consumed events to raw, JSON and protobuf for shipping upstream: cost and size"},
+	"replay":             {runReplayBenchmark, false, "Events of a ringbuf -dump fed back through the statistics pipeline, recomputing the result without the kernel side"},
+	"ringbuf":            {runRingBufferBenchmark, true, "Ring buffer throughput (default)"},
+	"ringbuf-consumers":  {runConsumerScalingBenchmark, true, "Ring buffer and perf buffer throughput as consumer goroutines are added"},
+	"ringbuf-contention": {runContentionBenchmark, true, "Shared ring buffer reserve failures and per-CPU emit latency as producers are added"},
+	"ringbuf-output":     {runOutputBenchmark, true, "bpf_ringbuf_reserve/submit against bpf_ringbuf_output with a copy from the stack: paired throughput and drop rate"},
+	"ringbuf-percpu":     {runPerCPURingBenchmark, true, "Per-CPU ring buffer array vs one shared ring buffer under producer contention"},
+	"ringbuf-wakeup":     {runWakeupBenchmark, true, "Ring buffer wakeup strategies with epoll and busy-poll consumers"},
+	"schema-compat":      {runSchemaCompatBenchmark, true, "Old and new event structs across raw, prefix, versioned and TLV framing: graceful degradation and encoding cost"},
+	"tailcall":           {runTailCallBenchmark, false, "Per-invocation cost of tail calls and bpf-to-bpf calls against inline code on a high-rate tracepoint"},
+	"tc":                 {runTCBenchmark, true, "TC (clsact) classifier throughput on a veth pair"},
+	"uprobe":             {runUprobeBenchmark, false, "Uprobe event delivery throughput and per-call overhead"},
+	"workload":           {runWorkloadBenchmark, true, "Generate a known syscall, network or scheduler load from child processes"},
+	"xdp":                {runXDPBenchmark, true, "XDP packet-processing throughput on a veth pair"},
+}
+
+func init() {
+	for name, b := range benchmarks {
+		commands[name] = command{benchmarkCommand(name, b.run), b.description}
+	}
+}
+
+// benchmarkCommand adapts a benchmarkFunc to a subcommand that saves and
+// prints its results
+func benchmarkCommand(name string, run benchmarkFunc) func(args []string) error {
+	return func(args []string) error {
+		args, notes, skip := adaptToHost(name, args, hostCapabilities())
+		for _, note := range notes {
+			slog.Warn(note, "benchmark", name)
+		}
+		if skip {
+			return fmt.Errorf("host cannot run this benchmark (see the capabilities subcommand)")
+		}
+		ctx, stop := signalContext()
+		defer stop()
+		results, opts, err := runIterations(ctx, name, run, args)
+		if err != nil {
+			return err
+		}
+		emitResults(results, opts)
+		emitAggregates(results, opts)
+		return nil
+	}
+}
+
+// emitResults applies the display unit, validates the metrics, attaches
+// the annotations taken during each run, saves results to the output file
+// and history store, exports them to InfluxDB and OTLP and prints them.
+// In JSON a single result is saved as an object, several as an array;
+// JSONL and CSV files are appended to.
+func emitResults(results []*BenchmarkResult, opts benchOptions) {
+	start := time.Now()
+	for _, r := range results {
+		r.LatencyUnit = opts.LatencyUnit
+		r.CheckQuality()
+		r.Annotations = annotationsBetween(r.StartTime, r.EndTime)
+		r.normalizeTimes()
+	}
+	for _, r := range results {
+		if r.Timing != nil {
+			r.Timing.ReportSeconds = time.Since(start).Seconds()
+			r.Timing.total()
+		}
+	}
+
+	w, err := NewResultWriter(opts.Format, opts.Output, opts.Pretty)
+	if err == nil {
+		err = w.Write(results)
+	}
+	if err != nil {
+		slog.Warn("Failed to save result", "output", opts.Output, "err", err)
+	} else {
+		slog.Info("Result saved", "output", opts.Output)
+	}
+	if opts.Store != "" {
+		if _, err := OpenResultStore(opts.Store).Append(results, opts.Tags); err != nil {
+			slog.Warn("Failed to store result", "store", opts.Store, "err", err)
+		} else {
+			slog.Info("Result stored", "store", opts.Store)
+		}
+	}
+	if opts.Influx != "" {
+		if err := exportInflux(opts.Influx, results); err != nil {
+			slog.Warn("Failed to export result", "influx", opts.Influx, "err", err)
+		} else {
+			slog.Info("Result exported", "influx", opts.Influx)
+		}
+	}
+	if opts.OTLP != "" {
+		if err := exportOTLP(opts.OTLP, results); err != nil {
+			slog.Warn("Failed to export result", "otlp", opts.OTLP, "err", err)
+		} else {
+			slog.Info("Result exported", "otlp", opts.OTLP)
+		}
+	}
+
+	for _, r := range results {
+		PrintSeparator()
+		fmt.Print(r.String())
+	}
+	PrintSeparator()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/parlakisik/ebpf_benchmark/src/golang/workloadgen"
+)
+
+// command is a subcommand selected by the first command-line argument
+type command struct {
+	run         func(args []string) error
+	description string
+}
+
+// commands maps subcommand names to their implementations. Benchmark
+// subcommands are added from benchmarks by init.
+var commands = map[string]command{
+	"alloc-audit":       {runAllocAudit, "Fail if a per-event consumer path allocates, listing the sites"},
+	"annotate":          {runAnnotate, "Add a timestamped note to the timeline of a running benchmark"},
+	"baseline":          {runBaseline, "Promote a stored run to the baseline used by compare"},
+	"capabilities":      {runCapabilities, "Probe kernel features and privileges the benchmarks need"},
+	"compare":           {runCompare, "Compare results against a baseline and fail on regressions"},
+	"compare-languages": {runCompareLanguages, "Compare one benchmark's results across implementation languages"},
+	"doctor":            {runDoctor, "Check host configuration for stable benchmark runs"},
+	"history":           {runHistory, "List stored runs and plot metric trends over time"},
+	"init":              {runInit, "Probe the host, ask what to compare and write a ready-to-run suite config"},
+	"matrix":            {runVMMatrix, "Run a benchmark across kernels in vmtest/qemu VMs"},
+	"mitigations":       {runMitigationsReport, "Show mitigation status or compare results by mitigation profile"},
+	"prune":             {runPrune, "Delete old and invalid runs from the history store"},
+	"report":            {runReport, "Summarize result files in a table"},
+	"suite":             {runSuite, "Run several benchmarks back to back"},
+}
+
+// defaultCommand runs when the first argument is a flag or missing, so
+// "ebpf-bench -d 10" keeps working as the ring buffer benchmark
+const defaultCommand = "ringbuf"
+
+func main() {
+	workloadgen.RunChild()
+	args := os.Args[1:]
+	if len(args) == 1 && isHelpFlag(args[0]) || len(args) > 0 && args[0] == "help" {
+		printUsage()
+		return
+	}
+	name := defaultCommand
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown subcommand %q\n", name)
+		printUsage()
+		os.Exit(2)
+	}
+	if err := cmd.run(args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+// isHelpFlag reports whether arg asks for usage
+func isHelpFlag(arg string) bool {
+	return arg == "-h" || arg == "-help" || arg == "--help"
+}
+
+// printUsage lists the available subcommands
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Usage: %s <subcommand> [flags]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [ringbuf flags]\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "\nSubcommands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-18s %s\n", name, commands[name].description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <subcommand> -h' for subcommand flags.\n", os.Args[0])
+}
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
 // Event matches the kernel-space structure
@@ -14,61 +22,509 @@ type Event struct {
 	Data      uint32 // Generic data field
 }
 
-// BenchmarkResult stores benchmark metrics
+// BenchmarkResult stores benchmark metrics. The headline figures are its
+// own fields; the rest is grouped by what it describes. The groups are
+// embedded, so their fields are reached as r.GC and the like and the
+// result JSON keeps its flat field names.
 type BenchmarkResult struct {
-	Name          string
-	Language      string
-	ProgramType   string
-	DataMechanism string
-	Duration      float64
-	EventCount    int64
-	Throughput    float64
-	CPUUsage      float64
-	MemoryUsage   uint64
-	StartTime     time.Time
-	EndTime       time.Time
-	Errors        []string
-}
-
-// EventBuffer manages event collection
+	Name           string
+	Benchmark      string // Subcommand that produced the result
+	Iteration      int    // 1-based run number under -iterations, else 0
+	Language       string
+	ProgramType    string
+	Tracepoint     string // Tracepoint the program attaches to (category:name), if selected
+	DataMechanism  string
+	ReaderStrategy string // How the consumer drained events (e.g. polling)
+	Duration       float64
+	EventCount     int64
+	DroppedEvents  int64      // Events lost before reaching the consumer
+	DropRate       float64    // DroppedEvents / (EventCount + DroppedEvents)
+	Drops          DropCounts // DroppedEvents by cause
+	Throughput     float64
+	CPUUsage       float64
+	CPUBudget      CPUBudget
+	MemoryUsage    uint64
+	Latency        LatencyStats // Between consecutive event timestamps
+	Host           HostInfo
+	StartTime      time.Time // UTC once reported
+	EndTime        time.Time
+	Errors         []string
+	Quality        DataQuality // Data-quality issues found in the measurements
+
+	RunContext
+	WorkloadSetup
+	LatencyDetail
+	Breakdowns
+	EventCapture
+	RuntimeDiagnostics
+	BenchmarkSections
+}
+
+// RunContext places a run among others: its schedule, window and clock,
+// and what it can be compared with
+type RunContext struct {
+	Scheduled        *ScheduledRun      // Run of a scheduled suite; nil when run directly
+	Warmup           float64            // Seconds run before Duration, excluded from the metrics
+	Cooldown         float64            // Seconds run after Duration, excluded from the metrics
+	UTCOffset        string             `json:",omitempty"` // Offset of the recording host's zone at StartTime, e.g. +02:00
+	TimeZone         string             `json:",omitempty"` // Recording host's time zone, e.g. Europe/Berlin
+	MonotonicSeconds float64            `json:",omitempty"` // StartTime to EndTime on the monotonic clock
+	Timing           *PhaseTiming       // Wall time of each lifecycle phase of the run
+	Identity         *BenchmarkIdentity // What was measured, for comparability checks; nil in results from before it was recorded
+	Annotations      []Annotation       // Operator notes taken during the run (see annotate)
+}
+
+// WorkloadSetup describes the load a run was driven with and how its
+// events were buffered
+type WorkloadSetup struct {
+	Payload      string             // Payload content generator (zeros, random, syscall)
+	HeaderStack  string             // Packet headers between the outer Ethernet and innermost UDP; packet benchmarks only
+	Encoding     *EncodingStats     // Ring record encoding; nil when events are handed over as structs
+	RateProfile  string             // Simulated event arrival schedule, if any
+	PageCache    string             // Page cache state of file workloads (warm, cold:<method>)
+	DropPolicy   string             // Full-buffer policy of the userspace buffer, if configurable
+	Affinity     *AffinityStats     // CPU pinning of the consumer and load generator; nil when unpinned
+	Coordination *CoordinationStats // Generator/program coordination channel; nil for the default atomic
+}
+
+// LatencyDetail holds latency measurements beyond the Latency summary
+type LatencyDetail struct {
+	LatencyUnit      LatencyUnit       // Display unit only; values are stored in ns
+	LatencyHistogram []HistogramBucket // HDR-style latency distribution
+	DeliveryLatency  *LatencyStats     // Kernel timestamp to userspace receipt, where measured
+	Outliers         *OutlierStats     // Context of the slowest deliveries, if captured
+}
+
+// Breakdowns split a run's events and operations by operation, event
+// type, CPU, consumer and attach point
+type Breakdowns struct {
+	Operations []OperationResult // Per-operation breakdown, if any
+	OverheadNs float64           // Per-call cost added by instrumentation, if measured
+	EventTypes []EventTypeStats  // Per-event-type breakdown when types share the buffer
+	CPUs       []CPUStats        // Per-CPU breakdown when events came from several CPUs
+	CPUSkew    float64           // Busiest CPU's events over the per-CPU mean; 1 is even
+	Consumers  *ScalingStats     // Per-consumer breakdown and scaling; ringbuf-consumers only
+	Interfaces []InterfaceStats  // Per-attach-point breakdown of multi-interface XDP runs
+}
+
+// EventCapture describes what was kept of the events themselves
+type EventCapture struct {
+	Streaming       *StreamingStats   // Online statistics state; nil when every event was kept
+	EventSample     *EventSample      // Reservoir of raw events, if requested
+	Compressibility *CompressionStats // How small the kept events would archive, if analysed
+	Archive         *ArchiveStats     // Compressed archive of the delivered events, if written
+	Dump            *DumpStats        // Binary dump of the received events, if written
+	Replay          *ReplayStats      // Dump the result was recomputed from; replay only
+}
+
+// RuntimeDiagnostics describe the harness process and the host while the
+// run was measured
+type RuntimeDiagnostics struct {
+	LoadGenerator *LoadGeneratorUsage // Load generator's own usage; nil when it shares the consumer's thread
+	BufferGrowth  *BufferGrowth       // On-demand buffer growth; nil when the buffer was preallocated
+	GC            *GCStats            // Go GC activity during the measured window
+	GoTrace       *GoTraceStats       // Go execution trace of part of the window, if taken
+	Profiles      *ProfileStats       // pprof profiles of the window, if taken
+	PerfCounters  *PerfCounterStats   // Hardware and scheduler counters of the window, if counted
+	Snapshots     []SnapshotRef       // System state captured on throughput drops, with -snapshot-on-drop
+	Stalls        *StallStats         // Consumer stalls seen by the ring monitor; nil when not monitored
+	Teardown      *TeardownStats      // Events drained after the measured window; nil if not tracked
+}
+
+// BenchmarkSections are the results particular to one benchmark; each is
+// nil in the others' results
+type BenchmarkSections struct {
+	FlowTable     *FlowTableStats     // Conntrack map of stateful XDP runs; nil when stateless
+	Chaos         *ChaosStats         // Consumer disruptions of a chaos run; nil otherwise
+	Handshake     *HandshakeStats     // Reader readiness at the start of the run, where the program waits on it
+	EmitCost      *EmitCostStats      // The producer's own timing of its emits; ringbuf-wakeup -self-time only
+	LatencyFilter *LatencyFilterStats // In-kernel threshold filtering; latency-threshold only
+	Pairing       *PairingStats       // Entry/exit pairing accuracy and cost; pairing only
+	OutputPair    *OutputPairStats    // Emit API and its paired comparison; ringbuf-output only
+	Schema        *SchemaStats        // Event framing across schema versions; schema-compat only
+	Reencode      *ReencodeStats      // Upstream format of consumed events; reencode only
+	Program       *ProgramStats       // Size of the loaded program; loader only
+}
+
+// DropCounts breaks dropped events down by where they were lost
+type DropCounts struct {
+	BufferFull    int64 // Userspace EventBuffer at capacity
+	ReserveFailed int64 // Kernel bpf_ringbuf_reserve failures
+	LostSamples   int64 // Perf buffer lost samples (PERF_RECORD_LOST)
+	Overwritten   int64 // Oldest events overwritten under the drop-old policy
+	BlockTimeouts int64 // Events rejected after the block policy timed out
+}
+
+// Total returns the number of dropped events across all causes
+func (d DropCounts) Total() int64 {
+	return d.BufferFull + d.ReserveFailed + d.LostSamples + d.Overwritten + d.BlockTimeouts
+}
+
+// RecordDrops stores drop counts and derives the drop rate against the
+// delivered EventCount, which must already be set
+func (r *BenchmarkResult) RecordDrops(d DropCounts) {
+	r.Drops = d
+	r.DroppedEvents = d.Total()
+	if offered := r.EventCount + r.DroppedEvents; offered > 0 {
+		r.DropRate = float64(r.DroppedEvents) / float64(offered)
+	}
+}
+
+// OperationResult stores metrics for one operation within a benchmark,
+// such as map lookups or probe attaches
+type OperationResult struct {
+	Name       string
+	Count      int64
+	Duration   float64       // Seconds
+	Throughput float64       // Operations per second
+	AvgNs      float64       // Mean time per operation
+	Latency    *LatencyStats // Per-operation latency distribution, if sampled
+}
+
+// NewOperationResult derives throughput and mean latency for an operation
+func NewOperationResult(name string, count int64, elapsed time.Duration) OperationResult {
+	op := OperationResult{Name: name, Count: count, Duration: elapsed.Seconds()}
+	if elapsed > 0 && count > 0 {
+		op.Throughput = float64(count) / elapsed.Seconds()
+		op.AvgNs = float64(elapsed.Nanoseconds()) / float64(count)
+	}
+	return op
+}
+
+// EventBuffer manages event collection. It is not safe for concurrent
+// Add; see ShardedEventBuffer.
 type EventBuffer struct {
-	events    []Event
-	maxSize   int
-	startTime time.Time
-	endTime   time.Time
+	events      []Event   // Current chunk, or all events when preallocated
+	chunks      [][]Event // Full chunks before events, in growing mode
+	sealed      int       // Events held in chunks
+	chunkSize   int       // Growth step; 0 when preallocated
+	growth      BufferGrowth
+	maxSize     int
+	quantiles   []float64
+	policy      DropPolicy
+	timeout     time.Duration // Longest wait for space under the block policy
+	head        int           // Oldest event once drop-old has wrapped
+	dropped     int64
+	overwritten int64
+	timedOut    int64
+	kept        atomic.Int64 // Events added, for Release
+	released    atomic.Int64 // Events whose space the consumer has freed
+	mu          sync.Mutex   // Guards the wait for space
+	space       *sync.Cond   // Signalled when Release frees space
+	progress    *Progress    // Live counters for the metrics exporter, if any
+	delivery    deliveryRecorder
+	stream      *streamStats // Online statistics in place of events, in streaming mode
+	reservoir   *eventReservoir
+	clock       func() time.Time // Time source of Start, End and receipt; nil for the wall clock
+	startTime   time.Time
+	endTime     time.Time
 }
 
 // NewEventBuffer creates a new event buffer
 func NewEventBuffer(maxSize int) *EventBuffer {
 	return &EventBuffer{
-		events:  make([]Event, 0, maxSize),
-		maxSize: maxSize,
+		events:    make([]Event, 0, maxSize),
+		maxSize:   maxSize,
+		quantiles: DefaultQuantiles,
+		policy:    DropNewest,
+		timeout:   DefaultBlockTimeout,
 	}
 }
 
-// Add adds an event to the buffer
+// NewStreamingEventBuffer creates an event buffer that keeps no events.
+// Counts, the latency histogram and t-digest percentiles, overall and per
+// CPU and event type, are updated as each event arrives, so memory stays
+// bounded however long the run. It never fills, so nothing is dropped,
+// and its histogram is kept at DefaultHistogramPrecision.
+func NewStreamingEventBuffer() *EventBuffer {
+	eb := NewEventBuffer(0)
+	eb.stream = newStreamStats()
+	return eb
+}
+
+// GetStreamingStats describes the online statistics, or nil when the
+// buffer keeps its events
+func (eb *EventBuffer) GetStreamingStats() *StreamingStats {
+	if eb.stream == nil {
+		return nil
+	}
+	return eb.stream.summary()
+}
+
+// BufferGrowth records what growing an EventBuffer on demand cost
+type BufferGrowth struct {
+	ChunkSize      int    // Events per chunk
+	Chunks         int    // Chunks allocated during collection
+	AllocatedBytes uint64 // Backing storage allocated for them
+	PauseNs        int64  // Total time spent allocating chunks
+	MaxPauseNs     int64  // Longest single allocation
+	CompactNs      int64  // Time spent joining the chunks for analysis
+}
+
+// NewGrowingEventBuffer creates an event buffer that allocates storage in
+// chunks of chunkSize events as they arrive, up to maxSize, instead of
+// preallocating it. Earlier chunks are never copied while collecting, so
+// each growth step costs one allocation; the chunks are joined once when
+// the events are analysed.
+func NewGrowingEventBuffer(chunkSize, maxSize int) *EventBuffer {
+	eb := NewEventBuffer(0)
+	eb.maxSize = maxSize
+	eb.chunkSize = chunkSize
+	eb.growth.ChunkSize = chunkSize
+	return eb
+}
+
+// grow seals the current chunk and allocates the next one
+func (eb *EventBuffer) grow() {
+	start := time.Now()
+	if len(eb.events) > 0 {
+		eb.chunks = append(eb.chunks, eb.events)
+		eb.sealed += len(eb.events)
+	}
+	size := min(eb.chunkSize, eb.maxSize-eb.sealed)
+	eb.events = make([]Event, 0, size)
+	pause := time.Since(start).Nanoseconds()
+
+	eb.growth.Chunks++
+	eb.growth.AllocatedBytes += uint64(size) * uint64(unsafe.Sizeof(Event{}))
+	eb.growth.PauseNs += pause
+	eb.growth.MaxPauseNs = max(eb.growth.MaxPauseNs, pause)
+}
+
+// GetGrowth returns the buffer's growth accounting, or nil when it was
+// preallocated
+func (eb *EventBuffer) GetGrowth() *BufferGrowth {
+	if eb.chunkSize == 0 {
+		return nil
+	}
+	g := eb.growth
+	return &g
+}
+
+// SetDropPolicy selects how a full buffer handles new events. timeout
+// bounds how long DropBlock waits for a consumer's Release to free space
+// before it rejects the event; the wait shows up in latency and
+// throughput.
+func (eb *EventBuffer) SetDropPolicy(policy DropPolicy, timeout time.Duration) {
+	eb.policy = policy
+	eb.timeout = timeout
+}
+
+// Release frees the space of up to n of the oldest events still held, as
+// a consumer downstream of the buffer does once it has processed them,
+// and wakes an Add waiting under the block policy. Released events stay
+// in the statistics; the buffer's capacity bounds those not yet released.
+// It may be called while another goroutine adds, and returns the number
+// released.
+func (eb *EventBuffer) Release(n int) int {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	n = int(min(int64(n), eb.kept.Load()-eb.released.Load()))
+	if n <= 0 {
+		return 0
+	}
+	eb.released.Add(int64(n))
+	if eb.space != nil {
+		eb.space.Broadcast()
+	}
+	return n
+}
+
+// full reports whether the events not yet released fill the buffer
+func (eb *EventBuffer) full() bool {
+	return eb.kept.Load()-eb.released.Load() >= int64(eb.maxSize)
+}
+
+// waitForSpace blocks until a Release makes room or the block timeout
+// passes, reporting whether there is room
+func (eb *EventBuffer) waitForSpace() bool {
+	deadline := time.Now().Add(eb.timeout)
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	if eb.space == nil {
+		eb.space = sync.NewCond(&eb.mu)
+	}
+	for eb.full() {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return false
+		}
+		timer := time.AfterFunc(wait, func() {
+			eb.mu.Lock()
+			eb.space.Broadcast()
+			eb.mu.Unlock()
+		})
+		eb.space.Wait()
+		timer.Stop()
+	}
+	return true
+}
+
+// SetQuantiles sets the percentiles reported by GetLatencyStats
+func (eb *EventBuffer) SetQuantiles(quantiles []float64) {
+	eb.quantiles = quantiles
+}
+
+// SetProgress publishes the buffer's counts to the metrics exporter. A nil
+// Progress disables it.
+func (eb *EventBuffer) SetProgress(p *Progress) {
+	eb.progress = p
+	if p != nil && eb.stream == nil {
+		p.capacity.Store(int64(eb.maxSize))
+	}
+}
+
+// Add adds an event to the buffer. Events that do not fit are handled by
+// the drop policy and counted by cause.
 func (eb *EventBuffer) Add(e Event) bool {
-	if len(eb.events) >= eb.maxSize {
+	eb.delivery.recordEvent(&e, eb.nowNs(), eb.sealed+len(eb.events), eb.maxSize)
+	if eb.reservoir != nil {
+		eb.reservoir.add(e)
+	}
+	if eb.stream != nil {
+		eb.stream.add(e)
+		if eb.progress != nil {
+			eb.progress.delivered(&e)
+		}
+		return true
+	}
+	if !eb.full() || eb.policy == DropBlock && eb.waitForSpace() {
+		if len(eb.events) == cap(eb.events) && eb.chunkSize > 0 {
+			eb.grow()
+		}
+		// Past a preallocated buffer's capacity only once the consumer
+		// has released space, and then append grows it
+		eb.events = append(eb.events, e)
+		eb.kept.Add(1)
+		if eb.progress != nil {
+			eb.progress.delivered(&e)
+		}
+		return true
+	}
+	if eb.progress != nil {
+		eb.progress.dropped.Add(1)
+	}
+	switch eb.policy {
+	case DropOldest:
+		if eb.maxSize == 0 {
+			break
+		}
+		if eb.chunks != nil {
+			eb.ordered() // Overwriting needs one contiguous slice
+		}
+		eb.events[eb.head] = e
+		eb.head = (eb.head + 1) % eb.maxSize
+		eb.overwritten++
+		if eb.progress != nil {
+			eb.progress.delivered(&e)
+		}
+		return true
+	case DropBlock:
+		eb.timedOut++
 		return false
 	}
-	eb.events = append(eb.events, e)
-	return true
+	eb.dropped++
+	return false
+}
+
+// SetClock replaces the wall clock the buffer reads at Start, End and the
+// receipt of each event, so a scripted source controls every duration,
+// rate and delivery latency it reports
+func (eb *EventBuffer) SetClock(now func() time.Time) {
+	eb.clock = now
+}
+
+// now reads the buffer's clock
+func (eb *EventBuffer) now() time.Time {
+	if eb.clock != nil {
+		return eb.clock()
+	}
+	return time.Now()
+}
+
+// nowNs is now in Event.Timestamp units, without the indirection on the
+// wall clock
+func (eb *EventBuffer) nowNs() uint64 {
+	if eb.clock != nil {
+		return uint64(eb.clock().UnixNano())
+	}
+	return nowNs()
 }
 
 // Start marks the start of collection
 func (eb *EventBuffer) Start() {
-	eb.startTime = time.Now()
+	eb.startTime = eb.now()
 	eb.events = eb.events[:0] // Reset events
+	eb.chunks = nil
+	eb.sealed = 0
+	eb.growth = BufferGrowth{ChunkSize: eb.chunkSize}
+	eb.head = 0
+	eb.dropped = 0
+	eb.overwritten = 0
+	eb.timedOut = 0
+	eb.mu.Lock()
+	eb.kept.Store(0)
+	eb.released.Store(0)
+	eb.mu.Unlock()
+	eb.delivery.reset()
+	if eb.stream != nil {
+		eb.stream.reset()
+	}
+	if eb.reservoir != nil {
+		eb.reservoir.reset()
+	}
+	if eb.progress != nil {
+		eb.progress.start()
+	}
 }
 
 // End marks the end of collection
 func (eb *EventBuffer) End() {
-	eb.endTime = time.Now()
+	eb.endTime = eb.now()
+	if eb.progress != nil {
+		eb.progress.end()
+	}
 }
 
 // GetEventCount returns the number of events collected
 func (eb *EventBuffer) GetEventCount() int64 {
-	return int64(len(eb.events))
+	if eb.stream != nil {
+		return eb.stream.all.count
+	}
+	return int64(eb.sealed + len(eb.events))
+}
+
+// GetDroppedCount returns the number of events rejected because the
+// buffer was full
+func (eb *EventBuffer) GetDroppedCount() int64 {
+	return eb.dropped
+}
+
+// GetDropCounts returns the buffer's losses by drop policy
+func (eb *EventBuffer) GetDropCounts() DropCounts {
+	return DropCounts{BufferFull: eb.dropped, Overwritten: eb.overwritten, BlockTimeouts: eb.timedOut}
+}
+
+// ordered returns the events oldest first, joining chunks and undoing
+// drop-old wrapping
+func (eb *EventBuffer) ordered() []Event {
+	if eb.chunks != nil {
+		start := time.Now()
+		all := make([]Event, 0, eb.sealed+len(eb.events))
+		for _, c := range eb.chunks {
+			all = append(all, c...)
+		}
+		eb.events = append(all, eb.events...)
+		eb.chunks, eb.sealed = nil, 0
+		eb.growth.CompactNs += time.Since(start).Nanoseconds()
+	}
+	if eb.head != 0 {
+		slices.Reverse(eb.events[:eb.head])
+		slices.Reverse(eb.events[eb.head:])
+		slices.Reverse(eb.events)
+		eb.head = 0
+	}
+	return eb.events
 }
 
 // GetDuration returns the collection duration
@@ -88,57 +544,56 @@ func (eb *EventBuffer) GetThroughput() float64 {
 	return float64(eb.GetEventCount()) / duration
 }
 
-// GetLatencyStats calculates latency statistics
-func (eb *EventBuffer) GetLatencyStats() map[string]float64 {
-	if len(eb.events) < 2 {
-		return map[string]float64{
-			"min":     0,
-			"max":     0,
-			"average": 0,
-		}
+// latencySamples returns the nanosecond differences between consecutive
+// event timestamps. Backwards steps from clock skew are skipped and counter
+// wraps are bridged, both recorded in q.
+func (eb *EventBuffer) latencySamples(q *DataQuality) []uint64 {
+	events := eb.ordered()
+	if len(events) < 2 {
+		return nil
 	}
-
-	// Calculate latencies from timestamp differences
-	latencies := make([]float64, 0)
-	for i := 1; i < len(eb.events); i++ {
-		diff := float64(eb.events[i].Timestamp-eb.events[i-1].Timestamp) / 1000 // Convert to microseconds
-		latencies = append(latencies, diff)
-	}
-
-	var minLat, maxLat, sumLat float64
-	if len(latencies) > 0 {
-		minLat = latencies[0]
-		maxLat = latencies[0]
-		for _, lat := range latencies {
-			if lat < minLat {
-				minLat = lat
-			}
-			if lat > maxLat {
-				maxLat = lat
-			}
-			sumLat += lat
+	samples := make([]uint64, 0, len(events)-1)
+	for i := 1; i < len(events); i++ {
+		if d, ok := timestampDelta(events[i-1].Timestamp, events[i].Timestamp, q); ok {
+			samples = append(samples, d)
 		}
 	}
+	return samples
+}
 
-	avgLat := 0.0
-	if len(latencies) > 0 {
-		avgLat = sumLat / float64(len(latencies))
+// GetLatencyStats calculates latency statistics, including the configured
+// percentiles, from consecutive event timestamps
+func (eb *EventBuffer) GetLatencyStats() LatencyStats {
+	if eb.stream != nil {
+		return eb.stream.all.stats(eb.quantiles)
 	}
+	return computeLatencyStats(eb.latencySamples(&DataQuality{}), eb.quantiles)
+}
 
-	return map[string]float64{
-		"min":     minLat,
-		"max":     maxLat,
-		"average": avgLat,
+// GetLatencyHistogram builds an HDR-style histogram of the latency samples
+func (eb *EventBuffer) GetLatencyHistogram(precision uint) *LatencyHistogram {
+	if eb.stream != nil {
+		return eb.stream.histogram
+	}
+	h := NewLatencyHistogram(precision)
+	for _, ns := range eb.latencySamples(&DataQuality{}) {
+		h.Record(ns)
 	}
+	return h
 }
 
-// GetCPUs returns unique CPUs that generated events
-func (eb *EventBuffer) GetCPUs() map[uint32]bool {
-	cpus := make(map[uint32]bool)
-	for _, e := range eb.events {
-		cpus[e.CPU] = true
+// GetDataQuality reports timestamp problems in the collected events
+func (eb *EventBuffer) GetDataQuality() DataQuality {
+	var q DataQuality
+	if eb.stream != nil {
+		q = eb.stream.quality
+	} else {
+		eb.latencySamples(&q)
+	}
+	if eb.GetDuration() <= 0 && eb.GetEventCount() > 0 {
+		q.Flag(QualityZeroDuration)
 	}
-	return cpus
+	return q
 }
 
 // EventSize returns the size of an Event structure
@@ -154,36 +609,230 @@ func (e *Event) String() string {
 	)
 }
 
+// resultSections render the optional sections of a result, in the order
+// String prints them between End and Errors. Each returns "" when its
+// section is absent.
+var resultSections = []func(*BenchmarkResult) string{
+	(*BenchmarkResult).formatPhases,
+	(*BenchmarkResult).formatStreaming,
+	(*BenchmarkResult).formatEventSample,
+	(*BenchmarkResult).formatCompression,
+	(*BenchmarkResult).formatArchive,
+	(*BenchmarkResult).formatDump,
+	(*BenchmarkResult).formatReplay,
+	(*BenchmarkResult).formatDelivery,
+	(*BenchmarkResult).formatOutliers,
+	(*BenchmarkResult).formatHeaders,
+	(*BenchmarkResult).formatEncoding,
+	(*BenchmarkResult).formatLoadGenerator,
+	(*BenchmarkResult).formatBufferGrowth,
+	(*BenchmarkResult).formatOperations,
+	(*BenchmarkResult).formatEventTypes,
+	(*BenchmarkResult).formatCPUs,
+	(*BenchmarkResult).formatConsumers,
+	(*BenchmarkResult).formatInterfaces,
+	(*BenchmarkResult).formatFlowTable,
+	(*BenchmarkResult).formatAffinity,
+	(*BenchmarkResult).formatChaos,
+	(*BenchmarkResult).formatTeardown,
+	(*BenchmarkResult).formatHandshake,
+	(*BenchmarkResult).formatEmitCost,
+	(*BenchmarkResult).formatStalls,
+	(*BenchmarkResult).formatCoordination,
+	(*BenchmarkResult).formatSchema,
+	(*BenchmarkResult).formatReencode,
+	(*BenchmarkResult).formatLatencyFilter,
+	(*BenchmarkResult).formatPairing,
+	(*BenchmarkResult).formatOutputPair,
+	(*BenchmarkResult).formatProgram,
+	(*BenchmarkResult).formatScheduled,
+	(*BenchmarkResult).formatTiming,
+	(*BenchmarkResult).formatGC,
+	(*BenchmarkResult).formatPerfCounters,
+	(*BenchmarkResult).formatGoTrace,
+	(*BenchmarkResult).formatProfiles,
+	(*BenchmarkResult).formatSnapshots,
+	(*BenchmarkResult).formatHost,
+	(*BenchmarkResult).formatIdentity,
+	(*BenchmarkResult).formatAnnotations,
+}
+
 // PrintResult prints benchmark result
 func (r *BenchmarkResult) String() string {
+	start, end := r.formatWindow()
+	var sections strings.Builder
+	for _, format := range resultSections {
+		sections.WriteString(format(r))
+	}
 	return fmt.Sprintf(
 		`
 === %s Benchmark Results ===
 Language:        %s
 Program Type:    %s
 Data Mechanism:  %s
-Duration:        %.2f seconds
+Payload:         %s
+Rate Profile:    %s
+Page Cache:      %s
+Duration:        %.3f seconds
 Event Count:     %d
+Dropped Events:  %d (%.4f%%)
+Drop Policy:     %s
 Throughput:      %.0f events/sec
 CPU Usage:       %.2f%%
+CPU/Event:       %.3f µs (%s, %s)
 Memory Usage:    %d bytes
-Start:           %v
-End:             %v
-Errors:          %v
+Latency Min:     %s
+Latency Max:     %s
+Latency Avg:     %s
+Latency StdDev:  %s
+Latency Var:     %.0f ns²
+Latency Jitter:  %s
+Percentiles:     %s
+Data Quality:    %s
+Start:           %s
+End:             %s
+%sErrors:          %v
 `,
-		r.Name, r.Language, r.ProgramType, r.DataMechanism,
-		r.Duration, r.EventCount, r.Throughput, r.CPUUsage,
-		r.MemoryUsage, r.StartTime, r.EndTime, r.Errors,
+		r.Name, r.Language, r.programLabel(), r.DataMechanism, orNone(r.Payload), orNone(r.RateProfile),
+		orNone(r.PageCache),
+		r.Duration, r.EventCount, r.DroppedEvents, r.DropRate*100, orNone(r.DropPolicy), r.Throughput, r.CPUUsage,
+		r.CPUBudget.CPUPerEventUs, r.DataMechanism, r.ReaderStrategy,
+		r.MemoryUsage,
+		r.LatencyUnit.Format(float64(r.Latency.MinNs)),
+		r.LatencyUnit.Format(float64(r.Latency.MaxNs)),
+		r.LatencyUnit.Format(r.Latency.AvgNs),
+		r.LatencyUnit.Format(r.Latency.StdDevNs),
+		r.Latency.VarianceNs2,
+		r.LatencyUnit.Format(r.Latency.JitterNs),
+		r.formatPercentiles(), r.Quality,
+		start, end, sections.String(), r.Errors,
 	)
 }
 
-// SaveToJSON saves result to JSON (placeholder)
-func (r *BenchmarkResult) SaveToJSON(filename string) error {
-	// This would use encoding/json in real implementation
-	fmt.Printf("Would save result to %s\n", filename)
+// formatLoadGenerator renders the load generator's usage, if measured
+func (r *BenchmarkResult) formatLoadGenerator() string {
+	g := r.LoadGenerator
+	if g == nil {
+		return ""
+	}
+	return fmt.Sprintf("Load Generator:  %.2f%% CPU, %.0f µs user, %.0f µs sys, %d bytes (%s)\n",
+		g.CPUPercent, g.UserTimeUs, g.SystemTimeUs, g.MemoryBytes, g.Source)
+}
+
+// formatBufferGrowth renders the buffer growth line, if the buffer grew on
+// demand
+func (r *BenchmarkResult) formatBufferGrowth() string {
+	g := r.BufferGrowth
+	if g == nil {
+		return ""
+	}
+	return fmt.Sprintf("Buffer Growth:   %d chunks of %d events, %d bytes, %s pauses (max %s), %s compact\n",
+		g.Chunks, g.ChunkSize, g.AllocatedBytes, time.Duration(g.PauseNs), time.Duration(g.MaxPauseNs),
+		time.Duration(g.CompactNs))
+}
+
+// formatOperations renders the per-operation breakdown, one line each
+func (r *BenchmarkResult) formatOperations() string {
+	var sb strings.Builder
+	for _, op := range r.Operations {
+		fmt.Fprintf(&sb, "  %-14s %10d ops  %12.0f ops/sec  %10.1f ns/op\n",
+			op.Name+":", op.Count, op.Throughput, op.AvgNs)
+	}
+	if sb.Len() == 0 {
+		return ""
+	}
+	if r.OverheadNs != 0 {
+		fmt.Fprintf(&sb, "  %-14s %.1f ns/call\n", "overhead:", r.OverheadNs)
+	}
+	return "Operations:\n" + sb.String()
+}
+
+// formatPercentiles renders latency percentiles in ascending order
+func (r *BenchmarkResult) formatPercentiles() string {
+	if len(r.Latency.Percentiles) == 0 {
+		return "n/a"
+	}
+	parts := make([]string, 0, len(r.Latency.Percentiles))
+	for _, p := range r.Latency.Percentiles {
+		parts = append(parts, fmt.Sprintf("%s=%s", QuantileKey(p.Quantile), r.LatencyUnit.Format(float64(p.ValueNs))))
+	}
+	return strings.Join(parts, " ")
+}
+
+// SaveToJSON saves result to JSON
+func (r *BenchmarkResult) SaveToJSON(filename string, pretty bool) error {
+	return saveJSON(filename, r, pretty)
+}
+
+// SaveResultsToJSON saves several results to one file as a JSON array
+func SaveResultsToJSON(filename string, results []*BenchmarkResult, pretty bool) error {
+	return saveJSON(filename, results, pretty)
+}
+
+// saveJSON marshals v and writes it to filename.
+//
+// The file is written to a temporary file in the same directory and renamed
+// into place, so readers never observe a partially written result.
+func saveJSON(filename string, v interface{}, pretty bool) error {
+	var data []byte
+	var err error
+	if pretty {
+		data, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		data, err = json.Marshal(v)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to marshal result: %w", err)
+	}
+	return writeFileAtomic(filename, data)
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory
+// and renames it over filename
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // No-op once the rename has succeeded
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write result file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync result file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close result file: %w", err)
+	}
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		return fmt.Errorf("failed to set result file mode: %w", err)
+	}
+	if err := os.Rename(tmpName, filename); err != nil {
+		return fmt.Errorf("failed to rename result file: %w", err)
+	}
+
 	return nil
 }
 
+// LoadFromJSON loads a result previously written by SaveToJSON
+func LoadFromJSON(filename string) (*BenchmarkResult, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read result file: %w", err)
+	}
+
+	var r BenchmarkResult
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("failed to parse result file %s: %w", filename, err)
+	}
+
+	return &r, nil
+}
+
 // GetCPUUsage gets current CPU usage percentage
 func GetCPUUsage() (float64, error) {
 	// Simplified version - in real implementation would read /proc/stat
@@ -203,11 +852,6 @@ func PrintBenchmarkHeader(name string) {
 	fmt.Println()
 }
 
-// PrintBenchmarkStatus prints status updates
-func PrintBenchmarkStatus(msg string) {
-	fmt.Printf("[%v] %s\n", time.Now().Format("15:04:05"), msg)
-}
-
 // PrintSeparator prints a separator line
 func PrintSeparator() {
 	fmt.Println("=" + "=================================================" + "=")
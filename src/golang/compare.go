@@ -0,0 +1,329 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// compareMetric is one metric compared between baseline and current runs
+type compareMetric struct {
+	name         string
+	higherBetter bool
+	threshold    *float64                   // Allowed worsening in percent
+	tolerance    func(t Tolerance) *float64 // Per-benchmark override of threshold
+	value        func(r *BenchmarkResult) (float64, bool)
+	format       func(v float64) string
+}
+
+// compareRow is the comparison of one metric of one benchmark
+type compareRow struct {
+	benchmark  string
+	metric     string
+	baseline   string
+	current    string
+	deltaPct   float64
+	regression bool
+	unstable   bool // Beyond the allowed run-to-run variation
+}
+
+// resultKey identifies the same benchmark configuration across files
+func resultKey(r *BenchmarkResult) string {
+	key := r.Name
+	if r.ReaderStrategy != "" {
+		key += " [" + r.ReaderStrategy + "]"
+	}
+	if r.Tracepoint != "" {
+		key += " (" + r.Tracepoint + ")"
+	}
+	if r.Encoding != nil {
+		key += " <" + r.Encoding.Encoding + ">"
+	}
+	if r.HeaderStack != "" && r.HeaderStack != defaultHeaderStack {
+		key += " {" + r.HeaderStack + "}"
+	}
+	return key
+}
+
+// groupResults groups results by resultKey, keeping first-seen order
+func groupResults(results []*BenchmarkResult) ([]string, map[string][]*BenchmarkResult) {
+	var keys []string
+	groups := make(map[string][]*BenchmarkResult)
+	for _, r := range results {
+		k := resultKey(r)
+		if groups[k] == nil {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], r)
+	}
+	return keys, groups
+}
+
+// meanMetric averages a metric over the runs that report it
+func meanMetric(runs []*BenchmarkResult, value func(r *BenchmarkResult) (float64, bool)) (float64, bool) {
+	var values []float64
+	for _, r := range runs {
+		if v, ok := value(r); ok {
+			values = append(values, v)
+		}
+	}
+	return meanOf(values), len(values) > 0
+}
+
+// latencyPercentile reads a percentile from a result, if it was computed
+func latencyPercentile(q float64) func(r *BenchmarkResult) (float64, bool) {
+	return func(r *BenchmarkResult) (float64, bool) {
+		v, ok := r.Latency.Percentile(q)
+		return float64(v), ok
+	}
+}
+
+// runCompare is the entry point of the compare subcommand. It compares a
+// current result file against a baseline and fails when a metric worsens
+// by more than its threshold. Files holding several runs of a benchmark
+// are compared by their mean. Without a baseline file, each result is
+// compared against the baseline promoted for it in the history store.
+func runCompare(args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	maxThroughput := fs.Float64("max-throughput-drop", 5, "Allowed throughput decrease in percent")
+	maxLatency := fs.Float64("max-latency-increase", 10, "Allowed p50/p99/p99.9 latency and jitter increase in percent")
+	maxCPU := fs.Float64("max-cpu-increase", 10, "Allowed CPU-per-event increase in percent")
+	maxMemory := fs.Float64("max-memory-increase", 20, "Allowed memory usage increase in percent")
+	configFile := fs.String("config", "", "Suite config whose per-benchmark tolerances override the thresholds above")
+	allowMissing := fs.Bool("allow-missing", false, "Do not fail when a baseline benchmark is missing from the current results")
+	latencyUnit := fs.String("latency-unit", "us", "Latency display unit (ns, us, ms)")
+	storePath := fs.String("store", defaultStorePath, "History store holding the promoted baselines, used when no baseline file is given (or sqlite:FILE)")
+	allowMismatch := fs.Bool("allow-identity-mismatch", false, "Compare benchmarks whose baseline and current identity hashes differ, with a warning, instead of refusing")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: compare [flags] baseline.json current.json\n       compare [flags] current.json\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 && fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("want a current result file and optionally a baseline before it")
+	}
+	unit, err := ParseLatencyUnit(*latencyUnit)
+	if err != nil {
+		return err
+	}
+	current, err := LoadResultsFromJSON(fs.Arg(fs.NArg() - 1))
+	if err != nil {
+		return err
+	}
+	var baseline []*BenchmarkResult
+	var unbaselined []string
+	if fs.NArg() == 2 {
+		if baseline, err = LoadResultsFromJSON(fs.Arg(0)); err != nil {
+			return err
+		}
+	} else if baseline, unbaselined, err = storedBaselines(OpenResultStore(*storePath), current); err != nil {
+		return err
+	}
+
+	tolerances := map[string]Tolerance{}
+	if *configFile != "" {
+		cfg, err := LoadSuiteConfig(*configFile)
+		if err != nil {
+			return err
+		}
+		tolerances = cfg.Tolerances()
+	}
+
+	latency := func(v float64) string { return unit.Format(v) }
+	latencyTolerance := func(t Tolerance) *float64 { return t.MaxLatencyIncrease }
+	metrics := []compareMetric{
+		{"throughput", true, maxThroughput, func(t Tolerance) *float64 { return t.MaxThroughputDrop },
+			throughputMetric,
+			func(v float64) string { return fmt.Sprintf("%.0f/s", v) }},
+		{"p50", false, maxLatency, latencyTolerance, latencyPercentile(0.5), latency},
+		{"p99", false, maxLatency, latencyTolerance, latencyPercentile(0.99), latency},
+		{"p99.9", false, maxLatency, latencyTolerance, latencyPercentile(0.999), latency},
+		{"jitter", false, maxLatency, latencyTolerance,
+			func(r *BenchmarkResult) (float64, bool) { return r.Latency.JitterNs, r.Latency.Samples > 1 },
+			latency},
+		{"cpu/event", false, maxCPU, func(t Tolerance) *float64 { return t.MaxCPUIncrease },
+			func(r *BenchmarkResult) (float64, bool) {
+				return r.CPUBudget.CPUPerEventUs, r.CPUBudget.CPUPerEventUs > 0
+			},
+			func(v float64) string { return fmt.Sprintf("%.3fµs", v) }},
+		{"memory", false, maxMemory, func(t Tolerance) *float64 { return t.MaxMemoryIncrease },
+			func(r *BenchmarkResult) (float64, bool) { return float64(r.MemoryUsage), r.MemoryUsage > 0 },
+			func(v float64) string { return fmt.Sprintf("%.0fB", v) }},
+	}
+
+	keys, base := groupResults(baseline)
+	_, cur := groupResults(current)
+	var rows []compareRow
+	var missing, mismatched, unidentified []string
+	var identityNotes, hostNotes []string
+	for _, k := range keys {
+		if cur[k] == nil {
+			missing = append(missing, k)
+			continue
+		}
+		// Only runs of the same identity measured the same thing
+		bid, bmixed := groupIdentity(base[k])
+		cid, cmixed := groupIdentity(cur[k])
+		if bmixed || cmixed {
+			identityNotes = append(identityNotes, fmt.Sprintf("Runs of %s disagree on their identity among themselves; checked against the first", k))
+		}
+		switch {
+		case bid == nil || cid == nil:
+			unidentified = append(unidentified, k)
+		case bid.Hash != cid.Hash && identityCompatible(bid, cid):
+			note := fmt.Sprintf("Identity of %s differs only in parameters one side does not record; compared", k)
+			for _, d := range identityDiff(bid, cid) {
+				note += "\n    " + d
+			}
+			identityNotes = append(identityNotes, note)
+		case bid.Hash != cid.Hash:
+			mismatched = append(mismatched, k)
+			note := fmt.Sprintf("Identity mismatch: %s: baseline %s, current %s", k, bid.Hash, cid.Hash)
+			for _, d := range identityDiff(bid, cid) {
+				note += "\n    " + d
+			}
+			identityNotes = append(identityNotes, note)
+			if !*allowMismatch {
+				continue
+			}
+		}
+		// Cross-host comparisons are allowed, but say what differs
+		if bh, ch := base[k][0].Host, cur[k][0].Host; bh.Fingerprint != "" && ch.Fingerprint != "" && bh.Fingerprint != ch.Fingerprint {
+			note := fmt.Sprintf("Host environment differs: %s: baseline %s (%s), current %s (%s)",
+				k, bh.Fingerprint, hostLabel(base[k][0]), ch.Fingerprint, hostLabel(cur[k][0]))
+			for _, d := range paramDiff(hostEnvironment(bh), hostEnvironment(ch)) {
+				note += "\n    " + d
+			}
+			hostNotes = append(hostNotes, note)
+		}
+		tol := tolerances[cur[k][0].Benchmark]
+		for _, m := range metrics {
+			threshold := *m.threshold
+			if v := m.tolerance(tol); v != nil {
+				threshold = *v
+			}
+			b, ok := meanMetric(base[k], m.value)
+			if !ok || b == 0 {
+				continue
+			}
+			c, ok := meanMetric(cur[k], m.value)
+			if !ok {
+				continue
+			}
+			delta := (c - b) / b * 100
+			worse := delta
+			if m.higherBetter {
+				worse = -delta
+			}
+			rows = append(rows, compareRow{k, m.name, m.format(b), m.format(c), delta, worse > threshold, false})
+		}
+		if tol.MaxThroughputCV != nil && len(cur[k]) > 1 {
+			rows = append(rows, stabilityRow(k, base[k], cur[k], *tol.MaxThroughputCV))
+		}
+	}
+	printCompareTable(rows)
+
+	regressions := 0
+	for _, row := range rows {
+		if row.regression || row.unstable {
+			regressions++
+		}
+	}
+	sort.Strings(missing)
+	for _, k := range missing {
+		fmt.Printf("Missing from current results: %s\n", k)
+	}
+	for _, k := range unbaselined {
+		fmt.Printf("No promoted baseline: %s\n", k)
+	}
+	for _, note := range identityNotes {
+		fmt.Println(note)
+	}
+	for _, note := range hostNotes {
+		fmt.Println(note)
+	}
+	if len(unidentified) > 0 {
+		fmt.Printf("Identity not recorded, comparability unchecked: %s\n", strings.Join(unidentified, ", "))
+	}
+	if len(mismatched) > 0 {
+		if *allowMismatch {
+			fmt.Printf("WARNING: %s\n", identitySummary(mismatched, true))
+		} else {
+			fmt.Println(identitySummary(mismatched, false) + " (-allow-identity-mismatch compares them anyway)")
+		}
+	}
+	if !*allowMissing {
+		regressions += len(missing)
+	}
+	if !*allowMismatch && len(mismatched) > 0 {
+		return fmt.Errorf("%d benchmark(s) not comparable: identity hashes differ", len(mismatched))
+	}
+	if regressions > 0 {
+		return fmt.Errorf("%d regression(s) beyond thresholds", regressions)
+	}
+	fmt.Println("No regressions beyond thresholds")
+	return nil
+}
+
+// throughputMetric reads a result's throughput, if it measured any
+func throughputMetric(r *BenchmarkResult) (float64, bool) {
+	return r.Throughput, r.Throughput > 0
+}
+
+// throughputCV is the coefficient of variation of throughput across runs,
+// in percent
+func throughputCV(runs []*BenchmarkResult) (float64, bool) {
+	var values []float64
+	for _, r := range runs {
+		if v, ok := throughputMetric(r); ok {
+			values = append(values, v)
+		}
+	}
+	mean := meanOf(values)
+	if len(values) < 2 || mean == 0 {
+		return 0, false
+	}
+	var ss float64
+	for _, v := range values {
+		ss += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(ss/float64(len(values)-1)) / mean * 100, true
+}
+
+// stabilityRow checks the current runs' throughput spread against the
+// benchmark's variance window
+func stabilityRow(k string, baseline, current []*BenchmarkResult, maxCV float64) compareRow {
+	row := compareRow{benchmark: k, metric: "thru cv", baseline: "-"}
+	if b, ok := throughputCV(baseline); ok {
+		row.baseline = fmt.Sprintf("%.1f%%", b)
+	}
+	c, _ := throughputCV(current)
+	row.current = fmt.Sprintf("%.1f%%", c)
+	row.deltaPct = c - maxCV // Percentage points beyond the window
+	row.unstable = c > maxCV
+	return row
+}
+
+// printCompareTable prints one line per compared metric
+func printCompareTable(rows []compareRow) {
+	PrintSeparator()
+	fmt.Printf("%-48s %-10s %14s %14s %9s  %s\n", "Benchmark", "Metric", "Baseline", "Current", "Delta", "Status")
+	for _, row := range rows {
+		status := "ok"
+		switch {
+		case row.regression:
+			status = "REGRESSION"
+		case row.unstable:
+			status = "UNSTABLE"
+		}
+		fmt.Printf("%-48s %-10s %14s %14s %+8.1f%%  %s\n",
+			row.benchmark, row.metric, row.baseline, row.current, row.deltaPct, status)
+	}
+	PrintSeparator()
+}
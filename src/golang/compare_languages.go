@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// foreignTimeLayout is how the Rust userspace writes its start and end
+// times, in local time
+const foreignTimeLayout = "2006-01-02 15:04:05"
+
+// loadLanguageResults reads a result file written by any of the
+// implementations. The Rust userspace writes snake_case keys and plain
+// local times; both are mapped onto BenchmarkResult, whose field names
+// encoding/json matches case-insensitively once the underscores go.
+func loadLanguageResults(filename string) ([]*BenchmarkResult, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read result file: %w", err)
+	}
+	var objects []map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var v any
+		if err := dec.Decode(&v); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to parse result file %s: %w", filename, err)
+		}
+		switch v := v.(type) {
+		case map[string]any:
+			objects = append(objects, v)
+		case []any:
+			for _, e := range v {
+				if m, ok := e.(map[string]any); ok {
+					objects = append(objects, m)
+				}
+			}
+		}
+	}
+	var results []*BenchmarkResult
+	for _, o := range objects {
+		norm := make(map[string]any, len(o))
+		for k, v := range o {
+			k = strings.ReplaceAll(k, "_", "")
+			if s, ok := v.(string); ok && (strings.EqualFold(k, "StartTime") || strings.EqualFold(k, "EndTime")) {
+				if t, err := time.ParseInLocation(foreignTimeLayout, s, time.Local); err == nil {
+					v = t.Format(time.RFC3339Nano)
+				}
+			}
+			norm[k] = v
+		}
+		raw, err := json.Marshal(norm)
+		if err != nil {
+			return nil, err
+		}
+		var r BenchmarkResult
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return nil, fmt.Errorf("failed to parse result file %s: %w", filename, err)
+		}
+		results = append(results, &r)
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("result file %s is empty", filename)
+	}
+	normalizeResultTimes(results)
+	return results, nil
+}
+
+// languageSummary is the mean of one language's runs of a benchmark
+type languageSummary struct {
+	language   string
+	runs       int
+	throughput float64
+	cpu        float64 // CPU µs per event; 0 when not measured
+	p50, p99   float64
+	hasLatency bool
+}
+
+func summarizeLanguage(language string, runs []*BenchmarkResult) languageSummary {
+	s := languageSummary{language: language, runs: len(runs)}
+	s.throughput, _ = meanMetric(runs, func(r *BenchmarkResult) (float64, bool) { return r.Throughput, true })
+	s.cpu, _ = meanMetric(runs, func(r *BenchmarkResult) (float64, bool) {
+		return r.CPUBudget.CPUPerEventUs, r.CPUBudget.CPUPerEventUs > 0
+	})
+	s.p50, s.hasLatency = meanMetric(runs, latencyPercentile(0.5))
+	s.p99, _ = meanMetric(runs, latencyPercentile(0.99))
+	return s
+}
+
+// overhead is how much worse v is than ref in percent, for metrics where
+// lower is better; "-" when either is missing
+func overhead(v, ref float64) string {
+	if v <= 0 || ref <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%+.1f%%", (v/ref-1)*100)
+}
+
+// runCompareLanguages is the entry point of the compare-languages
+// subcommand. It lines up each benchmark's results from the different
+// implementations, normalized to per-event costs, with each language's
+// overhead relative to a reference language.
+func runCompareLanguages(args []string) error {
+	fs := flag.NewFlagSet("compare-languages", flag.ExitOnError)
+	reference := fs.String("reference", "", "Language the others are compared against (default: the fastest of each benchmark)")
+	latencyUnit := fs.String("latency-unit", "us", "Latency display unit (ns, us, ms)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: compare-languages [flags] result.json...\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no result files given")
+	}
+	unit, err := ParseLatencyUnit(*latencyUnit)
+	if err != nil {
+		return err
+	}
+
+	// Benchmarks are matched by name: the other implementations do not
+	// record the reader strategy or encoding that resultKey adds
+	var names []string
+	byName := make(map[string]map[string][]*BenchmarkResult)
+	for _, file := range fs.Args() {
+		results, err := loadLanguageResults(file)
+		if err != nil {
+			return err
+		}
+		for _, r := range results {
+			if byName[r.Name] == nil {
+				names = append(names, r.Name)
+				byName[r.Name] = make(map[string][]*BenchmarkResult)
+			}
+			language := r.Language
+			if language == "" {
+				language = "unknown"
+			}
+			byName[r.Name][language] = append(byName[r.Name][language], r)
+		}
+	}
+
+	PrintBenchmarkHeader("Language Comparison")
+	compared := 0
+	for _, name := range names {
+		var summaries []languageSummary
+		for language, runs := range byName[name] {
+			summaries = append(summaries, summarizeLanguage(language, runs))
+		}
+		sort.Slice(summaries, func(i, j int) bool { return summaries[i].throughput > summaries[j].throughput })
+		ref := summaries[0]
+		if *reference != "" {
+			found := false
+			for _, s := range summaries {
+				if strings.EqualFold(s.language, *reference) {
+					ref, found = s, true
+				}
+			}
+			if !found {
+				fmt.Printf("%s: no %s results, skipped\n\n", name, *reference)
+				continue
+			}
+		}
+		if len(summaries) < 2 {
+			fmt.Printf("%s: only %s results, nothing to compare\n\n", name, ref.language)
+			continue
+		}
+		compared++
+
+		fmt.Printf("%s (reference: %s)\n", name, ref.language)
+		PrintSeparator()
+		fmt.Printf("%-10s %5s %15s %10s %9s %12s %9s %12s %9s %12s %9s\n",
+			"Language", "Runs", "Throughput", "ns/event", "vs ref", "CPU/Event", "vs ref", "p50", "vs ref", "p99", "vs ref")
+		for _, s := range summaries {
+			nsPerEvent, refNs := 0.0, 0.0
+			if s.throughput > 0 {
+				nsPerEvent = 1e9 / s.throughput
+			}
+			if ref.throughput > 0 {
+				refNs = 1e9 / ref.throughput
+			}
+			cpu, p50, p99 := "-", "-", "-"
+			if s.cpu > 0 {
+				cpu = fmt.Sprintf("%.3fµs", s.cpu)
+			}
+			if s.hasLatency {
+				p50, p99 = unit.Format(s.p50), unit.Format(s.p99)
+			}
+			fmt.Printf("%-10s %5d %15.0f %10.1f %9s %12s %9s %12s %9s %12s %9s\n",
+				s.language, s.runs, s.throughput, nsPerEvent, overhead(nsPerEvent, refNs),
+				cpu, overhead(s.cpu, ref.cpu), p50, overhead(s.p50, ref.p50), p99, overhead(s.p99, ref.p99))
+		}
+		PrintSeparator()
+		fmt.Println()
+	}
+	if compared == 0 {
+		return fmt.Errorf("no benchmark has results from two languages")
+	}
+	fmt.Println("vs ref: cost relative to the reference, positive is slower; - where a language does not measure it")
+	return nil
+}
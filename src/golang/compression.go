@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"time"
+)
+
+// The delta encoding stores each event as varints: the zigzagged
+// timestamp difference to the previous event, then the PID, CPU, event
+// type and data. Slowly changing fields shrink to a byte or two.
+
+// archiveMagic starts the decompressed stream of an archive file
+const archiveMagic = "ebpfev1\n"
+
+// zigzag maps signed deltas to unsigned so small magnitudes stay short
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+// appendDeltaEvent appends e delta-encoded against prev
+func appendDeltaEvent(b []byte, prev, e *Event) []byte {
+	b = appendVarint(b, zigzag(int64(e.Timestamp-prev.Timestamp)))
+	b = appendVarint(b, uint64(e.PID))
+	b = appendVarint(b, uint64(e.CPU))
+	b = appendVarint(b, uint64(e.EventType))
+	return appendVarint(b, uint64(e.Data))
+}
+
+// CompressionStats estimate how compressible a run's event stream is,
+// for sizing an archive of it
+type CompressionStats struct {
+	Events          int64
+	RawBytes        int64   // 32-byte records
+	DeltaBytes      int64   // Delta-encoded varints
+	RawFlateBytes   int64   // Records through DEFLATE
+	DeltaFlateBytes int64   // Delta varints through DEFLATE
+	AnalysisSeconds float64 // Time the pass took
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// analyzeCompression encodes events every way and measures the output.
+// DEFLATE runs at its default level.
+func analyzeCompression(events []Event) *CompressionStats {
+	start := time.Now()
+	s := &CompressionStats{Events: int64(len(events)), RawBytes: int64(len(events)) * eventV1Size}
+	rawOut := &countingWriter{w: io.Discard}
+	deltaOut := &countingWriter{w: io.Discard}
+	rawFlate, _ := flate.NewWriter(rawOut, flate.DefaultCompression)
+	deltaFlate, _ := flate.NewWriter(deltaOut, flate.DefaultCompression)
+
+	var prev Event
+	var rec [eventV1Size]byte
+	buf := make([]byte, 0, 64*1024)
+	for i := range events {
+		putFixed(rec[:], &extendedEvent{Event: events[i]}, schemaV1)
+		rawFlate.Write(rec[:])
+		buf = appendDeltaEvent(buf, &prev, &events[i])
+		prev = events[i]
+		if len(buf) > cap(buf)-64 {
+			s.DeltaBytes += int64(len(buf))
+			deltaFlate.Write(buf)
+			buf = buf[:0]
+		}
+	}
+	s.DeltaBytes += int64(len(buf))
+	deltaFlate.Write(buf)
+	rawFlate.Close()
+	deltaFlate.Close()
+	s.RawFlateBytes = rawOut.n
+	s.DeltaFlateBytes = deltaOut.n
+	s.AnalysisSeconds = time.Since(start).Seconds()
+	return s
+}
+
+// ratio is raw over compressed, or 0 when nothing was written
+func ratio(raw, compressed int64) float64 {
+	if compressed == 0 {
+		return 0
+	}
+	return float64(raw) / float64(compressed)
+}
+
+// formatCompression renders the compressibility analysis, if run
+func (r *BenchmarkResult) formatCompression() string {
+	s := r.Compressibility
+	if s == nil || s.Events == 0 {
+		return ""
+	}
+	per := func(b int64) float64 { return float64(b) / float64(s.Events) }
+	return fmt.Sprintf("Compressibility: delta %.1f B/event (%.1fx), deflate %.1f B/event (%.1fx), delta+deflate %.1f B/event (%.1fx)\n",
+		per(s.DeltaBytes), ratio(s.RawBytes, s.DeltaBytes),
+		per(s.RawFlateBytes), ratio(s.RawBytes, s.RawFlateBytes),
+		per(s.DeltaFlateBytes), ratio(s.RawBytes, s.DeltaFlateBytes))
+}
+
+// ArchiveStats describe the compressed archive written during a run
+type ArchiveStats struct {
+	Path      string
+	Level     int              // gzip level
+	Events    int64            // Events archived
+	RawBytes  int64            // Their size as 32-byte records
+	Bytes     int64            // Archive file size
+	ArchiveNs float64          // Mean time to archive one event, on the consumer path
+	IO        *ArtifactIOStats // How the file was written
+	Error     string           `json:",omitempty"` // Why archiving stopped early
+}
+
+// eventArchive writes delivered events to a file as delta varints in a
+// gzip stream. zstd would compress better and faster, but needs a module
+// outside the standard library; gzip files open with standard tools.
+type eventArchive struct {
+	file  *artifactFile
+	out   *countingWriter
+	gz    *gzip.Writer
+	bw    *bufio.Writer
+	prev  Event
+	buf   []byte
+	stats ArchiveStats
+	spent time.Duration
+	err   error
+}
+
+// createEventArchive creates the archive at path, written under policy
+func createEventArchive(path string, level int, policy artifactPolicy) (*eventArchive, error) {
+	f, err := createArtifactFile(path, policy)
+	if err != nil {
+		return nil, err
+	}
+	out := &countingWriter{w: f}
+	gz, err := gzip.NewWriterLevel(out, level)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a := &eventArchive{file: f, out: out, gz: gz, bw: bufio.NewWriterSize(gz, 64*1024)}
+	a.stats.Path = path
+	a.stats.Level = level
+	a.bw.WriteString(archiveMagic)
+	return a, nil
+}
+
+// write archives a batch of delivered events. After a write error the
+// archive stops and reports it.
+func (a *eventArchive) write(events []Event) {
+	if a == nil || a.err != nil || len(events) == 0 {
+		return
+	}
+	start := time.Now()
+	a.buf = a.buf[:0]
+	for i := range events {
+		a.buf = appendDeltaEvent(a.buf, &a.prev, &events[i])
+		a.prev = events[i]
+	}
+	if _, err := a.bw.Write(a.buf); err != nil {
+		a.err = err
+	}
+	a.stats.Events += int64(len(events))
+	a.spent += time.Since(start)
+}
+
+// Close flushes the archive and returns its statistics; nil for a nil
+// archive
+func (a *eventArchive) Close() *ArchiveStats {
+	if a == nil {
+		return nil
+	}
+	// Finishing the file, which waits for a writer thread and fsyncs, is
+	// not counted against the consumer
+	start := time.Now()
+	for i, step := range []func() error{a.bw.Flush, a.gz.Close, a.file.Close} {
+		if i == 2 {
+			a.spent += time.Since(start)
+		}
+		if err := step(); err != nil && a.err == nil {
+			a.err = err
+		}
+	}
+	s := a.stats
+	s.RawBytes = s.Events * eventV1Size
+	s.Bytes = a.out.n
+	s.IO = a.file.Stats()
+	if s.Events > 0 {
+		s.ArchiveNs = float64(a.spent.Nanoseconds()) / float64(s.Events)
+	}
+	if a.err != nil {
+		s.Error = a.err.Error()
+	}
+	return &s
+}
+
+// formatArchive renders the archive statistics, if written
+func (r *BenchmarkResult) formatArchive() string {
+	s := r.Archive
+	if s == nil {
+		return ""
+	}
+	line := fmt.Sprintf("Archive:         %s, %d events in %d bytes (%.1fx), %.1f ns/event on the consumer path",
+		s.Path, s.Events, s.Bytes, ratio(s.RawBytes, s.Bytes), s.ArchiveNs)
+	if s.Error != "" {
+		line += ", stopped: " + s.Error
+	}
+	return line + "\n" + formatArtifactIO(s.IO, r.LatencyUnit)
+}
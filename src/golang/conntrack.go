@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// flowKey is the 5-tuple a conntrack table is keyed by; IPv4 addresses
+// take the first four bytes, as in Cilium's and Katran's IPv6-sized keys
+type flowKey struct {
+	src, dst         [16]byte
+	srcPort, dstPort uint16
+	proto            uint8
+}
+
+// flowEntry is the value a conntrack program keeps per flow
+type flowEntry struct {
+	packets, bytes uint64
+	lastSeenNs     uint64
+	referenced     bool // Touched since the eviction hand last passed
+}
+
+// FlowTableStats describe the flow table of a conntrack run. The counts
+// cover the warm-up and cooldown as well, since the table persists across
+// them as a pinned map would.
+type FlowTableStats struct {
+	MapType    string
+	MaxEntries int
+	Entries    int     // Flows in the table at the end
+	Occupancy  float64 // Entries over MaxEntries
+	Lookups    int64
+	Hits       int64
+	Inserts    int64
+	Evictions  int64 // lru_hash: older flows evicted to make room
+	Failed     int64 // hash: new flows not tracked because the table was full
+	HitRate    float64
+}
+
+// ctTable models a conntrack map for the userspace model of the program;
+// the attached program uses a real one. It is a preallocated BPF hash or
+// LRU hash of flowEntry. The LRU is approximated with a clock hand over the
+// preallocated entries, as the kernel's LRU is approximate too. Packet
+// programs on several attach points share one table, as they would one
+// map; a mutex stands in for the kernel's bucket locks.
+type ctTable struct {
+	mu         sync.Mutex
+	lru        bool
+	maxEntries int
+	index      map[flowKey]int32
+	keys       []flowKey
+	entries    []flowEntry
+	hand       int
+	lookups    int64
+	hits       int64
+	inserts    int64
+	evictions  int64
+	failed     int64
+}
+
+func newCTTable(mapType string, maxEntries int) (*ctTable, error) {
+	if mapType != mapTypeHash && mapType != mapTypeLRUHash {
+		return nil, fmt.Errorf("unknown conntrack map type %q (want hash or lru_hash)", mapType)
+	}
+	if maxEntries <= 0 {
+		return nil, fmt.Errorf("conntrack map size must be positive")
+	}
+	return &ctTable{
+		lru:        mapType == mapTypeLRUHash,
+		index:      make(map[flowKey]int32, maxEntries),
+		keys:       make([]flowKey, 0, maxEntries),
+		entries:    make([]flowEntry, 0, maxEntries),
+		maxEntries: maxEntries,
+	}, nil
+}
+
+// track looks the packet's flow up and updates its counters, inserting
+// a new flow; l3 and payload are the offsets of its innermost IP header and
+// UDP payload
+func (t *ctTable) track(pkt []byte, l3, payload int, now uint64) {
+	var k flowKey
+	ip := pkt[l3:]
+	if ip[0]>>4 == 6 {
+		copy(k.src[:], ip[8:24])
+		copy(k.dst[:], ip[24:40])
+		k.proto = ip[6]
+	} else {
+		copy(k.src[:4], ip[12:16])
+		copy(k.dst[:4], ip[16:20])
+		k.proto = ip[9]
+	}
+	udp := pkt[payload-udpHeaderLen:]
+	k.srcPort = binary.BigEndian.Uint16(udp[0:2])
+	k.dstPort = binary.BigEndian.Uint16(udp[2:4])
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lookups++
+	i, ok := t.index[k]
+	if ok {
+		t.hits++
+	} else if i, ok = t.insert(k); !ok {
+		return
+	}
+	e := &t.entries[i]
+	e.packets++
+	e.bytes += uint64(len(pkt))
+	e.lastSeenNs = now
+	e.referenced = true
+}
+
+// insert adds k with empty counters, evicting a flow from a full LRU
+func (t *ctTable) insert(k flowKey) (int32, bool) {
+	if len(t.entries) < t.maxEntries {
+		t.keys = append(t.keys, k)
+		t.entries = append(t.entries, flowEntry{})
+		i := int32(len(t.entries) - 1)
+		t.index[k] = i
+		t.inserts++
+		return i, true
+	}
+	if !t.lru {
+		t.failed++ // bpf_map_update_elem returns -E2BIG
+		return 0, false
+	}
+	for t.entries[t.hand].referenced {
+		t.entries[t.hand].referenced = false
+		t.hand = (t.hand + 1) % len(t.entries)
+	}
+	i := int32(t.hand)
+	t.hand = (t.hand + 1) % len(t.entries)
+	delete(t.index, t.keys[i])
+	t.keys[i] = k
+	t.entries[i] = flowEntry{}
+	t.index[k] = i
+	t.inserts++
+	t.evictions++
+	return i, true
+}
+
+// mapType is the map type the table models, as -ct-map names it
+func (t *ctTable) mapType() string {
+	if t.lru {
+		return mapTypeLRUHash
+	}
+	return mapTypeHash
+}
+
+func (t *ctTable) stats() *FlowTableStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &FlowTableStats{
+		MapType:    t.mapType(),
+		MaxEntries: t.maxEntries,
+		Entries:    len(t.index),
+		Occupancy:  float64(len(t.index)) / float64(t.maxEntries),
+		Lookups:    t.lookups,
+		Hits:       t.hits,
+		Inserts:    t.inserts,
+		Evictions:  t.evictions,
+		Failed:     t.failed,
+	}
+	if t.lookups > 0 {
+		s.HitRate = float64(t.hits) / float64(t.lookups)
+	}
+	return s
+}
+
+// parseFlowCounts parses a sweep such as 1k,100k,1M; k and M are
+// decimal thousands and millions
+func parseFlowCounts(s string) ([]int, error) {
+	var counts []int
+	for _, field := range splitList(s) {
+		mult := 1
+		digits := field
+		switch {
+		case strings.HasSuffix(field, "k"), strings.HasSuffix(field, "K"):
+			mult, digits = 1000, field[:len(field)-1]
+		case strings.HasSuffix(field, "M"), strings.HasSuffix(field, "m"):
+			mult, digits = 1000000, field[:len(field)-1]
+		}
+		n, err := strconv.Atoi(digits)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid flow count %q", field)
+		}
+		counts = append(counts, n*mult)
+	}
+	if len(counts) == 0 {
+		return nil, fmt.Errorf("no flow counts given")
+	}
+	return counts, nil
+}
+
+// formatFlowCount renders a flow count the way -flows takes it
+func formatFlowCount(n int) string {
+	switch {
+	case n >= 1000000 && n%1000000 == 0:
+		return strconv.Itoa(n/1000000) + "M"
+	case n >= 1000 && n%1000 == 0:
+		return strconv.Itoa(n/1000) + "k"
+	}
+	return strconv.Itoa(n)
+}
+
+// formatFlowTable renders the conntrack table of a run, if it had one
+func (r *BenchmarkResult) formatFlowTable() string {
+	s := r.FlowTable
+	if s == nil {
+		return ""
+	}
+	line := fmt.Sprintf("Flow Table:      %s, %d of %d entries (%.1f%%), hit rate %.2f%%, %d inserts",
+		s.MapType, s.Entries, s.MaxEntries, s.Occupancy*100, s.HitRate*100, s.Inserts)
+	if s.Evictions > 0 {
+		line += fmt.Sprintf(", %d evictions", s.Evictions)
+	}
+	if s.Failed > 0 {
+		line += fmt.Sprintf(", %d untracked (table full)", s.Failed)
+	}
+	return line + "\n"
+}
+
+// printFlowSweep prints packets per second against active flows for the
+// results of a flow sweep
+func printFlowSweep(results []*BenchmarkResult, flows []int) {
+	PrintBenchmarkHeader("Packets per second by active flows")
+	fmt.Printf("%10s %12s %14s %10s %10s\n", "Flows", "In table", "pps", "vs first", "Hit rate")
+	for i, r := range results {
+		inTable, hitRate := "-", "-"
+		if s := r.FlowTable; s != nil {
+			inTable = strconv.Itoa(s.Entries)
+			hitRate = fmt.Sprintf("%.2f%%", s.HitRate*100)
+		}
+		rel := "-"
+		if i > 0 && results[0].Throughput > 0 {
+			rel = fmt.Sprintf("%+.1f%%", (r.Throughput/results[0].Throughput-1)*100)
+		}
+		fmt.Printf("%10s %12s %14.0f %10s %10s\n", formatFlowCount(flows[i]), inTable, r.Throughput, rel, hitRate)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CPUStats are the statistics of the events generated on one CPU
+type CPUStats struct {
+	CPU        uint32
+	EventCount int64
+	Share      float64 // Fraction of all delivered events
+	Throughput float64
+	Latency    LatencyStats // Between consecutive events of this CPU; emit latency in ringbuf-contention
+}
+
+// GetCPUs breaks the collected events down by the CPU that generated
+// them, in CPU order
+func (eb *EventBuffer) GetCPUs() []CPUStats {
+	if eb.stream != nil {
+		return eb.stream.cpuStats(eb.quantiles, eb.GetDuration())
+	}
+	events := eb.ordered()
+	last := make(map[uint32]uint64)
+	samples := make(map[uint32][]uint64)
+	counts := make(map[uint32]int64)
+	var q DataQuality
+	for _, e := range events {
+		if prev, seen := last[e.CPU]; seen {
+			if d, ok := timestampDelta(prev, e.Timestamp, &q); ok {
+				samples[e.CPU] = append(samples[e.CPU], d)
+			}
+		}
+		last[e.CPU] = e.Timestamp
+		counts[e.CPU]++
+	}
+
+	cpus := make([]uint32, 0, len(counts))
+	for cpu := range counts {
+		cpus = append(cpus, cpu)
+	}
+	sort.Slice(cpus, func(i, j int) bool { return cpus[i] < cpus[j] })
+
+	duration := eb.GetDuration()
+	stats := make([]CPUStats, 0, len(cpus))
+	for _, cpu := range cpus {
+		s := CPUStats{
+			CPU:        cpu,
+			EventCount: counts[cpu],
+			Share:      float64(counts[cpu]) / float64(len(events)),
+			Latency:    computeLatencyStats(samples[cpu], eb.quantiles),
+		}
+		if duration > 0 {
+			s.Throughput = float64(counts[cpu]) / duration
+		}
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// cpuSkew is the busiest CPU's event count over the mean across CPUs: 1
+// when events are spread evenly, the number of CPUs when one CPU
+// generated them all
+func cpuSkew(stats []CPUStats) float64 {
+	if len(stats) == 0 {
+		return 0
+	}
+	var total, busiest int64
+	for _, s := range stats {
+		total += s.EventCount
+		busiest = max(busiest, s.EventCount)
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(busiest) / (float64(total) / float64(len(stats)))
+}
+
+// recordCPUs stores the per-CPU breakdown of eb in the result. It is left
+// empty when a single CPU generated every event.
+func (r *BenchmarkResult) recordCPUs(eb *EventBuffer) {
+	stats := eb.GetCPUs()
+	if len(stats) < 2 {
+		return
+	}
+	r.CPUs = stats
+	r.CPUSkew = cpuSkew(stats)
+}
+
+// formatCPUs renders the per-CPU breakdown, one line each
+func (r *BenchmarkResult) formatCPUs() string {
+	if len(r.CPUs) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "CPUs (skew %.2f):\n", r.CPUSkew)
+	for _, c := range r.CPUs {
+		p99 := "-"
+		if v, ok := c.Latency.Percentile(0.99); ok {
+			p99 = r.LatencyUnit.Format(float64(v))
+		}
+		fmt.Fprintf(&sb, "  cpu%-4d %10d events (%5.1f%%)  %12.0f events/sec  avg %s  p99 %s\n",
+			c.CPU, c.EventCount, c.Share*100, c.Throughput, r.LatencyUnit.Format(c.Latency.AvgNs), p99)
+	}
+	return sb.String()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Layout of the live dashboard
+const (
+	dashboardInterval = time.Second
+	sparklineWidth    = 60 // Seconds of throughput history
+	cpuBarWidth       = 30
+)
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// dashboardTrack is what the dashboard remembers of one benchmark between
+// redraws, to turn its cumulative counters into per-second rates
+type dashboardTrack struct {
+	events   int64
+	cpus     [progressCPUs]int64
+	rates    []float64 // Events per second, oldest first
+	cpuRates map[int]float64
+	done     bool // Its final frame has been drawn
+}
+
+// dashboard redraws every tracked benchmark that is collecting events
+type dashboard struct {
+	out    io.Writer
+	unit   LatencyUnit
+	tracks map[*Progress]*dashboardTrack
+	last   time.Time
+}
+
+var dashboardOnce sync.Once
+
+// startDashboard draws a terminal dashboard of every benchmark's live
+// counters on out, once a second: throughput with a sparkline of its
+// history, drops, per-CPU event bars and recent latency percentiles. Only
+// the first call starts it, so a suite and its benchmarks share one.
+func startDashboard(out io.Writer, unit LatencyUnit) {
+	dashboardOnce.Do(func() {
+		metricsRegistry.Lock()
+		metricsRegistry.tracking = true
+		metricsRegistry.Unlock()
+		d := &dashboard{out: out, unit: unit, tracks: make(map[*Progress]*dashboardTrack), last: time.Now()}
+		go func() {
+			ticker := time.NewTicker(dashboardInterval)
+			defer ticker.Stop()
+			for now := range ticker.C {
+				d.tick(now)
+			}
+		}()
+	})
+}
+
+// tick updates the rates and redraws. A benchmark that stopped collecting
+// gets one last frame, after which the screen is left to its summary.
+func (d *dashboard) tick(now time.Time) {
+	elapsed := now.Sub(d.last).Seconds()
+	d.last = now
+
+	metricsRegistry.Lock()
+	progress := append([]*Progress(nil), metricsRegistry.progress...)
+	metricsRegistry.Unlock()
+	sort.SliceStable(progress, func(i, j int) bool { return progress[i].benchmark < progress[j].benchmark })
+
+	var visible []*Progress
+	for _, p := range progress {
+		if p.startNs.Load() == 0 {
+			continue
+		}
+		t := d.tracks[p]
+		if t == nil {
+			t = &dashboardTrack{}
+			d.tracks[p] = t
+		}
+		if t.done {
+			continue
+		}
+		t.update(p, elapsed)
+		t.done = p.endNs.Load() != 0
+		visible = append(visible, p)
+	}
+	if len(visible) == 0 {
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString("\x1b[H\x1b[2J") // Home and clear
+	fmt.Fprintf(&sb, "ebpf-bench live dashboard  %s\n", now.Format("15:04:05"))
+	for _, p := range visible {
+		d.render(&sb, p, d.tracks[p], now)
+	}
+	io.WriteString(d.out, sb.String())
+}
+
+// update takes the rates since the previous tick from p's counters
+func (t *dashboardTrack) update(p *Progress, elapsed float64) {
+	events := p.events.Load()
+	if elapsed > 0 {
+		t.rates = append(t.rates, float64(events-t.events)/elapsed)
+		if len(t.rates) > sparklineWidth {
+			t.rates = t.rates[len(t.rates)-sparklineWidth:]
+		}
+	}
+	t.events = events
+	t.cpuRates = make(map[int]float64)
+	for cpu := range p.cpus {
+		n := p.cpus[cpu].Load()
+		if n != t.cpus[cpu] && elapsed > 0 {
+			t.cpuRates[cpu] = float64(n-t.cpus[cpu]) / elapsed
+		}
+		t.cpus[cpu] = n
+	}
+}
+
+// render draws one benchmark's panel
+func (d *dashboard) render(sb *strings.Builder, p *Progress, t *dashboardTrack, now time.Time) {
+	state, end := "collecting", now
+	if endNs := p.endNs.Load(); endNs != 0 {
+		state, end = "done", time.Unix(0, endNs)
+	}
+	fmt.Fprintf(sb, "\n%s  %s  %s\n", p.benchmark, end.Sub(time.Unix(0, p.startNs.Load())).Round(100*time.Millisecond), state)
+
+	var rate float64
+	if len(t.rates) > 0 {
+		rate = t.rates[len(t.rates)-1]
+	}
+	fmt.Fprintf(sb, "  Throughput  %12.0f events/s  %s\n", rate, sparkline(t.rates))
+
+	events, dropped := p.events.Load(), p.dropped.Load()
+	var dropRate float64
+	if events+dropped > 0 {
+		dropRate = float64(dropped) / float64(events+dropped) * 100
+	}
+	fmt.Fprintf(sb, "  Events      %12d   Dropped %d (%.4f%%)\n", events, dropped, dropRate)
+
+	if samples := p.recentLatencies(); len(samples) > 0 {
+		stats := computeLatencyStats(samples, DefaultQuantiles)
+		parts := make([]string, 0, len(stats.Percentiles))
+		for _, pc := range stats.Percentiles {
+			parts = append(parts, QuantileKey(pc.Quantile)+" "+d.unit.Format(float64(pc.ValueNs)))
+		}
+		fmt.Fprintf(sb, "  Latency     %s  (last %d samples)\n", strings.Join(parts, "  "), len(samples))
+	}
+
+	cpus := make([]int, 0, len(t.cpuRates))
+	var total float64
+	for cpu, r := range t.cpuRates {
+		cpus = append(cpus, cpu)
+		total += r
+	}
+	sort.Ints(cpus)
+	for _, cpu := range cpus {
+		share := t.cpuRates[cpu] / total
+		filled := int(share*cpuBarWidth + 0.5)
+		fmt.Fprintf(sb, "  cpu%-4d %s%s %5.1f%% %12.0f events/s\n", cpu,
+			strings.Repeat("█", filled), strings.Repeat("░", cpuBarWidth-filled), share*100, t.cpuRates[cpu])
+	}
+}
+
+// sparkline draws rates scaled to the largest of them
+func sparkline(rates []float64) string {
+	var peak float64
+	for _, r := range rates {
+		peak = max(peak, r)
+	}
+	if peak == 0 {
+		return strings.Repeat(string(sparkBlocks[0]), len(rates))
+	}
+	var sb strings.Builder
+	for _, r := range rates {
+		sb.WriteRune(sparkBlocks[int(r/peak*float64(len(sparkBlocks)-1)+0.5)])
+	}
+	return sb.String()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxDeliverySamples bounds the samples kept for delivery percentiles;
+// the streaming statistics cover every event
+const maxDeliverySamples = 100000
+
+// deliveryRecorder accumulates kernel-to-user delivery latency: the time
+// from an event's kernel timestamp to its receipt by the userspace reader.
+// Both ends must read the same clock, which holds for the simulated paths
+// and for bpf_ktime_get_ns against CLOCK_MONOTONIC.
+type deliveryRecorder struct {
+	latency  StreamingLatency
+	samples  []uint64
+	future   int64           // Events stamped after their receipt: clock skew
+	outliers *outlierCapture // Context of the slowest events, if enabled
+}
+
+// record notes the receipt now of an event stamped ts
+func (d *deliveryRecorder) record(ts, now uint64) {
+	if ts > now {
+		d.future++
+		return
+	}
+	d.latency.Record(now - ts)
+	if len(d.samples) < maxDeliverySamples {
+		d.samples = append(d.samples, now-ts)
+	}
+}
+
+// recordEvent is record with the event at hand, for outlier capture;
+// used and capacity give the occupancy of the buffer it came from
+func (d *deliveryRecorder) recordEvent(e *Event, now uint64, used, capacity int) {
+	d.record(e.Timestamp, now)
+	if d.outliers != nil && e.Timestamp <= now {
+		d.outliers.check(e, now-e.Timestamp, now, used, capacity)
+	}
+}
+
+// reset discards everything recorded
+func (d *deliveryRecorder) reset() {
+	*d = deliveryRecorder{samples: d.samples[:0], outliers: d.outliers.reset()}
+}
+
+// merge adds the recordings of o
+func (d *deliveryRecorder) merge(o *deliveryRecorder) {
+	d.latency.Merge(&o.latency)
+	room := maxDeliverySamples - len(d.samples)
+	d.samples = append(d.samples, o.samples[:min(room, len(o.samples))]...)
+	d.future += o.future
+	d.outliers = d.outliers.merge(o.outliers)
+}
+
+// stats returns the delivery latency with the given percentiles, or nil
+// when nothing was recorded
+func (d *deliveryRecorder) stats(quantiles []float64) *LatencyStats {
+	s := d.latency.Stats()
+	if s.Samples == 0 {
+		return nil
+	}
+	s.Percentiles = computeLatencyStats(d.samples, quantiles).Percentiles
+	return &s
+}
+
+// GetDeliveryLatency returns the kernel-to-user latency of the events
+// added since Start, or nil when there were none
+func (eb *EventBuffer) GetDeliveryLatency() *LatencyStats {
+	return eb.delivery.stats(eb.quantiles)
+}
+
+// recordDelivery stores the delivery latency of eb's events
+func (r *BenchmarkResult) recordDelivery(eb *EventBuffer) {
+	r.DeliveryLatency = eb.GetDeliveryLatency()
+	r.Outliers = eb.delivery.outliers.stats()
+	if eb.delivery.future > 0 {
+		r.Quality.Flag(QualityClockSkew)
+	}
+}
+
+// formatDelivery renders the delivery latency, if measured
+func (r *BenchmarkResult) formatDelivery() string {
+	s := r.DeliveryLatency
+	if s == nil {
+		return ""
+	}
+	p := func(q float64) string {
+		if v, ok := s.Percentile(q); ok {
+			return r.LatencyUnit.Format(float64(v))
+		}
+		return "-"
+	}
+	return fmt.Sprintf("Delivery:        avg %s, p50 %s, p99 %s, p999 %s, max %s (kernel to user)\n",
+		r.LatencyUnit.Format(s.AvgNs), p(0.5), p(0.99), p(0.999), r.LatencyUnit.Format(float64(s.MaxNs)))
+}
+
+// nowNs is the receive timestamp of a userspace reader
+func nowNs() uint64 {
+	return uint64(time.Now().UnixNano())
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// -disk-check modes
+const (
+	diskCheckRefuse = "refuse" // Do not start a run whose artifacts will not fit
+	diskCheckWarn   = "warn"
+	diskCheckOff    = "off"
+)
+
+// Artifact size estimates, from results and archives of typical runs
+const (
+	resultBaseBytes    = 64 << 10 // One result record, histogram and breakdowns included
+	sampledEventBytes  = 160      // One -sample-events entry in pretty-printed JSON
+	archivedEventBytes = 8        // One delta-encoded, gzipped event; random payloads take about 6
+	dumpedEventBytes   = dumpRecordSize
+)
+
+// artifact is a file a run will write, with its expected size
+type artifact struct {
+	path  string
+	bytes uint64
+	what  string
+}
+
+// resultArtifacts estimates the output file and history store of a run
+// keeping samples raw events per result
+func (o benchOptions) resultArtifacts(samples int) []artifact {
+	size := uint64(resultBaseBytes+samples*sampledEventBytes) * uint64(max(o.Iterations, 1))
+	var artifacts []artifact
+	if o.Output != "" {
+		artifacts = append(artifacts, artifact{o.Output, size, "result file"})
+	}
+	if o.Store != "" {
+		artifacts = append(artifacts, artifact{OpenResultStore(o.Store).path, size, "history store"})
+	}
+	return artifacts
+}
+
+// checkDisk compares the estimated artifacts with the free space of the
+// filesystems they go to, before anything is written: a dump cut short by
+// ENOSPC otherwise looks like lost events. Under -disk-check refuse a run
+// that will not fit is an error; warn only prints the shortfall. Filling
+// most of the free space is always a warning.
+func (o benchOptions) checkDisk(artifacts ...artifact) error {
+	if o.DiskCheck == diskCheckOff {
+		return nil
+	}
+	type filesystem struct {
+		dir  string
+		free uint64
+		need uint64
+		what []string
+	}
+	var order []syscall.Fsid
+	byFS := make(map[syscall.Fsid]*filesystem)
+	for _, a := range artifacts {
+		dir, st, err := statfsExisting(filepath.Dir(a.path))
+		if err != nil {
+			continue // Creating the file will report it
+		}
+		fs := byFS[st.Fsid]
+		if fs == nil {
+			fs = &filesystem{dir: dir, free: st.Bavail * uint64(st.Bsize)}
+			byFS[st.Fsid] = fs
+			order = append(order, st.Fsid)
+		}
+		fs.need += a.bytes
+		fs.what = append(fs.what, fmt.Sprintf("%s %s (%s)", a.what, a.path, formatBytes(a.bytes)))
+	}
+	for _, id := range order {
+		fs := byFS[id]
+		what := strings.Join(fs.what, ", ")
+		switch {
+		case fs.need > fs.free && o.DiskCheck == diskCheckRefuse:
+			return fmt.Errorf("not enough disk space on %s: %s need about %s but %s is free (-disk-check warn runs anyway)",
+				fs.dir, what, formatBytes(fs.need), formatBytes(fs.free))
+		case fs.need > fs.free:
+			slog.Warn(fmt.Sprintf("%s need about %s but %s is free on %s; they will be cut short",
+				what, formatBytes(fs.need), formatBytes(fs.free), fs.dir))
+		case fs.need > fs.free/10*9:
+			slog.Warn(fmt.Sprintf("%s will fill most of the %s free on %s", what, formatBytes(fs.free), fs.dir))
+		}
+	}
+	return nil
+}
+
+// statfsExisting statfs's dir, or its closest existing parent when the
+// run is yet to create it
+func statfsExisting(dir string) (string, *syscall.Statfs_t, error) {
+	for {
+		var st syscall.Statfs_t
+		err := syscall.Statfs(dir, &st)
+		if err == nil {
+			return dir, &st, nil
+		}
+		parent := filepath.Dir(dir)
+		if !errors.Is(err, syscall.ENOENT) || parent == dir {
+			return "", nil, err
+		}
+		dir = parent
+	}
+}
+
+// formatBytes renders a size in binary units
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// runDoctor inspects the host and suggests settings for more stable runs
+func runDoctor(args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	threads := fs.Int("threads", 2, "Number of benchmark threads to suggest pinning targets for")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	host := CollectHostInfo()
+
+	PrintBenchmarkHeader("Host Doctor")
+	fmt.Printf("Kernel:          %s\n", orNone(host.KernelRelease))
+	fmt.Printf("CPU:             %s\n", host.formatHostEnvironment())
+	for _, n := range host.NUMANodes {
+		fmt.Printf("NUMA node %d:     CPUs %s, %d MB\n", n.ID, orNone(FormatCPUList(n.CPUs)), n.MemoryMB)
+	}
+	fmt.Printf("Fingerprint:     %s\n", host.Fingerprint)
+	fmt.Printf("Online CPUs:     %s\n", orNone(FormatCPUList(host.OnlineCPUs)))
+	fmt.Printf("Allowed CPUs:    %s\n", orNone(FormatCPUList(host.AllowedCPUs)))
+	fmt.Printf("Cgroup cpuset:   %s\n", orNone(host.CPUSet))
+	fmt.Printf("isolcpus:        %s\n", orNone(FormatCPUList(host.IsolatedCPUs)))
+	fmt.Printf("nohz_full:       %s\n", orNone(FormatCPUList(host.NohzFullCPUs)))
+	fmt.Println()
+
+	if len(host.IsolatedCPUs) == 0 {
+		fmt.Println("✗ No isolated CPUs: benchmark threads share cores with other work")
+		if suggestion := SuggestIsolation(host); suggestion != "" {
+			fmt.Println("  Add to the kernel command line and reboot:")
+			fmt.Printf("    %s\n", suggestion)
+		} else {
+			fmt.Println("  Host has too few CPUs to isolate a useful subset")
+		}
+	} else {
+		fmt.Println("✓ Isolated CPUs available")
+		if len(host.NohzFullCPUs) == 0 {
+			fmt.Println("  Consider also setting nohz_full and rcu_nocbs for the isolated CPUs")
+		}
+	}
+
+	if host.CPUGovernor != "" && host.CPUGovernor != "performance" {
+		fmt.Printf("✗ CPU frequency governor is %s: clock speed varies with load\n", host.CPUGovernor)
+		fmt.Println("  Set it with: cpupower frequency-set -g performance")
+	}
+	if host.BPFJITEnable == "0" {
+		fmt.Println("✗ BPF JIT is off: programs run in the interpreter")
+		fmt.Println("  Enable it with: sysctl net.core.bpf_jit_enable=1")
+	}
+	if host.Clocksource != "" && host.Clocksource != "tsc" && host.Clocksource != "arch_sys_counter" {
+		fmt.Printf("✗ Clocksource is %s: timestamps cost more than with tsc\n", host.Clocksource)
+	}
+
+	if host.KernelConfigSource == "" {
+		fmt.Println("✗ Kernel config unavailable (enable CONFIG_IKCONFIG_PROC or install /boot/config-*)")
+	} else {
+		fmt.Printf("Kernel config (%s):\n", host.KernelConfigSource)
+		for _, opt := range kernelConfigHighlights {
+			if v, ok := host.KernelConfig[opt]; ok {
+				fmt.Printf("  %-28s %s\n", opt, v)
+			}
+		}
+		if host.KernelConfig["CONFIG_BPF_JIT_ALWAYS_ON"] != "y" {
+			fmt.Println("  Note: BPF JIT is not forced on; check /proc/sys/net/core/bpf_jit_enable")
+		}
+	}
+	if len(host.CmdlineMitigations) > 0 {
+		fmt.Printf("Mitigation params: %s\n", strings.Join(host.CmdlineMitigations, " "))
+	}
+	fmt.Printf("Mitigation profile: %s\n", host.MitigationProfile)
+
+	if pins := SelectPinningCPUs(host, *threads); len(pins) > 0 {
+		fmt.Printf("Suggested pinning targets: %s\n", FormatCPUList(pins))
+	}
+
+	return nil
+}
+
+// orNone substitutes "none" for an empty value
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
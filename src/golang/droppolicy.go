@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// DropPolicy selects what an EventBuffer does with an event that arrives
+// while it is full
+type DropPolicy string
+
+const (
+	DropNewest DropPolicy = "drop-new" // Reject the arriving event
+	DropOldest DropPolicy = "drop-old" // Overwrite the oldest event, as a ring does
+	DropBlock  DropPolicy = "block"    // Wait up to a timeout for the consumer to free space, then reject
+)
+
+// DefaultBlockTimeout bounds how long the block policy holds up the
+// producer waiting for space
+const DefaultBlockTimeout = time.Millisecond
+
+// ParseDropPolicy parses a -drop-policy flag value
+func ParseDropPolicy(s string) (DropPolicy, error) {
+	switch p := DropPolicy(s); p {
+	case DropNewest, DropOldest, DropBlock:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown drop policy %q (want drop-new, drop-old or block)", s)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// Slots of the emit cost map, after EMIT_COST_* in benchmark.h: log2
+// buckets of the time from reserve to submit, then the totals
+const (
+	emitCostBuckets = 32
+	emitCostCount   = emitCostBuckets + 0 // Emits timed
+	emitCostSum     = emitCostBuckets + 1 // Their total time in ns
+	emitCostClock   = emitCostBuckets + 2 // Cheapest back-to-back clock pair
+	emitCostSlots   = emitCostBuckets + 3
+)
+
+// emitCostClockEvery is how often, in emits, the program times its clock
+const emitCostClockEvery = 1024
+
+// emitCostOpenNs is the lower bound of the last bucket, which holds every
+// longer emit too
+const emitCostOpenNs = 1 << (emitCostBuckets - 2)
+
+// emitCostMap is one CPU's emit cost map, as the program fills it when
+// userspace sets the self-time slot of the config map
+type emitCostMap [emitCostSlots]uint64
+
+// record adds an emit that took d ns, timing the clock on every
+// emitCostClockEvery-th emit as emit_done does
+func (m *emitCostMap) record(d uint64) {
+	m[min(bits.Len64(d), emitCostBuckets-1)]++
+	m[emitCostSum] += d
+	m[emitCostCount]++
+	if (m[emitCostCount]-1)%emitCostClockEvery != 0 {
+		return
+	}
+	a := nowNs()
+	if c := nowNs() - a; m[emitCostClock] == 0 || c < m[emitCostClock] {
+		m[emitCostClock] = c
+	}
+}
+
+// EmitCostStats are the program's timing of its own reserve-to-submit
+// path, so producer cost is separate from what the consumer spends
+type EmitCostStats struct {
+	Simulated  bool              // Timed by the userspace producer, not read from the emit_cost map
+	Emits      int64             // Emits timed
+	MeanNs     float64           // Mean reserve to submit, without the clock's cost
+	P50Ns      uint64            // Upper bound of the median's bucket; the lower bound from emitCostOpenNs up
+	P99Ns      uint64            // Upper bound of the 99th percentile's bucket, as P50Ns
+	ClockNs    uint64            // Cost of a clock read, taken out of MeanNs
+	ConsumerNs float64           // Consumer CPU time per event, for comparison
+	Histogram  []HistogramBucket // Non-empty log2 buckets
+}
+
+// emitCostStats sums the per-CPU maps. consumerUs is the consumer's CPU
+// time per event.
+func emitCostStats(cpus []emitCostMap, consumerUs float64) *EmitCostStats {
+	var total emitCostMap
+	for _, m := range cpus {
+		for i := 0; i < emitCostClock; i++ {
+			total[i] += m[i]
+		}
+		if c := m[emitCostClock]; c > 0 && (total[emitCostClock] == 0 || c < total[emitCostClock]) {
+			total[emitCostClock] = c
+		}
+	}
+	s := &EmitCostStats{Emits: int64(total[emitCostCount]), ClockNs: total[emitCostClock], ConsumerNs: consumerUs * 1000}
+	if s.Emits == 0 {
+		return s
+	}
+	s.MeanNs = max(float64(total[emitCostSum])/float64(s.Emits)-float64(s.ClockNs), 0)
+	var seen int64
+	for i := 0; i < emitCostBuckets; i++ {
+		n := int64(total[i])
+		if n == 0 {
+			continue
+		}
+		b := HistogramBucket{Count: n}
+		if i > 0 {
+			b.LowNs, b.HighNs = 1<<(i-1), 1<<i-1
+		}
+		if i == emitCostBuckets-1 {
+			b.HighNs = b.LowNs // Open-ended: emitCostBound reports it as a lower bound
+		}
+		s.Histogram = append(s.Histogram, b)
+		if seen < (s.Emits+1)/2 && seen+n >= (s.Emits+1)/2 {
+			s.P50Ns = b.HighNs
+		}
+		if q := (s.Emits*99 + 99) / 100; seen < q && seen+n >= q {
+			s.P99Ns = b.HighNs
+		}
+		seen += n
+	}
+	return s
+}
+
+// formatEmitCost renders the program's timing of its emits beside the
+// consumer's cost per event
+func (r *BenchmarkResult) formatEmitCost() string {
+	c := r.EmitCost
+	if c == nil {
+		return ""
+	}
+	source := "the producer"
+	if c.Simulated {
+		source = "the simulated producer"
+	}
+	s := fmt.Sprintf("Emit Cost:       %d emits timed by %s, mean %s (p50 %s, p99 %s; %d ns clock read removed)",
+		c.Emits, source, r.LatencyUnit.Format(c.MeanNs), r.emitCostBound(c.P50Ns), r.emitCostBound(c.P99Ns), c.ClockNs)
+	if c.ConsumerNs > 0 {
+		s += fmt.Sprintf("; consumer %s/event, producer %.0f%% of the pair", r.LatencyUnit.Format(c.ConsumerNs), 100*c.MeanNs/(c.MeanNs+c.ConsumerNs))
+	}
+	s += "\n"
+	if len(c.Histogram) > 0 {
+		var parts []string
+		for _, b := range c.Histogram {
+			parts = append(parts, fmt.Sprintf("%s: %d", r.emitCostBound(b.HighNs), b.Count))
+		}
+		s += "                 emits " + strings.Join(parts, ", ") + "\n"
+	}
+	return s
+}
+
+// emitCostBound renders a bucket bound: "<= high", or ">= low" for the
+// open-ended last bucket
+func (r *BenchmarkResult) emitCostBound(ns uint64) string {
+	if ns >= emitCostOpenNs {
+		return ">= " + r.LatencyUnit.Format(emitCostOpenNs)
+	}
+	return "<= " + r.LatencyUnit.Format(float64(ns))
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Event schemas. Version 1 is struct event of benchmark.h padded to the
+// 32 bytes EventSize reports; version 2 appends the fields a richer
+// program would capture.
+const (
+	schemaV1 = 1
+	schemaV2 = 2
+)
+
+// Record sizes of the fixed layouts
+const (
+	eventCoreSize = 24 // timestamp, pid, cpu_id, event_type, data
+	eventV1Size   = 32 // Core plus padding
+	eventV2Size   = eventV1Size + 8 + 16
+)
+
+// extendedEvent is an Event with the fields schema 2 adds. A schema 1
+// producer leaves them zero.
+type extendedEvent struct {
+	Event
+	CgroupID uint64
+	Comm     [16]byte
+}
+
+// schemaSize is the fixed-layout record size of schema
+func schemaSize(schema int) int {
+	if schema >= schemaV2 {
+		return eventV2Size
+	}
+	return eventV1Size
+}
+
+// decodeOutcome classifies a decoded record
+type decodeOutcome int
+
+const (
+	decodeExact     decodeOutcome = iota // Producer and consumer schemas agree
+	decodeDefaulted                      // Fields the consumer expects were absent and left zero
+	decodeSkipped                        // Fields the consumer does not know were ignored
+)
+
+// eventFraming is how an event is laid out in a ring record, and so what
+// a consumer can do with a record from a producer on another schema
+type eventFraming interface {
+	Name() string
+	// MaxSize bounds the encoded size of an event of schema
+	MaxSize(schema int) int
+	// Encode writes e as schema into buf and returns the bytes used
+	Encode(buf []byte, e *extendedEvent, schema int) int
+	// Decode reads rec into e as a consumer of schema. Fields the record
+	// does not carry are zeroed.
+	Decode(rec []byte, e *extendedEvent, schema int) (decodeOutcome, error)
+}
+
+// eventFramings maps -framing values to framings
+var eventFramings = map[string]eventFraming{
+	"raw":       rawFraming{},
+	"prefix":    prefixFraming{},
+	"versioned": versionedFraming{},
+	"tlv":       tlvFraming{},
+}
+
+// putFixed writes the fixed layout of schema, zeroing padding
+func putFixed(buf []byte, e *extendedEvent, schema int) int {
+	binary.LittleEndian.PutUint64(buf[0:], e.Timestamp)
+	binary.LittleEndian.PutUint32(buf[8:], e.PID)
+	binary.LittleEndian.PutUint32(buf[12:], e.CPU)
+	binary.LittleEndian.PutUint32(buf[16:], e.EventType)
+	binary.LittleEndian.PutUint32(buf[20:], e.Data)
+	binary.LittleEndian.PutUint64(buf[24:], 0)
+	if schema < schemaV2 {
+		return eventV1Size
+	}
+	binary.LittleEndian.PutUint64(buf[32:], e.CgroupID)
+	copy(buf[40:eventV2Size], e.Comm[:])
+	return eventV2Size
+}
+
+// getFixed reads as much of the fixed layout of schema as rec holds, which
+// must be at least the core fields
+func getFixed(rec []byte, e *extendedEvent, schema int) {
+	e.Timestamp = binary.LittleEndian.Uint64(rec[0:])
+	e.PID = binary.LittleEndian.Uint32(rec[8:])
+	e.CPU = binary.LittleEndian.Uint32(rec[12:])
+	e.EventType = binary.LittleEndian.Uint32(rec[16:])
+	e.Data = binary.LittleEndian.Uint32(rec[20:])
+	e.CgroupID = 0
+	e.Comm = [16]byte{}
+	if schema >= schemaV2 && len(rec) >= eventV2Size {
+		e.CgroupID = binary.LittleEndian.Uint64(rec[32:])
+		copy(e.Comm[:], rec[40:eventV2Size])
+	}
+}
+
+// rawFraming casts the record to the consumer's struct, as a consumer
+// built against one header does: any size mismatch is an error
+type rawFraming struct{}
+
+func (rawFraming) Name() string           { return "raw" }
+func (rawFraming) MaxSize(schema int) int { return schemaSize(schema) }
+func (rawFraming) Encode(buf []byte, e *extendedEvent, schema int) int {
+	return putFixed(buf, e, schema)
+}
+
+func (rawFraming) Decode(rec []byte, e *extendedEvent, schema int) (decodeOutcome, error) {
+	if want := schemaSize(schema); len(rec) != want {
+		return 0, fmt.Errorf("record is %d bytes, want %d", len(rec), want)
+	}
+	getFixed(rec, e, schema)
+	return decodeExact, nil
+}
+
+// prefixFraming only ever appends fields, and the consumer reads the
+// prefix it knows from the record length the ring reports. It needs no
+// extra bytes but cannot tell a new field from a changed one.
+type prefixFraming struct{}
+
+func (prefixFraming) Name() string           { return "prefix" }
+func (prefixFraming) MaxSize(schema int) int { return schemaSize(schema) }
+func (prefixFraming) Encode(buf []byte, e *extendedEvent, schema int) int {
+	return putFixed(buf, e, schema)
+}
+
+func (prefixFraming) Decode(rec []byte, e *extendedEvent, schema int) (decodeOutcome, error) {
+	if len(rec) < eventCoreSize {
+		return 0, fmt.Errorf("record is %d bytes, shorter than the %d-byte core", len(rec), eventCoreSize)
+	}
+	getFixed(rec, e, schema)
+	switch want := schemaSize(schema); {
+	case len(rec) > want:
+		return decodeSkipped, nil
+	case len(rec) < want:
+		return decodeDefaulted, nil
+	}
+	return decodeExact, nil
+}
+
+// versionedHeaderSize is the version and body length before each record
+const versionedHeaderSize = 4
+
+// versionedFraming prefixes the fixed layout with its schema version and
+// length, so a consumer knows which fields are present without trusting
+// the record size
+type versionedFraming struct{}
+
+func (versionedFraming) Name() string           { return "versioned" }
+func (versionedFraming) MaxSize(schema int) int { return versionedHeaderSize + schemaSize(schema) }
+
+func (versionedFraming) Encode(buf []byte, e *extendedEvent, schema int) int {
+	n := putFixed(buf[versionedHeaderSize:], e, schema)
+	binary.LittleEndian.PutUint16(buf[0:], uint16(schema))
+	binary.LittleEndian.PutUint16(buf[2:], uint16(n))
+	return versionedHeaderSize + n
+}
+
+func (versionedFraming) Decode(rec []byte, e *extendedEvent, schema int) (decodeOutcome, error) {
+	if len(rec) < versionedHeaderSize {
+		return 0, fmt.Errorf("record is %d bytes, shorter than its header", len(rec))
+	}
+	version := int(binary.LittleEndian.Uint16(rec[0:]))
+	body := rec[versionedHeaderSize:]
+	if version < schemaV1 {
+		return 0, fmt.Errorf("invalid version %d", version)
+	}
+	if n := int(binary.LittleEndian.Uint16(rec[2:])); n != len(body) || n < schemaSize(min(version, schema)) {
+		return 0, fmt.Errorf("version %d body is %d bytes, header says %d", version, len(body), n)
+	}
+	// Versions this consumer knows have a fixed size; only newer ones may
+	// carry fields beyond it
+	if version <= schemaV2 && len(body) != schemaSize(version) {
+		return 0, fmt.Errorf("version %d body is %d bytes, want %d", version, len(body), schemaSize(version))
+	}
+	getFixed(body, e, min(version, schema))
+	switch {
+	case version > schema:
+		return decodeSkipped, nil
+	case version < schema:
+		return decodeDefaulted, nil
+	}
+	return decodeExact, nil
+}
+
+// Field types of the TLV framing
+const (
+	tlvTimestamp = iota + 1
+	tlvPID
+	tlvCPU
+	tlvEventType
+	tlvData
+	tlvCgroupID
+	tlvComm
+)
+
+// tlvFieldSchema is the schema that introduced each field type
+var tlvFieldSchema = [...]int{
+	tlvTimestamp: schemaV1,
+	tlvPID:       schemaV1,
+	tlvCPU:       schemaV1,
+	tlvEventType: schemaV1,
+	tlvData:      schemaV1,
+	tlvCgroupID:  schemaV2,
+	tlvComm:      schemaV2,
+}
+
+// tlvFraming encodes every field as a one-byte type, a one-byte length
+// and the value. Consumers skip the types they do not know by length and
+// zero the ones missing, so fields can be added, dropped or reordered.
+type tlvFraming struct{}
+
+func (tlvFraming) Name() string { return "tlv" }
+
+func (tlvFraming) MaxSize(schema int) int {
+	n := 5 * 2 // Five core fields of two header bytes
+	n += eventCoreSize
+	if schema >= schemaV2 {
+		n += 2*2 + 8 + 16
+	}
+	return n
+}
+
+func (tlvFraming) Encode(buf []byte, e *extendedEvent, schema int) int {
+	n := 0
+	put := func(typ byte, size int) []byte {
+		buf[n], buf[n+1] = typ, byte(size)
+		v := buf[n+2 : n+2+size]
+		n += 2 + size
+		return v
+	}
+	binary.LittleEndian.PutUint64(put(tlvTimestamp, 8), e.Timestamp)
+	binary.LittleEndian.PutUint32(put(tlvPID, 4), e.PID)
+	binary.LittleEndian.PutUint32(put(tlvCPU, 4), e.CPU)
+	binary.LittleEndian.PutUint32(put(tlvEventType, 4), e.EventType)
+	binary.LittleEndian.PutUint32(put(tlvData, 4), e.Data)
+	if schema >= schemaV2 {
+		binary.LittleEndian.PutUint64(put(tlvCgroupID, 8), e.CgroupID)
+		copy(put(tlvComm, 16), e.Comm[:])
+	}
+	return n
+}
+
+func (tlvFraming) Decode(rec []byte, e *extendedEvent, schema int) (decodeOutcome, error) {
+	*e = extendedEvent{}
+	var seen uint32
+	skipped := false
+	for len(rec) > 0 {
+		if len(rec) < 2 || len(rec) < 2+int(rec[1]) {
+			return 0, fmt.Errorf("truncated field of type %d", rec[0])
+		}
+		typ, v := int(rec[0]), rec[2:2+int(rec[1])]
+		rec = rec[2+len(v):]
+		if typ >= len(tlvFieldSchema) || tlvFieldSchema[typ] == 0 || tlvFieldSchema[typ] > schema {
+			skipped = true
+			continue
+		}
+		if !tlvFits(typ, len(v)) {
+			return 0, fmt.Errorf("field of type %d is %d bytes", typ, len(v))
+		}
+		if seen&(1<<typ) != 0 {
+			return 0, fmt.Errorf("field of type %d repeated", typ) // Which copy is right is unknowable
+		}
+		seen |= 1 << typ
+		switch typ {
+		case tlvTimestamp:
+			e.Timestamp = binary.LittleEndian.Uint64(v)
+		case tlvPID:
+			e.PID = binary.LittleEndian.Uint32(v)
+		case tlvCPU:
+			e.CPU = binary.LittleEndian.Uint32(v)
+		case tlvEventType:
+			e.EventType = binary.LittleEndian.Uint32(v)
+		case tlvData:
+			e.Data = binary.LittleEndian.Uint32(v)
+		case tlvCgroupID:
+			e.CgroupID = binary.LittleEndian.Uint64(v)
+		case tlvComm:
+			copy(e.Comm[:], v)
+		}
+	}
+	for typ := tlvTimestamp; typ < len(tlvFieldSchema); typ++ {
+		if tlvFieldSchema[typ] <= schema && seen&(1<<typ) == 0 {
+			return decodeDefaulted, nil
+		}
+	}
+	if skipped {
+		return decodeSkipped, nil
+	}
+	return decodeExact, nil
+}
+
+// tlvFits reports whether a value of size bytes is valid for field typ
+func tlvFits(typ, size int) bool {
+	switch typ {
+	case tlvTimestamp, tlvCgroupID:
+		return size == 8
+	case tlvComm:
+		return size <= 16
+	}
+	return size == 4
+}
+
+// recordEncodings maps -encoding values of the throughput benchmarks to
+// the framing the program writes records with
+var recordEncodings = map[string]eventFraming{
+	"fixed": rawFraming{},
+	"tlv":   tlvFraming{},
+}
+
+// EncodingStats describe the ring record encoding of a run whose events
+// were encoded by the program and decoded by the consumer
+type EncodingStats struct {
+	Encoding      string
+	BytesPerEvent float64
+	EncodeNs      float64 // Mean program-side encode time
+	DecodeNs      float64 // Mean consumer-side decode time
+	Rejected      int64   // Records that failed to decode, dropped
+}
+
+// recordCodec round-trips a tick's events through ring records of one
+// encoding, timing each side
+type recordCodec struct {
+	framing  eventFraming
+	arena    []byte
+	lens     []int
+	scratch  extendedEvent // Passed to the framing, which would let a local escape
+	bytes    int64
+	records  int64
+	rejected int64
+	encodeNs int64
+	decodeNs int64
+}
+
+func newRecordCodec(framing eventFraming) *recordCodec {
+	return &recordCodec{framing: framing}
+}
+
+// roundTrip encodes events as v1 records, decodes them back in place and
+// then passes each decoded event to deliver, outside the timed decode.
+// Only counted runs update the statistics.
+func (c *recordCodec) roundTrip(events []Event, count bool, deliver func(Event)) {
+	size := c.framing.MaxSize(schemaV1)
+	if need := len(events) * size; len(c.arena) < need {
+		c.arena = make([]byte, need)
+		c.lens = make([]int, len(events))
+	}
+	t0 := time.Now()
+	e := &c.scratch
+	for i := range events {
+		*e = extendedEvent{Event: events[i]}
+		c.lens[i] = c.framing.Encode(c.arena[i*size:], e, schemaV1)
+	}
+	t1 := time.Now()
+	var rejected, bytes int64
+	decoded := events[:0]
+	for i := range events {
+		*e = extendedEvent{}
+		rec := c.arena[i*size : i*size+c.lens[i]]
+		bytes += int64(len(rec))
+		if _, err := c.framing.Decode(rec, e, schemaV1); err != nil {
+			rejected++
+			continue
+		}
+		decoded = append(decoded, e.Event)
+	}
+	t2 := time.Now()
+	for _, e := range decoded {
+		deliver(e)
+	}
+	if !count {
+		return
+	}
+	c.decodeNs += t2.Sub(t1).Nanoseconds()
+	c.encodeNs += t1.Sub(t0).Nanoseconds()
+	c.records += int64(len(events))
+	c.rejected += rejected
+	c.bytes += bytes
+}
+
+// stats returns the encoding statistics, or nil for a nil codec
+func (c *recordCodec) stats() *EncodingStats {
+	if c == nil {
+		return nil
+	}
+	s := &EncodingStats{Encoding: c.framing.Name(), Rejected: c.rejected}
+	if s.Encoding == "raw" {
+		s.Encoding = "fixed"
+	}
+	if c.records > 0 {
+		s.BytesPerEvent = float64(c.bytes) / float64(c.records)
+		s.EncodeNs = float64(c.encodeNs) / float64(c.records)
+		s.DecodeNs = float64(c.decodeNs) / float64(c.records)
+	}
+	return s
+}
+
+// formatEncoding renders the record encoding, if events were decoded
+func (r *BenchmarkResult) formatEncoding() string {
+	s := r.Encoding
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("Encoding:        %s, %.1f B/event, encode %.1f ns, decode %.1f ns, %d rejected\n",
+		s.Encoding, s.BytesPerEvent, s.EncodeNs, s.DecodeNs, s.Rejected)
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// An event dump is a flat file of the raw events a consumer received, for
+// replaying them through the analysis later. It starts with a fixed
+// header:
+//
+//	magic "ebpfdump", version u16, record size u16, metadata length u32,
+//	window start u64, window end u64, event count u64
+//
+// then the metadata as JSON and one record per event. A version 1 record
+// is the 32-byte fixed layout of schema 1 with the padding holding the
+// receipt time, so delivery latency can be recomputed. Times are Unix ns
+// and all integers little-endian. The window and count are filled in when
+// the dump is closed; a dump cut short leaves them zero.
+
+const (
+	dumpMagic       = "ebpfdump"
+	dumpVersion     = 1
+	dumpHeaderSize  = 40
+	dumpRecordSize  = eventV1Size
+	dumpReceiptOff  = 24 // Receipt time, in the schema 1 padding
+	dumpWindowOff   = 16 // Window start, end and event count in the header
+	maxDumpMetadata = 1 << 20
+)
+
+// dumpMetadata describes the run that wrote a dump, so a replay reports
+// under the same names
+type dumpMetadata struct {
+	Benchmark      string
+	Name           string
+	Language       string
+	ProgramType    string
+	Tracepoint     string `json:",omitempty"`
+	DataMechanism  string
+	ReaderStrategy string
+	Payload        string `json:",omitempty"`
+	RateProfile    string `json:",omitempty"`
+}
+
+// dumpMetadataOf takes the metadata of a dump from the result of the run
+// writing it
+func dumpMetadataOf(benchmark string, r *BenchmarkResult) dumpMetadata {
+	return dumpMetadata{
+		Benchmark:      benchmark,
+		Name:           r.Name,
+		Language:       r.Language,
+		ProgramType:    r.ProgramType,
+		Tracepoint:     r.Tracepoint,
+		DataMechanism:  r.DataMechanism,
+		ReaderStrategy: r.ReaderStrategy,
+		Payload:        r.Payload,
+		RateProfile:    r.RateProfile,
+	}
+}
+
+// DumpStats describe the event dump written during a run
+type DumpStats struct {
+	Path   string
+	Events int64
+	Bytes  int64            // Dump file size
+	DumpNs float64          // Mean time to dump one event, on the consumer path
+	IO     *ArtifactIOStats // How the file was written
+	Error  string           `json:",omitempty"` // Why dumping stopped early
+}
+
+// eventDump writes received events to a dump file
+type eventDump struct {
+	file  *artifactFile
+	out   *countingWriter
+	bw    *bufio.Writer
+	rec   [dumpRecordSize]byte
+	stats DumpStats
+	spent time.Duration
+	err   error
+}
+
+// createEventDump creates the dump at path, written under policy, and
+// writes its header
+func createEventDump(path string, meta dumpMetadata, policy artifactPolicy) (*eventDump, error) {
+	m, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	f, err := createArtifactFile(path, policy)
+	if err != nil {
+		return nil, err
+	}
+	out := &countingWriter{w: f}
+	d := &eventDump{file: f, out: out, bw: bufio.NewWriterSize(out, 64*1024)}
+	d.stats.Path = path
+	var h [dumpHeaderSize]byte
+	copy(h[:], dumpMagic)
+	binary.LittleEndian.PutUint16(h[8:], dumpVersion)
+	binary.LittleEndian.PutUint16(h[10:], dumpRecordSize)
+	binary.LittleEndian.PutUint32(h[12:], uint32(len(m)))
+	d.bw.Write(h[:])
+	if _, err := d.bw.Write(m); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// write dumps an event received at now. After a write error the dump
+// stops and reports it.
+func (d *eventDump) write(e *Event, now uint64) {
+	if d == nil || d.err != nil {
+		return
+	}
+	start := time.Now()
+	putFixed(d.rec[:], &extendedEvent{Event: *e}, schemaV1)
+	binary.LittleEndian.PutUint64(d.rec[dumpReceiptOff:], now)
+	if _, err := d.bw.Write(d.rec[:]); err != nil {
+		d.err = err
+	}
+	d.stats.Events++
+	d.spent += time.Since(start)
+}
+
+// Close flushes the dump, fills in the window of the run and returns the
+// dump's statistics; nil for a nil dump
+func (d *eventDump) Close(start, end time.Time) *DumpStats {
+	if d == nil {
+		return nil
+	}
+	t := time.Now()
+	var w [24]byte
+	binary.LittleEndian.PutUint64(w[0:], uint64(start.UnixNano()))
+	binary.LittleEndian.PutUint64(w[8:], uint64(end.UnixNano()))
+	binary.LittleEndian.PutUint64(w[16:], uint64(d.stats.Events))
+	steps := []func() error{
+		d.bw.Flush,
+		func() error { _, err := d.file.WriteAt(w[:], dumpWindowOff); return err },
+		d.file.Close,
+	}
+	// Finishing the file, which waits for a writer thread and fsyncs, is
+	// not counted against the consumer
+	for i, step := range steps {
+		if i == 1 {
+			d.spent += time.Since(t)
+		}
+		if err := step(); err != nil && d.err == nil {
+			d.err = err
+		}
+	}
+	s := d.stats
+	s.Bytes = d.out.n
+	s.IO = d.file.Stats()
+	if s.Events > 0 {
+		s.DumpNs = float64(d.spent.Nanoseconds()) / float64(s.Events)
+	}
+	if d.err != nil {
+		s.Error = d.err.Error()
+	}
+	return &s
+}
+
+// formatDump renders the dump statistics, if written
+func (r *BenchmarkResult) formatDump() string {
+	s := r.Dump
+	if s == nil {
+		return ""
+	}
+	line := fmt.Sprintf("Dump:            %s, %d events in %d bytes, %.1f ns/event on the consumer path",
+		s.Path, s.Events, s.Bytes, s.DumpNs)
+	if s.Error != "" {
+		line += ", stopped: " + s.Error
+	}
+	return line + "\n" + formatArtifactIO(s.IO, r.LatencyUnit)
+}
+
+// dumpReader reads the events of a dump back
+type dumpReader struct {
+	r        *bufio.Reader
+	version  int
+	recSize  int
+	meta     dumpMetadata
+	start    uint64 // Window start; 0 if the dump was not closed
+	end      uint64
+	declared uint64 // Event count of the header
+	rec      []byte
+	read     int64
+	partial  bool // The last record was cut short
+}
+
+// newDumpReader reads the header of a dump. Records larger than a
+// version 1 record, from a later version, have their extra bytes skipped.
+func newDumpReader(r io.Reader) (*dumpReader, error) {
+	d := &dumpReader{r: bufio.NewReaderSize(r, 64*1024)}
+	var h [dumpHeaderSize]byte
+	if _, err := io.ReadFull(d.r, h[:]); err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	if string(h[:8]) != dumpMagic {
+		return nil, fmt.Errorf("not an event dump")
+	}
+	d.version = int(binary.LittleEndian.Uint16(h[8:]))
+	d.recSize = int(binary.LittleEndian.Uint16(h[10:]))
+	metaLen := binary.LittleEndian.Uint32(h[12:])
+	d.start = binary.LittleEndian.Uint64(h[16:])
+	d.end = binary.LittleEndian.Uint64(h[24:])
+	d.declared = binary.LittleEndian.Uint64(h[32:])
+	if d.version < 1 {
+		return nil, fmt.Errorf("invalid dump version %d", d.version)
+	}
+	if d.recSize < dumpRecordSize {
+		return nil, fmt.Errorf("dump records of %d bytes are smaller than version 1's %d", d.recSize, dumpRecordSize)
+	}
+	if metaLen > maxDumpMetadata {
+		return nil, fmt.Errorf("dump metadata of %d bytes is too large", metaLen)
+	}
+	m := make([]byte, metaLen)
+	if _, err := io.ReadFull(d.r, m); err != nil {
+		return nil, fmt.Errorf("reading metadata: %w", err)
+	}
+	if err := json.Unmarshal(m, &d.meta); err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+	d.rec = make([]byte, d.recSize)
+	return d, nil
+}
+
+// next reads the next event and its receipt time; false at the end of
+// the dump
+func (d *dumpReader) next(e *Event) (uint64, bool, error) {
+	n, err := io.ReadFull(d.r, d.rec)
+	switch {
+	case errors.Is(err, io.EOF):
+		return 0, false, nil
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		d.partial = n > 0
+		return 0, false, nil
+	case err != nil:
+		return 0, false, err
+	}
+	var x extendedEvent
+	getFixed(d.rec, &x, schemaV1)
+	*e = x.Event
+	d.read++
+	return binary.LittleEndian.Uint64(d.rec[dumpReceiptOff:]), true, nil
+}
+
+// ReplayStats describe the dump a replayed result was computed from
+type ReplayStats struct {
+	Path        string
+	Version     int
+	Benchmark   string    // Benchmark that wrote the dump
+	SourceStart time.Time // Measured window of the recorded run
+	SourceEnd   time.Time
+	Events      int64 // Events replayed
+	Truncated   bool  // The dump was not closed or ended mid-record
+}
+
+// formatReplay renders where a replayed result came from
+func (r *BenchmarkResult) formatReplay() string {
+	s := r.Replay
+	if s == nil {
+		return ""
+	}
+	line := fmt.Sprintf("Replay:          %s (version %d, from %s at %s), %d events",
+		s.Path, s.Version, s.Benchmark, s.SourceStart.UTC().Format(time.RFC3339), s.Events)
+	if s.Truncated {
+		line += ", truncated"
+	}
+	return line + "\n"
+}
+
+// replayCheckEvery is how many events are replayed between checks for
+// cancellation
+const replayCheckEvery = 1 << 16
+
+// replayDump feeds the events of a dump through eb on a clock following
+// their receipt times, and fills in r from the buffer as the recording
+// benchmark would
+func replayDump(ctx context.Context, path string, eb *EventBuffer, r *BenchmarkResult) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d, err := newDumpReader(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	m := d.meta
+	r.Name, r.Language, r.ProgramType, r.Tracepoint = m.Name, m.Language, m.ProgramType, m.Tracepoint
+	r.DataMechanism, r.ReaderStrategy, r.Payload, r.RateProfile = m.DataMechanism, m.ReaderStrategy, m.Payload, m.RateProfile
+
+	// A dump that was not closed has no window; it then runs from the
+	// first receipt to the last
+	var e Event
+	now, ok, err := d.next(&e)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	clock := &mockClock{ns: int64(d.start)}
+	if d.start == 0 {
+		clock.ns = int64(now)
+	}
+	source := clock.ns
+	eb.SetClock(clock.Now)
+	r.StartTime = time.Now()
+	eb.Start()
+	for ok {
+		clock.ns = max(clock.ns, int64(now))
+		eb.Add(e)
+		if d.read%replayCheckEvery == 0 && ctx.Err() != nil {
+			break
+		}
+		if now, ok, err = d.next(&e); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	markInterrupted(ctx, r)
+	if d.end != 0 && ctx.Err() == nil {
+		clock.ns = max(clock.ns, int64(d.end))
+	}
+	eb.End()
+	r.EndTime = time.Now()
+
+	r.Duration = eb.GetDuration()
+	r.EventCount = eb.GetEventCount()
+	r.RecordDrops(eb.GetDropCounts())
+	r.Throughput = eb.GetThroughput()
+	r.Latency = eb.GetLatencyStats()
+	r.LatencyHistogram = eb.GetLatencyHistogram(DefaultHistogramPrecision).Buckets()
+	r.Quality.Merge(eb.GetDataQuality())
+	r.EventTypes = eb.GetEventTypeStats()
+	r.recordCPUs(eb)
+	r.recordDelivery(eb)
+	r.Streaming = eb.GetStreamingStats()
+	r.EventSample = eb.GetEventSample()
+	r.Replay = &ReplayStats{
+		Path:        path,
+		Version:     d.version,
+		Benchmark:   m.Benchmark,
+		SourceStart: time.Unix(0, source),
+		SourceEnd:   time.Unix(0, clock.ns),
+		Events:      d.read,
+		Truncated:   d.end == 0 || d.partial || d.declared != uint64(d.read),
+	}
+	if r.Replay.Truncated && ctx.Err() == nil {
+		r.Errors = append(r.Errors, fmt.Sprintf("%s: dump is truncated after %d events", path, d.read))
+	}
+	return nil
+}
+
+// runReplayBenchmark is the entry point of the replay subcommand
+func runReplayBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	common := addBenchFlags(fs, "replay_result.json", false)
+	input := fs.String("i", "", "Event dump to replay, written with ringbuf -dump")
+	bufferSize := fs.Int("buffer-size", 10000000, "Userspace event buffer capacity in events")
+	dropPolicy := fs.String("drop-policy", string(DropNewest), "Full-buffer policy (drop-new, drop-old)")
+	streaming := fs.Bool("streaming", false, "Compute statistics online with t-digest percentiles instead of keeping events")
+	sampleEvents := fs.Int("sample-events", 0, "Keep a uniform random sample of this many raw events in the result file (0 disables)")
+	seed := fs.Uint64("seed", 1, "Seed of -sample-events")
+	compressibility := fs.Bool("compressibility", false, "Measure how small the kept events would archive with delta and DEFLATE encoding")
+	quantiles := fs.String("quantiles", "0.5,0.9,0.99,0.999", "Comma-separated latency quantiles to report")
+	outlierFlags := addOutlierFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+	if *input == "" {
+		return nil, opts, fmt.Errorf("-i is required")
+	}
+	if *bufferSize <= 0 {
+		return nil, opts, fmt.Errorf("-buffer-size must be positive")
+	}
+	if *sampleEvents < 0 {
+		return nil, opts, fmt.Errorf("-sample-events must not be negative")
+	}
+	if *streaming && *compressibility {
+		return nil, opts, fmt.Errorf("-streaming keeps no events to analyse")
+	}
+	policy, err := ParseDropPolicy(*dropPolicy)
+	if err != nil {
+		return nil, opts, fmt.Errorf("invalid -drop-policy: %w", err)
+	}
+	if policy == DropBlock {
+		return nil, opts, fmt.Errorf("-drop-policy block waits on the wall clock for a consumer, which a replay has neither of")
+	}
+	qs, err := ParseQuantiles(*quantiles)
+	if err != nil {
+		return nil, opts, fmt.Errorf("invalid -quantiles: %w", err)
+	}
+	outliers, err := outlierFlags.capture()
+	if err != nil {
+		return nil, opts, err
+	}
+	if err := opts.checkDisk(opts.resultArtifacts(*sampleEvents)...); err != nil {
+		return nil, opts, err
+	}
+
+	eb := NewEventBuffer(*bufferSize)
+	if *streaming {
+		eb = NewStreamingEventBuffer()
+	}
+	eb.SetDropPolicy(policy, DefaultBlockTimeout)
+	eb.SetQuantiles(qs)
+	eb.SetSampling(*sampleEvents, *seed)
+	eb.SetOutliers(outliers)
+	r := &BenchmarkResult{
+		Errors:        []string{},
+		Host:          CollectHostInfo(),
+		WorkloadSetup: WorkloadSetup{DropPolicy: string(policy)},
+	}
+	if err := replayDump(ctx, *input, eb, r); err != nil {
+		return nil, opts, err
+	}
+	if *compressibility {
+		r.Compressibility = analyzeCompression(eb.ordered())
+	}
+	return []*BenchmarkResult{r}, opts, nil
+}
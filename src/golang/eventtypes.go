@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// eventTypeNames names the Event.EventType values
+var eventTypeNames = map[uint32]string{
+	eventTypeKprobe:     "kprobe",
+	eventTypeTracepoint: "tracepoint",
+	eventTypeUprobe:     "uprobe",
+	eventTypeXDP:        "xdp",
+	eventTypeTC:         "tc",
+}
+
+// eventTypeName returns the name of an event type, or its number
+func eventTypeName(t uint32) string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return strconv.FormatUint(uint64(t), 10)
+}
+
+// EventTypeStats are the statistics of one event type in a buffer shared
+// by several
+type EventTypeStats struct {
+	EventType  uint32
+	Name       string
+	EventCount int64
+	Share      float64 // Fraction of all delivered events
+	Throughput float64
+	Latency    LatencyStats // Between consecutive events of this type
+}
+
+// GetEventTypeStats breaks the collected events down by EventType. It
+// returns nil when only one type was seen, as the aggregate numbers then
+// already describe it.
+func (eb *EventBuffer) GetEventTypeStats() []EventTypeStats {
+	if eb.stream != nil {
+		return eb.stream.eventTypeStats(eb.quantiles, eb.GetDuration())
+	}
+	events := eb.ordered()
+	last := make(map[uint32]uint64)
+	samples := make(map[uint32][]uint64)
+	counts := make(map[uint32]int64)
+	var q DataQuality
+	for _, e := range events {
+		if prev, seen := last[e.EventType]; seen {
+			if d, ok := timestampDelta(prev, e.Timestamp, &q); ok {
+				samples[e.EventType] = append(samples[e.EventType], d)
+			}
+		}
+		last[e.EventType] = e.Timestamp
+		counts[e.EventType]++
+	}
+	if len(counts) < 2 {
+		return nil
+	}
+
+	types := make([]uint32, 0, len(counts))
+	for t := range counts {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	duration := eb.GetDuration()
+	stats := make([]EventTypeStats, 0, len(types))
+	for _, t := range types {
+		s := EventTypeStats{
+			EventType:  t,
+			Name:       eventTypeName(t),
+			EventCount: counts[t],
+			Share:      float64(counts[t]) / float64(len(events)),
+			Latency:    computeLatencyStats(samples[t], eb.quantiles),
+		}
+		if duration > 0 {
+			s.Throughput = float64(counts[t]) / duration
+		}
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// formatEventTypes renders the per-event-type breakdown, one line each
+func (r *BenchmarkResult) formatEventTypes() string {
+	if len(r.EventTypes) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("Event Types:\n")
+	for _, t := range r.EventTypes {
+		p99 := "-"
+		if v, ok := t.Latency.Percentile(0.99); ok {
+			p99 = r.LatencyUnit.Format(float64(v))
+		}
+		fmt.Fprintf(&sb, "  %-14s %10d events (%5.1f%%)  %12.0f events/sec  avg %s  p99 %s\n",
+			t.Name+":", t.EventCount, t.Share*100, t.Throughput, r.LatencyUnit.Format(t.Latency.AvgNs), p99)
+	}
+	return sb.String()
+}
+
+// eventMix assigns event types to simulated events in fixed proportions
+type eventMix struct {
+	types []uint32 // One entry per unit of weight, interleaved
+	next  int
+}
+
+// parseEventMix parses a mix such as "tracepoint:3,kprobe:1". Weights
+// default to 1. Types are interleaved so each appears evenly spread out.
+func parseEventMix(s string) (*eventMix, error) {
+	byName := make(map[string]uint32, len(eventTypeNames))
+	for t, name := range eventTypeNames {
+		byName[name] = t
+	}
+
+	type entry struct {
+		t      uint32
+		weight int
+	}
+	var entries []entry
+	total := 0
+	for _, field := range splitList(s) {
+		name, weightStr, hasWeight := strings.Cut(field, ":")
+		t, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown event type %q", name)
+		}
+		weight := 1
+		if hasWeight {
+			w, err := strconv.Atoi(weightStr)
+			if err != nil || w <= 0 {
+				return nil, fmt.Errorf("invalid weight %q for %s", weightStr, name)
+			}
+			weight = w
+		}
+		entries = append(entries, entry{t, weight})
+		total += weight
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no event types given")
+	}
+
+	// Smooth weighted round-robin, so tracepoint:3,kprobe:1 yields
+	// tp tp kprobe tp rather than tp tp tp kprobe
+	m := &eventMix{}
+	current := make([]int, len(entries))
+	for i := 0; i < total; i++ {
+		best := 0
+		for j, e := range entries {
+			current[j] += e.weight
+			if current[j] > current[best] {
+				best = j
+			}
+		}
+		current[best] -= total
+		m.types = append(m.types, entries[best].t)
+	}
+	return m, nil
+}
+
+// Next returns the type of the next simulated event
+func (m *eventMix) Next() uint32 {
+	t := m.types[m.next]
+	m.next = (m.next + 1) % len(m.types)
+	return t
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+)
+
+// probeBackendBPF attaches real BPF programs through bpf(2)
+const probeBackendBPF = "bpf"
+
+// Attach types of the fentry benchmark
+const (
+	bpfTraceFentry = 24
+	bpfTraceFexit  = 25
+)
+
+// tracingProbe attaches a BPF fentry or fexit program to a kernel
+// function. Attaching loads the program against the function's BTF ID and
+// links it with BPF_RAW_TRACEPOINT_OPEN; detaching closes both, so each
+// cycle pays for the trampoline being built and torn down.
+type tracingProbe struct {
+	bpfAttachment
+	attachType uint32
+	btfIDs     map[string]uint32
+}
+
+func newTracingProbe(attachType uint32) *tracingProbe {
+	return &tracingProbe{bpfAttachment: newBPFAttachment(), attachType: attachType, btfIDs: make(map[string]uint32)}
+}
+
+func (p *tracingProbe) Attach(symbol string) error {
+	id, ok := p.btfIDs[symbol]
+	if !ok {
+		var err error
+		if id, err = btfFuncID(vmlinuxBTF, symbol); err != nil {
+			return err
+		}
+		p.btfIDs[symbol] = id
+	}
+
+	var err error
+	if p.prog, err = loadBPFProgram(bpfProgTypeTracing, p.attachType, id); err != nil {
+		return err
+	}
+	if p.link, err = rawTracepointOpen("", p.prog); err != nil {
+		p.close()
+		return err
+	}
+	return nil
+}
+
+func (p *tracingProbe) Detach() error { return p.close() }
+
+func (p *tracingProbe) Hit()            {}
+func (p *tracingProbe) Backend() string { return probeBackendBPF }
+
+// newTracingAttacher selects a backend for an fentry or fexit probe on
+// symbol. auto tries one attach with bpf(2) and falls back to simulation
+// when the kernel or privileges do not allow it.
+func newTracingAttacher(backend string, attachType uint32, symbol string, buffer *EventBuffer) (kprobeAttacher, error) {
+	switch backend {
+	case probeBackendSim:
+		return &simulatedKprobe{buffer: buffer}, nil
+	case probeBackendBPF, probeBackendAuto:
+		p := newTracingProbe(attachType)
+		err := p.Attach(symbol)
+		if err == nil {
+			err = p.Detach()
+		}
+		if err == nil {
+			return p, nil
+		}
+		if backend == probeBackendBPF {
+			return nil, err
+		}
+		return &simulatedKprobe{buffer: buffer}, nil
+	}
+	return nil, fmt.Errorf("unknown probe backend %q (want auto, bpf or sim)", backend)
+}
+
+// tracingKinds are the programs the fentry benchmark attaches, in order
+var tracingKinds = []struct {
+	programType string
+	name        string
+	attachType  uint32
+}{
+	{"fentry", "Fentry Overhead", bpfTraceFentry},
+	{"fexit", "Fexit Overhead", bpfTraceFexit},
+}
+
+// runFentryOverhead is the entry point of the fentry subcommand. It runs
+// the kprobe overhead benchmark with fentry and fexit programs on the same
+// function, and by default the kprobe itself, so the results line up.
+func runFentryOverhead(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("fentry", flag.ExitOnError)
+	common := addBenchFlags(fs, "fentry_result.json", false)
+	symbol := fs.String("symbol", "do_sys_openat2", "Kernel function to attach to")
+	cycles := fs.Int("n", 100, "Attach/detach cycles")
+	calls := fs.Int("calls", 100000, "Probed syscalls per overhead measurement")
+	backend := fs.String("backend", probeBackendAuto, "fentry/fexit backend (auto, bpf, sim)")
+	kprobe := fs.Bool("kprobe", true, "Also run the kprobe benchmark on the symbol for comparison")
+	kprobeBackend := fs.String("kprobe-backend", probeBackendAuto, "Kprobe backend for the comparison (auto, tracefs, sim)")
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+	if *cycles <= 0 || *calls <= 0 {
+		return nil, opts, fmt.Errorf("-n and -calls must be positive")
+	}
+
+	var results []*BenchmarkResult
+	if *kprobe {
+		r, err := NewKprobeOverheadBenchmark(*symbol, *cycles, *calls, *kprobeBackend, opts.Verbose).Run(ctx)
+		if err != nil {
+			return nil, opts, fmt.Errorf("kprobe: %w", err)
+		}
+		results = append(results, r)
+	}
+	for _, kind := range tracingKinds {
+		bench := NewKprobeOverheadBenchmark(*symbol, *cycles, *calls, *backend, opts.Verbose)
+		bench.name, bench.programType = kind.name, kind.programType
+		bench.simNote = "bpf(2) tracing programs unavailable: " + kind.programType + " simulated in userspace"
+		attachType := kind.attachType
+		bench.newProbe = func(buffer *EventBuffer) (kprobeAttacher, error) {
+			return newTracingAttacher(*backend, attachType, *symbol, buffer)
+		}
+		r, err := bench.Run(ctx)
+		if err != nil {
+			return nil, opts, fmt.Errorf("%s on %s: %w", kind.programType, *symbol, err)
+		}
+		results = append(results, r)
+	}
+
+	if *kprobe {
+		base := results[0]
+		PrintBenchmarkHeader("Per-call overhead on " + *symbol)
+		for _, r := range results {
+			line := fmt.Sprintf("%-8s %-8s %10.1f ns/call", r.ProgramType, r.ReaderStrategy, r.OverheadNs)
+			if r != base && base.OverheadNs > 0 {
+				line += fmt.Sprintf("  %+.1f%% vs kprobe", (r.OverheadNs/base.OverheadNs-1)*100)
+			}
+			fmt.Println(line)
+		}
+	}
+	return results, opts, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Page cache modes applied before each measured phase of a file workload
+const (
+	cacheModeNone = "none" // Leave the cache as the previous phase left it
+	cacheModeWarm = "warm" // Read every file once so all reads hit the cache
+	cacheModeCold = "cold" // Evict the files so reads go to storage
+)
+
+// posixFadvDontNeed is POSIX_FADV_DONTNEED, which the syscall package
+// does not export
+const posixFadvDontNeed = 4
+
+// FileChurn is a file-IO load generator: each operation opens, reads and
+// closes the next file of a working set created in a scratch directory
+type FileChurn struct {
+	dir   string
+	files []string
+	buf   []byte
+	next  int
+}
+
+// NewFileChurn creates count files of size bytes under parent, filled by
+// payload so the contents have realistic entropy
+func NewFileChurn(parent string, count, size int, payload PayloadGenerator) (*FileChurn, error) {
+	if count <= 0 || size <= 0 {
+		return nil, fmt.Errorf("file count and size must be positive")
+	}
+	dir, err := os.MkdirTemp(parent, "ebpf-bench-churn-")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &FileChurn{dir: dir, buf: make([]byte, size)}
+	data := make([]byte, size)
+	for i := 0; i < count; i++ {
+		payload.Fill(data)
+		path := filepath.Join(dir, fmt.Sprintf("file%04d", i))
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.files = append(c.files, path)
+	}
+	return c, nil
+}
+
+// Op opens, reads and closes the next file in the working set
+func (c *FileChurn) Op() error {
+	path := c.files[c.next]
+	c.next = (c.next + 1) % len(c.files)
+
+	fd, err := syscall.Open(path, syscall.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	for {
+		n, err := syscall.Read(fd, c.buf)
+		if err != nil {
+			syscall.Close(fd)
+			return err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	return syscall.Close(fd)
+}
+
+// PrepareCache puts the working set into the requested page cache state
+// and returns a label of the method used, for recording in the result.
+// Cold mode drops the whole page cache when permitted and otherwise
+// evicts only the working set with fadvise.
+func (c *FileChurn) PrepareCache(mode string) (string, error) {
+	switch mode {
+	case cacheModeNone:
+		return cacheModeNone, nil
+	case cacheModeWarm:
+		for _, path := range c.files {
+			f, err := os.Open(path)
+			if err != nil {
+				return "", err
+			}
+			_, err = io.Copy(io.Discard, f)
+			f.Close()
+			if err != nil {
+				return "", err
+			}
+		}
+		return cacheModeWarm, nil
+	case cacheModeCold:
+		syscall.Sync()
+		if err := os.WriteFile("/proc/sys/vm/drop_caches", []byte("1"), 0); err == nil {
+			return cacheModeCold + ":drop_caches", nil
+		}
+		for _, path := range c.files {
+			if err := fadviseDontNeed(path); err != nil {
+				return "", fmt.Errorf("evict %s: %w", path, err)
+			}
+		}
+		return cacheModeCold + ":fadvise", nil
+	}
+	return "", fmt.Errorf("unknown cache mode %q (want none, warm or cold)", mode)
+}
+
+// fadviseDontNeed asks the kernel to drop a file's cached pages
+func fadviseDontNeed(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, posixFadvDontNeed, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Close removes the working set
+func (c *FileChurn) Close() error {
+	return os.RemoveAll(c.dir)
+}
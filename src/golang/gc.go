@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"runtime/debug"
+	"runtime/metrics"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GCStats is what the Go garbage collector did during a result's measured
+// window, and the settings it ran with. Values come from runtime/metrics
+// sampled every gcSampleEvery, so the window is widened to the samples
+// around it.
+type GCStats struct {
+	GOGC           int   // GC percent in effect; -1 when off
+	MemoryLimit    int64 // Soft memory limit in bytes; math.MaxInt64 when none
+	Cycles         uint64
+	Pauses         uint64            // Stop-the-world pauses
+	PauseTotalNs   float64           // Estimated from the pause histogram's bucket midpoints
+	PauseMaxNs     uint64            // Upper bound of the longest pause's bucket
+	PauseHistogram []HistogramBucket // Non-empty buckets of the pause distribution
+	CPUSeconds     float64           // Estimated CPU time spent in the GC
+	CPUFraction    float64           // GC share of the process's non-idle CPU time
+	Allocs         uint64            // Heap objects allocated
+	AllocBytes     uint64
+	AllocsPerEvent float64 // Allocs per measured event, if any
+}
+
+// gcSampleEvery is how often the GC counters are sampled during a run
+const gcSampleEvery = 25 * time.Millisecond
+
+// gcMetrics are the runtime/metrics a gcSample reads, in that order
+var gcMetrics = []string{
+	"/gc/cycles/total:gc-cycles",
+	"/gc/heap/allocs:objects",
+	"/gc/heap/allocs:bytes",
+	"/cpu/classes/gc/total:cpu-seconds",
+	"/cpu/classes/total:cpu-seconds",
+	"/cpu/classes/idle:cpu-seconds",
+	"/gc/pauses:seconds",
+}
+
+// gcSample holds the cumulative GC counters at a point in time, and the
+// pauses counted since the previous sample
+type gcSample struct {
+	at                         time.Time
+	cycles, allocs, allocBytes uint64
+	gcCPU, totalCPU, idleCPU   float64
+	newPauses                  map[int]uint64 // Pause histogram bucket to count
+}
+
+// gcMonitor samples the GC counters of one benchmark run in the background
+type gcMonitor struct {
+	mu      sync.Mutex
+	samples []gcSample
+	read    []metrics.Sample
+	pauses  []uint64 // Cumulative pause counts of the last sample
+	buckets []float64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// startGCMonitor takes a first sample and keeps sampling until stopped
+func startGCMonitor() *gcMonitor {
+	m := &gcMonitor{stop: make(chan struct{}), done: make(chan struct{})}
+	m.read = make([]metrics.Sample, len(gcMetrics))
+	for i, name := range gcMetrics {
+		m.read[i].Name = name
+	}
+	m.sample()
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(gcSampleEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.sample()
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+	return m
+}
+
+// sample appends the current counters
+func (m *gcMonitor) sample() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	metrics.Read(m.read)
+	uint64At := func(i int) uint64 {
+		if m.read[i].Value.Kind() != metrics.KindUint64 {
+			return 0
+		}
+		return m.read[i].Value.Uint64()
+	}
+	float64At := func(i int) float64 {
+		if m.read[i].Value.Kind() != metrics.KindFloat64 {
+			return 0
+		}
+		return m.read[i].Value.Float64()
+	}
+	s := gcSample{
+		at:         time.Now(),
+		cycles:     uint64At(0),
+		allocs:     uint64At(1),
+		allocBytes: uint64At(2),
+		gcCPU:      float64At(3),
+		totalCPU:   float64At(4),
+		idleCPU:    float64At(5),
+	}
+	if v := m.read[6].Value; v.Kind() == metrics.KindFloat64Histogram {
+		h := v.Float64Histogram()
+		m.buckets = h.Buckets
+		if m.pauses == nil {
+			m.pauses = make([]uint64, len(h.Counts))
+		}
+		for i, n := range h.Counts {
+			if i >= len(m.pauses) || n <= m.pauses[i] {
+				continue
+			}
+			if len(m.samples) > 0 { // The first sample only sets the baseline
+				if s.newPauses == nil {
+					s.newPauses = make(map[int]uint64)
+				}
+				s.newPauses[i] = n - m.pauses[i]
+			}
+			m.pauses[i] = n
+		}
+	}
+	m.samples = append(m.samples, s)
+}
+
+// finish takes a last sample and stops the monitor
+func (m *gcMonitor) finish() {
+	close(m.stop)
+	<-m.done
+	m.sample()
+}
+
+// record fills in the GC of each result from the samples around its
+// measured window
+func (m *gcMonitor) record(results []*BenchmarkResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	gogc, limit := currentGCSettings()
+	for _, r := range results {
+		if r.StartTime.IsZero() || len(m.samples) < 2 {
+			continue
+		}
+		// The last sample at or before the start, the first at or after the end
+		first := sort.Search(len(m.samples), func(i int) bool { return m.samples[i].at.After(r.StartTime) }) - 1
+		last := sort.Search(len(m.samples), func(i int) bool { return !m.samples[i].at.Before(r.EndTime) })
+		first = max(first, 0)
+		last = min(last, len(m.samples)-1)
+		if last <= first {
+			continue
+		}
+		a, b := m.samples[first], m.samples[last]
+		g := &GCStats{
+			GOGC:        gogc,
+			MemoryLimit: limit,
+			Cycles:      b.cycles - a.cycles,
+			CPUSeconds:  b.gcCPU - a.gcCPU,
+			Allocs:      b.allocs - a.allocs,
+			AllocBytes:  b.allocBytes - a.allocBytes,
+		}
+		if busy := (b.totalCPU - a.totalCPU) - (b.idleCPU - a.idleCPU); busy > 0 {
+			g.CPUFraction = g.CPUSeconds / busy
+		}
+		if r.EventCount > 0 {
+			g.AllocsPerEvent = float64(g.Allocs) / float64(r.EventCount)
+		}
+		counts := make(map[int]uint64)
+		for _, s := range m.samples[first+1 : last+1] {
+			for i, n := range s.newPauses {
+				counts[i] += n
+			}
+		}
+		g.setPauses(counts, m.buckets)
+		r.GC = g
+	}
+}
+
+// setPauses fills in the pause distribution from counts per bucket of the
+// runtime's pause histogram, whose bucket i spans buckets[i] to
+// buckets[i+1] seconds
+func (g *GCStats) setPauses(counts map[int]uint64, buckets []float64) {
+	ns := func(s float64) uint64 {
+		switch {
+		case math.IsInf(s, -1) || s < 0:
+			return 0
+		case math.IsInf(s, 1):
+			return math.MaxUint64
+		}
+		return uint64(s * 1e9)
+	}
+	var idx []int
+	for i := range counts {
+		if i+1 < len(buckets) {
+			idx = append(idx, i)
+		}
+	}
+	sort.Ints(idx)
+	for _, i := range idx {
+		low, high := ns(buckets[i]), ns(buckets[i+1])
+		if high == math.MaxUint64 {
+			high = low
+		}
+		n := counts[i]
+		g.PauseHistogram = append(g.PauseHistogram, HistogramBucket{LowNs: low, HighNs: high, Count: int64(n)})
+		g.Pauses += n
+		g.PauseTotalNs += float64(n) * float64(low+high) / 2
+		g.PauseMaxNs = high
+	}
+}
+
+// currentGCSettings returns the GC percent and memory limit in effect
+func currentGCSettings() (int, int64) {
+	percent := debug.SetGCPercent(100)
+	debug.SetGCPercent(percent)
+	return percent, debug.SetMemoryLimit(-1)
+}
+
+// defaultGCPercent and defaultMemoryLimit are the GC settings the process
+// started with, from GOGC and GOMEMLIMIT, restored for runs that set none
+var defaultGCPercent, defaultMemoryLimit = currentGCSettings()
+
+// applyGCSettings sets the GC percent and memory limit for the next run
+// from -gogc and -gomemlimit. Empty values restore the process defaults.
+// The settings are process-wide, so concurrent runs share them.
+func applyGCSettings(gogc, memLimit string) error {
+	percent, limit := defaultGCPercent, defaultMemoryLimit
+	switch gogc {
+	case "":
+	case "off":
+		percent = -1
+	default:
+		v, err := strconv.Atoi(gogc)
+		if err != nil || v < 0 {
+			return fmt.Errorf("invalid -gogc %q (want a non-negative percentage or off)", gogc)
+		}
+		percent = v
+	}
+	switch memLimit {
+	case "":
+	case "off":
+		limit = math.MaxInt64
+	default:
+		v, err := parseByteSize(memLimit)
+		if err != nil {
+			return fmt.Errorf("invalid -gomemlimit: %w", err)
+		}
+		limit = v
+	}
+	debug.SetGCPercent(percent)
+	debug.SetMemoryLimit(limit)
+	return nil
+}
+
+// parseByteSize parses a byte count with an optional B, KiB, MiB, GiB or
+// TiB suffix, as GOMEMLIMIT takes it
+func parseByteSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		scale  int64
+	}{{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}, {"B", 1}}
+	num, scale := s, int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			num, scale = strings.TrimSuffix(s, u.suffix), u.scale
+			break
+		}
+	}
+	v, err := strconv.ParseInt(strings.TrimSpace(num), 10, 64)
+	if err != nil || v < 0 || v > math.MaxInt64/scale {
+		return 0, fmt.Errorf("%q is not a byte size (e.g. 512MiB)", s)
+	}
+	return v * scale, nil
+}
+
+// gcSettingsLabel describes a GC percent and memory limit
+func gcSettingsLabel(percent int, limit int64) string {
+	s := "GOGC " + strconv.Itoa(percent)
+	if percent < 0 {
+		s = "GOGC off"
+	}
+	if limit == math.MaxInt64 {
+		return s + ", no memory limit"
+	}
+	return s + fmt.Sprintf(", memory limit %.1f MiB", float64(limit)/(1<<20))
+}
+
+// formatGC renders the GC activity of the measured window, if recorded
+func (r *BenchmarkResult) formatGC() string {
+	g := r.GC
+	if g == nil {
+		return ""
+	}
+	s := fmt.Sprintf("GC:              %d cycles, %d pauses", g.Cycles, g.Pauses)
+	if g.Pauses > 0 {
+		s += fmt.Sprintf(" (~%s total, max <= %s)", r.LatencyUnit.Format(g.PauseTotalNs), r.LatencyUnit.Format(float64(g.PauseMaxNs)))
+	}
+	s += fmt.Sprintf(", %.2f%% of CPU; %d allocs", g.CPUFraction*100, g.Allocs)
+	if g.AllocsPerEvent > 0 {
+		s += fmt.Sprintf(" (%.3f/event)", g.AllocsPerEvent)
+	}
+	s += fmt.Sprintf(", %.1f MiB; %s\n", float64(g.AllocBytes)/(1<<20), gcSettingsLabel(g.GOGC, g.MemoryLimit))
+	if len(g.PauseHistogram) > 0 {
+		var parts []string
+		for _, b := range g.PauseHistogram {
+			parts = append(parts, fmt.Sprintf("<= %s: %d", r.LatencyUnit.Format(float64(b.HighNs)), b.Count))
+		}
+		s += "                 pauses " + strings.Join(parts, ", ") + "\n"
+	}
+	return s
+}
@@ -1,14 +1,3 @@
-module ebpf-benchmark
+module github.com/parlakisik/ebpf_benchmark/src/golang
 
 go 1.21
-
-require (
-    github.com/cilium/ebpf v0.12.0
-    github.com/prometheus/client_golang v1.17.0
-    github.com/urfave/cli/v2 v2.25.0
-)
-
-require (
-    golang.org/x/exp v0.0.0-20230817173708-d852ddb80c63
-    golang.org/x/sys v0.13.0
-)
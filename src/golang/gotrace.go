@@ -0,0 +1,407 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"runtime/trace"
+	"sort"
+	"sync"
+	"time"
+)
+
+// GoTraceStats describe a Go execution trace taken during a result's
+// measured window, and the consumer's timeline over it: events delivered
+// per interval beside what the runtime did to the process in the same
+// interval, so throughput dips can be put down to the runtime or not.
+// The trace file itself opens with go tool trace.
+type GoTraceStats struct {
+	Path       string
+	Bytes      int64
+	Start      time.Time
+	End        time.Time
+	IntervalMs float64
+	Intervals  []GoTraceInterval
+	Dips       int // Intervals delivering under goTraceDipFraction of the median rate
+
+	// Means per interval, over the dips and over the other intervals
+	DipSchedP99Ns       float64
+	SteadySchedP99Ns    float64
+	DipGCPauses         float64
+	SteadyGCPauses      float64
+	DipMutexWaitNs      float64
+	SteadyMutexWaitNs   float64
+	DipBlockEvents      float64
+	SteadyBlockEvents   float64
+	RuntimeLimited      bool     // Dips coincide with the runtime delaying the consumer
+	RuntimeLimitReasons []string `json:",omitempty"`
+	Error               string   `json:",omitempty"` // Why the trace is incomplete
+}
+
+// GoTraceInterval is one interval of a traced window
+type GoTraceInterval struct {
+	OffsetMs    float64 // From the start of the trace
+	Events      int64
+	Rate        float64 // Events per second
+	SchedP99Ns  float64 // p99 time goroutines waited runnable, bucket upper bound
+	GCPauses    uint64
+	MutexWaitNs float64 // Time goroutines spent blocked on sync mutexes
+	BlockEvents int64   // Blocking events recorded by the block profile
+	Goroutines  uint64
+	Dip         bool
+}
+
+// Go trace defaults and thresholds
+const (
+	goTraceSampleEvery   = 20 * time.Millisecond
+	goTraceDipFraction   = 0.5     // An interval under this share of the median rate is a dip
+	goTraceRuntimeFactor = 2.0     // Dips must see this many times the steady runtime activity
+	goTraceBytesPerSec   = 8 << 20 // Trace size estimate of a busy consumer, for the disk check
+	goTraceMaxBlockStack = 1 << 12 // Block profile records read per sample
+	goTraceWatchEvery    = 10 * time.Millisecond
+)
+
+// goTraceMetrics are the runtime/metrics a goTraceSample reads, in that order
+var goTraceMetrics = []string{
+	"/sched/latencies:seconds",
+	"/gc/pauses:seconds",
+	"/sync/mutex/wait/total:seconds",
+	"/sched/goroutines:goroutines",
+}
+
+// goTraceSample holds the cumulative runtime counters and the traced
+// benchmark's delivered events at a point in time
+type goTraceSample struct {
+	at          time.Time
+	events      int64
+	schedLat    []uint64
+	gcPauses    []uint64
+	mutexWait   float64
+	blockEvents int64
+	goroutines  uint64
+}
+
+// goTrace is the one execution trace a process takes, armed by -go-trace
+// and started once a tracked benchmark has been collecting for the delay
+var goTrace struct {
+	sync.Mutex
+	once      sync.Once
+	benchmark string        // Benchmark being traced, once started
+	done      chan struct{} // Closed when the trace has been written
+	stats     *GoTraceStats
+}
+
+// startGoTrace arms the trace: path receives window of trace from delay
+// after the first tracked benchmark starts collecting. Only the first call
+// arms it, so a suite traces its first benchmark.
+func startGoTrace(path string, window, delay time.Duration) {
+	goTrace.once.Do(func() {
+		metricsRegistry.Lock()
+		metricsRegistry.tracking = true
+		metricsRegistry.Unlock()
+		go watchGoTrace(path, window, delay)
+	})
+}
+
+// watchGoTrace waits for a benchmark to be collecting for delay and
+// traces it
+func watchGoTrace(path string, window, delay time.Duration) {
+	ticker := time.NewTicker(goTraceWatchEvery)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		metricsRegistry.Lock()
+		progress := append([]*Progress(nil), metricsRegistry.progress...)
+		metricsRegistry.Unlock()
+		for _, p := range progress {
+			start := p.startNs.Load()
+			if start == 0 || p.endNs.Load() != 0 || now.Before(time.Unix(0, start).Add(delay)) {
+				continue
+			}
+			goTrace.Lock()
+			goTrace.benchmark = p.benchmark
+			goTrace.done = make(chan struct{})
+			goTrace.Unlock()
+			s := captureGoTrace(path, window, p)
+			goTrace.Lock()
+			goTrace.stats = s
+			close(goTrace.done)
+			goTrace.Unlock()
+			return
+		}
+	}
+}
+
+// captureGoTrace writes an execution trace for window, or until p stops
+// collecting, while sampling p's events and the runtime's counters
+func captureGoTrace(path string, window time.Duration, p *Progress) *GoTraceStats {
+	s := &GoTraceStats{Path: path, IntervalMs: float64(goTraceSampleEvery) / float64(time.Millisecond)}
+	f, err := os.Create(path)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	out := &countingWriter{w: f}
+	if err := trace.Start(out); err != nil {
+		f.Close()
+		s.Error = err.Error()
+		return s
+	}
+	// Every blocking event is recorded while the trace runs, which the
+	// trace's own overhead dwarfs
+	runtime.SetBlockProfileRate(1)
+	sampler := newGoTraceSampler(p)
+	samples := []goTraceSample{sampler.sample()}
+	ticker := time.NewTicker(goTraceSampleEvery)
+	end := time.NewTimer(window)
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			samples = append(samples, sampler.sample())
+			if p.endNs.Load() != 0 {
+				s.Error = "benchmark stopped collecting before the window ended"
+				break loop
+			}
+		case <-end.C:
+			samples = append(samples, sampler.sample())
+			break loop
+		}
+	}
+	ticker.Stop()
+	end.Stop()
+	trace.Stop()
+	runtime.SetBlockProfileRate(0)
+	if err := f.Close(); err != nil && s.Error == "" {
+		s.Error = err.Error()
+	}
+	s.Bytes = out.n
+	s.analyze(samples, sampler.schedBuckets)
+	return s
+}
+
+// goTraceSampler reads the counters of one trace
+type goTraceSampler struct {
+	p            *Progress
+	read         []metrics.Sample
+	schedBuckets []float64
+	records      []runtime.BlockProfileRecord
+}
+
+func newGoTraceSampler(p *Progress) *goTraceSampler {
+	g := &goTraceSampler{p: p, read: make([]metrics.Sample, len(goTraceMetrics))}
+	for i, name := range goTraceMetrics {
+		g.read[i].Name = name
+	}
+	g.records = make([]runtime.BlockProfileRecord, goTraceMaxBlockStack)
+	return g
+}
+
+// sample reads the current counters
+func (g *goTraceSampler) sample() goTraceSample {
+	metrics.Read(g.read)
+	s := goTraceSample{at: time.Now(), events: g.p.events.Load()}
+	if v := g.read[0].Value; v.Kind() == metrics.KindFloat64Histogram {
+		h := v.Float64Histogram()
+		g.schedBuckets = h.Buckets
+		s.schedLat = append([]uint64(nil), h.Counts...)
+	}
+	if v := g.read[1].Value; v.Kind() == metrics.KindFloat64Histogram {
+		h := v.Float64Histogram()
+		s.gcPauses = append([]uint64(nil), h.Counts...)
+	}
+	if v := g.read[2].Value; v.Kind() == metrics.KindFloat64 {
+		s.mutexWait = v.Float64()
+	}
+	if v := g.read[3].Value; v.Kind() == metrics.KindUint64 {
+		s.goroutines = v.Uint64()
+	}
+	if n, ok := runtime.BlockProfile(g.records); ok {
+		for _, r := range g.records[:n] {
+			s.blockEvents += r.Count
+		}
+	}
+	return s
+}
+
+// analyze turns the samples into intervals, finds the dips and compares
+// the runtime's activity in them with the rest
+func (s *GoTraceStats) analyze(samples []goTraceSample, schedBuckets []float64) {
+	if len(samples) < 2 {
+		return
+	}
+	s.Start, s.End = samples[0].at, samples[len(samples)-1].at
+	for i := 1; i < len(samples); i++ {
+		a, b := samples[i-1], samples[i]
+		secs := b.at.Sub(a.at).Seconds()
+		// A last interval cut short by the window's end is too short to
+		// judge a rate by
+		if secs <= 0 || (i == len(samples)-1 && secs < goTraceSampleEvery.Seconds()/2) {
+			continue
+		}
+		in := GoTraceInterval{
+			OffsetMs:    float64(a.at.Sub(s.Start)) / float64(time.Millisecond),
+			Events:      b.events - a.events,
+			SchedP99Ns:  histogramDeltaQuantile(a.schedLat, b.schedLat, schedBuckets, 0.99),
+			MutexWaitNs: (b.mutexWait - a.mutexWait) * 1e9,
+			BlockEvents: max(b.blockEvents-a.blockEvents, 0),
+			Goroutines:  b.goroutines,
+		}
+		in.Rate = float64(in.Events) / secs
+		for j := range b.gcPauses {
+			if j < len(a.gcPauses) && b.gcPauses[j] > a.gcPauses[j] {
+				in.GCPauses += b.gcPauses[j] - a.gcPauses[j]
+			}
+		}
+		s.Intervals = append(s.Intervals, in)
+	}
+
+	rates := make([]float64, len(s.Intervals))
+	for i, in := range s.Intervals {
+		rates[i] = in.Rate
+	}
+	sort.Float64s(rates)
+	median := rates[len(rates)/2]
+	if median <= 0 {
+		return
+	}
+	var dip, steady struct {
+		n                         int
+		sched, gc, mutex, blocked float64
+	}
+	for i := range s.Intervals {
+		in := &s.Intervals[i]
+		acc := &steady
+		if in.Rate < median*goTraceDipFraction {
+			in.Dip = true
+			acc = &dip
+		}
+		acc.n++
+		acc.sched += in.SchedP99Ns
+		acc.gc += float64(in.GCPauses)
+		acc.mutex += in.MutexWaitNs
+		acc.blocked += float64(in.BlockEvents)
+	}
+	s.Dips = dip.n
+	if dip.n == 0 || steady.n == 0 {
+		return
+	}
+	mean := func(sum float64, n int) float64 { return sum / float64(n) }
+	s.DipSchedP99Ns, s.SteadySchedP99Ns = mean(dip.sched, dip.n), mean(steady.sched, steady.n)
+	s.DipGCPauses, s.SteadyGCPauses = mean(dip.gc, dip.n), mean(steady.gc, steady.n)
+	s.DipMutexWaitNs, s.SteadyMutexWaitNs = mean(dip.mutex, dip.n), mean(steady.mutex, steady.n)
+	s.DipBlockEvents, s.SteadyBlockEvents = mean(dip.blocked, dip.n), mean(steady.blocked, steady.n)
+	elevated := func(d, st float64) bool { return d > 0 && d >= st*goTraceRuntimeFactor }
+	if elevated(s.DipSchedP99Ns, s.SteadySchedP99Ns) {
+		s.RuntimeLimitReasons = append(s.RuntimeLimitReasons, "scheduling latency")
+	}
+	if elevated(s.DipGCPauses, s.SteadyGCPauses) {
+		s.RuntimeLimitReasons = append(s.RuntimeLimitReasons, "GC pauses")
+	}
+	if elevated(s.DipMutexWaitNs, s.SteadyMutexWaitNs) {
+		s.RuntimeLimitReasons = append(s.RuntimeLimitReasons, "mutex waits")
+	}
+	s.RuntimeLimited = len(s.RuntimeLimitReasons) > 0
+}
+
+// histogramDeltaQuantile returns the upper bound in ns of the bucket
+// holding quantile q of the counts added between cumulative histograms a
+// and b, whose bucket i spans buckets[i] to buckets[i+1] seconds
+func histogramDeltaQuantile(a, b []uint64, buckets []float64, q float64) float64 {
+	var total uint64
+	delta := make([]uint64, len(b))
+	for i := range b {
+		if i < len(a) && b[i] > a[i] {
+			delta[i] = b[i] - a[i]
+		}
+		total += delta[i]
+	}
+	if total == 0 {
+		return 0
+	}
+	target := uint64(math.Ceil(q * float64(total)))
+	var seen uint64
+	for i, n := range delta {
+		seen += n
+		if seen < target || i+1 >= len(buckets) {
+			continue
+		}
+		high := buckets[i+1]
+		if math.IsInf(high, 1) {
+			high = buckets[i]
+		}
+		return max(high, 0) * 1e9
+	}
+	return 0
+}
+
+// recordGoTrace waits for a trace of the benchmark name in progress to be
+// written and attaches it to the results whose window it overlaps
+func recordGoTrace(name string, results []*BenchmarkResult) {
+	goTrace.Lock()
+	done, benchmark := goTrace.done, goTrace.benchmark
+	goTrace.Unlock()
+	if done == nil || benchmark != name {
+		return
+	}
+	<-done
+	goTrace.Lock()
+	s := goTrace.stats
+	goTrace.Unlock()
+	if s == nil {
+		return
+	}
+	for _, r := range results {
+		if r.StartTime.IsZero() || r.EndTime.Before(s.Start) || r.StartTime.After(s.End) {
+			continue
+		}
+		r.GoTrace = s
+		if s.Error != "" {
+			slog.Warn("Go trace incomplete", "path", s.Path, "err", s.Error)
+		}
+	}
+}
+
+// formatGoTrace renders the traced window and its dips, if traced
+func (r *BenchmarkResult) formatGoTrace() string {
+	s := r.GoTrace
+	if s == nil {
+		return ""
+	}
+	line := fmt.Sprintf("Go trace:        %s, %s over %s at +%.1fs, %d intervals of %.0fms, %d dips under %.0f%% of the median rate",
+		s.Path, formatBytes(uint64(s.Bytes)), s.End.Sub(s.Start).Round(time.Millisecond), s.Start.Sub(r.StartTime).Seconds(),
+		len(s.Intervals), s.IntervalMs, s.Dips, goTraceDipFraction*100)
+	if s.Error != "" {
+		line += ", " + s.Error
+	}
+	line += "\n"
+	if s.Dips == 0 || s.Dips == len(s.Intervals) {
+		return line
+	}
+	verdict := "not limited by the Go runtime"
+	if s.RuntimeLimited {
+		verdict = "runtime-limited by " + joinAnd(s.RuntimeLimitReasons)
+	}
+	return line + fmt.Sprintf("                 dips vs steady: sched p99 %s vs %s, GC pauses %.2f vs %.2f, mutex wait %s vs %s, block events %.1f vs %.1f; %s\n",
+		r.LatencyUnit.Format(s.DipSchedP99Ns), r.LatencyUnit.Format(s.SteadySchedP99Ns),
+		s.DipGCPauses, s.SteadyGCPauses,
+		r.LatencyUnit.Format(s.DipMutexWaitNs), r.LatencyUnit.Format(s.SteadyMutexWaitNs),
+		s.DipBlockEvents, s.SteadyBlockEvents, verdict)
+}
+
+// joinAnd joins words into a list read as "a, b and c"
+func joinAnd(words []string) string {
+	switch len(words) {
+	case 0:
+		return ""
+	case 1:
+		return words[0]
+	}
+	s := words[0]
+	for _, w := range words[1 : len(words)-1] {
+		s += ", " + w
+	}
+	return s + " and " + words[len(words)-1]
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// coordConfigMap is the readiness channel of a loaded program that does
+// not share the coordination map: the ready slot of its own config map
+const coordConfigMap = "config-map"
+
+// Reader readiness, in the coordination map's ready slot. The program
+// emits nothing until userspace stores readyDraining, so events are not
+// lost to a ring nobody reads yet.
+const (
+	readyWaiting  int32 = 0
+	readyDraining int32 = 1
+)
+
+// HandshakeStats describe the start of a run: how long the reader took to
+// start draining, and what the program did until then
+type HandshakeStats struct {
+	Enabled      bool    // The program waited for the reader
+	Channel      string  // Where the readiness flag lives: atomic, pinned-map or config-map
+	ReadyAfterUs float64 // From the program starting to the reader draining
+	GatedEvents  int64   // Events the program held back until the reader was ready
+	StartupDrops int64   // Events lost before the reader was ready
+}
+
+// startupGate is the program's side of the readiness handshake
+type startupGate struct {
+	flag    phaseMarker
+	enabled bool
+	start   time.Time
+	readyAt time.Time // When the reader stored readyDraining
+	open    bool      // The program has seen the reader ready
+	stats   HandshakeStats
+}
+
+// newStartupGate resets flag for a run starting now; the program waits
+// on it when enabled
+func newStartupGate(flag phaseMarker, enabled bool, channel string) *startupGate {
+	flag.Store(readyWaiting) // A shared pin may hold a previous run's flag
+	g := &startupGate{flag: flag, enabled: enabled, start: time.Now()}
+	g.stats.Enabled = enabled
+	g.stats.Channel = channel
+	return g
+}
+
+// ready is called by the reader once it is draining
+func (g *startupGate) ready() {
+	g.readyAt = time.Now()
+	g.flag.Store(readyDraining)
+}
+
+// allow reports whether the program may emit n events now. Until the
+// reader is ready a gated program holds them back; an ungated one emits
+// and its losses are counted as startup drops through lost.
+func (g *startupGate) allow(n int) bool {
+	if !g.open {
+		g.open = g.flag.Load() == readyDraining
+	}
+	if !g.open && g.enabled {
+		g.stats.GatedEvents += int64(n)
+		return false
+	}
+	return true
+}
+
+// lost counts events dropped by the program, before the reader was ready
+func (g *startupGate) lost(n int64) {
+	if !g.open {
+		g.stats.StartupDrops += n
+	}
+}
+
+// counted takes the held back events and startup drops from a loaded
+// program, which counts them itself instead of calling allow and lost
+func (g *startupGate) counted(gated, drops int64) {
+	g.stats.GatedEvents = gated
+	g.stats.StartupDrops = drops
+}
+
+// result returns the handshake's statistics once the run is over
+func (g *startupGate) result() *HandshakeStats {
+	s := g.stats
+	if !g.readyAt.IsZero() {
+		s.ReadyAfterUs = float64(g.readyAt.Sub(g.start)) / float64(time.Microsecond)
+	}
+	return &s
+}
+
+// formatHandshake renders the start of the run, if recorded
+func (r *BenchmarkResult) formatHandshake() string {
+	h := r.Handshake
+	if h == nil {
+		return ""
+	}
+	mode := "off"
+	if h.Enabled {
+		mode = "program waits on the reader (" + h.Channel + ")"
+	}
+	return fmt.Sprintf("Handshake:       %s, reader draining after %.0f µs, %d events held back, %d dropped before it\n",
+		mode, h.ReadyAfterUs, h.GatedEvents, h.StartupDrops)
+}
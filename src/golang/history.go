@@ -0,0 +1,207 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// trendMetric is a value history trend can plot, with its formatting
+type trendMetric struct {
+	value  func(r *BenchmarkResult) (float64, bool)
+	format func(v float64, unit LatencyUnit) string
+}
+
+// percentileMetric plots latency quantile q
+func percentileMetric(q float64) trendMetric {
+	return trendMetric{
+		value: func(r *BenchmarkResult) (float64, bool) {
+			v, ok := r.Latency.Percentile(q)
+			return float64(v), ok
+		},
+		format: func(v float64, unit LatencyUnit) string { return unit.Format(v) },
+	}
+}
+
+// trendMetrics are the -metric values of history trend
+var trendMetrics = map[string]trendMetric{
+	"throughput": {
+		value:  func(r *BenchmarkResult) (float64, bool) { return r.Throughput, true },
+		format: func(v float64, _ LatencyUnit) string { return fmt.Sprintf("%.0f/s", v) },
+	},
+	"drop-rate": {
+		value:  func(r *BenchmarkResult) (float64, bool) { return r.DropRate * 100, true },
+		format: func(v float64, _ LatencyUnit) string { return fmt.Sprintf("%.3f%%", v) },
+	},
+	"cpu-per-event": {
+		value:  func(r *BenchmarkResult) (float64, bool) { return r.CPUBudget.CPUPerEventUs, r.EventCount > 0 },
+		format: func(v float64, _ LatencyUnit) string { return fmt.Sprintf("%.3fµs", v) },
+	},
+	"p50": percentileMetric(0.5),
+	"p99": percentileMetric(0.99),
+}
+
+// runHistory is the entry point of the history subcommand, which lists
+// the runs in the history store and plots metrics over them
+func runHistory(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	storePath := fs.String("store", defaultStorePath, "History store to read (a JSON lines file or sqlite:FILE)")
+	from := fs.String("from", "", "Only runs started on or after this date or RFC 3339 time")
+	to := fs.String("to", "", "Only runs started before this date or RFC 3339 time")
+	benchmark := fs.String("benchmark", "", "Only runs of this benchmark (subcommand or result name)")
+	limit := fs.Int("limit", 20, "list: show at most this many of the newest runs (0 for all)")
+	metric := fs.String("metric", "throughput", "trend: metric to plot (throughput, drop-rate, cpu-per-event, p50, p99)")
+	width := fs.Int("width", 40, "trend: plot at most this many of the newest runs per benchmark")
+	latencyUnit := fs.String("latency-unit", "us", "Latency display unit (ns, us, ms)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: history list [flags]\n       history trend [flags]\n\n")
+		fs.PrintDefaults()
+	}
+	var action string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if action != "list" && action != "trend" || fs.NArg() != 0 {
+		fs.Usage()
+		return fmt.Errorf("want list or trend")
+	}
+	unit, err := ParseLatencyUnit(*latencyUnit)
+	if err != nil {
+		return err
+	}
+	var q StoreQuery
+	if *from != "" {
+		if q.From, err = parseQueryTime(*from); err != nil {
+			return err
+		}
+	}
+	if *to != "" {
+		if q.To, err = parseQueryTime(*to); err != nil {
+			return err
+		}
+	}
+	q.Benchmark = *benchmark
+
+	m, ok := trendMetrics[*metric]
+	if !ok {
+		return fmt.Errorf("unknown -metric %q", *metric)
+	}
+	store := OpenResultStore(*storePath)
+	runs, err := store.Query(q)
+	if err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		return fmt.Errorf("no runs in %s match", store)
+	}
+	// Runs are appended as they finish; plot them in the order they ran
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].Result.StartTime.Before(runs[j].Result.StartTime)
+	})
+	if action == "list" {
+		if *limit > 0 && len(runs) > *limit {
+			runs = runs[len(runs)-*limit:]
+		}
+		listHistory(runs, unit)
+		return nil
+	}
+	return printTrends(runs, *metric, m, max(*width, 1), unit)
+}
+
+// listHistory prints one line per stored run, oldest first
+func listHistory(runs []StoredRun, unit LatencyUnit) {
+	PrintSeparator()
+	fmt.Printf("%-16s %-20s %-40s %-16s %-20s %-12s %15s %8s %12s  %s\n",
+		"ID", "Started", "Benchmark", "Mechanism", "Kernel", "Commit", "Throughput", "Drop%", "p99", "Tags")
+	for _, run := range runs {
+		r := run.Result
+		p99 := "-"
+		if v, ok := r.Latency.Percentile(0.99); ok {
+			p99 = unit.Format(float64(v))
+		}
+		commit := run.GitCommit
+		if commit == "" {
+			commit = "-"
+		} else if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		tags := run.Tags
+		if run.Invalid {
+			tags = append([]string{"INVALID"}, tags...)
+		}
+		fmt.Printf("%-16s %-20s %-40s %-16s %-20s %-12s %15.0f %7.3f%% %12s  %s\n",
+			run.ID, formatResultTime(r.StartTime), resultKey(r), r.DataMechanism,
+			r.Host.KernelRelease, commit, r.Throughput, r.DropRate*100, p99, strings.Join(tags, ","))
+	}
+	PrintSeparator()
+}
+
+// printTrends plots a metric over the valid runs of each benchmark
+// configuration, grouped as baselines are: the same benchmark, mechanism
+// and host. The sparkline spans the lowest to the highest value of its row.
+func printTrends(runs []StoredRun, name string, m trendMetric, width int, unit LatencyUnit) error {
+	type series struct {
+		label  string
+		values []float64
+	}
+	var order []string
+	byKey := make(map[string]*series)
+	for _, run := range runs {
+		if run.Invalid {
+			continue
+		}
+		v, ok := m.value(run.Result)
+		if !ok {
+			continue
+		}
+		k := baselineKey(run.Result)
+		s := byKey[k]
+		if s == nil {
+			r := run.Result
+			s = &series{label: fmt.Sprintf("%s %s @%s", resultKey(r), r.DataMechanism, hostLabel(r))}
+			byKey[k] = s
+			order = append(order, k)
+		}
+		s.values = append(s.values, v)
+	}
+	if len(order) == 0 {
+		return fmt.Errorf("no valid runs report %s", name)
+	}
+
+	PrintSeparator()
+	fmt.Printf("Trend of %s, oldest run on the left\n\n", name)
+	fmt.Printf("%-56s %5s  %-*s %12s %12s %12s %12s %9s\n",
+		"Benchmark", "Runs", width, "", "First", "Last", "Min", "Max", "Change")
+	for _, k := range order {
+		s := byKey[k]
+		values := s.values
+		if len(values) > width {
+			values = values[len(values)-width:]
+		}
+		lo, hi := values[0], values[0]
+		for _, v := range values {
+			lo, hi = min(lo, v), max(hi, v)
+		}
+		shifted := make([]float64, len(values))
+		for i, v := range values {
+			shifted[i] = v - lo
+		}
+		first, last := values[0], values[len(values)-1]
+		change := "-"
+		if first != 0 {
+			change = fmt.Sprintf("%+.1f%%", (last-first)/first*100)
+		}
+		// Pad by hand: the blocks are several bytes each
+		plot := sparkline(shifted) + strings.Repeat(" ", width-len(shifted))
+		fmt.Printf("%-56s %5d  %s %12s %12s %12s %12s %9s\n", s.label, len(s.values),
+			plot, m.format(first, unit), m.format(last, unit),
+			m.format(lo, unit), m.format(hi, unit), change)
+	}
+	PrintSeparator()
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NUMANode is one NUMA node of the host
+type NUMANode struct {
+	ID       int
+	CPUs     []int
+	MemoryMB uint64
+}
+
+// collectHostEnvironment fills in the CPU, NUMA, frequency scaling, BPF
+// JIT and clock settings of h, and fingerprints them
+func collectHostEnvironment(h *HostInfo) {
+	h.CPUModel = readCPUModel()
+	h.CPUSockets, h.CPUCores = cpuTopology(h.OnlineCPUs)
+	h.NUMANodes = readNUMANodes()
+	h.CPUGovernor = cpuGovernor(h.OnlineCPUs)
+	h.BPFJITEnable = readSysValue("/proc/sys/net/core/bpf_jit_enable")
+	h.BPFJITHarden = readSysValue("/proc/sys/net/core/bpf_jit_harden")
+	h.Clocksource = readSysValue("/sys/devices/system/clocksource/clocksource0/current_clocksource")
+	h.Fingerprint = identityHash(hostEnvironment(*h))
+}
+
+// readSysValue returns the trimmed contents of a procfs or sysfs file, or
+// "" if unavailable
+func readSysValue(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readCPUModel returns the CPU model name of /proc/cpuinfo. Architectures
+// without "model name" report it under other keys.
+func readCPUModel() string {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		k, v, ok := strings.Cut(scanner.Text(), ":")
+		k = strings.TrimSpace(k)
+		if !ok || fields[k] != "" {
+			continue
+		}
+		fields[k] = strings.TrimSpace(v)
+	}
+	for _, k := range []string{"model name", "Model", "cpu model", "Processor", "cpu"} {
+		if fields[k] != "" {
+			return fields[k]
+		}
+	}
+	if part := fields["CPU part"]; part != "" {
+		return fmt.Sprintf("implementer %s part %s", fields["CPU implementer"], part)
+	}
+	return ""
+}
+
+// cpuTopology counts the packages and physical cores the CPUs belong to
+func cpuTopology(cpus []int) (sockets, cores int) {
+	packages := make(map[string]bool)
+	physical := make(map[string]bool)
+	for _, cpu := range cpus {
+		dir := fmt.Sprintf("/sys/devices/system/cpu/cpu%d/topology", cpu)
+		pkg := readSysValue(filepath.Join(dir, "physical_package_id"))
+		core := readSysValue(filepath.Join(dir, "core_id"))
+		if pkg == "" || core == "" {
+			return 0, 0
+		}
+		packages[pkg] = true
+		physical[pkg+"/"+core] = true
+	}
+	return len(packages), len(physical)
+}
+
+// readNUMANodes lists the online NUMA nodes with their CPUs and memory
+func readNUMANodes() []NUMANode {
+	online, err := readCPUListFile("/sys/devices/system/node/online")
+	if err != nil {
+		return nil
+	}
+	var nodes []NUMANode
+	for _, id := range online {
+		dir := fmt.Sprintf("/sys/devices/system/node/node%d", id)
+		n := NUMANode{ID: id}
+		n.CPUs, _ = readCPUListFile(filepath.Join(dir, "cpulist"))
+		// "Node 0 MemTotal:       16303156 kB"
+		for _, line := range strings.Split(readSysValue(filepath.Join(dir, "meminfo")), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 4 && fields[2] == "MemTotal:" {
+				kb, _ := strconv.ParseUint(fields[3], 10, 64)
+				n.MemoryMB = kb / 1024
+			}
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// cpuGovernor returns the cpufreq governor of the CPUs, or each governor
+// with its CPUs ("performance (0-3), powersave (4-7)") when they differ
+func cpuGovernor(cpus []int) string {
+	byGovernor := make(map[string][]int)
+	for _, cpu := range cpus {
+		g := readSysValue(fmt.Sprintf("/sys/devices/system/cpu/cpu%d/cpufreq/scaling_governor", cpu))
+		if g != "" {
+			byGovernor[g] = append(byGovernor[g], cpu)
+		}
+	}
+	if len(byGovernor) == 1 {
+		for g := range byGovernor {
+			return g
+		}
+	}
+	var parts []string
+	for g, list := range byGovernor {
+		parts = append(parts, fmt.Sprintf("%s (%s)", g, FormatCPUList(list)))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// hostEnvironment lists the host settings that results of the same
+// benchmark depend on, by name. The hostname is left out, so identically
+// set up machines share a fingerprint.
+func hostEnvironment(h HostInfo) map[string]string {
+	var numa []string
+	for _, n := range h.NUMANodes {
+		numa = append(numa, fmt.Sprintf("%d:%s", n.ID, FormatCPUList(n.CPUs)))
+	}
+	return map[string]string{
+		"kernel":      h.KernelRelease,
+		"cpu_model":   h.CPUModel,
+		"sockets":     strconv.Itoa(h.CPUSockets),
+		"cores":       strconv.Itoa(h.CPUCores),
+		"online_cpus": FormatCPUList(h.OnlineCPUs),
+		"isolated":    FormatCPUList(h.IsolatedCPUs),
+		"numa":        strings.Join(numa, " "),
+		"governor":    h.CPUGovernor,
+		"bpf_jit":     h.BPFJITEnable,
+		"jit_harden":  h.BPFJITHarden,
+		"clocksource": h.Clocksource,
+		"mitigations": h.MitigationProfile,
+	}
+}
+
+// orUnknown substitutes "unknown" for an empty value
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// jitLabel describes a bpf_jit_enable value
+func jitLabel(v string) string {
+	switch v {
+	case "0":
+		return "off"
+	case "1":
+		return "on"
+	case "2":
+		return "on (debug)"
+	}
+	return orUnknown(v)
+}
+
+// formatHostEnvironment renders the CPU and kernel settings of a host
+func (h HostInfo) formatHostEnvironment() string {
+	cores := ""
+	if h.CPUCores > 0 {
+		cores = fmt.Sprintf(", %d socket(s), %d cores", h.CPUSockets, h.CPUCores)
+	}
+	return fmt.Sprintf("%s%s, %d CPUs, %d NUMA node(s), governor %s, BPF JIT %s, clocksource %s",
+		orUnknown(h.CPUModel), cores, len(h.OnlineCPUs), len(h.NUMANodes),
+		orUnknown(h.CPUGovernor), jitLabel(h.BPFJITEnable), orUnknown(h.Clocksource))
+}
+
+// formatHost renders the host environment, if recorded
+func (r *BenchmarkResult) formatHost() string {
+	if r.Host.Fingerprint == "" {
+		return ""
+	}
+	return fmt.Sprintf("Host:            %s (fingerprint %s)\n", r.Host.formatHostEnvironment(), r.Host.Fingerprint)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HostInfo records host configuration that affects benchmark stability
+type HostInfo struct {
+	Hostname      string
+	KernelRelease string
+	OnlineCPUs    []int  // CPUs currently online
+	AllowedCPUs   []int  // CPUs this process may run on (cpuset/affinity)
+	IsolatedCPUs  []int  // CPUs removed from the scheduler via isolcpus
+	NohzFullCPUs  []int  // CPUs running in adaptive-tick mode
+	CPUSet        string // Effective cgroup cpuset, if any
+
+	KernelConfig       map[string]string // Benchmark-relevant CONFIG_* options
+	KernelConfigSource string            // File the config was read from
+	CmdlineMitigations []string          // Mitigation parameters on the kernel command line
+	Vulnerabilities    map[string]string // CPU vulnerability -> mitigation status
+	MitigationProfile  string            // Short label grouping hosts by mitigation state
+
+	CPUModel     string
+	CPUSockets   int        // Packages of the online CPUs; 0 when the topology is unknown
+	CPUCores     int        // Physical cores of the online CPUs
+	NUMANodes    []NUMANode // Online NUMA nodes
+	CPUGovernor  string     // cpufreq governor; each with its CPUs when they differ
+	BPFJITEnable string     // net.core.bpf_jit_enable: 0 off, 1 on, 2 on with debug output
+	BPFJITHarden string     // net.core.bpf_jit_harden: 0 off, 1 unprivileged, 2 all
+	Clocksource  string     // Current kernel clocksource (tsc, hpet, ...)
+	Fingerprint  string     // Hash of the settings results depend on; see hostEnvironment
+}
+
+// CollectHostInfo gathers host metadata. Missing files are not errors;
+// the corresponding fields are simply left empty.
+func CollectHostInfo() HostInfo {
+	var h HostInfo
+	h.Hostname, _ = os.Hostname()
+	h.KernelRelease = kernelRelease()
+	h.OnlineCPUs, _ = readCPUListFile("/sys/devices/system/cpu/online")
+	h.IsolatedCPUs, _ = readCPUListFile("/sys/devices/system/cpu/isolated")
+	h.NohzFullCPUs, _ = readCPUListFile("/sys/devices/system/cpu/nohz_full")
+
+	// Fall back to the kernel command line on kernels that don't expose
+	// the sysfs files
+	cmdline := readKernelCmdline()
+	if len(h.IsolatedCPUs) == 0 {
+		h.IsolatedCPUs = cmdlineCPUList(cmdline, "isolcpus")
+	}
+	if len(h.NohzFullCPUs) == 0 {
+		h.NohzFullCPUs = cmdlineCPUList(cmdline, "nohz_full")
+	}
+
+	h.KernelConfig, h.KernelConfigSource, _ = ReadKernelConfigHighlights(h.KernelRelease)
+	h.CmdlineMitigations = cmdlineMitigations(cmdline)
+	h.Vulnerabilities = readVulnerabilities()
+	h.MitigationProfile = mitigationProfile(h.CmdlineMitigations, h.Vulnerabilities)
+
+	h.AllowedCPUs = readAllowedCPUs()
+	for _, path := range []string{
+		"/sys/fs/cgroup/cpuset.cpus.effective",
+		"/sys/fs/cgroup/cpuset/cpuset.effective_cpus",
+	} {
+		if data, err := os.ReadFile(path); err == nil {
+			h.CPUSet = strings.TrimSpace(string(data))
+			break
+		}
+	}
+	collectHostEnvironment(&h)
+
+	return h
+}
+
+// readAllowedCPUs returns the Cpus_allowed_list of the current process
+func readAllowedCPUs() []int {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if v, ok := strings.CutPrefix(scanner.Text(), "Cpus_allowed_list:"); ok {
+			cpus, _ := ParseCPUList(strings.TrimSpace(v))
+			return cpus
+		}
+	}
+	return nil
+}
+
+// readKernelCmdline returns /proc/cmdline, or "" if unavailable
+func readKernelCmdline() string {
+	data, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// cmdlineCPUList extracts the CPU list of a kernel parameter such as
+// isolcpus=domain,managed_irq,2-5. Leading flag words are skipped.
+func cmdlineCPUList(cmdline, param string) []int {
+	for _, field := range strings.Fields(cmdline) {
+		v, ok := strings.CutPrefix(field, param+"=")
+		if !ok {
+			continue
+		}
+		parts := strings.Split(v, ",")
+		for i, p := range parts {
+			if p != "" && p[0] >= '0' && p[0] <= '9' {
+				cpus, err := ParseCPUList(strings.Join(parts[i:], ","))
+				if err == nil {
+					return cpus
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// readCPUListFile parses a sysfs CPU list file
+func readCPUListFile(path string) ([]int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCPUList(strings.TrimSpace(string(data)))
+}
+
+// ParseCPUList parses the kernel CPU list format ("0-3,8,10-11")
+func ParseCPUList(s string) ([]int, error) {
+	var cpus []int
+	if s == "" {
+		return cpus, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU list %q: %w", s, err)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(hi); err != nil {
+				return nil, fmt.Errorf("invalid CPU list %q: %w", s, err)
+			}
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+// FormatCPUList renders CPUs in the kernel CPU list format
+func FormatCPUList(cpus []int) string {
+	if len(cpus) == 0 {
+		return ""
+	}
+	sorted := append([]int(nil), cpus...)
+	sort.Ints(sorted)
+
+	var parts []string
+	start, prev := sorted[0], sorted[0]
+	flush := func() {
+		if start == prev {
+			parts = append(parts, strconv.Itoa(start))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", start, prev))
+		}
+	}
+	for _, cpu := range sorted[1:] {
+		if cpu == prev+1 {
+			prev = cpu
+			continue
+		}
+		flush()
+		start, prev = cpu, cpu
+	}
+	flush()
+	return strings.Join(parts, ",")
+}
+
+// SelectPinningCPUs picks up to n CPUs for pinning benchmark threads.
+// Isolated CPUs the process is allowed to use are preferred; otherwise the
+// highest-numbered allowed CPUs are chosen, avoiding CPU 0 which usually
+// services most interrupts and housekeeping work.
+func SelectPinningCPUs(h HostInfo, n int) []int {
+	allowed := h.AllowedCPUs
+	if len(allowed) == 0 {
+		allowed = h.OnlineCPUs
+	}
+	allowedSet := make(map[int]bool, len(allowed))
+	for _, cpu := range allowed {
+		allowedSet[cpu] = true
+	}
+
+	var picked []int
+	for _, cpu := range h.IsolatedCPUs {
+		if len(picked) == n {
+			return picked
+		}
+		if allowedSet[cpu] {
+			picked = append(picked, cpu)
+		}
+	}
+	if len(picked) > 0 {
+		return picked
+	}
+
+	for i := len(allowed) - 1; i >= 0 && len(picked) < n; i-- {
+		if allowed[i] == 0 && len(allowed) > 1 {
+			continue
+		}
+		picked = append(picked, allowed[i])
+	}
+	sort.Ints(picked)
+	return picked
+}
+
+// SuggestIsolation proposes kernel command line parameters isolating the
+// upper half of the online CPUs, or "" when the host is too small
+func SuggestIsolation(h HostInfo) string {
+	if len(h.OnlineCPUs) < 4 {
+		return ""
+	}
+	isolated := h.OnlineCPUs[len(h.OnlineCPUs)/2:]
+	list := FormatCPUList(isolated)
+	return fmt.Sprintf("isolcpus=%s nohz_full=%s rcu_nocbs=%s", list, list, list)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// BenchmarkIdentity is what a result measured, as far as comparing it
+// with another result goes. Two results with different hashes ran
+// different programs, event sizes, mechanisms, sampling or filters, and
+// their metrics are not comparable.
+type BenchmarkIdentity struct {
+	Hash   string            // Hash of Params, in hex
+	Params map[string]string // Benchmark flags, as "-name", and result settings
+}
+
+// identityIgnoredFlags are benchmark flags that do not change what is
+// measured: where coordination state lives, what is reported or checked
+// afterwards, and random seeds, whose runs are meant to be compared
+var identityIgnoredFlags = map[string]bool{
+	"check":           true,
+	"chaos-seed":      true,
+	"outliers":        true,
+	"pin-path":        true,
+	"quantiles":       true,
+	"seed":            true,
+	"stall-threshold": true,
+}
+
+// identityPresenceFlags only matter by being set: writing an archive or
+// dump costs the same wherever it goes
+var identityPresenceFlags = map[string]bool{
+	"archive": true,
+	"dump":    true,
+}
+
+// benchmarkParams returns the values of the flags in fs that are not
+// shared flags, defaults included, so a changed default changes the
+// identity of the runs that relied on it
+func benchmarkParams(fs *flag.FlagSet, shared map[string]bool) map[string]string {
+	params := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if shared[f.Name] || identityIgnoredFlags[f.Name] {
+			return
+		}
+		v := f.Value.String()
+		if identityPresenceFlags[f.Name] {
+			v = strconv.FormatBool(v != "")
+		}
+		params["-"+f.Name] = v
+	})
+	return params
+}
+
+// newBenchmarkIdentity combines a run's benchmark flags with the settings
+// its result records, which distinguish the configurations one run covers
+func newBenchmarkIdentity(r *BenchmarkResult, flags map[string]string) *BenchmarkIdentity {
+	params := make(map[string]string, len(flags)+16)
+	for k, v := range flags {
+		params[k] = v
+	}
+	set := func(k, v string) {
+		if v != "" {
+			params[k] = v
+		}
+	}
+	set("benchmark", r.Benchmark)
+	set("name", r.Name)
+	set("language", r.Language)
+	set("program", r.ProgramType)
+	set("tracepoint", r.Tracepoint)
+	set("mechanism", r.DataMechanism)
+	set("reader", r.ReaderStrategy)
+	set("payload", r.Payload)
+	set("headers", r.HeaderStack)
+	set("rate_profile", r.RateProfile)
+	set("page_cache", r.PageCache)
+	set("drop_policy", r.DropPolicy)
+	if r.Encoding != nil {
+		set("encoding", r.Encoding.Encoding)
+	}
+	if r.Streaming != nil {
+		set("streaming", "true")
+	}
+	if r.EventSample != nil {
+		set("sampled", "true")
+	}
+	return &BenchmarkIdentity{Hash: identityHash(params), Params: params}
+}
+
+// identityHash hashes params in key order
+func identityHash(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%s\n", k, params[k])
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// identityDiff lists the params that differ between two identities, as
+// "key: a -> b"
+func identityDiff(a, b *BenchmarkIdentity) []string {
+	return paramDiff(a.Params, b.Params)
+}
+
+// paramDiff lists the keys whose values differ between a and b, as
+// "key: a -> b"
+func paramDiff(a, b map[string]string) []string {
+	keys := make(map[string]bool)
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	var diff []string
+	for k := range keys {
+		av, aok := a[k]
+		bv, bok := b[k]
+		if av == bv && aok == bok {
+			continue
+		}
+		if !aok {
+			av = "(unset)"
+		}
+		if !bok {
+			bv = "(unset)"
+		}
+		diff = append(diff, fmt.Sprintf("%s: %s -> %s", k, av, bv))
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+// identityCompatible reports whether two identities differ only in
+// params one of them does not record, as when a later harness added a flag
+func identityCompatible(a, b *BenchmarkIdentity) bool {
+	for k, av := range a.Params {
+		if bv, ok := b.Params[k]; ok && bv != av {
+			return false
+		}
+	}
+	return true
+}
+
+// groupIdentity returns the identity shared by runs, nil when none
+// recorded one, and whether the runs disagree among themselves
+func groupIdentity(runs []*BenchmarkResult) (*BenchmarkIdentity, bool) {
+	var id *BenchmarkIdentity
+	for _, r := range runs {
+		if r.Identity == nil {
+			continue
+		}
+		if id == nil {
+			id = r.Identity
+		} else if id.Hash != r.Identity.Hash {
+			return id, true
+		}
+	}
+	return id, false
+}
+
+// formatIdentity renders the identity hash, if recorded
+func (r *BenchmarkResult) formatIdentity() string {
+	if r.Identity == nil {
+		return ""
+	}
+	return fmt.Sprintf("Identity:        %s (%d parameters)\n", r.Identity.Hash, len(r.Identity.Params))
+}
+
+// identitySummary is a one-line account of how many comparisons an
+// identity check refused or let through
+func identitySummary(mismatched []string, allowed bool) string {
+	verb := "refused"
+	if allowed {
+		verb = "compared anyway"
+	}
+	return fmt.Sprintf("%d benchmark(s) with mismatched identity %s: %s", len(mismatched), verb, strings.Join(mismatched, ", "))
+}
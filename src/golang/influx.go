@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Measurements written by the InfluxDB exporter
+const (
+	influxResultMeasurement   = "ebpf_bench_result"   // One point per result
+	influxIntervalMeasurement = "ebpf_bench_interval" // One point per second of collection
+)
+
+// influxTokenEnv names the environment variable holding the API token sent
+// with InfluxDB 2.x writes. 1.x credentials go in the URL (u=, p=).
+const influxTokenEnv = "INFLUX_TOKEN"
+
+// influxBatchLines bounds the lines of one write request
+const influxBatchLines = 5000
+
+// seriesPoint is a benchmark's cumulative counters at one second of its
+// collection
+type seriesPoint struct {
+	time    time.Time
+	events  int64
+	dropped int64
+}
+
+// seriesRecorder samples every tracked benchmark's live counters once a
+// second while it collects, for the per-second series of exported results
+var seriesRecorder struct {
+	sync.Mutex
+	once    sync.Once
+	samples map[*Progress][]seriesPoint
+}
+
+// startSeriesRecorder turns on progress tracking and starts sampling.
+// Only the first call starts it, so a suite and its benchmarks share one.
+func startSeriesRecorder() {
+	seriesRecorder.once.Do(func() {
+		metricsRegistry.Lock()
+		metricsRegistry.tracking = true
+		metricsRegistry.Unlock()
+		seriesRecorder.samples = make(map[*Progress][]seriesPoint)
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for now := range ticker.C {
+				recordSeries(now)
+			}
+		}()
+	})
+}
+
+// recordSeries appends a point for each benchmark that is collecting, and
+// a last one at the end of each that stopped since the previous tick
+func recordSeries(now time.Time) {
+	metricsRegistry.Lock()
+	progress := append([]*Progress(nil), metricsRegistry.progress...)
+	metricsRegistry.Unlock()
+
+	seriesRecorder.Lock()
+	defer seriesRecorder.Unlock()
+	if seriesRecorder.samples == nil {
+		return // Not started
+	}
+	for _, p := range progress {
+		if p.startNs.Load() == 0 {
+			continue
+		}
+		samples := seriesRecorder.samples[p]
+		t := now
+		if endNs := p.endNs.Load(); endNs != 0 {
+			t = time.Unix(0, endNs)
+			if len(samples) > 0 && !samples[len(samples)-1].time.Before(t) {
+				continue // Already closed
+			}
+		}
+		seriesRecorder.samples[p] = append(samples, seriesPoint{t, p.events.Load(), p.dropped.Load()})
+	}
+}
+
+// resultSeries returns the points recorded for r: those of the tracked
+// benchmark of the same subcommand whose collection overlaps r's window
+func resultSeries(r *BenchmarkResult) []seriesPoint {
+	seriesRecorder.Lock()
+	defer seriesRecorder.Unlock()
+	var points []seriesPoint
+	for p, samples := range seriesRecorder.samples {
+		if p.benchmark != r.Benchmark {
+			continue
+		}
+		start, end := time.Unix(0, p.startNs.Load()), time.Unix(0, p.endNs.Load())
+		if p.endNs.Load() == 0 || end.Before(r.StartTime) || start.After(r.EndTime) {
+			continue
+		}
+		for _, s := range samples {
+			if !s.time.Before(r.StartTime) && !s.time.After(r.EndTime) {
+				points = append(points, s)
+			}
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].time.Before(points[j].time) })
+	return points
+}
+
+// influxTags are the tags that identify a result's series
+func influxTags(r *BenchmarkResult) string {
+	tags := [][2]string{
+		{"benchmark", r.Benchmark},
+		{"name", r.Name},
+		{"language", r.Language},
+		{"program", r.ProgramType},
+		{"mechanism", r.DataMechanism},
+		{"reader", r.ReaderStrategy},
+		{"host", r.Host.Hostname},
+		{"kernel", r.Host.KernelRelease},
+	}
+	if r.Iteration > 0 {
+		tags = append(tags, [2]string{"iteration", strconv.Itoa(r.Iteration)})
+	}
+	var sb strings.Builder
+	for _, t := range tags {
+		if t[1] == "" {
+			continue // Empty tag values are invalid
+		}
+		sb.WriteString("," + influxEscape(t[0], ",= ") + "=" + influxEscape(t[1], ",= "))
+	}
+	return sb.String()
+}
+
+// influxFields accumulates the fields of one line
+type influxFields struct {
+	sb strings.Builder
+}
+
+func (f *influxFields) sep() {
+	if f.sb.Len() > 0 {
+		f.sb.WriteByte(',')
+	}
+}
+
+func (f *influxFields) float(key string, v float64) {
+	if v != v || v > 1e308 || v < -1e308 {
+		return // NaN and infinities are not representable
+	}
+	f.sep()
+	f.sb.WriteString(influxEscape(key, ",= ") + "=" + strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func (f *influxFields) int(key string, v int64) {
+	f.sep()
+	f.sb.WriteString(influxEscape(key, ",= ") + "=" + strconv.FormatInt(v, 10) + "i")
+}
+
+func (f *influxFields) latency(prefix string, s LatencyStats) {
+	if s.Samples == 0 {
+		return
+	}
+	f.int(prefix+"_samples", s.Samples)
+	f.int(prefix+"_min_ns", int64(s.MinNs))
+	f.int(prefix+"_max_ns", int64(s.MaxNs))
+	f.float(prefix+"_avg_ns", s.AvgNs)
+	f.float(prefix+"_stddev_ns", s.StdDevNs)
+	f.float(prefix+"_jitter_ns", s.JitterNs)
+	for _, p := range s.Percentiles {
+		f.int(prefix+"_"+QuantileKey(p.Quantile)+"_ns", int64(p.ValueNs))
+	}
+}
+
+// influxEscape backslash-escapes the characters special in a tag key,
+// tag value or field key
+func influxEscape(s, special string) string {
+	if !strings.ContainsAny(s, special+"\\") {
+		return s
+	}
+	var sb strings.Builder
+	for _, c := range s {
+		if c == '\\' || strings.ContainsRune(special, c) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+// influxLines renders a result as line protocol: its summary metrics at
+// its start time, then the events and drops of each second it collected
+func influxLines(r *BenchmarkResult) []string {
+	tags := influxTags(r)
+	var f influxFields
+	f.float("duration_s", r.Duration)
+	f.int("events", r.EventCount)
+	f.int("dropped", r.DroppedEvents)
+	f.float("drop_rate", r.DropRate)
+	f.float("throughput", r.Throughput)
+	f.float("cpu_usage", r.CPUUsage)
+	f.float("cpu_per_event_us", r.CPUBudget.CPUPerEventUs)
+	f.int("memory_bytes", int64(r.MemoryUsage))
+	f.latency("latency", r.Latency)
+	if r.DeliveryLatency != nil {
+		f.latency("delivery", *r.DeliveryLatency)
+	}
+	f.int("errors", int64(len(r.Errors)))
+	var ok int64
+	if r.Quality.OK() {
+		ok = 1
+	}
+	f.int("quality_ok", ok)
+	lines := []string{fmt.Sprintf("%s%s %s %d", influxResultMeasurement, tags, f.sb.String(), r.StartTime.UnixNano())}
+
+	prev := seriesPoint{time: r.StartTime}
+	for _, p := range resultSeries(r) {
+		elapsed := p.time.Sub(prev.time).Seconds()
+		if elapsed < 0.5 {
+			continue // The tail after the last tick; its rate would be noise
+		}
+		var f influxFields
+		f.float("events_per_second", float64(p.events-prev.events)/elapsed)
+		f.float("drops_per_second", float64(p.dropped-prev.dropped)/elapsed)
+		f.int("events", p.events)
+		f.int("dropped", p.dropped)
+		lines = append(lines, fmt.Sprintf("%s%s %s %d", influxIntervalMeasurement, tags, f.sb.String(), p.time.UnixNano()))
+		prev = p
+	}
+	return lines
+}
+
+// exportInflux writes results as line protocol to dest: POSTed in batches
+// when it is an http(s) write URL, else appended to the file it names
+func exportInflux(dest string, results []*BenchmarkResult) error {
+	recordSeries(time.Now()) // Close the series of runs that just ended
+	var lines []string
+	for _, r := range results {
+		lines = append(lines, influxLines(r)...)
+	}
+	if !strings.HasPrefix(dest, "http://") && !strings.HasPrefix(dest, "https://") {
+		return appendToFile(dest, func(f *os.File, _ bool) error {
+			_, err := io.WriteString(f, strings.Join(lines, "\n")+"\n")
+			return err
+		})
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	for len(lines) > 0 {
+		n := min(len(lines), influxBatchLines)
+		if err := postInflux(client, dest, strings.Join(lines[:n], "\n")+"\n"); err != nil {
+			return err
+		}
+		lines = lines[n:]
+	}
+	return nil
+}
+
+// postInflux sends one batch to a write endpoint
+func postInflux(client *http.Client, url, body string) error {
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid InfluxDB URL: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if token := os.Getenv(influxTokenEnv); token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("InfluxDB write: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("InfluxDB write: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+// Command apicheck guards the module's stable API. It lists the exported
+// declarations of the stable packages, one per line in the style of the
+// Go distribution's api/ files, and compares them with the recorded list:
+// a recorded line that is gone or changed is a breaking change and fails
+// the check. New lines are reported so they can be recorded with -write.
+//
+// Run it from src/golang:
+//
+//	go run ./internal/apicheck
+//	go run ./internal/apicheck -write
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// modulePath prefixes the packages in the recorded lines
+const modulePath = "github.com/parlakisik/ebpf_benchmark/src/golang"
+
+// stablePackages are the directories whose exported API is covered by the
+// compatibility promise in API.md
+var stablePackages = []string{"stats", "workloadgen"}
+
+func main() {
+	file := flag.String("api", "api/v0.txt", "Recorded API file")
+	write := flag.Bool("write", false, "Record the current API instead of checking it")
+	flag.Parse()
+
+	current, err := currentAPI(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "apicheck: %v\n", err)
+		os.Exit(2)
+	}
+
+	if *write {
+		if err := os.WriteFile(*file, []byte(strings.Join(current, "\n")+"\n"), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "apicheck: %v\n", err)
+			os.Exit(2)
+		}
+		fmt.Printf("Recorded %d declarations in %s\n", len(current), *file)
+		return
+	}
+
+	recorded, err := readLines(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "apicheck: %v\n", err)
+		os.Exit(2)
+	}
+	added, removed := diffAPI(recorded, current)
+	for _, l := range added {
+		fmt.Printf("+%s\n", l)
+	}
+	for _, l := range removed {
+		fmt.Printf("-%s\n", l)
+	}
+	if len(removed) > 0 {
+		fmt.Fprintf(os.Stderr, "apicheck: %d recorded declarations were removed or changed; "+
+			"deprecate them instead (API.md), or record the break with -write in a new major version\n", len(removed))
+		os.Exit(1)
+	}
+	if len(added) > 0 {
+		fmt.Fprintf(os.Stderr, "apicheck: %d new declarations; record them with -write\n", len(added))
+	}
+}
+
+// currentAPI lists the exported declarations of the stable packages of
+// the module rooted at root, sorted
+func currentAPI(root string) ([]string, error) {
+	var current []string
+	for _, dir := range stablePackages {
+		lines, err := packageAPI(root, dir)
+		if err != nil {
+			return nil, err
+		}
+		current = append(current, lines...)
+	}
+	sort.Strings(current)
+	return current, nil
+}
+
+// diffAPI returns the lines of current that were not recorded, and the
+// recorded lines that are gone from current
+func diffAPI(recorded, current []string) (added, removed []string) {
+	have := make(map[string]bool, len(current))
+	for _, l := range current {
+		have[l] = true
+	}
+	was := make(map[string]bool, len(recorded))
+	for _, l := range recorded {
+		was[l] = true
+		if !have[l] {
+			removed = append(removed, l)
+		}
+	}
+	for _, l := range current {
+		if !was[l] {
+			added = append(added, l)
+		}
+	}
+	return added, removed
+}
+
+// readLines reads the non-empty, non-comment lines of an API file
+func readLines(name string) ([]string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		if l := strings.TrimSpace(sc.Text()); l != "" && !strings.HasPrefix(l, "#") {
+			lines = append(lines, l)
+		}
+	}
+	return lines, sc.Err()
+}
+
+// packageAPI lists the exported declarations of the package in dir,
+// relative to the module root
+func packageAPI(root, dir string) ([]string, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, filepath.Join(root, dir), func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+	prefix := "pkg " + path.Join(modulePath, dir) + ", "
+	var lines []string
+	emit := func(format string, args ...any) {
+		lines = append(lines, prefix+fmt.Sprintf(format, args...))
+	}
+	for _, pkg := range pkgs {
+		for _, f := range pkg.Files {
+			for _, decl := range f.Decls {
+				switch d := decl.(type) {
+				case *ast.FuncDecl:
+					if !d.Name.IsExported() {
+						continue
+					}
+					if d.Recv == nil {
+						emit("func %s%s", d.Name.Name, signature(fset, d.Type))
+						continue
+					}
+					recv := expr(fset, d.Recv.List[0].Type)
+					if !ast.IsExported(strings.TrimPrefix(recv, "*")) {
+						continue
+					}
+					emit("method (%s) %s%s", recv, d.Name.Name, signature(fset, d.Type))
+				case *ast.GenDecl:
+					genDecl(fset, d, emit)
+				}
+			}
+		}
+	}
+	return lines, nil
+}
+
+// genDecl lists the exported constants, variables and types of d
+func genDecl(fset *token.FileSet, d *ast.GenDecl, emit func(string, ...any)) {
+	var typ ast.Expr // Carried over by iota-style constant groups
+	for _, spec := range d.Specs {
+		switch s := spec.(type) {
+		case *ast.ValueSpec:
+			if s.Type != nil || len(s.Values) > 0 {
+				typ = s.Type
+			}
+			for i, name := range s.Names {
+				if !name.IsExported() {
+					continue
+				}
+				kind := "var"
+				if d.Tok == token.CONST {
+					kind = "const"
+				}
+				switch {
+				case typ != nil:
+					emit("%s %s %s", kind, name.Name, expr(fset, typ))
+				case d.Tok == token.CONST && i < len(s.Values):
+					emit("%s %s = %s", kind, name.Name, expr(fset, s.Values[i]))
+				default:
+					emit("%s %s", kind, name.Name) // Type left to inference
+				}
+			}
+		case *ast.TypeSpec:
+			if !s.Name.IsExported() {
+				continue
+			}
+			switch t := s.Type.(type) {
+			case *ast.StructType:
+				emit("type %s struct", s.Name.Name)
+				for _, field := range t.Fields.List {
+					ft := expr(fset, field.Type)
+					if len(field.Names) == 0 {
+						if ast.IsExported(ft[strings.LastIndexAny(ft, "*.")+1:]) {
+							emit("type %s struct, embedded %s", s.Name.Name, ft)
+						}
+						continue
+					}
+					for _, name := range field.Names {
+						if name.IsExported() {
+							emit("type %s struct, %s %s", s.Name.Name, name.Name, ft)
+						}
+					}
+				}
+			case *ast.InterfaceType:
+				emit("type %s interface", s.Name.Name)
+				for _, m := range t.Methods.List {
+					for _, name := range m.Names {
+						if name.IsExported() {
+							emit("type %s interface, %s%s", s.Name.Name, name.Name, signature(fset, m.Type.(*ast.FuncType)))
+						}
+					}
+				}
+			default:
+				if s.Assign.IsValid() {
+					emit("type %s = %s", s.Name.Name, expr(fset, s.Type))
+				} else {
+					emit("type %s %s", s.Name.Name, expr(fset, s.Type))
+				}
+			}
+		}
+	}
+}
+
+// signature renders a function type's parameters and results without
+// their names, which callers do not depend on
+func signature(fset *token.FileSet, ft *ast.FuncType) string {
+	s := "(" + fieldTypes(fset, ft.Params) + ")"
+	if ft.Results == nil {
+		return s
+	}
+	results := fieldTypes(fset, ft.Results)
+	if len(ft.Results.List) == 1 && len(ft.Results.List[0].Names) <= 1 {
+		return s + " " + results
+	}
+	return s + " (" + results + ")"
+}
+
+func fieldTypes(fset *token.FileSet, fields *ast.FieldList) string {
+	if fields == nil {
+		return ""
+	}
+	var types []string
+	for _, field := range fields.List {
+		t := expr(fset, field.Type)
+		for i := 0; i < max(len(field.Names), 1); i++ {
+			types = append(types, t)
+		}
+	}
+	return strings.Join(types, ", ")
+}
+
+func expr(fset *token.FileSet, e ast.Expr) string {
+	var buf bytes.Buffer
+	printer.Fprint(&buf, fset, e)
+	return buf.String()
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+// TestAPICompatible runs the check of main against the recorded API, so
+// go test fails on a breaking change to a stable package
+func TestAPICompatible(t *testing.T) {
+	current, err := currentAPI("../..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, err := readLines("../../api/v0.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, removed := diffAPI(recorded, current)
+	for _, l := range removed {
+		t.Errorf("recorded declaration removed or changed: %s", l)
+	}
+	if len(removed) > 0 {
+		t.Log("deprecate them instead (API.md), or record the break with go run ./internal/apicheck -write in a new major version")
+	}
+	for _, l := range added {
+		t.Logf("new declaration, record it with go run ./internal/apicheck -write: %s", l)
+	}
+}
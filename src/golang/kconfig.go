@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// kernelConfigHighlights are the kernel config options that most often
+// explain benchmark differences between hosts
+var kernelConfigHighlights = []string{
+	"CONFIG_PREEMPT",
+	"CONFIG_PREEMPT_VOLUNTARY",
+	"CONFIG_PREEMPT_NONE",
+	"CONFIG_PREEMPT_DYNAMIC",
+	"CONFIG_PREEMPT_RT",
+	"CONFIG_HZ",
+	"CONFIG_NO_HZ_FULL",
+	"CONFIG_BPF_JIT",
+	"CONFIG_BPF_JIT_ALWAYS_ON",
+	"CONFIG_BPF_JIT_DEFAULT_ON",
+	"CONFIG_DEBUG_INFO_BTF",
+	"CONFIG_BPF_EVENTS",
+	"CONFIG_KPROBES",
+	"CONFIG_FPROBE",
+	"CONFIG_MITIGATION_RETPOLINE",
+	"CONFIG_RETPOLINE",
+	"CONFIG_PAGE_TABLE_ISOLATION",
+}
+
+// kernelRelease returns the running kernel release (uname -r)
+func kernelRelease() string {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return ""
+	}
+	b := make([]byte, 0, len(uts.Release))
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(c))
+	}
+	return string(b)
+}
+
+// openKernelConfig opens /proc/config.gz or /boot/config-<release>,
+// returning the reader and the path it came from
+func openKernelConfig(release string) (io.ReadCloser, string, error) {
+	if f, err := os.Open("/proc/config.gz"); err == nil {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, "", fmt.Errorf("/proc/config.gz: %w", err)
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{zr, f}, "/proc/config.gz", nil
+	}
+
+	path := "/boot/config-" + release
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("kernel config not found (/proc/config.gz, %s)", path)
+	}
+	return f, path, nil
+}
+
+// ReadKernelConfigHighlights extracts kernelConfigHighlights from the
+// running kernel's config. Options that are not set are recorded as "n".
+func ReadKernelConfigHighlights(release string) (map[string]string, string, error) {
+	rc, source, err := openKernelConfig(release)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+
+	wanted := make(map[string]bool, len(kernelConfigHighlights))
+	for _, opt := range kernelConfigHighlights {
+		wanted[opt] = true
+	}
+
+	config := make(map[string]string)
+	scanner := bufio.NewScanner(rc)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if opt, ok := strings.CutPrefix(line, "# "); ok {
+			// "# CONFIG_FOO is not set"
+			if name, ok := strings.CutSuffix(opt, " is not set"); ok && wanted[name] {
+				config[name] = "n"
+			}
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if ok && wanted[name] {
+			config[name] = strings.Trim(value, `"`)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, source, fmt.Errorf("%s: %w", source, err)
+	}
+	return config, source, nil
+}
+
+// mitigationParams are kernel command line parameters that change CPU
+// vulnerability mitigations
+var mitigationParams = []string{
+	"mitigations", "nospectre_v1", "nospectre_v2", "spectre_v2", "spectre_v2_user",
+	"nopti", "pti", "retbleed", "spec_store_bypass_disable", "mds", "tsx_async_abort",
+	"l1tf", "mmio_stale_data", "srbds", "gather_data_sampling", "spec_rstack_overflow",
+}
+
+// cmdlineMitigations returns the mitigation-related parameters on the
+// kernel command line, as written (e.g. "mitigations=off")
+func cmdlineMitigations(cmdline string) []string {
+	var found []string
+	for _, param := range mitigationParams {
+		if v, ok := cmdlineParam(cmdline, param); ok {
+			if v == "" {
+				found = append(found, param)
+			} else {
+				found = append(found, param+"="+v)
+			}
+		}
+	}
+	return found
+}
+
+// cmdlineParam returns the value of a kernel command line parameter
+func cmdlineParam(cmdline, param string) (string, bool) {
+	for _, field := range strings.Fields(cmdline) {
+		if v, ok := strings.CutPrefix(field, param+"="); ok {
+			return v, true
+		}
+		if field == param {
+			return "", true
+		}
+	}
+	return "", false
+}
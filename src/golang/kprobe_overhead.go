@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// Probe backends for the kprobe overhead benchmark
+const (
+	probeBackendAuto    = "auto"
+	probeBackendTracefs = "tracefs"
+	probeBackendSim     = "sim"
+)
+
+// kprobeGroup and kprobeEvent name the tracefs kprobe
+const kprobeGroup, kprobeEvent = "ebpf_bench", "kprobe_overhead"
+
+// kprobeAttacher attaches and detaches a probe on a kernel function
+type kprobeAttacher interface {
+	Attach(symbol string) error
+	Detach() error
+	// Hit is called after every probed syscall; simulated probes run their
+	// handler here, real probes run in the kernel and do nothing
+	Hit()
+	Backend() string
+}
+
+// tracefsKprobe creates real kprobes through tracefs kprobe_events
+type tracefsKprobe struct {
+	root string
+}
+
+func (k *tracefsKprobe) Attach(symbol string) error {
+	def := fmt.Sprintf("p:%s/%s %s\n", kprobeGroup, kprobeEvent, symbol)
+	if err := writeTracefs(filepath.Join(k.root, "kprobe_events"), def, true); err != nil {
+		return fmt.Errorf("create kprobe: %w", err)
+	}
+	enable := filepath.Join(k.root, "events", kprobeGroup, kprobeEvent, "enable")
+	if err := writeTracefs(enable, "1", false); err != nil {
+		return fmt.Errorf("enable kprobe: %w", err)
+	}
+	return nil
+}
+
+func (k *tracefsKprobe) Detach() error {
+	enable := filepath.Join(k.root, "events", kprobeGroup, kprobeEvent, "enable")
+	if err := writeTracefs(enable, "0", false); err != nil {
+		return fmt.Errorf("disable kprobe: %w", err)
+	}
+	def := fmt.Sprintf("-:%s/%s\n", kprobeGroup, kprobeEvent)
+	if err := writeTracefs(filepath.Join(k.root, "kprobe_events"), def, true); err != nil {
+		return fmt.Errorf("remove kprobe: %w", err)
+	}
+	return nil
+}
+
+func (k *tracefsKprobe) Hit()            {}
+func (k *tracefsKprobe) Backend() string { return probeBackendTracefs }
+
+// simulatedKprobe models a kprobe in userspace: attaching installs a
+// handler that emits an Event on every probed call, like the BPF program in
+// ringbuf_throughput.c would
+type simulatedKprobe struct {
+	handler func()
+	buffer  *EventBuffer
+}
+
+func (k *simulatedKprobe) Attach(string) error {
+	pid := uint32(os.Getpid())
+	k.handler = func() {
+		k.buffer.Add(Event{
+			Timestamp: uint64(time.Now().UnixNano()),
+			PID:       pid,
+			EventType: eventTypeKprobe,
+		})
+	}
+	return nil
+}
+
+func (k *simulatedKprobe) Detach() error {
+	k.handler = nil
+	return nil
+}
+
+func (k *simulatedKprobe) Hit() {
+	if k.handler != nil {
+		k.handler()
+	}
+}
+
+func (k *simulatedKprobe) Backend() string { return probeBackendSim }
+
+// newKprobeAttacher selects a probe backend. auto uses tracefs when it is
+// mounted with kprobe support and falls back to simulation otherwise.
+func newKprobeAttacher(backend string, buffer *EventBuffer) (kprobeAttacher, error) {
+	switch backend {
+	case probeBackendSim:
+		return &simulatedKprobe{buffer: buffer}, nil
+	case probeBackendTracefs, probeBackendAuto:
+		root, err := findTracefs()
+		if err == nil {
+			_, err = os.Stat(filepath.Join(root, "kprobe_events"))
+		}
+		if err == nil {
+			return &tracefsKprobe{root: root}, nil
+		}
+		if backend == probeBackendTracefs {
+			return nil, err
+		}
+		return &simulatedKprobe{buffer: buffer}, nil
+	}
+	return nil, fmt.Errorf("unknown probe backend %q", backend)
+}
+
+// KprobeOverheadBenchmark measures kprobe attach/detach latency and the
+// per-call overhead a kprobe adds to the probed syscall. Other probes on a
+// kernel function, such as fentry, reuse it with their own attacher.
+type KprobeOverheadBenchmark struct {
+	symbol  string
+	cycles  int
+	calls   int
+	backend string
+	verbose bool
+
+	name        string // Result name, e.g. Kprobe Overhead
+	programType string
+	simNote     string // Error recorded when the probe is simulated
+	newProbe    func(buffer *EventBuffer) (kprobeAttacher, error)
+
+	// Optional file-IO workload replacing the /dev/null open/close, with
+	// the page cache mode applied before each measured phase
+	churn     *FileChurn
+	cacheMode string
+}
+
+// NewKprobeOverheadBenchmark creates a new benchmark instance
+func NewKprobeOverheadBenchmark(symbol string, cycles, calls int, backend string, verbose bool) *KprobeOverheadBenchmark {
+	return &KprobeOverheadBenchmark{
+		symbol:      symbol,
+		cycles:      cycles,
+		calls:       calls,
+		backend:     backend,
+		verbose:     verbose,
+		name:        "Kprobe Overhead",
+		programType: "kprobe",
+		simNote:     "tracefs unavailable: kprobe simulated in userspace",
+		newProbe: func(buffer *EventBuffer) (kprobeAttacher, error) {
+			return newKprobeAttacher(backend, buffer)
+		},
+	}
+}
+
+// probedCall issues one openat(2), which enters do_sys_openat2
+func probedCall() error {
+	fd, err := syscall.Open("/dev/null", syscall.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	return syscall.Close(fd)
+}
+
+// timeCalls runs the probed call n times and returns the elapsed time
+func timeCalls(probe kprobeAttacher, n int, call func() error) (time.Duration, error) {
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		if err := call(); err != nil {
+			return 0, err
+		}
+		probe.Hit()
+	}
+	return time.Since(start), nil
+}
+
+// Run executes the benchmark
+func (b *KprobeOverheadBenchmark) Run(ctx context.Context) (*BenchmarkResult, error) {
+	buffer := NewEventBuffer(b.calls)
+	buffer.SetProgress(NewProgress(b.programType))
+	markPhase(ctx, lifecycleLoad)
+	probe, err := b.newProbe(buffer)
+	if err != nil {
+		return nil, err
+	}
+	markPhase(ctx, lifecycleSetup)
+
+	r := &BenchmarkResult{
+		Name:           b.name,
+		Language:       "Go",
+		ProgramType:    b.programType,
+		DataMechanism:  "none",
+		ReaderStrategy: probe.Backend(),
+		Errors:         []string{},
+		Host:           CollectHostInfo(),
+	}
+	if probe.Backend() == probeBackendSim {
+		r.Errors = append(r.Errors, b.simNote)
+	}
+
+	if b.verbose {
+		PrintBenchmarkHeader(b.name + " Benchmark (Go)")
+	}
+	log := benchLog(ctx)
+	log.Info("Probing", "symbol", b.symbol, "backend", probe.Backend())
+
+	startUsage, _ := TakeResourceSnapshot()
+	r.StartTime = time.Now()
+
+	// Attach/detach cycles, timing each transition individually
+	attachNs := make([]uint64, 0, b.cycles)
+	detachNs := make([]uint64, 0, b.cycles)
+	var attachTotal, detachTotal time.Duration
+	for i := 0; i < b.cycles; i++ {
+		start := time.Now()
+		if err := probe.Attach(b.symbol); err != nil {
+			return nil, err
+		}
+		d := time.Since(start)
+		attachTotal += d
+		attachNs = append(attachNs, uint64(d))
+
+		start = time.Now()
+		if err := probe.Detach(); err != nil {
+			return nil, err
+		}
+		d = time.Since(start)
+		detachTotal += d
+		detachNs = append(detachNs, uint64(d))
+	}
+
+	attach := NewOperationResult("attach", int64(b.cycles), attachTotal)
+	attachStats := computeLatencyStats(attachNs, DefaultQuantiles)
+	attach.Latency = &attachStats
+	detach := NewOperationResult("detach", int64(b.cycles), detachTotal)
+	detachStats := computeLatencyStats(detachNs, DefaultQuantiles)
+	detach.Latency = &detachStats
+
+	log.Info("Measuring per-call overhead")
+
+	// Per-call overhead: the same syscall loop without and with the probe
+	call := probedCall
+	if b.churn != nil {
+		call = b.churn.Op
+	}
+	if err := b.prepareCache(r); err != nil {
+		return nil, err
+	}
+	unprobedTime, err := timeCalls(probe, b.calls, call)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.prepareCache(r); err != nil {
+		return nil, err
+	}
+	if err := probe.Attach(b.symbol); err != nil {
+		return nil, err
+	}
+	buffer.Start()
+	probedTime, err := timeCalls(probe, b.calls, call)
+	buffer.End()
+	if detachErr := probe.Detach(); detachErr != nil && err == nil {
+		err = detachErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	unprobed := NewOperationResult("call_unprobed", int64(b.calls), unprobedTime)
+	probed := NewOperationResult("call_probed", int64(b.calls), probedTime)
+	r.Operations = []OperationResult{attach, detach, unprobed, probed}
+	r.OverheadNs = probed.AvgNs - unprobed.AvgNs
+
+	r.EndTime = time.Now()
+	endUsage, _ := TakeResourceSnapshot()
+
+	r.Duration = r.EndTime.Sub(r.StartTime).Seconds()
+	r.EventCount = buffer.GetEventCount()
+	r.RecordDrops(DropCounts{BufferFull: buffer.GetDroppedCount()})
+	r.Throughput = probed.Throughput
+	r.CPUBudget = NewCPUBudget(startUsage, endUsage, int64(2*b.calls))
+	r.CPUUsage = r.CPUBudget.CPUPercent(endUsage.Wall.Sub(startUsage.Wall))
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	r.MemoryUsage = ms.Alloc
+
+	return r, nil
+}
+
+// prepareCache applies the page cache mode of the file workload, if any,
+// and records the method used in the result
+func (b *KprobeOverheadBenchmark) prepareCache(r *BenchmarkResult) error {
+	if b.churn == nil {
+		return nil
+	}
+	label, err := b.churn.PrepareCache(b.cacheMode)
+	if err != nil {
+		return fmt.Errorf("page cache: %w", err)
+	}
+	r.PageCache = label
+	return nil
+}
+
+// runKprobeOverhead is the entry point of the kprobe subcommand
+func runKprobeOverhead(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("kprobe", flag.ExitOnError)
+	common := addBenchFlags(fs, "kprobe_result.json", false)
+	symbol := fs.String("symbol", "do_sys_openat2", "Kernel function to probe")
+	cycles := fs.Int("n", 100, "Attach/detach cycles")
+	calls := fs.Int("calls", 100000, "Probed syscalls per overhead measurement")
+	backend := fs.String("backend", probeBackendAuto, "Probe backend (auto, tracefs, sim)")
+	workload := fs.String("workload", "devnull", "Probed call (devnull: open/close /dev/null, files: open/read/close a file working set)")
+	files := fs.Int("files", 64, "Working set size for -workload files")
+	fileSize := fs.Int("file-size", 4096, "File size in bytes for -workload files")
+	workdir := fs.String("workdir", os.TempDir(), "Directory for the -workload files working set")
+	cacheMode := fs.String("cache", cacheModeWarm, "Page cache state before each phase (none, warm, cold); cold only affects the first pass over the working set")
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+	if *cycles <= 0 || *calls <= 0 {
+		return nil, opts, fmt.Errorf("-n and -calls must be positive")
+	}
+
+	bench := NewKprobeOverheadBenchmark(*symbol, *cycles, *calls, *backend, opts.Verbose)
+	switch *workload {
+	case "devnull":
+	case "files":
+		payload, _ := NewPayloadGenerator("random", 1)
+		churn, err := NewFileChurn(*workdir, *files, *fileSize, payload)
+		if err != nil {
+			return nil, opts, fmt.Errorf("create working set: %w", err)
+		}
+		defer churn.Close()
+		bench.churn = churn
+		bench.cacheMode = *cacheMode
+	default:
+		return nil, opts, fmt.Errorf("unknown workload %q (want devnull or files)", *workload)
+	}
+	r, err := bench.Run(ctx)
+	if err != nil {
+		return nil, opts, err
+	}
+
+	return []*BenchmarkResult{r}, opts, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import "github.com/parlakisik/ebpf_benchmark/src/golang/stats"
+
+// The latency statistics live in the stats package, which other projects
+// import; these names keep the benchmarks reading as before
+type (
+	LatencyUnit      = stats.LatencyUnit
+	LatencyStats     = stats.LatencyStats
+	Percentile       = stats.Percentile
+	StreamingLatency = stats.StreamingLatency
+	LatencyHistogram = stats.LatencyHistogram
+	HistogramBucket  = stats.HistogramBucket
+	TDigest          = stats.TDigest
+)
+
+const (
+	LatencyUnitNanoseconds  = stats.LatencyUnitNanoseconds
+	LatencyUnitMicroseconds = stats.LatencyUnitMicroseconds
+	LatencyUnitMilliseconds = stats.LatencyUnitMilliseconds
+
+	DefaultHistogramPrecision = stats.DefaultHistogramPrecision
+	DefaultTDigestCompression = stats.DefaultTDigestCompression
+)
+
+var (
+	DefaultQuantiles = stats.DefaultQuantiles
+
+	ParseLatencyUnit    = stats.ParseLatencyUnit
+	ParseQuantiles      = stats.ParseQuantiles
+	QuantileKey         = stats.QuantileKey
+	NewLatencyHistogram = stats.NewLatencyHistogram
+	NewTDigest          = stats.NewTDigest
+	computeLatencyStats = stats.ComputeLatencyStats
+)
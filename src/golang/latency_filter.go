@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// LatencyFilterStats is what the exit program of a threshold-filtered
+// latency tracer observed and emitted
+type LatencyFilterStats struct {
+	ThresholdNs      int64   // Exits at or above this duration are emitted; 0 emits all
+	Syscalls         int64   // Entry/exit pairs the programs handled in the window
+	Emitted          int64   // Records submitted to the ring
+	Filtered         int64   // Exits below the threshold, dropped in the kernel
+	EmitRatio        float64 // Emitted over syscalls
+	ExpectedRatio    float64 // Share of the duration distribution at or above the threshold
+	VolumeVsAll      float64 // Emitted per second over that of an unfiltered run, if one ran
+	ProgramNs        float64 // Producer time per syscall: map update, lookup and delete, and emitting
+	ConsumerCPU      float64 // Consumer thread CPU, as a percentage of one core
+	ConsumerNsPerSys float64 // Consumer thread CPU per syscall traced
+	EmittedP50Ns     uint64  // Median duration of the emitted records, as the tracer reports it
+	EmittedP99Ns     uint64
+}
+
+// latencyFilterPoll is how long the consumer sleeps on an empty ring, as
+// an epoll consumer woken once per batch of records would
+const latencyFilterPoll = time.Millisecond
+
+// latencyStartBuckets is the number of locked buckets of the start map
+const latencyStartBuckets = 64
+
+// latencyStartMap is the BPF_MAP_TYPE_HASH the entry program stores start
+// timestamps in by thread ID. Like the kernel's hash map, each bucket has
+// its own lock, and with max_entries set new keys fail once it is full.
+type latencyStartMap struct {
+	buckets [latencyStartBuckets]struct {
+		sync.Mutex
+		m map[uint32]uint64
+		_ [cacheLineSize]byte
+	}
+	limit int64 // max_entries; 0 for no limit
+	size  atomic.Int64
+}
+
+func newLatencyStartMap(limit int) *latencyStartMap {
+	m := &latencyStartMap{limit: int64(limit)}
+	for i := range m.buckets {
+		m.buckets[i].m = make(map[uint32]uint64)
+	}
+	return m
+}
+
+// update stores the start of tid's syscall, like bpf_map_update_elem with
+// BPF_ANY. It fails, returning false, when a new key finds the map full.
+func (m *latencyStartMap) update(tid uint32, ts uint64) bool {
+	b := &m.buckets[tid%latencyStartBuckets]
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.m[tid]; !ok {
+		if m.limit > 0 && m.size.Load() >= m.limit {
+			return false
+		}
+		m.size.Add(1)
+	}
+	b.m[tid] = ts
+	return true
+}
+
+// take looks up and deletes the start of tid's syscall, as the exit
+// program does with bpf_map_lookup_elem and bpf_map_delete_elem
+func (m *latencyStartMap) take(tid uint32) (uint64, bool) {
+	b := &m.buckets[tid%latencyStartBuckets]
+	b.Lock()
+	ts, ok := b.m[tid]
+	if ok {
+		delete(b.m, tid)
+		m.size.Add(-1)
+	}
+	b.Unlock()
+	return ts, ok
+}
+
+// len returns the number of entries
+func (m *latencyStartMap) len() int64 { return m.size.Load() }
+
+// runPaced calls step with 0, 1, 2... until stop is set, perSecond times a
+// second or, when 0, flat out. It returns the time spent in step.
+func runPaced(stop *atomic.Bool, perSecond float64, step func(n int64)) time.Duration {
+	var n int64
+	var spent time.Duration
+	start := time.Now()
+	for !stop.Load() {
+		batch := int64(256)
+		if perSecond > 0 {
+			due := int64(time.Since(start).Seconds() * perSecond)
+			if n >= due {
+				time.Sleep(100 * time.Microsecond)
+				continue
+			}
+			batch = min(due-n, batch)
+		}
+		t := time.Now()
+		for i := int64(0); i < batch; i, n = i+1, n+1 {
+			step(n)
+		}
+		spent += time.Since(t)
+	}
+	return spent
+}
+
+// threadConsumer drains a ring on its own OS thread, so its CPU time can
+// be told apart from the producers'. It sleeps latencyFilterPoll whenever
+// the ring is empty.
+type threadConsumer struct {
+	start, end ResourceSnapshot // Thread CPU over the measured window
+	postWindow int64            // Records read after stop was set, handed to drain
+	done       chan struct{}
+}
+
+// startThreadConsumer starts delivering the ring's records until stop is set
+// and handing them to drain after, if not nil, until producersDone is set
+// and the ring is empty. It returns once the consumer thread is measured.
+func startThreadConsumer(ring *mpscRing, stop, producersDone *atomic.Bool, deliver, drain func(e Event)) *threadConsumer {
+	c := &threadConsumer{done: make(chan struct{})}
+	ready := make(chan struct{})
+	go func() {
+		defer close(c.done)
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		discard := func(e Event) {
+			c.postWindow++
+			if drain != nil {
+				drain(e)
+			}
+		}
+		c.start, _ = TakeThreadResourceSnapshot()
+		close(ready)
+		measuring := true
+		for {
+			done := producersDone.Load()
+			read := deliver
+			if stop.Load() {
+				if measuring {
+					c.end, _ = TakeThreadResourceSnapshot()
+					measuring = false
+				}
+				read = discard
+			}
+			if ring.consume(read) > 0 {
+				continue
+			}
+			if done {
+				return
+			}
+			time.Sleep(latencyFilterPoll)
+		}
+	}()
+	<-ready
+	return c
+}
+
+// wait returns once the consumer has drained the ring
+func (c *threadConsumer) wait() { <-c.done }
+
+// budget is the consumer thread's CPU over the window, for events delivered
+func (c *threadConsumer) budget(events int64) CPUBudget { return NewCPUBudget(c.start, c.end, events) }
+
+// syscallDurations draws syscall durations from a log-normal distribution,
+// whose long tail is what a latency tracer is after
+type syscallDurations struct {
+	median float64 // ns
+	sigma  float64
+	rng    randomPayload
+}
+
+// next draws a duration in ns
+func (d *syscallDurations) next() uint64 { return d.draw(&d.rng) }
+
+// at returns the duration of the syscall identified by key, always the
+// same for the same key, so pairs can be checked after the fact
+func (d *syscallDurations) at(key uint64) uint64 {
+	// splitmix64, so neighbouring keys draw unrelated durations
+	key += 0x9e3779b97f4a7c15
+	key = (key ^ key>>30) * 0xbf58476d1ce4e5b9
+	key = (key ^ key>>27) * 0x94d049bb133111eb
+	rng := randomPayload{state: (key ^ key>>31) | 1}
+	return d.draw(&rng)
+}
+
+// draw draws a duration in ns from rng with the Box-Muller transform
+func (d *syscallDurations) draw(rng *randomPayload) uint64 {
+	u1 := (float64(rng.next()>>11) + 1) / (1 << 53)
+	u2 := float64(rng.next()>>11) / (1 << 53)
+	z := math.Sqrt(-2*math.Log(u1)) * math.Cos(2*math.Pi*u2)
+	return uint64(d.median * math.Exp(d.sigma*z))
+}
+
+// above returns the share of the distribution at or above ns
+func (d *syscallDurations) above(ns int64) float64 {
+	if ns <= 0 {
+		return 1
+	}
+	return 0.5 * math.Erfc(math.Log(float64(ns)/d.median)/(d.sigma*math.Sqrt2))
+}
+
+// LatencyFilterBenchmark traces syscall latency the way production tools
+// do: an entry program stores a start timestamp per thread in a hash map,
+// the exit program looks it up, computes the duration and emits a record
+// only when it reaches the threshold. Syscalls are simulated at a fixed
+// rate with durations from a log-normal distribution: the exit program
+// sees the clock advanced by the drawn duration. Each threshold runs in
+// turn, so the drop in event volume and consumer load can be compared
+// with the unfiltered run.
+type LatencyFilterBenchmark struct {
+	duration   time.Duration
+	thresholds []time.Duration
+	producers  int
+	threads    int // Thread IDs per producer, each with a syscall in flight
+	rate       int // Syscalls per second over all producers; 0 runs flat out
+	median     time.Duration
+	sigma      float64
+	ringSize   int
+	seed       uint64
+	maxSamples int
+	verbose    bool
+}
+
+// runOne traces with one threshold
+func (b *LatencyFilterBenchmark) runOne(ctx context.Context, threshold time.Duration) (*BenchmarkResult, error) {
+	ring := newMPSCRing(b.ringSize)
+	starts := newLatencyStartMap(0)
+
+	r := &BenchmarkResult{
+		Name:           "Latency Threshold Filter",
+		Language:       "Go",
+		ProgramType:    "tracepoint",
+		Tracepoint:     "raw_syscalls:sys_enter+sys_exit",
+		DataMechanism:  "ring_buffer",
+		ReaderStrategy: fmt.Sprintf("%s/threshold=%s/producers=%d", probeBackendSim, threshold, b.producers),
+		Host:           CollectHostInfo(),
+		// Syscalls and their durations are drawn, not traced
+		Errors: []string{"no BPF backend: sys_enter/sys_exit programs simulated in userspace"},
+	}
+	benchLog(ctx).Info("Running", "threshold", threshold, "producers", b.producers, "rate", b.rate, "duration", b.duration)
+
+	var stop, producersDone atomic.Bool
+	var syscalls, emitted, filtered, failed atomic.Int64
+	var programTime atomic.Int64
+	pid := uint32(os.Getpid())
+	thresholdNs := uint64(threshold.Nanoseconds())
+	perProducer := float64(b.rate) / float64(b.producers)
+
+	var consumed int64
+	delivery := make([]uint64, 0, min(b.maxSamples, 1024))
+	durations := make([]uint64, 0, min(b.maxSamples, 1024))
+	consumer := startThreadConsumer(ring, &stop, &producersDone, func(e Event) {
+		now := uint64(time.Now().UnixNano())
+		if len(delivery) < b.maxSamples {
+			if now >= e.Timestamp {
+				delivery = append(delivery, now-e.Timestamp)
+			}
+			durations = append(durations, uint64(e.Data))
+		}
+		consumed++
+	}, nil)
+
+	startUsage, _ := TakeResourceSnapshot()
+	r.StartTime = time.Now()
+
+	var wg sync.WaitGroup
+	for cpu := 0; cpu < b.producers; cpu++ {
+		wg.Add(1)
+		go func(cpu int) {
+			defer wg.Done()
+			dist := &syscallDurations{median: float64(b.median.Nanoseconds()), sigma: b.sigma,
+				rng: randomPayload{state: (b.seed + uint64(cpu)*0x9e3779b97f4a7c15) | 1}}
+			base := uint32(cpu * b.threads)
+			var traced, kept, dropped, full int64
+			// Each thread exits its previous syscall and enters the next, so
+			// every thread keeps a start in the map
+			trace := func(tid uint32) {
+				// sys_exit, whose clock reads the start plus a drawn duration
+				_, ok := starts.take(tid)
+				// sys_enter of the next syscall
+				starts.update(tid, uint64(time.Now().UnixNano()))
+				if !ok {
+					return // First syscall of the thread
+				}
+				traced++
+				d := dist.next()
+				if d < thresholdNs {
+					dropped++
+					return
+				}
+				pos, ok := ring.reserve()
+				if !ok {
+					full++
+					return
+				}
+				ring.submit(pos, Event{
+					Timestamp: uint64(time.Now().UnixNano()),
+					PID:       pid,
+					CPU:       uint32(cpu),
+					EventType: eventTypeTracepoint,
+					Data:      uint32(min(d, math.MaxUint32)),
+				})
+				kept++
+			}
+			spent := runPaced(&stop, perProducer, func(n int64) { trace(base + uint32(n%int64(b.threads))) })
+			syscalls.Add(traced)
+			emitted.Add(kept)
+			filtered.Add(dropped)
+			failed.Add(full)
+			programTime.Add(int64(spent))
+		}(cpu)
+	}
+
+	timer := time.NewTimer(b.duration)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+		r.Quality.Flag(QualityInterrupted)
+	}
+	stop.Store(true)
+	r.EndTime = time.Now()
+	endUsage, _ := TakeResourceSnapshot()
+	wg.Wait()
+	producersDone.Store(true)
+	consumer.wait()
+	drainTime := time.Since(r.EndTime)
+
+	wall := r.EndTime.Sub(r.StartTime)
+	r.Duration = wall.Seconds()
+	r.EventCount = consumed
+	r.RecordDrops(DropCounts{ReserveFailed: failed.Load()})
+	r.recordTeardown(emitted.Load()+failed.Load(), consumer.postWindow, drainTime)
+	if r.Duration > 0 {
+		r.Throughput = float64(consumed) / r.Duration
+	}
+	r.Latency = computeLatencyStats(delivery, DefaultQuantiles)
+	r.CPUBudget = NewCPUBudget(startUsage, endUsage, consumed)
+	r.CPUUsage = r.CPUBudget.CPUPercent(wall)
+	r.MemoryUsage = uint64(len(ring.records)) * uint64(unsafe.Sizeof(Event{}))
+
+	consumerCPU := consumer.budget(consumed)
+	dist := &syscallDurations{median: float64(b.median.Nanoseconds()), sigma: b.sigma}
+	s := &LatencyFilterStats{
+		ThresholdNs:   threshold.Nanoseconds(),
+		Syscalls:      syscalls.Load(),
+		Emitted:       emitted.Load(),
+		Filtered:      filtered.Load(),
+		ExpectedRatio: dist.above(threshold.Nanoseconds()),
+		ConsumerCPU:   consumerCPU.CPUPercent(wall),
+	}
+	if s.Syscalls > 0 {
+		s.EmitRatio = float64(s.Emitted) / float64(s.Syscalls)
+		s.ProgramNs = float64(programTime.Load()) / float64(s.Syscalls)
+		s.ConsumerNsPerSys = (consumerCPU.UserTimeUs + consumerCPU.SystemTimeUs) * 1000 / float64(s.Syscalls)
+	}
+	emittedDurations := computeLatencyStats(durations, DefaultQuantiles)
+	s.EmittedP50Ns, _ = emittedDurations.Percentile(0.5)
+	s.EmittedP99Ns, _ = emittedDurations.Percentile(0.99)
+	r.LatencyFilter = s
+	r.Operations = []OperationResult{
+		NewOperationResult("syscall", s.Syscalls, wall),
+		NewOperationResult("emit", s.Emitted, wall),
+		NewOperationResult("filtered", s.Filtered, wall),
+	}
+	// Exits that passed the filter but found the ring full count too
+	if passed := float64(s.Emitted+failed.Load()) / float64(max(s.Syscalls, 1)); s.Syscalls > 0 &&
+		math.Abs(passed-s.ExpectedRatio) > 0.01+0.2*s.ExpectedRatio {
+		r.Errors = append(r.Errors, fmt.Sprintf("%.3f%% of syscalls passed the filter, %.3f%% expected at threshold %s",
+			passed*100, s.ExpectedRatio*100, threshold))
+	}
+	return r, nil
+}
+
+// Run traces with every threshold in turn, relating each one's event
+// volume to the unfiltered run's
+func (b *LatencyFilterBenchmark) Run(ctx context.Context) ([]*BenchmarkResult, error) {
+	if b.verbose {
+		PrintBenchmarkHeader("In-Kernel Latency Threshold Filter Benchmark (Go)")
+	}
+	var results []*BenchmarkResult
+	var allRate float64
+	for _, threshold := range b.thresholds {
+		if ctx.Err() != nil {
+			break
+		}
+		r, err := b.runOne(ctx, threshold)
+		if err != nil {
+			return nil, err
+		}
+		if threshold == 0 && r.Duration > 0 {
+			allRate = float64(r.LatencyFilter.Emitted) / r.Duration
+		}
+		results = append(results, r)
+	}
+	if allRate > 0 {
+		for _, r := range results {
+			if r.Duration > 0 {
+				r.LatencyFilter.VolumeVsAll = float64(r.LatencyFilter.Emitted) / r.Duration / allRate
+			}
+		}
+	}
+	return results, nil
+}
+
+// formatLatencyFilter renders the threshold filter's counts, if any
+func (r *BenchmarkResult) formatLatencyFilter() string {
+	s := r.LatencyFilter
+	if s == nil {
+		return ""
+	}
+	volume := ""
+	if s.VolumeVsAll > 0 {
+		volume = fmt.Sprintf(", %.2f%% of the unfiltered volume", s.VolumeVsAll*100)
+	}
+	return fmt.Sprintf("Threshold:       %s: %d of %d syscalls emitted (%.3f%%, %.3f%% expected)%s\n",
+		time.Duration(s.ThresholdNs), s.Emitted, s.Syscalls, s.EmitRatio*100, s.ExpectedRatio*100, volume) +
+		fmt.Sprintf("                 programs %.0f ns/syscall, consumer %.1f%% CPU, %.1f ns/syscall; emitted p50 %s, p99 %s\n",
+			s.ProgramNs, s.ConsumerCPU, s.ConsumerNsPerSys, r.LatencyUnit.Format(float64(s.EmittedP50Ns)), r.LatencyUnit.Format(float64(s.EmittedP99Ns)))
+}
+
+// parseThresholds parses a comma-separated list of durations, returned in
+// ascending order
+func parseThresholds(s string) ([]time.Duration, error) {
+	var list []time.Duration
+	for _, field := range splitList(s) {
+		d, err := time.ParseDuration(field)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid threshold %q (want a duration such as 100us)", field)
+		}
+		list = append(list, d)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("-thresholds lists no thresholds")
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list, nil
+}
+
+// runLatencyFilterBenchmark is the entry point of the latency-threshold
+// subcommand
+func runLatencyFilterBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("latency-threshold", flag.ExitOnError)
+	common := addBenchFlags(fs, "latency_threshold_result.json", true)
+	thresholds := fs.String("thresholds", "0,10us,100us,1ms", "Comma-separated emit thresholds; 0 emits every exit")
+	producers := fs.Int("producers", max(runtime.NumCPU()-1, 1), "Producer CPUs, one goroutine each")
+	threads := fs.Int("threads", 64, "Threads per producer CPU, each with a syscall in flight in the start map")
+	rate := fs.Int("rate", 200000, "Syscalls per second over all producers (0 for flat out)")
+	median := fs.Duration("median", 5*time.Microsecond, "Median simulated syscall duration")
+	sigma := fs.Float64("sigma", 1.5, "Log-normal shape of the durations; larger values lengthen the tail")
+	ringSize := fs.Int("ring", 4096, "Records in the ring buffer (power of two)")
+	seed := fs.Uint64("seed", 1, "Duration generator seed")
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+	list, err := parseThresholds(*thresholds)
+	if err != nil {
+		return nil, opts, err
+	}
+	switch {
+	case *producers <= 0:
+		return nil, opts, fmt.Errorf("-producers must be positive")
+	case *threads <= 0:
+		return nil, opts, fmt.Errorf("-threads must be positive")
+	case *rate < 0:
+		return nil, opts, fmt.Errorf("-rate must not be negative")
+	case *median <= 0:
+		return nil, opts, fmt.Errorf("-median must be positive")
+	case *sigma < 0:
+		return nil, opts, fmt.Errorf("-sigma must not be negative")
+	case *ringSize <= 0 || *ringSize&(*ringSize-1) != 0:
+		return nil, opts, fmt.Errorf("-ring must be a power of two")
+	}
+
+	bench := &LatencyFilterBenchmark{
+		duration:   opts.Duration,
+		thresholds: list,
+		producers:  *producers,
+		threads:    *threads,
+		rate:       *rate,
+		median:     *median,
+		sigma:      *sigma,
+		ringSize:   *ringSize,
+		seed:       *seed,
+		maxSamples: 100000,
+		verbose:    opts.Verbose,
+	}
+	results, err := bench.Run(ctx)
+	if err != nil {
+		return nil, opts, err
+	}
+
+	PrintBenchmarkHeader(fmt.Sprintf("Latency threshold filtering, median %s, sigma %.2f", *median, *sigma))
+	fmt.Printf("%-10s %12s %12s %9s %12s %10s %14s\n", "Threshold", "Syscalls", "Emitted", "Emitted%", "Volume", "Consumer", "Consumer/sys")
+	for _, r := range results {
+		s := r.LatencyFilter
+		volume := "-"
+		if s.VolumeVsAll > 0 {
+			volume = fmt.Sprintf("%.2f%%", s.VolumeVsAll*100)
+		}
+		fmt.Printf("%-10s %12d %12d %8.3f%% %12s %9.1f%% %11.1f ns\n", time.Duration(s.ThresholdNs),
+			s.Syscalls, s.Emitted, s.EmitRatio*100, volume, s.ConsumerCPU, s.ConsumerNsPerSys)
+	}
+	return results, opts, nil
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math/bits"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// maxProgramInsns is BPF_COMPLEXITY_LIMIT_INSNS, the longest program a
+// privileged loader may load
+const maxProgramInsns = 1000000
+
+// generateProgram returns a straight-line program of n instructions: r0 =
+// 0, then r0 += 1; r1 = r0; r0 += r1 repeated, then exit. Every
+// instruction is verified and JITed once, so the load cost follows n.
+func generateProgram(n int) []uint64 {
+	insns := make([]uint64, n)
+	insns[0] = 0xb7 // BPF_ALU64|BPF_MOV|BPF_K r0, 0
+	body := [3]uint64{
+		0x07 | 1<<32,   // BPF_ALU64|BPF_ADD|BPF_K r0, 1
+		0xbf | 0x01<<8, // BPF_ALU64|BPF_MOV|BPF_X r1, r0
+		0x0f | 0x10<<8, // BPF_ALU64|BPF_ADD|BPF_X r0, r1
+	}
+	for i := 1; i < n-1; i++ {
+		insns[i] = body[(i-1)%len(body)]
+	}
+	insns[n-1] = 0x95 // BPF_JMP|BPF_EXIT
+	return insns
+}
+
+// loadTiming is one program load, split into its phases where known
+type loadTiming struct {
+	total, verify, jit time.Duration
+	split              bool // verify and jit are known
+	verified           int64
+	xlated, jited      int // Bytes
+}
+
+// programLoader loads a program and reports where the time went
+type programLoader interface {
+	Load(insns []uint64) (loadTiming, error)
+	Backend() string
+}
+
+// bpfLoader loads socket filter programs with bpf(2). The verifier reports
+// its own time in the BPF_LOG_STATS log; the kernel does not time the JIT,
+// so jit is the rest of the load, which JIT compilation dominates.
+type bpfLoader struct {
+	log []byte
+}
+
+func (l *bpfLoader) Load(insns []uint64) (loadTiming, error) {
+	for i := range l.log {
+		l.log[i] = 0
+	}
+	start := time.Now()
+	fd, err := loadInsns(progLoadAttr{progType: bpfProgTypeSocketFilter}, insns, l.log)
+	t := loadTiming{total: time.Since(start)}
+	if err != nil {
+		return t, err
+	}
+	defer syscall.Close(fd)
+
+	t.verify, t.verified, t.split = parseVerifierStats(l.log)
+	if t.split {
+		t.jit = t.total - t.verify
+		if t.jit < 0 {
+			t.jit = 0
+		}
+	}
+	info, err := progInfo(fd)
+	if err != nil {
+		return t, err
+	}
+	t.jited = int(binary.LittleEndian.Uint32(info[16:]))
+	t.xlated = int(binary.LittleEndian.Uint32(info[20:]))
+	if verified := binary.LittleEndian.Uint32(info[216:]); verified > 0 {
+		t.verified = int64(verified) // bpf_prog_info.verified_insns, 5.16+
+	}
+	return t, nil
+}
+
+func (l *bpfLoader) Backend() string { return probeBackendBPF }
+
+// parseVerifierStats reads the verification time and processed
+// instruction count from a BPF_LOG_STATS log
+func parseVerifierStats(log []byte) (verify time.Duration, processed int64, ok bool) {
+	if end := bytes.IndexByte(log, 0); end >= 0 {
+		log = log[:end]
+	}
+	for _, line := range strings.Split(string(log), "\n") {
+		var n int64
+		if _, err := fmt.Sscanf(line, "verification time %d usec", &n); err == nil {
+			verify, ok = time.Duration(n)*time.Microsecond, true
+		} else if _, err := fmt.Sscanf(line, "processed %d insns", &n); err == nil {
+			processed = n
+		}
+	}
+	return verify, processed, ok
+}
+
+// progInfo returns the leading bytes of the program's bpf_prog_info, up to
+// and including verified_insns
+func progInfo(fd int) ([]byte, error) {
+	info := make([]byte, 220)
+	attr := struct {
+		fd      uint32
+		infoLen uint32
+		info    uint64
+	}{uint32(fd), uint32(len(info)), uint64(uintptr(unsafe.Pointer(&info[0])))}
+	_, err := bpfSyscall(bpfObjGetInfoByFD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(info)
+	if err != nil {
+		return nil, fmt.Errorf("program info: %w", err)
+	}
+	return info, nil
+}
+
+// simRegister is what the simulated verifier knows about a register
+type simRegister struct {
+	init     bool
+	min, max uint64
+}
+
+// simulatedLoader verifies and JITs in userspace: it tracks the bounds
+// of every register through the program, as the verifier does for
+// scalars, then emits x86-64 code for each instruction
+type simulatedLoader struct {
+	code []byte
+}
+
+// simX86Reg maps BPF registers to their x86-64 register numbers, as the
+// kernel's JIT does
+var simX86Reg = [11]byte{0, 7, 6, 2, 1, 0, 3, 5, 6, 7, 5}
+
+func (l *simulatedLoader) Load(insns []uint64) (loadTiming, error) {
+	var t loadTiming
+	start := time.Now()
+
+	var regs [11]simRegister
+	regs[1].init = true // Context pointer
+	for i, insn := range insns {
+		op, dst, src := byte(insn), insn>>8&0xf, insn>>12&0xf
+		imm := uint64(int64(int32(insn >> 32)))
+		if dst > 10 || src > 10 {
+			return t, fmt.Errorf("insn %d: invalid register", i)
+		}
+		switch op {
+		case 0xb7:
+			regs[dst] = simRegister{true, imm, imm}
+		case 0xbf:
+			if !regs[src].init {
+				return t, fmt.Errorf("insn %d: R%d !read_ok", i, src)
+			}
+			regs[dst] = regs[src]
+		case 0x07, 0x0f:
+			add := simRegister{true, imm, imm}
+			if op == 0x0f {
+				add = regs[src]
+			}
+			if !regs[dst].init || !add.init {
+				return t, fmt.Errorf("insn %d: R%d !read_ok", i, dst)
+			}
+			r := &regs[dst]
+			lo, c1 := bits.Add64(r.min, add.min, 0)
+			hi, c2 := bits.Add64(r.max, add.max, 0)
+			if c1|c2 != 0 {
+				lo, hi = 0, ^uint64(0) // May overflow: unbounded
+			}
+			r.min, r.max = lo, hi
+		case 0x95:
+			if !regs[0].init {
+				return t, fmt.Errorf("insn %d: R0 !read_ok", i)
+			}
+		default:
+			return t, fmt.Errorf("insn %d: unknown opcode %#02x", i, op)
+		}
+		t.verified++
+	}
+	t.verify = time.Since(start)
+
+	jitStart := time.Now()
+	code := l.code[:0]
+	for _, insn := range insns {
+		op, dst, src := byte(insn), simX86Reg[insn>>8&0xf], simX86Reg[insn>>12&0xf]
+		switch op {
+		case 0xb7: // mov dst, imm32
+			code = append(code, 0x48, 0xc7, 0xc0|dst)
+			code = binary.LittleEndian.AppendUint32(code, uint32(insn>>32))
+		case 0x07: // add dst, imm8
+			code = append(code, 0x48, 0x83, 0xc0|dst, byte(insn>>32))
+		case 0xbf: // mov dst, src
+			code = append(code, 0x48, 0x89, 0xc0|src<<3|dst)
+		case 0x0f: // add dst, src
+			code = append(code, 0x48, 0x01, 0xc0|src<<3|dst)
+		case 0x95: // leave; ret
+			code = append(code, 0xc9, 0xc3)
+		}
+	}
+	l.code = code
+	t.jit = time.Since(jitStart)
+
+	t.total = time.Since(start)
+	t.split = true
+	t.xlated, t.jited = 8*len(insns), len(code)
+	return t, nil
+}
+
+func (l *simulatedLoader) Backend() string { return probeBackendSim }
+
+// newProgramLoader selects a loader backend; auto tries one load with
+// bpf(2) and falls back to simulation when the kernel or privileges do
+// not allow it
+func newProgramLoader(backend string) (programLoader, error) {
+	switch backend {
+	case probeBackendSim:
+		return &simulatedLoader{}, nil
+	case probeBackendBPF, probeBackendAuto:
+		l := &bpfLoader{log: make([]byte, 4096)}
+		_, err := l.Load(emptyProgram[:])
+		if err == nil {
+			return l, nil
+		}
+		if backend == probeBackendBPF {
+			return nil, err
+		}
+		return &simulatedLoader{}, nil
+	}
+	return nil, fmt.Errorf("unknown loader backend %q (want auto, bpf or sim)", backend)
+}
+
+// ProgramStats describe the program a loader result loaded
+type ProgramStats struct {
+	Insns         int   // Instructions loaded
+	VerifiedInsns int64 // Instructions the verifier processed
+	XlatedBytes   int   // After the verifier's rewrites
+	JitedBytes    int   // Native code; 0 with the JIT disabled
+}
+
+// formatProgram renders the loaded program's size, if the result has one
+func (r *BenchmarkResult) formatProgram() string {
+	p := r.Program
+	if p == nil {
+		return ""
+	}
+	return fmt.Sprintf("Program:         %d insns, %d verified, %d bytes xlated, %d bytes jited\n",
+		p.Insns, p.VerifiedInsns, p.XlatedBytes, p.JitedBytes)
+}
+
+// LoaderBenchmark measures program load time against program size
+type LoaderBenchmark struct {
+	sizes   []int
+	loads   int
+	loader  programLoader
+	verbose bool
+}
+
+// NewLoaderBenchmark creates a new loader benchmark instance
+func NewLoaderBenchmark(sizes []int, loads int, loader programLoader, verbose bool) *LoaderBenchmark {
+	return &LoaderBenchmark{sizes: sizes, loads: loads, loader: loader, verbose: verbose}
+}
+
+// Run executes the benchmark, producing one result per program size
+func (b *LoaderBenchmark) Run(ctx context.Context) ([]*BenchmarkResult, error) {
+	if b.verbose {
+		PrintBenchmarkHeader("Program Load Benchmark (Go)")
+	}
+	host := CollectHostInfo()
+	var results []*BenchmarkResult
+	for _, n := range b.sizes {
+		benchLog(ctx).Info("Loading programs", "instructions", n, "backend", b.loader.Backend())
+		r, err := b.runOne(n)
+		if err != nil {
+			return results, fmt.Errorf("%d insns: %w", n, err)
+		}
+		r.Host = host
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// runOne loads the n-instruction program b.loads times, after one
+// untimed load that also records the program's size
+func (b *LoaderBenchmark) runOne(n int) (*BenchmarkResult, error) {
+	insns := generateProgram(n)
+	first, err := b.loader.Load(insns)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &BenchmarkResult{
+		Name:           fmt.Sprintf("Program Load (%d insns)", n),
+		Language:       "Go",
+		ProgramType:    "socket_filter",
+		DataMechanism:  "none",
+		ReaderStrategy: b.loader.Backend(),
+		Errors:         []string{},
+	}
+	r.Program = &ProgramStats{Insns: n, VerifiedInsns: first.verified, XlatedBytes: first.xlated, JitedBytes: first.jited}
+	if b.loader.Backend() == probeBackendSim {
+		r.Errors = append(r.Errors, "bpf(2) program loads unavailable: verifier and JIT simulated in userspace")
+	}
+
+	startUsage, _ := TakeResourceSnapshot()
+	r.StartTime = time.Now()
+	loadNs := make([]uint64, 0, b.loads)
+	verifyNs := make([]uint64, 0, b.loads)
+	jitNs := make([]uint64, 0, b.loads)
+	var loadTotal, verifyTotal, jitTotal time.Duration
+	split := true
+	for i := 0; i < b.loads; i++ {
+		t, err := b.loader.Load(insns)
+		if err != nil {
+			return nil, err
+		}
+		loadTotal += t.total
+		loadNs = append(loadNs, uint64(t.total))
+		split = split && t.split
+		verifyTotal += t.verify
+		verifyNs = append(verifyNs, uint64(t.verify))
+		jitTotal += t.jit
+		jitNs = append(jitNs, uint64(t.jit))
+	}
+	r.EndTime = time.Now()
+	endUsage, _ := TakeResourceSnapshot()
+
+	load := NewOperationResult("load", int64(b.loads), loadTotal)
+	r.Latency = computeLatencyStats(loadNs, DefaultQuantiles)
+	loadStats := r.Latency
+	load.Latency = &loadStats
+	r.Operations = []OperationResult{load}
+	if split {
+		verify := NewOperationResult("verify", int64(b.loads), verifyTotal)
+		verifyStats := computeLatencyStats(verifyNs, DefaultQuantiles)
+		verify.Latency = &verifyStats
+		jit := NewOperationResult("jit", int64(b.loads), jitTotal)
+		jitStats := computeLatencyStats(jitNs, DefaultQuantiles)
+		jit.Latency = &jitStats
+		r.Operations = append(r.Operations, verify, jit)
+	} else {
+		r.Errors = append(r.Errors, "verifier stats missing from the log: load time not split into verify and jit")
+	}
+	if first.jited == 0 {
+		r.Errors = append(r.Errors, "JIT disabled (net.core.bpf_jit_enable=0): jit is the rest of the load")
+	}
+
+	r.Duration = loadTotal.Seconds()
+	r.EventCount = int64(b.loads)
+	if r.Duration > 0 {
+		r.Throughput = float64(r.EventCount) / r.Duration
+	}
+	r.CPUBudget = NewCPUBudget(startUsage, endUsage, r.EventCount)
+	r.CPUUsage = r.CPUBudget.CPUPercent(endUsage.Wall.Sub(startUsage.Wall))
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	r.MemoryUsage = ms.Alloc
+
+	return r, nil
+}
+
+// printLoadSweep prints mean load, verify and JIT time against program
+// size for the results of a loader run
+func printLoadSweep(results []*BenchmarkResult) {
+	PrintBenchmarkHeader("Load time by program size")
+	fmt.Printf("%10s %10s %12s %12s %12s %10s\n", "Insns", "Verified", "Load us", "Verify us", "JIT us", "ns/insn")
+	for _, r := range results {
+		verify, jit := "-", "-"
+		for _, op := range r.Operations {
+			switch op.Name {
+			case "verify":
+				verify = fmt.Sprintf("%.1f", op.AvgNs/1e3)
+			case "jit":
+				jit = fmt.Sprintf("%.1f", op.AvgNs/1e3)
+			}
+		}
+		p := r.Program
+		fmt.Printf("%10d %10d %12.1f %12s %12s %10.1f\n",
+			p.Insns, p.VerifiedInsns, r.Operations[0].AvgNs/1e3, verify, jit, r.Operations[0].AvgNs/float64(p.Insns))
+	}
+}
+
+// runLoaderBenchmark is the entry point of the loader subcommand
+func runLoaderBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("loader", flag.ExitOnError)
+	common := addBenchFlags(fs, "loader_result.json", false)
+	sizes := fs.String("insns", "16,256,4096,65536", "Comma-separated program sizes in instructions")
+	loads := fs.Int("n", 20, "Timed loads per program size")
+	backend := fs.String("backend", probeBackendAuto, "Loader backend (auto, bpf, sim)")
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+	if *loads <= 0 {
+		return nil, opts, fmt.Errorf("-n must be positive")
+	}
+	var counts []int
+	for _, field := range splitList(*sizes) {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 2 || n > maxProgramInsns {
+			return nil, opts, fmt.Errorf("invalid program size %q (want 2 to %d instructions)", field, maxProgramInsns)
+		}
+		counts = append(counts, n)
+	}
+	if len(counts) == 0 {
+		return nil, opts, fmt.Errorf("-insns gives no program sizes")
+	}
+
+	loader, err := newProgramLoader(*backend)
+	if err != nil {
+		return nil, opts, err
+	}
+	results, err := NewLoaderBenchmark(counts, *loads, loader, opts.Verbose).Run(ctx)
+	if err != nil {
+		return nil, opts, err
+	}
+	printLoadSweep(results)
+	return results, opts, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// -log-format values
+const (
+	logFormatText = "text" // Status lines on stdout, warnings on stderr
+	logFormatJSON = "json" // One JSON object per record on stderr
+)
+
+// logLevel is the level of every handler. Without -log-level it follows
+// -v: status lines are info records, so quiet runs only log warnings.
+var logLevel slog.LevelVar
+
+// logMu serialises writes of the text handlers, which parallel suite
+// benchmarks share
+var logMu sync.Mutex
+
+func init() {
+	logLevel.Set(slog.LevelWarn)
+	slog.SetDefault(slog.New(&textLogHandler{out: os.Stdout, errOut: os.Stderr, level: &logLevel}))
+}
+
+// configureLogging installs the handler for -log-format and sets the level
+// from -log-level, or from -v when that is empty. It reports whether info
+// records are logged, which is what -v used to mean.
+func configureLogging(level, format string, verbose bool) (bool, error) {
+	l := slog.LevelWarn
+	if verbose {
+		l = slog.LevelInfo
+	}
+	if level != "" {
+		if err := l.UnmarshalText([]byte(level)); err != nil {
+			return verbose, fmt.Errorf("invalid -log-level %q (want debug, info, warn or error)", level)
+		}
+	}
+	var h slog.Handler
+	switch format {
+	case logFormatText:
+		h = &textLogHandler{out: os.Stdout, errOut: os.Stderr, level: &logLevel}
+	case logFormatJSON:
+		h = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: &logLevel})
+	default:
+		return verbose, fmt.Errorf("invalid -log-format %q (want text or json)", format)
+	}
+	logLevel.Set(l)
+	slog.SetDefault(slog.New(h))
+	return l <= slog.LevelInfo, nil
+}
+
+// benchmarkKey is the context key of the benchmark name
+type benchmarkKey struct{}
+
+// withBenchmark tags ctx with the name of the benchmark running under it
+func withBenchmark(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, benchmarkKey{}, name)
+}
+
+// benchLog returns the logger of the benchmark running under ctx, whose
+// records carry its name. It is looked up on each call, so it follows the
+// handler the benchmark's own flags installed.
+func benchLog(ctx context.Context) *slog.Logger {
+	if name, ok := ctx.Value(benchmarkKey{}).(string); ok {
+		return slog.Default().With("benchmark", name)
+	}
+	return slog.Default()
+}
+
+// textLogHandler writes records the way the harness always printed status:
+// "[15:04:05] ringbuf: Running duration=10s" on stdout, and warnings and
+// errors without a timestamp on stderr. The benchmark attribute becomes the
+// prefix; the others follow the message as key=value.
+type textLogHandler struct {
+	out, errOut io.Writer
+	level       slog.Leveler
+	benchmark   string
+	attrs       string // Formatted attributes added by WithAttrs
+	group       string // Key prefix from WithGroup, ending in a dot
+}
+
+func (h *textLogHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *textLogHandler) Handle(_ context.Context, r slog.Record) error {
+	var sb strings.Builder
+	out := h.out
+	switch {
+	case r.Level >= slog.LevelError:
+		out = h.errOut
+		sb.WriteString("error: ")
+	case r.Level >= slog.LevelWarn:
+		out = h.errOut
+		sb.WriteString("warning: ")
+	default:
+		fmt.Fprintf(&sb, "[%s] ", r.Time.Format("15:04:05"))
+		if r.Level < slog.LevelInfo {
+			sb.WriteString("debug: ")
+		}
+	}
+	benchmark, attrs := h.benchmark, h.attrs
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "benchmark" && h.group == "" {
+			benchmark = a.Value.String()
+		} else {
+			attrs += formatLogAttr(h.group, a)
+		}
+		return true
+	})
+	if benchmark != "" {
+		sb.WriteString(benchmark + ": ")
+	}
+	sb.WriteString(r.Message)
+	sb.WriteString(attrs)
+	sb.WriteByte('\n')
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	_, err := io.WriteString(out, sb.String())
+	return err
+}
+
+func (h *textLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	for _, a := range attrs {
+		if a.Key == "benchmark" && h.group == "" {
+			c.benchmark = a.Value.String()
+		} else {
+			c.attrs += formatLogAttr(h.group, a)
+		}
+	}
+	return &c
+}
+
+func (h *textLogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	c := *h
+	c.group += name + "."
+	return &c
+}
+
+// formatLogAttr renders a as " key=value", flattening groups and quoting
+// values that would not read back as one field
+func formatLogAttr(prefix string, a slog.Attr) string {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		var s string
+		for _, ga := range v.Group() {
+			s += formatLogAttr(prefix, ga)
+		}
+		return s
+	}
+	if a.Equal(slog.Attr{}) {
+		return ""
+	}
+	text := v.String()
+	if text == "" || strings.ContainsAny(text, " \t\n\"=") {
+		text = strconv.Quote(text)
+	}
+	return " " + prefix + a.Key + "=" + text
+}
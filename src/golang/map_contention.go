@@ -0,0 +1,519 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Program-side map operations of the map-contention benchmark
+const (
+	mapOpUpdate    = "update"    // bpf_map_update_elem, under the bucket lock for both types
+	mapOpIncrement = "increment" // bpf_map_lookup_elem and an add in place, lock free
+)
+
+var allMapOps = []string{mapOpUpdate, mapOpIncrement}
+
+// BPF helpers called by the contention programs
+const (
+	bpfFuncMapLookupElem = 1
+	bpfFuncMapUpdateElem = 2
+	bpfFuncGetPrandomU32 = 7
+)
+
+// contentionProgram returns a raw tracepoint program that applies op to a
+// random one of keys entries of the map mapFD, as a counter updated on
+// every event of a storm would be. Increments of a hash map value are
+// atomic, since every CPU shares it; each CPU owns its per-CPU value.
+func contentionProgram(mapType, op string, mapFD, keys int) []uint64 {
+	p := []uint64{
+		bpfInsn(0x85, 0, 0, 0, bpfFuncGetPrandomU32),
+		bpfInsn(0x94, 0, 0, 0, int32(keys)), // w0 %= keys
+		bpfInsn(0x63, 10, 0, -4, 0),         // *(u32 *)(fp - 4) = r0
+	}
+	loadMap := []uint64{bpfInsn(0x18, 1, bpfPseudoMapFD, 0, int32(mapFD)), 0}  // r1 = map
+	keyPtr := []uint64{bpfInsn(0xbf, 2, 10, 0, 0), bpfInsn(0x07, 2, 0, 0, -4)} // r2 = fp - 4
+	switch op {
+	case mapOpUpdate:
+		p = append(p, bpfInsn(0xb7, 1, 0, 0, 1), bpfInsn(0x7b, 10, 1, -16, 0)) // *(u64 *)(fp - 16) = 1
+		p = append(p, loadMap...)
+		p = append(p, keyPtr...)
+		p = append(p,
+			bpfInsn(0xbf, 3, 10, 0, 0), bpfInsn(0x07, 3, 0, 0, -16), // r3 = fp - 16
+			bpfInsn(0xb7, 4, 0, 0, 0), // BPF_ANY
+			bpfInsn(0x85, 0, 0, 0, bpfFuncMapUpdateElem))
+	case mapOpIncrement:
+		p = append(p, loadMap...)
+		p = append(p, keyPtr...)
+		p = append(p, bpfInsn(0x85, 0, 0, 0, bpfFuncMapLookupElem))
+		add := []uint64{
+			bpfInsn(0xb7, 1, 0, 0, 1),
+			bpfInsn(0xdb, 0, 1, 0, 0), // lock *(u64 *)(r0 + 0) += r1
+		}
+		if mapType == mapTypePerCPUHash {
+			add = []uint64{
+				bpfInsn(0x79, 1, 0, 0, 0), // r1 = *(u64 *)(r0 + 0)
+				bpfInsn(0x07, 1, 0, 0, 1),
+				bpfInsn(0x7b, 0, 1, 0, 0), // *(u64 *)(r0 + 0) = r1
+			}
+		}
+		p = append(p, bpfInsn(0x15, 0, 0, int16(len(add)), 0)) // if r0 == 0 skip the add
+		p = append(p, add...)
+	}
+	return append(p, insnReturn0, insnExit)
+}
+
+// possibleCPUs returns the number of possible CPUs, which sizes the
+// values of per-CPU maps in userspace
+func possibleCPUs() int {
+	data, err := os.ReadFile("/sys/devices/system/cpu/possible")
+	if err != nil {
+		return runtime.NumCPU()
+	}
+	cpus, err := ParseCPUList(strings.TrimSpace(string(data)))
+	if err != nil || len(cpus) == 0 {
+		return runtime.NumCPU()
+	}
+	return cpus[len(cpus)-1] + 1
+}
+
+// contendedMap is a map type under an event storm. Producers drive it
+// until stop; events are its updates, counted by each producer where the
+// backend can, and in total by stats.
+type contendedMap interface {
+	// Produce runs one producer until stop
+	Produce(producer int, stop *atomic.Bool, st *mapProducerStats)
+	// Stats returns the updates applied and the time spent in them
+	Stats() (updates int64, busy time.Duration, err error)
+	Backend() string
+	Close() error
+}
+
+// mapProducerStats are one producer's counters
+type mapProducerStats struct {
+	producerStats
+	contended int64 // Bucket lock acquisitions that had to spin
+}
+
+// bpfContendedMap is a BPF map updated by a raw tracepoint program on
+// sys_enter, which the producers fire with getpid(2) from their CPUs. The
+// kernel's run time stats of the program give the update count and cost.
+type bpfContendedMap struct {
+	mapFD, prog, link, stats int
+	runNs, runs              uint64 // Counters when the storm started
+}
+
+func newBPFContendedMap(mapType, op string, keys int) (*bpfContendedMap, error) {
+	m := &bpfContendedMap{mapFD: -1, prog: -1, link: -1, stats: -1}
+	// Userspace reads and writes every CPU's value of a per-CPU map at once
+	typ, valueLen := uint32(bpfMapTypeHash), 8
+	if mapType == mapTypePerCPUHash {
+		typ, valueLen = bpfMapTypePercpuHash, 8*possibleCPUs()
+	}
+	create := struct {
+		mapType, keySize, valueSize, maxEntries uint32
+	}{typ, 4, 8, uint32(keys)}
+	fd, err := bpfSyscall(bpfMapCreate, unsafe.Pointer(&create), unsafe.Sizeof(create))
+	if err != nil {
+		return nil, fmt.Errorf("create %s map: %w", mapType, err)
+	}
+	m.mapFD = int(fd)
+
+	// Every key exists, so updates replace values rather than allocate
+	value := make([]byte, valueLen)
+	for key := uint32(0); key < uint32(keys); key++ {
+		attr := elemAttr{mapFD: uint32(m.mapFD), key: uint64(uintptr(unsafe.Pointer(&key))), value: uint64(uintptr(unsafe.Pointer(&value[0])))}
+		if _, err := bpfSyscall(bpfMapUpdateElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+			m.Close()
+			return nil, fmt.Errorf("populate %s map: %w", mapType, err)
+		}
+	}
+	runtime.KeepAlive(value)
+
+	if m.prog, err = loadInsns(progLoadAttr{progType: bpfProgTypeRawTracepoint}, contentionProgram(mapType, op, m.mapFD, keys), nil); err != nil {
+		m.Close()
+		return nil, err
+	}
+	if m.stats, err = enableRunTimeStats(); err != nil {
+		m.Close()
+		return nil, err
+	}
+	if m.link, err = rawTracepointOpen(callTracepointRawTP, m.prog); err != nil {
+		m.Close()
+		return nil, err
+	}
+	if m.runNs, m.runs, err = progRunStats(m.prog); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *bpfContendedMap) Produce(_ int, stop *atomic.Bool, st *mapProducerStats) {
+	for !stop.Load() {
+		syscall.Getpid()
+		st.emitted++
+	}
+}
+
+func (m *bpfContendedMap) Stats() (int64, time.Duration, error) {
+	runNs, runs, err := progRunStats(m.prog)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int64(runs - m.runs), time.Duration(runNs - m.runNs), nil
+}
+
+func (m *bpfContendedMap) Backend() string { return probeBackendBPF }
+
+func (m *bpfContendedMap) Close() error {
+	for _, fd := range []int{m.link, m.stats, m.prog, m.mapFD} {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}
+	m.mapFD, m.prog, m.link, m.stats = -1, -1, -1, -1
+	return nil
+}
+
+// simBucket is one bucket of a simulated htab: its raw spinlock and, for a
+// hash map, the value of its one key. Buckets are padded to a cache line.
+type simBucket struct {
+	lock  atomic.Uint32
+	value atomic.Uint64
+	_     [48]byte
+}
+
+// simCPUValue is one CPU's value of a per-CPU map entry, on its own cache
+// line as per-CPU allocations are
+type simCPUValue struct {
+	v uint64
+	_ [56]byte
+}
+
+// simulatedContendedMap models the kernel hash table under concurrent
+// programs: an update takes the key's bucket spinlock for either type,
+// while an increment looks the key up without locking and then adds to
+// the shared value atomically or to its own CPU's value. Each producer
+// stands for one CPU, so it owns one per-CPU slot.
+type simulatedContendedMap struct {
+	percpu  bool
+	op      string
+	keys    uint64
+	buckets []simBucket
+	values  [][]simCPUValue // Per key, one value per producer; per-CPU only
+	updates atomic.Int64
+	busy    atomic.Int64 // Nanoseconds spent in updates
+}
+
+func newSimulatedContendedMap(mapType, op string, keys, producers int) *simulatedContendedMap {
+	m := &simulatedContendedMap{percpu: mapType == mapTypePerCPUHash, op: op, keys: uint64(keys), buckets: make([]simBucket, keys)}
+	if m.percpu {
+		m.values = make([][]simCPUValue, keys)
+		for i := range m.values {
+			m.values[i] = make([]simCPUValue, producers)
+		}
+	}
+	return m
+}
+
+// apply performs one operation on key from producer, reporting whether
+// the bucket lock was contended
+func (m *simulatedContendedMap) apply(producer int, key uint64) bool {
+	b := &m.buckets[key]
+	if m.op == mapOpIncrement {
+		if m.percpu {
+			m.values[key][producer].v++
+		} else {
+			b.value.Add(1)
+		}
+		return false
+	}
+	contended := !b.lock.CompareAndSwap(0, 1)
+	for spins := 1; contended && !b.lock.CompareAndSwap(0, 1); spins++ {
+		if spins%64 == 0 {
+			runtime.Gosched() // The holder may share this CPU
+		}
+	}
+	if m.percpu {
+		m.values[key][producer].v = 1
+	} else {
+		b.value.Store(1)
+	}
+	b.lock.Store(0)
+	return contended
+}
+
+func (m *simulatedContendedMap) Produce(producer int, stop *atomic.Bool, st *mapProducerStats) {
+	rng := randomPayload{state: uint64(producer)*0x9e3779b97f4a7c15 | 1}
+	var busy time.Duration
+	for !stop.Load() {
+		key := rng.next() % m.keys
+		t0 := time.Now()
+		contended := m.apply(producer, key)
+		d := time.Since(t0)
+		busy += d
+		st.emitted++
+		if contended {
+			st.contended++
+		}
+		if len(st.samples) < cap(st.samples) {
+			st.samples = append(st.samples, uint64(d))
+		}
+	}
+	m.updates.Add(st.emitted)
+	m.busy.Add(int64(busy))
+}
+
+func (m *simulatedContendedMap) Stats() (int64, time.Duration, error) {
+	return m.updates.Load(), time.Duration(m.busy.Load()), nil
+}
+
+func (m *simulatedContendedMap) Backend() string { return probeBackendSim }
+func (m *simulatedContendedMap) Close() error    { return nil }
+
+// newContendedMap selects a backend; auto falls back to simulation when
+// the map or program cannot be created or attached
+func newContendedMap(backend, mapType, op string, keys, producers int) (contendedMap, error) {
+	switch backend {
+	case probeBackendSim:
+		return newSimulatedContendedMap(mapType, op, keys, producers), nil
+	case probeBackendBPF, probeBackendAuto:
+		m, err := newBPFContendedMap(mapType, op, keys)
+		if err == nil {
+			return m, nil
+		}
+		if backend == probeBackendBPF {
+			return nil, err
+		}
+		return newSimulatedContendedMap(mapType, op, keys, producers), nil
+	}
+	return nil, fmt.Errorf("unknown backend %q (want auto, bpf or sim)", backend)
+}
+
+// MapContentionBenchmark compares BPF_MAP_TYPE_HASH with PERCPU_HASH under
+// an event storm on every CPU: each producer updates a small set of hot
+// keys flat out, as a counter map on a busy tracepoint sees, and the
+// producer count is swept to show what the shared bucket locks and cache
+// lines cost as CPUs are added
+type MapContentionBenchmark struct {
+	duration   time.Duration
+	mapTypes   []string
+	ops        []string
+	producers  []int
+	keys       int
+	backend    string
+	maxSamples int
+	verbose    bool
+}
+
+// runOne measures n producers applying op to a map of mapType
+func (b *MapContentionBenchmark) runOne(ctx context.Context, mapType, op string, n int, cpus []int) (*BenchmarkResult, error) {
+	m, err := newContendedMap(b.backend, mapType, op, b.keys, n)
+	if err != nil {
+		return nil, err
+	}
+	defer m.Close()
+
+	r := &BenchmarkResult{
+		Name:           fmt.Sprintf("Map Contention (%s, %s)", mapType, op),
+		Language:       "Go",
+		ProgramType:    "raw_tracepoint",
+		Tracepoint:     callTracepoint,
+		DataMechanism:  mapType + "_map",
+		ReaderStrategy: fmt.Sprintf("%s/producers=%d/keys=%d", m.Backend(), n, b.keys),
+		Host:           CollectHostInfo(),
+		Errors:         []string{},
+	}
+	if m.Backend() == probeBackendSim {
+		r.Errors = append(r.Errors, "bpf(2) map programs unavailable: "+mapType+" map simulated in userspace")
+	}
+	benchLog(ctx).Info("Running producers", "producers", n, "map_type", mapType, "op", op, "duration", b.duration)
+
+	var stop atomic.Bool
+	stats := make([]mapProducerStats, n)
+	perProducer := max(b.maxSamples/n, 1)
+	if m.Backend() != probeBackendSim {
+		perProducer = 0 // The kernel times updates only in total
+	}
+
+	startUsage, _ := TakeResourceSnapshot()
+	r.StartTime = time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		stats[i].cpu = cpus[i%len(cpus)]
+		wg.Add(1)
+		go func(i int, st *mapProducerStats) {
+			defer wg.Done()
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			st.pinnedErr = pinThread(st.cpu)
+			st.samples = make([]uint64, 0, min(perProducer, 1024))
+			m.Produce(i, &stop, st)
+		}(i, &stats[i])
+	}
+
+	timer := time.NewTimer(b.duration)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+		r.Quality.Flag(QualityInterrupted)
+	}
+	stop.Store(true)
+	wg.Wait()
+	r.EndTime = time.Now()
+	endUsage, _ := TakeResourceSnapshot()
+
+	updates, busy, err := m.Stats()
+	if err != nil {
+		return nil, err
+	}
+	wall := r.EndTime.Sub(r.StartTime)
+	var contended int64
+	producers := make([]producerStats, n)
+	var samples []uint64
+	for i := range stats {
+		contended += stats[i].contended
+		producers[i] = stats[i].producerStats
+		samples = append(samples, stats[i].samples...)
+		if stats[i].pinnedErr != nil {
+			r.Errors = append(r.Errors, fmt.Sprintf("pinning producer to cpu%d: %v", stats[i].cpu, stats[i].pinnedErr))
+		}
+	}
+	r.Duration = wall.Seconds()
+	r.EventCount = updates
+	if r.Duration > 0 {
+		r.Throughput = float64(updates) / r.Duration
+	}
+	if len(samples) > 0 {
+		r.Latency = computeLatencyStats(samples, DefaultQuantiles)
+	}
+	r.CPUBudget = NewCPUBudget(startUsage, endUsage, updates)
+	r.CPUUsage = r.CPUBudget.CPUPercent(wall)
+	r.Operations = []OperationResult{NewOperationResult(op, updates, busy)}
+	if m.Backend() == probeBackendSim {
+		r.Operations = append(r.Operations, NewOperationResult("contended_lock", contended, wall))
+	}
+	r.recordProducerCPUs(producers, wall)
+	return r, nil
+}
+
+// Run measures every operation on every map type at every producer count
+func (b *MapContentionBenchmark) Run(ctx context.Context) ([]*BenchmarkResult, error) {
+	if b.verbose {
+		PrintBenchmarkHeader("Per-CPU vs Shared Hash Map Contention Benchmark (Go)")
+	}
+	cpus := readAllowedCPUs()
+	if len(cpus) == 0 {
+		for i := 0; i < runtime.NumCPU(); i++ {
+			cpus = append(cpus, i)
+		}
+	}
+	var results []*BenchmarkResult
+	for _, op := range b.ops {
+		for _, mapType := range b.mapTypes {
+			for _, n := range b.producers {
+				if ctx.Err() != nil {
+					return results, nil
+				}
+				r, err := b.runOne(ctx, mapType, op, n, cpus)
+				if err != nil {
+					return nil, fmt.Errorf("%s map %s with %d producers: %w", mapType, op, n, err)
+				}
+				results = append(results, r)
+			}
+		}
+	}
+	return results, nil
+}
+
+// printMapContention tabulates updates per second and the cost of one
+// update against the same map and operation at the first producer count
+func printMapContention(results []*BenchmarkResult) {
+	PrintBenchmarkHeader("Update throughput by map type and producers")
+	base := make(map[string]float64)
+	for _, r := range results {
+		ns := r.Operations[0].AvgNs
+		line := fmt.Sprintf("%-40s %-30s %12.0f updates/s %8.1f ns/update", r.Name, r.ReaderStrategy, r.Throughput, ns)
+		if b, ok := base[r.Name]; !ok {
+			base[r.Name] = ns
+		} else if b > 0 {
+			line += fmt.Sprintf("  %.2fx", ns/b)
+		}
+		if len(r.Operations) > 1 && r.EventCount > 0 {
+			line += fmt.Sprintf("  %.1f%% contended", float64(r.Operations[1].Count)/float64(r.EventCount)*100)
+		}
+		fmt.Println(line)
+	}
+}
+
+// runMapContentionBenchmark is the entry point of the map-contention subcommand
+func runMapContentionBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("map-contention", flag.ExitOnError)
+	common := addBenchFlags(fs, "map_contention_result.json", true)
+	types := fs.String("types", mapTypeHash+","+mapTypePerCPUHash, "Comma-separated map types to compare (hash, percpu_hash)")
+	ops := fs.String("ops", strings.Join(allMapOps, ","), "Comma-separated program operations (update, increment)")
+	producers := fs.String("producers", defaultProducerSweep(), "Comma-separated producer counts to sweep; producers are pinned round-robin to the allowed CPUs")
+	keys := fs.Int("keys", 16, "Hot keys the producers update at random")
+	backend := fs.String("backend", probeBackendAuto, "Backend (auto, bpf, sim)")
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+	if *keys <= 0 {
+		return nil, opts, fmt.Errorf("-keys must be positive")
+	}
+	mapTypes := splitList(*types)
+	for _, t := range mapTypes {
+		if t != mapTypeHash && t != mapTypePerCPUHash {
+			return nil, opts, fmt.Errorf("unknown map type %q (want hash or percpu_hash)", t)
+		}
+	}
+	opList := splitList(*ops)
+	for _, op := range opList {
+		if !containsString(allMapOps, op) {
+			return nil, opts, fmt.Errorf("unknown map operation %q", op)
+		}
+	}
+	var counts []int
+	for _, s := range splitList(*producers) {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return nil, opts, fmt.Errorf("invalid producer count %q", s)
+		}
+		counts = append(counts, n)
+	}
+	if len(mapTypes) == 0 || len(opList) == 0 || len(counts) == 0 {
+		return nil, opts, fmt.Errorf("-types, -ops and -producers must each list at least one item")
+	}
+
+	bench := &MapContentionBenchmark{
+		duration:   opts.Duration,
+		mapTypes:   mapTypes,
+		ops:        opList,
+		producers:  counts,
+		keys:       *keys,
+		backend:    *backend,
+		maxSamples: 100000,
+		verbose:    opts.Verbose,
+	}
+	results, err := bench.Run(ctx)
+	if err != nil {
+		return nil, opts, err
+	}
+	printMapContention(results)
+	return results, opts, nil
+}
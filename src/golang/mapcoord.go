@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// bpf(2) commands used by the coordination map
+const (
+	bpfMapLookupElem = 1
+	bpfMapUpdateElem = 2
+	bpfObjPin        = 6
+	bpfObjGet        = 7
+)
+
+// Coordination channels between the load generator and the measurement
+// program
+const (
+	coordAtomic    = "atomic"     // Shared process memory; free, but invisible to other processes
+	coordPinnedMap = "pinned-map" // A BPF array map pinned in bpffs, readable kernel-side
+)
+
+// defaultPinPath is where the coordination map is pinned
+const defaultPinPath = "/sys/fs/bpf/ebpf-bench/control"
+
+// Slots of the coordination map
+const (
+	coordSlotPhase = iota // Current pipeline phase
+	coordSlotReady        // Reader readiness, checked by the program before emitting
+	coordSlots
+)
+
+// bpfSyscall issues a bpf(2) command with attr, which must be a pointer to
+// the command's prefix of union bpf_attr
+func bpfSyscall(cmd int, attr unsafe.Pointer, size uintptr) (uintptr, error) {
+	if sysBPF < 0 {
+		return 0, fmt.Errorf("bpf(2) is not supported on %s", runtime.GOARCH)
+	}
+	r, _, errno := syscall.Syscall(uintptr(sysBPF), uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return r, nil
+}
+
+// coordMap is a BPF_MAP_TYPE_ARRAY of uint64 slots shared through a pin
+type coordMap struct {
+	fd      int
+	path    string
+	created bool // Pinned by this process, so unpinned on Close
+}
+
+// openCoordMap opens the map pinned at path, creating and pinning it when
+// there is none, so an external load generator can share it
+func openCoordMap(path string) (*coordMap, error) {
+	name, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	var get struct {
+		pathname  uint64
+		bpfFD     uint32
+		fileFlags uint32
+	}
+	get.pathname = uint64(uintptr(unsafe.Pointer(name)))
+	fd, err := bpfSyscall(bpfObjGet, unsafe.Pointer(&get), unsafe.Sizeof(get))
+	if err == nil {
+		return &coordMap{fd: int(fd), path: path}, nil
+	}
+	if !errors.Is(err, syscall.ENOENT) {
+		return nil, fmt.Errorf("open pinned map %s: %w", path, err)
+	}
+
+	create := struct {
+		mapType, keySize, valueSize, maxEntries uint32
+	}{bpfMapTypeArray, 4, 8, coordSlots}
+	fd, err = bpfSyscall(bpfMapCreate, unsafe.Pointer(&create), unsafe.Sizeof(create))
+	if err != nil {
+		return nil, fmt.Errorf("create coordination map: %w", err)
+	}
+	m := &coordMap{fd: int(fd), path: path, created: true}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		syscall.Close(m.fd)
+		return nil, fmt.Errorf("pin %s (is bpffs mounted?): %w", path, err)
+	}
+	pin := get
+	pin.bpfFD = uint32(fd)
+	if _, err := bpfSyscall(bpfObjPin, unsafe.Pointer(&pin), unsafe.Sizeof(pin)); err != nil {
+		syscall.Close(m.fd)
+		return nil, fmt.Errorf("pin %s (is bpffs mounted?): %w", path, err)
+	}
+	return m, nil
+}
+
+// elemAttr is the BPF_MAP_*_ELEM prefix of union bpf_attr
+type elemAttr struct {
+	mapFD uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+func (m *coordMap) lookup(slot uint32) (uint64, error) {
+	var v uint64
+	attr := elemAttr{mapFD: uint32(m.fd), key: uint64(uintptr(unsafe.Pointer(&slot))), value: uint64(uintptr(unsafe.Pointer(&v)))}
+	_, err := bpfSyscall(bpfMapLookupElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return v, err
+}
+
+func (m *coordMap) update(slot uint32, v uint64) error {
+	attr := elemAttr{mapFD: uint32(m.fd), key: uint64(uintptr(unsafe.Pointer(&slot))), value: uint64(uintptr(unsafe.Pointer(&v)))}
+	_, err := bpfSyscall(bpfMapUpdateElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// Close closes the map, unpinning it if this process pinned it
+func (m *coordMap) Close() {
+	if m.created {
+		os.Remove(m.path)
+	}
+	syscall.Close(m.fd)
+}
+
+// phaseMarker carries the pipeline phase between the harness, the load
+// generator and the measurement program. *atomic.Int32 is one.
+type phaseMarker interface {
+	Load() int32
+	Store(p int32)
+}
+
+// mapPhaseMarker keeps the phase, or another slot's value, in the
+// coordination map. A failed map operation is counted and leaves the last
+// value seen in place.
+type mapPhaseMarker struct {
+	m      *coordMap
+	slot   uint32
+	last   atomic.Int32
+	failed atomic.Int64
+}
+
+func (p *mapPhaseMarker) Load() int32 {
+	v, err := p.m.lookup(p.slot)
+	if err != nil {
+		p.failed.Add(1)
+		return p.last.Load()
+	}
+	p.last.Store(int32(v))
+	return int32(v)
+}
+
+func (p *mapPhaseMarker) Store(phase int32) {
+	if err := p.m.update(p.slot, uint64(phase)); err != nil {
+		p.failed.Add(1)
+	}
+	p.last.Store(phase)
+}
+
+// timedMarker times the measuring side's use of a marker so the channel's
+// cost can be taken out of its results
+type timedMarker struct {
+	phaseMarker
+	ops   int64
+	spent time.Duration
+}
+
+func (t *timedMarker) Load() int32 {
+	t0 := time.Now()
+	p := t.phaseMarker.Load()
+	t.spent += time.Since(t0)
+	t.ops++
+	return p
+}
+
+func (t *timedMarker) Store(phase int32) {
+	t0 := time.Now()
+	t.phaseMarker.Store(phase)
+	t.spent += time.Since(t0)
+	t.ops++
+}
+
+// CoordinationStats describe the coordination channel of a run. Its cost
+// on the measuring side is excluded from the CPU budget and latencies.
+type CoordinationStats struct {
+	Channel    string
+	PinPath    string
+	Operations int64   // Map reads and writes by the measuring side
+	AvgNs      float64 // Mean cost of one operation
+	ExcludedUs float64 // Measuring-side time in the channel, removed from the CPU budget
+	Failed     int64   // Map operations that failed, on either side
+}
+
+// coordFlagSet holds the -coord and -pin-path flags
+type coordFlagSet struct {
+	channel *string
+	pinPath *string
+}
+
+// addCoordFlags registers -coord and -pin-path
+func addCoordFlags(fs *flag.FlagSet) *coordFlagSet {
+	return &coordFlagSet{
+		channel: fs.String("coord", coordAtomic, "Phase marker channel between generator and program (atomic, pinned-map)"),
+		pinPath: fs.String("pin-path", defaultPinPath, "bpffs path of the pinned-map coordination map; an existing pin is shared"),
+	}
+}
+
+// coordination is the phase marker channel of one run
+type coordination struct {
+	channel string
+	m       *coordMap
+	shared  phaseMarker // Used by the load generator
+	timed   *timedMarker
+	mapSide *mapPhaseMarker
+	ready   phaseMarker // Reader readiness; see readiness
+}
+
+// open sets up the selected channel; Close releases it
+func (f *coordFlagSet) open() (*coordination, error) {
+	c := &coordination{channel: *f.channel}
+	switch *f.channel {
+	case coordAtomic:
+		c.shared = &atomic.Int32{}
+		c.ready = &atomic.Int32{}
+	case coordPinnedMap:
+		m, err := openCoordMap(*f.pinPath)
+		if err != nil {
+			return nil, err
+		}
+		c.m = m
+		c.mapSide = &mapPhaseMarker{m: m, slot: coordSlotPhase}
+		c.shared = c.mapSide
+		c.ready = &mapPhaseMarker{m: m, slot: coordSlotReady}
+	default:
+		return nil, fmt.Errorf("unknown -coord channel %q (want atomic or pinned-map)", *f.channel)
+	}
+	c.timed = &timedMarker{phaseMarker: c.shared}
+	return c, nil
+}
+
+// Close unpins and closes the coordination map, if any
+func (c *coordination) Close() {
+	if c != nil && c.m != nil {
+		c.m.Close()
+	}
+}
+
+// markers returns the generator's and the measuring side's view of the
+// phase. The atomic channel is used unwrapped, since timing it would cost
+// more than it does. A nil coordination is a fresh atomic channel.
+func (c *coordination) markers() (generator, measuring phaseMarker) {
+	if c == nil {
+		p := &atomic.Int32{}
+		return p, p
+	}
+	if c.m == nil {
+		return c.shared, c.shared
+	}
+	return c.shared, c.timed
+}
+
+// readiness returns the reader readiness flag the program checks before
+// emitting, which holds readyWaiting or readyDraining. Both sides share
+// it; a nil coordination is a fresh atomic.
+func (c *coordination) readiness() phaseMarker {
+	if c == nil {
+		return &atomic.Int32{}
+	}
+	return c.ready
+}
+
+// pinned returns the coordination map of the pinned-map channel, or nil
+func (c *coordination) pinned() *coordMap {
+	if c == nil {
+		return nil
+	}
+	return c.m
+}
+
+// stats describes the channel after a run; nil for the atomic channel,
+// whose cost is negligible
+func (c *coordination) stats() *CoordinationStats {
+	if c == nil || c.m == nil {
+		return nil
+	}
+	s := &CoordinationStats{
+		Channel:    c.channel,
+		PinPath:    c.m.path,
+		Operations: c.timed.ops,
+		ExcludedUs: float64(c.timed.spent) / float64(time.Microsecond),
+		Failed:     c.mapSide.failed.Load(),
+	}
+	if s.Operations > 0 {
+		s.AvgNs = float64(c.timed.spent.Nanoseconds()) / float64(s.Operations)
+	}
+	return s
+}
+
+// formatCoordination renders the coordination channel, if measured
+func (r *BenchmarkResult) formatCoordination() string {
+	c := r.Coordination
+	if c == nil {
+		return ""
+	}
+	return fmt.Sprintf("Coordination:    %s %s, %d ops at %.0f ns, %.0f µs excluded, %d failed\n",
+		c.Channel, c.PinPath, c.Operations, c.AvgNs, c.ExcludedUs, c.Failed)
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"flag"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Map types covered by the maps benchmark, named after their BPF_MAP_TYPE_*
+const (
+	mapTypeHash       = "hash"
+	mapTypeArray      = "array"
+	mapTypeLRUHash    = "lru_hash"
+	mapTypePerCPUHash = "percpu_hash"
+)
+
+var allMapTypes = []string{mapTypeHash, mapTypeArray, mapTypeLRUHash, mapTypePerCPUHash}
+
+// Access origins: userspace goes through the bpf() syscall for every
+// operation, a BPF program calls the map helpers directly
+const (
+	mapOriginUserspace = "userspace"
+	mapOriginBPF       = "bpf"
+)
+
+// benchMap is a BPF map under test, real or modelled in userspace. cpu is
+// the CPU the caller runs on and only matters for per-CPU maps.
+type benchMap interface {
+	Update(cpu int, key uint32, value uint64) error
+	Lookup(cpu int, key uint32) (uint64, bool)
+	Delete(key uint32) bool
+	Backend() string
+	Close() error
+}
+
+// hashMap models BPF_MAP_TYPE_HASH: preallocated buckets behind a lock
+type hashMap struct {
+	mu         sync.Mutex
+	entries    map[uint32]uint64
+	maxEntries int
+}
+
+func newHashMap(maxEntries int) *hashMap {
+	return &hashMap{entries: make(map[uint32]uint64, maxEntries), maxEntries: maxEntries}
+}
+
+func (m *hashMap) Update(_ int, key uint32, value uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.entries[key]; !ok && len(m.entries) >= m.maxEntries {
+		return syscall.E2BIG
+	}
+	m.entries[key] = value
+	return nil
+}
+
+func (m *hashMap) Lookup(_ int, key uint32) (uint64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.entries[key]
+	return v, ok
+}
+
+func (m *hashMap) Delete(key uint32) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.entries[key]
+	delete(m.entries, key)
+	return ok
+}
+
+// arrayMap models BPF_MAP_TYPE_ARRAY: fixed slots, delete is not supported
+type arrayMap struct {
+	values []uint64
+}
+
+func newArrayMap(maxEntries int) *arrayMap {
+	return &arrayMap{values: make([]uint64, maxEntries)}
+}
+
+func (m *arrayMap) Update(_ int, key uint32, value uint64) error {
+	if int(key) >= len(m.values) {
+		return syscall.E2BIG
+	}
+	m.values[key] = value
+	return nil
+}
+
+func (m *arrayMap) Lookup(_ int, key uint32) (uint64, bool) {
+	if int(key) >= len(m.values) {
+		return 0, false
+	}
+	return m.values[key], true
+}
+
+func (m *arrayMap) Delete(uint32) bool {
+	return false // Array elements cannot be deleted (EINVAL in the kernel)
+}
+
+// lruHashMap models BPF_MAP_TYPE_LRU_HASH: the least recently used entry is
+// evicted when the map is full
+type lruHashMap struct {
+	mu         sync.Mutex
+	entries    map[uint32]*list.Element
+	order      *list.List
+	maxEntries int
+}
+
+type lruEntry struct {
+	key   uint32
+	value uint64
+}
+
+func newLRUHashMap(maxEntries int) *lruHashMap {
+	return &lruHashMap{
+		entries:    make(map[uint32]*list.Element, maxEntries),
+		order:      list.New(),
+		maxEntries: maxEntries,
+	}
+}
+
+func (m *lruHashMap) Update(_ int, key uint32, value uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.entries[key]; ok {
+		el.Value.(*lruEntry).value = value
+		m.order.MoveToFront(el)
+		return nil
+	}
+	if len(m.entries) >= m.maxEntries {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*lruEntry).key)
+	}
+	m.entries[key] = m.order.PushFront(&lruEntry{key: key, value: value})
+	return nil
+}
+
+func (m *lruHashMap) Lookup(_ int, key uint32) (uint64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.entries[key]
+	if !ok {
+		return 0, false
+	}
+	m.order.MoveToFront(el)
+	return el.Value.(*lruEntry).value, true
+}
+
+func (m *lruHashMap) Delete(key uint32) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.entries[key]
+	if !ok {
+		return false
+	}
+	m.order.Remove(el)
+	delete(m.entries, key)
+	return true
+}
+
+// perCPUHashMap models BPF_MAP_TYPE_PERCPU_HASH. BPF programs only touch
+// the slot of the CPU they run on; userspace reads and writes all slots at
+// once, which is what makes per-CPU maps expensive from userspace.
+type perCPUHashMap struct {
+	mu         sync.Mutex
+	entries    map[uint32][]uint64
+	numCPU     int
+	maxEntries int
+	fromUser   bool
+}
+
+func newPerCPUHashMap(maxEntries int, fromUser bool) *perCPUHashMap {
+	return &perCPUHashMap{
+		entries:    make(map[uint32][]uint64, maxEntries),
+		numCPU:     runtime.NumCPU(),
+		maxEntries: maxEntries,
+		fromUser:   fromUser,
+	}
+}
+
+func (m *perCPUHashMap) Update(cpu int, key uint32, value uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	values, ok := m.entries[key]
+	if !ok {
+		if len(m.entries) >= m.maxEntries {
+			return syscall.E2BIG
+		}
+		values = make([]uint64, m.numCPU)
+		m.entries[key] = values
+	}
+	if m.fromUser {
+		for i := range values {
+			values[i] = value
+		}
+	} else {
+		values[cpu%m.numCPU] = value
+	}
+	return nil
+}
+
+func (m *perCPUHashMap) Lookup(cpu int, key uint32) (uint64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	values, ok := m.entries[key]
+	if !ok {
+		return 0, false
+	}
+	if m.fromUser {
+		var sum uint64
+		for _, v := range values {
+			sum += v
+		}
+		return sum, true
+	}
+	return values[cpu%m.numCPU], true
+}
+
+func (m *perCPUHashMap) Delete(key uint32) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.entries[key]
+	delete(m.entries, key)
+	return ok
+}
+
+func (*hashMap) Backend() string       { return probeBackendSim }
+func (*hashMap) Close() error          { return nil }
+func (*arrayMap) Backend() string      { return probeBackendSim }
+func (*arrayMap) Close() error         { return nil }
+func (*lruHashMap) Backend() string    { return probeBackendSim }
+func (*lruHashMap) Close() error       { return nil }
+func (*perCPUHashMap) Backend() string { return probeBackendSim }
+func (*perCPUHashMap) Close() error    { return nil }
+
+// bpf(2) command and map type numbers of the maps benchmark beyond those
+// of the feature probes and the coordination map
+const bpfMapDeleteElem = 3
+
+var bpfMapTypes = map[string]uint32{
+	mapTypeHash:       bpfMapTypeHash,
+	mapTypeArray:      bpfMapTypeArray,
+	mapTypeLRUHash:    bpfMapTypeLRUHash,
+	mapTypePerCPUHash: bpfMapTypePercpuHash,
+}
+
+// syscallMap is a real BPF map operated from userspace, one bpf(2) call
+// per operation. A per-CPU map's value holds every possible CPU's slot,
+// all written by an update and summed by a lookup, as the simulated
+// per-CPU map does for userspace.
+type syscallMap struct {
+	fd     int
+	perCPU bool
+	value  []uint64
+}
+
+func newSyscallMap(mapType string, maxEntries int) (*syscallMap, error) {
+	typ, ok := bpfMapTypes[mapType]
+	if !ok {
+		return nil, fmt.Errorf("unknown map type %q", mapType)
+	}
+	m := &syscallMap{perCPU: mapType == mapTypePerCPUHash, value: make([]uint64, 1)}
+	if m.perCPU {
+		m.value = make([]uint64, possibleCPUs())
+	}
+	create := struct {
+		mapType, keySize, valueSize, maxEntries uint32
+	}{typ, 4, 8, uint32(maxEntries)}
+	fd, err := bpfSyscall(bpfMapCreate, unsafe.Pointer(&create), unsafe.Sizeof(create))
+	if err != nil {
+		return nil, fmt.Errorf("create %s map: %w", mapType, err)
+	}
+	m.fd = int(fd)
+	return m, nil
+}
+
+// elem issues a BPF_MAP_*_ELEM command on key, with m.value as the value
+func (m *syscallMap) elem(cmd int, key uint32) error {
+	attr := elemAttr{mapFD: uint32(m.fd), key: uint64(uintptr(unsafe.Pointer(&key)))}
+	if cmd != bpfMapDeleteElem {
+		attr.value = uint64(uintptr(unsafe.Pointer(&m.value[0])))
+	}
+	_, err := bpfSyscall(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+func (m *syscallMap) Update(_ int, key uint32, value uint64) error {
+	for i := range m.value {
+		m.value[i] = value
+	}
+	return m.elem(bpfMapUpdateElem, key)
+}
+
+func (m *syscallMap) Lookup(_ int, key uint32) (uint64, bool) {
+	if err := m.elem(bpfMapLookupElem, key); err != nil {
+		return 0, false
+	}
+	var sum uint64
+	for _, v := range m.value {
+		sum += v
+	}
+	return sum, true
+}
+
+func (m *syscallMap) Delete(key uint32) bool {
+	return m.elem(bpfMapDeleteElem, key) == nil
+}
+
+func (m *syscallMap) Backend() string { return probeBackendBPF }
+
+func (m *syscallMap) Close() error { return syscall.Close(m.fd) }
+
+// newBenchMap selects a backend. Only userspace access has a real one:
+// BPF-side helper calls are always simulated. auto falls back to
+// simulation when the map cannot be created.
+func newBenchMap(backend, mapType string, maxEntries int, origin string) (benchMap, error) {
+	switch backend {
+	case probeBackendSim:
+	case probeBackendBPF, probeBackendAuto:
+		if origin != mapOriginUserspace {
+			break
+		}
+		m, err := newSyscallMap(mapType, maxEntries)
+		if err == nil {
+			return m, nil
+		}
+		if backend == probeBackendBPF {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown backend %q (want auto, bpf or sim)", backend)
+	}
+	return newSimMap(mapType, maxEntries, origin)
+}
+
+// newSimMap creates a simulated map of the given type
+func newSimMap(mapType string, maxEntries int, origin string) (benchMap, error) {
+	switch mapType {
+	case mapTypeHash:
+		return newHashMap(maxEntries), nil
+	case mapTypeArray:
+		return newArrayMap(maxEntries), nil
+	case mapTypeLRUHash:
+		return newLRUHashMap(maxEntries), nil
+	case mapTypePerCPUHash:
+		return newPerCPUHashMap(maxEntries, origin == mapOriginUserspace), nil
+	}
+	return nil, fmt.Errorf("unknown map type %q", mapType)
+}
+
+// MapsBenchmark measures update, lookup and delete throughput per map type
+type MapsBenchmark struct {
+	backend    string
+	mapTypes   []string
+	origins    []string
+	maxEntries int
+	ops        int
+	verbose    bool
+}
+
+// NewMapsBenchmark creates a new maps benchmark instance
+func NewMapsBenchmark(backend string, mapTypes, origins []string, maxEntries, ops int, verbose bool) *MapsBenchmark {
+	return &MapsBenchmark{
+		backend:    backend,
+		mapTypes:   mapTypes,
+		origins:    origins,
+		maxEntries: maxEntries,
+		ops:        ops,
+		verbose:    verbose,
+	}
+}
+
+// Run executes the benchmark, producing one result per map type and origin
+func (b *MapsBenchmark) Run(ctx context.Context) ([]*BenchmarkResult, error) {
+	if b.verbose {
+		PrintBenchmarkHeader("Map Operations Benchmark (Go)")
+	}
+
+	host := CollectHostInfo()
+	var results []*BenchmarkResult
+	for _, mapType := range b.mapTypes {
+		for _, origin := range b.origins {
+			benchLog(ctx).Info("Benchmarking map", "type", mapType, "origin", origin)
+			r, err := b.runOne(mapType, origin)
+			if err != nil {
+				return results, err
+			}
+			r.Host = host
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
+
+// runOne benchmarks a single map type from a single origin
+func (b *MapsBenchmark) runOne(mapType, origin string) (*BenchmarkResult, error) {
+	m, err := newBenchMap(b.backend, mapType, b.maxEntries, origin)
+	if err != nil {
+		return nil, err
+	}
+	defer m.Close()
+	simulated := m.Backend() == probeBackendSim
+
+	programType, strategy := "tracepoint", "helper"
+	if origin == mapOriginUserspace {
+		programType, strategy = "userspace", "bpf_syscall"
+	}
+	r := &BenchmarkResult{
+		Name:           fmt.Sprintf("Map Operations (%s, %s)", mapType, origin),
+		Language:       "Go",
+		ProgramType:    programType,
+		DataMechanism:  mapType + "_map",
+		ReaderStrategy: m.Backend() + "/" + strategy,
+		Errors:         []string{},
+	}
+	switch {
+	case simulated && origin == mapOriginUserspace:
+		r.Errors = append(r.Errors, "bpf(2) maps unavailable: "+mapType+" map simulated in userspace, a getpid(2) per operation standing in for the syscall")
+	case simulated:
+		r.Errors = append(r.Errors, "BPF programs not loaded: "+mapType+" map helpers simulated in userspace")
+	}
+
+	startUsage, _ := TakeResourceSnapshot()
+	r.StartTime = time.Now()
+
+	// Each phase walks the key space so updates populate the map, lookups
+	// hit and deletes remove existing entries
+	phases := []struct {
+		name string
+		op   func(cpu int, key uint32) bool
+	}{
+		{"update", func(cpu int, key uint32) bool { return m.Update(cpu, key, uint64(key)) == nil }},
+		{"lookup", func(cpu int, key uint32) bool { _, ok := m.Lookup(cpu, key); return ok }},
+		{"delete", func(_ int, key uint32) bool { return m.Delete(key) }},
+	}
+
+	numCPU := runtime.NumCPU()
+	for _, phase := range phases {
+		if mapType == mapTypeArray && phase.name == "delete" {
+			r.Errors = append(r.Errors, "delete: not supported on array maps")
+			continue
+		}
+
+		var failures int64
+		var elapsed time.Duration
+		for done := 0; done < b.ops; {
+			// Deletes empty the map, so refill it (untimed) before every
+			// pass over the key space
+			if phase.name == "delete" && done > 0 {
+				for key := 0; key < b.maxEntries; key++ {
+					m.Update(key%numCPU, uint32(key), uint64(key))
+				}
+			}
+
+			pass := b.ops - done
+			if pass > b.maxEntries {
+				pass = b.maxEntries
+			}
+			start := time.Now()
+			for key := 0; key < pass; key++ {
+				if simulated && origin == mapOriginUserspace {
+					// Every userspace map operation is a bpf() syscall;
+					// the real backend makes it
+					syscall.Getpid()
+				}
+				if !phase.op(key%numCPU, uint32(key)) {
+					failures++
+				}
+			}
+			elapsed += time.Since(start)
+			done += pass
+		}
+
+		op := NewOperationResult(phase.name, int64(b.ops), elapsed)
+		r.Operations = append(r.Operations, op)
+		r.EventCount += op.Count
+		if failures > 0 {
+			r.Errors = append(r.Errors, fmt.Sprintf("%s: %d operations failed", phase.name, failures))
+		}
+	}
+
+	r.EndTime = time.Now()
+	endUsage, _ := TakeResourceSnapshot()
+
+	// Throughput only counts time spent in timed operations, not refills
+	for _, op := range r.Operations {
+		r.Duration += op.Duration
+	}
+	if r.Duration > 0 {
+		r.Throughput = float64(r.EventCount) / r.Duration
+	}
+	r.CPUBudget = NewCPUBudget(startUsage, endUsage, r.EventCount)
+	r.CPUUsage = r.CPUBudget.CPUPercent(endUsage.Wall.Sub(startUsage.Wall))
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	r.MemoryUsage = ms.Alloc
+
+	return r, nil
+}
+
+// runMapsBenchmark is the entry point of the maps subcommand
+func runMapsBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("maps", flag.ExitOnError)
+	common := addBenchFlags(fs, "maps_result.json", false)
+	types := fs.String("types", strings.Join(allMapTypes, ","), "Comma-separated map types to benchmark")
+	origins := fs.String("origins", mapOriginUserspace+","+mapOriginBPF, "Comma-separated access origins (userspace, bpf)")
+	entries := fs.Int("entries", 10240, "Maximum map entries")
+	ops := fs.Int("n", 1000000, "Operations per phase (update, lookup, delete)")
+	backend := fs.String("backend", probeBackendAuto, "Backend of userspace access (auto, bpf, sim); bpf-side access is simulated")
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+
+	if *entries <= 0 || *ops <= 0 {
+		return nil, opts, fmt.Errorf("-entries and -n must be positive")
+	}
+	for _, origin := range splitList(*origins) {
+		if origin != mapOriginUserspace && origin != mapOriginBPF {
+			return nil, opts, fmt.Errorf("unknown origin %q", origin)
+		}
+	}
+
+	switch *backend {
+	case probeBackendAuto, probeBackendBPF, probeBackendSim:
+	default:
+		return nil, opts, fmt.Errorf("unknown -backend %q (want auto, bpf or sim)", *backend)
+	}
+	bench := NewMapsBenchmark(*backend, splitList(*types), splitList(*origins), *entries, *ops, opts.Verbose)
+	results, err := bench.Run(ctx)
+	if err != nil {
+		return nil, opts, err
+	}
+
+	return results, opts, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/metrics"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sizes of the live per-CPU and latency views of a Progress
+const (
+	progressCPUs        = 256  // CPUs with their own event counter
+	progressSamples     = 1024 // Latest latency samples kept
+	progressSampleEvery = 16   // Events per latency sample
+)
+
+// Progress holds the live counters of one benchmark's event buffer,
+// published by the metrics exporter and the dashboard while the benchmark
+// runs
+type Progress struct {
+	benchmark string
+	events    atomic.Int64
+	dropped   atomic.Int64
+	startNs   atomic.Int64 // First collection start, unix ns
+	endNs     atomic.Int64 // Last collection end, or 0 while collecting
+	cpus      [progressCPUs]atomic.Int64
+	samples   [progressSamples]atomic.Uint64 // Delivery latencies in ns, a ring
+	sampled   atomic.Uint64                  // Samples written to the ring
+	capacity  atomic.Int64                   // Events the buffer can keep; 0 when streaming
+}
+
+// metricsRegistry is the set of benchmarks reported on /metrics and the
+// dashboard. Progress tracking stays off until one of them is started.
+var metricsRegistry struct {
+	sync.Mutex
+	tracking bool
+	progress []*Progress
+}
+
+// NewProgress registers live counters for a benchmark. It returns nil when
+// no exporter is running; buffers treat a nil Progress as disabled. The
+// counters replace those of an earlier run of the same benchmark, such as
+// a previous -iterations run, so each benchmark stays one series.
+func NewProgress(benchmark string) *Progress {
+	metricsRegistry.Lock()
+	defer metricsRegistry.Unlock()
+	if !metricsRegistry.tracking {
+		return nil
+	}
+	p := &Progress{benchmark: benchmark}
+	for i, old := range metricsRegistry.progress {
+		if old.benchmark == benchmark {
+			metricsRegistry.progress[i] = p
+			return p
+		}
+	}
+	metricsRegistry.progress = append(metricsRegistry.progress, p)
+	return p
+}
+
+// delivered counts an event that reached the buffer, by CPU, and samples
+// its delivery latency
+func (p *Progress) delivered(e *Event) {
+	n := p.events.Add(1)
+	if e.CPU < progressCPUs {
+		p.cpus[e.CPU].Add(1)
+	}
+	if n%progressSampleEvery == 0 {
+		if now := nowNs(); now >= e.Timestamp {
+			p.samples[p.sampled.Add(1)%progressSamples].Store(now - e.Timestamp)
+		}
+	}
+}
+
+// recentLatencies returns the latest sampled delivery latencies
+func (p *Progress) recentLatencies() []uint64 {
+	n := min(p.sampled.Load(), progressSamples)
+	samples := make([]uint64, n)
+	for i := range samples {
+		samples[i] = p.samples[i].Load()
+	}
+	return samples
+}
+
+func (p *Progress) start() {
+	p.startNs.CompareAndSwap(0, time.Now().UnixNano())
+	p.endNs.Store(0)
+}
+
+func (p *Progress) end() {
+	p.endNs.Store(time.Now().UnixNano())
+}
+
+// Progress is a rateSource of the snapshot trigger
+func (p *Progress) sourceBenchmark() string { return p.benchmark }
+func (p *Progress) eventsSoFar() int64      { return p.events.Load() }
+
+// bufferOccupancy reports how full the buffer is, if it keeps its events
+func (p *Progress) bufferOccupancy() []float64 {
+	c := p.capacity.Load()
+	if c <= 0 {
+		return nil
+	}
+	return []float64{float64(min(p.events.Load(), c)) / float64(c)}
+}
+
+// throughput returns events per second averaged over collection so far
+func (p *Progress) throughput() float64 {
+	start := p.startNs.Load()
+	if start == 0 {
+		return 0
+	}
+	end := p.endNs.Load()
+	if end == 0 {
+		end = time.Now().UnixNano()
+	}
+	if end <= start {
+		return 0
+	}
+	return float64(p.events.Load()) / time.Duration(end-start).Seconds()
+}
+
+var metricsOnce struct {
+	sync.Once
+	err error
+}
+
+// startMetricsServer serves /metrics on addr in the background. Only the
+// first call starts a listener, so a suite and its benchmarks share one.
+func startMetricsServer(addr string) error {
+	metricsOnce.Do(func() {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			metricsOnce.err = fmt.Errorf("metrics listener: %w", err)
+			return
+		}
+		metricsRegistry.Lock()
+		metricsRegistry.tracking = true
+		metricsRegistry.Unlock()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", serveMetrics)
+		go func() {
+			if err := http.Serve(ln, mux); err != nil {
+				slog.Error("Metrics server stopped", "addr", addr, "err", err)
+			}
+		}()
+	})
+	return metricsOnce.err
+}
+
+// serveMetrics writes the live counters in the Prometheus text format
+func serveMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	metricsRegistry.Lock()
+	progress := append([]*Progress(nil), metricsRegistry.progress...)
+	metricsRegistry.Unlock()
+	sort.SliceStable(progress, func(i, j int) bool { return progress[i].benchmark < progress[j].benchmark })
+
+	writeMetric(w, "ebpf_bench_events_received_total", "counter", "Events delivered to the userspace buffer", progress,
+		func(p *Progress) float64 { return float64(p.events.Load()) })
+	writeMetric(w, "ebpf_bench_events_dropped_total", "counter", "Events lost at the userspace buffer", progress,
+		func(p *Progress) float64 { return float64(p.dropped.Load()) })
+	writeMetric(w, "ebpf_bench_throughput_events_per_second", "gauge", "Mean delivery rate since collection started", progress,
+		(*Progress).throughput)
+	writeMetric(w, "ebpf_bench_collecting", "gauge", "Whether the benchmark is collecting events", progress,
+		func(p *Progress) float64 {
+			if p.startNs.Load() != 0 && p.endNs.Load() == 0 {
+				return 1
+			}
+			return 0
+		})
+
+	if usage, err := TakeResourceSnapshot(); err == nil {
+		fmt.Fprintf(w, "# HELP ebpf_bench_cpu_seconds_total Process CPU time\n# TYPE ebpf_bench_cpu_seconds_total counter\n")
+		fmt.Fprintf(w, "ebpf_bench_cpu_seconds_total{mode=\"user\"} %g\n", usage.User.Seconds())
+		fmt.Fprintf(w, "ebpf_bench_cpu_seconds_total{mode=\"system\"} %g\n", usage.System.Seconds())
+		fmt.Fprintf(w, "# HELP ebpf_bench_max_rss_bytes Peak resident set size\n# TYPE ebpf_bench_max_rss_bytes gauge\n")
+		fmt.Fprintf(w, "ebpf_bench_max_rss_bytes %d\n", usage.MaxRSS)
+	}
+	// runtime/metrics, unlike ReadMemStats, does not stop the world under
+	// the benchmark at every scrape
+	heap := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(heap)
+	if heap[0].Value.Kind() == metrics.KindUint64 {
+		fmt.Fprintf(w, "# HELP ebpf_bench_memory_alloc_bytes Live heap allocation\n# TYPE ebpf_bench_memory_alloc_bytes gauge\n")
+		fmt.Fprintf(w, "ebpf_bench_memory_alloc_bytes %d\n", heap[0].Value.Uint64())
+	}
+}
+
+// writeMetric writes one per-benchmark metric family
+func writeMetric(w io.Writer, name, kind, help string, progress []*Progress, value func(*Progress) float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, p := range progress {
+		fmt.Fprintf(w, "%s{benchmark=%q} %g\n", name, p.benchmark, value(p))
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// vulnerabilitiesDir lists CPU vulnerabilities and their mitigation status
+const vulnerabilitiesDir = "/sys/devices/system/cpu/vulnerabilities"
+
+// readVulnerabilities returns the status line of every CPU vulnerability
+// the kernel knows about, keyed by vulnerability name
+func readVulnerabilities() map[string]string {
+	entries, err := os.ReadDir(vulnerabilitiesDir)
+	if err != nil {
+		return nil
+	}
+	vulns := make(map[string]string, len(entries))
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(vulnerabilitiesDir, e.Name()))
+		if err != nil {
+			continue
+		}
+		vulns[e.Name()] = strings.TrimSpace(string(data))
+	}
+	return vulns
+}
+
+// mitigationProfile summarises mitigation state as a short label used to
+// group results, e.g. "auto:5M/1V" for the default mode with five mitigated
+// and one unmitigated vulnerability. Hosts with the same label are
+// comparable as far as mitigations are concerned.
+func mitigationProfile(cmdlineParams []string, vulns map[string]string) string {
+	if len(vulns) == 0 {
+		return "unknown"
+	}
+
+	mode := "auto"
+	for _, p := range cmdlineParams {
+		if v, ok := strings.CutPrefix(p, "mitigations="); ok {
+			mode, _, _ = strings.Cut(v, ",")
+		}
+	}
+
+	var mitigated, vulnerable int
+	for _, status := range vulns {
+		switch {
+		case strings.HasPrefix(status, "Mitigation"):
+			mitigated++
+		case strings.HasPrefix(status, "Vulnerable"):
+			vulnerable++
+		}
+	}
+	return fmt.Sprintf("%s:%dM/%dV", mode, mitigated, vulnerable)
+}
+
+// runMitigationsReport groups result files by mitigation profile and
+// compares throughput of the same benchmark across profiles
+func runMitigationsReport(args []string) error {
+	fs := flag.NewFlagSet("mitigations", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: mitigations [flags] result.json...\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		host := CollectHostInfo()
+		PrintBenchmarkHeader("CPU Vulnerability Mitigations")
+		fmt.Printf("Profile: %s\n\n", host.MitigationProfile)
+		names := make([]string, 0, len(host.Vulnerabilities))
+		for name := range host.Vulnerabilities {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("  %-28s %s\n", name, host.Vulnerabilities[name])
+		}
+		return nil
+	}
+
+	// benchmark name -> mitigation profile -> throughputs
+	groups := make(map[string]map[string][]float64)
+	for _, file := range fs.Args() {
+		results, err := LoadResultsFromJSON(file)
+		if err != nil {
+			return err
+		}
+		for _, r := range results {
+			profile := r.Host.MitigationProfile
+			if profile == "" {
+				profile = "unknown"
+			}
+			if groups[r.Name] == nil {
+				groups[r.Name] = make(map[string][]float64)
+			}
+			groups[r.Name][profile] = append(groups[r.Name][profile], r.Throughput)
+		}
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	PrintSeparator()
+	fmt.Printf("%-36s %-28s %6s %15s %9s\n", "Benchmark", "Mitigation Profile", "Runs", "Throughput", "Delta")
+	for _, name := range names {
+		profiles := make([]string, 0, len(groups[name]))
+		for p := range groups[name] {
+			profiles = append(profiles, p)
+		}
+		sort.Strings(profiles)
+
+		// Deltas are relative to the first profile in sort order
+		var reference float64
+		for i, p := range profiles {
+			mean := meanOf(groups[name][p])
+			delta := "-"
+			if i == 0 {
+				reference = mean
+			} else if reference > 0 {
+				delta = fmt.Sprintf("%+.1f%%", (mean-reference)/reference*100)
+			}
+			fmt.Printf("%-36s %-28s %6d %15.0f %9s\n", name, p, len(groups[name][p]), mean, delta)
+		}
+	}
+	PrintSeparator()
+	return nil
+}
+
+// meanOf returns the arithmetic mean of values
+func meanOf(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Loss causes a mock script can inject
+const (
+	mockLossReserve = "reserve" // bpf_ringbuf_reserve failed
+	mockLossLost    = "lost"    // PERF_RECORD_LOST
+)
+
+// defaultMockScript exercises steady delivery on two CPUs, kernel-side
+// losses of both kinds and a burst that overruns the default buffer
+const defaultMockScript = `
+# Steady tracepoint events on CPU 0, kprobe events on CPU 1
+emit 10000 interval 10us delay 2us cpu 0
+emit 10000 interval 10us delay 5us cpu 1 type kprobe
+lose 100 cause reserve
+idle 1ms
+# A burst: 5000 events stamped together, read late
+emit 5000 interval 0 delay 50us cpu 0
+lose 20 cause lost
+`
+
+// eventReader is the consumer end of a delivery path: Read hands over the
+// events that became readable and the kernel-side losses since the
+// previous Read. io.EOF ends the stream.
+type eventReader interface {
+	Read(buf []Event) (int, DropCounts, error)
+}
+
+// consumeReader hands everything r delivers to add, up to len(buf) events
+// per read, until r ends or ctx is done. add is typically an EventBuffer's
+// Add, or a ShardedEventBuffer's through shardByCPU. It returns the
+// kernel-side losses r reported.
+func consumeReader(ctx context.Context, r eventReader, add func(Event) bool, buf []Event) (DropCounts, error) {
+	var kernel DropCounts
+	for ctx.Err() == nil {
+		n, lost, err := r.Read(buf)
+		kernel.ReserveFailed += lost.ReserveFailed
+		kernel.LostSamples += lost.LostSamples
+		for _, e := range buf[:n] {
+			add(e)
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return kernel, err
+		}
+	}
+	return kernel, nil
+}
+
+// shardByCPU adds events to sb in the shard of the CPU that emitted them
+func shardByCPU(sb *ShardedEventBuffer) func(Event) bool {
+	return func(e Event) bool { return sb.Add(int(e.CPU), e) }
+}
+
+// mockStep is one line of a mock script:
+//
+//	emit N [interval D] [delay D] [cpu C] [type T] [pid P]
+//	lose N [cause reserve|lost]
+//	idle D
+//
+// emit stamps N events interval apart, each readable delay after its
+// stamp; lose counts N events the kernel never delivered; idle advances
+// the clock.
+type mockStep struct {
+	op        string
+	count     int
+	interval  time.Duration
+	delay     time.Duration
+	cpu       uint32
+	eventType uint32
+	pid       uint32
+	cause     string
+	idle      time.Duration
+}
+
+// parseMockScript reads a script, one step per line; # starts a comment
+func parseMockScript(r io.Reader) ([]mockStep, error) {
+	byName := make(map[string]uint32, len(eventTypeNames))
+	for t, name := range eventTypeNames {
+		byName[name] = t
+	}
+	var steps []mockStep
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		step, err := parseMockStep(fields, byName)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		steps = append(steps, step)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("script has no steps")
+	}
+	return steps, nil
+}
+
+func parseMockStep(fields []string, eventTypes map[string]uint32) (mockStep, error) {
+	step := mockStep{op: fields[0], eventType: eventTypeTracepoint, cause: mockLossReserve, pid: uint32(os.Getpid())}
+	args := fields[1:]
+	switch step.op {
+	case "emit", "lose":
+		if len(args) == 0 {
+			return step, fmt.Errorf("%s needs a count", step.op)
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return step, fmt.Errorf("invalid %s count %q", step.op, args[0])
+		}
+		step.count = n
+		args = args[1:]
+	case "idle":
+		if len(args) != 1 {
+			return step, fmt.Errorf("idle needs one duration")
+		}
+		d, err := time.ParseDuration(args[0])
+		if err != nil || d < 0 {
+			return step, fmt.Errorf("invalid idle duration %q", args[0])
+		}
+		step.idle = d
+		return step, nil
+	default:
+		return step, fmt.Errorf("unknown step %q (want emit, lose or idle)", step.op)
+	}
+	if len(args)%2 != 0 {
+		return step, fmt.Errorf("%s options come in key value pairs", step.op)
+	}
+	for i := 0; i < len(args); i += 2 {
+		key, value := args[i], args[i+1]
+		var err error
+		switch {
+		case step.op == "emit" && (key == "interval" || key == "delay"):
+			var d time.Duration
+			if d, err = time.ParseDuration(value); err == nil && d < 0 {
+				err = fmt.Errorf("negative")
+			}
+			if key == "interval" {
+				step.interval = d
+			} else {
+				step.delay = d
+			}
+		case step.op == "emit" && (key == "cpu" || key == "pid"):
+			var n uint64
+			n, err = strconv.ParseUint(value, 10, 32)
+			if key == "cpu" {
+				step.cpu = uint32(n)
+			} else {
+				step.pid = uint32(n)
+			}
+		case step.op == "emit" && key == "type":
+			t, ok := eventTypes[value]
+			if !ok {
+				err = fmt.Errorf("unknown event type")
+			}
+			step.eventType = t
+		case step.op == "lose" && key == "cause":
+			if value != mockLossReserve && value != mockLossLost {
+				err = fmt.Errorf("want %s or %s", mockLossReserve, mockLossLost)
+			}
+			step.cause = value
+		default:
+			return step, fmt.Errorf("unknown %s option %q", step.op, key)
+		}
+		if err != nil {
+			return step, fmt.Errorf("invalid %s %q: %v", key, value, err)
+		}
+	}
+	return step, nil
+}
+
+// addLoss counts n events lost for cause
+func (d *DropCounts) addLoss(cause string, n int64) {
+	if cause == mockLossLost {
+		d.LostSamples += n
+	} else {
+		d.ReserveFailed += n
+	}
+}
+
+// mockClock is a virtual clock that only moves when the script does, so
+// every duration of a mock run is exact and repeatable
+type mockClock struct {
+	ns int64
+}
+
+func (c *mockClock) Now() time.Time { return time.Unix(0, c.ns) }
+
+// mockReader plays a script as an eventReader. Events emitted by the
+// script are lost at random with probability loss, as injected kernel
+// drops of cause lossCause.
+type mockReader struct {
+	steps     []mockStep
+	clock     *mockClock
+	loss      float64
+	lossCause string
+	rng       randomPayload
+
+	step    int
+	emitted int   // Events of the current emit step handed out or lost
+	base    int64 // Kernel timestamp of the current step's first event
+	seq     uint32
+	pending DropCounts // Losses not yet reported by Read
+
+	generated int64 // Every event the script produced, delivered or not
+	injected  int64 // Events lost to the loss probability
+}
+
+func newMockReader(steps []mockStep, clock *mockClock, loss float64, lossCause string, seed uint64) *mockReader {
+	return &mockReader{steps: steps, clock: clock, loss: loss, lossCause: lossCause,
+		rng: randomPayload{state: seed | 1}, base: -1}
+}
+
+// Read hands over up to len(buf) events of the current emit step,
+// advancing the clock to when the last of them became readable
+func (m *mockReader) Read(buf []Event) (int, DropCounts, error) {
+	n := 0
+	for n == 0 && m.step < len(m.steps) {
+		s := &m.steps[m.step]
+		switch s.op {
+		case "lose":
+			m.pending.addLoss(s.cause, int64(s.count))
+			m.generated += int64(s.count)
+			m.step++
+			continue
+		case "idle":
+			m.clock.ns += s.idle.Nanoseconds()
+			m.step++
+			continue
+		}
+		if m.base < 0 {
+			m.base = m.clock.ns
+		}
+		for n < len(buf) && m.emitted < s.count {
+			ts := m.base + int64(m.emitted)*s.interval.Nanoseconds()
+			m.emitted++
+			m.generated++
+			m.clock.ns = max(m.clock.ns, ts+s.delay.Nanoseconds())
+			if m.loss > 0 && float64(m.rng.next()>>11)/(1<<53) < m.loss {
+				m.pending.addLoss(m.lossCause, 1)
+				m.injected++
+				continue
+			}
+			buf[n] = Event{Timestamp: uint64(ts), PID: s.pid, CPU: s.cpu, EventType: s.eventType, Data: m.seq}
+			m.seq++
+			n++
+		}
+		if m.emitted == s.count {
+			m.step, m.emitted, m.base = m.step+1, 0, -1
+		}
+	}
+	lost := m.pending
+	m.pending = DropCounts{}
+	if n == 0 && m.step == len(m.steps) {
+		return 0, lost, io.EOF
+	}
+	return n, lost, nil
+}
+
+// MockBenchmark drives the statistics, drop accounting and reporting of
+// the real benchmarks from a scripted reader on a virtual clock: no
+// privileges, no particular kernel, and exactly the same numbers on every
+// run. With check set, the result is compared with what the script
+// implies, so the pipeline can be verified in CI.
+type MockBenchmark struct {
+	benchRunner
+	steps     []mockStep
+	reader    *mockReader
+	clock     *mockClock
+	buffer    *EventBuffer
+	readBatch int
+	loss      float64
+	check     bool
+	verbose   bool
+	result    *BenchmarkResult
+}
+
+// Run replays the script until it ends or ctx is done
+func (b *MockBenchmark) Run(ctx context.Context) error {
+	if b.verbose {
+		PrintBenchmarkHeader("Mock Pipeline (Go)")
+	}
+	log := benchLog(ctx)
+	log.Info("Replaying script", "steps", len(b.steps), "read_batch", b.readBatch, "loss", b.loss)
+
+	b.clock.ns = time.Now().UnixNano()
+	b.buffer.SetClock(b.clock.Now)
+	b.result.StartTime = b.clock.Now()
+	b.buffer.Start()
+
+	kernel, err := consumeReader(ctx, b.reader, b.buffer.Add, make([]Event, b.readBatch))
+	if err != nil {
+		return err
+	}
+	markInterrupted(ctx, b.result)
+
+	b.buffer.End()
+	b.result.EndTime = b.clock.Now()
+
+	r := b.result
+	r.Duration = b.buffer.GetDuration()
+	r.EventCount = b.buffer.GetEventCount()
+	drops := b.buffer.GetDropCounts()
+	drops.ReserveFailed += kernel.ReserveFailed
+	drops.LostSamples += kernel.LostSamples
+	r.RecordDrops(drops)
+	r.Throughput = b.buffer.GetThroughput()
+	r.Latency = b.buffer.GetLatencyStats()
+	r.LatencyHistogram = b.buffer.GetLatencyHistogram(DefaultHistogramPrecision).Buckets()
+	r.Quality.Merge(b.buffer.GetDataQuality())
+	r.EventTypes = b.buffer.GetEventTypeStats()
+	r.recordCPUs(b.buffer)
+	r.recordDelivery(b.buffer)
+	if ctx.Err() == nil {
+		r.recordTeardown(b.reader.generated, 0, 0)
+	}
+
+	if b.check && ctx.Err() == nil {
+		if err := b.verify(); err != nil {
+			return err
+		}
+		log.Info("Result matches the script")
+	}
+	return nil
+}
+
+// verify compares the result with what the script implies, computed from
+// the steps alone rather than from the reader's counters. Only the
+// injected losses, which are random, are taken from the reader.
+func (b *MockBenchmark) verify() error {
+	var emitted, span int64
+	var scripted DropCounts
+	minDelay, maxDelay := int64(math.MaxInt64), int64(-1)
+	for _, s := range b.steps {
+		switch s.op {
+		case "emit":
+			if s.count == 0 {
+				continue
+			}
+			emitted += int64(s.count)
+			span += int64(s.count-1)*s.interval.Nanoseconds() + s.delay.Nanoseconds()
+			minDelay = min(minDelay, s.delay.Nanoseconds())
+			maxDelay = max(maxDelay, s.delay.Nanoseconds())
+		case "lose":
+			scripted.addLoss(s.cause, int64(s.count))
+		case "idle":
+			span += s.idle.Nanoseconds()
+		}
+	}
+	offered := emitted - b.reader.injected
+	kept := min(offered, int64(b.buffer.maxSize))
+	if b.buffer.stream != nil {
+		kept = offered // A streaming buffer never fills
+	}
+	expected := scripted
+	expected.addLoss(b.reader.lossCause, b.reader.injected)
+	if b.buffer.policy == DropOldest {
+		expected.Overwritten = offered - kept
+	} else {
+		expected.BufferFull = offered - kept
+	}
+
+	r := b.result
+	var errs []error
+	mismatch := func(what string, got, want any) {
+		errs = append(errs, fmt.Errorf("%s: got %v, script implies %v", what, got, want))
+	}
+	if r.EventCount != kept {
+		mismatch("EventCount", r.EventCount, kept)
+	}
+	if r.Drops != expected {
+		mismatch("Drops", r.Drops, expected)
+	}
+	if got := int64(math.Round(r.Duration * 1e9)); got != span {
+		mismatch("Duration", time.Duration(got), time.Duration(span))
+	}
+	if r.Duration > 0 && math.Abs(r.Throughput-float64(r.EventCount)/r.Duration) > 1e-6*r.Throughput {
+		mismatch("Throughput", r.Throughput, float64(r.EventCount)/r.Duration)
+	}
+	var perCPU int64
+	for _, c := range r.CPUs {
+		perCPU += c.EventCount
+	}
+	if len(r.CPUs) > 0 && perCPU != r.EventCount {
+		mismatch("sum of per-CPU events", perCPU, r.EventCount)
+	}
+	// Readers taking one event at a time see exactly the scripted delays
+	if d := r.DeliveryLatency; b.readBatch == 1 && b.loss == 0 && d != nil {
+		if int64(d.MinNs) != minDelay {
+			mismatch("delivery latency min", time.Duration(d.MinNs), time.Duration(minDelay))
+		}
+		if int64(d.MaxNs) != maxDelay {
+			mismatch("delivery latency max", time.Duration(d.MaxNs), time.Duration(maxDelay))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("result does not match the script: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Start runs the benchmark in the background
+func (b *MockBenchmark) Start(ctx context.Context) error {
+	return b.start(ctx, b.Run)
+}
+
+// Wait returns the result once the benchmark has finished
+func (b *MockBenchmark) Wait() (*BenchmarkResult, error) {
+	return b.result, b.wait()
+}
+
+// runMockBenchmark is the entry point of the mock subcommand
+func runMockBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("mock", flag.ExitOnError)
+	common := addBenchFlags(fs, "mock_result.json", false)
+	scriptFile := fs.String("script", "", "Script of emit, lose and idle steps to replay (- for stdin; default: a built-in script)")
+	bufferSize := fs.Int("buffer-size", 20000, "Userspace event buffer capacity in events")
+	readBatch := fs.Int("read-batch", 1, "Events handed over per read; above 1 later events in a batch wait for the last")
+	loss := fs.Float64("loss", 0, "Probability of losing each emitted event in the kernel")
+	lossCause := fs.String("loss-cause", mockLossReserve, "Cause of injected losses ("+mockLossReserve+", "+mockLossLost+")")
+	seed := fs.Uint64("seed", 1, "Seed of the injected losses")
+	dropPolicy := fs.String("drop-policy", string(DropNewest), "Full-buffer policy (drop-new, drop-old)")
+	streaming := fs.Bool("streaming", false, "Compute statistics online instead of keeping events")
+	quantiles := fs.String("quantiles", "0.5,0.9,0.99,0.999", "Comma-separated latency quantiles to report")
+	check := fs.Bool("check", true, "Fail when the result differs from what the script implies")
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+	var script io.Reader = strings.NewReader(defaultMockScript)
+	switch *scriptFile {
+	case "":
+	case "-":
+		script = os.Stdin
+	default:
+		f, err := os.Open(*scriptFile)
+		if err != nil {
+			return nil, opts, err
+		}
+		defer f.Close()
+		script = f
+	}
+	steps, err := parseMockScript(script)
+	if err != nil {
+		return nil, opts, fmt.Errorf("invalid -script: %w", err)
+	}
+	if *bufferSize <= 0 {
+		return nil, opts, fmt.Errorf("-buffer-size must be positive")
+	}
+	if *readBatch <= 0 {
+		return nil, opts, fmt.Errorf("-read-batch must be positive")
+	}
+	if *loss < 0 || *loss >= 1 {
+		return nil, opts, fmt.Errorf("-loss must be in [0, 1)")
+	}
+	if *lossCause != mockLossReserve && *lossCause != mockLossLost {
+		return nil, opts, fmt.Errorf("invalid -loss-cause %q (want %s or %s)", *lossCause, mockLossReserve, mockLossLost)
+	}
+	policy, err := ParseDropPolicy(*dropPolicy)
+	if err != nil {
+		return nil, opts, fmt.Errorf("invalid -drop-policy: %w", err)
+	}
+	if policy == DropBlock {
+		return nil, opts, fmt.Errorf("-drop-policy block waits on the wall clock for a consumer, which a mock run has neither of")
+	}
+	qs, err := ParseQuantiles(*quantiles)
+	if err != nil {
+		return nil, opts, fmt.Errorf("invalid -quantiles: %w", err)
+	}
+
+	eb := NewEventBuffer(*bufferSize)
+	if *streaming {
+		eb = NewStreamingEventBuffer()
+	}
+	eb.SetDropPolicy(policy, DefaultBlockTimeout)
+	eb.SetQuantiles(qs)
+	eb.SetProgress(NewProgress("mock"))
+
+	clock := &mockClock{}
+	reader := newMockReader(steps, clock, *loss, *lossCause, *seed)
+	bench := &MockBenchmark{
+		steps:     steps,
+		reader:    reader,
+		clock:     clock,
+		buffer:    eb,
+		readBatch: *readBatch,
+		loss:      *loss,
+		check:     *check,
+		verbose:   opts.Verbose,
+		result: &BenchmarkResult{
+			Name:           "Mock Pipeline",
+			Language:       "Go",
+			ProgramType:    "mock",
+			DataMechanism:  "scripted reader",
+			ReaderStrategy: fmt.Sprintf("batch-%d", *readBatch),
+			Errors:         []string{},
+			Host:           CollectHostInfo(),
+			WorkloadSetup:  WorkloadSetup{DropPolicy: string(policy)},
+		},
+	}
+	if err := bench.Start(ctx); err != nil {
+		return nil, opts, err
+	}
+	r, err := bench.Wait()
+	if err != nil {
+		return nil, opts, err
+	}
+	return []*BenchmarkResult{r}, opts, nil
+}
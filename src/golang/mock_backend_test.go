@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// playScript parses script and reads it into add on a virtual clock that
+// eb, if set, follows. It returns the kernel-side losses and the reader.
+func playScript(t *testing.T, script string, eb *EventBuffer, add func(Event) bool, batch int) (DropCounts, *mockReader) {
+	t.Helper()
+	steps, err := parseMockScript(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &mockClock{ns: 1e9}
+	reader := newMockReader(steps, clock, 0, mockLossReserve, 1)
+	if eb != nil {
+		eb.SetClock(clock.Now)
+		eb.Start()
+	}
+	kernel, err := consumeReader(context.Background(), reader, add, make([]Event, batch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eb != nil {
+		eb.End()
+	}
+	return kernel, reader
+}
+
+const testScript = `
+emit 300 interval 10us delay 2us cpu 0
+lose 7 cause reserve
+emit 200 interval 10us delay 5us cpu 1 type kprobe
+idle 1ms
+lose 3 cause lost
+`
+
+// TestMockScriptEventBuffer reads a script into buffers too small for it
+// and checks what each drop policy kept and counted
+func TestMockScriptEventBuffer(t *testing.T) {
+	tests := []struct {
+		policy DropPolicy
+		drops  DropCounts
+	}{
+		{DropNewest, DropCounts{BufferFull: 100}},
+		{DropOldest, DropCounts{Overwritten: 100}},
+	}
+	for _, tt := range tests {
+		for _, batch := range []int{1, 64} {
+			eb := NewEventBuffer(400)
+			eb.SetDropPolicy(tt.policy, DefaultBlockTimeout)
+			kernel, reader := playScript(t, testScript, eb, eb.Add, batch)
+
+			if want := (DropCounts{ReserveFailed: 7, LostSamples: 3}); kernel != want {
+				t.Errorf("%s/batch %d: kernel drops %+v, want %+v", tt.policy, batch, kernel, want)
+			}
+			if reader.generated != 510 {
+				t.Errorf("%s/batch %d: generated %d events, want 510", tt.policy, batch, reader.generated)
+			}
+			if n := eb.GetEventCount(); n != 400 {
+				t.Errorf("%s/batch %d: kept %d events, want 400", tt.policy, batch, n)
+			}
+			if got := eb.GetDropCounts(); got != tt.drops {
+				t.Errorf("%s/batch %d: buffer drops %+v, want %+v", tt.policy, batch, got, tt.drops)
+			}
+			if q := eb.GetDataQuality(); !q.OK() {
+				t.Errorf("%s/batch %d: quality %v, want ok", tt.policy, batch, q)
+			}
+		}
+	}
+}
+
+// TestEventBufferBlock fills a buffer under the block policy and checks
+// that an Add waits for a Release from another goroutine, and is rejected
+// once the timeout passes without one
+func TestEventBufferBlock(t *testing.T) {
+	eb := NewEventBuffer(2)
+	eb.SetDropPolicy(DropBlock, 5*time.Millisecond)
+	eb.Start()
+	for i := 0; i < 2; i++ {
+		if !eb.Add(Event{Data: uint32(i)}) {
+			t.Fatalf("event %d rejected by a buffer with room", i)
+		}
+	}
+	if eb.Add(Event{Data: 2}) {
+		t.Fatal("event added to a full buffer nobody released")
+	}
+
+	eb.SetDropPolicy(DropBlock, 10*time.Second)
+	released := make(chan int)
+	go func() {
+		time.Sleep(time.Millisecond)
+		released <- eb.Release(1)
+	}()
+	if !eb.Add(Event{Data: 3}) {
+		t.Fatal("event rejected after the consumer released space")
+	}
+	if n := <-released; n != 1 {
+		t.Errorf("released %d events, want 1", n)
+	}
+	if n := eb.GetEventCount(); n != 3 {
+		t.Errorf("kept %d events, want 3", n)
+	}
+	if got, want := eb.GetDropCounts(), (DropCounts{BlockTimeouts: 1}); got != want {
+		t.Errorf("drops %+v, want %+v", got, want)
+	}
+}
+
+// TestMockScriptDuration checks that the buffer's window is the script's
+// span on the virtual clock
+func TestMockScriptDuration(t *testing.T) {
+	eb := NewEventBuffer(1000)
+	playScript(t, testScript, eb, eb.Add, 1)
+	// 299 intervals + 2us, then 199 intervals + 5us, then 1ms idle
+	const want = 299*10e-6 + 2e-6 + 199*10e-6 + 5e-6 + 1e-3
+	if d := eb.GetDuration(); d < want-1e-12 || d > want+1e-12 {
+		t.Errorf("duration %gs, want %gs", d, want)
+	}
+	stats := eb.GetEventTypeStats()
+	var kprobes int64
+	for _, s := range stats {
+		if s.EventType == eventTypeKprobe {
+			kprobes = s.EventCount
+		}
+	}
+	if kprobes != 200 {
+		t.Errorf("%d kprobe events, want 200", kprobes)
+	}
+}
+
+// TestMockScriptZeroDuration stamps a burst at one instant, read without
+// delay: the events span no time, which the buffer must flag
+func TestMockScriptZeroDuration(t *testing.T) {
+	eb := NewEventBuffer(100)
+	playScript(t, "emit 50 interval 0 delay 0", eb, eb.Add, 16)
+	if n := eb.GetEventCount(); n != 50 {
+		t.Errorf("kept %d events, want 50", n)
+	}
+	if q := eb.GetDataQuality(); !reflect.DeepEqual(q.Flags, []string{QualityZeroDuration}) {
+		t.Errorf("quality %v, want %s", q, QualityZeroDuration)
+	}
+}
+
+// TestMockScriptShardedBuffer reads a script on two CPUs into per-CPU
+// shards, one of which fills
+func TestMockScriptShardedBuffer(t *testing.T) {
+	sb := NewShardedEventBuffer(2, 500) // 250 events a shard
+	sb.Start()
+	kernel, _ := playScript(t, testScript, nil, shardByCPU(sb), 32)
+	sb.End()
+	merged := sb.Merge()
+
+	if want := (DropCounts{ReserveFailed: 7, LostSamples: 3}); kernel != want {
+		t.Errorf("kernel drops %+v, want %+v", kernel, want)
+	}
+	// CPU 0 emitted 300 into 250 slots; CPU 1's 200 all fit
+	if n := merged.GetEventCount(); n != 450 {
+		t.Errorf("kept %d events, want 450", n)
+	}
+	if n := merged.GetDroppedCount(); n != 50 {
+		t.Errorf("dropped %d events, want 50", n)
+	}
+	var perCPU [2]int64
+	for _, e := range merged.ordered() {
+		perCPU[e.CPU]++
+	}
+	if perCPU != [2]int64{250, 200} {
+		t.Errorf("events per CPU %v, want [250 200]", perCPU)
+	}
+	var q DataQuality
+	if merged.latencySamples(&q); !q.OK() {
+		t.Errorf("quality %v, want ok", q)
+	}
+}
+
+// TestMockBenchmarkCheck runs the mock benchmark's own check of the result
+// against the default script
+func TestMockBenchmarkCheck(t *testing.T) {
+	steps, err := parseMockScript(strings.NewReader(defaultMockScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		batch     int
+		loss      float64
+		policy    DropPolicy
+		streaming bool
+	}{
+		{1, 0, DropNewest, false},
+		{16, 0, DropOldest, false},
+		{1, 0.01, DropNewest, false},
+		{8, 0.05, DropNewest, true},
+	} {
+		eb := NewEventBuffer(20000)
+		if tt.streaming {
+			eb = NewStreamingEventBuffer()
+		}
+		eb.SetDropPolicy(tt.policy, DefaultBlockTimeout)
+		clock := &mockClock{}
+		b := &MockBenchmark{
+			steps:     steps,
+			reader:    newMockReader(steps, clock, tt.loss, mockLossLost, 1),
+			clock:     clock,
+			buffer:    eb,
+			readBatch: tt.batch,
+			loss:      tt.loss,
+			check:     true,
+			result:    &BenchmarkResult{Errors: []string{}},
+		}
+		if err := b.Run(context.Background()); err != nil {
+			t.Errorf("%+v: %v", tt, err)
+		}
+	}
+}
+
+func TestParseMockScriptErrors(t *testing.T) {
+	for _, script := range []string{
+		"",
+		"# only a comment",
+		"emit",
+		"emit -1",
+		"emit 10 interval",
+		"emit 10 delay -1us",
+		"emit 10 type nosuch",
+		"lose 5 cause other",
+		"lose 5 cpu 1",
+		"idle",
+		"idle soon",
+		"wait 1ms",
+	} {
+		if _, err := parseMockScript(strings.NewReader(script)); err == nil {
+			t.Errorf("%q parsed without error", script)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// rtnetlink attributes and tc handles for the veth pairs and clsact hooks
+// of the packet benchmarks, which the syscall package does not export
+const (
+	iflaInfoKind    = 1 // IFLA_INFO_KIND
+	iflaInfoData    = 2 // IFLA_INFO_DATA
+	vethInfoPeer    = 1 // VETH_INFO_PEER
+	nlaFNested      = 0x8000
+	tcaKind         = 1 // TCA_KIND
+	tcaOptions      = 2 // TCA_OPTIONS
+	tcaBPFFD        = 6 // TCA_BPF_FD
+	tcaBPFName      = 7 // TCA_BPF_NAME
+	tcaBPFFlags     = 8 // TCA_BPF_FLAGS
+	tcaBPFActDirect = 1 // TCA_BPF_FLAG_ACT_DIRECT: the program's return is the action
+	tcHClsact       = 0xfffffff1
+	tcHMinIngress   = 0xfff2
+	tcHMinEgress    = 0xfff3
+	ethPAll         = 0x0003
+	sizeofTcmsg     = 20
+)
+
+// nlMsg builds one rtnetlink request
+type nlMsg struct {
+	buf []byte
+}
+
+// newNLMsg starts a request of typ with its fixed header
+func newNLMsg(typ uint16, flags uint16, header []byte) *nlMsg {
+	m := &nlMsg{buf: make([]byte, syscall.SizeofNlMsghdr, 256)}
+	binary.LittleEndian.PutUint16(m.buf[4:], typ)
+	binary.LittleEndian.PutUint16(m.buf[6:], flags|syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	m.buf = append(m.buf, header...)
+	return m
+}
+
+// attr appends an attribute, padded to four bytes
+func (m *nlMsg) attr(typ uint16, data []byte) {
+	var hdr [syscall.SizeofRtAttr]byte
+	binary.LittleEndian.PutUint16(hdr[0:], uint16(syscall.SizeofRtAttr+len(data)))
+	binary.LittleEndian.PutUint16(hdr[2:], typ)
+	m.buf = append(append(m.buf, hdr[:]...), data...)
+	for len(m.buf)%4 != 0 {
+		m.buf = append(m.buf, 0)
+	}
+}
+
+// nest appends an attribute holding whatever fill appends
+func (m *nlMsg) nest(typ uint16, fill func()) {
+	start := len(m.buf)
+	m.attr(typ|nlaFNested, nil)
+	fill()
+	binary.LittleEndian.PutUint16(m.buf[start:], uint16(len(m.buf)-start))
+}
+
+func nlString(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func nlUint32(v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, v)
+}
+
+// ifInfomsg encodes the header of a link request
+func ifInfomsg(index int, flags, change uint32) []byte {
+	msg := syscall.IfInfomsg{Family: syscall.AF_UNSPEC, Index: int32(index), Flags: flags, Change: change}
+	return (*[syscall.SizeofIfInfomsg]byte)(unsafe.Pointer(&msg))[:]
+}
+
+// tcmsg encodes the header of a qdisc or filter request
+func tcmsg(ifindex int, handle, parent, info uint32) []byte {
+	b := make([]byte, sizeofTcmsg)
+	binary.LittleEndian.PutUint32(b[4:], uint32(ifindex))
+	binary.LittleEndian.PutUint32(b[8:], handle)
+	binary.LittleEndian.PutUint32(b[12:], parent)
+	binary.LittleEndian.PutUint32(b[16:], info)
+	return b
+}
+
+// send issues the request on a fresh NETLINK_ROUTE socket and returns the
+// kernel's acknowledgement
+func (m *nlMsg) send() error {
+	binary.LittleEndian.PutUint32(m.buf[0:], uint32(len(m.buf)))
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("netlink socket: %w", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Sendto(fd, m.buf, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("netlink send: %w", err)
+	}
+	reply := make([]byte, 4096)
+	n, _, err := syscall.Recvfrom(fd, reply, 0)
+	if err != nil {
+		return fmt.Errorf("netlink receive: %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(reply[:n])
+	if err != nil {
+		return fmt.Errorf("netlink reply: %w", err)
+	}
+	for _, msg := range msgs {
+		if msg.Header.Type == syscall.NLMSG_ERROR && len(msg.Data) >= 4 {
+			if errno := -int32(binary.LittleEndian.Uint32(msg.Data)); errno != 0 {
+				return syscall.Errno(errno)
+			}
+			return nil
+		}
+	}
+	return errors.New("netlink: no acknowledgement")
+}
+
+// vethPair is a veth pair created for a run: frames written to one end
+// arrive on the other. Close deletes it, and with it any program or
+// qdisc attached.
+type vethPair struct {
+	names   [2]string
+	ifindex [2]int
+}
+
+// createVethPair creates and brings up the pair name and peer, as
+// ip link add name type veth peer name peer does
+func createVethPair(name, peer string) (*vethPair, error) {
+	m := newNLMsg(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, ifInfomsg(0, 0, 0))
+	m.attr(syscall.IFLA_IFNAME, nlString(name))
+	m.nest(syscall.IFLA_LINKINFO, func() {
+		m.attr(iflaInfoKind, nlString("veth"))
+		m.nest(iflaInfoData, func() {
+			m.nest(vethInfoPeer, func() {
+				m.buf = append(m.buf, ifInfomsg(0, 0, 0)...)
+				m.attr(syscall.IFLA_IFNAME, nlString(peer))
+			})
+		})
+	})
+	if err := m.send(); err != nil {
+		if errors.Is(err, syscall.EEXIST) {
+			return nil, fmt.Errorf("create veth %s: an interface of that name exists; delete it with ip link del %s", name, name)
+		}
+		return nil, fmt.Errorf("create veth %s: %w", name, err)
+	}
+	v := &vethPair{names: [2]string{name, peer}}
+	for i, n := range v.names {
+		iface, err := net.InterfaceByName(n)
+		if err != nil {
+			v.Close()
+			return nil, err
+		}
+		v.ifindex[i] = iface.Index
+		up := newNLMsg(syscall.RTM_NEWLINK, 0, ifInfomsg(iface.Index, syscall.IFF_UP, syscall.IFF_UP))
+		if err := up.send(); err != nil {
+			v.Close()
+			return nil, fmt.Errorf("set %s up: %w", n, err)
+		}
+	}
+	return v, nil
+}
+
+// Close deletes the pair; deleting one end deletes both
+func (v *vethPair) Close() error {
+	m := newNLMsg(syscall.RTM_DELLINK, 0, ifInfomsg(0, 0, 0))
+	m.attr(syscall.IFLA_IFNAME, nlString(v.names[0]))
+	return m.send()
+}
+
+// attachClsact attaches prog as a direct-action cls_bpf filter on the
+// clsact ingress or egress hook of ifindex, adding the clsact qdisc first,
+// as tc qdisc add dev DEV clsact and tc filter add dev DEV ingress bpf da
+// do
+func attachClsact(ifindex int, egress bool, prog int, name string) error {
+	qdisc := newNLMsg(syscall.RTM_NEWQDISC, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, tcmsg(ifindex, tcHClsact&0xffff0000, tcHClsact, 0))
+	qdisc.attr(tcaKind, nlString("clsact"))
+	if err := qdisc.send(); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return fmt.Errorf("add clsact qdisc: %w", err)
+	}
+	parent := uint32(tcHClsact&0xffff0000 | tcHMinIngress)
+	if egress {
+		parent = tcHClsact&0xffff0000 | tcHMinEgress
+	}
+	const prio = 1
+	info := uint32(prio<<16) | uint32(ethPAll>>8|ethPAll&0xff<<8) // Protocol in network order
+	filter := newNLMsg(syscall.RTM_NEWTFILTER, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, tcmsg(ifindex, 0, parent, info))
+	filter.attr(tcaKind, nlString("bpf"))
+	filter.nest(tcaOptions, func() {
+		filter.attr(tcaBPFFD, nlUint32(uint32(prog)))
+		filter.attr(tcaBPFName, nlString(name))
+		filter.attr(tcaBPFFlags, nlUint32(tcaBPFActDirect))
+	})
+	if err := filter.send(); err != nil {
+		return fmt.Errorf("add bpf filter: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"runtime"
+	"time"
+)
+
+// packetProcessor models a packet program (XDP or TC). It returns the
+// program's verdict and the UDP payload offset, or 0 if the packet could not
+// be parsed.
+type packetProcessor func(frame []byte) (verdict uint32, payload int)
+
+// simVeth models a veth pair as a ring of preallocated frames: the
+// generator fills free slots on one end and the XDP program consumes them
+// on the other, returning slots once processed
+type simVeth struct {
+	frames [][]byte
+	free   chan int
+	rx     chan int
+}
+
+func newSimVeth(slots, frameSize int) *simVeth {
+	v := &simVeth{
+		frames: make([][]byte, slots),
+		free:   make(chan int, slots),
+		rx:     make(chan int, slots),
+	}
+	for i := range v.frames {
+		v.frames[i] = make([]byte, frameSize)
+		v.free <- i
+	}
+	return v
+}
+
+// simPacketNote is recorded on every XDP and TC result: no program is
+// attached, a userspace model of it processes frames crossing a simVeth
+func simPacketNote(programType string) string {
+	return programType + " program not attached: packets processed by a userspace model on a simulated veth pair"
+}
+
+// pipelineStats summarises one run of runPacketPipeline
+type pipelineStats struct {
+	received int64            // Packets parsed during the measurement window
+	sent     int64            // Packets written to a real veth during it; 0 in the simulation
+	samples  []uint64         // Per-packet generation-to-verdict latency (ns), up to maxSamples
+	latency  StreamingLatency // The same latency over every packet
+	// interrupted is set when ctx ended the run before its duration
+	interrupted bool
+	// start and end are process usage at the edges of the measured window
+	start, end ResourceSnapshot
+	verdicts   map[uint32]int64 // Packets per verdict
+	// coordination is the phase marker channel's cost, if measured
+	coordination *CoordinationStats
+	// generator is the generator goroutine's own usage, measured on its
+	// locked OS thread so it can be excluded from the consumer's budget
+	generator LoadGeneratorUsage
+}
+
+// Pipeline phases, shared with the generator through a phaseMarker
+const (
+	phaseWarmup int32 = iota
+	phaseMeasure
+	phaseCooldown
+)
+
+// runPacketPipeline drives generated packets through a simulated veth pair
+// into process for the given duration, or until ctx is done. Every parsed
+// packet is recorded in buffer as an Event of eventType, the same way the
+// kernel program would report it, so packet and syscall benchmarks share
+// one result pipeline. Packets of the warm-up and cooldown phases are
+// processed but not recorded. The phase reaches the generator and the
+// per-packet check through coord, an atomic when nil. The consumer and
+// generator threads are pinned as pin says, unless it is nil.
+func runPacketPipeline(ctx context.Context, phases Phases, coord *coordination, pin *cpuPinning, duration time.Duration, gen *PacketGenerator,
+	ringSize, maxSamples int, eventType uint32, buffer *EventBuffer, process packetProcessor) pipelineStats {
+
+	if pin != nil {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+	consumer := pin.pinConsumer()
+	defer consumer.release()
+
+	veth := newSimVeth(ringSize, gen.Size())
+	stats := pipelineStats{
+		samples:  make([]uint64, 0, 1024),
+		verdicts: make(map[uint32]int64),
+	}
+	genPhase, phase := coord.markers()
+	if phases.Warmup <= 0 {
+		phase.Store(phaseMeasure)
+	} else {
+		phase.Store(phaseWarmup) // A shared pin may hold a previous run's phase
+	}
+
+	// Packet generator: the peer end of the veth pair. Its usage is taken
+	// over the packets it generates in the measured window.
+	stop := make(chan struct{})
+	frameBytes := uint64(ringSize * gen.Size())
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		defer close(veth.rx)
+		defer pin.pinGenerator().release()
+		usage := newGeneratorUsage(genPhase.Load())
+		defer func() { stats.generator = usage.usage(frameBytes) }()
+		for {
+			usage.observe(genPhase.Load())
+			select {
+			case <-stop:
+				return
+			case idx := <-veth.free:
+				gen.Next(veth.frames[idx])
+				veth.rx <- idx
+			}
+		}
+	}()
+
+	startMeasuring := func(d time.Duration) <-chan time.Time {
+		stats.start, _ = TakeResourceSnapshot()
+		buffer.Start()
+		phase.Store(phaseMeasure)
+		return time.After(d)
+	}
+	stopMeasuring := func() {
+		buffer.End()
+		stats.end, _ = TakeResourceSnapshot()
+		phase.Store(phaseCooldown)
+	}
+
+	var deadline <-chan time.Time
+	if phase.Load() == phaseMeasure {
+		deadline = startMeasuring(duration)
+	} else {
+		deadline = time.After(phases.Warmup)
+	}
+	running := true
+	var packets uint64
+	for idx := range veth.rx {
+		if packets++; consumer != nil && packets%affinitySampleEvery == 0 {
+			consumer.observe()
+		}
+		if running {
+			select {
+			case <-deadline:
+				switch phase.Load() {
+				case phaseWarmup:
+					deadline = startMeasuring(duration)
+				case phaseMeasure:
+					stopMeasuring()
+					deadline = time.After(phases.Cooldown)
+				case phaseCooldown:
+					running = false
+					close(stop)
+				}
+			case <-ctx.Done():
+				if phase.Load() == phaseMeasure {
+					stopMeasuring()
+				}
+				stats.interrupted = true
+				running = false
+				close(stop)
+			default:
+			}
+		}
+
+		frame := veth.frames[idx]
+		verdict, payload := process(frame)
+		now := uint64(time.Now().UnixNano()) // Before the phase check, which may be a map lookup
+		if running && phase.Load() == phaseMeasure && payload > 0 {
+			sent := binary.LittleEndian.Uint64(frame[payload:])
+			stats.received++
+			stats.verdicts[verdict]++
+			if now >= sent {
+				stats.latency.Record(now - sent)
+				if len(stats.samples) < maxSamples {
+					stats.samples = append(stats.samples, now-sent)
+				}
+			}
+			buffer.Add(Event{
+				Timestamp: sent,
+				EventType: eventType,
+				Data:      verdict,
+			})
+		}
+		veth.free <- idx
+	}
+
+	stats.coordination = coord.stats()
+	return stats
+}
+
+// generatorUsage takes a generator thread's usage over the measured
+// phase, following the phase as the generator sees it
+type generatorUsage struct {
+	seen       int32
+	start, end ResourceSnapshot
+}
+
+func newGeneratorUsage(phase int32) *generatorUsage {
+	u := &generatorUsage{seen: phaseWarmup}
+	u.observe(phase)
+	return u
+}
+
+// observe notes the current phase, taking a snapshot on entering and
+// leaving the measured one
+func (u *generatorUsage) observe(phase int32) {
+	if phase == u.seen {
+		return
+	}
+	switch phase {
+	case phaseMeasure:
+		u.start, _ = TakeThreadResourceSnapshot()
+	case phaseCooldown:
+		if u.seen == phaseWarmup {
+			u.start, _ = TakeThreadResourceSnapshot()
+		}
+		u.end, _ = TakeThreadResourceSnapshot()
+	}
+	u.seen = phase
+}
+
+// usage returns the usage over the measured phase, ending it if the
+// generator stops within it; memory is the generator's own frame memory
+func (u *generatorUsage) usage(memory uint64) LoadGeneratorUsage {
+	if u.seen == phaseMeasure {
+		u.end, _ = TakeThreadResourceSnapshot()
+	}
+	return NewLoadGeneratorUsage("thread", u.start, u.end, memory)
+}
+
+// fillPacketResult derives the standard result metrics from a pipeline run
+func fillPacketResult(r *BenchmarkResult, stats pipelineStats, buffer *EventBuffer, startUsage, endUsage ResourceSnapshot) {
+	r.Duration = buffer.GetDuration()
+	r.EventCount = stats.received
+	if stats.interrupted {
+		r.Quality.Flag(QualityInterrupted)
+	}
+	r.RecordDrops(DropCounts{BufferFull: buffer.GetDroppedCount()})
+	if r.Duration > 0 {
+		r.Throughput = float64(stats.received) / r.Duration
+	}
+	// Percentiles come from the bounded sample, everything else from the
+	// streaming statistics over all packets
+	r.Latency = stats.latency.Stats()
+	r.Latency.Percentiles = computeLatencyStats(stats.samples, DefaultQuantiles).Percentiles
+	r.LoadGenerator = &stats.generator
+	r.CPUBudget = NewCPUBudget(startUsage, endUsage, stats.received).Without(stats.generator, stats.received)
+	if c := stats.coordination; c != nil {
+		r.Coordination = c
+		r.CPUBudget = r.CPUBudget.WithoutSystem(c.ExcludedUs, stats.received)
+	}
+	r.CPUUsage = r.CPUBudget.CPUPercent(endUsage.Wall.Sub(startUsage.Wall))
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	r.MemoryUsage = ms.Alloc
+	if r.MemoryUsage > stats.generator.MemoryBytes {
+		r.MemoryUsage -= stats.generator.MemoryBytes
+	}
+}
+
+// verdictOperations reports packets per verdict as operations, so mixed
+// verdicts remain visible in the result
+func verdictOperations(stats pipelineStats, duration float64, name func(uint32) string) []OperationResult {
+	var ops []OperationResult
+	for verdict, count := range stats.verdicts {
+		op := OperationResult{Name: name(verdict), Count: count, Duration: duration}
+		if duration > 0 {
+			op.Throughput = float64(count) / duration
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
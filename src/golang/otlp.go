@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// otlpHeadersEnv names the environment variable holding extra headers for
+// OTLP requests, as "key=value,key=value" (the OpenTelemetry SDK variable)
+const otlpHeadersEnv = "OTEL_EXPORTER_OTLP_HEADERS"
+
+// otlpScope names the instrumentation scope of exported spans and metrics
+const otlpScope = "github.com/parlakisik/ebpf_benchmark/src/golang"
+
+// OTLP span kind and status codes used by the exporter
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusOK         = 1
+	otlpStatusError      = 2
+)
+
+// The OTLP/HTTP JSON encoding of the messages the exporter sends. 64-bit
+// integers are strings, IDs lowercase hex.
+type (
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeInfo struct {
+		Name string `json:"name"`
+	}
+
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpEvent struct {
+		TimeUnixNano string         `json:"timeUnixNano"`
+		Name         string         `json:"name"`
+		Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Events            []otlpEvent    `json:"events,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScopeInfo `json:"scope"`
+		Spans []otlpSpan    `json:"spans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+
+	otlpNumberPoint struct {
+		Attributes        []otlpKeyValue `json:"attributes"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		TimeUnixNano      string         `json:"timeUnixNano"`
+		AsDouble          *float64       `json:"asDouble,omitempty"`
+		AsInt             *string        `json:"asInt,omitempty"`
+	}
+	otlpQuantile struct {
+		Quantile float64 `json:"quantile"`
+		Value    float64 `json:"value"`
+	}
+	otlpSummaryPoint struct {
+		Attributes        []otlpKeyValue `json:"attributes"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		TimeUnixNano      string         `json:"timeUnixNano"`
+		Count             string         `json:"count"`
+		Sum               float64        `json:"sum"`
+		QuantileValues    []otlpQuantile `json:"quantileValues"`
+	}
+	otlpGauge struct {
+		DataPoints []otlpNumberPoint `json:"dataPoints"`
+	}
+	otlpSummary struct {
+		DataPoints []otlpSummaryPoint `json:"dataPoints"`
+	}
+	otlpMetric struct {
+		Name        string       `json:"name"`
+		Description string       `json:"description,omitempty"`
+		Unit        string       `json:"unit,omitempty"`
+		Gauge       *otlpGauge   `json:"gauge,omitempty"`
+		Summary     *otlpSummary `json:"summary,omitempty"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScopeInfo `json:"scope"`
+		Metrics []otlpMetric  `json:"metrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpMetrics struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+)
+
+func otlpString(k, v string) otlpKeyValue {
+	return otlpKeyValue{Key: k, Value: otlpValue{StringValue: &v}}
+}
+
+func otlpInt(k string, v int64) otlpKeyValue {
+	s := strconv.FormatInt(v, 10)
+	return otlpKeyValue{Key: k, Value: otlpValue{IntValue: &s}}
+}
+
+func otlpDouble(k string, v float64) otlpKeyValue {
+	return otlpKeyValue{Key: k, Value: otlpValue{DoubleValue: &v}}
+}
+
+func otlpBool(k string, v bool) otlpKeyValue {
+	return otlpKeyValue{Key: k, Value: otlpValue{BoolValue: &v}}
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// otlpID returns n random bytes in hex, for trace and span IDs
+func otlpID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// otlpResourceOf describes the process and host that produced r
+func otlpResourceOf(r *BenchmarkResult) otlpResource {
+	attrs := []otlpKeyValue{otlpString("service.name", "ebpf-bench")}
+	if r.Host.Hostname != "" {
+		attrs = append(attrs, otlpString("host.name", r.Host.Hostname))
+	}
+	if r.Host.KernelRelease != "" {
+		attrs = append(attrs, otlpString("os.type", "linux"), otlpString("os.version", r.Host.KernelRelease))
+	}
+	return otlpResource{Attributes: attrs}
+}
+
+// otlpAttributes are the attributes that identify a result's spans and
+// data points, the same settings the InfluxDB exporter tags with
+func otlpAttributes(r *BenchmarkResult) []otlpKeyValue {
+	var attrs []otlpKeyValue
+	for _, a := range [][2]string{
+		{"benchmark", r.Benchmark},
+		{"benchmark.name", r.Name},
+		{"benchmark.language", r.Language},
+		{"benchmark.program", r.ProgramType},
+		{"benchmark.mechanism", r.DataMechanism},
+		{"benchmark.reader", r.ReaderStrategy},
+	} {
+		if a[1] != "" {
+			attrs = append(attrs, otlpString(a[0], a[1]))
+		}
+	}
+	if r.Identity != nil {
+		attrs = append(attrs, otlpString("benchmark.identity", r.Identity.Hash))
+	}
+	if r.Iteration > 0 {
+		attrs = append(attrs, otlpInt("benchmark.iteration", int64(r.Iteration)))
+	}
+	return attrs
+}
+
+// otlpResultSpans renders a result as one trace: a span for the whole run
+// with a child per phase. The measured window is the result's start and
+// end; warm-up and cooldown are placed around it from their durations.
+func otlpResultSpans(r *BenchmarkResult) []otlpSpan {
+	traceID := otlpID(16)
+	warmup := time.Duration(r.Warmup * float64(time.Second))
+	cooldown := time.Duration(r.Cooldown * float64(time.Second))
+	attrs := otlpAttributes(r)
+
+	status := otlpStatus{Code: otlpStatusOK}
+	if !r.Quality.OK() || len(r.Errors) > 0 {
+		msg := r.Quality.String()
+		if len(r.Errors) > 0 {
+			msg = strings.Join(r.Errors, "; ")
+		}
+		status = otlpStatus{Code: otlpStatusError, Message: msg}
+	}
+	run := otlpSpan{
+		TraceID:           traceID,
+		SpanID:            otlpID(8),
+		Name:              "benchmark " + resultKey(r),
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: otlpTime(r.StartTime.Add(-warmup)),
+		EndTimeUnixNano:   otlpTime(r.EndTime.Add(cooldown)),
+		Attributes: append(attrs[:len(attrs):len(attrs)],
+			otlpInt("events", r.EventCount),
+			otlpInt("dropped", r.DroppedEvents),
+			otlpDouble("throughput", r.Throughput),
+			otlpBool("quality.ok", r.Quality.OK())),
+		Status: status,
+	}
+	phase := func(name string, start, end time.Time) otlpSpan {
+		return otlpSpan{
+			TraceID:           traceID,
+			SpanID:            otlpID(8),
+			ParentSpanID:      run.SpanID,
+			Name:              name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: otlpTime(start),
+			EndTimeUnixNano:   otlpTime(end),
+			Attributes:        attrs,
+			Status:            otlpStatus{Code: otlpStatusOK},
+		}
+	}
+	var spans []otlpSpan
+	spans = append(spans, run)
+	if warmup > 0 {
+		spans = append(spans, phase("warmup", r.StartTime.Add(-warmup), r.StartTime))
+	}
+	measure := phase("measure", r.StartTime, r.EndTime)
+	measure.Status = status
+	for _, a := range r.Annotations {
+		measure.Events = append(measure.Events, otlpEvent{
+			TimeUnixNano: otlpTime(a.Time),
+			Name:         "annotation",
+			Attributes:   []otlpKeyValue{otlpString("note", a.Note)},
+		})
+	}
+	spans = append(spans, measure)
+	if cooldown > 0 {
+		spans = append(spans, phase("cooldown", r.EndTime, r.EndTime.Add(cooldown)))
+	}
+	return spans
+}
+
+// otlpResultMetrics renders a result's summary metrics as gauges over its
+// measured window, and its latencies as summaries of their percentiles
+func otlpResultMetrics(r *BenchmarkResult) []otlpMetric {
+	attrs := otlpAttributes(r)
+	start, end := otlpTime(r.StartTime), otlpTime(r.EndTime)
+	var metrics []otlpMetric
+	double := func(name, unit, desc string, v float64) {
+		if v != v || v > 1e308 || v < -1e308 {
+			return // NaN and infinities are not representable in JSON
+		}
+		metrics = append(metrics, otlpMetric{Name: name, Description: desc, Unit: unit, Gauge: &otlpGauge{
+			DataPoints: []otlpNumberPoint{{Attributes: attrs, StartTimeUnixNano: start, TimeUnixNano: end, AsDouble: &v}},
+		}})
+	}
+	integer := func(name, unit, desc string, v int64) {
+		s := strconv.FormatInt(v, 10)
+		metrics = append(metrics, otlpMetric{Name: name, Description: desc, Unit: unit, Gauge: &otlpGauge{
+			DataPoints: []otlpNumberPoint{{Attributes: attrs, StartTimeUnixNano: start, TimeUnixNano: end, AsInt: &s}},
+		}})
+	}
+	latency := func(name, desc string, s LatencyStats) {
+		if s.Samples == 0 {
+			return
+		}
+		p := otlpSummaryPoint{
+			Attributes:        attrs,
+			StartTimeUnixNano: start,
+			TimeUnixNano:      end,
+			Count:             strconv.FormatInt(s.Samples, 10),
+			Sum:               s.AvgNs * float64(s.Samples),
+			QuantileValues:    []otlpQuantile{{Quantile: 0, Value: float64(s.MinNs)}},
+		}
+		for _, q := range s.Percentiles {
+			p.QuantileValues = append(p.QuantileValues, otlpQuantile{Quantile: q.Quantile, Value: float64(q.ValueNs)})
+		}
+		p.QuantileValues = append(p.QuantileValues, otlpQuantile{Quantile: 1, Value: float64(s.MaxNs)})
+		metrics = append(metrics, otlpMetric{Name: name, Description: desc, Unit: "ns", Summary: &otlpSummary{
+			DataPoints: []otlpSummaryPoint{p},
+		}})
+	}
+
+	double("ebpf_bench.throughput", "{event}/s", "Events delivered per second of the measured window", r.Throughput)
+	integer("ebpf_bench.events", "{event}", "Events delivered in the measured window", r.EventCount)
+	integer("ebpf_bench.dropped", "{event}", "Events lost before reaching the consumer", r.DroppedEvents)
+	double("ebpf_bench.drop_rate", "1", "Dropped events over all events", r.DropRate)
+	double("ebpf_bench.cpu_usage", "%", "Consumer CPU usage", r.CPUUsage)
+	double("ebpf_bench.cpu_per_event", "us", "Consumer CPU time per event", r.CPUBudget.CPUPerEventUs)
+	integer("ebpf_bench.memory", "By", "Consumer memory usage", int64(r.MemoryUsage))
+	latency("ebpf_bench.latency", "Between consecutive event timestamps", r.Latency)
+	if r.DeliveryLatency != nil {
+		latency("ebpf_bench.delivery_latency", "Kernel timestamp to userspace receipt", *r.DeliveryLatency)
+	}
+	return metrics
+}
+
+// exportOTLP sends results as OTLP traces and metrics to dest: POSTed as
+// JSON to its /v1/traces and /v1/metrics when it is an http(s) collector
+// endpoint, else appended to the file it names, one request per line
+func exportOTLP(dest string, results []*BenchmarkResult) error {
+	var traces otlpTraces
+	var metrics otlpMetrics
+	for _, r := range results {
+		res := otlpResourceOf(r)
+		traces.ResourceSpans = append(traces.ResourceSpans, otlpResourceSpans{
+			Resource:   res,
+			ScopeSpans: []otlpScopeSpans{{Scope: otlpScopeInfo{Name: otlpScope}, Spans: otlpResultSpans(r)}},
+		})
+		metrics.ResourceMetrics = append(metrics.ResourceMetrics, otlpResourceMetrics{
+			Resource:     res,
+			ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScopeInfo{Name: otlpScope}, Metrics: otlpResultMetrics(r)}},
+		})
+	}
+	tracesBody, err := json.Marshal(traces)
+	if err != nil {
+		return err
+	}
+	metricsBody, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(dest, "http://") && !strings.HasPrefix(dest, "https://") {
+		return appendToFile(dest, func(f *os.File, _ bool) error {
+			_, err := f.Write(append(append(append(tracesBody, '\n'), metricsBody...), '\n'))
+			return err
+		})
+	}
+	headers, err := otlpHeaders(os.Getenv(otlpHeadersEnv))
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	base := strings.TrimSuffix(dest, "/")
+	if err := postOTLP(client, base+"/v1/traces", tracesBody, headers); err != nil {
+		return err
+	}
+	return postOTLP(client, base+"/v1/metrics", metricsBody, headers)
+}
+
+// otlpHeaders parses the "key=value,key=value" header list of
+// OTEL_EXPORTER_OTLP_HEADERS
+func otlpHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, kv := range splitList(s) {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("invalid %s entry %q (want key=value)", otlpHeadersEnv, kv)
+		}
+		headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return headers, nil
+}
+
+// postOTLP sends one export request to a collector endpoint
+func postOTLP(client *http.Client, url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid OTLP endpoint: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("OTLP export: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("OTLP export to %s: %s: %s", url, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Outlier is the context of one event whose delivery latency exceeded the
+// outlier threshold
+type Outlier struct {
+	Timestamp uint64 // The event's kernel timestamp
+	CPU       uint32
+	EventType uint32
+	LatencyNs uint64  // Kernel timestamp to userspace receipt
+	Occupancy float64 // Fill of the buffer it was read from, 0 to 1
+	GCCycles  uint32  // GC cycles completed since the run started
+	SinceGCNs int64   // From the end of the last GC cycle to receipt; -1 before any
+	GCInLag   bool    // A GC cycle ended while the event was in flight
+}
+
+// OutlierStats are the worst delivery outliers of a run
+type OutlierStats struct {
+	ThresholdNs uint64
+	Count       int64     // Events over the threshold
+	Top         []Outlier // The slowest, worst first
+}
+
+// The GC context comes from a finalizer that runs once after every GC
+// cycle, so noting it costs an atomic load instead of stopping the world
+// as runtime.ReadMemStats would. The time is when the finalizer ran,
+// shortly after the cycle ended.
+var (
+	gcWatch  sync.Once
+	gcCycles atomic.Uint32
+	gcLastNs atomic.Uint64
+)
+
+type gcSentinel struct{ _ *byte } // Holds a pointer, so not tiny-allocated
+
+func armGCSentinel() {
+	runtime.SetFinalizer(&gcSentinel{}, func(*gcSentinel) {
+		gcCycles.Add(1)
+		gcLastNs.Store(nowNs())
+		armGCSentinel()
+	})
+}
+
+// outlierCapture keeps the limit slowest events over threshold
+type outlierCapture struct {
+	threshold uint64
+	limit     int
+	count     int64
+	top       []Outlier // Unordered
+	fastest   int       // Index of the quickest in top
+	gcBase    uint32    // gcCycles when the run started
+}
+
+func newOutlierCapture(threshold uint64, limit int) *outlierCapture {
+	gcWatch.Do(armGCSentinel)
+	return &outlierCapture{threshold: threshold, limit: limit, top: make([]Outlier, 0, limit), gcBase: gcCycles.Load()}
+}
+
+// check notes e if its latency is over the threshold and among the
+// slowest; used and capacity give the occupancy of its buffer
+func (c *outlierCapture) check(e *Event, latency, now uint64, used, capacity int) {
+	if latency <= c.threshold {
+		return
+	}
+	c.count++
+	if len(c.top) == c.limit && latency <= c.top[c.fastest].LatencyNs {
+		return
+	}
+	o := Outlier{
+		Timestamp: e.Timestamp, CPU: e.CPU, EventType: e.EventType, LatencyNs: latency,
+		GCCycles: gcCycles.Load() - c.gcBase, SinceGCNs: -1,
+	}
+	if capacity > 0 {
+		o.Occupancy = float64(used) / float64(capacity)
+	}
+	if last := gcLastNs.Load(); last != 0 && last <= now {
+		o.SinceGCNs = int64(now - last)
+		o.GCInLag = last >= e.Timestamp
+	}
+	if len(c.top) < c.limit {
+		c.top = append(c.top, o)
+	} else {
+		c.top[c.fastest] = o
+	}
+	c.fastest = 0
+	for i := range c.top {
+		if c.top[i].LatencyNs < c.top[c.fastest].LatencyNs {
+			c.fastest = i
+		}
+	}
+}
+
+// reset discards the outliers so far, keeping the settings
+func (c *outlierCapture) reset() *outlierCapture {
+	if c == nil {
+		return nil
+	}
+	return &outlierCapture{threshold: c.threshold, limit: c.limit, top: c.top[:0], gcBase: gcCycles.Load()}
+}
+
+// merge adds the outliers of o, which has the same settings
+func (c *outlierCapture) merge(o *outlierCapture) *outlierCapture {
+	if o == nil {
+		return c
+	}
+	if c == nil {
+		c = &outlierCapture{threshold: o.threshold, limit: o.limit, gcBase: o.gcBase}
+	}
+	c.count += o.count
+	c.top = append(c.top, o.top...)
+	sort.Slice(c.top, func(i, j int) bool { return c.top[i].LatencyNs > c.top[j].LatencyNs })
+	c.top = c.top[:min(len(c.top), c.limit)]
+	c.fastest = len(c.top) - 1
+	return c
+}
+
+// stats returns the outliers worst first; nil when capture is off
+func (c *outlierCapture) stats() *OutlierStats {
+	if c == nil {
+		return nil
+	}
+	top := append([]Outlier(nil), c.top...)
+	sort.Slice(top, func(i, j int) bool { return top[i].LatencyNs > top[j].LatencyNs })
+	return &OutlierStats{ThresholdNs: c.threshold, Count: c.count, Top: top}
+}
+
+// outlierFlagSet holds the -outlier-threshold and -outliers flags
+type outlierFlagSet struct {
+	threshold *durationFlag
+	limit     *int
+}
+
+// addOutlierFlags registers -outlier-threshold and -outliers
+func addOutlierFlags(fs *flag.FlagSet) *outlierFlagSet {
+	f := &outlierFlagSet{threshold: &durationFlag{}}
+	fs.Var(f.threshold, "outlier-threshold", "Capture the context of events delivered slower than this (0 disables)")
+	f.limit = fs.Int("outliers", 10, "Slowest outliers kept in the result")
+	return f
+}
+
+// capture validates the flags and returns the capture, or nil when off
+func (f *outlierFlagSet) capture() (*outlierCapture, error) {
+	if f.threshold.d < 0 || *f.limit <= 0 {
+		return nil, fmt.Errorf("-outlier-threshold must not be negative and -outliers must be positive")
+	}
+	if f.threshold.d == 0 {
+		return nil, nil
+	}
+	return newOutlierCapture(uint64(f.threshold.d.Nanoseconds()), *f.limit), nil
+}
+
+// SetOutliers captures the context of events delivered slower than the
+// capture's threshold; nil turns it off
+func (eb *EventBuffer) SetOutliers(c *outlierCapture) {
+	eb.delivery.outliers = c
+}
+
+// formatOutliers summarizes the outliers; their context is in the JSON
+func (r *BenchmarkResult) formatOutliers() string {
+	s := r.Outliers
+	if s == nil {
+		return ""
+	}
+	line := fmt.Sprintf("Outliers:        %d events over %s", s.Count, r.LatencyUnit.Format(float64(s.ThresholdNs)))
+	if len(s.Top) > 0 {
+		gc := 0
+		for _, o := range s.Top {
+			if o.GCInLag {
+				gc++
+			}
+		}
+		w := s.Top[0]
+		line += fmt.Sprintf("; worst %s on CPU %d at %.0f%% occupancy; %d of the top %d overlapped a GC",
+			r.LatencyUnit.Format(float64(w.LatencyNs)), w.CPU, w.Occupancy*100, gc, len(s.Top))
+	}
+	return line + "\n"
+}
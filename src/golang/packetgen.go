@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Header sizes of the generated frames
+const (
+	ethHeaderLen  = 14
+	ipv4HeaderLen = 20
+	udpHeaderLen  = 8
+	// pktTimestampLen is the generation timestamp at the start of the payload
+	pktTimestampLen = 8
+
+	minPacketSize = ethHeaderLen + ipv4HeaderLen + udpHeaderLen + pktTimestampLen
+	maxPacketSize = 9000
+
+	etherTypeIPv4 = 0x0800
+	ipProtoUDP    = 17
+)
+
+// PacketGenerator builds Ethernet/IPv4/UDP frames for the network
+// benchmarks, or frames with another HeaderStack. Each frame carries its
+// generation timestamp at the start of the innermost UDP payload so the
+// receiver can compute per-packet latency. Flows are spread over the UDP
+// source ports and the low bits of the source addresses. The rest of the
+// payload is filled by an optional PayloadGenerator.
+type PacketGenerator struct {
+	size    int
+	flows   int
+	seq     uint64
+	headers *HeaderStack
+	payload PayloadGenerator
+}
+
+// NewPacketGenerator creates a generator of frames of the given size
+// cycling through the given number of flows
+func NewPacketGenerator(size, flows int) (*PacketGenerator, error) {
+	if size < minPacketSize || size > maxPacketSize {
+		return nil, fmt.Errorf("packet size %d out of range [%d, %d]", size, minPacketSize, maxPacketSize)
+	}
+	if flows <= 0 {
+		return nil, fmt.Errorf("flow count must be positive")
+	}
+	headers, err := parseHeaderStack(defaultHeaderStack)
+	if err != nil {
+		return nil, err
+	}
+	return &PacketGenerator{size: size, flows: flows, headers: headers}, nil
+}
+
+// SetPayload sets the generator filling the payload after the timestamp.
+// With no generator the payload is left as whatever the buffer held.
+func (g *PacketGenerator) SetPayload(p PayloadGenerator) {
+	g.payload = p
+}
+
+// Size returns the frame size in bytes
+func (g *PacketGenerator) Size() int {
+	return g.size
+}
+
+// SetHeaders sets the layers between the outer Ethernet header and the
+// innermost UDP header, IPv4 by default. The frame size must hold them.
+func (g *PacketGenerator) SetHeaders(h *HeaderStack) error {
+	if g.size < h.MinSize() {
+		return fmt.Errorf("packet size %d too small for headers %s (minimum %d)", g.size, h, h.MinSize())
+	}
+	g.headers = h
+	return nil
+}
+
+// Next writes the next frame into buf, which must hold at least Size()
+// bytes, and returns the frame
+func (g *PacketGenerator) Next(buf []byte) []byte {
+	pkt := buf[:g.size]
+	flow := uint32(g.seq % uint64(g.flows))
+	g.seq++
+
+	payload := g.headers.write(pkt, flow, g.seq)
+	if g.payload != nil {
+		g.payload.Fill(payload[pktTimestampLen:])
+	}
+	binary.LittleEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+	return pkt
+}
+
+// ipv4Checksum computes the IPv4 header checksum
+func ipv4Checksum(hdr []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(hdr); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i:]))
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Header sizes and identifiers of the layers a header stack can hold
+const (
+	vlanTagLen      = 4
+	ipv6HeaderLen   = 40
+	encapHeaderLen  = 8 // VXLAN header, or GENEVE base header without options
+	etherTypeIPv6   = 0x86dd
+	etherTypeVLAN   = 0x8100 // 802.1Q C-tag
+	etherTypeQinQ   = 0x88a8 // 802.1ad S-tag, outside a C-tag
+	etherTypeTEB    = 0x6558 // Transparent Ethernet bridging, GENEVE's inner protocol
+	vxlanPort       = 4789
+	genevePort      = 6081
+	udpDiscardPort  = 9
+	maxVLANTags     = 2 // Per Ethernet header, as a bounded eBPF parser allows
+	maxEncapsulated = 3 // Tunnel headers a parser follows before giving up
+
+	defaultHeaderStack = "ipv4"
+)
+
+// headerLayer is one layer of a header stack
+type headerLayer int
+
+const (
+	layerVLAN headerLayer = iota
+	layerIPv4
+	layerIPv6
+	layerVXLAN  // Outer UDP, VXLAN header and inner Ethernet
+	layerGENEVE // Outer UDP, GENEVE header and inner Ethernet
+)
+
+var headerLayerNames = map[string]headerLayer{
+	"vlan":   layerVLAN,
+	"ipv4":   layerIPv4,
+	"ipv6":   layerIPv6,
+	"vxlan":  layerVXLAN,
+	"geneve": layerGENEVE,
+}
+
+func (l headerLayer) size() int {
+	switch l {
+	case layerVLAN:
+		return vlanTagLen
+	case layerIPv4:
+		return ipv4HeaderLen
+	case layerIPv6:
+		return ipv6HeaderLen
+	default:
+		return udpHeaderLen + encapHeaderLen + ethHeaderLen
+	}
+}
+
+// HeaderStack is the layers of a generated frame between the outer
+// Ethernet header and the innermost UDP header, e.g. vlan,ipv6 or
+// ipv4,vxlan,ipv4. Every IP layer is followed by UDP, either the tunnel's
+// or the innermost one carrying the timestamp.
+type HeaderStack struct {
+	spec    string
+	layers  []headerLayer
+	offsets []int // Of each layer in the frame
+	udp     int   // Offset of the innermost UDP header
+}
+
+// parseHeaderStack parses a comma-separated header stack. VLAN tags and
+// an IP layer follow each Ethernet header; a tunnel follows an IP layer
+// and starts a new Ethernet frame; the stack ends on an IP layer.
+func parseHeaderStack(spec string) (*HeaderStack, error) {
+	h := &HeaderStack{udp: ethHeaderLen}
+	names := splitList(spec)
+	tags, tunnels := 0, 0
+	inL2 := true // After an Ethernet header, before its IP layer
+	for _, name := range names {
+		l, ok := headerLayerNames[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown header %q (want vlan, ipv4, ipv6, vxlan or geneve)", name)
+		}
+		switch l {
+		case layerVLAN:
+			if !inL2 {
+				return nil, fmt.Errorf("vlan must follow an Ethernet header, not an IP layer")
+			}
+			if tags++; tags > maxVLANTags {
+				return nil, fmt.Errorf("at most %d VLAN tags per Ethernet header", maxVLANTags)
+			}
+		case layerIPv4, layerIPv6:
+			if !inL2 {
+				return nil, fmt.Errorf("%s must follow an Ethernet header or VLAN tag, not an IP layer", name)
+			}
+			inL2 = false
+		case layerVXLAN, layerGENEVE:
+			if inL2 {
+				return nil, fmt.Errorf("%s must follow an IP layer", name)
+			}
+			if tunnels++; tunnels > maxEncapsulated {
+				return nil, fmt.Errorf("at most %d tunnel headers", maxEncapsulated)
+			}
+			inL2, tags = true, 0
+		}
+		h.layers = append(h.layers, l)
+		h.offsets = append(h.offsets, h.udp)
+		h.udp += l.size()
+	}
+	if len(h.layers) == 0 || inL2 {
+		return nil, fmt.Errorf("header stack %q must end on ipv4 or ipv6", spec)
+	}
+	h.spec = strings.ToLower(strings.Join(names, ","))
+	return h, nil
+}
+
+// String returns the stack as parsed, e.g. vlan,ipv6
+func (h *HeaderStack) String() string {
+	return h.spec
+}
+
+// MinSize is the smallest frame that holds the stack, the innermost UDP
+// header and the timestamp
+func (h *HeaderStack) MinSize() int {
+	return h.udp + udpHeaderLen + pktTimestampLen
+}
+
+// write fills pkt's headers for flow, returning the innermost UDP payload
+func (h *HeaderStack) write(pkt []byte, flow uint32, seq uint64) []byte {
+	writeEthernet(pkt)
+	etherType := 12 // Where the next layer's EtherType or TPID goes
+	for i, l := range h.layers {
+		off := h.offsets[i]
+		hdr := pkt[off:]
+		switch l {
+		case layerVLAN:
+			tpid := uint16(etherTypeVLAN)
+			if i+1 < len(h.layers) && h.layers[i+1] == layerVLAN {
+				tpid = etherTypeQinQ
+			}
+			binary.BigEndian.PutUint16(pkt[etherType:], tpid)
+			binary.BigEndian.PutUint16(hdr[0:2], uint16(100+i)) // PCP 0, VID
+			etherType = off + 2
+		case layerIPv4:
+			binary.BigEndian.PutUint16(pkt[etherType:], etherTypeIPv4)
+			writeIPv4(hdr, len(pkt)-off, flow, seq)
+		case layerIPv6:
+			binary.BigEndian.PutUint16(pkt[etherType:], etherTypeIPv6)
+			writeIPv6(hdr, len(pkt)-off, flow)
+		case layerVXLAN, layerGENEVE:
+			// Tunnels take the flow's entropy in the outer source port, as
+			// RFC 7348 recommends
+			port := uint16(vxlanPort)
+			if l == layerGENEVE {
+				port = genevePort
+			}
+			writeUDP(hdr, len(pkt)-off, flow, port)
+			encap := hdr[udpHeaderLen:]
+			for j := range encap[:encapHeaderLen] {
+				encap[j] = 0
+			}
+			if l == layerVXLAN {
+				encap[0] = 0x08 // VNI present
+			} else {
+				binary.BigEndian.PutUint16(encap[2:4], etherTypeTEB)
+			}
+			binary.BigEndian.PutUint32(encap[4:8], uint32(i+1)<<8) // VNI
+			writeEthernet(encap[encapHeaderLen:])
+			etherType = off + udpHeaderLen + encapHeaderLen + 12
+		}
+	}
+	udp := pkt[h.udp:]
+	writeUDP(udp, len(pkt)-h.udp, flow, udpDiscardPort)
+	return udp[udpHeaderLen:]
+}
+
+// writeEthernet writes locally administered MACs; the EtherType is left
+// for the next layer
+func writeEthernet(eth []byte) {
+	copy(eth[0:6], []byte{0x02, 0, 0, 0, 0, 0x02})
+	copy(eth[6:12], []byte{0x02, 0, 0, 0, 0, 0x01})
+}
+
+// writeIPv4 writes a UDP-carrying IPv4 header, 10.x.y.z (flow) ->
+// 10.255.255.254, for totalLen bytes from the header on
+func writeIPv4(ip []byte, totalLen int, flow uint32, seq uint64) {
+	ip[0] = 0x45 // Version 4, IHL 5
+	ip[1] = 0
+	binary.BigEndian.PutUint16(ip[2:4], uint16(totalLen))
+	binary.BigEndian.PutUint16(ip[4:6], uint16(seq))
+	binary.BigEndian.PutUint16(ip[6:8], 0x4000) // Don't fragment
+	ip[8] = 64
+	ip[9] = ipProtoUDP
+	binary.BigEndian.PutUint32(ip[12:16], 0x0a000000|flow&0xffffff)
+	binary.BigEndian.PutUint32(ip[16:20], 0x0afffffe)
+	binary.BigEndian.PutUint16(ip[10:12], 0)
+	binary.BigEndian.PutUint16(ip[10:12], ipv4Checksum(ip[:ipv4HeaderLen]))
+}
+
+// writeIPv6 writes a UDP-carrying IPv6 header, fd00::flow -> fd00::fffe,
+// with the flow also in the flow label, for totalLen bytes from the header on
+func writeIPv6(ip []byte, totalLen int, flow uint32) {
+	binary.BigEndian.PutUint32(ip[0:4], 6<<28|flow&0xfffff)
+	binary.BigEndian.PutUint16(ip[4:6], uint16(totalLen-ipv6HeaderLen))
+	ip[6] = ipProtoUDP
+	ip[7] = 64 // Hop limit
+	for i := 8; i < ipv6HeaderLen; i++ {
+		ip[i] = 0
+	}
+	ip[8], ip[9] = 0xfd, 0
+	binary.BigEndian.PutUint32(ip[20:24], flow)
+	ip[24], ip[25] = 0xfd, 0
+	binary.BigEndian.PutUint16(ip[38:40], 0xfffe)
+}
+
+// writeUDP writes a UDP header whose source port carries the low flow
+// bits. The checksum is left zero, which RFC 6935 also allows over IPv6
+// for tunnels; the programs do not verify it.
+func writeUDP(udp []byte, totalLen int, flow uint32, dstPort uint16) {
+	binary.BigEndian.PutUint16(udp[0:2], uint16(1024+flow%64512))
+	binary.BigEndian.PutUint16(udp[2:4], dstPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(totalLen))
+	binary.BigEndian.PutUint16(udp[6:8], 0)
+}
+
+// parseUDPPayload walks the headers of a frame as the packet programs do:
+// Ethernet, up to maxVLANTags VLAN tags, IPv4 or IPv6, then UDP, following
+// VXLAN and GENEVE tunnels into their inner frames up to maxEncapsulated
+// deep. It returns the offset of the innermost UDP payload.
+func parseUDPPayload(pkt []byte) (int, error) {
+	_, payload, err := parsePacket(pkt)
+	return payload, err
+}
+
+// parsePacket is parseUDPPayload that also returns the offset of the
+// innermost IP header
+func parsePacket(pkt []byte) (l3, payload int, err error) {
+	off := 0
+	for depth := 0; depth <= maxEncapsulated; depth++ {
+		if len(pkt) < off+ethHeaderLen {
+			return 0, 0, fmt.Errorf("truncated Ethernet header")
+		}
+		etherType := binary.BigEndian.Uint16(pkt[off+12:])
+		off += ethHeaderLen
+		for tags := 0; etherType == etherTypeVLAN || etherType == etherTypeQinQ; tags++ {
+			if tags == maxVLANTags {
+				return 0, 0, fmt.Errorf("more than %d VLAN tags", maxVLANTags)
+			}
+			if len(pkt) < off+vlanTagLen {
+				return 0, 0, fmt.Errorf("truncated VLAN tag")
+			}
+			etherType = binary.BigEndian.Uint16(pkt[off+2:])
+			off += vlanTagLen
+		}
+
+		l3 = off
+		switch etherType {
+		case etherTypeIPv4:
+			ip := pkt[off:]
+			if len(ip) < ipv4HeaderLen || ip[9] != ipProtoUDP {
+				return 0, 0, fmt.Errorf("not a UDP packet")
+			}
+			ihl := int(ip[0]&0x0f) * 4
+			if ihl < ipv4HeaderLen {
+				return 0, 0, fmt.Errorf("truncated header")
+			}
+			off += ihl
+		case etherTypeIPv6:
+			ip := pkt[off:]
+			if len(ip) < ipv6HeaderLen || ip[6] != ipProtoUDP {
+				return 0, 0, fmt.Errorf("not a UDP packet") // Extension headers are not followed
+			}
+			off += ipv6HeaderLen
+		default:
+			return 0, 0, fmt.Errorf("unsupported EtherType 0x%04x", etherType)
+		}
+
+		if len(pkt) < off+udpHeaderLen {
+			return 0, 0, fmt.Errorf("truncated header")
+		}
+		switch binary.BigEndian.Uint16(pkt[off+2:]) {
+		case vxlanPort:
+			off += udpHeaderLen + encapHeaderLen
+		case genevePort:
+			if len(pkt) < off+udpHeaderLen+encapHeaderLen {
+				return 0, 0, fmt.Errorf("truncated GENEVE header")
+			}
+			geneve := pkt[off+udpHeaderLen:]
+			if binary.BigEndian.Uint16(geneve[2:4]) != etherTypeTEB {
+				return 0, 0, fmt.Errorf("GENEVE does not carry Ethernet")
+			}
+			off += udpHeaderLen + encapHeaderLen + int(geneve[0]&0x3f)*4 // Options
+		default:
+			return l3, off + udpHeaderLen, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("more than %d tunnel headers", maxEncapsulated)
+}
+
+// formatHeaders renders the header stack of a packet benchmark
+func (r *BenchmarkResult) formatHeaders() string {
+	if r.HeaderStack == "" {
+		return ""
+	}
+	h, err := parseHeaderStack(r.HeaderStack)
+	if err != nil {
+		return fmt.Sprintf("Headers:         %s\n", r.HeaderStack)
+	}
+	return fmt.Sprintf("Headers:         eth,%s,udp (%d bytes before the payload)\n", h, h.udp+udpHeaderLen)
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Pairing modes of the pairing benchmark
+const (
+	pairKernel = "kernel" // The exit program pairs with the start in a hash map and emits one record
+	pairRaw    = "raw"    // Both programs emit a record; userspace pairs them
+)
+
+var allPairModes = []string{pairRaw, pairKernel}
+
+// Record kinds of raw mode, in Event.Data
+const (
+	pairEnter = 0
+	pairExit  = 1
+)
+
+// PairingStats is how well one pairing mode turned syscall entries and
+// exits into durations, and what it cost
+type PairingStats struct {
+	Mode              string
+	Syscalls          int64 // Syscalls that completed in the window
+	Records           int64 // Records submitted to the ring
+	RecordsPerSyscall float64
+	BytesPerSyscall   float64 // Ring bytes submitted per syscall
+	Lost              int64   // Records lost to a full ring
+	MissedExits       int64   // Exits the exit program never saw, as when a thread dies mid-syscall
+	MapFull           int64   // Entries the start map refused for want of room; kernel only
+	NoStart           int64   // Exits without a start to pair with
+	OrphanStarts      int64   // Starts replaced before their exit arrived; raw only
+	Paired            int64   // Durations the consumer got, drained ones included
+	Correct           int64   // Durations of the right syscall
+	Mispaired         int64   // Durations from a start and an exit of different syscalls
+	Accuracy          float64 // Correct durations over syscalls
+	LeakedEntries     int64   // Starts left behind by threads that are gone
+	MapOps            int64   // Start map updates, lookups and deletes; kernel only
+	ProgramNs         float64 // Producer time per syscall: both programs, their map operations and emits
+	ConsumerCPU       float64 // Consumer thread CPU, as a percentage of one core
+	ConsumerNsPerSys  float64 // Consumer thread CPU per syscall
+}
+
+// PairingBenchmark compares pairing syscall entries with their exits in
+// the kernel, through a hash map keyed by thread ID, with emitting both
+// raw events for userspace to pair. Syscalls are simulated at a fixed rate
+// with log-normal durations. Exits can be missed and threads replaced by
+// new ones, which in kernel mode leaks map entries until the map is full.
+// Each duration is checked against the syscall it belongs to.
+type PairingBenchmark struct {
+	duration   time.Duration
+	modes      []string
+	producers  int
+	threads    int // Threads per producer, each with a syscall in flight
+	rate       int // Syscalls per second over all producers; 0 runs flat out
+	mapEntries int // max_entries of the start map
+	miss       float64
+	churn      float64
+	median     time.Duration
+	sigma      float64
+	ringSize   int
+	seed       uint64
+	verbose    bool
+}
+
+// pairProducer is the state of one producer CPU
+type pairProducer struct {
+	tids   []uint32 // Current thread of each slot
+	starts []uint64 // Start of each slot's syscall in flight, 0 if none
+	rng    randomPayload
+
+	syscalls, records, lost, missed, mapFull, noStart, mapOps int64
+}
+
+// chance returns true with probability p
+func (p *pairProducer) chance(prob float64) bool {
+	return prob > 0 && float64(p.rng.next()>>11)/(1<<53) < prob
+}
+
+// runOne measures one mode
+func (b *PairingBenchmark) runOne(ctx context.Context, mode string) (*BenchmarkResult, error) {
+	ring := newMPSCRing(b.ringSize)
+	starts := newLatencyStartMap(b.mapEntries)
+	dist := &syscallDurations{median: float64(b.median.Nanoseconds()), sigma: b.sigma}
+	duration := func(start uint64) uint64 { return dist.at(start ^ b.seed) }
+
+	r := &BenchmarkResult{
+		Name:           "Entry/Exit Pairing",
+		Language:       "Go",
+		ProgramType:    "tracepoint",
+		Tracepoint:     "raw_syscalls:sys_enter+sys_exit",
+		DataMechanism:  "ring_buffer",
+		ReaderStrategy: fmt.Sprintf("%s/%s/producers=%d", probeBackendSim, mode, b.producers),
+		Host:           CollectHostInfo(),
+		Errors:         []string{"no BPF backend: sys_enter/sys_exit programs simulated in userspace"},
+	}
+	benchLog(ctx).Info("Running", "mode", mode, "producers", b.producers, "rate", b.rate, "duration", b.duration)
+
+	var stop, producersDone atomic.Bool
+	s := &PairingStats{Mode: mode}
+
+	// Userspace pairing of raw mode, and checking the durations of both
+	var consumed int64
+	pending := make(map[uint32]uint64) // Start by thread, raw mode
+	check := func(start, d uint64) {
+		s.Paired++
+		if d == min(duration(start), math.MaxUint32) {
+			s.Correct++
+		} else {
+			s.Mispaired++
+		}
+	}
+	pair := func(e Event) {
+		if mode == pairKernel {
+			check(e.Timestamp, uint64(e.Data))
+			return
+		}
+		start, ok := pending[e.PID]
+		if e.Data == pairEnter {
+			if ok {
+				s.OrphanStarts++
+			}
+			pending[e.PID] = e.Timestamp
+			return
+		}
+		if !ok {
+			s.NoStart++
+			return
+		}
+		delete(pending, e.PID)
+		check(start, min(e.Timestamp-start, math.MaxUint32))
+	}
+	// Records read after the window still belong to syscalls in it
+	consumer := startThreadConsumer(ring, &stop, &producersDone, func(e Event) {
+		consumed++
+		pair(e)
+	}, pair)
+
+	startUsage, _ := TakeResourceSnapshot()
+	r.StartTime = time.Now()
+
+	var nextTid atomic.Uint32
+	nextTid.Store(uint32(b.producers * b.threads))
+	producers := make([]*pairProducer, b.producers)
+	var programTime atomic.Int64
+	var wg sync.WaitGroup
+	for cpu := range producers {
+		p := &pairProducer{
+			tids:   make([]uint32, b.threads),
+			starts: make([]uint64, b.threads),
+			rng:    randomPayload{state: (b.seed + uint64(cpu)*0x9e3779b97f4a7c15) | 1},
+		}
+		for i := range p.tids {
+			p.tids[i] = uint32(cpu*b.threads + i)
+		}
+		producers[cpu] = p
+		emit := func(e Event) {
+			pos, ok := ring.reserve()
+			if !ok {
+				p.lost++
+				return
+			}
+			ring.submit(pos, e)
+			p.records++
+		}
+		enter := func(tid uint32, start uint64) {
+			if mode == pairKernel {
+				p.mapOps++
+				if !starts.update(tid, start) {
+					p.mapFull++
+				}
+				return
+			}
+			emit(Event{Timestamp: start, PID: tid, CPU: uint32(cpu), EventType: eventTypeTracepoint, Data: pairEnter})
+		}
+		exit := func(tid uint32, end uint64) {
+			if mode == pairKernel {
+				p.mapOps += 2
+				start, ok := starts.take(tid)
+				if !ok {
+					p.noStart++
+					return
+				}
+				emit(Event{Timestamp: start, PID: tid, CPU: uint32(cpu), EventType: eventTypeTracepoint,
+					Data: uint32(min(end-start, math.MaxUint32))})
+				return
+			}
+			emit(Event{Timestamp: end, PID: tid, CPU: uint32(cpu), EventType: eventTypeTracepoint, Data: pairExit})
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each thread exits its previous syscall and enters the next one.
+			// The exit's clock reads the start plus the syscall's duration.
+			spent := runPaced(&stop, float64(b.rate)/float64(b.producers), func(n int64) {
+				slot := int(n % int64(b.threads))
+				tid := p.tids[slot]
+				if start := p.starts[slot]; start != 0 {
+					p.syscalls++
+					if p.chance(b.miss) {
+						p.missed++
+					} else {
+						exit(tid, start+duration(start))
+					}
+					if p.chance(b.churn) {
+						tid = nextTid.Add(1)
+						p.tids[slot] = tid
+					}
+				}
+				start := uint64(time.Now().UnixNano())
+				p.starts[slot] = start
+				enter(tid, start)
+			})
+			programTime.Add(int64(spent))
+		}()
+	}
+
+	timer := time.NewTimer(b.duration)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+		r.Quality.Flag(QualityInterrupted)
+	}
+	stop.Store(true)
+	r.EndTime = time.Now()
+	endUsage, _ := TakeResourceSnapshot()
+	wg.Wait()
+	producersDone.Store(true)
+	consumer.wait()
+	drainTime := time.Since(r.EndTime)
+
+	for _, p := range producers {
+		s.Syscalls += p.syscalls
+		s.Records += p.records
+		s.Lost += p.lost
+		s.MissedExits += p.missed
+		s.MapFull += p.mapFull
+		s.NoStart += p.noStart
+		s.MapOps += p.mapOps
+	}
+	// Every thread still has a syscall in flight; other starts are leaked
+	inFlight := int64(b.producers * b.threads)
+	if mode == pairKernel {
+		s.LeakedEntries = max(starts.len()-inFlight, 0)
+	} else {
+		s.LeakedEntries = max(int64(len(pending))-inFlight, 0)
+	}
+
+	wall := r.EndTime.Sub(r.StartTime)
+	consumerCPU := consumer.budget(consumed)
+	r.Duration = wall.Seconds()
+	r.EventCount = consumed
+	r.RecordDrops(DropCounts{ReserveFailed: s.Lost})
+	r.recordTeardown(s.Records+s.Lost, consumer.postWindow, drainTime)
+	if r.Duration > 0 {
+		r.Throughput = float64(s.Paired) / r.Duration
+	}
+	r.CPUBudget = NewCPUBudget(startUsage, endUsage, consumed)
+	r.CPUUsage = r.CPUBudget.CPUPercent(wall)
+	r.MemoryUsage = uint64(len(ring.records)) * uint64(unsafe.Sizeof(Event{}))
+	s.ConsumerCPU = consumerCPU.CPUPercent(wall)
+	if s.Syscalls > 0 {
+		s.RecordsPerSyscall = float64(s.Records) / float64(s.Syscalls)
+		s.BytesPerSyscall = s.RecordsPerSyscall * float64(unsafe.Sizeof(Event{}))
+		s.Accuracy = float64(s.Correct) / float64(s.Syscalls)
+		s.ProgramNs = float64(programTime.Load()) / float64(s.Syscalls)
+		s.ConsumerNsPerSys = (consumerCPU.UserTimeUs + consumerCPU.SystemTimeUs) * 1000 / float64(s.Syscalls)
+	}
+	r.Pairing = s
+	r.Operations = []OperationResult{
+		NewOperationResult("syscall", s.Syscalls, wall),
+		NewOperationResult("record", s.Records, wall),
+		NewOperationResult("pair", s.Paired, wall),
+	}
+	if mode == pairKernel {
+		r.Operations = append(r.Operations, NewOperationResult("map_op", s.MapOps, wall))
+	}
+	return r, nil
+}
+
+// Run measures every mode in turn
+func (b *PairingBenchmark) Run(ctx context.Context) ([]*BenchmarkResult, error) {
+	if b.verbose {
+		PrintBenchmarkHeader("Entry/Exit Pairing Benchmark (Go)")
+	}
+	var results []*BenchmarkResult
+	for _, mode := range b.modes {
+		if ctx.Err() != nil {
+			break
+		}
+		r, err := b.runOne(ctx, mode)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// formatPairing renders the pairing counts, if any
+func (r *BenchmarkResult) formatPairing() string {
+	s := r.Pairing
+	if s == nil {
+		return ""
+	}
+	out := fmt.Sprintf("Pairing:         %s: %d of %d syscalls paired correctly (%.3f%%), %d mispaired; %.2f records (%.0f B) per syscall\n",
+		s.Mode, s.Correct, s.Syscalls, s.Accuracy*100, s.Mispaired, s.RecordsPerSyscall, s.BytesPerSyscall)
+	out += fmt.Sprintf("                 %d lost, %d exits missed, %d without a start", s.Lost, s.MissedExits, s.NoStart)
+	if s.Mode == pairKernel {
+		out += fmt.Sprintf(", %d refused by a full map", s.MapFull)
+	} else {
+		out += fmt.Sprintf(", %d orphaned starts", s.OrphanStarts)
+	}
+	out += fmt.Sprintf(", %d leaked entries\n", s.LeakedEntries)
+	return out + fmt.Sprintf("                 programs %.0f ns/syscall, consumer %.1f%% CPU, %.1f ns/syscall\n",
+		s.ProgramNs, s.ConsumerCPU, s.ConsumerNsPerSys)
+}
+
+// runPairingBenchmark is the entry point of the pairing subcommand
+func runPairingBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("pairing", flag.ExitOnError)
+	common := addBenchFlags(fs, "pairing_result.json", true)
+	modes := fs.String("modes", strings.Join(allPairModes, ","), "Comma-separated pairing modes (raw, kernel)")
+	producers := fs.Int("producers", max(runtime.NumCPU()-1, 1), "Producer CPUs, one goroutine each")
+	threads := fs.Int("threads", 64, "Threads per producer CPU, each with a syscall in flight")
+	rate := fs.Int("rate", 200000, "Syscalls per second over all producers (0 for flat out)")
+	mapEntries := fs.Int("map-entries", 10240, "max_entries of the kernel start map")
+	miss := fs.Float64("miss", 0.0001, "Probability that an exit is never seen, as when a thread dies mid-syscall")
+	churn := fs.Float64("churn", 0.001, "Probability that a thread exits after a syscall and a new thread takes its place")
+	median := fs.Duration("median", 5*time.Microsecond, "Median simulated syscall duration")
+	sigma := fs.Float64("sigma", 1.5, "Log-normal shape of the durations")
+	ringSize := fs.Int("ring", 4096, "Records in the ring buffer (power of two)")
+	seed := fs.Uint64("seed", 1, "Duration and churn generator seed")
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+	list := splitList(*modes)
+	for _, m := range list {
+		if !containsString(allPairModes, m) {
+			return nil, opts, fmt.Errorf("unknown pairing mode %q (want raw or kernel)", m)
+		}
+	}
+	switch {
+	case len(list) == 0:
+		return nil, opts, fmt.Errorf("-modes lists no pairing modes")
+	case *producers <= 0:
+		return nil, opts, fmt.Errorf("-producers must be positive")
+	case *threads <= 0:
+		return nil, opts, fmt.Errorf("-threads must be positive")
+	case *rate < 0:
+		return nil, opts, fmt.Errorf("-rate must not be negative")
+	case *mapEntries <= 0:
+		return nil, opts, fmt.Errorf("-map-entries must be positive")
+	case *miss < 0 || *miss > 1 || *churn < 0 || *churn > 1:
+		return nil, opts, fmt.Errorf("-miss and -churn must be probabilities from 0 to 1")
+	case *median <= 0:
+		return nil, opts, fmt.Errorf("-median must be positive")
+	case *sigma < 0:
+		return nil, opts, fmt.Errorf("-sigma must not be negative")
+	case *ringSize <= 0 || *ringSize&(*ringSize-1) != 0:
+		return nil, opts, fmt.Errorf("-ring must be a power of two")
+	}
+	if *mapEntries < *producers**threads && containsString(list, pairKernel) {
+		benchLog(ctx).Warn("The start map holds fewer entries than there are threads", "map_entries", *mapEntries, "threads", *producers**threads)
+	}
+
+	bench := &PairingBenchmark{
+		duration:   opts.Duration,
+		modes:      list,
+		producers:  *producers,
+		threads:    *threads,
+		rate:       *rate,
+		mapEntries: *mapEntries,
+		miss:       *miss,
+		churn:      *churn,
+		median:     *median,
+		sigma:      *sigma,
+		ringSize:   *ringSize,
+		seed:       *seed,
+		verbose:    opts.Verbose,
+	}
+	results, err := bench.Run(ctx)
+	if err != nil {
+		return nil, opts, err
+	}
+
+	PrintBenchmarkHeader(fmt.Sprintf("Entry/exit pairing, %d threads, miss %g, churn %g", *producers**threads, *miss, *churn))
+	fmt.Printf("%-7s %12s %9s %10s %10s %9s %11s %10s %14s\n",
+		"Mode", "Syscalls", "Accuracy", "Mispaired", "Records/sys", "Leaked", "Program/sys", "Consumer", "Consumer/sys")
+	for _, r := range results {
+		s := r.Pairing
+		fmt.Printf("%-7s %12d %8.3f%% %10d %11.2f %9d %8.0f ns %9.1f%% %11.1f ns\n", s.Mode, s.Syscalls, s.Accuracy*100,
+			s.Mispaired, s.RecordsPerSyscall, s.LeakedEntries, s.ProgramNs, s.ConsumerCPU, s.ConsumerNsPerSys)
+	}
+	return results, opts, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// PayloadGenerator produces event and packet payload contents. Entropy
+// matters: all-zero payloads compress perfectly and stay hot in cache,
+// which makes downstream stages look unrealistically cheap.
+type PayloadGenerator interface {
+	// Uint32 returns the next 32-bit value, e.g. for Event.Data
+	Uint32() uint32
+	// Fill overwrites buf with payload bytes
+	Fill(buf []byte)
+	Name() string
+}
+
+// payloadGenerators maps -payload flag values to constructors
+var payloadGenerators = map[string]func(seed uint64) PayloadGenerator{
+	"zeros":   func(uint64) PayloadGenerator { return zeroPayload{} },
+	"random":  func(seed uint64) PayloadGenerator { return &randomPayload{state: seed | 1} },
+	"syscall": func(seed uint64) PayloadGenerator { return &syscallPayload{rng: randomPayload{state: seed | 1}} },
+}
+
+// NewPayloadGenerator creates the named generator. Generators are seeded
+// deterministically so runs with the same seed see identical data.
+func NewPayloadGenerator(name string, seed uint64) (PayloadGenerator, error) {
+	ctor, ok := payloadGenerators[name]
+	if !ok {
+		names := make([]string, 0, len(payloadGenerators))
+		for n := range payloadGenerators {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown payload generator %q (want one of %v)", name, names)
+	}
+	return ctor(seed), nil
+}
+
+// zeroPayload produces all-zero payloads
+type zeroPayload struct{}
+
+func (zeroPayload) Uint32() uint32 { return 0 }
+func (zeroPayload) Name() string   { return "zeros" }
+
+func (zeroPayload) Fill(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
+
+// randomPayload produces incompressible data from a xorshift64* generator,
+// which is fast enough not to dominate the hot path
+type randomPayload struct {
+	state uint64
+}
+
+func (r *randomPayload) next() uint64 {
+	r.state ^= r.state >> 12
+	r.state ^= r.state << 25
+	r.state ^= r.state >> 27
+	return r.state * 2685821657736338717
+}
+
+func (r *randomPayload) Uint32() uint32 { return uint32(r.next() >> 32) }
+func (r *randomPayload) Name() string   { return "random" }
+
+func (r *randomPayload) Fill(buf []byte) {
+	i := 0
+	for ; i+8 <= len(buf); i += 8 {
+		binary.LittleEndian.PutUint64(buf[i:], r.next())
+	}
+	if i < len(buf) {
+		var tail [8]byte
+		binary.LittleEndian.PutUint64(tail[:], r.next())
+		copy(buf[i:], tail[:])
+	}
+}
+
+// syscallPayload mimics syscall arguments: small file descriptors, open
+// flag combinations, power-of-two sizes and userspace pointers. The result
+// has the skewed, partially redundant distribution of real tracing data.
+type syscallPayload struct {
+	rng randomPayload
+}
+
+var syscallFlagValues = []uint32{
+	0x0,      // O_RDONLY
+	0x80000,  // O_RDONLY|O_CLOEXEC
+	0x80241,  // O_WRONLY|O_CREAT|O_TRUNC|O_CLOEXEC
+	0x88000,  // O_RDONLY|O_LARGEFILE|O_CLOEXEC
+	0x90800,  // O_RDONLY|O_NONBLOCK|O_DIRECTORY|O_CLOEXEC
+	0x80042,  // O_RDWR|O_CREAT|O_CLOEXEC
+	0x100000, // O_PATH
+}
+
+func (s *syscallPayload) Uint32() uint32 {
+	r := s.rng.next()
+	switch r % 4 {
+	case 0: // File descriptor, mostly small
+		return uint32(3 + (r>>8)%29)
+	case 1: // Open flags
+		return syscallFlagValues[(r>>8)%uint64(len(syscallFlagValues))]
+	case 2: // Buffer size: power of two up to 64KiB
+		return 1 << ((r >> 8) % 17)
+	default: // Low bits of a stack or heap pointer, 8-byte aligned
+		return uint32(0xd3c00000 | (r>>8)&0x3ffff8)
+	}
+}
+
+func (s *syscallPayload) Name() string { return "syscall" }
+
+func (s *syscallPayload) Fill(buf []byte) {
+	// Argument-sized words with the high half of pointers shared, like a
+	// struct of syscall arguments captured from one process
+	i := 0
+	for ; i+8 <= len(buf); i += 8 {
+		word := uint64(0x00007ffd00000000) | uint64(s.Uint32())
+		binary.LittleEndian.PutUint64(buf[i:], word)
+	}
+	for ; i < len(buf); i++ {
+		buf[i] = byte(s.Uint32())
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// perfRecordSize is the size of one sample record in a perf buffer: the
+// perf_event_header and u32 size prefix around the 24-byte event, padded
+// to 8 bytes
+const perfRecordSize = 8 + 4 + 24 + 4
+
+// perfCPUBuffer models one per-CPU perf ring of a perf event array
+type perfCPUBuffer struct {
+	records []Event
+	lost    int64
+}
+
+// PerfBufBenchmark simulates perf event array delivery. Unlike the shared
+// ring buffer, every CPU writes to its own ring, the reader is woken once a
+// ring holds wakeupEvents samples, and samples from different CPUs reach
+// userspace out of order. With several readers the rings are split
+// between goroutines that append to a sharded buffer, one shard per CPU.
+type PerfBufBenchmark struct {
+	benchRunner
+	duration     time.Duration
+	pages        int // Per-CPU ring size in pages
+	wakeupEvents int
+	readers      int
+	verbose      bool
+	payload      PayloadGenerator
+	mix          *eventMix
+	schedule     *RateSchedule
+	phases       Phases
+	discard      bool // Outside the measured window: drain without recording
+	rings        []perfCPUBuffer
+	capacity     int // Records per ring
+	eventBuffer  *ShardedEventBuffer
+	wakeups      int64
+	generated    int64              // Samples produced in the measured window, lost ones included
+	delivery     []deliveryRecorder // Per reader, merged after the run
+	readBufs     [][]Event          // Per reader, perfReadBatch samples each
+	chaos        *chaosMonkey       // Consumer disruptions, if in chaos mode
+	pausedUntil  time.Time          // Chaos pause: rings fill but are not read
+	pinning      *cpuPinning        // Polling thread CPUs; nil leaves it unpinned
+	result       *BenchmarkResult
+}
+
+// NewPerfBufBenchmark creates a new benchmark instance
+func NewPerfBufBenchmark(duration time.Duration, pages, wakeupEvents, readers int, verbose bool) *PerfBufBenchmark {
+	cpus := runtime.NumCPU()
+	return &PerfBufBenchmark{
+		duration:     duration,
+		pages:        pages,
+		wakeupEvents: wakeupEvents,
+		readers:      min(readers, cpus),
+		verbose:      verbose,
+		rings:        make([]perfCPUBuffer, cpus),
+		delivery:     make([]deliveryRecorder, max(min(readers, cpus), 1)),
+		readBufs:     newReadBufs(max(min(readers, cpus), 1), perfReadBatch),
+		capacity:     pages * os.Getpagesize() / perfRecordSize,
+		eventBuffer:  NewShardedEventBuffer(cpus, 10000000), // Same cap as the ring buffer benchmark
+		result: &BenchmarkResult{
+			Name:           "Perf Buffer Throughput",
+			Language:       "Go",
+			ProgramType:    "tracepoint",
+			DataMechanism:  "perf_buffer",
+			ReaderStrategy: fmt.Sprintf("epoll/wakeup=%d/readers=%d", wakeupEvents, min(readers, cpus)),
+			Errors:         []string{},
+		},
+	}
+}
+
+// SetPhases sets the unmeasured warm-up and cooldown around the run
+func (b *PerfBufBenchmark) SetPhases(p Phases) {
+	b.phases = p
+	p.record(b.result)
+}
+
+// unmeasured runs the rings for d at the schedule's steady rate, draining
+// them without recording anything. Counters are reset afterwards so they
+// cover only the measured window.
+func (b *PerfBufBenchmark) unmeasured(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	var steady *RateSchedule
+	if b.schedule != nil {
+		steady = b.schedule.Steady()
+	}
+	b.discard = true
+	runPhase(ctx, d, func() {
+		if b.produce(steady) {
+			b.drain()
+		}
+	})
+	b.drain() // Empties the rings and their lost counts
+	b.discard = false
+	b.wakeups = 0
+	b.generated = 0
+}
+
+// Start runs the benchmark in the background
+func (b *PerfBufBenchmark) Start(ctx context.Context) error {
+	return b.start(ctx, b.Run)
+}
+
+// Wait returns the result once the benchmark has finished
+func (b *PerfBufBenchmark) Wait() (*BenchmarkResult, error) {
+	return b.result, b.wait()
+}
+
+// Run executes the benchmark until its duration elapses or ctx is done
+func (b *PerfBufBenchmark) Run(ctx context.Context) error {
+	if b.verbose {
+		PrintBenchmarkHeader("Perf Buffer Throughput Benchmark (Go)")
+	}
+	log := benchLog(ctx)
+	log.Info("Running", "duration", b.duration, "cpus", len(b.rings), "pages", b.pages,
+		"wakeup_events", b.wakeupEvents, "readers", b.readers)
+
+	b.result.Host = CollectHostInfo()
+	pin := b.pinning.newRun()
+	if b.chaos != nil || pin != nil {
+		runtime.LockOSThread() // Chaos migrates the thread polling the rings, pinning holds it
+		defer runtime.UnlockOSThread()
+	}
+	consumer := pin.pinConsumer()
+	defer consumer.release()
+	b.unmeasured(ctx, b.phases.Warmup)
+
+	startUsage, err := TakeResourceSnapshot()
+	if err != nil {
+		b.result.Errors = append(b.result.Errors, fmt.Sprintf("rusage: %v", err))
+	}
+
+	b.result.StartTime = time.Now()
+	b.eventBuffer.Start()
+	for i := range b.delivery {
+		b.delivery[i].reset()
+	}
+	b.chaos.start()
+
+	ticker := time.NewTicker(simTick)
+	defer ticker.Stop()
+	done := time.NewTimer(b.duration)
+	defer done.Stop()
+
+	var lost int64
+loop:
+	for {
+		select {
+		case <-done.C:
+			break loop
+		case <-ctx.Done():
+			log.Info("Stopped early")
+			b.result.Quality.Flag(QualityInterrupted)
+			break loop
+		case <-ticker.C:
+			wake := b.produce(b.schedule)
+			if b.chaos != nil {
+				now := time.Now()
+				if b.chaos.due(now) {
+					b.pausedUntil = now.Add(b.chaos.disrupt(now))
+				}
+				wake = wake && !now.Before(b.pausedUntil)
+			}
+			if wake {
+				lost += b.drain().LostSamples
+			}
+			consumer.observe()
+		}
+	}
+	b.result.Chaos = b.chaos.stop()
+	b.result.Affinity = pin.stats()
+	b.eventBuffer.End()
+	b.result.EndTime = time.Now()
+
+	// Samples that never reached the watermark, or arrived while a chaos
+	// pause held the reader, are still in the rings: drain them uncounted.
+	// Their rings' losses happened in the window, so those count.
+	var postWindow int64
+	for _, ring := range b.rings {
+		postWindow += int64(len(ring.records))
+	}
+	wakeups := b.wakeups
+	b.discard = true
+	lost += b.drain().LostSamples
+	b.discard = false
+	drainTime := time.Since(b.result.EndTime)
+	merged := b.eventBuffer.Merge()
+
+	b.result.Duration = merged.GetDuration()
+	b.result.EventCount = merged.GetEventCount()
+	b.result.RecordDrops(DropCounts{BufferFull: merged.GetDroppedCount(), LostSamples: lost})
+	b.result.Throughput = merged.GetThroughput()
+	b.result.Latency = merged.GetLatencyStats()
+	b.result.LatencyHistogram = merged.GetLatencyHistogram(DefaultHistogramPrecision).Buckets()
+	b.result.Quality.Merge(merged.GetDataQuality())
+	b.result.EventTypes = merged.GetEventTypeStats()
+	b.result.recordCPUs(merged)
+	for i := range b.delivery {
+		merged.delivery.merge(&b.delivery[i])
+	}
+	b.result.recordDelivery(merged)
+	b.result.recordTeardown(b.generated, postWindow, drainTime)
+	b.result.Operations = []OperationResult{NewOperationResult("wakeup", wakeups, b.result.EndTime.Sub(b.result.StartTime))}
+
+	endUsage, err := TakeResourceSnapshot()
+	if err != nil {
+		b.result.Errors = append(b.result.Errors, fmt.Sprintf("rusage: %v", err))
+	}
+	b.result.CPUBudget = NewCPUBudget(startUsage, endUsage, b.result.EventCount)
+	b.result.CPUUsage = b.result.CPUBudget.CPUPercent(endUsage.Wall.Sub(startUsage.Wall))
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	b.result.MemoryUsage = m.Alloc
+
+	b.unmeasured(ctx, b.phases.Cooldown)
+	return nil
+}
+
+// produce writes one tick of simulated samples into the per-CPU rings, at
+// the same rate as the ring buffer benchmark, and reports whether any ring
+// reached the wakeup watermark
+func (b *PerfBufBenchmark) produce(schedule *RateSchedule) bool {
+	eventsToCreate := 50 + (len(b.rings) * 5)
+	if schedule != nil {
+		eventsToCreate = schedule.Next()
+	}
+	pid := uint32(os.Getpid())
+	wake := false
+	if !b.discard {
+		b.generated += int64(eventsToCreate)
+	}
+
+	for i := 0; i < eventsToCreate; i++ {
+		cpu := i % len(b.rings)
+		ring := &b.rings[cpu]
+		if len(ring.records) >= b.capacity {
+			ring.lost++
+			// A full ring is still past the watermark a paused reader
+			// missed, so epoll keeps reporting it readable
+			wake = wake || len(ring.records) >= b.wakeupEvents
+			continue
+		}
+		e := Event{
+			Timestamp: uint64(time.Now().UnixNano()),
+			PID:       pid,
+			CPU:       uint32(cpu),
+			EventType: eventTypeTracepoint,
+			Data:      uint32(i),
+		}
+		if b.mix != nil {
+			e.EventType = b.mix.Next()
+		}
+		if b.payload != nil {
+			e.Data = b.payload.Uint32()
+		}
+		ring.records = append(ring.records, e)
+		if len(ring.records) >= b.wakeupEvents {
+			wake = true
+		}
+	}
+	return wake
+}
+
+// drain reads every per-CPU ring after epoll reports them readable. A
+// single reader walks the rings in CPU order, as perf_buffer__poll does;
+// several readers each consume every readers-th ring concurrently. It
+// returns the samples the rings lost since they were last read.
+func (b *PerfBufBenchmark) drain() DropCounts {
+	b.wakeups++
+	if b.readers <= 1 {
+		return b.drainRings(0, 1, &b.delivery[0])
+	}
+	var wg sync.WaitGroup
+	lost := make([]DropCounts, b.readers)
+	for r := 0; r < b.readers; r++ {
+		wg.Add(1)
+		go func(first int) {
+			defer wg.Done()
+			lost[first] = b.drainRings(first, b.readers, &b.delivery[first])
+		}(r)
+	}
+	wg.Wait()
+	var total DropCounts
+	for _, l := range lost {
+		total.LostSamples += l.LostSamples
+	}
+	return total
+}
+
+// perfReadBatch is how many samples a reader takes per read
+const perfReadBatch = 256
+
+// newReadBufs returns a read buffer of size events for each of n readers
+func newReadBufs(n, size int) [][]Event {
+	bufs := make([][]Event, n)
+	for i := range bufs {
+		bufs[i] = make([]Event, size)
+	}
+	return bufs
+}
+
+// drainRings consumes rings first, first+stride, ... into their CPU's
+// shard until they are empty
+func (b *PerfBufBenchmark) drainRings(first, stride int, d *deliveryRecorder) DropCounts {
+	r := &perfReader{b: b, cpu: first, stride: stride, delivery: d}
+	lost, _ := consumeReader(context.Background(), r, shardByCPU(b.eventBuffer), b.readBufs[first])
+	return lost
+}
+
+// perfReader reads a reader's share of the per-CPU rings once through,
+// as perf_buffer__consume does, ending when they are all empty. The lost
+// count of each ring is reported once the ring is read, as the
+// PERF_RECORD_LOST it stands for would be.
+type perfReader struct {
+	b        *PerfBufBenchmark
+	cpu      int // Ring being read
+	pos      int // Next record in it
+	stride   int
+	delivery *deliveryRecorder // Notes each sample's delivery latency
+}
+
+// Read hands over the next samples. Outside the measured window the rings
+// are emptied without handing anything over.
+func (r *perfReader) Read(buf []Event) (int, DropCounts, error) {
+	var lost DropCounts
+	n := 0
+	for n < len(buf) && r.cpu < len(r.b.rings) {
+		ring := &r.b.rings[r.cpu]
+		if r.b.discard {
+			r.pos = len(ring.records)
+		}
+		for ; r.pos < len(ring.records) && n < len(buf); r.pos++ {
+			e := &ring.records[r.pos]
+			r.delivery.recordEvent(e, nowNs(), len(ring.records)-r.pos, r.b.capacity)
+			buf[n] = *e
+			n++
+		}
+		if r.pos == len(ring.records) {
+			lost.LostSamples += ring.lost
+			ring.lost = 0
+			ring.records = ring.records[:0]
+			r.cpu += r.stride
+			r.pos = 0
+		}
+	}
+	if n == 0 && r.cpu >= len(r.b.rings) {
+		return 0, lost, io.EOF
+	}
+	return n, lost, nil
+}
+
+// runPerfBufBenchmark is the entry point of the perfbuf subcommand
+func runPerfBufBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("perfbuf", flag.ExitOnError)
+	common := addBenchFlags(fs, "perfbuf_result.json", true)
+	pages := fs.Int("pages", 64, "Per-CPU ring size in pages")
+	wakeup := fs.Int("wakeup", 1, "Samples per CPU before the reader is woken (wakeup_events)")
+	payloadName := fs.String("payload", "syscall", "Event payload contents (zeros, random, syscall)")
+	seed := fs.Uint64("seed", 1, "Payload generator seed")
+	readers := fs.Int("readers", 1, "Reader goroutines draining the per-CPU rings (capped at the CPU count)")
+	mixFlag := fs.String("event-mix", "tracepoint", "Event types sharing the rings, with weights (e.g. tracepoint:3,kprobe:1)")
+	rate := addRateFlags(fs)
+	tracepoint := addTracepointFlag(fs)
+	phaseFlags := addPhaseFlags(fs)
+	outlierFlags := addOutlierFlags(fs)
+	chaosFlags := addChaosFlags(fs)
+	affinityFlags := addAffinityFlags(fs, false)
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+	if *pages <= 0 || *pages&(*pages-1) != 0 {
+		return nil, opts, fmt.Errorf("-pages must be a power of two")
+	}
+	if *wakeup <= 0 {
+		return nil, opts, fmt.Errorf("-wakeup must be positive")
+	}
+	if *readers <= 0 {
+		return nil, opts, fmt.Errorf("-readers must be positive")
+	}
+	mix, err := parseEventMix(*mixFlag)
+	if err != nil {
+		return nil, opts, fmt.Errorf("invalid -event-mix: %w", err)
+	}
+	payload, err := NewPayloadGenerator(*payloadName, *seed)
+	if err != nil {
+		return nil, opts, err
+	}
+	schedule, err := rate.schedule(opts.Duration, *seed)
+	if err != nil {
+		return nil, opts, err
+	}
+	phases, err := phaseFlags.phases()
+	if err != nil {
+		return nil, opts, err
+	}
+	outliers, err := outlierFlags.capture()
+	if err != nil {
+		return nil, opts, err
+	}
+	tp, err := resolveTracepoint(*tracepoint)
+	if err != nil {
+		return nil, opts, fmt.Errorf("invalid -tracepoint: %w", err)
+	}
+	chaos, err := chaosFlags.monkey()
+	if err != nil {
+		return nil, opts, err
+	}
+	pinning, err := affinityFlags.pinning()
+	if err != nil {
+		return nil, opts, err
+	}
+	if chaos != nil && chaos.migrate && pinning != nil && len(pinning.consumer) > 0 {
+		return nil, opts, fmt.Errorf("-chaos migrates the consumer off the -cpu-affinity CPUs; add -chaos-migrate=false")
+	}
+
+	bench := NewPerfBufBenchmark(opts.Duration, *pages, *wakeup, *readers, opts.Verbose)
+	bench.payload = payload
+	bench.mix = mix
+	bench.eventBuffer.SetProgress(NewProgress("perfbuf"))
+	bench.result.Payload = payload.Name()
+	bench.schedule = schedule
+	bench.result.RateProfile = schedule.Name()
+	bench.SetPhases(phases)
+	bench.result.Tracepoint = tp
+	bench.pinning = pinning
+	if chaos != nil {
+		bench.chaos = chaos
+		bench.result.ReaderStrategy += "/chaos"
+	}
+	for i := range bench.delivery {
+		bench.delivery[i].outliers = outliers.reset() // One capture per reader
+	}
+	if err := bench.Run(ctx); err != nil {
+		return nil, opts, err
+	}
+	return []*BenchmarkResult{bench.result}, opts, nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// PerfCounterStats are the process's hardware and scheduler counters over
+// a result's measured window, as perf stat would count them. Counters are
+// sampled every gcSampleEvery, so the window is widened to the samples
+// around it, and include the sampler's own small share.
+type PerfCounterStats struct {
+	Cycles               uint64
+	Instructions         uint64
+	CacheReferences      uint64
+	CacheMisses          uint64
+	ContextSwitches      uint64
+	CPUMigrations        uint64
+	IPC                  float64 // Instructions per cycle
+	CacheMissRate        float64 // Cache misses per cache reference
+	CyclesPerEvent       float64 // Per measured event, if any
+	InstructionsPerEvent float64
+	UserOnly             bool     `json:",omitempty"` // Kernel-mode counts were not allowed (perf_event_paranoid)
+	Scaled               bool     `json:",omitempty"` // Counters were multiplexed and scaled to the time enabled
+	Unavailable          []string `json:",omitempty"` // Counters the kernel or hardware does not provide
+}
+
+// perf_event_open(2) constants for counting
+const (
+	perfTypeHardware     = 0
+	perfTypeSoftware     = 1
+	perfFormatTotalTimes = 1 | 2 // PERF_FORMAT_TOTAL_TIME_ENABLED | _RUNNING
+	perfAttrExcludeKern  = 1 << 5
+	perfAttrExcludeHV    = 1 << 6
+)
+
+// perfCounterKinds are the counters opened on every thread, in the order
+// of perfCounterSample.values
+var perfCounterKinds = []struct {
+	name   string
+	typ    uint32
+	config uint64
+}{
+	{"cycles", perfTypeHardware, 0},
+	{"instructions", perfTypeHardware, 1},
+	{"cache-references", perfTypeHardware, 2},
+	{"cache-misses", perfTypeHardware, 3},
+	{"context-switches", perfTypeSoftware, 3},
+	{"cpu-migrations", perfTypeSoftware, 4},
+}
+
+// perfCounterSample holds the process's counters, summed over its
+// threads, at a point in time
+type perfCounterSample struct {
+	at     time.Time
+	values []uint64
+	scaled bool
+}
+
+// perfThread is the counters of one thread; a counter the kernel refused
+// has fd -1. last keeps the final values of a thread that has exited.
+type perfThread struct {
+	fds  []int
+	last []uint64
+	gone bool
+}
+
+// perfCounterMonitor samples the counters of every thread of the process
+type perfCounterMonitor struct {
+	mu          sync.Mutex
+	threads     map[int]*perfThread
+	userOnly    bool
+	unavailable map[string]bool
+	samples     []perfCounterSample
+}
+
+// perfCounters is the process's monitor, started by -perf-counters
+var perfCounters struct {
+	once    sync.Once
+	monitor *perfCounterMonitor
+	err     error
+}
+
+// startPerfCounters opens the counters and samples them until the process
+// exits. Only the first call starts it, so a suite and its benchmarks
+// share one.
+func startPerfCounters() error {
+	perfCounters.once.Do(func() {
+		m := &perfCounterMonitor{threads: make(map[int]*perfThread), unavailable: make(map[string]bool)}
+		m.sample()
+		if len(m.unavailable) == len(perfCounterKinds) {
+			perfCounters.err = fmt.Errorf("perf_event_open refused every counter (see /proc/sys/kernel/perf_event_paranoid)")
+			return
+		}
+		perfCounters.monitor = m
+		go func() {
+			ticker := time.NewTicker(gcSampleEvery)
+			defer ticker.Stop()
+			for range ticker.C {
+				m.sample()
+			}
+		}()
+	})
+	return perfCounters.err
+}
+
+// openCounter opens one counting event on tid. Kernel-mode counting is
+// dropped if perf_event_paranoid forbids it.
+func (m *perfCounterMonitor) openCounter(tid int, typ uint32, config uint64) (int, error) {
+	attr := perfEventAttr{typ: typ, config: config, readFormat: perfFormatTotalTimes}
+	attr.size = uint32(unsafe.Sizeof(attr))
+	if m.userOnly {
+		attr.flags |= perfAttrExcludeKern | perfAttrExcludeHV
+	}
+	for {
+		fd, _, errno := syscall.Syscall6(syscall.SYS_PERF_EVENT_OPEN, uintptr(unsafe.Pointer(&attr)),
+			uintptr(tid), ^uintptr(0), ^uintptr(0), perfFlagFDCloexec, 0)
+		if errno == 0 {
+			return int(fd), nil
+		}
+		if (errno == syscall.EACCES || errno == syscall.EPERM) && !m.userOnly {
+			m.userOnly = true
+			attr.flags |= perfAttrExcludeKern | perfAttrExcludeHV
+			continue
+		}
+		return -1, errno
+	}
+}
+
+// sample opens counters on threads started since the last sample, and
+// appends the process's totals
+func (m *perfCounterMonitor) sample() {
+	tids, _ := processThreads()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, tid := range tids {
+		if m.threads[tid] != nil {
+			continue
+		}
+		t := &perfThread{fds: make([]int, len(perfCounterKinds)), last: make([]uint64, len(perfCounterKinds))}
+		for i, k := range perfCounterKinds {
+			fd, err := -1, error(nil)
+			if !m.unavailable[k.name] {
+				fd, err = m.openCounter(tid, k.typ, k.config)
+			}
+			// ESRCH is a thread that already exited; anything else means
+			// the counter is not there to count
+			if err != nil && !errors.Is(err, syscall.ESRCH) {
+				m.unavailable[k.name] = true
+			}
+			t.fds[i] = fd
+		}
+		m.threads[tid] = t
+	}
+
+	s := perfCounterSample{at: time.Now(), values: make([]uint64, len(perfCounterKinds))}
+	var buf [24]byte
+	for _, t := range m.threads {
+		for i, fd := range t.fds {
+			if fd < 0 || t.gone {
+				s.values[i] += t.last[i]
+				continue
+			}
+			if n, err := syscall.Read(fd, buf[:]); err == nil && n == len(buf) {
+				v := binary.LittleEndian.Uint64(buf[0:])
+				enabled := binary.LittleEndian.Uint64(buf[8:])
+				running := binary.LittleEndian.Uint64(buf[16:])
+				if running > 0 && running < enabled {
+					v = uint64(float64(v) * float64(enabled) / float64(running))
+					s.scaled = true
+				}
+				t.last[i] = max(t.last[i], v)
+			}
+			s.values[i] += t.last[i]
+		}
+	}
+	// Threads that exited keep their last counts; their counters are closed
+	live := make(map[int]bool, len(tids))
+	for _, tid := range tids {
+		live[tid] = true
+	}
+	for tid, t := range m.threads {
+		if !live[tid] && !t.gone {
+			t.gone = true
+			for _, fd := range t.fds {
+				if fd >= 0 {
+					syscall.Close(fd)
+				}
+			}
+		}
+	}
+	m.samples = append(m.samples, s)
+}
+
+// processThreads lists the thread IDs of the process
+func processThreads() ([]int, error) {
+	entries, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return nil, err
+	}
+	tids := make([]int, 0, len(entries))
+	for _, e := range entries {
+		if tid, err := strconv.Atoi(e.Name()); err == nil {
+			tids = append(tids, tid)
+		}
+	}
+	return tids, nil
+}
+
+// recordPerfCounters fills in the counters of each result from the
+// samples around its measured window, if -perf-counters is on
+func recordPerfCounters(results []*BenchmarkResult) {
+	m := perfCounters.monitor
+	if m == nil {
+		return
+	}
+	m.sample() // So a window that just ended has a sample after it
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range results {
+		if r.StartTime.IsZero() || len(m.samples) < 2 {
+			continue
+		}
+		first := sort.Search(len(m.samples), func(i int) bool { return m.samples[i].at.After(r.StartTime) }) - 1
+		last := sort.Search(len(m.samples), func(i int) bool { return !m.samples[i].at.Before(r.EndTime) })
+		first = max(first, 0)
+		last = min(last, len(m.samples)-1)
+		if last <= first {
+			continue
+		}
+		a, b := m.samples[first], m.samples[last]
+		d := func(i int) uint64 {
+			if b.values[i] < a.values[i] {
+				return 0
+			}
+			return b.values[i] - a.values[i]
+		}
+		p := &PerfCounterStats{
+			Cycles:          d(0),
+			Instructions:    d(1),
+			CacheReferences: d(2),
+			CacheMisses:     d(3),
+			ContextSwitches: d(4),
+			CPUMigrations:   d(5),
+			UserOnly:        m.userOnly,
+		}
+		for _, s := range m.samples[first : last+1] {
+			p.Scaled = p.Scaled || s.scaled
+		}
+		for _, k := range perfCounterKinds {
+			if m.unavailable[k.name] {
+				p.Unavailable = append(p.Unavailable, k.name)
+			}
+		}
+		if p.Cycles > 0 {
+			p.IPC = float64(p.Instructions) / float64(p.Cycles)
+		}
+		if p.CacheReferences > 0 {
+			p.CacheMissRate = float64(p.CacheMisses) / float64(p.CacheReferences)
+		}
+		if r.EventCount > 0 {
+			p.CyclesPerEvent = float64(p.Cycles) / float64(r.EventCount)
+			p.InstructionsPerEvent = float64(p.Instructions) / float64(r.EventCount)
+		}
+		r.PerfCounters = p
+	}
+}
+
+// formatPerfCounters renders the counters of the measured window, if
+// recorded
+func (r *BenchmarkResult) formatPerfCounters() string {
+	p := r.PerfCounters
+	if p == nil {
+		return ""
+	}
+	unavailable := make(map[string]bool, len(p.Unavailable))
+	for _, name := range p.Unavailable {
+		unavailable[name] = true
+	}
+	var parts []string
+	if !unavailable["cycles"] && !unavailable["instructions"] {
+		s := fmt.Sprintf("%d cycles, %d instructions (IPC %.2f)", p.Cycles, p.Instructions, p.IPC)
+		if p.CyclesPerEvent > 0 {
+			s += fmt.Sprintf(", %.0f cycles/event", p.CyclesPerEvent)
+		}
+		parts = append(parts, s)
+	}
+	if !unavailable["cache-references"] && !unavailable["cache-misses"] {
+		parts = append(parts, fmt.Sprintf("%d of %d cache references missed (%.2f%%)", p.CacheMisses, p.CacheReferences, p.CacheMissRate*100))
+	}
+	parts = append(parts, fmt.Sprintf("%d context switches, %d migrations", p.ContextSwitches, p.CPUMigrations))
+	line := "Perf counters:   " + strings.Join(parts, "; ")
+	var notes []string
+	if p.UserOnly {
+		notes = append(notes, "user mode only")
+	}
+	if p.Scaled {
+		notes = append(notes, "multiplexed")
+	}
+	if len(p.Unavailable) > 0 {
+		notes = append(notes, "no "+strings.Join(p.Unavailable, ", "))
+	}
+	if len(notes) > 0 {
+		line += " (" + strings.Join(notes, "; ") + ")"
+	}
+	return line + "\n"
+}
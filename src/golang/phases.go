@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// Phases are the unmeasured periods around a benchmark's measured window.
+// Events keep flowing through the pipeline during both, so JIT warm-up,
+// map population and page-cache effects settle before measurement and the
+// window's last events are not cut off by teardown.
+type Phases struct {
+	Warmup   time.Duration
+	Cooldown time.Duration
+}
+
+// phaseFlagSet holds the -warmup and -cooldown flags
+type phaseFlagSet struct {
+	warmup   *durationFlag
+	cooldown *durationFlag
+}
+
+// addPhaseFlags registers -warmup and -cooldown
+func addPhaseFlags(fs *flag.FlagSet) *phaseFlagSet {
+	f := &phaseFlagSet{warmup: &durationFlag{}, cooldown: &durationFlag{}}
+	fs.Var(f.warmup, "warmup", "Run this long before measuring; events are consumed but excluded from statistics")
+	fs.Var(f.cooldown, "cooldown", "Keep running this long after measuring, excluded from statistics")
+	return f
+}
+
+// phases validates and returns the parsed flags
+func (f *phaseFlagSet) phases() (Phases, error) {
+	p := Phases{Warmup: f.warmup.d, Cooldown: f.cooldown.d}
+	if p.Warmup < 0 || p.Cooldown < 0 {
+		return p, fmt.Errorf("-warmup and -cooldown must not be negative")
+	}
+	return p, nil
+}
+
+// record stores the phases in r
+func (p Phases) record(r *BenchmarkResult) {
+	r.Warmup = p.Warmup.Seconds()
+	r.Cooldown = p.Cooldown.Seconds()
+}
+
+// runPhase calls tick every simTick for d. It returns early, and false,
+// when ctx is done.
+func runPhase(ctx context.Context, d time.Duration, tick func()) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	ticker := time.NewTicker(simTick)
+	defer ticker.Stop()
+	done := time.NewTimer(d)
+	defer done.Stop()
+	for {
+		select {
+		case <-done.C:
+			return true
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+			tick()
+		}
+	}
+}
+
+// formatPhases renders the excluded phases, if any
+func (r *BenchmarkResult) formatPhases() string {
+	if r.Warmup == 0 && r.Cooldown == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Excluded:        %.3fs warm-up, %.3fs cooldown\n", r.Warmup, r.Cooldown)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProfileStats name the pprof profiles taken over a result's measured
+// window. They open with go tool pprof, e.g. -top to see whether decode,
+// map operations or the GC dominate the consumer.
+type ProfileStats struct {
+	CPUProfile  string    `json:",omitempty"`
+	HeapProfile string    `json:",omitempty"` // In-use and allocated heap at the end of the window
+	Start       time.Time // Window profiled, from when the live counters showed collection
+	End         time.Time
+	Error       string `json:",omitempty"`
+}
+
+// Profiles -pprof can take
+const (
+	profileCPU  = "cpu"
+	profileHeap = "heap"
+)
+
+// profiler takes the -pprof profiles of every collection window of the
+// tracked benchmarks, one at a time: the CPU profiler is process-wide
+var profiler struct {
+	sync.Mutex
+	once      sync.Once
+	armed     bool
+	kinds     map[string]bool
+	base      string // Output path without its extension
+	seq       int    // Windows profiled under base
+	seen      map[*Progress]bool
+	benchmark string        // Benchmark of the window being profiled
+	done      chan struct{} // Closed when its profiles are written
+	captures  []profileCapture
+}
+
+// profileCapture is a profiled window of a benchmark
+type profileCapture struct {
+	benchmark string
+	stats     *ProfileStats
+}
+
+// parseProfileKinds parses -pprof
+func parseProfileKinds(s string) (map[string]bool, error) {
+	kinds := make(map[string]bool)
+	for _, k := range splitList(s) {
+		switch k {
+		case profileCPU, profileHeap:
+			kinds[k] = true
+		default:
+			return nil, fmt.Errorf("invalid -pprof %q (want cpu, heap or both)", k)
+		}
+	}
+	return kinds, nil
+}
+
+// startProfiler profiles the collection windows of the benchmarks that
+// follow, saving the profiles next to output. Later calls only move the
+// profiles to their output, so a suite's benchmarks each get their own.
+func startProfiler(kinds map[string]bool, output string) {
+	profiler.Lock()
+	base := strings.TrimSuffix(output, filepath.Ext(output))
+	if base != profiler.base {
+		profiler.base, profiler.seq = base, 0
+	}
+	profiler.kinds = kinds
+	profiler.armed = true
+	profiler.Unlock()
+	profiler.once.Do(func() {
+		metricsRegistry.Lock()
+		metricsRegistry.tracking = true
+		metricsRegistry.Unlock()
+		profiler.seen = make(map[*Progress]bool)
+		go watchProfiles()
+	})
+}
+
+// watchProfiles profiles each tracked benchmark that starts collecting
+func watchProfiles() {
+	ticker := time.NewTicker(goTraceWatchEvery)
+	defer ticker.Stop()
+	for range ticker.C {
+		metricsRegistry.Lock()
+		progress := append([]*Progress(nil), metricsRegistry.progress...)
+		metricsRegistry.Unlock()
+		for _, p := range progress {
+			if profiler.seen[p] || p.startNs.Load() == 0 || p.endNs.Load() != 0 {
+				continue
+			}
+			profiler.seen[p] = true
+			profiler.Lock()
+			profiler.seq++
+			name := profiler.base
+			if profiler.seq > 1 {
+				name += fmt.Sprintf("_%d", profiler.seq)
+			}
+			kinds := profiler.kinds
+			profiler.benchmark = p.benchmark
+			profiler.done = make(chan struct{})
+			profiler.Unlock()
+
+			s := profileWindow(p, name, kinds)
+			profiler.Lock()
+			profiler.captures = append(profiler.captures, profileCapture{p.benchmark, s})
+			close(profiler.done)
+			profiler.done = nil
+			profiler.Unlock()
+		}
+	}
+}
+
+// profileWindow profiles until p stops collecting, writing the profiles
+// to name with a _cpu.pprof and _heap.pprof suffix
+func profileWindow(p *Progress, name string, kinds map[string]bool) *ProfileStats {
+	s := &ProfileStats{Start: time.Now()}
+	var errs []string
+	var cpu *os.File
+	if kinds[profileCPU] {
+		s.CPUProfile = name + "_cpu.pprof"
+		f, err := os.Create(s.CPUProfile)
+		if err == nil {
+			if err = pprof.StartCPUProfile(f); err != nil {
+				f.Close()
+			} else {
+				cpu = f
+			}
+		}
+		if err != nil {
+			errs = append(errs, "cpu: "+err.Error())
+			s.CPUProfile = ""
+		}
+	}
+	for p.endNs.Load() == 0 {
+		time.Sleep(goTraceWatchEvery)
+	}
+	s.End = time.Unix(0, p.endNs.Load())
+	if cpu != nil {
+		pprof.StopCPUProfile()
+		if err := cpu.Close(); err != nil {
+			errs = append(errs, "cpu: "+err.Error())
+		}
+	}
+	if kinds[profileHeap] {
+		s.HeapProfile = name + "_heap.pprof"
+		if err := writeHeapProfile(s.HeapProfile); err != nil {
+			errs = append(errs, "heap: "+err.Error())
+			s.HeapProfile = ""
+		}
+	}
+	s.Error = strings.Join(errs, "; ")
+	return s
+}
+
+// writeHeapProfile writes the heap profile as of a GC run now, after the
+// window, so the in-use figures are current
+func writeHeapProfile(path string) error {
+	runtime.GC()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := pprof.Lookup("heap").WriteTo(f, 0); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// recordProfiles waits for a window of the benchmark name still being
+// profiled and attaches the profiles to the results whose windows they
+// cover. Results of a benchmark without live counters get none.
+func recordProfiles(name string, results []*BenchmarkResult) {
+	profiler.Lock()
+	armed, done, benchmark := profiler.armed, profiler.done, profiler.benchmark
+	profiler.Unlock()
+	if !armed {
+		return
+	}
+	if done != nil && benchmark == name {
+		<-done
+	}
+	profiler.Lock()
+	defer profiler.Unlock()
+	missed := 0
+	for _, r := range results {
+		if r.StartTime.IsZero() {
+			continue
+		}
+		for _, c := range profiler.captures {
+			if c.benchmark == name && !c.stats.End.Before(r.StartTime) && !c.stats.Start.After(r.EndTime) {
+				r.Profiles = c.stats
+			}
+		}
+		if r.Profiles == nil {
+			missed++
+		}
+	}
+	if missed > 0 {
+		slog.Warn("No profile covers these results; only benchmarks with live counters are profiled", "benchmark", name, "results", missed)
+	}
+}
+
+// formatProfiles renders where the profiles of the window went, if taken
+func (r *BenchmarkResult) formatProfiles() string {
+	s := r.Profiles
+	if s == nil {
+		return ""
+	}
+	var files []string
+	for _, f := range []string{s.CPUProfile, s.HeapProfile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	line := fmt.Sprintf("Profiles:        %s over %s (go tool pprof -top FILE)",
+		strings.Join(files, ", "), s.End.Sub(s.Start).Round(time.Millisecond))
+	if s.Error != "" {
+		line += ", " + s.Error
+	}
+	return line + "\n"
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+)
+
+// severeQualityFlags mark results whose headline numbers are meaningless
+var severeQualityFlags = []string{QualityZeroDuration, QualityNonFinite, QualityInconsistent}
+
+// invalidRun reports whether a stored run was marked invalid or carries a
+// data-quality flag that makes its metrics meaningless
+func invalidRun(run StoredRun) bool {
+	if run.Invalid {
+		return true
+	}
+	for _, f := range run.Result.Quality.Flags {
+		for _, severe := range severeQualityFlags {
+			if f == severe {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasAnyTag reports whether a run carries one of tags, or any tag at all
+// when tags is empty
+func hasAnyTag(run StoredRun, tags []string) bool {
+	if len(tags) == 0 {
+		return len(run.Tags) > 0
+	}
+	for _, t := range run.Tags {
+		for _, want := range tags {
+			if t == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// runPrune is the entry point of the prune subcommand. Tagged runs are
+// always kept; otherwise invalid runs are deleted and only the newest
+// -keep runs of each benchmark configuration survive.
+func runPrune(args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	storePath := fs.String("store", defaultStorePath, "History store to prune")
+	keep := fs.Int("keep", 0, "Keep the newest N untagged runs per benchmark (0 keeps all)")
+	keepTags := fs.String("keep-tags", "", "Comma-separated tags whose runs are kept forever (default: any tag)")
+	keepInvalid := fs.Bool("keep-invalid", false, "Keep runs marked invalid or with meaningless metrics")
+	invalidate := fs.String("invalidate", "", "Comma-separated run IDs to mark invalid before pruning")
+	dryRun := fs.Bool("dry-run", false, "Report what would be deleted without changing the store")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *keep < 0 {
+		return fmt.Errorf("-keep must not be negative")
+	}
+
+	store := OpenResultStore(*storePath)
+	runs, err := store.Load()
+	if err != nil {
+		return err
+	}
+	ids := make(map[string]bool)
+	for _, id := range splitList(*invalidate) {
+		ids[id] = true
+	}
+	for i := range runs {
+		if ids[runs[i].ID] {
+			runs[i].Invalid = true
+			delete(ids, runs[i].ID)
+		}
+	}
+	if len(ids) > 0 {
+		missing := make([]string, 0, len(ids))
+		for id := range ids {
+			missing = append(missing, id)
+		}
+		sort.Strings(missing)
+		return fmt.Errorf("no runs with IDs %v", missing)
+	}
+
+	tags := splitList(*keepTags)
+	deleted := make([]bool, len(runs))
+	var invalid, expired int
+
+	// Newest first within each benchmark, so the first -keep survive
+	order := make([]int, len(runs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return runs[order[a]].Result.StartTime.After(runs[order[b]].Result.StartTime)
+	})
+	seen := make(map[string]int)
+	for _, i := range order {
+		run := runs[i]
+		switch {
+		case hasAnyTag(run, tags):
+		case invalidRun(run) && !*keepInvalid:
+			deleted[i] = true
+			invalid++
+		default:
+			k := run.Result.Benchmark + "|" + resultKey(run.Result)
+			seen[k]++
+			if *keep > 0 && seen[k] > *keep {
+				deleted[i] = true
+				expired++
+			}
+		}
+	}
+
+	var kept []StoredRun
+	var gone []string
+	for i, run := range runs {
+		if deleted[i] {
+			gone = append(gone, run.ID)
+		} else {
+			kept = append(kept, run)
+		}
+	}
+	verb := "Deleted"
+	if *dryRun {
+		verb = "Would delete"
+	}
+	fmt.Printf("%s %d of %d runs (%d invalid, %d beyond -keep); %d kept\n",
+		verb, invalid+expired, len(runs), invalid, expired, len(kept))
+	if *dryRun || invalid+expired == 0 && *invalidate == "" {
+		return nil
+	}
+	return store.Replace(kept, gone)
+}
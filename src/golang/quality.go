@@ -0,0 +1,140 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// Data-quality flags recorded on a result when a measurement should not be
+// taken at face value
+const (
+	QualityZeroDuration   = "zero_duration"        // Events counted over an empty or negative window; rates zeroed
+	QualityShortWindow    = "short_window"         // Window shorter than minRateWindow; rates are noisy
+	QualityClockSkew      = "clock_skew"           // Timestamps went backwards, e.g. across CPUs; those deltas were skipped
+	QualityWraparound     = "timestamp_wraparound" // Timestamp counter wrapped; deltas taken modulo 2^64
+	QualitySumOverflow    = "latency_sum_overflow" // Latency sum saturated; the mean uses a 128-bit sum
+	QualityNonFinite      = "non_finite"           // A rate or statistic was NaN or Inf and was zeroed
+	QualityInconsistent   = "inconsistent_latency" // Latency min, mean and max are out of order
+	QualityDropAccounting = "drop_rate_out_of_range"
+	QualityInterrupted    = "interrupted" // Stopped before its duration; metrics cover the partial run
+)
+
+// minRateWindow is the shortest window, in seconds, over which rates are
+// considered meaningful
+const minRateWindow = 0.01
+
+// wrapThreshold separates a wrapped timestamp counter from a timestamp that
+// is merely behind its predecessor: a backwards step larger than half the
+// counter range is a wrap
+const wrapThreshold = 1 << 63
+
+// DataQuality describes problems found while computing a result
+type DataQuality struct {
+	Flags          []string // Empty when the data is clean
+	SkewedSamples  int64    // Latency deltas skipped because timestamps went backwards
+	WrappedSamples int64    // Latency deltas taken across a counter wrap
+}
+
+// Flag records a quality issue once
+func (q *DataQuality) Flag(flag string) {
+	for _, f := range q.Flags {
+		if f == flag {
+			return
+		}
+	}
+	q.Flags = append(q.Flags, flag)
+}
+
+// Merge adds the issues found in other
+func (q *DataQuality) Merge(other DataQuality) {
+	for _, f := range other.Flags {
+		q.Flag(f)
+	}
+	q.SkewedSamples += other.SkewedSamples
+	q.WrappedSamples += other.WrappedSamples
+}
+
+// OK reports whether no issues were found
+func (q DataQuality) OK() bool {
+	return len(q.Flags) == 0
+}
+
+func (q DataQuality) String() string {
+	if q.OK() {
+		return "ok"
+	}
+	return strings.Join(q.Flags, ", ")
+}
+
+// timestampDelta returns the nanoseconds from prev to cur. A small
+// backwards step is clock skew and yields ok == false; a large one is a
+// counter wrap, whose delta unsigned subtraction already gets right.
+func timestampDelta(prev, cur uint64, q *DataQuality) (delta uint64, ok bool) {
+	if cur >= prev {
+		return cur - prev, true
+	}
+	if prev-cur < wrapThreshold {
+		q.SkewedSamples++
+		q.Flag(QualityClockSkew)
+		return 0, false
+	}
+	q.WrappedSamples++
+	q.Flag(QualityWraparound)
+	return cur - prev, true
+}
+
+// finite returns v, or zero after flagging the result when v is NaN or Inf
+func (q *DataQuality) finite(v float64) float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		q.Flag(QualityNonFinite)
+		return 0
+	}
+	return v
+}
+
+// CheckQuality validates the derived metrics of a result, zeroing values
+// that cannot be trusted and recording why in Quality. It keeps any flags
+// the benchmark already recorded.
+func (r *BenchmarkResult) CheckQuality() {
+	q := &r.Quality
+
+	switch {
+	case r.Duration <= 0 || math.IsNaN(r.Duration):
+		if r.EventCount > 0 || r.Duration < 0 {
+			q.Flag(QualityZeroDuration)
+		}
+		r.Duration = 0
+		r.Throughput = 0
+		r.CPUUsage = 0
+	case r.Duration < minRateWindow && r.EventCount > 0:
+		q.Flag(QualityShortWindow)
+	}
+
+	r.Duration = q.finite(r.Duration)
+	r.Throughput = q.finite(r.Throughput)
+	r.CPUUsage = q.finite(r.CPUUsage)
+	r.CPUBudget.CPUPerEventUs = q.finite(r.CPUBudget.CPUPerEventUs)
+	r.DropRate = q.finite(r.DropRate)
+	if r.DropRate < 0 || r.DropRate > 1 {
+		q.Flag(QualityDropAccounting)
+		r.DropRate = 0
+	}
+	for i := range r.Operations {
+		r.Operations[i].Throughput = q.finite(r.Operations[i].Throughput)
+		r.Operations[i].AvgNs = q.finite(r.Operations[i].AvgNs)
+	}
+
+	l := &r.Latency
+	l.AvgNs = q.finite(l.AvgNs)
+	l.StdDevNs = q.finite(l.StdDevNs)
+	l.VarianceNs2 = q.finite(l.VarianceNs2)
+	l.JitterNs = q.finite(l.JitterNs)
+	if l.Samples > 0 {
+		if l.SumNs == math.MaxUint64 {
+			q.Flag(QualitySumOverflow)
+		}
+		if l.MinNs > l.MaxNs || l.AvgNs < float64(l.MinNs) || l.AvgNs > float64(l.MaxNs) {
+			q.Flag(QualityInconsistent)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"math"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"slices"
+	"testing"
+	"testing/quick"
+)
+
+// TestTimestampDeltaWraparound steps a timestamp across the top of the
+// counter: the delta must come out modulo 2^64 and the result flagged as
+// wrapped, not skewed
+func TestTimestampDeltaWraparound(t *testing.T) {
+	f := func(before, after uint32) bool {
+		prev := math.MaxUint64 - uint64(before)
+		cur := uint64(after)
+		var q DataQuality
+		d, ok := timestampDelta(prev, cur, &q)
+		return ok && d == uint64(before)+uint64(after)+1 &&
+			q.WrappedSamples == 1 && q.SkewedSamples == 0 &&
+			reflect.DeepEqual(q.Flags, []string{QualityWraparound})
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestTimestampDeltaThreshold checks both sides of wrapThreshold: a
+// backwards step just short of it is skew, one at it is a wrap
+func TestTimestampDeltaThreshold(t *testing.T) {
+	f := func(cur uint64) bool {
+		cur %= wrapThreshold
+		var skew, wrap DataQuality
+		_, skewOK := timestampDelta(cur+wrapThreshold-1, cur, &skew)
+		d, wrapOK := timestampDelta(cur+wrapThreshold, cur, &wrap)
+		return !skewOK && skew.SkewedSamples == 1 && reflect.DeepEqual(skew.Flags, []string{QualityClockSkew}) &&
+			wrapOK && d == wrapThreshold && wrap.WrappedSamples == 1 && reflect.DeepEqual(wrap.Flags, []string{QualityWraparound})
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// largeSamples generates latency samples near the top of the uint64
+// range, so a handful of them overflow a 64-bit sum
+type largeSamples []uint64
+
+func (largeSamples) Generate(rng *rand.Rand, size int) reflect.Value {
+	s := make(largeSamples, 1+rng.Intn(size+1))
+	for i := range s {
+		if rng.Intn(2) == 0 {
+			s[i] = math.MaxUint64 - rng.Uint64()>>rng.Intn(64)
+		} else {
+			s[i] = rng.Uint64() >> rng.Intn(64)
+		}
+	}
+	return reflect.ValueOf(s)
+}
+
+// TestLatencySum128 compares the mean and the saturating sum against a
+// big.Int reference. A sum of exactly MaxUint64 cannot be told from a
+// saturated one, so it is flagged too.
+func TestLatencySum128(t *testing.T) {
+	f := func(samples largeSamples) bool {
+		sum := new(big.Int)
+		for _, v := range samples {
+			sum.Add(sum, new(big.Int).SetUint64(v))
+		}
+		mean, _ := new(big.Float).Quo(new(big.Float).SetInt(sum), big.NewFloat(float64(len(samples)))).Float64()
+
+		s := computeLatencyStats(slices.Clone([]uint64(samples)), DefaultQuantiles)
+		wantSum := uint64(math.MaxUint64)
+		if sum.IsUint64() {
+			wantSum = sum.Uint64()
+		}
+		if s.SumNs != wantSum || s.Samples != int64(len(samples)) {
+			return false
+		}
+		if math.Abs(s.AvgNs-mean) > mean*1e-12 {
+			t.Logf("mean %g, want %g", s.AvgNs, mean)
+			return false
+		}
+
+		r := &BenchmarkResult{Duration: 1, Latency: s}
+		r.CheckQuality()
+		flagged := slices.Contains(r.Quality.Flags, QualitySumOverflow)
+		return flagged == (wantSum == math.MaxUint64) && !slices.Contains(r.Quality.Flags, QualityInconsistent)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// eventsAt returns one event per timestamp, in order
+func eventsAt(timestamps []uint64) *EventBuffer {
+	eb := NewEventBuffer(len(timestamps))
+	for _, ts := range timestamps {
+		eb.Add(Event{Timestamp: ts})
+	}
+	return eb
+}
+
+// TestLatencySamplesMonotonic checks that non-decreasing timestamps give
+// one sample per gap and no quality flags
+func TestLatencySamplesMonotonic(t *testing.T) {
+	f := func(start uint32, gaps []uint32) bool {
+		ts := []uint64{uint64(start)}
+		for _, g := range gaps {
+			ts = append(ts, ts[len(ts)-1]+uint64(g))
+		}
+		var q DataQuality
+		samples := eventsAt(ts).latencySamples(&q)
+		if !q.OK() || len(samples) != len(gaps) {
+			return false
+		}
+		for i, g := range gaps {
+			if samples[i] != uint64(g) {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestLatencySamplesOutOfOrder swaps adjacent timestamps: each backwards
+// step is skipped as skew, and only clock_skew is flagged
+func TestLatencySamplesOutOfOrder(t *testing.T) {
+	f := func(start uint32, gaps []uint16, swaps []uint8) bool {
+		ts := []uint64{uint64(start)}
+		for _, g := range gaps {
+			ts = append(ts, ts[len(ts)-1]+1+uint64(g))
+		}
+		for _, s := range swaps {
+			if i := int(s) % len(ts); i+1 < len(ts) {
+				ts[i], ts[i+1] = ts[i+1], ts[i]
+			}
+		}
+		var backwards int64
+		for i := 1; i < len(ts); i++ {
+			if ts[i] < ts[i-1] {
+				backwards++
+			}
+		}
+
+		var q DataQuality
+		samples := eventsAt(ts).latencySamples(&q)
+		if q.SkewedSamples != backwards || q.WrappedSamples != 0 || int64(len(samples)) != int64(len(ts)-1)-backwards {
+			return false
+		}
+		if backwards == 0 {
+			return q.OK()
+		}
+		return reflect.DeepEqual(q.Flags, []string{QualityClockSkew})
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestCheckQualityFlags checks the flags CheckQuality derives from a
+// result's own values
+func TestCheckQualityFlags(t *testing.T) {
+	tests := []struct {
+		name string
+		r    BenchmarkResult
+		want []string
+	}{
+		{"clean", BenchmarkResult{Duration: 1, EventCount: 10, Throughput: 10, Latency: LatencyStats{Samples: 2, MinNs: 1, MaxNs: 3, AvgNs: 2}}, nil},
+		{"zero duration", BenchmarkResult{EventCount: 10}, []string{QualityZeroDuration}},
+		{"short window", BenchmarkResult{Duration: minRateWindow / 2, EventCount: 10}, []string{QualityShortWindow}},
+		{"non-finite", BenchmarkResult{Duration: 1, Throughput: math.Inf(1)}, []string{QualityNonFinite}},
+		{"drop rate", BenchmarkResult{Duration: 1, DropRate: 1.5}, []string{QualityDropAccounting}},
+		{"inconsistent", BenchmarkResult{Duration: 1, Latency: LatencyStats{Samples: 2, MinNs: 5, MaxNs: 3, AvgNs: 4}}, []string{QualityInconsistent}},
+	}
+	for _, tt := range tests {
+		tt.r.CheckQuality()
+		if !reflect.DeepEqual(tt.r.Quality.Flags, tt.want) {
+			t.Errorf("%s: flags %v, want %v", tt.name, tt.r.Quality.Flags, tt.want)
+		}
+	}
+}
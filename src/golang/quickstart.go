@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// quickstartEntry is a benchmark a quickstart goal runs
+type quickstartEntry struct {
+	benchmark string
+	windows   int      // Measured windows of a timed benchmark's sweep; 0 when untimed
+	params    []string // Flags as "name: value" YAML lines, if any
+	comment   string
+}
+
+// quickstartGoal is an answer to "what do you want to compare"
+type quickstartGoal struct {
+	name        string
+	description string
+	entries     func(cpus int) []quickstartEntry // cpus ends the sweeps: the CPUs available, at least two
+}
+
+// quickstartGoals are the comparisons init offers, each a few benchmarks
+// with settings that keep their sweeps short
+var quickstartGoals = []quickstartGoal{
+	{"mechanisms", "Ring buffer against perf buffer event delivery", func(int) []quickstartEntry {
+		return []quickstartEntry{
+			{benchmark: "ringbuf", windows: 1},
+			{benchmark: "perfbuf", windows: 1},
+			{benchmark: "ringbuf-wakeup", windows: len(allWakeupStrategies) * len(allConsumerModes),
+				comment: "Every wakeup strategy with each consumer mode"},
+		}
+	}},
+	{"probes", "What attaching a kprobe, fentry, raw tracepoint or uprobe costs", func(int) []quickstartEntry {
+		return []quickstartEntry{
+			{benchmark: "kprobe"},
+			{benchmark: "fentry", params: []string{"kprobe: false"}, comment: "kprobe runs on its own"},
+			{benchmark: "rawtp"},
+			{benchmark: "uprobe"},
+		}
+	}},
+	{"maps", "BPF map operation throughput and contention", func(cpus int) []quickstartEntry {
+		return []quickstartEntry{
+			{benchmark: "maps"},
+			{benchmark: "map-contention", windows: 2 * len(allMapOps) * 2, params: []string{fmt.Sprintf("producers: [1, %d]", cpus)},
+				comment: "One producer against every CPU"},
+		}
+	}},
+	{"network", "XDP against TC packet processing", func(int) []quickstartEntry {
+		return []quickstartEntry{
+			{benchmark: "xdp", windows: 1},
+			{benchmark: "tc", windows: 1},
+		}
+	}},
+	{"scaling", "How ring buffers scale with producers and consumers", func(cpus int) []quickstartEntry {
+		sweep := fmt.Sprintf("[1, %d]", cpus)
+		return []quickstartEntry{
+			{benchmark: "ringbuf-contention", windows: 2, params: []string{"producers: " + sweep}, comment: "One producer against every CPU"},
+			{benchmark: "ringbuf-consumers", windows: 2 * len(allConsumerMechanisms), params: []string{"consumers: " + sweep, fmt.Sprintf("producers: %d", cpus)},
+				comment: "One consumer against one per CPU, for each mechanism"},
+		}
+	}},
+}
+
+// quickstartUntimed is roughly how long an untimed benchmark takes
+const quickstartUntimed = 10 * time.Second
+
+// quickstart asks its questions on in, printing prompts to out. With
+// defaults set every question takes its default answer.
+type quickstart struct {
+	in       *bufio.Reader
+	out      io.Writer
+	defaults bool
+}
+
+// ask prints prompt with its default and returns the answer, or def for
+// an empty line or the end of input
+func (q *quickstart) ask(prompt, def string) string {
+	fmt.Fprintf(q.out, "%s [%s]: ", prompt, def)
+	if q.defaults {
+		fmt.Fprintln(q.out, def)
+		return def
+	}
+	line, err := q.in.ReadString('\n')
+	if line = strings.TrimSpace(line); line == "" {
+		if err != nil {
+			fmt.Fprintln(q.out) // End of input: finish the prompt's line
+		}
+		return def
+	}
+	return line
+}
+
+// askUntil repeats a question until parse accepts the answer
+func askUntil[T any](q *quickstart, prompt, def string, parse func(string) (T, error)) (T, error) {
+	for {
+		v, err := parse(q.ask(prompt, def))
+		if err == nil {
+			return v, nil
+		}
+		if q.defaults {
+			return v, err
+		}
+		fmt.Fprintf(q.out, "  %v\n", err)
+	}
+}
+
+// parseGoals parses a comma-separated list of goal numbers or names
+func parseGoals(s string) ([]quickstartGoal, error) {
+	var goals []quickstartGoal
+	seen := make(map[string]bool)
+	for _, item := range splitList(s) {
+		var goal *quickstartGoal
+		if n, err := strconv.Atoi(item); err == nil && n >= 1 && n <= len(quickstartGoals) {
+			goal = &quickstartGoals[n-1]
+		}
+		for i := range quickstartGoals {
+			if quickstartGoals[i].name == item {
+				goal = &quickstartGoals[i]
+			}
+		}
+		if goal == nil {
+			return nil, fmt.Errorf("unknown choice %q (want 1-%d or a name)", item, len(quickstartGoals))
+		}
+		if !seen[goal.name] {
+			seen[goal.name] = true
+			goals = append(goals, *goal)
+		}
+	}
+	if len(goals) == 0 {
+		return nil, fmt.Errorf("choose at least one")
+	}
+	return goals, nil
+}
+
+// planQuickstart splits budget between the entries' measured windows,
+// after setting aside time for the untimed ones. It returns the duration
+// of each window, whole seconds and at least one, and the suite's
+// estimated run time.
+func planQuickstart(entries []quickstartEntry, budget time.Duration) (window, estimate time.Duration) {
+	windows := 0
+	var untimed time.Duration
+	for _, e := range entries {
+		if e.windows == 0 {
+			untimed += quickstartUntimed
+		}
+		windows += e.windows
+	}
+	if windows == 0 {
+		return 0, untimed
+	}
+	window = max((budget-untimed)/time.Duration(windows), time.Second).Truncate(time.Second)
+	return window, untimed + window*time.Duration(windows)
+}
+
+// writeQuickstartConfig renders the suite config of entries
+func writeQuickstartConfig(w io.Writer, host HostInfo, goals []quickstartGoal, entries []quickstartEntry, notes map[string]string, window, estimate time.Duration) error {
+	names := make([]string, len(goals))
+	for i, g := range goals {
+		names[i] = g.name
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# Suite written by `ebpf-bench init` on %s (kernel %s, %d CPUs)\n",
+		orNone(host.Hostname), orNone(host.KernelRelease), max(len(host.OnlineCPUs), 1))
+	fmt.Fprintf(&sb, "# Compares: %s. Estimated run time: %s.\n", strings.Join(names, ", "), estimate.Round(time.Second))
+	sb.WriteString("#\n# Entries take any flag of their benchmark under params; see the\n# example in benchmarks/configs/suite.yaml.\n")
+	sb.WriteString("name: quickstart\nparallel: false\n")
+	if window > 0 {
+		fmt.Fprintf(&sb, "duration: %s          # Measured window of each timed benchmark\n", window)
+	}
+	sb.WriteString("\nbenchmarks:\n")
+	for _, e := range entries {
+		fmt.Fprintf(&sb, "  - benchmark: %s", e.benchmark)
+		comment := e.comment
+		if note := notes[e.benchmark]; note != "" {
+			comment = note
+		}
+		if comment != "" {
+			fmt.Fprintf(&sb, "   # %s", comment)
+		}
+		sb.WriteString("\n")
+		if len(e.params) > 0 {
+			sb.WriteString("    params:\n")
+			for _, p := range e.params {
+				fmt.Fprintf(&sb, "      %s\n", p)
+			}
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// fallbackParams adds the arguments adaptToHost chose to run a benchmark
+// on this host to the entry's params
+func (e *quickstartEntry) fallbackParams(args []string) {
+	for i := 0; i+1 < len(args); i += 2 {
+		e.params = append(e.params, strings.TrimLeft(args[i], "-")+": "+args[i+1])
+	}
+}
+
+// runInit is the entry point of the init subcommand
+func runInit(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	output := fs.String("o", "suite.yaml", "Suite config file to write")
+	defaults := fs.Bool("defaults", false, "Take every default answer without asking")
+	force := fs.Bool("force", false, "Overwrite an existing config file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	q := &quickstart{in: bufio.NewReader(os.Stdin), out: os.Stdout, defaults: *defaults}
+
+	PrintBenchmarkHeader("Benchmark Quickstart")
+	host := CollectHostInfo()
+	caps := hostCapabilities()
+	cpus := max(len(host.AllowedCPUs), 1)
+	sweepTo := max(cpus, 2) // Sweeps compare one against several, even on one CPU
+	yesNo := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	fmt.Printf("Host:            %s, kernel %s, %d CPUs available\n", orNone(host.Hostname), orNone(host.KernelRelease), cpus)
+	fmt.Printf("BPF:             load %s, trace %s, BTF %s\n", yesNo(caps.CanLoadBPF()), yesNo(caps.CanTrace()), yesNo(caps.BTF))
+	if host.CPUGovernor != "" && host.CPUGovernor != "performance" {
+		fmt.Printf("Note:            CPU governor is %s; see the doctor subcommand for steadier runs\n", host.CPUGovernor)
+	}
+	fmt.Println()
+
+	fmt.Println("What do you want to compare?")
+	for i, g := range quickstartGoals {
+		fmt.Printf("  %d) %-11s %s\n", i+1, g.name, g.description)
+	}
+	goals, err := askUntil(q, "Choices, comma-separated", "1", parseGoals)
+	if err != nil {
+		return err
+	}
+	budget, err := askUntil(q, "How long can the suite run? (e.g. 90s, 10m)", "2m", func(s string) (time.Duration, error) {
+		d, err := parseDuration(s)
+		if err == nil && d <= 0 {
+			err = fmt.Errorf("the time must be positive")
+		}
+		return d, err
+	})
+	if err != nil {
+		return err
+	}
+	store := q.ask("Keep results in a history store for trends? (a path, or none)", "none")
+
+	var entries []quickstartEntry
+	notes := make(map[string]string)
+	for _, g := range goals {
+		for _, e := range g.entries(sweepTo) {
+			adapted, _, skip := adaptToHost(e.benchmark, nil, caps)
+			if skip {
+				fmt.Printf("Skipping %s: this host cannot run it (see the capabilities subcommand)\n", e.benchmark)
+				continue
+			}
+			if len(adapted) > 0 {
+				e.fallbackParams(adapted)
+				notes[e.benchmark] = "Simulated: this host cannot run the BPF backend"
+			}
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("this host can run none of the chosen benchmarks")
+	}
+	window, estimate := planQuickstart(entries, budget)
+	if estimate > budget+budget/10 {
+		fmt.Printf("Note: the chosen benchmarks need about %s even with 1s windows\n", estimate.Round(time.Second))
+	}
+
+	if _, err := os.Stat(*output); err == nil && !*force {
+		if q.defaults {
+			return fmt.Errorf("%s exists; add -force to overwrite it", *output)
+		}
+		if answer := q.ask(*output+" exists. Overwrite it? (y/n)", "n"); !strings.HasPrefix(strings.ToLower(answer), "y") {
+			return errors.New("not overwritten")
+		}
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := writeQuickstartConfig(f, host, goals, entries, notes, window, estimate); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if _, err := LoadSuiteConfig(*output); err != nil {
+		return fmt.Errorf("wrote an invalid config: %w", err)
+	}
+
+	fmt.Printf("\nWrote %s: %d benchmarks", *output, len(entries))
+	if window > 0 {
+		fmt.Printf(", %s windows", window)
+	}
+	fmt.Printf(", about %s in all\n", estimate.Round(time.Second))
+	cmd := "ebpf-bench suite -config " + *output
+	if store != "" && store != "none" {
+		cmd += " -store " + store
+	}
+	fmt.Printf("Run it with:     %s\n", cmd)
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Event arrival rate profiles of the simulated producers
+const (
+	RateConstant = "constant" // Steady rate
+	RateRamp     = "ramp"     // Linear rise from zero to the rate over the period, then steady
+	RateSine     = "sine"     // Rate ±50% on a sine wave of the period
+	RatePoisson  = "poisson"  // Poisson arrivals around the rate
+)
+
+// simTick is the interval at which the simulated producers run
+const simTick = time.Millisecond
+
+// defaultSimRate is the original hardcoded simulation rate of 50 + 5 per
+// CPU events per millisecond
+func defaultSimRate() int {
+	return (50 + runtime.NumCPU()*5) * int(time.Second/simTick)
+}
+
+// RateSchedule decides how many simulated events arrive in each tick. It
+// advances in simulated time, one tick per call, so a given profile, rate
+// and seed always produce the same sequence however late the ticks fire.
+type RateSchedule struct {
+	profile string
+	rate    float64       // Mean events per second
+	burst   int           // Events are released in groups of this size
+	period  time.Duration // Ramp length or sine period
+	elapsed time.Duration
+	credit  float64 // Events owed but not yet released
+	rng     randomPayload
+}
+
+// NewRateSchedule creates a schedule for profile at rate events per
+// second. Poisson arrivals are drawn from a generator seeded with seed.
+func NewRateSchedule(profile string, rate, burst int, period time.Duration, seed uint64) (*RateSchedule, error) {
+	switch profile {
+	case RateConstant, RateRamp, RateSine, RatePoisson:
+	default:
+		return nil, fmt.Errorf("unknown rate profile %q (want constant, ramp, sine or poisson)", profile)
+	}
+	if rate <= 0 || burst <= 0 {
+		return nil, fmt.Errorf("rate and burst must be positive")
+	}
+	if period <= 0 && (profile == RateRamp || profile == RateSine) {
+		return nil, fmt.Errorf("%s profile needs a positive period", profile)
+	}
+	return &RateSchedule{
+		profile: profile,
+		rate:    float64(rate),
+		burst:   burst,
+		period:  period,
+		rng:     randomPayload{state: seed | 1},
+	}, nil
+}
+
+// Name describes the schedule for results, e.g. "sine 55000/s burst=8"
+func (s *RateSchedule) Name() string {
+	name := fmt.Sprintf("%s %.0f/s", s.profile, s.rate)
+	if s.profile == RateRamp || s.profile == RateSine {
+		name += " period=" + s.period.String()
+	}
+	if s.burst > 1 {
+		name += fmt.Sprintf(" burst=%d", s.burst)
+	}
+	return name
+}
+
+// Next returns the number of events arriving in the next tick
+func (s *RateSchedule) Next() int {
+	t := s.elapsed
+	s.elapsed += simTick
+	expected := s.rate * simTick.Seconds()
+
+	switch s.profile {
+	case RateRamp:
+		expected *= math.Min(float64(t)/float64(s.period), 1)
+	case RateSine:
+		expected *= 1 + 0.5*math.Sin(2*math.Pi*float64(t)/float64(s.period))
+	case RatePoisson:
+		expected = float64(s.poisson(expected))
+	}
+
+	s.credit += expected
+	n := int(s.credit) / s.burst * s.burst
+	s.credit -= float64(n)
+	return n
+}
+
+// Steady returns a constant schedule at the same mean rate and burst, for
+// the unmeasured phases around a run, so a ramp or sine is not advanced by
+// warm-up and cooldown
+func (s *RateSchedule) Steady() *RateSchedule {
+	return &RateSchedule{profile: RateConstant, rate: s.rate, burst: s.burst, rng: s.rng}
+}
+
+// poisson draws a Poisson-distributed count with mean lambda: Knuth's
+// method for small means, a normal approximation for large ones
+func (s *RateSchedule) poisson(lambda float64) int {
+	if lambda > 30 {
+		// Box-Muller
+		u1 := (float64(s.rng.next()>>11) + 1) / (1 << 53)
+		u2 := float64(s.rng.next()>>11) / (1 << 53)
+		z := math.Sqrt(-2*math.Log(u1)) * math.Cos(2*math.Pi*u2)
+		return max(int(math.Round(lambda+z*math.Sqrt(lambda))), 0)
+	}
+	limit := math.Exp(-lambda)
+	k := 0
+	for p := 1.0; ; k++ {
+		p *= float64(s.rng.next()>>11) / (1 << 53)
+		if p <= limit {
+			return k
+		}
+	}
+}
+
+// rateFlagSet holds the rate flags of the simulated benchmarks
+type rateFlagSet struct {
+	profile *string
+	rate    *int
+	burst   *int
+	period  *time.Duration
+}
+
+// addRateFlags registers -rate-profile, -rate, -burst and -rate-period
+func addRateFlags(fs *flag.FlagSet) *rateFlagSet {
+	return &rateFlagSet{
+		profile: fs.String("rate-profile", RateConstant, "Event arrival profile ("+strings.Join([]string{RateConstant, RateRamp, RateSine, RatePoisson}, ", ")+")"),
+		rate:    fs.Int("rate", defaultSimRate(), "Mean simulated events per second"),
+		burst:   fs.Int("burst", 1, "Release events in groups of this many"),
+		period:  fs.Duration("rate-period", 0, "Ramp length or sine period (default: the benchmark duration)"),
+	}
+}
+
+// schedule builds the schedule for a run of the given duration
+func (f *rateFlagSet) schedule(duration time.Duration, seed uint64) (*RateSchedule, error) {
+	period := *f.period
+	if period == 0 {
+		period = duration
+	}
+	s, err := NewRateSchedule(*f.profile, *f.rate, *f.burst, period, seed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate flags: %w", err)
+	}
+	return s, nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// perf_event_open(2) constants for attaching a program to a tracepoint
+const (
+	perfTypeTracepoint = 2
+	perfFlagFDCloexec  = 8
+	perfIocEnable      = 0x2400
+	perfIocSetBPF      = 0x40042408
+)
+
+// perfEventAttr is the PERF_ATTR_SIZE_VER0 prefix of perf_event_attr
+type perfEventAttr struct {
+	typ          uint32
+	size         uint32
+	config       uint64
+	samplePeriod uint64
+	sampleType   uint64
+	readFormat   uint64
+	flags        uint64
+	wakeupEvents uint32
+	bpType       uint32
+	config1      uint64
+}
+
+// perfTracepointProbe attaches a BPF_PROG_TYPE_TRACEPOINT program through
+// a perf event on the tracepoint, as libbpf does. The kernel marshals the
+// event's arguments into its trace record before the program runs.
+type perfTracepointProbe struct {
+	bpfAttachment
+	root string // tracefs mount
+}
+
+func (p *perfTracepointProbe) Attach(tp string) error {
+	category, event, err := parseTracepoint(tp)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(filepath.Join(p.root, "events", category, event, "id"))
+	if err != nil {
+		return fmt.Errorf("tracepoint id: %w", err)
+	}
+	id, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("tracepoint id: %w", err)
+	}
+	if p.prog, err = loadBPFProgram(bpfProgTypeTracepoint, 0, 0); err != nil {
+		return err
+	}
+
+	// One event on CPU 0 is enough: the program runs wherever the
+	// tracepoint fires
+	attr := perfEventAttr{typ: perfTypeTracepoint, config: id, samplePeriod: 1, wakeupEvents: 1}
+	attr.size = uint32(unsafe.Sizeof(attr))
+	fd, _, errno := syscall.Syscall6(syscall.SYS_PERF_EVENT_OPEN, uintptr(unsafe.Pointer(&attr)),
+		^uintptr(0), 0, ^uintptr(0), perfFlagFDCloexec, 0)
+	if errno != 0 {
+		p.close()
+		return fmt.Errorf("perf_event_open: %w", errno)
+	}
+	p.link = int(fd)
+	for _, req := range []struct {
+		op  string
+		cmd uintptr
+		arg uintptr
+	}{{"set bpf", perfIocSetBPF, uintptr(p.prog)}, {"enable", perfIocEnable, 0}} {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req.cmd, req.arg); errno != 0 {
+			p.close()
+			return fmt.Errorf("perf event %s: %w", req.op, errno)
+		}
+	}
+	return nil
+}
+
+func (p *perfTracepointProbe) Detach() error   { return p.close() }
+func (p *perfTracepointProbe) Hit()            {}
+func (p *perfTracepointProbe) Backend() string { return probeBackendBPF }
+
+// rawTracepointProbe attaches a BPF_PROG_TYPE_RAW_TRACEPOINT program by
+// event name. The program gets the tracepoint's raw arguments, so nothing
+// is marshalled.
+type rawTracepointProbe struct {
+	bpfAttachment
+}
+
+func (p *rawTracepointProbe) Attach(tp string) error {
+	_, event, err := parseTracepoint(tp)
+	if err != nil {
+		return err
+	}
+	if p.prog, err = loadBPFProgram(bpfProgTypeRawTracepoint, 0, 0); err != nil {
+		return err
+	}
+	if p.link, err = rawTracepointOpen(event, p.prog); err != nil {
+		p.close()
+		return err
+	}
+	return nil
+}
+
+func (p *rawTracepointProbe) Detach() error   { return p.close() }
+func (p *rawTracepointProbe) Hit()            {}
+func (p *rawTracepointProbe) Backend() string { return probeBackendBPF }
+
+// simulatedTracepoint models both attachments in userspace. The regular
+// tracepoint first marshals the six syscall arguments, the id and the
+// common header into a trace record, as perf_trace_buf_alloc and the
+// event's assign code would; the raw tracepoint hands the arguments over
+// as they are.
+type simulatedTracepoint struct {
+	marshal  bool
+	attached bool
+	buffer   *EventBuffer
+	args     [6]uint64
+	record   [64]byte
+	pid      uint32
+}
+
+func (t *simulatedTracepoint) Attach(string) error {
+	t.attached, t.pid = true, uint32(os.Getpid())
+	return nil
+}
+
+func (t *simulatedTracepoint) Detach() error {
+	t.attached = false
+	return nil
+}
+
+func (t *simulatedTracepoint) Hit() {
+	if !t.attached {
+		return
+	}
+	t.args[0]++
+	data := uint32(t.args[0])
+	if t.marshal {
+		binary.LittleEndian.PutUint16(t.record[0:], 1) // common_type
+		binary.LittleEndian.PutUint32(t.record[4:], t.pid)
+		binary.LittleEndian.PutUint64(t.record[8:], uint64(syscall.SYS_OPENAT))
+		for i, a := range t.args {
+			binary.LittleEndian.PutUint64(t.record[16+8*i:], a)
+		}
+		data = binary.LittleEndian.Uint32(t.record[16:])
+	}
+	t.buffer.Add(Event{
+		Timestamp: uint64(time.Now().UnixNano()),
+		PID:       t.pid,
+		EventType: eventTypeTracepoint,
+		Data:      data,
+	})
+}
+
+func (t *simulatedTracepoint) Backend() string { return probeBackendSim }
+
+// newTracepointAttacher selects a backend for a regular or raw tracepoint
+// attachment to tp. auto tries one attach and falls back to simulation
+// when tracefs, the kernel or privileges do not allow it.
+func newTracepointAttacher(backend string, raw bool, tp string, buffer *EventBuffer) (kprobeAttacher, error) {
+	sim := &simulatedTracepoint{marshal: !raw, buffer: buffer}
+	switch backend {
+	case probeBackendSim:
+		return sim, nil
+	case probeBackendBPF, probeBackendAuto:
+		var probe kprobeAttacher
+		var err error
+		if raw {
+			probe = &rawTracepointProbe{newBPFAttachment()}
+		} else {
+			var root string
+			if root, err = findTracefs(); err == nil {
+				probe = &perfTracepointProbe{newBPFAttachment(), root}
+			}
+		}
+		if err == nil {
+			if err = probe.Attach(tp); err == nil {
+				err = probe.Detach()
+			}
+		}
+		if err == nil {
+			return probe, nil
+		}
+		if backend == probeBackendBPF {
+			return nil, err
+		}
+		return sim, nil
+	}
+	return nil, fmt.Errorf("unknown probe backend %q (want auto, bpf or sim)", backend)
+}
+
+// runRawTracepointBenchmark is the entry point of the rawtp subcommand. It
+// runs the kprobe overhead measurement with a regular and then a raw
+// tracepoint program on the same event, returning the pair of results.
+func runRawTracepointBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("rawtp", flag.ExitOnError)
+	common := addBenchFlags(fs, "rawtp_result.json", false)
+	tracepoint := fs.String("tracepoint", "raw_syscalls:sys_enter", "Event both programs attach to as category:name; the raw tracepoint is its name")
+	cycles := fs.Int("n", 100, "Attach/detach cycles")
+	calls := fs.Int("calls", 100000, "Probed syscalls per overhead measurement")
+	backend := fs.String("backend", probeBackendAuto, "Backend (auto, bpf, sim)")
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+	if *cycles <= 0 || *calls <= 0 {
+		return nil, opts, fmt.Errorf("-n and -calls must be positive")
+	}
+	tp, err := resolveTracepoint(*tracepoint)
+	if err != nil {
+		return nil, opts, fmt.Errorf("invalid -tracepoint: %w", err)
+	}
+	if tp == "" {
+		return nil, opts, fmt.Errorf("-tracepoint is required")
+	}
+
+	var results []*BenchmarkResult
+	for _, kind := range []struct {
+		programType, name, simNote string
+		raw                        bool
+	}{
+		{"tracepoint", "Tracepoint Overhead", "BPF tracepoint attach unavailable: tracepoint simulated in userspace", false},
+		{"raw_tracepoint", "Raw Tracepoint Overhead", "BPF raw tracepoint attach unavailable: raw_tracepoint simulated in userspace", true},
+	} {
+		bench := NewKprobeOverheadBenchmark(tp, *cycles, *calls, *backend, opts.Verbose)
+		bench.name, bench.programType, bench.simNote = kind.name, kind.programType, kind.simNote
+		raw := kind.raw
+		bench.newProbe = func(buffer *EventBuffer) (kprobeAttacher, error) {
+			return newTracepointAttacher(*backend, raw, tp, buffer)
+		}
+		r, err := bench.Run(ctx)
+		if err != nil {
+			return nil, opts, fmt.Errorf("%s on %s: %w", kind.programType, tp, err)
+		}
+		r.Tracepoint = tp
+		results = append(results, r)
+	}
+
+	base := results[0]
+	PrintBenchmarkHeader("Per-call overhead on " + tp)
+	for _, r := range results {
+		line := fmt.Sprintf("%-15s %-4s %10.1f ns/call", r.ProgramType, r.ReaderStrategy, r.OverheadNs)
+		if r != base && base.OverheadNs > 0 {
+			line += fmt.Sprintf("  %+.1f%% vs tracepoint", (r.OverheadNs/base.OverheadNs-1)*100)
+		}
+		fmt.Println(line)
+	}
+	return results, opts, nil
+}
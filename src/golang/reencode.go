@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"math/bits"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Upstream formats consumed events are re-encoded to
+const (
+	formatRaw      = "raw"      // The 32-byte ring record, copied as is
+	formatJSON     = "json"     // encoding/json of the batch
+	formatProtobuf = "protobuf" // The EventBatch message below
+)
+
+var allReencodeFormats = []string{formatRaw, formatJSON, formatProtobuf}
+
+// The protobuf encoding is written by hand to the wire format of
+//
+//	message Event {
+//	  fixed64 timestamp  = 1; // Nanoseconds are too large for a short varint
+//	  uint32  pid        = 2;
+//	  uint32  cpu        = 3;
+//	  uint32  event_type = 4;
+//	  uint32  data       = 5;
+//	}
+//	message EventBatch {
+//	  repeated Event events = 1;
+//	}
+//
+// which is what protoc-generated code produces for it, without the
+// reflection that generated code adds on top.
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbLen     = 2
+)
+
+// appendVarint appends v as a protobuf varint
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// varintSize is the encoded length of v
+func varintSize(v uint64) int {
+	return (bits.Len64(v|1) + 6) / 7
+}
+
+// pbEventSize is the encoded length of an Event message body
+func pbEventSize(e *Event) int {
+	n := 1 + 8 // timestamp
+	for _, v := range [...]uint32{e.PID, e.CPU, e.EventType, e.Data} {
+		if v != 0 { // proto3 omits zero scalars
+			n += 1 + varintSize(uint64(v))
+		}
+	}
+	return n
+}
+
+// appendProtoEvent appends e as field 1 of an EventBatch
+func appendProtoEvent(b []byte, e *Event) []byte {
+	b = append(b, 1<<3|pbLen)
+	b = appendVarint(b, uint64(pbEventSize(e)))
+	b = append(b, 1<<3|pbFixed64)
+	b = binary.LittleEndian.AppendUint64(b, e.Timestamp)
+	for i, v := range [...]uint32{e.PID, e.CPU, e.EventType, e.Data} {
+		if v != 0 {
+			b = append(b, byte(i+2)<<3|pbVarint)
+			b = appendVarint(b, uint64(v))
+		}
+	}
+	return b
+}
+
+// decodeProtoBatch parses an EventBatch, to check the encoder against the
+// wire format
+func decodeProtoBatch(b []byte) ([]Event, error) {
+	var events []Event
+	for len(b) > 0 {
+		if b[0] != 1<<3|pbLen {
+			return nil, fmt.Errorf("unexpected batch tag %#x", b[0])
+		}
+		size, n := binary.Uvarint(b[1:])
+		if n <= 0 || uint64(len(b)-1-n) < size {
+			return nil, fmt.Errorf("truncated event")
+		}
+		msg := b[1+n : 1+n+int(size)]
+		b = b[1+n+int(size):]
+		var e Event
+		for len(msg) > 0 {
+			tag := msg[0]
+			msg = msg[1:]
+			if tag == 1<<3|pbFixed64 {
+				if len(msg) < 8 {
+					return nil, fmt.Errorf("truncated timestamp")
+				}
+				e.Timestamp = binary.LittleEndian.Uint64(msg)
+				msg = msg[8:]
+				continue
+			}
+			v, n := binary.Uvarint(msg)
+			if tag&7 != pbVarint || tag>>3 < 2 || tag>>3 > 5 || n <= 0 {
+				return nil, fmt.Errorf("unexpected field tag %#x", tag)
+			}
+			if v > math.MaxUint32 {
+				return nil, fmt.Errorf("field %d value %d overflows uint32", tag>>3, v)
+			}
+			msg = msg[n:]
+			*[...]*uint32{&e.PID, &e.CPU, &e.EventType, &e.Data}[tag>>3-2] = uint32(v)
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// jsonEvent is how an agent would name the fields for a JSON upstream
+type jsonEvent struct {
+	Timestamp uint64 `json:"timestamp"`
+	PID       uint32 `json:"pid"`
+	CPU       uint32 `json:"cpu"`
+	EventType uint32 `json:"event_type"`
+	Data      uint32 `json:"data"`
+}
+
+// ReencodeStats describe re-encoding consumed events for shipping upstream
+type ReencodeStats struct {
+	Format         string
+	BatchSize      int     // Events per upstream message
+	BytesPerEvent  float64 // Encoded output
+	SizeVsRaw      float64 // Output size over the 32-byte ring record
+	EncodeNs       float64 // Mean encode time per event
+	AllocsPerEvent float64 // Heap allocations per event
+}
+
+// ReencodeBenchmark times re-encoding batches of consumed events into
+// each upstream format, as an agent forwarding them off the host does.
+// Events are generated once with the syscall payload and the usual event
+// mix, so every format encodes identical data.
+type ReencodeBenchmark struct {
+	duration time.Duration
+	formats  []string
+	batch    int
+	events   []Event
+	verbose  bool
+}
+
+// newReencodeEvents builds a pool of n events like those a consumer
+// receives: rising timestamps, a few CPUs and syscall-shaped data
+func newReencodeEvents(n int, payload PayloadGenerator, mix *eventMix) []Event {
+	events := make([]Event, n)
+	pid := uint32(os.Getpid())
+	ts := uint64(time.Now().UnixNano())
+	for i := range events {
+		ts += 200 + uint64(payload.Uint32()%2000)
+		events[i] = Event{
+			Timestamp: ts,
+			PID:       pid,
+			CPU:       uint32(i % runtime.NumCPU()),
+			EventType: mix.Next(),
+			Data:      payload.Uint32(),
+		}
+	}
+	return events
+}
+
+// encodeBatch appends batch in format to out
+func encodeBatch(out []byte, format string, batch []Event, scratch []jsonEvent) ([]byte, error) {
+	switch format {
+	case formatRaw:
+		for i := range batch {
+			var rec [eventV1Size]byte
+			putFixed(rec[:], &extendedEvent{Event: batch[i]}, schemaV1)
+			out = append(out, rec[:]...)
+		}
+	case formatJSON:
+		for i, e := range batch {
+			scratch[i] = jsonEvent(e)
+		}
+		b, err := json.Marshal(scratch[:len(batch)])
+		if err != nil {
+			return out, err
+		}
+		out = append(out, b...)
+	case formatProtobuf:
+		for i := range batch {
+			out = appendProtoEvent(out, &batch[i])
+		}
+	}
+	return out, nil
+}
+
+// runOne measures one format
+func (b *ReencodeBenchmark) runOne(ctx context.Context, format string) (*BenchmarkResult, error) {
+	r := &BenchmarkResult{
+		Name:           "Upstream Re-encoding",
+		Language:       "Go",
+		ProgramType:    "tracepoint",
+		DataMechanism:  "ring_buffer",
+		ReaderStrategy: fmt.Sprintf("format=%s/batch=%d", format, b.batch),
+		Host:           CollectHostInfo(),
+		Errors:         []string{},
+		WorkloadSetup:  WorkloadSetup{Payload: "syscall"},
+	}
+	benchLog(ctx).Info("Encoding", "format", format, "batch", b.batch, "duration", b.duration)
+
+	// Check the encoding once before timing it
+	sample := b.events[:min(b.batch, len(b.events))]
+	scratch := make([]jsonEvent, b.batch)
+	out, err := encodeBatch(nil, format, sample, scratch)
+	if err != nil {
+		return nil, err
+	}
+	if format == formatProtobuf {
+		decoded, err := decodeProtoBatch(out)
+		if err != nil || len(decoded) != len(sample) {
+			return nil, fmt.Errorf("protobuf round trip: %v (%d of %d events)", err, len(decoded), len(sample))
+		}
+		for i := range decoded {
+			if decoded[i] != sample[i] {
+				return nil, fmt.Errorf("protobuf round trip: event %d is %v, want %v", i, decoded[i], sample[i])
+			}
+		}
+	}
+
+	var before, after runtime.MemStats
+	var encoded, bytes, batches int64
+	var spent time.Duration
+	startUsage, _ := TakeResourceSnapshot()
+	runtime.ReadMemStats(&before)
+	r.StartTime = time.Now()
+	deadline := r.StartTime.Add(b.duration)
+	for pos := 0; time.Now().Before(deadline) && ctx.Err() == nil; {
+		if pos+b.batch > len(b.events) {
+			pos = 0
+		}
+		batch := b.events[pos : pos+b.batch]
+		pos += b.batch
+		t0 := time.Now()
+		out, err = encodeBatch(out[:0], format, batch, scratch)
+		spent += time.Since(t0)
+		if err != nil {
+			return nil, err
+		}
+		encoded += int64(len(batch))
+		bytes += int64(len(out))
+		batches++
+	}
+	r.EndTime = time.Now()
+	runtime.ReadMemStats(&after)
+	endUsage, _ := TakeResourceSnapshot()
+	markInterrupted(ctx, r)
+
+	wall := r.EndTime.Sub(r.StartTime)
+	r.Duration = wall.Seconds()
+	r.EventCount = encoded
+	if spent > 0 {
+		r.Throughput = float64(encoded) / spent.Seconds()
+	}
+	s := &ReencodeStats{Format: format, BatchSize: b.batch}
+	if encoded > 0 {
+		s.BytesPerEvent = float64(bytes) / float64(encoded)
+		s.SizeVsRaw = s.BytesPerEvent / eventV1Size
+		s.EncodeNs = float64(spent.Nanoseconds()) / float64(encoded)
+		s.AllocsPerEvent = float64(after.Mallocs-before.Mallocs) / float64(encoded)
+	}
+	r.Reencode = s
+	r.CPUBudget = NewCPUBudget(startUsage, endUsage, encoded)
+	r.CPUUsage = r.CPUBudget.CPUPercent(wall)
+	r.MemoryUsage = uint64(cap(out))
+	r.Operations = []OperationResult{NewOperationResult("encode_batch", batches, spent)}
+	return r, nil
+}
+
+// Run measures every format in turn
+func (b *ReencodeBenchmark) Run(ctx context.Context) ([]*BenchmarkResult, error) {
+	if b.verbose {
+		PrintBenchmarkHeader("Upstream Re-encoding Benchmark (Go)")
+	}
+	var results []*BenchmarkResult
+	for _, format := range b.formats {
+		if ctx.Err() != nil {
+			break
+		}
+		r, err := b.runOne(ctx, format)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", format, err)
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// formatReencode renders the re-encoding statistics, if measured
+func (r *BenchmarkResult) formatReencode() string {
+	s := r.Reencode
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("Re-encoding:     %s, batch %d: %.1f B/event (%.2fx raw), %.1f ns/event, %.2f allocs/event\n",
+		s.Format, s.BatchSize, s.BytesPerEvent, s.SizeVsRaw, s.EncodeNs, s.AllocsPerEvent)
+}
+
+// runReencodeBenchmark is the entry point of the reencode subcommand
+func runReencodeBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("reencode", flag.ExitOnError)
+	common := addBenchFlags(fs, "reencode_result.json", true)
+	formats := fs.String("formats", strings.Join(allReencodeFormats, ","), "Comma-separated upstream formats (raw, json, protobuf)")
+	batch := fs.Int("batch", 256, "Events per upstream message")
+	pool := fs.Int("pool", 65536, "Distinct events cycled through the encoders")
+	seed := fs.Uint64("seed", 1, "Payload generator seed")
+	mixFlag := fs.String("event-mix", "tracepoint:3,kprobe:1", "Event types of the pool, with weights")
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+	for _, f := range splitList(*formats) {
+		if !containsString(allReencodeFormats, f) {
+			return nil, opts, fmt.Errorf("unknown format %q", f)
+		}
+	}
+	if *batch <= 0 {
+		return nil, opts, fmt.Errorf("-batch must be positive")
+	}
+	if *pool < *batch {
+		return nil, opts, fmt.Errorf("-pool must hold at least one batch")
+	}
+	mix, err := parseEventMix(*mixFlag)
+	if err != nil {
+		return nil, opts, fmt.Errorf("invalid -event-mix: %w", err)
+	}
+	payload, err := NewPayloadGenerator("syscall", *seed)
+	if err != nil {
+		return nil, opts, err
+	}
+
+	bench := &ReencodeBenchmark{
+		duration: opts.Duration,
+		formats:  splitList(*formats),
+		batch:    *batch,
+		events:   newReencodeEvents(*pool, payload, mix),
+		verbose:  opts.Verbose,
+	}
+	results, err := bench.Run(ctx)
+	if err != nil {
+		return nil, opts, err
+	}
+	return results, opts, nil
+}
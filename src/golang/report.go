@@ -0,0 +1,192 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// printReportTable prints one summary line per result, followed by any
+// data-quality flags
+func printReportTable(results []*BenchmarkResult, unit LatencyUnit) {
+	PrintSeparator()
+	fmt.Printf("%-40s %-6s %-12s %-28s %12s %8s %15s %12s %12s %12s %12s %10s\n",
+		"Benchmark", "Lang", "Program", "Mechanism", "Events", "Drop%", "Throughput", "p50", "p99", "StdDev", "Jitter",
+		"CPU/Event")
+	for _, r := range results {
+		p50, p99 := "-", "-"
+		if v, ok := r.Latency.Percentile(0.5); ok {
+			p50 = unit.Format(float64(v))
+		}
+		if v, ok := r.Latency.Percentile(0.99); ok {
+			p99 = unit.Format(float64(v))
+		}
+		mechanism := r.DataMechanism
+		if r.ReaderStrategy != "" {
+			mechanism += "/" + r.ReaderStrategy
+		}
+		fmt.Printf("%-40s %-6s %-12s %-28s %12d %7.3f%% %15.0f %12s %12s %12s %12s %8.3fµs\n",
+			r.Name, r.Language, r.ProgramType, mechanism, r.EventCount, r.DropRate*100, r.Throughput,
+			p50, p99, unit.Format(r.Latency.StdDevNs), unit.Format(r.Latency.JitterNs), r.CPUBudget.CPUPerEventUs)
+	}
+	for _, r := range results {
+		if !r.Quality.OK() {
+			fmt.Printf("Data quality: %s: %s\n", r.Name, r.Quality)
+		}
+	}
+	for _, r := range results {
+		for _, a := range r.Annotations {
+			fmt.Printf("Annotation: %s +%s: %s\n", r.Name, a.Time.Sub(r.StartTime).Round(time.Millisecond), a.Note)
+		}
+	}
+	printHarnessFloor(results, unit)
+	printTimeBudget(results)
+	PrintSeparator()
+}
+
+// reportGroups are the -group-by keys of the report subcommand
+var reportGroups = map[string]func(r *BenchmarkResult) string{
+	"benchmark":  func(r *BenchmarkResult) string { return resultKey(r) },
+	"kernel":     func(r *BenchmarkResult) string { return r.Host.KernelRelease },
+	"date":       func(r *BenchmarkResult) string { return r.StartTime.UTC().Format(resultDateLayout) },
+	"mitigation": func(r *BenchmarkResult) string { return r.Host.MitigationProfile },
+	"language":   func(r *BenchmarkResult) string { return r.Language },
+	"mechanism":  func(r *BenchmarkResult) string { return r.DataMechanism },
+}
+
+// runReport is the entry point of the report subcommand. It summarizes
+// result files, or runs queried from the history store.
+func runReport(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	latencyUnit := fs.String("latency-unit", "us", "Latency display unit (ns, us, ms)")
+	storePath := fs.String("store", "", "Query this history store instead of result files (default "+defaultStorePath+" when filtering)")
+	from := fs.String("from", "", "Only runs started on or after this date or RFC 3339 time")
+	to := fs.String("to", "", "Only runs started before this date or RFC 3339 time")
+	benchmark := fs.String("benchmark", "", "Only runs of this benchmark (subcommand or result name)")
+	groupBy := fs.String("group-by", "", "Aggregate runs by benchmark plus one of: date, kernel, language, mechanism, mitigation")
+	htmlPath := fs.String("html", "", "Also write the runs as a static HTML report with charts to this file")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: report [flags] [result.json...]\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	unit, err := ParseLatencyUnit(*latencyUnit)
+	if err != nil {
+		return err
+	}
+	var q StoreQuery
+	if *from != "" {
+		if q.From, err = parseQueryTime(*from); err != nil {
+			return err
+		}
+	}
+	if *to != "" {
+		if q.To, err = parseQueryTime(*to); err != nil {
+			return err
+		}
+	}
+	q.Benchmark = *benchmark
+	group := reportGroups[*groupBy]
+	if *groupBy != "" && group == nil {
+		return fmt.Errorf("unknown -group-by %q", *groupBy)
+	}
+
+	var all []*BenchmarkResult
+	if fs.NArg() > 0 {
+		for _, file := range fs.Args() {
+			results, err := LoadResultsFromJSON(file)
+			if err != nil {
+				return err
+			}
+			for _, r := range results {
+				if q.Match(StoredRun{Result: r}) {
+					all = append(all, r)
+				}
+			}
+		}
+	} else {
+		if *storePath == "" {
+			if q == (StoreQuery{}) && *groupBy == "" {
+				fs.Usage()
+				return fmt.Errorf("no result files or store query given")
+			}
+			*storePath = defaultStorePath
+		}
+		runs, err := OpenResultStore(*storePath).Query(q)
+		if err != nil {
+			return err
+		}
+		for _, run := range runs {
+			all = append(all, run.Result)
+		}
+	}
+	if len(all) == 0 {
+		return fmt.Errorf("no results match")
+	}
+	if *htmlPath != "" {
+		if err := writeHTMLReport(*htmlPath, all, unit); err != nil {
+			return fmt.Errorf("html report: %w", err)
+		}
+		fmt.Printf("HTML report written to %s\n", *htmlPath)
+	}
+
+	if group != nil {
+		printGroupedReport(all, *groupBy, group, unit)
+		return nil
+	}
+	printReportTable(all, unit)
+	return nil
+}
+
+// printGroupedReport prints one line per benchmark and group value, with
+// metrics averaged over the group's runs
+func printGroupedReport(results []*BenchmarkResult, groupName string, group func(r *BenchmarkResult) string,
+	unit LatencyUnit) {
+
+	type groupKey struct{ benchmark, value string }
+	var keys []groupKey
+	groups := make(map[groupKey][]*BenchmarkResult)
+	for _, r := range results {
+		k := groupKey{resultKey(r), group(r)}
+		if groupName == "benchmark" {
+			k.value = ""
+		}
+		if k.value == "" && groupName != "benchmark" {
+			k.value = "unknown"
+		}
+		if groups[k] == nil {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], r)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		if keys[i].benchmark != keys[j].benchmark {
+			return keys[i].benchmark < keys[j].benchmark
+		}
+		return keys[i].value < keys[j].value
+	})
+
+	formatLatency := func(runs []*BenchmarkResult, q float64) string {
+		v, ok := meanMetric(runs, latencyPercentile(q))
+		if !ok {
+			return "-"
+		}
+		return unit.Format(v)
+	}
+	PrintSeparator()
+	fmt.Printf("%-48s %-24s %5s %15s %12s %12s %10s\n",
+		"Benchmark", strings.ToUpper(groupName[:1])+groupName[1:], "Runs", "Throughput", "p50", "p99", "CPU/Event")
+	for _, k := range keys {
+		runs := groups[k]
+		throughput, _ := meanMetric(runs, func(r *BenchmarkResult) (float64, bool) { return r.Throughput, true })
+		cpu, _ := meanMetric(runs, func(r *BenchmarkResult) (float64, bool) { return r.CPUBudget.CPUPerEventUs, true })
+		fmt.Printf("%-48s %-24s %5d %15.0f %12s %12s %8.3fµs\n",
+			k.benchmark, k.value, len(runs), throughput, formatLatency(runs, 0.5), formatLatency(runs, 0.99), cpu)
+	}
+	PrintSeparator()
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"sort"
+	"time"
+)
+
+// The HTML report is one self-contained file: the charts are inline SVG
+// drawn on the server side, with no scripts or external assets, so it
+// can be mailed or attached to a ticket as is.
+
+const (
+	chartWidth  = 720
+	chartHeight = 240
+	chartMargin = 48 // Left and bottom, for the axis labels
+)
+
+// chartColors cycle across the series of a chart
+var chartColors = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b", "#e377c2", "#7f7f7f"}
+
+// svgBar is one bar of a bar chart, in SVG coordinates
+type svgBar struct {
+	X, Y, W, H float64
+	Label      string // Below the bar
+	Value      string // Tooltip
+	Color      string
+}
+
+// svgSeries is one line of a line chart
+type svgSeries struct {
+	Name   string
+	Points string // SVG polyline points
+	Dots   []svgDot
+	Color  string
+}
+
+type svgDot struct {
+	X, Y  float64
+	Value string
+}
+
+// svgChart is a bar or line chart ready for the template
+type svgChart struct {
+	Title         string
+	Width, Height int
+	Bars          []svgBar
+	Series        []svgSeries
+	YMax, XMin    string // Axis end labels
+	XMax          string
+	Note          string
+	RotateLabels  bool
+	PlotX, PlotY  float64 // Plot area origin and size
+	PlotW, PlotH  float64
+	LabelY, BaseY float64
+}
+
+func newSVGChart(title string) svgChart {
+	return svgChart{
+		Title: title, Width: chartWidth, Height: chartHeight,
+		PlotX: chartMargin, PlotY: 8,
+		PlotW: chartWidth - chartMargin - 8, PlotH: chartHeight - chartMargin - 8,
+		LabelY: chartHeight - chartMargin + 14, BaseY: chartHeight - chartMargin,
+	}
+}
+
+// barChart draws one bar per value; format renders values for labels
+func barChart(title string, labels []string, values []float64, format func(float64) string) svgChart {
+	c := newSVGChart(title)
+	top := 0.0
+	for _, v := range values {
+		top = max(top, v)
+	}
+	if top == 0 || len(values) == 0 {
+		return c
+	}
+	c.YMax = format(top)
+	slot := c.PlotW / float64(len(values))
+	c.RotateLabels = slot < 60
+	for i, v := range values {
+		h := v / top * c.PlotH
+		c.Bars = append(c.Bars, svgBar{
+			X: c.PlotX + float64(i)*slot + slot*0.1, Y: c.PlotY + c.PlotH - h,
+			W: slot * 0.8, H: h,
+			Label: labels[i], Value: labels[i] + ": " + format(v),
+			Color: chartColors[i%len(chartColors)],
+		})
+	}
+	return c
+}
+
+// throughputChart plots the throughput of each benchmark against the
+// start time of its runs, one line per benchmark
+func throughputChart(results []*BenchmarkResult) svgChart {
+	c := newSVGChart("Throughput over time")
+	keys, groups := groupResults(results)
+	var first, last time.Time
+	top := 0.0
+	for _, r := range results {
+		if first.IsZero() || r.StartTime.Before(first) {
+			first = r.StartTime
+		}
+		if r.StartTime.After(last) {
+			last = r.StartTime
+		}
+		top = max(top, r.Throughput)
+	}
+	span := last.Sub(first).Seconds()
+	if span == 0 || top == 0 {
+		c.Note = "All runs started together; run again or query the history store for a trend"
+		return c
+	}
+	c.YMax = fmt.Sprintf("%.0f/s", top)
+	c.XMin = first.UTC().Format("2006-01-02 15:04Z")
+	c.XMax = last.UTC().Format("2006-01-02 15:04Z")
+	for i, key := range keys {
+		runs := append([]*BenchmarkResult(nil), groups[key]...)
+		sort.Slice(runs, func(a, b int) bool { return runs[a].StartTime.Before(runs[b].StartTime) })
+		s := svgSeries{Name: key, Color: chartColors[i%len(chartColors)]}
+		for _, r := range runs {
+			x := c.PlotX + r.StartTime.Sub(first).Seconds()/span*c.PlotW
+			y := c.PlotY + c.PlotH - r.Throughput/top*c.PlotH
+			s.Points += fmt.Sprintf("%.1f,%.1f ", x, y)
+			s.Dots = append(s.Dots, svgDot{x, y, fmt.Sprintf("%s %s: %.0f events/sec", key, formatResultTime(r.StartTime), r.Throughput)})
+		}
+		c.Series = append(c.Series, s)
+	}
+	return c
+}
+
+// histogramChart draws a result's latency histogram, one bar per bucket
+// in bucket order so the log-linear buckets read left to right
+func histogramChart(r *BenchmarkResult, label string, unit LatencyUnit) svgChart {
+	labels := make([]string, len(r.LatencyHistogram))
+	counts := make([]float64, len(r.LatencyHistogram))
+	for i, b := range r.LatencyHistogram {
+		labels[i] = unit.Format(float64(b.LowNs))
+		counts[i] = float64(b.Count)
+	}
+	c := barChart(label+" latency", labels, counts, func(v float64) string { return fmt.Sprintf("%.0f", v) })
+	for i := range c.Bars {
+		c.Bars[i].Color = chartColors[0]
+		if len(c.Bars) > 24 && i%(len(c.Bars)/12) != 0 {
+			c.Bars[i].Label = "" // Keep the axis legible
+		}
+	}
+	return c
+}
+
+// htmlRow is one line of the summary table
+type htmlRow struct {
+	Name, Language, Program, Mechanism string
+	Events                             int64
+	DropRate                           float64
+	Throughput                         float64
+	P50, P99, StdDev                   string
+	CPUPerEventUs, CPUUsage            float64
+	Quality                            string
+	Started                            string
+}
+
+// htmlAnnotation is one operator note in the annotations table
+type htmlAnnotation struct {
+	Benchmark, Time, Offset, Note string
+}
+
+// htmlReport is the data of the report template
+type htmlReport struct {
+	Generated   string
+	Results     int
+	Rows        []htmlRow
+	Annotations []htmlAnnotation
+	Throughput  svgChart
+	CPU         svgChart
+	Histograms  []svgChart
+}
+
+// writeHTMLReport renders results as a static HTML report at path
+func writeHTMLReport(path string, results []*BenchmarkResult, unit LatencyUnit) error {
+	rep := htmlReport{Generated: time.Now().Format(time.RFC1123), Results: len(results)}
+	labels := make([]string, len(results))
+	seen := make(map[string]int)
+	var cpu []float64
+	for i, r := range results {
+		labels[i] = resultKey(r)
+		if seen[labels[i]]++; seen[labels[i]] > 1 {
+			labels[i] += fmt.Sprintf(" #%d", seen[labels[i]])
+		}
+		row := htmlRow{
+			Name: labels[i], Language: r.Language, Program: r.ProgramType, Mechanism: r.DataMechanism,
+			Events: r.EventCount, DropRate: r.DropRate * 100, Throughput: r.Throughput,
+			P50: "-", P99: "-", StdDev: unit.Format(r.Latency.StdDevNs),
+			CPUPerEventUs: r.CPUBudget.CPUPerEventUs, CPUUsage: r.CPUUsage,
+			Started: formatResultTime(r.StartTime),
+		}
+		if v, ok := r.Latency.Percentile(0.5); ok {
+			row.P50 = unit.Format(float64(v))
+		}
+		if v, ok := r.Latency.Percentile(0.99); ok {
+			row.P99 = unit.Format(float64(v))
+		}
+		if r.ReaderStrategy != "" {
+			row.Mechanism += "/" + r.ReaderStrategy
+		}
+		if !r.Quality.OK() {
+			row.Quality = r.Quality.String()
+		}
+		rep.Rows = append(rep.Rows, row)
+		for _, a := range r.Annotations {
+			rep.Annotations = append(rep.Annotations, htmlAnnotation{
+				Benchmark: labels[i], Time: formatResultTime(a.Time),
+				Offset: "+" + a.Time.Sub(r.StartTime).Round(time.Millisecond).String(), Note: a.Note,
+			})
+		}
+		cpu = append(cpu, r.CPUBudget.CPUPerEventUs)
+		if len(r.LatencyHistogram) > 0 {
+			rep.Histograms = append(rep.Histograms, histogramChart(r, labels[i], unit))
+		}
+	}
+	rep.Throughput = throughputChart(results)
+	rep.CPU = barChart("CPU time per event", labels, cpu, func(v float64) string { return fmt.Sprintf("%.3fµs", v) })
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := reportTemplate.Execute(f, rep); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>eBPF benchmark report</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; font-size: 0.9em; }
+th, td { padding: 4px 8px; border-bottom: 1px solid #ddd; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+td.quality { color: #b00; text-align: left; }
+svg { background: #fafafa; margin: 1em 0; }
+svg text { font-size: 11px; fill: #444; }
+.note { color: #666; font-style: italic; }
+.legend span { margin-right: 1em; }
+</style>
+</head>
+<body>
+<h1>eBPF benchmark report</h1>
+<p>{{.Results}} results, generated {{.Generated}}.</p>
+
+<h2>Summary</h2>
+<table>
+<tr><th>Benchmark</th><th>Lang</th><th>Program</th><th>Mechanism</th><th>Events</th><th>Drop%</th><th>Throughput/s</th><th>p50</th><th>p99</th><th>StdDev</th><th>CPU/Event</th><th>CPU%</th><th>Started</th><th>Data quality</th></tr>
+{{range .Rows}}<tr><td>{{.Name}}</td><td>{{.Language}}</td><td>{{.Program}}</td><td>{{.Mechanism}}</td><td>{{.Events}}</td><td>{{printf "%.3f" .DropRate}}</td><td>{{printf "%.0f" .Throughput}}</td><td>{{.P50}}</td><td>{{.P99}}</td><td>{{.StdDev}}</td><td>{{printf "%.3fµs" .CPUPerEventUs}}</td><td>{{printf "%.1f" .CPUUsage}}</td><td>{{.Started}}</td><td class="quality">{{.Quality}}</td></tr>
+{{end}}</table>
+
+{{if .Annotations}}<h2>Annotations</h2>
+<table>
+<tr><th>Benchmark</th><th>Time</th><th>Offset</th><th>Note</th></tr>
+{{range .Annotations}}<tr><td>{{.Benchmark}}</td><td>{{.Time}}</td><td>{{.Offset}}</td><td class="note">{{.Note}}</td></tr>
+{{end}}</table>
+{{end}}
+{{define "chart"}}<h3>{{.Title}}</h3>
+{{if .Note}}<p class="note">{{.Note}}</p>{{else}}<svg width="{{.Width}}" height="{{.Height}}" viewBox="0 0 {{.Width}} {{.Height}}">
+<line x1="{{.PlotX}}" y1="{{.BaseY}}" x2="{{.Width}}" y2="{{.BaseY}}" stroke="#999"/>
+<line x1="{{.PlotX}}" y1="{{.PlotY}}" x2="{{.PlotX}}" y2="{{.BaseY}}" stroke="#999"/>
+<text x="{{.PlotX}}" y="{{.PlotY}}" dx="-4" dy="10" text-anchor="end">{{.YMax}}</text>
+<text x="{{.PlotX}}" y="{{.BaseY}}" dx="-4" text-anchor="end">0</text>
+{{$c := .}}{{range .Bars}}<rect x="{{printf "%.1f" .X}}" y="{{printf "%.1f" .Y}}" width="{{printf "%.1f" .W}}" height="{{printf "%.1f" .H}}" fill="{{.Color}}"><title>{{.Value}}</title></rect>
+{{if .Label}}<text x="{{printf "%.1f" .X}}" y="{{$c.LabelY}}"{{if $c.RotateLabels}} transform="rotate(30 {{printf "%.1f" .X}} {{$c.LabelY}})"{{end}}>{{.Label}}</text>{{end}}
+{{end}}{{range .Series}}<polyline points="{{.Points}}" fill="none" stroke="{{.Color}}" stroke-width="2"/>
+{{$color := .Color}}{{range .Dots}}<circle cx="{{printf "%.1f" .X}}" cy="{{printf "%.1f" .Y}}" r="3" fill="{{$color}}"><title>{{.Value}}</title></circle>
+{{end}}{{end}}{{if .XMin}}<text x="{{.PlotX}}" y="{{.LabelY}}">{{.XMin}}</text><text x="{{.Width}}" y="{{.LabelY}}" dx="-4" text-anchor="end">{{.XMax}}</text>{{end}}
+</svg>
+{{if .Series}}<div class="legend">{{range .Series}}<span style="color: {{.Color}}">&#9632; {{.Name}}</span>{{end}}</div>{{end}}{{end}}
+{{end}}
+
+<h2>Throughput</h2>
+{{template "chart" .Throughput}}
+
+<h2>CPU usage</h2>
+{{template "chart" .CPU}}
+
+<h2>Latency histograms</h2>
+{{if not .Histograms}}<p class="note">No result carries a latency histogram.</p>{{end}}
+{{range .Histograms}}{{template "chart" .}}{{end}}
+</body>
+</html>
+`))
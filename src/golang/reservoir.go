@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// eventReservoir keeps a uniform random sample of a fixed number of the
+// events added to it (Vitter's algorithm R), so a run that keeps no
+// events still leaves some to inspect
+type eventReservoir struct {
+	events []Event
+	seen   int64
+	rng    randomPayload
+}
+
+func newEventReservoir(size int, seed uint64) *eventReservoir {
+	return &eventReservoir{events: make([]Event, 0, size), rng: randomPayload{state: seed | 1}}
+}
+
+func (r *eventReservoir) add(e Event) {
+	r.seen++
+	if len(r.events) < cap(r.events) {
+		r.events = append(r.events, e)
+		return
+	}
+	if j := r.rng.next() % uint64(r.seen); j < uint64(len(r.events)) {
+		r.events[j] = e
+	}
+}
+
+func (r *eventReservoir) reset() {
+	r.events = r.events[:0]
+	r.seen = 0
+}
+
+// EventSample is a uniform random sample of the events received, kept or
+// dropped
+type EventSample struct {
+	Size   int     // Events requested
+	Seen   int64   // Events sampled from
+	Events []Event // Ordered by timestamp
+}
+
+// SetSampling keeps a reservoir of size events, uniformly sampled from
+// every event added; 0 disables it
+func (eb *EventBuffer) SetSampling(size int, seed uint64) {
+	eb.reservoir = nil
+	if size > 0 {
+		eb.reservoir = newEventReservoir(size, seed)
+	}
+}
+
+// GetEventSample returns the reservoir, or nil when sampling is off
+func (eb *EventBuffer) GetEventSample() *EventSample {
+	r := eb.reservoir
+	if r == nil {
+		return nil
+	}
+	events := append([]Event(nil), r.events...)
+	sort.Slice(events, func(i, j int) bool { return events[i].Timestamp < events[j].Timestamp })
+	return &EventSample{Size: cap(r.events), Seen: r.seen, Events: events}
+}
+
+// formatEventSample summarizes the sample; the events are in the JSON
+func (r *BenchmarkResult) formatEventSample() string {
+	s := r.EventSample
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("Event Sample:    %d of %d events, in the result file\n", len(s.Events), s.Seen)
+}
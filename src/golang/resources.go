@@ -0,0 +1,118 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// ResourceSnapshot captures process CPU time at a point in time
+type ResourceSnapshot struct {
+	Wall   time.Time
+	User   time.Duration
+	System time.Duration
+	MaxRSS uint64 // Peak resident set size in bytes
+}
+
+// TakeResourceSnapshot reads getrusage(RUSAGE_SELF) for the current process
+func TakeResourceSnapshot() (ResourceSnapshot, error) {
+	return takeRusage(syscall.RUSAGE_SELF)
+}
+
+// CPUBudget describes consumer CPU cost over a measurement window
+type CPUBudget struct {
+	UserTimeUs    float64 // User CPU time spent in the window
+	SystemTimeUs  float64 // System CPU time spent in the window
+	CPUPerEventUs float64 // Total CPU time per delivered event
+}
+
+// NewCPUBudget computes the CPU budget between two snapshots
+func NewCPUBudget(start, end ResourceSnapshot, events int64) CPUBudget {
+	user := end.User - start.User
+	sys := end.System - start.System
+	b := CPUBudget{
+		UserTimeUs:   float64(user) / float64(time.Microsecond),
+		SystemTimeUs: float64(sys) / float64(time.Microsecond),
+	}
+	if events > 0 {
+		b.CPUPerEventUs = (b.UserTimeUs + b.SystemTimeUs) / float64(events)
+	}
+	return b
+}
+
+// CPUPercent returns CPU utilisation over the window as a percentage of one core
+func (b CPUBudget) CPUPercent(wall time.Duration) float64 {
+	if wall <= 0 {
+		return 0
+	}
+	return (b.UserTimeUs + b.SystemTimeUs) / (float64(wall) / float64(time.Microsecond)) * 100
+}
+
+// rusageThread is RUSAGE_THREAD, which the syscall package does not export
+const rusageThread = 1
+
+// TakeThreadResourceSnapshot reads getrusage(RUSAGE_THREAD). The calling
+// goroutine must be locked to its OS thread for the snapshot to mean
+// anything.
+func TakeThreadResourceSnapshot() (ResourceSnapshot, error) {
+	return takeRusage(rusageThread)
+}
+
+// TakeChildrenResourceSnapshot reads getrusage(RUSAGE_CHILDREN), covering
+// child processes that have been waited for
+func TakeChildrenResourceSnapshot() (ResourceSnapshot, error) {
+	return takeRusage(syscall.RUSAGE_CHILDREN)
+}
+
+func takeRusage(who int) (ResourceSnapshot, error) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(who, &ru); err != nil {
+		return ResourceSnapshot{Wall: time.Now()}, err
+	}
+	return ResourceSnapshot{
+		Wall:   time.Now(),
+		User:   time.Duration(ru.Utime.Nano()),
+		System: time.Duration(ru.Stime.Nano()),
+		MaxRSS: uint64(ru.Maxrss) * 1024,
+	}, nil
+}
+
+// LoadGeneratorUsage is the resource usage of the load generator, reported
+// separately so CPUBudget reflects only the consumer under test
+type LoadGeneratorUsage struct {
+	Source       string // How usage was measured: thread or child
+	UserTimeUs   float64
+	SystemTimeUs float64
+	CPUPercent   float64 // Of one core over the generator's lifetime
+	MemoryBytes  uint64  // Buffers owned by the generator, or child max RSS
+}
+
+// NewLoadGeneratorUsage computes generator usage between two snapshots
+func NewLoadGeneratorUsage(source string, start, end ResourceSnapshot, memory uint64) LoadGeneratorUsage {
+	b := NewCPUBudget(start, end, 0)
+	return LoadGeneratorUsage{
+		Source:       source,
+		UserTimeUs:   b.UserTimeUs,
+		SystemTimeUs: b.SystemTimeUs,
+		CPUPercent:   b.CPUPercent(end.Wall.Sub(start.Wall)),
+		MemoryBytes:  memory,
+	}
+}
+
+// Without removes the generator's CPU time from a process-wide budget,
+// recomputing the per-event cost for the consumer alone
+func (b CPUBudget) Without(gen LoadGeneratorUsage, events int64) CPUBudget {
+	out := CPUBudget{
+		UserTimeUs:   max(b.UserTimeUs-gen.UserTimeUs, 0),
+		SystemTimeUs: max(b.SystemTimeUs-gen.SystemTimeUs, 0),
+	}
+	if events > 0 {
+		out.CPUPerEventUs = (out.UserTimeUs + out.SystemTimeUs) / float64(events)
+	}
+	return out
+}
+
+// WithoutSystem removes us microseconds of system time, such as measured
+// harness syscalls, from the budget
+func (b CPUBudget) WithoutSystem(us float64, events int64) CPUBudget {
+	return b.Without(LoadGeneratorUsage{SystemTimeUs: us}, events)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Layouts of result times in tables and reports. Times are shown in UTC,
+// so results recorded in different time zones line up.
+const (
+	resultTimeLayout = "2006-01-02 15:04:05Z"
+	resultDateLayout = "2006-01-02"
+)
+
+// normalizeTimes stores a result's start and end in UTC, noting the UTC
+// offset and time zone they were recorded in. A result fresh from a run
+// also keeps its window's length on the monotonic clock, which wall-clock
+// steps during the run do not affect. Normalizing twice changes nothing.
+func (r *BenchmarkResult) normalizeTimes() {
+	if r.StartTime.IsZero() {
+		return
+	}
+	if r.UTCOffset == "" {
+		_, offset := r.StartTime.Zone()
+		r.UTCOffset = formatUTCOffset(offset)
+		if r.StartTime.Location() == time.Local {
+			r.TimeZone = localTimeZone()
+		}
+	}
+	// UTC drops the monotonic readings, so take the window's length first
+	if r.MonotonicSeconds == 0 && r.StartTime.Round(0) != r.StartTime && r.EndTime.Round(0) != r.EndTime {
+		r.MonotonicSeconds = r.EndTime.Sub(r.StartTime).Seconds()
+	}
+	r.StartTime = r.StartTime.UTC()
+	if !r.EndTime.IsZero() {
+		r.EndTime = r.EndTime.UTC()
+	}
+	for i := range r.Annotations {
+		r.Annotations[i].Time = r.Annotations[i].Time.UTC()
+	}
+}
+
+// normalizeResultTimes normalizes the times of every result
+func normalizeResultTimes(results []*BenchmarkResult) {
+	for _, r := range results {
+		r.normalizeTimes()
+	}
+}
+
+// formatUTCOffset renders an offset east of UTC in seconds as +hh:mm
+func formatUTCOffset(offset int) string {
+	sign := '+'
+	if offset < 0 {
+		sign, offset = '-', -offset
+	}
+	return fmt.Sprintf("%c%02d:%02d", sign, offset/3600, offset%3600/60)
+}
+
+// localTimeZone names the host's time zone: TZ if set, else the zoneinfo
+// file /etc/localtime links to, else the zone's abbreviation
+func localTimeZone() string {
+	if tz, ok := os.LookupEnv("TZ"); ok {
+		if tz = strings.TrimPrefix(tz, ":"); tz != "" {
+			return tz
+		}
+		return "UTC"
+	}
+	if target, err := os.Readlink("/etc/localtime"); err == nil {
+		if i := strings.Index(target, "zoneinfo/"); i >= 0 {
+			return target[i+len("zoneinfo/"):]
+		}
+		return filepath.Base(target)
+	}
+	name, _ := time.Now().Zone()
+	return name
+}
+
+// formatResultTime renders t for a table: UTC, to the second
+func formatResultTime(t time.Time) string {
+	return t.UTC().Format(resultTimeLayout)
+}
+
+// formatWindow renders the start and end lines of a result, in UTC with
+// the zone they were recorded in and the monotonic length of the window
+func (r *BenchmarkResult) formatWindow() (start, end string) {
+	start = r.StartTime.UTC().Format(time.RFC3339Nano)
+	if r.UTCOffset != "" {
+		zone := "UTC" + r.UTCOffset
+		if r.TimeZone != "" {
+			zone += ", " + r.TimeZone
+		}
+		start += " (recorded at " + zone + ")"
+	}
+	end = r.EndTime.UTC().Format(time.RFC3339Nano)
+	if r.MonotonicSeconds > 0 {
+		end += fmt.Sprintf(" (%.3fs on the monotonic clock)", r.MonotonicSeconds)
+	}
+	return start, end
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Result file formats
+const (
+	FormatJSON  = "json"  // One object, or an array for several results; replaces the file
+	FormatJSONL = "jsonl" // One object per line, appended
+	FormatCSV   = "csv"   // One flattened row per result, appended
+)
+
+// ResultWriter writes benchmark results to a file
+type ResultWriter interface {
+	Write(results []*BenchmarkResult) error
+}
+
+// NewResultWriter returns a writer for format, or for the format implied by
+// the file extension when format is empty
+func NewResultWriter(format, filename string, pretty bool) (ResultWriter, error) {
+	if format == "" {
+		format = formatFromExt(filename)
+	}
+	switch format {
+	case FormatJSON:
+		return &jsonResultWriter{filename, pretty}, nil
+	case FormatJSONL:
+		return &jsonlResultWriter{filename}, nil
+	case FormatCSV:
+		return &csvResultWriter{filename}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q (want json, jsonl or csv)", format)
+}
+
+// formatFromExt maps an output file extension to a format
+func formatFromExt(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".jsonl", ".ndjson":
+		return FormatJSONL
+	case ".csv":
+		return FormatCSV
+	}
+	return FormatJSON
+}
+
+// jsonResultWriter keeps the original behaviour: the file is replaced
+// atomically with one object, or an array for several results
+type jsonResultWriter struct {
+	filename string
+	pretty   bool
+}
+
+func (w *jsonResultWriter) Write(results []*BenchmarkResult) error {
+	if len(results) == 1 {
+		return results[0].SaveToJSON(w.filename, w.pretty)
+	}
+	return SaveResultsToJSON(w.filename, results, w.pretty)
+}
+
+// jsonlResultWriter appends one compact JSON object per result
+type jsonlResultWriter struct {
+	filename string
+}
+
+func (w *jsonlResultWriter) Write(results []*BenchmarkResult) error {
+	var buf []byte
+	for _, r := range results {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("failed to marshal result: %w", err)
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+	return appendToFile(w.filename, func(f *os.File, _ bool) error {
+		_, err := f.Write(buf)
+		return err
+	})
+}
+
+// csvColumns are the flattened result fields written by csvResultWriter.
+// The percentile columns are csvQuantiles, left empty for results that did
+// not compute them.
+var csvColumns = []string{
+	"Name", "Language", "ProgramType", "DataMechanism", "ReaderStrategy", "Payload", "PageCache", "DropPolicy",
+	"KernelRelease", "StartTime", "EndTime", "Duration", "EventCount", "DroppedEvents", "DropRate", "Throughput",
+	"CPUUsage", "CPUUserTimeUs", "CPUSystemTimeUs", "CPUPerEventUs", "MemoryUsage", "OverheadNs",
+	"LatencySamples", "LatencyMinNs", "LatencyMaxNs", "LatencyAvgNs", "LatencyStdDevNs",
+	"LatencyVarianceNs2", "LatencyJitterNs",
+	"LatencyP50Ns", "LatencyP90Ns", "LatencyP99Ns", "LatencyP999Ns",
+	"Quality", "Errors",
+}
+
+var csvQuantiles = []float64{0.5, 0.9, 0.99, 0.999}
+
+// csvResultWriter appends one row per result, writing the header when the
+// file is new. Appending to a file with other columns is an error.
+type csvResultWriter struct {
+	filename string
+}
+
+func (w *csvResultWriter) Write(results []*BenchmarkResult) error {
+	return appendToFile(w.filename, func(f *os.File, empty bool) error {
+		if !empty {
+			header, err := csv.NewReader(f).Read()
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("failed to read CSV header: %w", err)
+			}
+			if !slices.Equal(header, csvColumns) {
+				return fmt.Errorf("%s has different columns; write to a new file", w.filename)
+			}
+		}
+		var buf bytes.Buffer
+		cw := csv.NewWriter(&buf)
+		if empty {
+			cw.Write(csvColumns)
+		}
+		for _, r := range results {
+			cw.Write(csvRow(r))
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+		_, err := f.Write(buf.Bytes())
+		return err
+	})
+}
+
+// csvRow flattens a result in csvColumns order
+func csvRow(r *BenchmarkResult) []string {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+	i := func(v int64) string { return strconv.FormatInt(v, 10) }
+	u := func(v uint64) string { return strconv.FormatUint(v, 10) }
+	row := []string{
+		r.Name, r.Language, r.ProgramType, r.DataMechanism, r.ReaderStrategy, r.Payload, r.PageCache, r.DropPolicy,
+		r.Host.KernelRelease, r.StartTime.Format(time.RFC3339Nano), r.EndTime.Format(time.RFC3339Nano),
+		f(r.Duration), i(r.EventCount), i(r.DroppedEvents), f(r.DropRate), f(r.Throughput),
+		f(r.CPUUsage), f(r.CPUBudget.UserTimeUs), f(r.CPUBudget.SystemTimeUs), f(r.CPUBudget.CPUPerEventUs),
+		u(r.MemoryUsage), f(r.OverheadNs),
+		i(r.Latency.Samples), u(r.Latency.MinNs), u(r.Latency.MaxNs), f(r.Latency.AvgNs), f(r.Latency.StdDevNs),
+		f(r.Latency.VarianceNs2), f(r.Latency.JitterNs),
+	}
+	for _, q := range csvQuantiles {
+		v, ok := r.Latency.Percentile(q)
+		if ok {
+			row = append(row, u(v))
+		} else {
+			row = append(row, "")
+		}
+	}
+	return append(row, strings.Join(r.Quality.Flags, ";"), strings.Join(r.Errors, "; "))
+}
+
+// appendToFile opens filename for reading and appending, creating it if
+// needed, and passes write whether it was empty. Writers append each
+// batch with a single write, so concurrent runs sharing a file do not
+// interleave lines.
+func appendToFile(filename string, write func(f *os.File, empty bool) error) error {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open result file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat result file: %w", err)
+	}
+	if err := write(f, info.Size() == 0); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write result file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close result file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/bits"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Mechanisms the consumer scaling benchmark compares
+const (
+	consumersRingbuf = "ringbuf"
+	consumersPerfbuf = "perfbuf"
+)
+
+var allConsumerMechanisms = []string{consumersRingbuf, consumersPerfbuf}
+
+// ConsumerStats are one consumer's share of a run
+type ConsumerStats struct {
+	Consumer   int
+	Rings      int `json:",omitempty"` // Per-CPU rings it reads; perfbuf only
+	EventCount int64
+	Share      float64 // Of the run's measured events
+	Throughput float64
+	Batches    int64   // Polls that returned records
+	EmptyPolls int64   // Polls that found nothing to read
+	LockWaitUs float64 `json:",omitempty"` // Waiting for the shared consumer position; ringbuf only
+}
+
+// ScalingStats describe how a run's throughput compares with the
+// same mechanism's run with the fewest consumers in the sweep
+type ScalingStats struct {
+	Consumers   int
+	Baseline    int     // Consumer count the speedup is relative to
+	Speedup     float64 // Throughput over the baseline's
+	Efficiency  float64 // Speedup over the added consumer factor; 1 is linear scaling
+	Skew        float64 // Busiest consumer's events over the per-consumer mean; 1 is even
+	PerConsumer []ConsumerStats
+}
+
+// ConsumerScalingBenchmark measures how consumer throughput scales with
+// the number of readers. Producers emit flat out and every consumer spends
+// -handle on each event, as a decoder or exporter would, so the consumers
+// are the bottleneck. The ring buffer has one consumer position, so its
+// readers take turns claiming batches from the shared ring; a perf buffer
+// has a ring per CPU, split between its epoll readers.
+type ConsumerScalingBenchmark struct {
+	duration   time.Duration
+	mechanisms []string
+	consumers  []int // Consumer counts swept, one result each per mechanism
+	producers  int
+	ringSize   int // Records per per-CPU ring; the shared ring holds as many as the whole array
+	batch      int
+	handle     time.Duration
+	maxSamples int
+	stallAfter time.Duration
+	verbose    bool
+}
+
+// consumerState is one consumer's counters while it runs
+type consumerState struct {
+	rings      []*mpscRing
+	consumed   int64
+	postWindow int64 // Read after the window closed, uncounted
+	batches    int64
+	empty      int64
+	lockWait   time.Duration
+	samples    []uint64
+}
+
+// spinFor busies the calling goroutine for d, standing in for the work a
+// consumer does per event
+func spinFor(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	end := nowNs() + uint64(d)
+	for nowNs() < end {
+	}
+}
+
+// runOne measures n consumers of one mechanism
+func (b *ConsumerScalingBenchmark) runOne(ctx context.Context, mechanism string, n int) (*BenchmarkResult, error) {
+	var rings []*mpscRing
+	r := &BenchmarkResult{
+		Name:           "Ring Buffer Consumer Scaling",
+		Language:       "Go",
+		ProgramType:    "tracepoint",
+		DataMechanism:  "ring_buffer",
+		ReaderStrategy: fmt.Sprintf("%s/polling/consumers=%d", probeBackendSim, n),
+		Host:           CollectHostInfo(),
+		Errors:         []string{"no BPF backend: " + mechanism + " producers and consumers simulated in userspace"},
+	}
+	states := make([]consumerState, n)
+	switch mechanism {
+	case consumersRingbuf:
+		ring := newMPSCRing(1 << bits.Len(uint(b.ringSize*b.producers-1)))
+		rings = []*mpscRing{ring}
+		for i := range states {
+			states[i].rings = rings
+		}
+	case consumersPerfbuf:
+		r.DataMechanism = "perf_buffer"
+		r.ReaderStrategy = fmt.Sprintf("%s/epoll/consumers=%d", probeBackendSim, n)
+		for i := 0; i < b.producers; i++ {
+			ring := newMPSCRing(b.ringSize)
+			rings = append(rings, ring)
+			states[i%n].rings = append(states[i%n].rings, ring)
+		}
+	}
+	benchLog(ctx).Info("Running", "mechanism", mechanism, "consumers", n, "producers", b.producers, "duration", b.duration)
+
+	var stop, producersDone atomic.Bool
+	var produced atomic.Int64
+	var position sync.Mutex // The ring buffer's single consumer position
+	shared := mechanism == consumersRingbuf
+	pid := uint32(os.Getpid())
+	perConsumer := max(b.maxSamples/n, 1)
+
+	queryable := make([]queryableRing, len(rings))
+	for i, ring := range rings {
+		queryable[i] = ring
+	}
+	monitor := startStallMonitor(ctx, queryable, b.stallAfter)
+
+	startUsage, _ := TakeResourceSnapshot()
+	r.StartTime = time.Now()
+
+	var producerWG, consumerWG sync.WaitGroup
+	for cpu := 0; cpu < b.producers; cpu++ {
+		producerWG.Add(1)
+		go func(cpu int) {
+			defer producerWG.Done()
+			ring := rings[cpu%len(rings)]
+			var n int64
+			for i := uint32(0); !stop.Load(); i++ {
+				pos, ok := ring.reserve()
+				if !ok {
+					runtime.Gosched()
+					continue
+				}
+				ring.submit(pos, Event{
+					Timestamp: uint64(time.Now().UnixNano()),
+					PID:       pid,
+					CPU:       uint32(cpu),
+					EventType: eventTypeTracepoint,
+					Data:      i,
+				})
+				n++
+			}
+			produced.Add(n)
+		}(cpu)
+	}
+	for i := range states {
+		consumerWG.Add(1)
+		go func(st *consumerState) {
+			defer consumerWG.Done()
+			st.samples = make([]uint64, 0, min(perConsumer, 1024))
+			batch := make([]Event, b.batch)
+			poll := func(ring *mpscRing) int {
+				if !shared {
+					return ring.consumeBatch(batch)
+				}
+				if !position.TryLock() {
+					t0 := time.Now()
+					position.Lock()
+					st.lockWait += time.Since(t0)
+				}
+				defer position.Unlock()
+				return ring.consumeBatch(batch)
+			}
+			for {
+				done := producersDone.Load()
+				read := 0
+				for _, ring := range st.rings {
+					got := poll(ring)
+					if got == 0 {
+						continue
+					}
+					read += got
+					if stop.Load() {
+						st.postWindow += int64(got)
+						continue
+					}
+					st.batches++
+					for _, e := range batch[:got] {
+						now := uint64(time.Now().UnixNano())
+						if now >= e.Timestamp && len(st.samples) < perConsumer {
+							st.samples = append(st.samples, now-e.Timestamp)
+						}
+						spinFor(b.handle)
+						st.consumed++
+					}
+				}
+				if read > 0 {
+					continue
+				}
+				if done {
+					return
+				}
+				if !stop.Load() {
+					st.empty++
+				}
+				runtime.Gosched()
+			}
+		}(&states[i])
+	}
+
+	timer := time.NewTimer(b.duration)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+		r.Quality.Flag(QualityInterrupted)
+	}
+	stop.Store(true)
+	r.EndTime = time.Now()
+	endUsage, _ := TakeResourceSnapshot()
+	producerWG.Wait()
+	producersDone.Store(true)
+	consumerWG.Wait()
+	drainTime := time.Since(r.EndTime)
+	r.Stalls = monitor.stop()
+
+	wall := r.EndTime.Sub(r.StartTime)
+	var consumed, postWindow, failed, contended int64
+	var samples []uint64
+	for i := range states {
+		consumed += states[i].consumed
+		postWindow += states[i].postWindow
+		samples = append(samples, states[i].samples...)
+	}
+	for _, ring := range rings {
+		failed += ring.reserveFailed
+		contended += ring.contended
+	}
+	r.Duration = wall.Seconds()
+	r.EventCount = consumed
+	r.RecordDrops(DropCounts{ReserveFailed: failed})
+	r.recordTeardown(produced.Load()+failed, postWindow, drainTime)
+	if r.Duration > 0 {
+		r.Throughput = float64(consumed) / r.Duration
+	}
+	r.Latency = computeLatencyStats(samples, DefaultQuantiles)
+	r.CPUBudget = NewCPUBudget(startUsage, endUsage, consumed)
+	r.CPUUsage = r.CPUBudget.CPUPercent(wall)
+	for _, ring := range rings {
+		r.MemoryUsage += uint64(len(ring.records)) * uint64(unsafe.Sizeof(Event{}))
+	}
+	r.Operations = []OperationResult{
+		NewOperationResult("reserve", produced.Load()+failed, wall),
+		NewOperationResult("contended_reserve", contended, wall),
+	}
+	r.Consumers = consumerScaling(states, consumed, wall, shared)
+	return r, nil
+}
+
+// consumerScaling builds the per-consumer breakdown of a run. Speedup and
+// efficiency are filled in once the sweep has its baseline.
+func consumerScaling(states []consumerState, consumed int64, wall time.Duration, shared bool) *ScalingStats {
+	s := &ScalingStats{Consumers: len(states)}
+	var busiest int64
+	for i, st := range states {
+		c := ConsumerStats{
+			Consumer:   i,
+			EventCount: st.consumed,
+			Batches:    st.batches,
+			EmptyPolls: st.empty,
+		}
+		if !shared {
+			c.Rings = len(st.rings)
+		}
+		if consumed > 0 {
+			c.Share = float64(st.consumed) / float64(consumed)
+		}
+		if wall > 0 {
+			c.Throughput = float64(st.consumed) / wall.Seconds()
+		}
+		c.LockWaitUs = float64(st.lockWait) / float64(time.Microsecond)
+		busiest = max(busiest, st.consumed)
+		s.PerConsumer = append(s.PerConsumer, c)
+	}
+	if consumed > 0 {
+		s.Skew = float64(busiest) / (float64(consumed) / float64(len(states)))
+	}
+	return s
+}
+
+// Run measures every consumer count of every mechanism in turn, and
+// relates each run to its mechanism's run with the fewest consumers
+func (b *ConsumerScalingBenchmark) Run(ctx context.Context) ([]*BenchmarkResult, error) {
+	if b.verbose {
+		PrintBenchmarkHeader("Ring Buffer Consumer Scaling Benchmark (Go)")
+	}
+	var results []*BenchmarkResult
+	for _, mechanism := range b.mechanisms {
+		var base *BenchmarkResult
+		for _, n := range b.consumers {
+			if ctx.Err() != nil {
+				return results, nil
+			}
+			r, err := b.runOne(ctx, mechanism, n)
+			if err != nil {
+				return nil, err
+			}
+			if base == nil || n < base.Consumers.Consumers {
+				base = r
+			}
+			results = append(results, r)
+		}
+		for _, r := range results {
+			if r.DataMechanism != base.DataMechanism || base.Throughput <= 0 {
+				continue
+			}
+			s := r.Consumers
+			s.Baseline = base.Consumers.Consumers
+			s.Speedup = r.Throughput / base.Throughput
+			s.Efficiency = s.Speedup / (float64(s.Consumers) / float64(s.Baseline))
+		}
+	}
+	return results, nil
+}
+
+// formatConsumers renders the per-consumer breakdown and scaling, if any
+func (r *BenchmarkResult) formatConsumers() string {
+	s := r.Consumers
+	if s == nil {
+		return ""
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Consumers:       %d, %.2fx the throughput of %d (%.0f%% efficient), skew %.2f\n",
+		s.Consumers, s.Speedup, s.Baseline, s.Efficiency*100, s.Skew)
+	for _, c := range s.PerConsumer {
+		fmt.Fprintf(&sb, "  consumer%-3d %10d events (%5.1f%%)  %12.0f events/sec  %d batches, %d empty polls",
+			c.Consumer, c.EventCount, c.Share*100, c.Throughput, c.Batches, c.EmptyPolls)
+		if c.Rings > 0 {
+			fmt.Fprintf(&sb, ", %d rings", c.Rings)
+		}
+		if c.LockWaitUs > 0 {
+			fmt.Fprintf(&sb, ", %.0f µs waiting for the consumer position", c.LockWaitUs)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// runConsumerScalingBenchmark is the entry point of the ringbuf-consumers subcommand
+func runConsumerScalingBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("ringbuf-consumers", flag.ExitOnError)
+	common := addBenchFlags(fs, "ringbuf_consumers_result.json", true)
+	consumers := fs.String("consumers", defaultProducerSweep(), "Comma-separated consumer counts to sweep")
+	mechanisms := fs.String("mechanisms", strings.Join(allConsumerMechanisms, ","), "Comma-separated mechanisms (ringbuf: readers share one ring; perfbuf: per-CPU rings split between epoll readers)")
+	producers := fs.Int("producers", max(runtime.NumCPU(), 2), "Producer CPUs, one goroutine each")
+	ringSize := fs.Int("ring", 4096, "Records per per-CPU ring (power of two); the shared ring holds as many as the whole array")
+	batch := fs.Int("batch", 64, "Records a consumer claims per poll")
+	handle := fs.Duration("handle", time.Microsecond, "Work a consumer spends on each event")
+	stallAfter := addStallFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+	if *producers <= 0 {
+		return nil, opts, fmt.Errorf("-producers must be positive")
+	}
+	if *ringSize <= 0 || *ringSize&(*ringSize-1) != 0 {
+		return nil, opts, fmt.Errorf("-ring must be a power of two")
+	}
+	if *batch <= 0 {
+		return nil, opts, fmt.Errorf("-batch must be positive")
+	}
+	if *handle < 0 {
+		return nil, opts, fmt.Errorf("-handle must not be negative")
+	}
+	for _, m := range splitList(*mechanisms) {
+		if !containsString(allConsumerMechanisms, m) {
+			return nil, opts, fmt.Errorf("unknown mechanism %q (want ringbuf or perfbuf)", m)
+		}
+	}
+	var counts []int
+	for _, s := range splitList(*consumers) {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return nil, opts, fmt.Errorf("invalid consumer count %q", s)
+		}
+		// A perf ring has one reader, so further readers would sit idle
+		if n > *producers && containsString(splitList(*mechanisms), consumersPerfbuf) {
+			return nil, opts, fmt.Errorf("perfbuf has one ring per producer: %d consumers need at least as many -producers", n)
+		}
+		counts = append(counts, n)
+	}
+	if len(counts) == 0 {
+		return nil, opts, fmt.Errorf("-consumers must list at least one count")
+	}
+
+	bench := &ConsumerScalingBenchmark{
+		duration:   opts.Duration,
+		mechanisms: splitList(*mechanisms),
+		consumers:  counts,
+		producers:  *producers,
+		ringSize:   *ringSize,
+		batch:      *batch,
+		handle:     *handle,
+		maxSamples: 100000,
+		stallAfter: *stallAfter,
+		verbose:    opts.Verbose,
+	}
+	results, err := bench.Run(ctx)
+	if err != nil {
+		return nil, opts, err
+	}
+	return results, opts, nil
+}
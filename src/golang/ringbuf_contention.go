@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// pinThread binds the calling goroutine's thread to cpu. The caller must
+// hold runtime.LockOSThread.
+func pinThread(cpu int) error {
+	return setThreadAffinity([]int{cpu})
+}
+
+// setThreadAffinity lets the calling goroutine's thread run on cpus only.
+// The caller must hold runtime.LockOSThread.
+func setThreadAffinity(cpus []int) error {
+	var mask [16]uint64 // cpu_set_t of 1024 CPUs
+	for _, cpu := range cpus {
+		if cpu < 0 || cpu >= len(mask)*64 {
+			return fmt.Errorf("cpu %d out of range", cpu)
+		}
+		mask[cpu/64] |= 1 << (cpu % 64)
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// producerStats are one producer CPU's counters
+type producerStats struct {
+	cpu       int
+	attempts  int64
+	failed    int64
+	emitted   int64
+	samples   []uint64
+	pinnedErr error
+}
+
+// ContentionBenchmark characterizes the producer side of a shared ring
+// buffer: every producer emits flat out, as a program attached to an
+// event source firing on all CPUs at once would, and each reservation
+// that finds the ring full is a lost event. Emit latency, the time of one
+// bpf_ringbuf_reserve plus bpf_ringbuf_submit, is kept per producer CPU,
+// so the CPUs breakdown of each result shows how it grows with the
+// number of producers.
+type ContentionBenchmark struct {
+	duration   time.Duration
+	producers  []int // Producer counts swept, one result each
+	ringSize   int
+	maxSamples int
+	stallAfter time.Duration
+	verbose    bool
+}
+
+// runOne measures n concurrent producers
+func (b *ContentionBenchmark) runOne(ctx context.Context, n int, cpus []int) (*BenchmarkResult, error) {
+	ring := newMPSCRing(b.ringSize)
+	r := &BenchmarkResult{
+		Name:           "Ring Buffer Producer Contention",
+		Language:       "Go",
+		ProgramType:    "tracepoint",
+		DataMechanism:  "ring_buffer",
+		ReaderStrategy: fmt.Sprintf("%s/producers=%d", probeBackendSim, n),
+		Host:           CollectHostInfo(),
+		// The producers are pinned threads reserving on an in-process ring
+		// with the kernel's protocol, not programs on each CPU
+		Errors: []string{"no BPF backend: ring buffer reservations simulated in userspace"},
+	}
+	benchLog(ctx).Info("Running producers", "producers", n, "duration", b.duration)
+
+	var stop, producersDone atomic.Bool
+	var consumed int64
+	pid := uint32(os.Getpid())
+	stats := make([]producerStats, n)
+	perProducer := max(b.maxSamples/n, 1)
+
+	monitor := startStallMonitor(ctx, []queryableRing{ring}, b.stallAfter)
+	startUsage, _ := TakeResourceSnapshot()
+	r.StartTime = time.Now()
+
+	var producerWG, readerWG sync.WaitGroup
+	readerWG.Add(1)
+	go func() {
+		defer readerWG.Done()
+		deliver := func(Event) { consumed++ }
+		for {
+			done := producersDone.Load()
+			if ring.consume(deliver) > 0 {
+				continue
+			}
+			if done {
+				return
+			}
+			runtime.Gosched()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		stats[i].cpu = cpus[i%len(cpus)]
+		producerWG.Add(1)
+		go func(st *producerStats) {
+			defer producerWG.Done()
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			st.pinnedErr = pinThread(st.cpu)
+			st.samples = make([]uint64, 0, min(perProducer, 1024))
+			for seq := uint32(0); !stop.Load(); seq++ {
+				t0 := time.Now()
+				pos, ok := ring.reserve()
+				if ok {
+					ring.submit(pos, Event{
+						Timestamp: uint64(t0.UnixNano()),
+						PID:       pid,
+						CPU:       uint32(st.cpu),
+						EventType: eventTypeTracepoint,
+						Data:      seq,
+					})
+				}
+				emit := uint64(time.Since(t0).Nanoseconds())
+				st.attempts++
+				if !ok {
+					st.failed++
+					continue
+				}
+				st.emitted++
+				if len(st.samples) < perProducer {
+					st.samples = append(st.samples, emit)
+				}
+			}
+		}(&stats[i])
+	}
+
+	timer := time.NewTimer(b.duration)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+		r.Quality.Flag(QualityInterrupted)
+	}
+	stop.Store(true)
+	producerWG.Wait()
+	producersDone.Store(true)
+	readerWG.Wait()
+	r.EndTime = time.Now()
+	endUsage, _ := TakeResourceSnapshot()
+	r.Stalls = monitor.stop()
+
+	wall := r.EndTime.Sub(r.StartTime)
+	r.Duration = wall.Seconds()
+	var attempts, failed, emitted int64
+	var samples []uint64
+	for i := range stats {
+		st := &stats[i]
+		attempts += st.attempts
+		failed += st.failed
+		emitted += st.emitted
+		samples = append(samples, st.samples...)
+		if st.pinnedErr != nil {
+			r.Errors = append(r.Errors, fmt.Sprintf("pinning producer to cpu%d: %v", st.cpu, st.pinnedErr))
+		}
+	}
+	r.EventCount = consumed
+	r.RecordDrops(DropCounts{ReserveFailed: failed})
+	if r.Duration > 0 {
+		r.Throughput = float64(consumed) / r.Duration
+	}
+	r.Latency = computeLatencyStats(samples, DefaultQuantiles)
+	r.CPUBudget = NewCPUBudget(startUsage, endUsage, consumed)
+	r.CPUUsage = r.CPUBudget.CPUPercent(wall)
+	r.MemoryUsage = uint64(len(ring.records)) * uint64(unsafe.Sizeof(Event{}))
+	r.Operations = []OperationResult{
+		NewOperationResult("reserve", attempts, wall),
+		NewOperationResult("reserve_failed", failed, wall),
+		NewOperationResult("contended_reserve", ring.contended, wall),
+	}
+	r.recordProducerCPUs(stats, wall)
+	if consumed != emitted {
+		r.Errors = append(r.Errors, fmt.Sprintf("emitted %d events but consumed %d", emitted, consumed))
+	}
+	return r, nil
+}
+
+// recordProducerCPUs stores the per-CPU emit counts and latencies. Several
+// producers pinned to the same CPU are merged.
+func (r *BenchmarkResult) recordProducerCPUs(stats []producerStats, wall time.Duration) {
+	byCPU := make(map[int][]*producerStats)
+	for i := range stats {
+		byCPU[stats[i].cpu] = append(byCPU[stats[i].cpu], &stats[i])
+	}
+	cpus := make([]int, 0, len(byCPU))
+	for cpu := range byCPU {
+		cpus = append(cpus, cpu)
+	}
+	sort.Ints(cpus)
+
+	var total int64
+	for i := range stats {
+		total += stats[i].emitted
+	}
+	for _, cpu := range cpus {
+		s := CPUStats{CPU: uint32(cpu)}
+		var samples []uint64
+		for _, st := range byCPU[cpu] {
+			s.EventCount += st.emitted
+			samples = append(samples, st.samples...)
+		}
+		if total > 0 {
+			s.Share = float64(s.EventCount) / float64(total)
+		}
+		if wall > 0 {
+			s.Throughput = float64(s.EventCount) / wall.Seconds()
+		}
+		s.Latency = computeLatencyStats(samples, DefaultQuantiles)
+		r.CPUs = append(r.CPUs, s)
+	}
+	r.CPUSkew = cpuSkew(r.CPUs)
+}
+
+// Run measures every producer count in turn
+func (b *ContentionBenchmark) Run(ctx context.Context) ([]*BenchmarkResult, error) {
+	if b.verbose {
+		PrintBenchmarkHeader("Ring Buffer Producer Contention Benchmark (Go)")
+	}
+	cpus := readAllowedCPUs()
+	if len(cpus) == 0 {
+		for i := 0; i < runtime.NumCPU(); i++ {
+			cpus = append(cpus, i)
+		}
+	}
+	var results []*BenchmarkResult
+	for _, n := range b.producers {
+		if ctx.Err() != nil {
+			break
+		}
+		r, err := b.runOne(ctx, n, cpus)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// defaultProducerSweep doubles the producer count up to the number of
+// CPUs, ending with every CPU, and always includes two producers
+func defaultProducerSweep() string {
+	n := max(runtime.NumCPU(), 2)
+	var counts []string
+	for c := 1; c < n; c *= 2 {
+		counts = append(counts, strconv.Itoa(c))
+	}
+	counts = append(counts, strconv.Itoa(n))
+	return strings.Join(counts, ",")
+}
+
+// runContentionBenchmark is the entry point of the ringbuf-contention subcommand
+func runContentionBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("ringbuf-contention", flag.ExitOnError)
+	common := addBenchFlags(fs, "ringbuf_contention_result.json", true)
+	producers := fs.String("producers", defaultProducerSweep(), "Comma-separated producer counts to sweep; producers are pinned round-robin to the allowed CPUs")
+	ringSize := fs.Int("ring", 4096, "Records in the shared ring (power of two)")
+	stallAfter := addStallFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+	if *ringSize <= 0 || *ringSize&(*ringSize-1) != 0 {
+		return nil, opts, fmt.Errorf("-ring must be a power of two")
+	}
+	var counts []int
+	for _, s := range splitList(*producers) {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return nil, opts, fmt.Errorf("invalid producer count %q", s)
+		}
+		counts = append(counts, n)
+	}
+	if len(counts) == 0 {
+		return nil, opts, fmt.Errorf("-producers must list at least one count")
+	}
+
+	bench := &ContentionBenchmark{
+		duration:   opts.Duration,
+		producers:  counts,
+		ringSize:   *ringSize,
+		maxSamples: 100000,
+		stallAfter: *stallAfter,
+		verbose:    opts.Verbose,
+	}
+	results, err := bench.Run(ctx)
+	if err != nil {
+		return nil, opts, err
+	}
+	return results, opts, nil
+}
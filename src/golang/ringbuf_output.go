@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Ring buffer emit APIs compared by the ringbuf-output benchmark
+const (
+	apiReserve = "reserve" // bpf_ringbuf_reserve, fill the record in place, bpf_ringbuf_submit
+	apiOutput  = "output"  // Fill the record on the stack, bpf_ringbuf_output copies it in
+)
+
+var allEmitAPIs = []string{apiReserve, apiOutput}
+
+// OutputPairStats describe one emit API of a ringbuf-output run and how
+// it fared against the other API, measured beside it under the same load
+type OutputPairStats struct {
+	API             string
+	RecordBytes     int
+	ProducerNs      float64 // Producer time per emit attempt, failed ones included
+	CopiedBytes     int64   // Bytes copied from the stack into the ring; output only
+	Versus          string  // The other API; empty when it was not run
+	ThroughputRatio float64 // This API's throughput over the other's
+	DropRateDelta   float64 // This API's drop rate minus the other's, in percentage points
+}
+
+// payloadRing is an mpscRing whose records carry size bytes each, as the
+// records of a BPF ring buffer do, written in place or copied in
+type payloadRing struct {
+	*mpscRing
+	data []byte
+	size int
+}
+
+// record returns the bytes of the record at pos
+func (r *payloadRing) record(pos uint64) []byte {
+	i := int(pos&r.mask) * r.size
+	return r.data[i : i+r.size : i+r.size]
+}
+
+// fillRecord writes the record of the nth emit, as the program fills the
+// fields of its event
+func fillRecord(buf []byte, n int64) {
+	for i := range buf {
+		buf[i] = byte(n) + byte(i)
+	}
+}
+
+// OutputBenchmark compares the two ways a program emits a record into a
+// ring buffer: reserving space and filling it in place, and filling the
+// record on the stack and handing it to bpf_ringbuf_output, which
+// reserves, copies and commits. The programs are otherwise identical, as
+// tracepoint_openat and tracepoint_openat_output in ringbuf_throughput.c
+// are, and run one after the other under the same load, so the paired
+// results show what the copy costs in throughput and drops. Both variants
+// are loaded with bpf(2) and fired by the producers' getpid(2) calls; the
+// simulation emits on an MPSC ring of the same layout, and its results
+// say so.
+type OutputBenchmark struct {
+	duration   time.Duration
+	backend    string // auto, bpf or sim
+	apis       []string
+	producers  int
+	rate       int // Emits per second over all producers; 0 runs flat out
+	size       int // Record size in bytes
+	ringSize   int
+	stallAfter time.Duration
+	verbose    bool
+}
+
+// outputProducer is one producer CPU's counters
+type outputProducer struct {
+	stack                   []byte // The record as built on the stack; output only
+	attempts, emitted, lost int64
+	copied                  int64
+}
+
+// runOne measures one API with the selected backend. auto falls back to
+// the simulation when the program cannot be loaded or attached.
+func (b *OutputBenchmark) runOne(ctx context.Context, api string) (*BenchmarkResult, error) {
+	switch b.backend {
+	case probeBackendSim:
+		return b.runSim(ctx, api)
+	case probeBackendBPF, probeBackendAuto:
+		prog, err := openBPFRingProgram(ringProgOptions{api: api, recordSize: b.size, ringBytes: ringBytesFor(b.ringSize, b.size)})
+		if err == nil {
+			defer prog.Close()
+			return b.runBPF(ctx, api, prog)
+		}
+		if b.backend == probeBackendBPF {
+			return nil, err
+		}
+		return b.runSim(ctx, api)
+	}
+	return nil, fmt.Errorf("unknown backend %q (want auto, bpf or sim)", b.backend)
+}
+
+// runBPF measures one API with its variant loaded: every producer's
+// getpid(2) runs the program once, and the consumer drains the ring buffer
+// map through its mapped pages. The program counts what the ring had no
+// room for.
+func (b *OutputBenchmark) runBPF(ctx context.Context, api string, prog *bpfRingProgram) (*BenchmarkResult, error) {
+	r := &BenchmarkResult{
+		Name:           "Ring Buffer Reserve vs Output",
+		Language:       "Go",
+		ProgramType:    "raw_tracepoint",
+		Tracepoint:     callTracepoint,
+		DataMechanism:  "ring_buffer",
+		ReaderStrategy: fmt.Sprintf("%s/%s/producers=%d/size=%d", probeBackendBPF, api, b.producers, b.size),
+		Host:           CollectHostInfo(),
+		Errors:         []string{},
+	}
+	benchLog(ctx).Info("Running", "api", api, "producers", b.producers, "size", b.size, "duration", b.duration)
+
+	var stop, producersDone atomic.Bool
+	var consumed int64
+	consumer := startRingConsumer(prog.ring, &stop, &producersDone, func([]byte) { consumed++ })
+	monitor := startStallMonitor(ctx, []queryableRing{prog.ring}, b.stallAfter)
+
+	emitted0, lost0 := prog.count(prog.slot), prog.count(ringCountFull)
+	startUsage, _ := TakeResourceSnapshot()
+	r.StartTime = time.Now()
+
+	attempts := make([]int64, b.producers)
+	var programTime atomic.Int64
+	var wg sync.WaitGroup
+	for cpu := range attempts {
+		wg.Add(1)
+		go func(n *int64) {
+			defer wg.Done()
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			programTime.Add(int64(runPaced(&stop, float64(b.rate)/float64(b.producers), func(int64) {
+				prog.trigger()
+				*n++
+			})))
+		}(&attempts[cpu])
+	}
+
+	timer := time.NewTimer(b.duration)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+		r.Quality.Flag(QualityInterrupted)
+	}
+	stop.Store(true)
+	r.EndTime = time.Now()
+	endUsage, _ := TakeResourceSnapshot()
+	wg.Wait()
+	emitted, lost := prog.count(prog.slot)-emitted0, prog.count(ringCountFull)-lost0
+	producersDone.Store(true)
+	consumer.wait()
+	drainTime := time.Since(r.EndTime)
+	r.Stalls = monitor.stop()
+
+	s := &OutputPairStats{API: api, RecordBytes: b.size}
+	var total int64
+	for _, n := range attempts {
+		total += n
+	}
+	if total > 0 {
+		// The getpid(2) that fires the program is included, the same for
+		// both variants
+		s.ProducerNs = float64(programTime.Load()) / float64(total)
+	}
+	if api == apiOutput {
+		s.CopiedBytes = emitted * int64(b.size)
+	}
+
+	wall := r.EndTime.Sub(r.StartTime)
+	r.Duration = wall.Seconds()
+	r.EventCount = consumed
+	r.RecordDrops(DropCounts{ReserveFailed: lost})
+	// The program's count is what is accounted for: the runtime calls
+	// getpid(2) too, when it preempts a goroutine
+	r.recordTeardown(emitted+lost, consumer.postWindow, drainTime)
+	if r.Duration > 0 {
+		r.Throughput = float64(consumed) / r.Duration
+	}
+	r.CPUBudget = NewCPUBudget(startUsage, endUsage, consumed)
+	r.CPUUsage = r.CPUBudget.CPUPercent(wall)
+	r.MemoryUsage = prog.ring.size
+	r.OutputPair = s
+	r.Operations = []OperationResult{
+		NewOperationResult("emit", emitted+lost, wall),
+		NewOperationResult("submit", emitted, wall),
+	}
+	return r, nil
+}
+
+// runSim measures one API on the simulated ring
+func (b *OutputBenchmark) runSim(ctx context.Context, api string) (*BenchmarkResult, error) {
+	ring := &payloadRing{mpscRing: newMPSCRing(b.ringSize), data: make([]byte, b.ringSize*b.size), size: b.size}
+	r := &BenchmarkResult{
+		Name:           "Ring Buffer Reserve vs Output",
+		Language:       "Go",
+		ProgramType:    "tracepoint",
+		DataMechanism:  "ring_buffer",
+		ReaderStrategy: fmt.Sprintf("%s/%s/producers=%d/size=%d", probeBackendSim, api, b.producers, b.size),
+		Host:           CollectHostInfo(),
+		// getpid_reserve and getpid_output are not loaded; their emit
+		// paths are modelled on an in-process ring
+		Errors: []string{"BPF ring buffer programs not loaded: " + api + " emit simulated in userspace"},
+	}
+	benchLog(ctx).Info("Running", "api", api, "producers", b.producers, "size", b.size, "duration", b.duration)
+
+	var stop, producersDone atomic.Bool
+	var consumed int64
+	consumer := startThreadConsumer(ring.mpscRing, &stop, &producersDone, func(Event) { consumed++ }, nil)
+	monitor := startStallMonitor(ctx, []queryableRing{ring}, b.stallAfter)
+
+	startUsage, _ := TakeResourceSnapshot()
+	r.StartTime = time.Now()
+
+	pid := uint32(os.Getpid())
+	producers := make([]*outputProducer, b.producers)
+	var programTime atomic.Int64
+	var wg sync.WaitGroup
+	for cpu := range producers {
+		p := &outputProducer{stack: make([]byte, b.size)}
+		producers[cpu] = p
+		emit := func(n int64) {
+			p.attempts++
+			e := Event{Timestamp: uint64(time.Now().UnixNano()), PID: pid, CPU: uint32(cpu), EventType: eventTypeTracepoint, Data: uint32(n)}
+			if api == apiOutput {
+				// The record is built whether or not the ring has room
+				fillRecord(p.stack, n)
+			}
+			pos, ok := ring.reserve()
+			if !ok {
+				p.lost++
+				return
+			}
+			if api == apiOutput {
+				p.copied += int64(copy(ring.record(pos), p.stack))
+			} else {
+				fillRecord(ring.record(pos), n)
+			}
+			ring.submit(pos, e)
+			p.emitted++
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			programTime.Add(int64(runPaced(&stop, float64(b.rate)/float64(b.producers), emit)))
+		}()
+	}
+
+	timer := time.NewTimer(b.duration)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+		r.Quality.Flag(QualityInterrupted)
+	}
+	stop.Store(true)
+	r.EndTime = time.Now()
+	endUsage, _ := TakeResourceSnapshot()
+	wg.Wait()
+	producersDone.Store(true)
+	consumer.wait()
+	drainTime := time.Since(r.EndTime)
+	r.Stalls = monitor.stop()
+
+	s := &OutputPairStats{API: api, RecordBytes: b.size}
+	var attempts, emitted, lost int64
+	for _, p := range producers {
+		attempts += p.attempts
+		emitted += p.emitted
+		lost += p.lost
+		s.CopiedBytes += p.copied
+	}
+	if attempts > 0 {
+		s.ProducerNs = float64(programTime.Load()) / float64(attempts)
+	}
+
+	wall := r.EndTime.Sub(r.StartTime)
+	r.Duration = wall.Seconds()
+	r.EventCount = consumed
+	r.RecordDrops(DropCounts{ReserveFailed: lost})
+	r.recordTeardown(attempts, consumer.postWindow, drainTime)
+	if r.Duration > 0 {
+		r.Throughput = float64(consumed) / r.Duration
+	}
+	r.CPUBudget = NewCPUBudget(startUsage, endUsage, consumed)
+	r.CPUUsage = r.CPUBudget.CPUPercent(wall)
+	r.MemoryUsage = uint64(len(ring.data))
+	r.OutputPair = s
+	r.Operations = []OperationResult{
+		NewOperationResult("emit", attempts, wall),
+		NewOperationResult("submit", emitted, wall),
+		NewOperationResult("contended_reserve", ring.contended, wall),
+	}
+	return r, nil
+}
+
+// Run measures every API in turn and pairs the results
+func (b *OutputBenchmark) Run(ctx context.Context) ([]*BenchmarkResult, error) {
+	if b.verbose {
+		PrintBenchmarkHeader("Ring Buffer Reserve vs Output Benchmark (Go)")
+	}
+	var results []*BenchmarkResult
+	for _, api := range b.apis {
+		if ctx.Err() != nil {
+			break
+		}
+		r, err := b.runOne(ctx, api)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	pairOutputResults(results)
+	return results, nil
+}
+
+// pairOutputResults compares each API's result with the other's
+func pairOutputResults(results []*BenchmarkResult) {
+	if len(results) != 2 {
+		return
+	}
+	for i, r := range results {
+		other := results[1-i]
+		r.OutputPair.Versus = other.OutputPair.API
+		if other.Throughput > 0 {
+			r.OutputPair.ThroughputRatio = r.Throughput / other.Throughput
+		}
+		r.OutputPair.DropRateDelta = (r.DropRate - other.DropRate) * 100
+	}
+}
+
+// formatOutputPair renders the emit API and its comparison, if any
+func (r *BenchmarkResult) formatOutputPair() string {
+	s := r.OutputPair
+	if s == nil {
+		return ""
+	}
+	out := fmt.Sprintf("Emit API:        %s, %d B records, producer %.0f ns/emit", s.API, s.RecordBytes, s.ProducerNs)
+	if s.CopiedBytes > 0 {
+		out += fmt.Sprintf(", %.1f MiB copied from the stack", float64(s.CopiedBytes)/(1<<20))
+	}
+	out += "\n"
+	if s.Versus != "" {
+		out += fmt.Sprintf("                 against %s: %.3fx throughput, drop rate %+.3f pp\n", s.Versus, s.ThroughputRatio, s.DropRateDelta)
+	}
+	return out
+}
+
+// runOutputBenchmark is the entry point of the ringbuf-output subcommand
+func runOutputBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("ringbuf-output", flag.ExitOnError)
+	common := addBenchFlags(fs, "ringbuf_output_result.json", true)
+	apis := fs.String("apis", strings.Join(allEmitAPIs, ","), "Comma-separated emit APIs (reserve, output); both give a paired result")
+	producers := fs.Int("producers", max(runtime.NumCPU()-1, 1), "Producer CPUs, one goroutine each")
+	rate := fs.Int("rate", 0, "Emits per second over all producers (0 for flat out)")
+	size := fs.Int("size", 64, "Record size in bytes (a multiple of 8, at least the 24 of struct event; at most 256 with the program loaded)")
+	ringSize := fs.Int("ring", 4096, "Records in the ring buffer (power of two)")
+	stallAfter := addStallFlag(fs)
+	backend := fs.String("backend", probeBackendAuto, "Emit backend (auto, bpf, sim)")
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+	list := splitList(*apis)
+	for _, a := range list {
+		if !containsString(allEmitAPIs, a) {
+			return nil, opts, fmt.Errorf("unknown emit API %q (want reserve or output)", a)
+		}
+	}
+	switch {
+	case len(list) == 0:
+		return nil, opts, fmt.Errorf("-apis lists no emit APIs")
+	case *producers <= 0:
+		return nil, opts, fmt.Errorf("-producers must be positive")
+	case *rate < 0:
+		return nil, opts, fmt.Errorf("-rate must not be negative")
+	case *size < 24 || *size%8 != 0:
+		return nil, opts, fmt.Errorf("-size must be a multiple of 8 and at least 24")
+	case *ringSize <= 0 || *ringSize&(*ringSize-1) != 0:
+		return nil, opts, fmt.Errorf("-ring must be a power of two")
+	}
+
+	bench := &OutputBenchmark{
+		duration:   opts.Duration,
+		backend:    *backend,
+		apis:       list,
+		producers:  *producers,
+		rate:       *rate,
+		size:       *size,
+		ringSize:   *ringSize,
+		stallAfter: *stallAfter,
+		verbose:    opts.Verbose,
+	}
+	results, err := bench.Run(ctx)
+	if err != nil {
+		return nil, opts, err
+	}
+
+	title := fmt.Sprintf("Reserve vs output, %d producers, %d B records", *producers, *size)
+	if len(results) > 0 && strings.HasPrefix(results[0].ReaderStrategy, probeBackendSim+"/") {
+		title += " (simulated)"
+	}
+	PrintBenchmarkHeader(title)
+	fmt.Printf("%-8s %14s %10s %12s %12s %14s\n", "API", "Throughput", "Drops", "Producer", "vs other", "Drop delta")
+	for _, r := range results {
+		s := r.OutputPair
+		fmt.Printf("%-8s %10.0f ev/s %9.3f%% %9.0f ns %11.3fx %+11.3f pp\n",
+			s.API, r.Throughput, r.DropRate*100, s.ProducerNs, s.ThroughputRatio, s.DropRateDelta)
+	}
+	return results, opts, nil
+}
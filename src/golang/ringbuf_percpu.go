@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/bits"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Ring layouts compared by the ringbuf-percpu benchmark
+const (
+	layoutShared = "shared" // One BPF_MAP_TYPE_RINGBUF for every CPU
+	layoutPerCPU = "percpu" // BPF_MAP_TYPE_ARRAY_OF_MAPS of ring buffers indexed by CPU
+)
+
+var allRingLayouts = []string{layoutShared, layoutPerCPU}
+
+// mpscRing is a multi-producer ring with the reservation protocol of the
+// kernel ring buffer: producers take a lock only to advance the producer
+// position, write their record outside it and then commit it, and the
+// consumer stops at the first uncommitted record.
+type mpscRing struct {
+	mu        sync.Mutex
+	producer  atomic.Uint64 // Advanced under mu
+	_         [cacheLineSize]byte
+	consumer  atomic.Uint64
+	records   []Event
+	committed []atomic.Uint64 // Position+1 of the record in each slot once committed
+	mask      uint64
+
+	// Producer-side counters, guarded by mu
+	reserveFailed int64
+	contended     int64 // Reservations that found the lock held
+}
+
+func newMPSCRing(size int) *mpscRing {
+	return &mpscRing{
+		records:   make([]Event, size),
+		committed: make([]atomic.Uint64, size),
+		mask:      uint64(size - 1),
+	}
+}
+
+// reserve claims the next slot, like bpf_ringbuf_reserve
+func (r *mpscRing) reserve() (uint64, bool) {
+	if !r.mu.TryLock() {
+		r.mu.Lock()
+		r.contended++
+	}
+	defer r.mu.Unlock()
+	p := r.producer.Load()
+	if p-r.consumer.Load() >= uint64(len(r.records)) {
+		r.reserveFailed++
+		return 0, false
+	}
+	r.producer.Store(p + 1)
+	return p, true
+}
+
+// query reports the ring's positions, like bpf_ringbuf_query
+func (r *mpscRing) query() ringQuery {
+	c := r.consumer.Load()
+	p := r.producer.Load()
+	return ringQuery{availData: p - c, ringSize: uint64(len(r.records)), consPos: c, prodPos: p}
+}
+
+// submit writes and commits a reserved record, like bpf_ringbuf_submit
+func (r *mpscRing) submit(pos uint64, e Event) {
+	r.records[pos&r.mask] = e
+	r.committed[pos&r.mask].Store(pos + 1)
+}
+
+// consume delivers committed records in order and reports how many it read
+func (r *mpscRing) consume(deliver func(e Event)) int {
+	c := r.consumer.Load()
+	n := 0
+	for r.committed[c&r.mask].Load() == c+1 {
+		deliver(r.records[c&r.mask])
+		c++
+		n++
+	}
+	if n > 0 {
+		r.consumer.Store(c)
+	}
+	return n
+}
+
+// consumeBatch copies up to len(dst) committed records into dst, in
+// order, and reports how many it took. Readers sharing the ring must hold
+// a lock around it: there is one consumer position.
+func (r *mpscRing) consumeBatch(dst []Event) int {
+	c := r.consumer.Load()
+	n := 0
+	for n < len(dst) && r.committed[c&r.mask].Load() == c+1 {
+		dst[n] = r.records[c&r.mask]
+		c++
+		n++
+	}
+	if n > 0 {
+		r.consumer.Store(c)
+	}
+	return n
+}
+
+// PerCPURingBenchmark compares a single ring buffer shared by every
+// producer CPU with an array of per-CPU ring buffers, each drained by its
+// own reader. Producers run flat out on their own goroutines, so the
+// shared layout shows the cost of contention on the reservation lock.
+type PerCPURingBenchmark struct {
+	duration   time.Duration
+	producers  int
+	ringSize   int // Records per per-CPU ring; the shared ring matches the array's capacity
+	layouts    []string
+	maxSamples int
+	stallAfter time.Duration
+	verbose    bool
+}
+
+// readerStats are one reader's counters
+type readerStats struct {
+	consumed   int64
+	postWindow int64 // Read after the window closed, uncounted
+	samples    []uint64
+}
+
+// runOne measures one layout
+func (b *PerCPURingBenchmark) runOne(ctx context.Context, layout string) (*BenchmarkResult, error) {
+	var rings []*mpscRing
+	switch layout {
+	case layoutShared:
+		// Same total capacity as the array, rounded up to a power of two
+		rings = []*mpscRing{newMPSCRing(1 << bits.Len(uint(b.ringSize*b.producers-1)))}
+	case layoutPerCPU:
+		for i := 0; i < b.producers; i++ {
+			rings = append(rings, newMPSCRing(b.ringSize))
+		}
+	}
+
+	r := &BenchmarkResult{
+		Name:           "Ring Buffer Sharding",
+		Language:       "Go",
+		ProgramType:    "tracepoint",
+		DataMechanism:  "ring_buffer",
+		ReaderStrategy: fmt.Sprintf("%s/%s/producers=%d/readers=%d", probeBackendSim, layout, b.producers, len(rings)),
+		Host:           CollectHostInfo(),
+		// No program is loaded: both layouts are modelled on in-process
+		// rings with the kernel's reservation protocol
+		Errors: []string{"no BPF backend: " + layout + " ring buffers simulated in userspace"},
+	}
+	if layout == layoutPerCPU {
+		r.DataMechanism = "ring_buffer_array"
+	}
+	benchLog(ctx).Info("Running", "reader_strategy", r.ReaderStrategy, "duration", b.duration)
+
+	var stop, producersDone atomic.Bool
+	var produced atomic.Int64
+	pid := uint32(os.Getpid())
+	readers := make([]readerStats, len(rings))
+	perReader := b.maxSamples / len(rings)
+
+	queryable := make([]queryableRing, len(rings))
+	for i, ring := range rings {
+		queryable[i] = ring
+	}
+	monitor := startStallMonitor(ctx, queryable, b.stallAfter)
+
+	startUsage, _ := TakeResourceSnapshot()
+	r.StartTime = time.Now()
+
+	var producerWG, readerWG sync.WaitGroup
+	for cpu := 0; cpu < b.producers; cpu++ {
+		producerWG.Add(1)
+		go func(cpu int) {
+			defer producerWG.Done()
+			ring := rings[cpu%len(rings)]
+			var n int64
+			for i := uint32(0); !stop.Load(); i++ {
+				pos, ok := ring.reserve()
+				if !ok {
+					runtime.Gosched()
+					continue
+				}
+				ring.submit(pos, Event{
+					Timestamp: uint64(time.Now().UnixNano()),
+					PID:       pid,
+					CPU:       uint32(cpu),
+					EventType: eventTypeTracepoint,
+					Data:      i,
+				})
+				n++
+			}
+			produced.Add(n)
+		}(cpu)
+	}
+	for i, ring := range rings {
+		readerWG.Add(1)
+		go func(ring *mpscRing, st *readerStats) {
+			defer readerWG.Done()
+			st.samples = make([]uint64, 0, min(perReader, 1024))
+			deliver := func(e Event) {
+				now := uint64(time.Now().UnixNano())
+				if now >= e.Timestamp && len(st.samples) < perReader {
+					st.samples = append(st.samples, now-e.Timestamp)
+				}
+				st.consumed++
+			}
+			discard := func(Event) { st.postWindow++ }
+			for {
+				done := producersDone.Load()
+				read := deliver
+				if stop.Load() {
+					read = discard
+				}
+				if ring.consume(read) > 0 {
+					continue
+				}
+				if done {
+					return
+				}
+				runtime.Gosched()
+			}
+		}(ring, &readers[i])
+	}
+
+	timer := time.NewTimer(b.duration)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+		r.Quality.Flag(QualityInterrupted)
+	}
+	stop.Store(true)
+	r.EndTime = time.Now()
+	endUsage, _ := TakeResourceSnapshot()
+	producerWG.Wait()
+	producersDone.Store(true)
+	readerWG.Wait()
+	drainTime := time.Since(r.EndTime)
+	r.Stalls = monitor.stop()
+
+	wall := r.EndTime.Sub(r.StartTime)
+	var consumed, postWindow, failed, contended int64
+	var samples []uint64
+	for i, ring := range rings {
+		consumed += readers[i].consumed
+		postWindow += readers[i].postWindow
+		samples = append(samples, readers[i].samples...)
+		failed += ring.reserveFailed
+		contended += ring.contended
+	}
+	r.Duration = wall.Seconds()
+	r.EventCount = consumed
+	r.RecordDrops(DropCounts{ReserveFailed: failed})
+	r.recordTeardown(produced.Load()+failed, postWindow, drainTime)
+	if r.Duration > 0 {
+		r.Throughput = float64(consumed) / r.Duration
+	}
+	r.Latency = computeLatencyStats(samples, DefaultQuantiles)
+	r.CPUBudget = NewCPUBudget(startUsage, endUsage, consumed)
+	r.CPUUsage = r.CPUBudget.CPUPercent(wall)
+	for _, ring := range rings {
+		r.MemoryUsage += uint64(len(ring.records)) * uint64(unsafe.Sizeof(Event{}))
+	}
+	r.Operations = []OperationResult{
+		NewOperationResult("reserve", produced.Load()+failed, wall),
+		NewOperationResult("contended_reserve", contended, wall),
+	}
+	return r, nil
+}
+
+// Run measures every layout in turn
+func (b *PerCPURingBenchmark) Run(ctx context.Context) ([]*BenchmarkResult, error) {
+	if b.verbose {
+		PrintBenchmarkHeader("Per-CPU vs Shared Ring Buffer Benchmark (Go)")
+	}
+	var results []*BenchmarkResult
+	for _, layout := range b.layouts {
+		if ctx.Err() != nil {
+			break
+		}
+		r, err := b.runOne(ctx, layout)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// runPerCPURingBenchmark is the entry point of the ringbuf-percpu subcommand
+func runPerCPURingBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("ringbuf-percpu", flag.ExitOnError)
+	common := addBenchFlags(fs, "ringbuf_percpu_result.json", true)
+	layouts := fs.String("layouts", strings.Join(allRingLayouts, ","), "Comma-separated ring layouts (shared, percpu)")
+	producers := fs.Int("producers", max(runtime.NumCPU(), 2), "Producer CPUs, one goroutine each")
+	ringSize := fs.Int("ring", 4096, "Records per per-CPU ring (power of two); the shared ring holds as many as the whole array")
+	stallAfter := addStallFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+	if *producers <= 0 {
+		return nil, opts, fmt.Errorf("-producers must be positive")
+	}
+	if *ringSize <= 0 || *ringSize&(*ringSize-1) != 0 {
+		return nil, opts, fmt.Errorf("-ring must be a power of two")
+	}
+	for _, l := range splitList(*layouts) {
+		if !containsString(allRingLayouts, l) {
+			return nil, opts, fmt.Errorf("unknown layout %q (want shared or percpu)", l)
+		}
+	}
+
+	bench := &PerCPURingBenchmark{
+		duration:   opts.Duration,
+		producers:  *producers,
+		ringSize:   *ringSize,
+		layouts:    splitList(*layouts),
+		maxSamples: 100000,
+		stallAfter: *stallAfter,
+		verbose:    opts.Verbose,
+	}
+	results, err := bench.Run(ctx)
+	if err != nil {
+		return nil, opts, err
+	}
+	return results, opts, nil
+}
@@ -0,0 +1,720 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Producer notification strategies, after the flags of bpf_ringbuf_submit
+const (
+	wakeupAdaptive = "adaptive"  // Default: notify when the consumer had caught up
+	wakeupNone     = "no-wakeup" // BPF_RB_NO_WAKEUP on every record
+	wakeupForce    = "force"     // BPF_RB_FORCE_WAKEUP on every record
+	wakeupBatch    = "batch"     // BPF_RB_NO_WAKEUP except FORCE on every Nth record
+)
+
+// Consumer modes
+const (
+	consumerEpoll    = "epoll"     // Block in epoll_wait between drains, as ring_buffer__poll does
+	consumerBusyPoll = "busy-poll" // Spin on the producer position, as ring_buffer__consume in a loop does
+)
+
+var (
+	allWakeupStrategies = []string{wakeupAdaptive, wakeupNone, wakeupForce, wakeupBatch}
+	allConsumerModes    = []string{consumerEpoll, consumerBusyPoll}
+)
+
+// efdNonblock is EFD_NONBLOCK, which the syscall package does not export
+const efdNonblock = syscall.O_NONBLOCK
+
+// wakeupRing is a single-producer single-consumer ring of events with the
+// position protocol of a BPF ring buffer. Notifications go through an
+// eventfd that the consumer waits on with epoll, so wakeups cost the same
+// syscalls and context switches as a real ring buffer consumer.
+type wakeupRing struct {
+	records  []Event
+	mask     uint64
+	producer atomic.Uint64
+	_        [cacheLineSize - 8]byte
+	consumer atomic.Uint64
+	efd      int
+}
+
+func newWakeupRing(size int) (*wakeupRing, error) {
+	efd, _, errno := syscall.Syscall(syscall.SYS_EVENTFD2, 0, efdNonblock|syscall.O_CLOEXEC, 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("eventfd: %w", errno)
+	}
+	return &wakeupRing{records: make([]Event, size), mask: uint64(size - 1), efd: int(efd)}, nil
+}
+
+// notify signals the consumer
+func (r *wakeupRing) notify() {
+	one := uint64(1)
+	syscall.Write(r.efd, (*[8]byte)(unsafe.Pointer(&one))[:])
+}
+
+// clearNotify consumes pending notifications
+func (r *wakeupRing) clearNotify() {
+	var buf [8]byte
+	syscall.Read(r.efd, buf[:])
+}
+
+// query reports the ring's positions, like bpf_ringbuf_query
+func (r *wakeupRing) query() ringQuery {
+	c := r.consumer.Load()
+	p := r.producer.Load()
+	return ringQuery{availData: p - c, ringSize: uint64(len(r.records)), consPos: c, prodPos: p}
+}
+
+func (r *wakeupRing) Close() {
+	syscall.Close(r.efd)
+}
+
+// wakeupStats are the counters of one strategy run
+type wakeupStats struct {
+	produced      int64
+	reserveFailed int64
+	notifications int64
+	consumed      int64
+	postWindow    int64 // Read after the window closed, uncounted
+	wakeups       int64 // epoll_wait returned because of a notification
+	timeouts      int64 // epoll_wait timed out
+	emptyPolls    int64 // Busy-poll iterations that found nothing
+	batches       int64 // Reads of one or more records
+	syscalls      int64 // epoll_wait and eventfd reads by the consumer
+	latency       StreamingLatency
+	samples       []uint64
+	producerUsage LoadGeneratorUsage
+	emitCost      emitCostMap // The producer's own timing of its emits, with -self-time
+}
+
+// WakeupBenchmark compares ring buffer notification strategies and
+// consumer modes. Producer and consumer run on their own OS threads so
+// each one's CPU time is measured separately. The producer drives
+// getpid_reserve with the strategy's submit flags, through getpid(2); the
+// simulation emits on an eventfd-notified ring instead.
+type WakeupBenchmark struct {
+	duration    time.Duration
+	backend     string // auto, bpf or sim
+	ringSize    int
+	batch       int
+	pollTimeout time.Duration
+	rate        *rateFlagSet
+	seed        uint64
+	strategies  []string
+	consumers   []string
+	readBatches []int // Records per read swept; 0 drains everything available
+	maxSamples  int
+	stallAfter  time.Duration
+	chaos       *chaosFlagSet
+	handshake   bool          // The producer waits for the consumer to drain before emitting
+	coord       *coordination // Holds the readiness flag; nil is an atomic
+	selfTime    bool          // The program, or the simulated producer, times each reserve to submit
+	verbose     bool
+}
+
+// produce runs the producer until stop, submitting events at the scheduled
+// rate with the given notification strategy once gate allows. Like the
+// program's check of the config map, the gate is read once per batch.
+// With selfTime each successful emit, wakeup included, is timed into the
+// emit cost map as emit_start and emit_done do.
+func (b *WakeupBenchmark) produce(ring *wakeupRing, strategy string, schedule *RateSchedule, gate *startupGate, stop *atomic.Bool, stats *wakeupStats) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	start, _ := TakeThreadResourceSnapshot()
+	pid := uint32(os.Getpid())
+	size := uint64(len(ring.records))
+
+	next := time.Now()
+	for !stop.Load() {
+		n := schedule.Next()
+		if !gate.allow(n) {
+			n = 0
+		}
+		failed := stats.reserveFailed
+		for i := 0; i < n; i++ {
+			var emitStart uint64
+			if b.selfTime {
+				emitStart = nowNs()
+			}
+			p := ring.producer.Load()
+			c := ring.consumer.Load()
+			if p-c >= size {
+				stats.reserveFailed++
+				continue
+			}
+			ring.records[p&ring.mask] = Event{
+				Timestamp: uint64(time.Now().UnixNano()),
+				PID:       pid,
+				EventType: eventTypeTracepoint,
+				Data:      uint32(p),
+			}
+			ring.producer.Store(p + 1)
+			stats.produced++
+
+			var wake bool
+			switch strategy {
+			case wakeupAdaptive:
+				// The kernel wakes the consumer only if it had consumed
+				// everything before this record
+				wake = ring.consumer.Load() == p
+			case wakeupForce:
+				wake = true
+			case wakeupBatch:
+				wake = (p+1)%uint64(b.batch) == 0
+			}
+			if wake {
+				ring.notify()
+				stats.notifications++
+			}
+			if b.selfTime {
+				stats.emitCost.record(nowNs() - emitStart)
+			}
+		}
+		gate.lost(stats.reserveFailed - failed)
+		next = next.Add(simTick)
+		if d := time.Until(next); d > 0 {
+			time.Sleep(d)
+		}
+	}
+	end, _ := TakeThreadResourceSnapshot()
+	stats.producerUsage = NewLoadGeneratorUsage("thread", start, end, uint64(len(ring.records))*uint64(unsafe.Sizeof(Event{})))
+}
+
+// produceBPF runs the producer until stop, firing the program at the
+// scheduled rate. The program counts what it submitted and what the ring
+// had no room for.
+func (b *WakeupBenchmark) produceBPF(prog *bpfRingProgram, schedule *RateSchedule, stop *atomic.Bool, stats *wakeupStats) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	start, _ := TakeThreadResourceSnapshot()
+	next := time.Now()
+	for !stop.Load() {
+		for n := schedule.Next(); n > 0; n-- {
+			prog.trigger()
+		}
+		next = next.Add(simTick)
+		if d := time.Until(next); d > 0 {
+			time.Sleep(d)
+		}
+	}
+	end, _ := TakeThreadResourceSnapshot()
+	stats.producerUsage = NewLoadGeneratorUsage("thread", start, end, prog.ring.size)
+}
+
+// consumeBPF drains the program's ring buffer as consume drains the
+// simulated one, readBatch records per read with a non-blocking
+// epoll_wait between reads. The kernel notifies the ring's epoll as the
+// submit flags ask, so a wakeup is an epoll_wait that returned ready. The
+// gate's flag, which the program reads, is set once the consumer is about
+// to drain.
+func (b *WakeupBenchmark) consumeBPF(ring *bpfRingBuf, mode string, readBatch int, chaos *chaosMonkey, gate *startupGate, stop, producerStopped *atomic.Bool, stats *wakeupStats) error {
+	offset := ktimeWallOffset()
+	deliver := func(rec []byte) {
+		now := nowNs()
+		if ts := binary.LittleEndian.Uint64(rec) + offset; now >= ts {
+			stats.latency.Record(now - ts)
+			if len(stats.samples) < b.maxSamples {
+				stats.samples = append(stats.samples, now-ts)
+			}
+		}
+		stats.consumed++
+	}
+	discard := func([]byte) { stats.postWindow++ }
+
+	gate.ready()
+	for {
+		stopping := stop.Load()
+		finished := producerStopped.Load()
+		if chaos != nil && !stopping {
+			if now := time.Now(); chaos.due(now) {
+				time.Sleep(chaos.disrupt(now))
+			}
+		}
+		if stopping {
+			if ring.read(0, discard) > 0 {
+				continue
+			}
+		} else if ring.read(readBatch, deliver) > 0 {
+			stats.batches++
+			if readBatch > 0 && mode == consumerEpoll {
+				notified, err := ring.wait(0)
+				stats.syscalls++
+				if err != nil {
+					return err
+				}
+				if notified {
+					stats.wakeups++
+				}
+			}
+			continue
+		}
+		if finished {
+			return nil
+		}
+
+		switch mode {
+		case consumerBusyPoll:
+			stats.emptyPolls++
+		case consumerEpoll:
+			notified, err := ring.wait(b.pollTimeout)
+			stats.syscalls++
+			if err != nil {
+				return err
+			}
+			if notified {
+				stats.wakeups++
+			} else {
+				stats.timeouts++
+			}
+		}
+	}
+}
+
+// openProgram loads getpid_reserve with the strategy's submit flags, or
+// returns nil and why for the simulation to run instead: with -backend
+// sim, or with auto when the program cannot be loaded
+func (b *WakeupBenchmark) openProgram(strategy string) (*bpfRingProgram, string, error) {
+	if b.backend == probeBackendSim {
+		return nil, "-backend sim", nil
+	}
+	prog, err := openBPFRingProgram(ringProgOptions{
+		api:        apiReserve,
+		recordSize: eventCoreSize,
+		ringBytes:  ringBytesFor(b.ringSize, eventCoreSize),
+		wakeup:     strategy,
+		batch:      b.batch,
+		readiness:  true,
+		handshake:  b.handshake,
+		coord:      b.coord.pinned(),
+		selfTime:   b.selfTime,
+	})
+	if err != nil {
+		if b.backend == probeBackendBPF {
+			return nil, "", err
+		}
+		return nil, err.Error(), nil
+	}
+	return prog, "", nil
+}
+
+// consume drains the ring until stop, and then empties it without
+// counting what is left until the producer has finished. A readBatch
+// above zero caps the records taken per read; an epoll consumer then goes
+// back to the poll loop between reads, with a non-blocking epoll_wait
+// while records remain, as a consumer reading one record per call does.
+// A chaos monkey pauses and migrates the consumer between reads. The
+// gate is opened once the consumer is about to drain.
+func (b *WakeupBenchmark) consume(ring *wakeupRing, mode string, readBatch int, chaos *chaosMonkey, gate *startupGate, stop, producerStopped *atomic.Bool, stats *wakeupStats) error {
+	var epfd int
+	if mode == consumerEpoll {
+		var err error
+		if epfd, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC); err != nil {
+			return fmt.Errorf("epoll_create1: %w", err)
+		}
+		defer syscall.Close(epfd)
+		ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(ring.efd)}
+		if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, ring.efd, &ev); err != nil {
+			return fmt.Errorf("epoll_ctl: %w", err)
+		}
+	}
+	timeoutMs := int(b.pollTimeout / time.Millisecond)
+	events := make([]syscall.EpollEvent, 1)
+
+	gate.ready()
+	for {
+		stopping := stop.Load()
+		finished := producerStopped.Load()
+		if chaos != nil && !stopping {
+			if now := time.Now(); chaos.due(now) {
+				time.Sleep(chaos.disrupt(now))
+			}
+		}
+		c := ring.consumer.Load()
+		p := ring.producer.Load()
+		if c < p && stopping {
+			stats.postWindow += int64(p - c)
+			ring.consumer.Store(p)
+			continue
+		}
+		if c < p {
+			if readBatch > 0 {
+				p = min(p, c+uint64(readBatch))
+			}
+			now := uint64(time.Now().UnixNano())
+			for ; c < p; c++ {
+				e := ring.records[c&ring.mask]
+				if now >= e.Timestamp {
+					stats.latency.Record(now - e.Timestamp)
+					if len(stats.samples) < b.maxSamples {
+						stats.samples = append(stats.samples, now-e.Timestamp)
+					}
+				}
+				stats.consumed++
+			}
+			ring.consumer.Store(c)
+			stats.batches++
+			if readBatch > 0 && mode == consumerEpoll {
+				n, err := syscall.EpollWait(epfd, events, 0)
+				stats.syscalls++
+				if err != nil && err != syscall.EINTR {
+					return fmt.Errorf("epoll_wait: %w", err)
+				}
+				if n > 0 {
+					ring.clearNotify()
+					stats.syscalls++
+					stats.wakeups++
+				}
+			}
+			continue
+		}
+		if finished {
+			return nil
+		}
+
+		switch mode {
+		case consumerBusyPoll:
+			stats.emptyPolls++
+		case consumerEpoll:
+			n, err := syscall.EpollWait(epfd, events, timeoutMs)
+			stats.syscalls++
+			if err != nil && err != syscall.EINTR {
+				return fmt.Errorf("epoll_wait: %w", err)
+			}
+			if n > 0 {
+				ring.clearNotify()
+				stats.syscalls++
+				stats.wakeups++
+			} else if err == nil {
+				stats.timeouts++
+			}
+		}
+	}
+}
+
+// runOne measures one strategy, consumer mode and read batch combination
+func (b *WakeupBenchmark) runOne(ctx context.Context, strategy, mode string, readBatch int) (*BenchmarkResult, error) {
+	prog, simReason, err := b.openProgram(strategy)
+	if err != nil {
+		return nil, err
+	}
+	var ring *wakeupRing
+	if prog != nil {
+		defer prog.Close()
+	} else {
+		if ring, err = newWakeupRing(b.ringSize); err != nil {
+			return nil, err
+		}
+		defer ring.Close()
+	}
+	schedule, err := b.rate.schedule(b.duration, b.seed)
+	if err != nil {
+		return nil, err
+	}
+
+	readerStrategy := mode + "/" + strategy
+	if strategy == wakeupBatch {
+		readerStrategy += fmt.Sprintf("=%d", b.batch)
+	}
+	if readBatch > 0 {
+		readerStrategy += fmt.Sprintf("/read=%d", readBatch)
+	}
+	chaos, err := b.chaos.monkey()
+	if err != nil {
+		return nil, err
+	}
+	if chaos != nil {
+		readerStrategy += "/chaos"
+	}
+	if b.selfTime {
+		readerStrategy += "/self-time"
+	}
+	r := &BenchmarkResult{
+		Name:           "Ring Buffer Wakeup",
+		Language:       "Go",
+		ProgramType:    "raw_tracepoint",
+		Tracepoint:     callTracepoint,
+		DataMechanism:  "ring_buffer",
+		ReaderStrategy: probeBackendBPF + "/" + readerStrategy,
+		Host:           CollectHostInfo(),
+		Errors:         []string{},
+		WorkloadSetup:  WorkloadSetup{RateProfile: schedule.Name()},
+	}
+	var watched queryableRing = ring
+	if prog != nil {
+		watched = prog.ring
+	} else {
+		readerStrategy = probeBackendSim + "/" + readerStrategy
+		r.ProgramType, r.Tracepoint, r.ReaderStrategy = "tracepoint", "", readerStrategy
+		r.Errors = append(r.Errors, fmt.Sprintf("BPF ring buffer program not loaded (%s): producer simulated in userspace", simReason))
+	}
+	benchLog(ctx).Info("Running", "reader_strategy", readerStrategy, "duration", b.duration)
+
+	stats := &wakeupStats{samples: make([]uint64, 0, 1024)}
+	var stop, producerStopped atomic.Bool
+	producerDone := make(chan struct{})
+	consumerErr := make(chan error, 1)
+	var consumerStart, consumerEnd ResourceSnapshot
+
+	monitor := startStallMonitor(ctx, []queryableRing{watched}, b.stallAfter)
+	r.StartTime = time.Now()
+	channel := coordAtomic
+	if b.coord != nil {
+		channel = b.coord.channel
+	}
+	flag := b.coord.readiness()
+	if prog != nil {
+		// The program reads the flag from a map, its config map unless
+		// it shares the pinned coordination map
+		flag = prog.readiness(b.coord.pinned())
+		if b.coord.pinned() == nil {
+			channel = coordConfigMap
+		}
+	}
+	gate := newStartupGate(flag, b.handshake, channel)
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		consumerStart, _ = TakeThreadResourceSnapshot()
+		chaos.start()
+		var err error
+		if prog != nil {
+			err = b.consumeBPF(prog.ring, mode, readBatch, chaos, gate, &stop, &producerStopped, stats)
+		} else {
+			err = b.consume(ring, mode, readBatch, chaos, gate, &stop, &producerStopped, stats)
+		}
+		r.Chaos = chaos.stop()
+		consumerEnd, _ = TakeThreadResourceSnapshot()
+		consumerErr <- err
+	}()
+	go func() {
+		defer close(producerDone)
+		if prog != nil {
+			b.produceBPF(prog, schedule, &stop, stats)
+		} else {
+			b.produce(ring, strategy, schedule, gate, &stop, stats)
+		}
+	}()
+
+	done := time.NewTimer(b.duration)
+	select {
+	case <-done.C:
+	case <-ctx.Done():
+		done.Stop()
+		r.Quality.Flag(QualityInterrupted)
+	}
+	stop.Store(true)
+	r.EndTime = time.Now()
+	<-producerDone
+	producerStopped.Store(true)
+	if ring != nil {
+		ring.notify() // Wake a blocked consumer so it sees the producer is done
+	}
+	err = <-consumerErr
+	drainTime := time.Since(r.EndTime)
+	r.Stalls = monitor.stop()
+	if err != nil {
+		return nil, err
+	}
+	if prog != nil {
+		// The program's counts, read once the ring is drained; the
+		// runtime's own getpid(2) calls fire it too and are in both
+		stats.produced = prog.count(prog.slot)
+		stats.reserveFailed = prog.count(ringCountFull)
+		gate.counted(prog.count(ringCountGated), prog.count(ringCountStartupDrops))
+		switch strategy {
+		case wakeupForce:
+			stats.notifications = stats.produced
+		case wakeupBatch:
+			stats.notifications = stats.produced / int64(b.batch)
+		}
+	}
+
+	wall := r.EndTime.Sub(r.StartTime)
+	r.Duration = wall.Seconds()
+	r.EventCount = stats.consumed
+	r.RecordDrops(DropCounts{ReserveFailed: stats.reserveFailed})
+	r.recordTeardown(stats.produced+stats.reserveFailed, stats.postWindow, drainTime)
+	if r.Duration > 0 {
+		r.Throughput = float64(stats.consumed) / r.Duration
+	}
+	r.Latency = stats.latency.Stats()
+	r.Latency.Percentiles = computeLatencyStats(stats.samples, DefaultQuantiles).Percentiles
+	r.CPUBudget = NewCPUBudget(consumerStart, consumerEnd, stats.consumed)
+	r.CPUUsage = r.CPUBudget.CPUPercent(consumerEnd.Wall.Sub(consumerStart.Wall))
+	r.LoadGenerator = &stats.producerUsage
+	r.MemoryUsage = stats.producerUsage.MemoryBytes
+	r.Handshake = gate.result()
+	switch {
+	case b.selfTime && prog != nil:
+		cpus, err := prog.emitCosts()
+		if err != nil {
+			return nil, err
+		}
+		r.EmitCost = emitCostStats(cpus, r.CPUBudget.CPUPerEventUs)
+	case b.selfTime:
+		// The producer is simulated, so there is no emit_cost map to read
+		r.EmitCost = emitCostStats([]emitCostMap{stats.emitCost}, r.CPUBudget.CPUPerEventUs)
+		r.EmitCost.Simulated = true
+	}
+
+	r.Operations = []OperationResult{
+		NewOperationResult("read_batch", stats.batches, wall),
+		NewOperationResult("consumer_syscall", stats.syscalls, wall),
+	}
+	if prog == nil || strategy != wakeupAdaptive {
+		// Whether the kernel notifies an adaptive submit is its own call,
+		// seen only in the consumer's wakeups
+		r.Operations = append([]OperationResult{NewOperationResult("notify", stats.notifications, wall)}, r.Operations...)
+	}
+	switch mode {
+	case consumerEpoll:
+		r.Operations = append(r.Operations,
+			NewOperationResult("wakeup", stats.wakeups, wall),
+			NewOperationResult("poll_timeout", stats.timeouts, wall))
+	case consumerBusyPoll:
+		r.Operations = append(r.Operations, NewOperationResult("empty_poll", stats.emptyPolls, wall))
+	}
+	return r, nil
+}
+
+// Run measures every strategy with every consumer mode and read batch.
+// Combinations not reached when ctx is done are skipped.
+func (b *WakeupBenchmark) Run(ctx context.Context) ([]*BenchmarkResult, error) {
+	if b.verbose {
+		PrintBenchmarkHeader("Ring Buffer Wakeup Strategy Benchmark (Go)")
+	}
+	var results []*BenchmarkResult
+	for _, mode := range b.consumers {
+		for _, strategy := range b.strategies {
+			for _, readBatch := range b.readBatches {
+				if ctx.Err() != nil {
+					return results, nil
+				}
+				r, err := b.runOne(ctx, strategy, mode, readBatch)
+				if err != nil {
+					return nil, fmt.Errorf("%s/%s: %w", mode, strategy, err)
+				}
+				results = append(results, r)
+			}
+		}
+	}
+	return results, nil
+}
+
+// runWakeupBenchmark is the entry point of the ringbuf-wakeup subcommand
+func runWakeupBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("ringbuf-wakeup", flag.ExitOnError)
+	common := addBenchFlags(fs, "ringbuf_wakeup_result.json", true)
+	strategies := fs.String("strategies", strings.Join(allWakeupStrategies, ","), "Comma-separated notification strategies")
+	consumers := fs.String("consumers", strings.Join(allConsumerModes, ","), "Comma-separated consumer modes (epoll, busy-poll)")
+	ringSize := fs.Int("ring", 4096, "Ring size in records (power of two)")
+	batch := fs.Int("batch", 64, "Records per forced wakeup for the batch strategy")
+	readBatches := fs.String("read-batch", "0", "Comma-separated records per consumer read to sweep; 1 reads one at a time, 0 drains everything available")
+	pollTimeout := fs.Duration("poll-timeout", 10*time.Millisecond, "epoll_wait timeout, which bounds no-wakeup delivery delay")
+	seed := fs.Uint64("seed", 1, "Rate profile seed")
+	stallAfter := addStallFlag(fs)
+	backend := fs.String("backend", probeBackendAuto, "Producer backend (auto, bpf, sim)")
+	rate := addRateFlags(fs)
+	chaosFlags := addChaosFlags(fs)
+	handshake := fs.Bool("handshake", true, "Hold the producer back until the consumer is draining, as the program does through the config map's ready flag; false emits from the start")
+	coordFlags := addCoordFlags(fs)
+	selfTime := fs.Bool("self-time", false, "Have the program time each emit from reserve to submit into its emit_cost map, through the config map's self-time slot, to separate producer cost from consumer cost")
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+	if *ringSize <= 0 || *ringSize&(*ringSize-1) != 0 {
+		return nil, opts, fmt.Errorf("-ring must be a power of two")
+	}
+	if *batch <= 0 {
+		return nil, opts, fmt.Errorf("-batch must be positive")
+	}
+	if !containsString([]string{probeBackendAuto, probeBackendBPF, probeBackendSim}, *backend) {
+		return nil, opts, fmt.Errorf("unknown backend %q (want auto, bpf or sim)", *backend)
+	}
+	if *pollTimeout < time.Millisecond {
+		return nil, opts, fmt.Errorf("-poll-timeout must be at least 1ms")
+	}
+	for _, s := range splitList(*strategies) {
+		if !containsString(allWakeupStrategies, s) {
+			return nil, opts, fmt.Errorf("unknown wakeup strategy %q", s)
+		}
+	}
+	for _, c := range splitList(*consumers) {
+		if !containsString(allConsumerModes, c) {
+			return nil, opts, fmt.Errorf("unknown consumer mode %q", c)
+		}
+	}
+	var reads []int
+	for _, s := range splitList(*readBatches) {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, opts, fmt.Errorf("invalid read batch %q", s)
+		}
+		reads = append(reads, n)
+	}
+	if len(reads) == 0 {
+		return nil, opts, fmt.Errorf("-read-batch must list at least one size")
+	}
+	if _, err := rate.schedule(opts.Duration, *seed); err != nil {
+		return nil, opts, err
+	}
+	if _, err := chaosFlags.monkey(); err != nil {
+		return nil, opts, err
+	}
+	coord, err := coordFlags.open()
+	if err != nil {
+		return nil, opts, err
+	}
+	defer coord.Close()
+
+	bench := &WakeupBenchmark{
+		duration:    opts.Duration,
+		backend:     *backend,
+		ringSize:    *ringSize,
+		batch:       *batch,
+		pollTimeout: *pollTimeout,
+		rate:        rate,
+		seed:        *seed,
+		strategies:  splitList(*strategies),
+		consumers:   splitList(*consumers),
+		readBatches: reads,
+		maxSamples:  100000,
+		stallAfter:  *stallAfter,
+		chaos:       chaosFlags,
+		handshake:   *handshake,
+		coord:       coord,
+		selfTime:    *selfTime,
+		verbose:     opts.Verbose,
+	}
+	results, err := bench.Run(ctx)
+	if err != nil {
+		return nil, opts, err
+	}
+	return results, opts, nil
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
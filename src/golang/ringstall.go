@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ringQuery is what bpf_ringbuf_query reports about a ring, in records
+// rather than bytes
+type ringQuery struct {
+	availData uint64 // BPF_RB_AVAIL_DATA
+	ringSize  uint64 // BPF_RB_RING_SIZE
+	consPos   uint64 // BPF_RB_CONS_POS
+	prodPos   uint64 // BPF_RB_PROD_POS
+}
+
+// queryableRing is a ring the stall monitor can query
+type queryableRing interface {
+	query() ringQuery
+}
+
+// StallStats are the consumer stalls seen by the ring monitor: periods of
+// at least Threshold in which a ring held unread records but its consumer
+// position did not move
+type StallStats struct {
+	Backend        string  // bpf when every ring was a ring buffer map read through its mapped positions, sim otherwise
+	Threshold      float64 // Seconds
+	Count          int64
+	TotalSeconds   float64
+	LongestSeconds float64
+	MeanOccupancy  float64 // Mean fraction of the ring holding unread records
+	PeakOccupancy  float64
+}
+
+// addStallFlag registers -stall-threshold
+func addStallFlag(fs *flag.FlagSet) *time.Duration {
+	return fs.Duration("stall-threshold", 10*time.Millisecond,
+		"Report periods this long in which the consumer stopped draining a non-empty ring (0 disables monitoring)")
+}
+
+// ringWatch is the monitor's view of one ring
+type ringWatch struct {
+	ring         queryableRing
+	lastCons     uint64
+	stalledSince time.Time // Zero while the consumer is keeping up
+}
+
+// stallMonitor polls rings with ringQuery from its own goroutine, the way
+// a userspace monitor would call bpf_ringbuf_query through a helper
+// program, and records occupancy and consumer stalls. A ring buffer map is
+// queried through the positions mapped from the kernel; a simulated ring
+// reports its own.
+type stallMonitor struct {
+	watches   []ringWatch
+	startCons []uint64 // Consumer positions at the start, for the snapshot trigger
+	benchmark string
+	interval  time.Duration
+	threshold time.Duration
+	log       *slog.Logger
+	done      chan struct{}
+	wg        sync.WaitGroup
+
+	stats     StallStats
+	samples   int64
+	occupancy float64 // Sum over samples of the mean ring occupancy
+}
+
+// startStallMonitor starts monitoring rings. It returns nil when threshold
+// is zero; stop is safe to call on nil.
+func startStallMonitor(ctx context.Context, rings []queryableRing, threshold time.Duration) *stallMonitor {
+	if threshold <= 0 || len(rings) == 0 {
+		return nil
+	}
+	m := &stallMonitor{
+		interval:  max(threshold/10, 100*time.Microsecond),
+		threshold: threshold,
+		log:       benchLog(ctx),
+		done:      make(chan struct{}),
+	}
+	m.stats.Threshold = threshold.Seconds()
+	m.stats.Backend = probeBackendBPF
+	m.benchmark, _ = ctx.Value(benchmarkKey{}).(string)
+	for _, r := range rings {
+		if _, ok := r.(*bpfRingBuf); !ok {
+			m.stats.Backend = probeBackendSim
+		}
+		cons := r.query().consPos
+		m.watches = append(m.watches, ringWatch{ring: r, lastCons: cons})
+		m.startCons = append(m.startCons, cons)
+	}
+	watchRate(m)
+	m.wg.Add(1)
+	go m.run()
+	return m
+}
+
+// The monitor is a rateSource of the snapshot trigger, counting the
+// records its rings' consumers have read
+func (m *stallMonitor) sourceBenchmark() string { return m.benchmark }
+
+func (m *stallMonitor) eventsSoFar() int64 {
+	var n int64
+	for i := range m.watches {
+		n += int64(m.watches[i].ring.query().consPos - m.startCons[i])
+	}
+	return n
+}
+
+// bufferOccupancy reports the unread fraction of each ring
+func (m *stallMonitor) bufferOccupancy() []float64 {
+	fracs := make([]float64, len(m.watches))
+	for i := range m.watches {
+		if q := m.watches[i].ring.query(); q.ringSize > 0 {
+			fracs[i] = float64(q.availData) / float64(q.ringSize)
+		}
+	}
+	return fracs
+}
+
+func (m *stallMonitor) run() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			m.sample(now)
+		}
+	}
+}
+
+// sample queries every ring once
+func (m *stallMonitor) sample(now time.Time) {
+	var occupancy float64
+	for i := range m.watches {
+		w := &m.watches[i]
+		q := w.ring.query()
+		if q.ringSize > 0 {
+			frac := float64(q.availData) / float64(q.ringSize)
+			occupancy += frac
+			m.stats.PeakOccupancy = max(m.stats.PeakOccupancy, frac)
+		}
+		switch {
+		case q.availData > 0 && q.consPos == w.lastCons:
+			if w.stalledSince.IsZero() {
+				w.stalledSince = now
+			}
+		case !w.stalledSince.IsZero():
+			m.endStall(i, now, q)
+		}
+		w.lastCons = q.consPos
+	}
+	m.occupancy += occupancy / float64(len(m.watches))
+	m.samples++
+}
+
+// endStall records the stall of ring i if it lasted long enough
+func (m *stallMonitor) endStall(i int, now time.Time, q ringQuery) {
+	w := &m.watches[i]
+	d := now.Sub(w.stalledSince)
+	w.stalledSince = time.Time{}
+	if d < m.threshold {
+		return
+	}
+	m.stats.Count++
+	m.stats.TotalSeconds += d.Seconds()
+	m.stats.LongestSeconds = max(m.stats.LongestSeconds, d.Seconds())
+	m.log.Info("Consumer stall", "ring", i, "position", q.consPos, "duration", d.Round(time.Microsecond), "pending", q.availData)
+}
+
+// stop ends monitoring and returns the statistics. A stall still in
+// progress is counted up to now.
+func (m *stallMonitor) stop() *StallStats {
+	if m == nil {
+		return nil
+	}
+	unwatchRate(m)
+	close(m.done)
+	m.wg.Wait()
+	now := time.Now()
+	for i := range m.watches {
+		if !m.watches[i].stalledSince.IsZero() {
+			m.endStall(i, now, m.watches[i].ring.query())
+		}
+	}
+	if m.samples > 0 {
+		m.stats.MeanOccupancy = m.occupancy / float64(m.samples)
+	}
+	return &m.stats
+}
+
+// formatStalls renders the stall statistics, if monitored
+func (r *BenchmarkResult) formatStalls() string {
+	s := r.Stalls
+	if s == nil {
+		return ""
+	}
+	source := "ring buffer map positions"
+	if s.Backend != probeBackendBPF {
+		source = "simulated ring positions"
+	}
+	return fmt.Sprintf("Stalls:          %d >= %v (total %.3fs, longest %.3fs); occupancy mean %.1f%%, peak %.1f%%, from %s\n",
+		s.Count, time.Duration(s.Threshold*float64(time.Second)), s.TotalSeconds, s.LongestSeconds,
+		s.MeanOccupancy*100, s.PeakOccupancy*100, source)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScheduledRun places a result in the wall-clock schedule of the suite
+// that produced it
+type ScheduledRun struct {
+	Schedule string    // Planned start of the schedule's first run, identifying it
+	Run      int       // 1-based run of the schedule
+	Runs     int       // Runs planned; 0 when repeating until interrupted
+	Planned  time.Time // When this run was due to start
+}
+
+// suiteSchedule is when a suite runs: once now, or from start on, every
+// interval, for a number of runs
+type suiteSchedule struct {
+	start time.Time
+	every time.Duration
+	runs  int // 0 repeats until interrupted
+}
+
+// scheduleFlagSet holds the -start-at, -every and -runs flags
+type scheduleFlagSet struct {
+	startAt *string
+	every   *durationFlag
+	runs    *int
+}
+
+// addScheduleFlags registers -start-at, -every and -runs
+func addScheduleFlags(fs *flag.FlagSet) *scheduleFlagSet {
+	f := &scheduleFlagSet{every: &durationFlag{}}
+	f.startAt = fs.String("start-at", "", "Wait until this time to start: 15:04[:05] (next occurrence), 2006-01-02 15:04 or RFC 3339")
+	fs.Var(f.every, "every", "Repeat the suite at this interval from its start (e.g. 24h)")
+	f.runs = fs.Int("runs", 0, "Scheduled runs of the suite (default 1, or until interrupted with -every)")
+	return f
+}
+
+// schedule validates and returns the parsed flags. It is nil when the
+// suite runs once, right away.
+func (f *scheduleFlagSet) schedule(now time.Time) (*suiteSchedule, error) {
+	if *f.startAt == "" && f.every.d == 0 && *f.runs == 0 {
+		return nil, nil
+	}
+	s := &suiteSchedule{start: now, every: f.every.d, runs: *f.runs}
+	if s.every < 0 || s.runs < 0 {
+		return nil, fmt.Errorf("-every and -runs must not be negative")
+	}
+	if s.every == 0 {
+		if s.runs > 1 {
+			return nil, fmt.Errorf("-runs %d needs -every", s.runs)
+		}
+		s.runs = 1
+	}
+	if *f.startAt != "" {
+		start, err := parseStartAt(*f.startAt, now)
+		if err != nil {
+			return nil, err
+		}
+		if start.Before(now) && s.every == 0 {
+			return nil, fmt.Errorf("-start-at %s is in the past", start.Format(time.RFC3339))
+		}
+		s.start = start
+	}
+	return s, nil
+}
+
+// parseStartAt parses a -start-at time. A time of day is its next
+// occurrence after now.
+func parseStartAt(s string, now time.Time) (time.Time, error) {
+	for _, layout := range []string{"15:04", "15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			y, m, d := now.Date()
+			at := time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, time.Local)
+			if !at.After(now) {
+				at = at.AddDate(0, 0, 1)
+			}
+			return at, nil
+		}
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02 15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -start-at %q (want 15:04, 2006-01-02 15:04 or RFC 3339)", s)
+	}
+	return t, nil
+}
+
+// scheduleGrace is how late a run may start before its slot counts as
+// missed
+const scheduleGrace = time.Minute
+
+// nextSlot returns the index and time of slot from, or of the first slot
+// after now when from has passed by more than scheduleGrace: missed runs
+// are skipped, not run late
+func (s *suiteSchedule) nextSlot(now time.Time, from int) (int, time.Time) {
+	slot := from
+	if behind := now.Sub(s.start.Add(time.Duration(slot) * s.every)); s.every > 0 && behind > scheduleGrace {
+		slot += int((behind + s.every - 1) / s.every)
+	}
+	return slot, s.start.Add(time.Duration(slot) * s.every)
+}
+
+// label describes the schedule for logs
+func (s *suiteSchedule) label() string {
+	switch {
+	case s.every == 0:
+		return "once at " + s.start.Format(time.RFC3339)
+	case s.runs == 0:
+		return fmt.Sprintf("every %s from %s until interrupted", s.every, s.start.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("every %s from %s, %d runs", s.every, s.start.Format(time.RFC3339), s.runs)
+}
+
+// waitUntil sleeps until t. It returns early, and false, when ctx is done.
+func waitUntil(ctx context.Context, t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// scheduledOutput numbers the output file of a scheduled run, so JSON
+// files, which are replaced on every write, keep each run apart. JSONL
+// and CSV files are appended to and keep their name.
+func scheduledOutput(opts benchOptions, run int) string {
+	format := opts.Format
+	if format == "" {
+		format = formatFromExt(opts.Output)
+	}
+	if format != FormatJSON {
+		return opts.Output
+	}
+	ext := filepath.Ext(opts.Output)
+	return strings.TrimSuffix(opts.Output, ext) + "-" + strconv.Itoa(run) + ext
+}
+
+// formatScheduled renders the scheduled run of a result, if any
+func (r *BenchmarkResult) formatScheduled() string {
+	if r.Scheduled == nil {
+		return ""
+	}
+	runs := ""
+	if r.Scheduled.Runs > 0 {
+		runs = " of " + strconv.Itoa(r.Scheduled.Runs)
+	}
+	return fmt.Sprintf("Scheduled:       run %d%s of schedule %s, due %s\n",
+		r.Scheduled.Run, runs, r.Scheduled.Schedule, r.Scheduled.Planned.Format(time.RFC3339))
+}
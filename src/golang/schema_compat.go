@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// schemaBatch is how many records are encoded into the ring before the
+// consumer drains them
+const schemaBatch = 256
+
+// schemaPair is a producer and consumer schema
+type schemaPair struct {
+	producer, consumer int
+}
+
+func (p schemaPair) String() string {
+	return fmt.Sprintf("v%d:v%d", p.producer, p.consumer)
+}
+
+// parseSchemaPair parses producer:consumer, e.g. v2:v1
+func parseSchemaPair(s string) (schemaPair, error) {
+	var p schemaPair
+	if _, err := fmt.Sscanf(s, "v%d:v%d", &p.producer, &p.consumer); err != nil ||
+		p.producer < schemaV1 || p.producer > schemaV2 || p.consumer < schemaV1 || p.consumer > schemaV2 {
+		return p, fmt.Errorf("invalid schema pair %q (want producer:consumer of v1 or v2, e.g. v2:v1)", s)
+	}
+	return p, nil
+}
+
+// SchemaStats describe one framing between a producer and a consumer
+// that may disagree on the event schema
+type SchemaStats struct {
+	Framing       string
+	Producer      int // Schema version emitted
+	Consumer      int // Schema version expected
+	BytesPerEvent float64
+	EncodeNs      float64 // Mean producer-side encode time
+	DecodeNs      float64 // Mean consumer-side decode time
+	OverheadNs    float64 // Encode plus decode over raw framing with both sides on the producer's schema; 0 without that run
+	Decoded       int64
+	Defaulted     int64 // Decoded with fields the consumer expects left zero
+	Skipped       int64 // Decoded ignoring fields the consumer does not know
+	Rejected      int64 // Records the consumer could not decode
+	Mismatched    int64 // Decoded, but a field both schemas share came out wrong
+	Graceful      bool  // Nothing rejected or mismatched
+}
+
+// SchemaCompatBenchmark checks how each event framing copes with a
+// producer and consumer built against different versions of the event
+// struct, and what the framing costs when they agree. Records go through
+// an in-process byte ring: the producer encodes a batch with the
+// producer's schema, then the consumer decodes it with its own and checks
+// every field both schemas share.
+type SchemaCompatBenchmark struct {
+	duration time.Duration
+	framings []eventFraming
+	pairs    []schemaPair
+	verbose  bool
+}
+
+// runOne measures framing between the schemas of pair
+func (b *SchemaCompatBenchmark) runOne(ctx context.Context, framing eventFraming, pair schemaPair) *BenchmarkResult {
+	r := &BenchmarkResult{
+		Name:           "Event Schema Compatibility",
+		Language:       "Go",
+		ProgramType:    "tracepoint",
+		DataMechanism:  "ring_buffer",
+		ReaderStrategy: fmt.Sprintf("framing=%s/schema=%s", framing.Name(), pair),
+		Host:           CollectHostInfo(),
+		Errors:         []string{},
+	}
+	benchLog(ctx).Info("Running", "framing", framing.Name(), "producer_schema", pair.producer,
+		"consumer_schema", pair.consumer, "duration", b.duration)
+
+	size := framing.MaxSize(pair.producer)
+	arena := make([]byte, schemaBatch*size)
+	lens := make([]int, schemaBatch)
+	s := &SchemaStats{Framing: framing.Name(), Producer: pair.producer, Consumer: pair.consumer}
+	pid := uint32(os.Getpid())
+	var comm [16]byte
+	copy(comm[:], "ebpf-benchmark")
+	var firstErr error
+	var bytes, encodeNs, decodeNs int64
+	var seq uint32
+
+	startUsage, _ := TakeResourceSnapshot()
+	r.StartTime = time.Now()
+	deadline := r.StartTime.Add(b.duration)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		t0 := time.Now()
+		for i := range lens {
+			e := extendedEvent{
+				Event: Event{
+					Timestamp: uint64(t0.UnixNano()),
+					PID:       pid,
+					CPU:       uint32(i % 4),
+					EventType: eventTypeTracepoint,
+					Data:      seq + uint32(i),
+				},
+			}
+			if pair.producer >= schemaV2 {
+				e.CgroupID = uint64(seq+uint32(i)) * 0x9e3779b97f4a7c15
+				e.Comm = comm
+			}
+			lens[i] = framing.Encode(arena[i*size:], &e, pair.producer)
+		}
+		t1 := time.Now()
+		for i, n := range lens {
+			var e extendedEvent
+			outcome, err := framing.Decode(arena[i*size:i*size+n], &e, pair.consumer)
+			bytes += int64(n)
+			if err != nil {
+				s.Rejected++
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			s.Decoded++
+			switch outcome {
+			case decodeDefaulted:
+				s.Defaulted++
+			case decodeSkipped:
+				s.Skipped++
+			}
+			if !sharedFieldsMatch(&e, seq+uint32(i), pid, comm, min(pair.producer, pair.consumer)) {
+				s.Mismatched++
+			}
+		}
+		encodeNs += t1.Sub(t0).Nanoseconds()
+		decodeNs += time.Since(t1).Nanoseconds()
+		seq += schemaBatch
+	}
+	r.EndTime = time.Now()
+	endUsage, _ := TakeResourceSnapshot()
+	markInterrupted(ctx, r)
+
+	wall := r.EndTime.Sub(r.StartTime)
+	records := s.Decoded + s.Rejected
+	r.Duration = wall.Seconds()
+	r.EventCount = s.Decoded
+	if r.Duration > 0 {
+		r.Throughput = float64(s.Decoded) / r.Duration
+	}
+	if records > 0 {
+		s.BytesPerEvent = float64(bytes) / float64(records)
+		s.EncodeNs = float64(encodeNs) / float64(records)
+		s.DecodeNs = float64(decodeNs) / float64(records)
+	}
+	s.Graceful = s.Rejected == 0 && s.Mismatched == 0
+	r.Schema = s
+	r.CPUBudget = NewCPUBudget(startUsage, endUsage, records)
+	r.CPUUsage = r.CPUBudget.CPUPercent(wall)
+	r.MemoryUsage = uint64(len(arena))
+	r.Operations = []OperationResult{
+		NewOperationResult("encode", records, time.Duration(encodeNs)),
+		NewOperationResult("decode", records, time.Duration(decodeNs)),
+	}
+	if firstErr != nil {
+		r.Errors = append(r.Errors, fmt.Sprintf("%d records rejected, first: %v", s.Rejected, firstErr))
+	}
+	if s.Mismatched > 0 {
+		r.Errors = append(r.Errors, fmt.Sprintf("%d records decoded with wrong shared fields", s.Mismatched))
+	}
+	return r
+}
+
+// sharedFieldsMatch checks the fields of schema decoded from event seq
+func sharedFieldsMatch(e *extendedEvent, seq, pid uint32, comm [16]byte, schema int) bool {
+	ok := e.Data == seq && e.PID == pid && e.EventType == eventTypeTracepoint && e.Timestamp != 0
+	if schema >= schemaV2 {
+		ok = ok && e.CgroupID == uint64(seq)*0x9e3779b97f4a7c15 && e.Comm == comm
+	}
+	return ok
+}
+
+// Run measures every framing against every schema pair, then sets each
+// result's overhead against raw framing of the producer's schema on both
+// sides, the cost of the same event with no compatibility support
+func (b *SchemaCompatBenchmark) Run(ctx context.Context) []*BenchmarkResult {
+	if b.verbose {
+		PrintBenchmarkHeader("Event Schema Compatibility Benchmark (Go)")
+	}
+	var results []*BenchmarkResult
+	raw := make(map[schemaPair]*SchemaStats)
+	for _, framing := range b.framings {
+		for _, pair := range b.pairs {
+			if ctx.Err() != nil {
+				return results
+			}
+			r := b.runOne(ctx, framing, pair)
+			if _, ok := framing.(rawFraming); ok && pair.producer == pair.consumer {
+				raw[pair] = r.Schema
+			}
+			results = append(results, r)
+		}
+	}
+	for _, r := range results {
+		s := r.Schema
+		if base, ok := raw[schemaPair{s.Producer, s.Producer}]; ok && s.Framing != "raw" {
+			s.OverheadNs = s.EncodeNs + s.DecodeNs - base.EncodeNs - base.DecodeNs
+		}
+	}
+	return results
+}
+
+// formatSchema renders the schema compatibility statistics, if measured
+func (r *BenchmarkResult) formatSchema() string {
+	s := r.Schema
+	if s == nil {
+		return ""
+	}
+	verdict := "graceful"
+	if !s.Graceful {
+		verdict = "BROKEN"
+	}
+	return fmt.Sprintf("Schema:          %s v%d->v%d %s: %.1f B/event, encode %.1f ns, decode %.1f ns, overhead %+.1f ns; %d defaulted, %d skipped, %d rejected, %d mismatched\n",
+		s.Framing, s.Producer, s.Consumer, verdict, s.BytesPerEvent, s.EncodeNs, s.DecodeNs, s.OverheadNs,
+		s.Defaulted, s.Skipped, s.Rejected, s.Mismatched)
+}
+
+// runSchemaCompatBenchmark is the entry point of the schema-compat subcommand
+func runSchemaCompatBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("schema-compat", flag.ExitOnError)
+	common := addBenchFlags(fs, "schema_compat_result.json", true)
+	framingNames := fs.String("framing", "raw,prefix,versioned,tlv", "Comma-separated event framings to compare (raw, prefix, versioned, tlv)")
+	pairList := fs.String("pairs", "v1:v1,v2:v2,v2:v1,v1:v2", "Comma-separated producer:consumer schema pairs; v1 is the 32-byte event, v2 adds cgroup and comm")
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+	bench := &SchemaCompatBenchmark{duration: opts.Duration, verbose: opts.Verbose}
+	for _, name := range splitList(*framingNames) {
+		f, ok := eventFramings[name]
+		if !ok {
+			return nil, opts, fmt.Errorf("unknown framing %q (want raw, prefix, versioned or tlv)", name)
+		}
+		bench.framings = append(bench.framings, f)
+	}
+	for _, s := range splitList(*pairList) {
+		p, err := parseSchemaPair(strings.ToLower(s))
+		if err != nil {
+			return nil, opts, err
+		}
+		bench.pairs = append(bench.pairs, p)
+	}
+	if len(bench.framings) == 0 || len(bench.pairs) == 0 {
+		return nil, opts, fmt.Errorf("-framing and -pairs must each list at least one entry")
+	}
+	return bench.Run(ctx), opts, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// cacheLineSize pads shards so concurrent appenders don't false-share
+const cacheLineSize = 64
+
+// eventShard is one per-CPU slice of a ShardedEventBuffer. next counts
+// reservations, including those rejected because the shard was full.
+type eventShard struct {
+	events []Event
+	next   atomic.Int64
+	_      [cacheLineSize - 8]byte
+}
+
+// ShardedEventBuffer collects events from concurrent readers into per-CPU
+// shards. Add reserves a slot with a single atomic add, so readers never
+// take a lock and only contend when they share a shard. Merge combines the
+// shards into an EventBuffer once collection has stopped.
+type ShardedEventBuffer struct {
+	shards    []eventShard
+	quantiles []float64
+	progress  *Progress
+	startTime time.Time
+	endTime   time.Time
+}
+
+// NewShardedEventBuffer creates a buffer of n shards splitting maxSize
+// events between them
+func NewShardedEventBuffer(n, maxSize int) *ShardedEventBuffer {
+	if n < 1 {
+		n = 1
+	}
+	sb := &ShardedEventBuffer{
+		shards:    make([]eventShard, n),
+		quantiles: DefaultQuantiles,
+	}
+	for i := range sb.shards {
+		sb.shards[i].events = make([]Event, maxSize/n)
+	}
+	return sb
+}
+
+// SetQuantiles sets the percentiles reported by the merged buffer
+func (sb *ShardedEventBuffer) SetQuantiles(quantiles []float64) {
+	sb.quantiles = quantiles
+}
+
+// SetProgress publishes the buffer's counts to the metrics exporter
+func (sb *ShardedEventBuffer) SetProgress(p *Progress) {
+	sb.progress = p
+	if p != nil {
+		var capacity int
+		for i := range sb.shards {
+			capacity += len(sb.shards[i].events)
+		}
+		p.capacity.Store(int64(capacity))
+	}
+}
+
+// Shards returns the number of shards
+func (sb *ShardedEventBuffer) Shards() int {
+	return len(sb.shards)
+}
+
+// Add appends an event to a shard, typically the reader's CPU. It is safe
+// for concurrent use; events arriving while the shard is full are counted
+// as dropped.
+func (sb *ShardedEventBuffer) Add(shard int, e Event) bool {
+	s := &sb.shards[shard%len(sb.shards)]
+	i := s.next.Add(1) - 1
+	if i >= int64(len(s.events)) {
+		if sb.progress != nil {
+			sb.progress.dropped.Add(1)
+		}
+		return false
+	}
+	s.events[i] = e
+	if sb.progress != nil {
+		sb.progress.delivered(&e)
+	}
+	return true
+}
+
+// Start marks the start of collection and empties every shard. It must not
+// run concurrently with Add.
+func (sb *ShardedEventBuffer) Start() {
+	sb.startTime = time.Now()
+	for i := range sb.shards {
+		sb.shards[i].next.Store(0)
+	}
+	if sb.progress != nil {
+		sb.progress.start()
+	}
+}
+
+// End marks the end of collection
+func (sb *ShardedEventBuffer) End() {
+	sb.endTime = time.Now()
+	if sb.progress != nil {
+		sb.progress.end()
+	}
+}
+
+// count returns the events stored in a shard and the events it rejected
+func (s *eventShard) count() (stored, dropped int64) {
+	n := s.next.Load()
+	if capacity := int64(len(s.events)); n > capacity {
+		return capacity, n - capacity
+	}
+	return n, 0
+}
+
+// Merge combines the shards into an EventBuffer ordered by timestamp, so
+// the usual metrics apply. All readers must have stopped adding events.
+func (sb *ShardedEventBuffer) Merge() *EventBuffer {
+	var total, dropped int64
+	for i := range sb.shards {
+		n, d := sb.shards[i].count()
+		total += n
+		dropped += d
+	}
+
+	eb := NewEventBuffer(int(total))
+	eb.quantiles = sb.quantiles
+	for i := range sb.shards {
+		n, _ := sb.shards[i].count()
+		eb.events = append(eb.events, sb.shards[i].events[:n]...)
+	}
+	sort.SliceStable(eb.events, func(i, j int) bool {
+		return eb.events[i].Timestamp < eb.events[j].Timestamp
+	})
+	eb.dropped = dropped
+	eb.startTime = sb.startTime
+	eb.endTime = sb.endTime
+	return eb
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshot trigger settings
+const (
+	snapshotWindow     = time.Second      // Throughput is compared window to window
+	snapshotCooldown   = 10 * time.Second // Least time between snapshots of one benchmark
+	snapshotLimit      = 20               // Snapshots a process takes at most
+	snapshotTopCPU     = 5                // Busiest processes kept
+	snapshotInterrupts = 10               // Busiest interrupt sources kept
+	userHZ             = 100              // USER_HZ, the unit of CPU times in /proc
+)
+
+// SystemSnapshot is the state of the host when a benchmark's throughput
+// fell by more than the -snapshot-on-drop percentage from one window to
+// the next, for diagnosing transient interference after the run
+type SystemSnapshot struct {
+	Benchmark      string
+	Time           time.Time // End of the window that dropped
+	WindowSeconds  float64
+	PrevThroughput float64          // Events/s in the window before
+	Throughput     float64          // Events/s in the window that dropped
+	DropPercent    float64          // Fall from PrevThroughput
+	TopCPU         []ProcessCPU     // Busiest processes over the window
+	Interrupts     []InterruptDelta // Busiest interrupt sources over the window
+	Occupancy      []float64        // Unread fraction of each of the benchmark's buffers, where known
+	GC             SnapshotGC
+}
+
+// ProcessCPU is a process's CPU time over a snapshot's window
+type ProcessCPU struct {
+	PID        int
+	Command    string
+	CPUPercent float64 // Of one CPU
+}
+
+// InterruptDelta is the count of an interrupt source, summed over CPUs,
+// over a snapshot's window
+type InterruptDelta struct {
+	IRQ         string // Number or name, as in /proc/interrupts
+	Description string
+	Count       uint64
+}
+
+// SnapshotGC is the Go GC activity over a snapshot's window
+type SnapshotGC struct {
+	Cycles    uint32
+	PauseNs   uint64
+	HeapBytes uint64 // Heap in use at the end of the window
+}
+
+// SnapshotRef points a result at a snapshot taken in its window
+type SnapshotRef struct {
+	Time        time.Time
+	DropPercent float64
+	File        string `json:",omitempty"`
+	Error       string `json:",omitempty"`
+}
+
+// rateSource is an event count the snapshot trigger watches: the live
+// counters of a buffer, or the consumer positions of monitored rings
+type rateSource interface {
+	sourceBenchmark() string
+	eventsSoFar() int64
+	bufferOccupancy() []float64
+}
+
+// rateWatch is the trigger's state for one source
+type rateWatch struct {
+	events   int64
+	at       time.Time
+	rate     float64 // Events/s over the previous window; 0 before the first
+	lastShot time.Time
+}
+
+// snapshotter watches the event rate of every running benchmark and
+// takes a snapshot when it drops, saving it next to the output
+var snapshotter struct {
+	sync.Mutex
+	once      sync.Once
+	threshold float64 // Fraction of the previous window's rate that may be lost
+	base      string  // Output path without its extension
+	seq       int     // Snapshots saved under base
+	taken     int
+	sources   map[rateSource]bool // Ring monitors, registered while they run
+	watches   map[rateSource]*rateWatch
+	procs     map[int]uint64 // CPU ticks of each process at the last sample
+	irqs      map[string]uint64
+	gc        runtime.MemStats
+	sampled   time.Time
+	shots     []snapshotShot
+}
+
+// snapshotShot is a snapshot taken of a benchmark
+type snapshotShot struct {
+	benchmark string
+	ref       SnapshotRef
+}
+
+// startSnapshots arms the trigger for drops of more than percent, saving
+// snapshots next to output. Later calls only move them to their output,
+// so a suite's benchmarks each get their own.
+func startSnapshots(percent float64, output string) {
+	snapshotter.Lock()
+	base := strings.TrimSuffix(output, filepath.Ext(output))
+	if base != snapshotter.base {
+		snapshotter.base, snapshotter.seq = base, 0
+	}
+	snapshotter.threshold = percent / 100
+	snapshotter.Unlock()
+	snapshotter.once.Do(func() {
+		metricsRegistry.Lock()
+		metricsRegistry.tracking = true
+		metricsRegistry.Unlock()
+		snapshotter.Lock()
+		snapshotter.sources = make(map[rateSource]bool)
+		snapshotter.watches = make(map[rateSource]*rateWatch)
+		snapshotter.Unlock()
+		go func() {
+			ticker := time.NewTicker(snapshotWindow)
+			defer ticker.Stop()
+			for now := range ticker.C {
+				checkSnapshots(now)
+			}
+		}()
+	})
+}
+
+// watchRate adds a source to the trigger, if armed
+func watchRate(s rateSource) {
+	snapshotter.Lock()
+	defer snapshotter.Unlock()
+	if snapshotter.sources != nil {
+		snapshotter.sources[s] = true
+	}
+}
+
+// unwatchRate removes a source added by watchRate
+func unwatchRate(s rateSource) {
+	snapshotter.Lock()
+	defer snapshotter.Unlock()
+	delete(snapshotter.sources, s)
+	delete(snapshotter.watches, s)
+}
+
+// checkSnapshots compares each running source's rate over the window that
+// just ended with the window before, and takes a snapshot for those that
+// fell by more than the threshold
+func checkSnapshots(now time.Time) {
+	metricsRegistry.Lock()
+	progress := append([]*Progress(nil), metricsRegistry.progress...)
+	metricsRegistry.Unlock()
+
+	snapshotter.Lock()
+	defer snapshotter.Unlock()
+	running := make(map[rateSource]bool)
+	for s := range snapshotter.sources {
+		running[s] = true
+	}
+	for _, p := range progress {
+		if p.startNs.Load() != 0 && p.endNs.Load() == 0 {
+			running[p] = true
+		}
+	}
+	for s := range snapshotter.watches {
+		if !running[s] {
+			delete(snapshotter.watches, s)
+		}
+	}
+	if len(running) == 0 {
+		snapshotter.sampled = time.Time{}
+		return
+	}
+
+	// Deltas over the window, from the previous sample
+	procs, irqs := readProcessTicks(), readInterrupts()
+	var gc runtime.MemStats
+	runtime.ReadMemStats(&gc)
+	prevProcs, prevIRQs, prevGC, since := snapshotter.procs, snapshotter.irqs, snapshotter.gc, snapshotter.sampled
+	snapshotter.procs, snapshotter.irqs, snapshotter.gc, snapshotter.sampled = procs, irqs, gc, now
+
+	for s := range running {
+		events := s.eventsSoFar()
+		w := snapshotter.watches[s]
+		if w == nil {
+			snapshotter.watches[s] = &rateWatch{events: events, at: now}
+			continue
+		}
+		secs := now.Sub(w.at).Seconds()
+		if secs <= 0 {
+			continue
+		}
+		rate := float64(events-w.events) / secs
+		prev := w.rate
+		w.events, w.at, w.rate = events, now, rate
+		if prev <= 0 || rate >= prev*(1-snapshotter.threshold) || since.IsZero() ||
+			now.Sub(w.lastShot) < snapshotCooldown || snapshotter.taken >= snapshotLimit {
+			continue
+		}
+		w.lastShot = now
+		snapshotter.taken++
+		snap := &SystemSnapshot{
+			Benchmark:      s.sourceBenchmark(),
+			Time:           now.UTC(),
+			WindowSeconds:  secs,
+			PrevThroughput: prev,
+			Throughput:     rate,
+			DropPercent:    100 * (1 - rate/prev),
+			TopCPU:         topProcesses(prevProcs, procs, now.Sub(since)),
+			Interrupts:     topInterrupts(prevIRQs, irqs),
+			Occupancy:      s.bufferOccupancy(),
+			GC: SnapshotGC{
+				Cycles:    gc.NumGC - prevGC.NumGC,
+				PauseNs:   gc.PauseTotalNs - prevGC.PauseTotalNs,
+				HeapBytes: gc.HeapAlloc,
+			},
+		}
+		snapshotter.shots = append(snapshotter.shots, snapshotShot{snap.Benchmark, saveSnapshot(snap)})
+	}
+}
+
+// saveSnapshot writes snap to the next NAME_snapshot_N.json
+func saveSnapshot(snap *SystemSnapshot) SnapshotRef {
+	ref := SnapshotRef{Time: snap.Time, DropPercent: snap.DropPercent}
+	snapshotter.seq++
+	ref.File = fmt.Sprintf("%s_snapshot_%d.json", snapshotter.base, snapshotter.seq)
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err == nil {
+		err = os.WriteFile(ref.File, append(data, '\n'), 0o644)
+	}
+	if err != nil {
+		ref.File, ref.Error = "", err.Error()
+		slog.Warn("Snapshot not saved", "benchmark", snap.Benchmark, "error", err)
+		return ref
+	}
+	slog.Info("Throughput dropped; snapshot saved", "benchmark", snap.Benchmark,
+		"drop_percent", fmt.Sprintf("%.0f", snap.DropPercent), "file", ref.File)
+	return ref
+}
+
+// recordSnapshots attaches the snapshots taken of the benchmark name to
+// the results whose windows they fall in
+func recordSnapshots(name string, results []*BenchmarkResult) {
+	snapshotter.Lock()
+	defer snapshotter.Unlock()
+	for _, r := range results {
+		for _, s := range snapshotter.shots {
+			if s.benchmark == name && !s.ref.Time.Before(r.StartTime) && !s.ref.Time.After(r.EndTime) {
+				r.Snapshots = append(r.Snapshots, s.ref)
+			}
+		}
+	}
+}
+
+// readProcessTicks reads the user and system CPU ticks of every process
+func readProcessTicks() map[int]uint64 {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	ticks := make(map[int]uint64, len(entries))
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if _, t, ok := readProcessStat(pid); ok {
+			ticks[pid] = t
+		}
+	}
+	return ticks
+}
+
+// readProcessStat returns a process's command and user plus system ticks
+func readProcessStat(pid int) (string, uint64, bool) {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return "", 0, false
+	}
+	// The command is in parentheses and may hold spaces and parentheses
+	s := string(data)
+	open, end := strings.IndexByte(s, '('), strings.LastIndexByte(s, ')')
+	if open < 0 || end < open {
+		return "", 0, false
+	}
+	fields := strings.Fields(s[end+1:])
+	if len(fields) < 13 {
+		return "", 0, false
+	}
+	utime, err1 := strconv.ParseUint(fields[11], 10, 64)
+	stime, err2 := strconv.ParseUint(fields[12], 10, 64)
+	if err1 != nil || err2 != nil {
+		return "", 0, false
+	}
+	return s[open+1 : end], utime + stime, true
+}
+
+// topProcesses returns the processes that used the most CPU between two
+// samples taken window apart
+func topProcesses(before, after map[int]uint64, window time.Duration) []ProcessCPU {
+	type busy struct {
+		pid   int
+		ticks uint64
+	}
+	var procs []busy
+	for pid, t := range after {
+		if b, ok := before[pid]; ok && t > b {
+			procs = append(procs, busy{pid, t - b})
+		}
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i].ticks > procs[j].ticks })
+	var top []ProcessCPU
+	for _, p := range procs[:min(len(procs), snapshotTopCPU)] {
+		comm, _, _ := readProcessStat(p.pid)
+		top = append(top, ProcessCPU{
+			PID:        p.pid,
+			Command:    comm,
+			CPUPercent: 100 * float64(p.ticks) / userHZ / window.Seconds(),
+		})
+	}
+	return top
+}
+
+// readInterrupts reads /proc/interrupts as each source's count summed over
+// CPUs, keyed by "IRQ\tdescription"
+func readInterrupts() map[string]uint64 {
+	f, err := os.Open("/proc/interrupts")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	counts := make(map[string]uint64)
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	cpus := 0
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if cpus == 0 {
+			cpus = len(fields) // Header: one column per CPU
+			continue
+		}
+		if len(fields) < 2 || !strings.HasSuffix(fields[0], ":") {
+			continue
+		}
+		var total uint64
+		i := 1
+		for ; i < len(fields) && i <= cpus; i++ {
+			n, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				break
+			}
+			total += n
+		}
+		counts[strings.TrimSuffix(fields[0], ":")+"\t"+strings.Join(fields[i:], " ")] = total
+	}
+	return counts
+}
+
+// topInterrupts returns the interrupt sources that fired most between two
+// samples
+func topInterrupts(before, after map[string]uint64) []InterruptDelta {
+	var deltas []InterruptDelta
+	for key, n := range after {
+		if b, ok := before[key]; ok && n > b {
+			irq, desc, _ := strings.Cut(key, "\t")
+			deltas = append(deltas, InterruptDelta{IRQ: irq, Description: desc, Count: n - b})
+		}
+	}
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i].Count > deltas[j].Count })
+	return deltas[:min(len(deltas), snapshotInterrupts)]
+}
+
+// formatSnapshots renders the snapshots taken in the result's window
+func (r *BenchmarkResult) formatSnapshots() string {
+	var s string
+	for _, snap := range r.Snapshots {
+		where := snap.File
+		if where == "" {
+			where = "not saved: " + snap.Error
+		}
+		s += fmt.Sprintf("Snapshot:        throughput fell %.0f%% at %s; %s\n", snap.DropPercent, formatResultTime(snap.Time), where)
+	}
+	return s
+}
@@ -0,0 +1,9 @@
+// Package stats computes the latency statistics ebpf-bench reports: exact
+// percentiles of a sample, constant-memory streaming moments, HDR-style
+// histograms and t-digests, all over integer nanoseconds.
+//
+// The package is part of the module's stable API (see API.md): from v1 on,
+// exported names are only removed in a new major version, and are marked
+// Deprecated for at least one minor release first. Until then, changes are
+// recorded in api/ and called out in the release notes.
+package stats
@@ -0,0 +1,70 @@
+package stats
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// DefaultHistogramPrecision is the number of significant bits kept per
+// histogram bucket; 5 bits gives 16 sub-buckets per power of two (~6% error)
+const DefaultHistogramPrecision = 5
+
+// HistogramBucket is one exported bucket of a LatencyHistogram
+type HistogramBucket struct {
+	LowNs  uint64 // Inclusive lower bound
+	HighNs uint64 // Inclusive upper bound
+	Count  int64
+}
+
+// LatencyHistogram is an HDR-style log-linear histogram of nanosecond
+// values. Values below 2^precision are counted exactly; larger values are
+// grouped into buckets whose width grows with their magnitude, so relative
+// error stays constant across many orders of magnitude.
+type LatencyHistogram struct {
+	precision uint
+	counts    map[uint64]int64 // Keyed by bucket lower bound
+}
+
+// NewLatencyHistogram creates a histogram keeping precision significant bits
+func NewLatencyHistogram(precision uint) *LatencyHistogram {
+	if precision == 0 || precision > 16 {
+		precision = DefaultHistogramPrecision
+	}
+	return &LatencyHistogram{
+		precision: precision,
+		counts:    make(map[uint64]int64),
+	}
+}
+
+// bucketBounds returns the bucket containing v
+func (h *LatencyHistogram) bucketBounds(v uint64) (low, high uint64) {
+	n := uint(bits.Len64(v))
+	if n <= h.precision {
+		return v, v
+	}
+	shift := n - h.precision
+	low = (v >> shift) << shift
+	return low, low + (uint64(1) << shift) - 1
+}
+
+// Record adds a value to the histogram
+func (h *LatencyHistogram) Record(ns uint64) {
+	low, _ := h.bucketBounds(ns)
+	h.counts[low]++
+}
+
+// Len returns the number of occupied buckets
+func (h *LatencyHistogram) Len() int {
+	return len(h.counts)
+}
+
+// Buckets returns the non-empty buckets in ascending order
+func (h *LatencyHistogram) Buckets() []HistogramBucket {
+	buckets := make([]HistogramBucket, 0, len(h.counts))
+	for low, count := range h.counts {
+		_, high := h.bucketBounds(low)
+		buckets = append(buckets, HistogramBucket{LowNs: low, HighNs: high, Count: count})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].LowNs < buckets[j].LowNs })
+	return buckets
+}
@@ -0,0 +1,268 @@
+package stats
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LatencyUnit selects how latencies are displayed. Latencies are always
+// stored as integer nanoseconds; the unit only affects formatting.
+type LatencyUnit string
+
+const (
+	LatencyUnitNanoseconds  LatencyUnit = "ns"
+	LatencyUnitMicroseconds LatencyUnit = "us"
+	LatencyUnitMilliseconds LatencyUnit = "ms"
+)
+
+// ParseLatencyUnit parses a -latency-unit flag value
+func ParseLatencyUnit(s string) (LatencyUnit, error) {
+	switch strings.ToLower(s) {
+	case "ns":
+		return LatencyUnitNanoseconds, nil
+	case "us", "µs":
+		return LatencyUnitMicroseconds, nil
+	case "ms":
+		return LatencyUnitMilliseconds, nil
+	}
+	return "", fmt.Errorf("unknown latency unit %q (want ns, us or ms)", s)
+}
+
+// divisor returns the number of nanoseconds in one unit
+func (u LatencyUnit) divisor() float64 {
+	switch u {
+	case LatencyUnitMicroseconds:
+		return 1e3
+	case LatencyUnitMilliseconds:
+		return 1e6
+	}
+	return 1
+}
+
+// Format renders a nanosecond value in this unit
+func (u LatencyUnit) Format(ns float64) string {
+	if u == "" {
+		u = LatencyUnitMicroseconds
+	}
+	if u == LatencyUnitNanoseconds {
+		return fmt.Sprintf("%.0f %s", ns, u)
+	}
+	return fmt.Sprintf("%.3f %s", ns/u.divisor(), u)
+}
+
+// DefaultQuantiles are the percentiles reported when none are configured
+var DefaultQuantiles = []float64{0.5, 0.9, 0.99, 0.999}
+
+// ParseQuantiles parses a comma-separated list such as "0.5,0.99,0.999"
+func ParseQuantiles(s string) ([]float64, error) {
+	var qs []float64
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		q, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quantile %q: %w", field, err)
+		}
+		if q <= 0 || q > 1 {
+			return nil, fmt.Errorf("quantile %v out of range (0, 1]", q)
+		}
+		qs = append(qs, q)
+	}
+	if len(qs) == 0 {
+		return nil, fmt.Errorf("no quantiles given")
+	}
+	sort.Float64s(qs)
+	return qs, nil
+}
+
+// QuantileKey names a quantile the way latency tools usually do:
+// 0.5 -> "p50", 0.99 -> "p99", 0.999 -> "p999"
+func QuantileKey(q float64) string {
+	pct := strconv.FormatFloat(q*100, 'f', -1, 64)
+	return "p" + strings.Replace(pct, ".", "", 1)
+}
+
+// LatencyStats holds latency statistics in integer nanoseconds
+type LatencyStats struct {
+	Samples     int64        // Number of latency samples
+	MinNs       uint64       // Minimum latency
+	MaxNs       uint64       // Maximum latency
+	SumNs       uint64       // Sum of all latencies, saturating at MaxUint64
+	AvgNs       float64      // Mean latency
+	StdDevNs    float64      // Population standard deviation
+	VarianceNs2 float64      // Population variance, in ns²
+	JitterNs    float64      // Mean absolute difference between consecutive samples
+	Percentiles []Percentile // In ascending quantile order
+}
+
+// Percentile is a single latency quantile
+type Percentile struct {
+	Quantile float64
+	ValueNs  uint64
+}
+
+// Percentile looks up the value of quantile q, if it was computed
+func (s LatencyStats) Percentile(q float64) (uint64, bool) {
+	for _, p := range s.Percentiles {
+		if p.Quantile == q {
+			return p.ValueNs, true
+		}
+	}
+	return 0, false
+}
+
+// ComputeLatencyStats derives statistics from raw nanosecond samples.
+// The slice is sorted in place.
+func ComputeLatencyStats(samples []uint64, quantiles []float64) LatencyStats {
+	var s LatencyStats
+	if len(samples) == 0 {
+		return s
+	}
+	s.JitterNs = jitter(samples) // Needs arrival order, so before sorting
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+	s.Samples = int64(len(samples))
+	s.MinNs = samples[0]
+	s.MaxNs = samples[len(samples)-1]
+	// Accumulate in 128 bits so the mean survives a sum past 2^64 ns;
+	// SumNs saturates instead of wrapping
+	var hi, lo, carry uint64
+	for _, v := range samples {
+		lo, carry = bits.Add64(lo, v, 0)
+		hi += carry
+	}
+	s.SumNs = lo
+	if hi > 0 {
+		s.SumNs = math.MaxUint64
+	}
+	s.AvgNs = (float64(hi)*(1<<64) + float64(lo)) / float64(s.Samples)
+
+	var sq float64
+	for _, v := range samples {
+		d := float64(v) - s.AvgNs
+		sq += d * d
+	}
+	s.VarianceNs2 = sq / float64(s.Samples)
+	s.StdDevNs = math.Sqrt(s.VarianceNs2)
+
+	s.Percentiles = make([]Percentile, 0, len(quantiles))
+	for _, q := range quantiles {
+		s.Percentiles = append(s.Percentiles, Percentile{Quantile: q, ValueNs: percentile(samples, q)})
+	}
+
+	return s
+}
+
+// jitter returns the mean absolute difference between consecutive samples,
+// which separates steady delivery from bursts that share the same mean
+func jitter(samples []uint64) float64 {
+	if len(samples) < 2 {
+		return 0
+	}
+	var sum float64
+	for i := 1; i < len(samples); i++ {
+		sum += math.Abs(float64(samples[i]) - float64(samples[i-1]))
+	}
+	return sum / float64(len(samples)-1)
+}
+
+// StreamingLatency accumulates latency statistics one sample at a time in
+// constant memory, using Welford's method for the variance. It covers
+// every sample when only a bounded subset is kept for percentiles.
+type StreamingLatency struct {
+	n         int64
+	min, max  uint64
+	hi, lo    uint64 // 128-bit sum
+	mean, m2  float64
+	prev      uint64
+	jitterSum float64
+}
+
+// Record adds one sample
+func (s *StreamingLatency) Record(ns uint64) {
+	var carry uint64
+	s.lo, carry = bits.Add64(s.lo, ns, 0)
+	s.hi += carry
+	if s.n == 0 || ns < s.min {
+		s.min = ns
+	}
+	if ns > s.max {
+		s.max = ns
+	}
+	if s.n > 0 {
+		s.jitterSum += math.Abs(float64(ns) - float64(s.prev))
+	}
+	s.prev = ns
+
+	s.n++
+	d := float64(ns) - s.mean
+	s.mean += d / float64(s.n)
+	s.m2 += d * (float64(ns) - s.mean)
+}
+
+// Stats returns the accumulated statistics. It has no percentiles; fill
+// them from a sample with ComputeLatencyStats if needed.
+func (s *StreamingLatency) Stats() LatencyStats {
+	if s.n == 0 {
+		return LatencyStats{}
+	}
+	st := LatencyStats{
+		Samples:     s.n,
+		MinNs:       s.min,
+		MaxNs:       s.max,
+		SumNs:       s.lo,
+		AvgNs:       s.mean,
+		VarianceNs2: s.m2 / float64(s.n),
+	}
+	if s.hi > 0 {
+		st.SumNs = math.MaxUint64
+	}
+	st.StdDevNs = math.Sqrt(st.VarianceNs2)
+	if s.n > 1 {
+		st.JitterNs = s.jitterSum / float64(s.n-1)
+	}
+	return st
+}
+
+// Merge folds the statistics of o into s, as if every sample of o had
+// been recorded after those of s. Jitter across the seam is not counted.
+func (s *StreamingLatency) Merge(o *StreamingLatency) {
+	if o.n == 0 {
+		return
+	}
+	if s.n == 0 {
+		*s = *o
+		return
+	}
+	var carry uint64
+	n := s.n + o.n
+	d := o.mean - s.mean
+	s.lo, carry = bits.Add64(s.lo, o.lo, 0)
+	s.hi += o.hi + carry
+	s.min = min(s.min, o.min)
+	s.max = max(s.max, o.max)
+	s.m2 += o.m2 + d*d*float64(s.n)*float64(o.n)/float64(n)
+	s.mean += d * float64(o.n) / float64(n)
+	s.jitterSum += o.jitterSum
+	s.prev = o.prev
+	s.n = n
+}
+
+// percentile returns the nearest-rank quantile of sorted samples
+func percentile(sorted []uint64, q float64) uint64 {
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
@@ -0,0 +1,173 @@
+package stats
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"unsafe"
+)
+
+// DefaultTDigestCompression bounds a t-digest to about 100 centroids,
+// which keeps p99 within a fraction of a percent of exact
+const DefaultTDigestCompression = 200
+
+// centroid is a cluster of samples in a t-digest
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// TDigest estimates quantiles of a stream in constant memory (Dunning's
+// merging t-digest). Centroids are small near the tails and large in the
+// middle, so extreme quantiles stay accurate however long the stream.
+type TDigest struct {
+	compression float64
+	centroids   []centroid // Merged, ascending by mean
+	buffer      []centroid // Unmerged samples
+	scratch     []centroid // Reused by compress, so Add does not allocate
+	count       float64
+	min, max    float64
+}
+
+// NewTDigest creates a t-digest; a larger compression is more accurate
+// and keeps more centroids
+func NewTDigest(compression float64) *TDigest {
+	if compression <= 0 {
+		compression = DefaultTDigestCompression
+	}
+	return &TDigest{
+		compression: compression,
+		buffer:      make([]centroid, 0, int(5*compression)),
+	}
+}
+
+// Add adds one sample
+func (t *TDigest) Add(x float64) {
+	if t.count == 0 || x < t.min {
+		t.min = x
+	}
+	if t.count == 0 || x > t.max {
+		t.max = x
+	}
+	t.count++
+	t.buffer = append(t.buffer, centroid{x, 1})
+	if len(t.buffer) == cap(t.buffer) {
+		t.compress()
+	}
+}
+
+// Merge folds the samples of o into t
+func (t *TDigest) Merge(o *TDigest) {
+	if o.count == 0 {
+		return
+	}
+	if t.count == 0 || o.min < t.min {
+		t.min = o.min
+	}
+	if t.count == 0 || o.max > t.max {
+		t.max = o.max
+	}
+	t.count += o.count
+	t.buffer = append(t.buffer, o.centroids...)
+	t.buffer = append(t.buffer, o.buffer...)
+	t.compress()
+}
+
+// k is the scale function k2, which limits centroid size by quantile.
+// Its logarithmic tails keep the centroids near p999 small enough to
+// resolve a tail that is a step rather than a slope.
+func (t *TDigest) k(q float64) float64 {
+	q = min(max(q, 1e-15), 1-1e-15)
+	norm := 4*math.Log(max(t.count/t.compression, 1)) + 24
+	return t.compression / norm * math.Log(q/(1-q))
+}
+
+// compress merges the buffer into the centroids
+func (t *TDigest) compress() {
+	if len(t.buffer) == 0 {
+		return
+	}
+	all := append(append(t.scratch[:0], t.centroids...), t.buffer...)
+	slices.SortFunc(all, func(a, b centroid) int { return cmp.Compare(a.mean, b.mean) })
+	t.scratch = all
+	merged := t.centroids[:0] // Already copied into all
+	cur := all[0]
+	var before float64 // Weight of the centroids already emitted
+	for _, c := range all[1:] {
+		if t.k((before+cur.weight+c.weight)/t.count)-t.k(before/t.count) <= 1 {
+			cur.weight += c.weight
+			cur.mean += (c.mean - cur.mean) * c.weight / cur.weight
+			continue
+		}
+		before += cur.weight
+		merged = append(merged, cur)
+		cur = c
+	}
+	t.centroids = append(merged, cur)
+	t.buffer = t.buffer[:0]
+}
+
+// Count returns the number of samples added
+func (t *TDigest) Count() int64 {
+	return int64(t.count)
+}
+
+// Centroids returns the number of centroids once merged, a measure of the
+// digest's memory
+func (t *TDigest) Centroids() int {
+	t.compress()
+	return len(t.centroids)
+}
+
+// StateBytes approximates the memory t holds for its centroids
+func (t *TDigest) StateBytes() uint64 {
+	return uint64(unsafe.Sizeof(*t)) +
+		uint64(cap(t.centroids)+cap(t.buffer)+cap(t.scratch))*uint64(unsafe.Sizeof(centroid{}))
+}
+
+// Quantile estimates quantile q by interpolating between the centres of
+// neighbouring centroids; NaN when empty
+func (t *TDigest) Quantile(q float64) float64 {
+	t.compress()
+	cs := t.centroids
+	switch {
+	case len(cs) == 0:
+		return math.NaN()
+	case q <= 0:
+		return t.min
+	case q >= 1:
+		return t.max
+	case len(cs) == 1:
+		return cs[0].mean
+	}
+	target := q * t.count
+	if half := cs[0].weight / 2; target < half {
+		return t.min + (cs[0].mean-t.min)*target/half
+	}
+	last := cs[len(cs)-1]
+	if half := last.weight / 2; target > t.count-half {
+		return last.mean + (t.max-last.mean)*(target-(t.count-half))/half
+	}
+	cum := cs[0].weight / 2 // Weight up to the centre of centroid i
+	for i := 0; i < len(cs)-1; i++ {
+		gap := (cs[i].weight + cs[i+1].weight) / 2
+		if target <= cum+gap {
+			return cs[i].mean + (cs[i+1].mean-cs[i].mean)*(target-cum)/gap
+		}
+		cum += gap
+	}
+	return last.mean
+}
+
+// Percentiles returns the quantiles of t in the form of LatencyStats,
+// rounded to whole nanoseconds
+func (t *TDigest) Percentiles(quantiles []float64) []Percentile {
+	if t.count == 0 {
+		return nil
+	}
+	ps := make([]Percentile, 0, len(quantiles))
+	for _, q := range quantiles {
+		ps = append(ps, Percentile{Quantile: q, ValueNs: uint64(math.Round(t.Quantile(q)))})
+	}
+	return ps
+}
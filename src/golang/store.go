@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// defaultStorePath is the history store used when -store is given without
+// a path by commands that only read or maintain the store
+const defaultStorePath = "benchmarks/results/history.jsonl"
+
+// StoredRun is one result in the history store
+type StoredRun struct {
+	ID       string
+	StoredAt time.Time
+	Tags     []string // Labels such as a baseline name; see prune
+	Invalid  bool     // Marked as not to be trusted
+	Result   *BenchmarkResult
+
+	GitCommit string `json:",omitempty"` // Harness source revision; see gitCommit
+}
+
+// ResultStore is the benchmark history: one StoredRun per line in a JSON
+// lines file, so concurrent runs can append without coordination and the
+// file stays readable by jq and pandas. A path of the form sqlite:FILE
+// keeps the same runs in a SQLite database instead; see store_sqlite.go.
+type ResultStore struct {
+	path   string
+	sqlite bool
+}
+
+// OpenResultStore returns the store at path. The file is created on the
+// first Append.
+func OpenResultStore(path string) *ResultStore {
+	if db, ok := strings.CutPrefix(path, sqliteStorePrefix); ok {
+		return &ResultStore{path: db, sqlite: true}
+	}
+	return &ResultStore{path: path}
+}
+
+// String returns the path the store was opened with
+func (s *ResultStore) String() string {
+	if s.sqlite {
+		return sqliteStorePrefix + s.path
+	}
+	return s.path
+}
+
+// Append stores results with the given tags and returns their IDs
+func (s *ResultStore) Append(results []*BenchmarkResult, tags []string) ([]string, error) {
+	runs := make([]StoredRun, 0, len(results))
+	ids := make([]string, 0, len(results))
+	now := time.Now()
+	commit := gitCommit()
+	for _, r := range results {
+		run := StoredRun{ID: newRunID(), StoredAt: now, Tags: tags, Result: r, GitCommit: commit}
+		runs = append(runs, run)
+		ids = append(ids, run.ID)
+	}
+	if s.sqlite {
+		if err := s.sqliteAppend(runs); err != nil {
+			return nil, err
+		}
+		return ids, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %w", err)
+	}
+	var buf bytes.Buffer
+	for _, run := range runs {
+		data, err := json.Marshal(run)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal result: %w", err)
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	err := appendToFile(s.path, func(f *os.File, _ bool) error {
+		_, err := f.Write(buf.Bytes())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// Load reads every stored run. A missing store is empty.
+func (s *ResultStore) Load() ([]StoredRun, error) {
+	if s.sqlite {
+		return s.sqliteLoad("")
+	}
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store: %w", err)
+	}
+	defer f.Close()
+
+	var runs []StoredRun
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var run StoredRun
+		if err := json.Unmarshal(sc.Bytes(), &run); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", s.path, line, err)
+		}
+		if run.Result == nil {
+			return nil, fmt.Errorf("%s:%d: run %s has no result", s.path, line, run.ID)
+		}
+		run.Result.normalizeTimes()
+		runs = append(runs, run)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read store: %w", err)
+	}
+	return runs, nil
+}
+
+// Replace writes back runs loaded by a maintenance command, dropping the
+// runs with IDs in deleted. A SQLite store updates just those rows; a
+// JSON lines store is rewritten atomically as runs, so runs appended
+// since the Load are lost from it.
+func (s *ResultStore) Replace(runs []StoredRun, deleted []string) error {
+	if s.sqlite {
+		return s.sqliteReplace(runs, deleted)
+	}
+	var buf bytes.Buffer
+	for _, run := range runs {
+		data, err := json.Marshal(run)
+		if err != nil {
+			return fmt.Errorf("failed to marshal result: %w", err)
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	return writeFileAtomic(s.path, buf.Bytes())
+}
+
+// StoreQuery selects stored runs. Zero fields match everything.
+type StoreQuery struct {
+	From      time.Time // Runs started at or after
+	To        time.Time // Runs started before
+	Benchmark string    // Subcommand or result name, case-insensitive
+}
+
+// Match reports whether a run satisfies the query
+func (q StoreQuery) Match(run StoredRun) bool {
+	r := run.Result
+	if !q.From.IsZero() && r.StartTime.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !r.StartTime.Before(q.To) {
+		return false
+	}
+	if q.Benchmark != "" && !strings.EqualFold(q.Benchmark, r.Benchmark) && !strings.EqualFold(q.Benchmark, r.Name) {
+		return false
+	}
+	return true
+}
+
+// Query returns the stored runs matching q, in storage order
+func (s *ResultStore) Query(q StoreQuery) ([]StoredRun, error) {
+	var runs []StoredRun
+	var err error
+	if s.sqlite {
+		runs, err = s.sqliteLoad(q.sqliteWhere())
+	} else {
+		runs, err = s.Load()
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []StoredRun
+	for _, run := range runs {
+		if q.Match(run) {
+			out = append(out, run)
+		}
+	}
+	return out, nil
+}
+
+// parseQueryTime parses a -from/-to value: a date (2024-05-01) or an
+// RFC 3339 timestamp. Dates are midnight local time.
+func parseQueryTime(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q (want 2006-01-02 or RFC 3339)", s)
+	}
+	return t, nil
+}
+
+// gitCommit returns the revision of the harness source: the revision the
+// binary was built at, or else HEAD of the checkout it was built from,
+// with "-dirty" for uncommitted changes. It is empty when neither is
+// known.
+func gitCommit() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		var commit string
+		var modified bool
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				commit = s.Value
+			case "vcs.modified":
+				modified = s.Value == "true"
+			}
+		}
+		if commit != "" {
+			if modified {
+				commit += "-dirty"
+			}
+			return commit
+		}
+	}
+	// go run and go test builds carry no VCS stamp; ask git about the
+	// checkout the harness was built from, not the working directory
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		return ""
+	}
+	dir := filepath.Dir(file)
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	commit := strings.TrimSpace(string(out))
+	if st, err := exec.Command("git", "-C", dir, "status", "--porcelain", "--untracked-files=no").Output(); err == nil && len(bytes.TrimSpace(st)) > 0 {
+		commit += "-dirty"
+	}
+	return commit
+}
+
+// newRunID returns a random identifier for a stored run
+func newRunID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
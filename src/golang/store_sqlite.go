@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqliteStorePrefix selects a SQLite history store, as in
+// -store sqlite:results.db
+const sqliteStorePrefix = "sqlite:"
+
+// sqliteTimeLayout keeps stored times in one zone and width, so they
+// compare correctly as text
+const sqliteTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// sqliteSchema is the runs table. Each row holds the whole StoredRun as
+// JSON; the other columns copy out what queries and dashboards filter and
+// plot on, so the database is useful from sqlite3 and Grafana directly.
+// The real columns are NULL where the value is NaN or infinite.
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS runs (
+	seq            INTEGER PRIMARY KEY,
+	id             TEXT NOT NULL UNIQUE,
+	stored_at      TEXT NOT NULL,
+	started_at     TEXT NOT NULL,
+	benchmark      TEXT NOT NULL,
+	name           TEXT NOT NULL,
+	language       TEXT NOT NULL,
+	hostname       TEXT NOT NULL,
+	kernel         TEXT NOT NULL,
+	git_commit     TEXT NOT NULL,
+	tags           TEXT NOT NULL,
+	invalid        INTEGER NOT NULL,
+	throughput     REAL,
+	drop_rate      REAL,
+	latency_p99_ns INTEGER,
+	run            TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS runs_benchmark_started ON runs (benchmark, started_at);
+`
+
+// runSQL runs the sqlite3 shell on the store's database with script on
+// stdin and returns what it printed. Talking to the shell keeps the
+// harness a static, cgo-free binary; sqlite3 3.33 or later is needed for
+// -json.
+func (s *ResultStore) runSQL(script string, args ...string) ([]byte, error) {
+	bin, err := exec.LookPath("sqlite3")
+	if err != nil {
+		return nil, fmt.Errorf("sqlite3 not found, which %s%s stores need (install the sqlite3 package): %w", sqliteStorePrefix, s.path, err)
+	}
+	cmd := exec.Command(bin, append([]string{"-bail", "-batch"}, append(args, s.path)...)...)
+	cmd.Stdin = strings.NewReader(script)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("sqlite3 %s: %v: %s", s.path, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// sqliteColumns are the columns sqliteInsert sets, in order
+var sqliteColumns = []string{"id", "stored_at", "started_at", "benchmark", "name", "language", "hostname", "kernel",
+	"git_commit", "tags", "invalid", "throughput", "drop_rate", "latency_p99_ns", "run"}
+
+// sqliteInsert writes the INSERT of one run. With upsert, a row of the
+// same ID is updated in place, keeping its position.
+func sqliteInsert(sb *strings.Builder, run StoredRun, upsert bool) error {
+	data, err := json.Marshal(run)
+	if err != nil {
+		return fmt.Errorf("failed to marshal result: %w", err)
+	}
+	r := run.Result
+	p99 := "NULL"
+	if v, ok := r.Latency.Percentile(0.99); ok {
+		p99 = strconv.FormatUint(v, 10)
+	}
+	invalid := 0
+	if run.Invalid {
+		invalid = 1
+	}
+	fmt.Fprintf(sb, "INSERT INTO runs (%s) VALUES (%s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %d, %s, %s, %s, %s)",
+		strings.Join(sqliteColumns, ", "),
+		sqlQuote(run.ID), sqlQuote(sqliteTime(run.StoredAt)), sqlQuote(sqliteTime(r.StartTime)),
+		sqlQuote(r.Benchmark), sqlQuote(r.Name), sqlQuote(r.Language), sqlQuote(r.Host.Hostname),
+		sqlQuote(r.Host.KernelRelease), sqlQuote(run.GitCommit), sqlQuote(strings.Join(run.Tags, ",")), invalid,
+		sqlReal(r.Throughput), sqlReal(r.DropRate), p99, sqlQuote(string(data)))
+	if upsert {
+		set := make([]string, 0, len(sqliteColumns)-1)
+		for _, c := range sqliteColumns[1:] {
+			set = append(set, c+" = excluded."+c)
+		}
+		sb.WriteString(" ON CONFLICT (id) DO UPDATE SET " + strings.Join(set, ", "))
+	}
+	sb.WriteString(";\n")
+	return nil
+}
+
+// sqliteAppend adds runs in one transaction
+func (s *ResultStore) sqliteAppend(runs []StoredRun) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create store directory: %w", err)
+	}
+	var sb strings.Builder
+	sb.WriteString(sqliteSchema)
+	sb.WriteString("BEGIN;\n")
+	for _, run := range runs {
+		if err := sqliteInsert(&sb, run, false); err != nil {
+			return err
+		}
+	}
+	sb.WriteString("COMMIT;\n")
+	_, err := s.runSQL(sb.String())
+	return err
+}
+
+// sqliteReplace deletes the runs named in deleted and updates runs in
+// place, in one transaction. Only those rows are touched, so runs
+// appended since the caller's Load are kept.
+func (s *ResultStore) sqliteReplace(runs []StoredRun, deleted []string) error {
+	var sb strings.Builder
+	sb.WriteString(sqliteSchema)
+	sb.WriteString("BEGIN;\n")
+	for _, id := range deleted {
+		fmt.Fprintf(&sb, "DELETE FROM runs WHERE id = %s;\n", sqlQuote(id))
+	}
+	for _, run := range runs {
+		if err := sqliteInsert(&sb, run, true); err != nil {
+			return err
+		}
+	}
+	sb.WriteString("COMMIT;\n")
+	_, err := s.runSQL(sb.String())
+	return err
+}
+
+// sqliteLoad reads the runs matching where, in storage order. A missing
+// database is empty.
+func (s *ResultStore) sqliteLoad(where string) ([]StoredRun, error) {
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	query := "SELECT run FROM runs"
+	if where != "" {
+		query += " WHERE " + where
+	}
+	out, err := s.runSQL(sqliteSchema+query+" ORDER BY seq;\n", "-json")
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return nil, nil // No rows print nothing rather than []
+	}
+	var rows []struct{ Run string }
+	if err := json.Unmarshal(out, &rows); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.path, err)
+	}
+	runs := make([]StoredRun, 0, len(rows))
+	for _, row := range rows {
+		var run StoredRun
+		if err := json.Unmarshal([]byte(row.Run), &run); err != nil {
+			return nil, fmt.Errorf("%s: %w", s.path, err)
+		}
+		if run.Result == nil {
+			return nil, fmt.Errorf("%s: run %s has no result", s.path, run.ID)
+		}
+		run.Result.normalizeTimes()
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+// sqliteWhere translates q into a WHERE clause over the copied columns
+func (q StoreQuery) sqliteWhere() string {
+	var conds []string
+	if !q.From.IsZero() {
+		conds = append(conds, "started_at >= "+sqlQuote(sqliteTime(q.From)))
+	}
+	if !q.To.IsZero() {
+		conds = append(conds, "started_at < "+sqlQuote(sqliteTime(q.To)))
+	}
+	if q.Benchmark != "" {
+		b := sqlQuote(q.Benchmark)
+		conds = append(conds, fmt.Sprintf("(benchmark = %s COLLATE NOCASE OR name = %s COLLATE NOCASE)", b, b))
+	}
+	return strings.Join(conds, " AND ")
+}
+
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+// sqlQuote renders s as an SQL string literal
+func sqlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// sqlReal renders f as an SQL real; NaN and infinities become NULL
+func sqlReal(f float64) string {
+	if f != f || f > 1e308 || f < -1e308 {
+		return "NULL"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
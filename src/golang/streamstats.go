@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"unsafe"
+)
+
+// streamTrack is the online latency of one sequence of events: the whole
+// buffer, one CPU or one event type
+type streamTrack struct {
+	seen    bool
+	last    uint64
+	count   int64
+	latency StreamingLatency
+	digest  *TDigest
+}
+
+// add notes an event at ts, recording its gap to the previous one
+func (t *streamTrack) add(ts uint64, q *DataQuality, h *LatencyHistogram) {
+	if t.seen {
+		if d, ok := timestampDelta(t.last, ts, q); ok {
+			t.latency.Record(d)
+			t.digest.Add(float64(d))
+			if h != nil {
+				h.Record(d)
+			}
+		}
+	}
+	t.seen = true
+	t.last = ts
+	t.count++
+}
+
+// stats returns the track's latency with t-digest percentiles
+func (t *streamTrack) stats(quantiles []float64) LatencyStats {
+	s := t.latency.Stats()
+	s.Percentiles = t.digest.Percentiles(quantiles)
+	return s
+}
+
+// streamStats are the statistics of an EventBuffer that computes them as
+// events arrive instead of keeping the events. Memory is bounded by the
+// number of CPUs and event types, not the run length.
+type streamStats struct {
+	all       streamTrack
+	cpus      map[uint32]*streamTrack
+	types     map[uint32]*streamTrack
+	histogram *LatencyHistogram
+	quality   DataQuality
+}
+
+func newStreamStats() *streamStats {
+	s := &streamStats{}
+	s.reset()
+	return s
+}
+
+func (s *streamStats) reset() {
+	*s = streamStats{
+		all:       streamTrack{digest: NewTDigest(DefaultTDigestCompression)},
+		cpus:      make(map[uint32]*streamTrack),
+		types:     make(map[uint32]*streamTrack),
+		histogram: NewLatencyHistogram(DefaultHistogramPrecision),
+	}
+}
+
+// track returns the track of key in m, creating it
+func track(m map[uint32]*streamTrack, key uint32) *streamTrack {
+	t, ok := m[key]
+	if !ok {
+		t = &streamTrack{digest: NewTDigest(DefaultTDigestCompression)}
+		m[key] = t
+	}
+	return t
+}
+
+func (s *streamStats) add(e Event) {
+	s.all.add(e.Timestamp, &s.quality, s.histogram)
+	var ignored DataQuality // Already reported by the whole-buffer track
+	track(s.cpus, e.CPU).add(e.Timestamp, &ignored, nil)
+	track(s.types, e.EventType).add(e.Timestamp, &ignored, nil)
+}
+
+// breakdown returns the keys of m in ascending order
+func breakdown(m map[uint32]*streamTrack) []uint32 {
+	keys := make([]uint32, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// cpuStats is GetCPUs for a streaming buffer
+func (s *streamStats) cpuStats(quantiles []float64, duration float64) []CPUStats {
+	var stats []CPUStats
+	for _, cpu := range breakdown(s.cpus) {
+		t := s.cpus[cpu]
+		c := CPUStats{
+			CPU:        cpu,
+			EventCount: t.count,
+			Share:      float64(t.count) / float64(s.all.count),
+			Latency:    t.stats(quantiles),
+		}
+		if duration > 0 {
+			c.Throughput = float64(t.count) / duration
+		}
+		stats = append(stats, c)
+	}
+	return stats
+}
+
+// eventTypeStats is GetEventTypeStats for a streaming buffer
+func (s *streamStats) eventTypeStats(quantiles []float64, duration float64) []EventTypeStats {
+	if len(s.types) < 2 {
+		return nil
+	}
+	var stats []EventTypeStats
+	for _, typ := range breakdown(s.types) {
+		t := s.types[typ]
+		st := EventTypeStats{
+			EventType:  typ,
+			Name:       eventTypeName(typ),
+			EventCount: t.count,
+			Share:      float64(t.count) / float64(s.all.count),
+			Latency:    t.stats(quantiles),
+		}
+		if duration > 0 {
+			st.Throughput = float64(t.count) / duration
+		}
+		stats = append(stats, st)
+	}
+	return stats
+}
+
+// StreamingStats describe a run whose statistics were computed online.
+// Its percentiles are t-digest estimates rather than exact ranks.
+type StreamingStats struct {
+	Compression float64
+	Centroids   int    // In the whole-buffer digest
+	Tracks      int    // Digests kept: the whole buffer, each CPU and each event type
+	StateBytes  uint64 // Approximate memory of the digests and histogram
+}
+
+// summary describes the memory the statistics took
+func (s *streamStats) summary() *StreamingStats {
+	st := &StreamingStats{
+		Compression: DefaultTDigestCompression,
+		Centroids:   s.all.digest.Centroids(),
+		Tracks:      1 + len(s.cpus) + len(s.types),
+	}
+	tracks := append([]*streamTrack{&s.all}, mapValues(s.cpus)...)
+	tracks = append(tracks, mapValues(s.types)...)
+	for _, t := range tracks {
+		st.StateBytes += uint64(unsafe.Sizeof(*t)) + t.digest.StateBytes()
+	}
+	st.StateBytes += uint64(s.histogram.Len()) * 16 // Key and count per bucket
+	return st
+}
+
+func mapValues(m map[uint32]*streamTrack) []*streamTrack {
+	values := make([]*streamTrack, 0, len(m))
+	for _, t := range m {
+		values = append(values, t)
+	}
+	return values
+}
+
+// formatStreaming renders the online statistics state, if used
+func (r *BenchmarkResult) formatStreaming() string {
+	s := r.Streaming
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("Streaming:       t-digest (compression %.0f, %d centroids), %d tracks in %d bytes; percentiles are estimates\n",
+		s.Compression, s.Centroids, s.Tracks, s.StateBytes)
+}
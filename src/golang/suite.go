@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultSuite is the benchmark list run by the suite subcommand
+const defaultSuite = "ringbuf,perfbuf,maps,xdp,tc"
+
+// suiteRun is one benchmark invocation of a suite
+type suiteRun struct {
+	name string
+	args []string
+}
+
+// runSuite is the entry point of the suite subcommand. Each benchmark runs
+// with its own default flags plus the shared flags given to the suite, or
+// with the settings declared in a -config file. With -start-at or -every
+// the suite runs on a wall-clock schedule instead of once, right away.
+func runSuite(args []string) error {
+	fs := flag.NewFlagSet("suite", flag.ExitOnError)
+	common := addBenchFlags(fs, "suite_results.json", true)
+	names := fs.String("benchmarks", defaultSuite, "Comma-separated benchmarks to run, in order")
+	configFile := fs.String("config", "", "Suite config file (YAML or JSON); overrides -benchmarks")
+	parallel := fs.Bool("parallel", false, "Run benchmarks concurrently (CPU accounting then covers all of them)")
+	calibrate := fs.Duration("calibrate", 0, "Measure the harness latency floor for this long before the benchmarks (0 skips)")
+	scheduleFlags := addScheduleFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return err
+	}
+	sched, err := scheduleFlags.schedule(time.Now())
+	if err != nil {
+		return err
+	}
+	defaultDuration := opts.Duration
+
+	var runs []suiteRun
+	if *configFile != "" {
+		cfg, err := LoadSuiteConfig(*configFile)
+		if err != nil {
+			return err
+		}
+		if cfg.Duration.d > 0 {
+			defaultDuration = cfg.Duration.d
+		}
+		*parallel = *parallel || cfg.Parallel
+		if opts.Verbose && cfg.Name != "" {
+			PrintBenchmarkHeader("Suite: " + cfg.Name)
+		}
+		for _, e := range cfg.Benchmarks {
+			duration := defaultDuration
+			if e.Duration.d > 0 {
+				duration = e.Duration.d
+			}
+			runs = append(runs, suiteRun{e.Benchmark, suiteArgs(e.Benchmark, duration, opts, e.flags())})
+		}
+	} else {
+		for _, name := range splitList(*names) {
+			if _, ok := benchmarks[name]; !ok {
+				return fmt.Errorf("unknown benchmark %q", name)
+			}
+			runs = append(runs, suiteRun{name, suiteArgs(name, defaultDuration, opts, nil)})
+		}
+	}
+
+	// Calibration runs first and alone, so its floor is not inflated by
+	// concurrent benchmarks
+	if *calibrate > 0 {
+		runs = append([]suiteRun{{"calibrate", suiteArgs("calibrate", *calibrate, opts, nil)}}, runs...)
+	}
+
+	// Benchmarks the host cannot run as configured are downgraded or skipped
+	caps := hostCapabilities()
+	kept := runs[:0]
+	for _, run := range runs {
+		args, notes, skip := adaptToHost(run.name, run.args, caps)
+		for _, note := range notes {
+			slog.Warn(note, "benchmark", run.name)
+		}
+		if !skip {
+			kept = append(kept, suiteRun{run.name, args})
+		}
+	}
+	runs = kept
+
+	// An interrupt stops the running benchmarks, which keep their partial
+	// results, and skips the rest, including later scheduled runs
+	ctx, stop := signalContext()
+	defer stop()
+	if sched == nil {
+		all, err := runSuiteOnce(ctx, runs, *parallel, common)
+		if err != nil {
+			return err
+		}
+		emitSuiteResults(all, opts)
+		return nil
+	}
+
+	slog.Info("Suite scheduled", "schedule", sched.label())
+	id := sched.start.Format(time.RFC3339)
+	failed, slot := 0, 0
+	for run := 1; sched.runs == 0 || run <= sched.runs; run++ {
+		next, planned := sched.nextSlot(time.Now(), slot)
+		if next > slot {
+			slog.Warn("Skipping missed scheduled runs", "missed", next-slot)
+		}
+		slot = next + 1
+		slog.Info("Waiting for scheduled run", "run", run, "at", planned.Format(time.RFC3339))
+		if !waitUntil(ctx, planned) {
+			break
+		}
+		all, err := runSuiteOnce(ctx, runs, *parallel, common)
+		if err != nil {
+			// Unattended runs carry on; the failure is reported at the end
+			slog.Error("Scheduled run failed", "run", run, "err", err)
+			failed++
+			continue
+		}
+		for _, r := range all {
+			r.Scheduled = &ScheduledRun{Schedule: id, Run: run, Runs: sched.runs, Planned: planned}
+		}
+		runOpts := opts
+		runOpts.Output = scheduledOutput(opts, run)
+		emitSuiteResults(all, runOpts)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d scheduled run(s) failed", failed)
+	}
+	return nil
+}
+
+// runSuiteOnce runs the suite's benchmarks, one after another or
+// concurrently, and returns their results in declaration order. Concurrent
+// benchmarks run under the suite's log handler and GC settings, applied
+// once before the first of them starts.
+func runSuiteOnce(ctx context.Context, runs []suiteRun, parallel bool, common *benchFlags) ([]*BenchmarkResult, error) {
+	results := make([][]*BenchmarkResult, len(runs))
+	errs := make([]error, len(runs))
+	var wg sync.WaitGroup
+	defer processSettingsHeld.Store(false)
+	for i, run := range runs {
+		if parallel && run.name != "calibrate" && !processSettingsHeld.Load() {
+			if _, err := common.applyProcessSettings(); err != nil {
+				return nil, err
+			}
+			processSettingsHeld.Store(true)
+		}
+		slog.Info("Starting benchmark", "benchmark", run.name, "run", i+1, "of", len(runs))
+		if !parallel || run.name == "calibrate" {
+			results[i], _, errs[i] = runIterations(ctx, run.name, benchmarks[run.name].run, run.args)
+			if errs[i] != nil || ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, run suiteRun) {
+			defer wg.Done()
+			results[i], _, errs[i] = runIterations(ctx, run.name, benchmarks[run.name].run, run.args)
+		}(i, run)
+	}
+	wg.Wait()
+
+	var all []*BenchmarkResult
+	for i, run := range runs {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("%s: %w", run.name, errs[i])
+		}
+		all = append(all, results[i]...)
+	}
+	return all, nil
+}
+
+// emitSuiteResults saves and prints a suite's results with its report
+// and aggregate tables
+func emitSuiteResults(all []*BenchmarkResult, opts benchOptions) {
+	emitResults(all, opts)
+	printReportTable(all, opts.LatencyUnit)
+	emitAggregates(all, opts)
+}
+
+// suiteArgs builds a benchmark's arguments from the suite's shared flags
+// and the benchmark-specific flags
+func suiteArgs(name string, duration time.Duration, opts benchOptions, extra []string) []string {
+	args := []string{"-latency-unit", string(opts.LatencyUnit)}
+	if benchmarks[name].timed {
+		args = append(args, "-d", duration.String())
+	}
+	if opts.Verbose {
+		args = append(args, "-v")
+	}
+	if opts.LogLevel != "" {
+		args = append(args, "-log-level", opts.LogLevel)
+	}
+	args = append(args, "-log-format", opts.LogFormat)
+	if opts.Iterations > 1 {
+		args = append(args, "-iterations", strconv.Itoa(opts.Iterations))
+	}
+	return append(args, extra...)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SuiteConfig declares a benchmark suite. It is loaded from JSON, or from
+// YAML for any other file extension.
+type SuiteConfig struct {
+	Name       string       `json:"name"`
+	Parallel   bool         `json:"parallel"`  // Run benchmarks concurrently instead of in order
+	Duration   durationFlag `json:"duration"`  // Default duration for timed benchmarks
+	Tolerance  Tolerance    `json:"tolerance"` // Default regression thresholds and variance window
+	Benchmarks []SuiteEntry `json:"benchmarks"`
+}
+
+// Tolerance is the variance a benchmark is expected to show between runs.
+// Unset fields fall back to the suite default, then to the compare flags.
+// All values are percentages.
+type Tolerance struct {
+	MaxThroughputDrop  *float64 `json:"max_throughput_drop"`
+	MaxLatencyIncrease *float64 `json:"max_latency_increase"`
+	MaxCPUIncrease     *float64 `json:"max_cpu_increase"`
+	MaxMemoryIncrease  *float64 `json:"max_memory_increase"`
+	MaxThroughputCV    *float64 `json:"max_throughput_cv"` // Coefficient of variation allowed across repeated runs
+}
+
+// merge returns t with its unset fields taken from fallback
+func (t Tolerance) merge(fallback Tolerance) Tolerance {
+	pick := func(v, fb *float64) *float64 {
+		if v != nil {
+			return v
+		}
+		return fb
+	}
+	return Tolerance{
+		MaxThroughputDrop:  pick(t.MaxThroughputDrop, fallback.MaxThroughputDrop),
+		MaxLatencyIncrease: pick(t.MaxLatencyIncrease, fallback.MaxLatencyIncrease),
+		MaxCPUIncrease:     pick(t.MaxCPUIncrease, fallback.MaxCPUIncrease),
+		MaxMemoryIncrease:  pick(t.MaxMemoryIncrease, fallback.MaxMemoryIncrease),
+		MaxThroughputCV:    pick(t.MaxThroughputCV, fallback.MaxThroughputCV),
+	}
+}
+
+// validate rejects negative percentages
+func (t Tolerance) validate() error {
+	for _, v := range []*float64{t.MaxThroughputDrop, t.MaxLatencyIncrease, t.MaxCPUIncrease, t.MaxMemoryIncrease, t.MaxThroughputCV} {
+		if v != nil && *v < 0 {
+			return fmt.Errorf("tolerance values must not be negative")
+		}
+	}
+	return nil
+}
+
+// Tolerances returns the effective tolerance of each benchmark in the
+// suite. When a benchmark appears more than once, later entries win.
+func (c *SuiteConfig) Tolerances() map[string]Tolerance {
+	out := make(map[string]Tolerance, len(c.Benchmarks))
+	for _, e := range c.Benchmarks {
+		out[e.Benchmark] = e.Tolerance.merge(out[e.Benchmark]).merge(c.Tolerance)
+	}
+	return out
+}
+
+// SuiteEntry is one benchmark run of a suite
+type SuiteEntry struct {
+	Benchmark  string         `json:"benchmark"`   // Subcommand name
+	Mechanism  string         `json:"mechanism"`   // Selects the benchmark when Benchmark is empty
+	Duration   durationFlag   `json:"duration"`    // Overrides the suite default
+	BufferSize int            `json:"buffer_size"` // Mapped to the benchmark's buffer size flag
+	Rate       int            `json:"rate"`        // Mapped to the benchmark's event rate flag
+	Params     map[string]any `json:"params"`      // Other flags by name, e.g. {payload: random}
+	Tolerance  Tolerance      `json:"tolerance"`   // Overrides the suite tolerance
+}
+
+// mechanismBenchmarks resolves SuiteEntry.Mechanism to a benchmark
+var mechanismBenchmarks = map[string]string{
+	"ring_buffer": "ringbuf",
+	"perf_buffer": "perfbuf",
+}
+
+// bufferSizeFlags and rateFlags name the flag each benchmark uses for
+// SuiteEntry.BufferSize and SuiteEntry.Rate
+var (
+	bufferSizeFlags = map[string]string{"perfbuf": "pages", "xdp": "ring", "tc": "ring", "maps": "entries", "ringbuf": "buffer-size"}
+	rateFlags       = map[string]string{"uprobe": "rate", "ringbuf": "rate", "perfbuf": "rate"}
+)
+
+// LoadSuiteConfig reads and validates a suite config file
+func LoadSuiteConfig(path string) (*SuiteConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.ToLower(filepath.Ext(path)) != ".json" {
+		doc, err := parseYAML(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	var cfg SuiteConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(cfg.Benchmarks) == 0 {
+		return nil, fmt.Errorf("%s: no benchmarks declared", path)
+	}
+	if err := cfg.Tolerance.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i := range cfg.Benchmarks {
+		if err := cfg.Benchmarks[i].resolve(); err != nil {
+			return nil, fmt.Errorf("%s: benchmarks[%d]: %w", path, i, err)
+		}
+	}
+	return &cfg, nil
+}
+
+// UnmarshalJSON accepts a duration string ("500ms") or a number of seconds
+func (f *durationFlag) UnmarshalJSON(data []byte) error {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		f.d = time.Duration(v * float64(time.Second))
+		return nil
+	case string:
+		return f.Set(v)
+	}
+	return fmt.Errorf("invalid duration %s", data)
+}
+
+// resolve fills Benchmark from Mechanism and checks that the entry's
+// settings apply to the benchmark
+func (e *SuiteEntry) resolve() error {
+	if e.Benchmark == "" {
+		if e.Benchmark = mechanismBenchmarks[e.Mechanism]; e.Benchmark == "" {
+			return fmt.Errorf("benchmark or a known mechanism is required")
+		}
+	}
+	b, ok := benchmarks[e.Benchmark]
+	if !ok {
+		return fmt.Errorf("unknown benchmark %q", e.Benchmark)
+	}
+	if e.Duration.d < 0 || e.BufferSize < 0 || e.Rate < 0 {
+		return fmt.Errorf("duration, buffer_size and rate must not be negative")
+	}
+	if err := e.Tolerance.validate(); err != nil {
+		return err
+	}
+	if e.Duration.d > 0 && !b.timed {
+		return fmt.Errorf("%s does not take a duration", e.Benchmark)
+	}
+	if e.BufferSize > 0 && bufferSizeFlags[e.Benchmark] == "" {
+		return fmt.Errorf("%s has no buffer size setting", e.Benchmark)
+	}
+	if e.Rate > 0 && rateFlags[e.Benchmark] == "" {
+		return fmt.Errorf("%s has no event rate setting", e.Benchmark)
+	}
+	return nil
+}
+
+// flags returns the entry's benchmark flags. Shared flags are added by the
+// suite runner.
+func (e *SuiteEntry) flags() []string {
+	var args []string
+	if e.BufferSize > 0 {
+		args = append(args, "-"+bufferSizeFlags[e.Benchmark], strconv.Itoa(e.BufferSize))
+	}
+	if e.Rate > 0 {
+		args = append(args, "-"+rateFlags[e.Benchmark], strconv.Itoa(e.Rate))
+	}
+
+	names := make([]string, 0, len(e.Params))
+	for name := range e.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, fmt.Sprintf("-%s=%s", name, formatParam(e.Params[name])))
+	}
+	return args
+}
+
+// formatParam renders a decoded config value as a flag value. Lists are
+// joined with commas, matching the repo's list flags.
+func formatParam(v any) string {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []any:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			parts[i] = formatParam(item)
+		}
+		return strings.Join(parts, ",")
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
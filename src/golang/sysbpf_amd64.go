@@ -0,0 +1,5 @@
+package main
+
+// sysBPF is the bpf(2) syscall number, which the syscall package does not
+// export
+const sysBPF = 321
@@ -0,0 +1,7 @@
+//go:build !amd64 && !arm64
+
+package main
+
+// sysBPF is unknown on this architecture; map type probes report the
+// kernel version heuristic instead
+const sysBPF = -1
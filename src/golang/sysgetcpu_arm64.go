@@ -0,0 +1,5 @@
+package main
+
+// sysGetcpu is the getcpu(2) syscall number, which the syscall package
+// does not export
+const sysGetcpu = 168
@@ -0,0 +1,7 @@
+//go:build !amd64 && !arm64
+
+package main
+
+// sysGetcpu is unknown on this architecture; pinned runs record no
+// observed migrations
+const sysGetcpu = -1
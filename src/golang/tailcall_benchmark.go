@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Call variants of the tailcall benchmark
+const (
+	callInline   = "inline"    // Every stage in one function
+	callBPF2BPF  = "bpf2bpf"   // One bpf-to-bpf call per stage
+	callTailCall = "tail_call" // One program per stage, chained by bpf_tail_call
+)
+
+var allCallVariants = []string{callInline, callBPF2BPF, callTailCall}
+
+// maxTailCalls is MAX_TAIL_CALL_CNT: a chain may tail call this often
+const maxTailCalls = 33
+
+// bpf(2) commands, map type and helper of the tail call programs
+const (
+	bpfEnableStats       = 32
+	bpfMapTypeProgArray  = 3
+	bpfFuncTailCall      = 12
+	bpfPseudoCall        = 1 // src_reg of a bpf-to-bpf call
+	bpfPseudoMapFD       = 1 // src_reg of a map fd load
+	callTracepoint       = "raw_syscalls:sys_enter"
+	callTracepointRawTP  = "sys_enter"
+	progInfoRunTimeNsOff = 192 // bpf_prog_info.run_time_ns
+	progInfoRunCntOff    = 200 // bpf_prog_info.run_cnt
+)
+
+// bpfInsn encodes one instruction
+func bpfInsn(op uint8, dst, src uint8, off int16, imm int32) uint64 {
+	return uint64(op) | uint64(dst)<<8 | uint64(src)<<12 | uint64(uint16(off))<<16 | uint64(uint32(imm))<<32
+}
+
+// callStage is the work of one stage on register reg: reg = reg*31 + 7
+func callStage(reg uint8) []uint64 {
+	return []uint64{
+		bpfInsn(0x27, reg, 0, 0, 31), // BPF_ALU64|BPF_MUL|BPF_K
+		bpfInsn(0x07, reg, 0, 0, 7),  // BPF_ALU64|BPF_ADD|BPF_K
+	}
+}
+
+var (
+	insnExit    = bpfInsn(0x95, 0, 0, 0, 0) // BPF_JMP|BPF_EXIT
+	insnReturn0 = bpfInsn(0xb7, 0, 0, 0, 0) // r0 = 0
+)
+
+// callPrograms returns the programs of variant at depth stages. The first
+// is the entry; tail call chains index the others through a prog array,
+// whose fd the programs load as mapFD.
+func callPrograms(variant string, depth int, mapFD int) [][]uint64 {
+	switch variant {
+	case callInline:
+		p := []uint64{bpfInsn(0xb7, 6, 0, 0, 0)} // r6 = 0
+		for i := 0; i < depth; i++ {
+			p = append(p, callStage(6)...)
+		}
+		return [][]uint64{append(p, insnReturn0, insnExit)}
+	case callBPF2BPF:
+		// main: r1 = 0; (call sub; r1 = r0) * depth; return 0
+		// sub: r0 = r1 * 31 + 7
+		p := []uint64{bpfInsn(0xb7, 1, 0, 0, 0)}
+		sub := 1 + 2*depth + 2
+		for i := 0; i < depth; i++ {
+			pc := len(p)
+			p = append(p, bpfInsn(0x85, 0, bpfPseudoCall, 0, int32(sub-pc-1)), bpfInsn(0xbf, 1, 0, 0, 0))
+		}
+		p = append(p, insnReturn0, insnExit)
+		p = append(p, bpfInsn(0xbf, 0, 1, 0, 0))
+		p = append(p, callStage(0)...)
+		return [][]uint64{append(p, insnExit)}
+	}
+	// Program i runs stage i and tail calls i+1; the last one returns
+	progs := make([][]uint64, 0, depth+1)
+	for i := 0; i < depth; i++ {
+		p := []uint64{
+			bpfInsn(0xbf, 6, 1, 0, 0),        // r6 = ctx
+			bpfInsn(0xb7, 0, 0, 0, int32(i)), // r0 = i
+		}
+		p = append(p, callStage(0)...)
+		p = append(p,
+			bpfInsn(0xbf, 1, 6, 0, 0),                            // r1 = ctx
+			bpfInsn(0x18, 2, bpfPseudoMapFD, 0, int32(mapFD)), 0, // r2 = prog array
+			bpfInsn(0xb7, 3, 0, 0, int32(i+1)), // r3 = next index
+			bpfInsn(0x85, 0, 0, 0, bpfFuncTailCall),
+			insnReturn0, insnExit)
+		progs = append(progs, p)
+	}
+	return append(progs, []uint64{insnReturn0, insnExit})
+}
+
+// callStats are the counters of one driven run
+type callStats struct {
+	invocations int64         // Times the entry program ran
+	runTime     time.Duration // Time spent in it, chains and calls included
+	elapsed     time.Duration // Wall time of the driving syscalls
+}
+
+// callProgram is a call variant attached to the tracepoint
+type callProgram interface {
+	Drive(calls int) (callStats, error) // Fires the tracepoint with calls getpid(2)s
+	Backend() string
+	Close() error
+}
+
+// bpfCallProgram is a variant loaded with bpf(2) and attached to the
+// sys_enter raw tracepoint. The kernel's BPF_STATS_RUN_TIME counters give
+// the time per invocation, as bpftool prog show reports it.
+type bpfCallProgram struct {
+	progs []int
+	array int // Prog array, or -1
+	link  int
+	stats int // BPF_ENABLE_STATS fd; stats stay on while it is open
+}
+
+func newBPFCallProgram(ctx context.Context, variant string, depth int) (*bpfCallProgram, error) {
+	p := &bpfCallProgram{array: -1, link: -1, stats: -1}
+	if variant == callTailCall {
+		create := struct {
+			mapType, keySize, valueSize, maxEntries uint32
+		}{bpfMapTypeProgArray, 4, 4, uint32(depth + 1)}
+		fd, err := bpfSyscall(bpfMapCreate, unsafe.Pointer(&create), unsafe.Sizeof(create))
+		if err != nil {
+			return nil, fmt.Errorf("create prog array: %w", err)
+		}
+		p.array = int(fd)
+	}
+	for _, insns := range callPrograms(variant, depth, p.array) {
+		fd, err := loadInsns(progLoadAttr{progType: bpfProgTypeRawTracepoint}, insns, nil)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.progs = append(p.progs, fd)
+	}
+	if p.array >= 0 {
+		for i, prog := range p.progs {
+			key, value := uint32(i), uint32(prog)
+			attr := elemAttr{mapFD: uint32(p.array), key: uint64(uintptr(unsafe.Pointer(&key))), value: uint64(uintptr(unsafe.Pointer(&value)))}
+			if _, err := bpfSyscall(bpfMapUpdateElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+				p.Close()
+				return nil, fmt.Errorf("fill prog array: %w", err)
+			}
+		}
+	}
+
+	var err error
+	if p.stats, err = enableRunTimeStats(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	markPhase(ctx, lifecycleAttach)
+	if p.link, err = rawTracepointOpen(callTracepointRawTP, p.progs[0]); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// enableRunTimeStats turns on the kernel's BPF_STATS_RUN_TIME counters of
+// every program. They stay on until the returned fd is closed.
+func enableRunTimeStats() (int, error) {
+	statsType := uint32(0) // BPF_STATS_RUN_TIME
+	fd, err := bpfSyscall(bpfEnableStats, unsafe.Pointer(&statsType), unsafe.Sizeof(statsType))
+	if err != nil {
+		return -1, fmt.Errorf("enable run time stats (kernel 5.8 or newer): %w", err)
+	}
+	return int(fd), nil
+}
+
+// progRunStats reads a program's run time and run count
+func progRunStats(prog int) (runNs, runs uint64, err error) {
+	info, err := progInfo(prog)
+	if err != nil {
+		return 0, 0, err
+	}
+	return binary.LittleEndian.Uint64(info[progInfoRunTimeNsOff:]), binary.LittleEndian.Uint64(info[progInfoRunCntOff:]), nil
+}
+
+func (p *bpfCallProgram) Drive(calls int) (callStats, error) {
+	var s callStats
+	runNs0, runs0, err := progRunStats(p.progs[0])
+	if err != nil {
+		return s, err
+	}
+	start := time.Now()
+	for i := 0; i < calls; i++ {
+		syscall.Getpid()
+	}
+	s.elapsed = time.Since(start)
+	runNs1, runs1, err := progRunStats(p.progs[0])
+	if err != nil {
+		return s, err
+	}
+	s.invocations = int64(runs1 - runs0) // Other processes' syscalls count too
+	s.runTime = time.Duration(runNs1 - runNs0)
+	return s, nil
+}
+
+func (p *bpfCallProgram) Backend() string { return probeBackendBPF }
+
+func (p *bpfCallProgram) Close() error {
+	for _, fd := range append([]int{p.link, p.stats, p.array}, p.progs...) {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}
+	p.progs, p.array, p.link, p.stats = nil, -1, -1, -1
+	return nil
+}
+
+// simCallSink keeps the simulated stages from being optimized away
+var simCallSink uint64
+
+//go:noinline
+func simSubprog(acc uint64) uint64 { return acc*31 + 7 }
+
+// simTailProg is one program of a simulated tail call chain. It returns
+// the index to tail call, or -1 to return.
+type simTailProg func(acc *uint64) int
+
+// simulatedCallProgram runs the variant in userspace after every driving
+// syscall, timing each invocation as the kernel's run time stats do. Tail
+// calls go through a program table with the kernel's bounds, empty slot
+// and chain length checks, and replace the caller rather than nest.
+type simulatedCallProgram struct {
+	variant string
+	depth   int
+	table   []simTailProg
+}
+
+func newSimulatedCallProgram(variant string, depth int) *simulatedCallProgram {
+	p := &simulatedCallProgram{variant: variant, depth: depth}
+	if variant == callTailCall {
+		p.table = make([]simTailProg, depth+1)
+		for i := 0; i < depth; i++ {
+			next := i + 1
+			p.table[i] = func(acc *uint64) int { *acc = *acc*31 + 7; return next }
+		}
+		p.table[depth] = func(*uint64) int { return -1 }
+	}
+	return p
+}
+
+// invoke runs the variant once
+func (p *simulatedCallProgram) invoke() {
+	var acc uint64
+	switch p.variant {
+	case callInline:
+		for i := 0; i < p.depth; i++ {
+			acc = acc*31 + 7
+		}
+	case callBPF2BPF:
+		for i := 0; i < p.depth; i++ {
+			acc = simSubprog(acc)
+		}
+	case callTailCall:
+		for idx, count := 0, 0; ; count++ {
+			next := p.table[idx](&acc)
+			if next < 0 || next >= len(p.table) || p.table[next] == nil || count >= maxTailCalls {
+				break
+			}
+			idx = next
+		}
+	}
+	simCallSink = acc
+}
+
+func (p *simulatedCallProgram) Drive(calls int) (callStats, error) {
+	var s callStats
+	start := time.Now()
+	for i := 0; i < calls; i++ {
+		syscall.Getpid()
+		t := time.Now()
+		p.invoke()
+		s.runTime += time.Since(t)
+	}
+	s.elapsed = time.Since(start)
+	s.invocations = int64(calls)
+	return s, nil
+}
+
+func (p *simulatedCallProgram) Backend() string { return probeBackendSim }
+func (p *simulatedCallProgram) Close() error    { return nil }
+
+// newCallProgram selects a backend for variant; auto falls back to
+// simulation when the programs cannot be loaded or attached
+func newCallProgram(ctx context.Context, backend, variant string, depth int) (callProgram, error) {
+	switch backend {
+	case probeBackendSim:
+		return newSimulatedCallProgram(variant, depth), nil
+	case probeBackendBPF, probeBackendAuto:
+		p, err := newBPFCallProgram(ctx, variant, depth)
+		if err == nil {
+			return p, nil
+		}
+		if backend == probeBackendBPF {
+			return nil, err
+		}
+		return newSimulatedCallProgram(variant, depth), nil
+	}
+	return nil, fmt.Errorf("unknown backend %q (want auto, bpf or sim)", backend)
+}
+
+// TailCallBenchmark measures what tail calls and bpf-to-bpf calls add per
+// invocation over the same stages inline, with each variant attached to a
+// tracepoint that a getpid(2) loop fires at a high rate
+type TailCallBenchmark struct {
+	variants []string
+	depth    int
+	calls    int
+	backend  string
+	verbose  bool
+}
+
+// Run executes the benchmark, producing one result per variant. Results
+// after the inline one carry the cost per call over it as OverheadNs.
+func (b *TailCallBenchmark) Run(ctx context.Context) ([]*BenchmarkResult, error) {
+	if b.verbose {
+		PrintBenchmarkHeader("Tail Call and BPF-to-BPF Call Benchmark (Go)")
+	}
+	host := CollectHostInfo()
+	var results []*BenchmarkResult
+	var inlineNs float64
+	for _, variant := range b.variants {
+		r, err := b.runOne(ctx, variant)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", variant, err)
+		}
+		r.Host = host
+		if variant == callInline {
+			inlineNs = r.Operations[0].AvgNs
+		}
+		results = append(results, r)
+	}
+	if inlineNs > 0 {
+		for i, r := range results {
+			if b.variants[i] != callInline {
+				r.OverheadNs = (r.Operations[0].AvgNs - inlineNs) / float64(b.depth)
+			}
+		}
+	}
+	return results, nil
+}
+
+// runOne drives one variant for b.calls syscalls
+func (b *TailCallBenchmark) runOne(ctx context.Context, variant string) (*BenchmarkResult, error) {
+	markPhase(ctx, lifecycleLoad)
+	prog, err := newCallProgram(ctx, b.backend, variant, b.depth)
+	if err != nil {
+		return nil, err
+	}
+	defer prog.Close()
+	markPhase(ctx, lifecycleSetup)
+
+	r := &BenchmarkResult{
+		Name:           "Call Overhead (" + variant + ")",
+		Language:       "Go",
+		ProgramType:    "raw_tracepoint",
+		Tracepoint:     callTracepoint,
+		DataMechanism:  "none",
+		ReaderStrategy: fmt.Sprintf("%s/depth=%d", prog.Backend(), b.depth),
+		Errors:         []string{},
+	}
+	if prog.Backend() == probeBackendSim {
+		r.Errors = append(r.Errors, "bpf(2) raw tracepoint programs unavailable: "+variant+" simulated in userspace")
+	}
+	benchLog(ctx).Info("Driving calls", "variant", variant, "stages", b.depth, "syscalls", b.calls, "backend", prog.Backend())
+
+	// Warm the caches and branch predictors the first variant would
+	// otherwise warm for the rest
+	if _, err := prog.Drive(b.calls/10 + 1); err != nil {
+		return nil, err
+	}
+	startUsage, _ := TakeResourceSnapshot()
+	r.StartTime = time.Now()
+	s, err := prog.Drive(b.calls)
+	if err != nil {
+		return nil, err
+	}
+	r.EndTime = time.Now()
+	endUsage, _ := TakeResourceSnapshot()
+
+	r.Operations = []OperationResult{
+		NewOperationResult("invoke", s.invocations, s.runTime),
+		NewOperationResult("syscall", int64(b.calls), s.elapsed),
+	}
+	r.Duration = s.elapsed.Seconds()
+	r.EventCount = s.invocations
+	if r.Duration > 0 {
+		r.Throughput = float64(s.invocations) / r.Duration
+	}
+	r.CPUBudget = NewCPUBudget(startUsage, endUsage, s.invocations)
+	r.CPUUsage = r.CPUBudget.CPUPercent(endUsage.Wall.Sub(startUsage.Wall))
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	r.MemoryUsage = ms.Alloc
+
+	return r, nil
+}
+
+// runTailCallBenchmark is the entry point of the tailcall subcommand
+func runTailCallBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("tailcall", flag.ExitOnError)
+	common := addBenchFlags(fs, "tailcall_result.json", false)
+	variants := fs.String("variants", callInline+","+callBPF2BPF+","+callTailCall, "Comma-separated call variants (inline, bpf2bpf, tail_call)")
+	depth := fs.Int("depth", 8, fmt.Sprintf("Stages per invocation, each a call or tail call outside inline (1 to %d)", maxTailCalls-1))
+	calls := fs.Int("calls", 1000000, "getpid(2) calls firing the tracepoint per variant")
+	backend := fs.String("backend", probeBackendAuto, "Backend (auto, bpf, sim)")
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+	if *depth < 1 || *depth >= maxTailCalls {
+		return nil, opts, fmt.Errorf("-depth must be 1 to %d", maxTailCalls-1)
+	}
+	if *calls <= 0 {
+		return nil, opts, fmt.Errorf("-calls must be positive")
+	}
+	list := splitList(*variants)
+	for _, v := range list {
+		if !containsString(allCallVariants, v) {
+			return nil, opts, fmt.Errorf("unknown call variant %q", v)
+		}
+	}
+	if len(list) == 0 {
+		return nil, opts, fmt.Errorf("-variants lists no call variants")
+	}
+
+	bench := &TailCallBenchmark{variants: list, depth: *depth, calls: *calls, backend: *backend, verbose: opts.Verbose}
+	results, err := bench.Run(ctx)
+	if err != nil {
+		return nil, opts, err
+	}
+
+	PrintBenchmarkHeader(fmt.Sprintf("Per-invocation cost on %s, %d stages", callTracepoint, *depth))
+	for _, r := range results {
+		line := fmt.Sprintf("%-28s %-14s %10.1f ns/invocation", r.Name, r.ReaderStrategy, r.Operations[0].AvgNs)
+		if r.OverheadNs != 0 {
+			line += fmt.Sprintf("  %+.1f ns per call vs inline", r.OverheadNs)
+		}
+		fmt.Println(line)
+	}
+	return results, opts, nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// tcAction mirrors the TC_ACT_* return codes of a clsact classifier
+type tcAction uint32
+
+const (
+	tcActOK       tcAction = 0
+	tcActShot     tcAction = 2
+	tcActRedirect tcAction = 7
+)
+
+var tcActionNames = map[tcAction]string{
+	tcActOK:       "pass",
+	tcActShot:     "drop",
+	tcActRedirect: "redirect",
+}
+
+func (a tcAction) String() string {
+	if name, ok := tcActionNames[a]; ok {
+		return name
+	}
+	return fmt.Sprintf("action(%d)", uint32(a))
+}
+
+// parseTCAction parses an -action flag value
+func parseTCAction(s string) (tcAction, error) {
+	for a, name := range tcActionNames {
+		if strings.EqualFold(s, name) {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown TC action %q (want pass, drop or redirect)", s)
+}
+
+// clsact hook points
+const (
+	tcIngress = "ingress"
+	tcEgress  = "egress"
+)
+
+// simSkb models the sk_buff a TC program sees: unlike XDP, the packet has
+// already been copied out of the driver ring and carries metadata
+type simSkb struct {
+	data     []byte
+	protocol uint16
+	ifindex  uint32
+	mark     uint32
+}
+
+// tcProgram is a userspace model of tc_throughput.c attached to a clsact
+// hook. Ingress packets are first copied into an skb, as the stack does
+// after the driver hands them over; egress packets already live in an skb.
+type tcProgram struct {
+	action      tcAction
+	direction   string
+	skb         simSkb
+	packets     uint64
+	parseErrors uint64
+}
+
+func newTCProgram(action tcAction, direction string, frameSize int) *tcProgram {
+	return &tcProgram{
+		action:    action,
+		direction: direction,
+		skb:       simSkb{data: make([]byte, frameSize), ifindex: 1},
+	}
+}
+
+// Run processes one packet, returning the TC verdict and the UDP payload
+// offset (0 if the packet could not be parsed)
+func (p *tcProgram) Run(frame []byte) (uint32, int) {
+	data := frame
+	if p.direction == tcIngress {
+		n := copy(p.skb.data, frame)
+		data = p.skb.data[:n]
+	}
+	if len(data) >= ethHeaderLen {
+		p.skb.protocol = binary.BigEndian.Uint16(data[12:14])
+	}
+
+	payload, err := parseUDPPayload(data)
+	if err != nil {
+		p.parseErrors++
+		return uint32(tcActOK), 0
+	}
+	p.packets++
+	p.skb.mark = uint32(p.packets) // Classifiers commonly tag skb->mark
+	return uint32(p.action), payload
+}
+
+// TCBenchmark measures TC classifier throughput: tc_throughput's program
+// attached to a clsact hook of a veth, or its userspace model on a
+// simulated pair. Results are comparable with XDPBenchmark.
+type TCBenchmark struct {
+	duration   time.Duration
+	backend    string // auto, bpf or sim
+	phases     Phases
+	coord      *coordination // Phase marker channel; nil is an atomic
+	pinning    *cpuPinning   // Consumer and generator CPUs; nil leaves them unpinned
+	packetSize int
+	flows      int
+	headers    *HeaderStack // Layers of the generated frames; nil is IPv4
+	action     tcAction
+	direction  string
+	ringSize   int
+	payload    PayloadGenerator
+	maxSamples int
+	verbose    bool
+	result     *BenchmarkResult
+}
+
+// NewTCBenchmark creates a new benchmark instance
+func NewTCBenchmark(duration time.Duration, packetSize, flows int, action tcAction, direction string, ringSize int, verbose bool) *TCBenchmark {
+	return &TCBenchmark{
+		duration:   duration,
+		backend:    probeBackendAuto,
+		packetSize: packetSize,
+		flows:      flows,
+		action:     action,
+		direction:  direction,
+		ringSize:   ringSize,
+		maxSamples: 10000000,
+		verbose:    verbose,
+		result: &BenchmarkResult{
+			Name:           "TC Packet Processing",
+			Language:       "Go",
+			ProgramType:    "tc",
+			DataMechanism:  "veth",
+			ReaderStrategy: direction + "/" + action.String(), // Run prefixes the backend
+			Errors:         []string{},
+		},
+	}
+}
+
+// Run executes the benchmark until its duration elapses or ctx is done
+func (b *TCBenchmark) Run(ctx context.Context) error {
+	gen, err := NewPacketGenerator(b.packetSize, b.flows)
+	if err != nil {
+		return err
+	}
+	if b.headers != nil {
+		if err := gen.SetHeaders(b.headers); err != nil {
+			return err
+		}
+	}
+	if b.payload != nil {
+		gen.SetPayload(b.payload)
+		b.result.Payload = b.payload.Name()
+	}
+	prog := newTCProgram(b.action, b.direction, b.packetSize)
+	buffer := NewEventBuffer(b.maxSamples)
+	buffer.SetProgress(NewProgress("tc"))
+
+	if b.verbose {
+		PrintBenchmarkHeader("TC Packet Processing Benchmark (Go)")
+	}
+	benchLog(ctx).Info("Running", "duration", b.duration, "direction", b.direction,
+		"packet_size", b.packetSize, "flows", b.flows, "action", b.action)
+
+	path, err := openPacketBackend(b.backend, tcHook, bpfPacketOptions{
+		points:      xdpAttachPoints(1, false),
+		egress:      b.direction == tcEgress,
+		verdict:     uint32(b.action),
+		frameSize:   b.packetSize,
+		unsupported: b.bpfUnsupported(),
+	})
+	if err != nil {
+		return err
+	}
+	if path != nil {
+		defer path.Close()
+		b.result.ReaderStrategy = probeBackendBPF + "/" + b.result.ReaderStrategy
+	} else {
+		b.result.ReaderStrategy = probeBackendSim + "/" + b.result.ReaderStrategy
+		b.result.Errors = append(b.result.Errors, simPacketNote("tc"))
+	}
+
+	b.result.Host = CollectHostInfo()
+	pin := b.pinning.newRun()
+	var stats pipelineStats
+	var counters bpfPipelineCounters
+	if path != nil {
+		var all []pipelineStats
+		all, counters = runBPFPacketPipeline(ctx, b.phases, b.coord, pin, b.duration, path, []*PacketGenerator{gen},
+			b.maxSamples, eventTypeTC, []*EventBuffer{buffer})
+		stats = all[0]
+	} else {
+		stats = runPacketPipeline(ctx, b.phases, b.coord, pin, b.duration, gen, b.ringSize, b.maxSamples, eventTypeTC, buffer, prog.Run)
+		counters.parseErrors = int64(prog.parseErrors)
+	}
+
+	b.result.StartTime = stats.start.Wall
+	b.result.EndTime = stats.end.Wall
+
+	fillPacketResult(b.result, stats, buffer, stats.start, stats.end)
+	b.result.Affinity = pin.stats()
+	b.result.Operations = verdictOperations(stats, b.result.Duration, func(v uint32) string {
+		return tcAction(v).String()
+	})
+	if path != nil {
+		recordBPFPacketCounters(b.result, stats, counters)
+	}
+	if counters.parseErrors > 0 {
+		b.result.Errors = append(b.result.Errors, fmt.Sprintf("%d packets failed to parse", counters.parseErrors))
+	}
+
+	return nil
+}
+
+// bpfUnsupported reports why the run's options need the userspace model,
+// or nil when the program can run them
+func (b *TCBenchmark) bpfUnsupported() error {
+	if b.headers != nil && b.headers.String() != defaultHeaderStack {
+		return fmt.Errorf("the TC program parses Ethernet/IPv4/UDP only, not -headers %s", b.headers)
+	}
+	return nil
+}
+
+// runTCBenchmark is the entry point of the tc subcommand
+func runTCBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("tc", flag.ExitOnError)
+	common := addBenchFlags(fs, "tc_result.json", true)
+	size := fs.Int("size", 64, "Packet size in bytes")
+	flows := fs.Int("flows", 1, "Number of distinct flows")
+	actionName := fs.String("action", "pass", "TC action returned by the classifier (pass, drop, redirect)")
+	direction := fs.String("direction", tcIngress, "clsact hook (ingress, egress)")
+	ringSize := fs.Int("ring", 1024, "veth ring size in frames")
+	payloadName := fs.String("payload", "syscall", "Payload contents (zeros, random, syscall)")
+	seed := fs.Uint64("seed", 1, "Payload generator seed")
+	headerFlag := fs.String("headers", defaultHeaderStack, "Headers between the outer Ethernet and UDP (vlan, ipv4, ipv6, vxlan, geneve; e.g. vlan,ipv6)")
+	backend := fs.String("backend", probeBackendAuto, "Packet path backend (auto, bpf, sim)")
+	phaseFlags := addPhaseFlags(fs)
+	coordFlags := addCoordFlags(fs)
+	affinityFlags := addAffinityFlags(fs, true)
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+
+	action, err := parseTCAction(*actionName)
+	if err != nil {
+		return nil, opts, err
+	}
+	if *direction != tcIngress && *direction != tcEgress {
+		return nil, opts, fmt.Errorf("unknown direction %q (want ingress or egress)", *direction)
+	}
+	if *ringSize <= 0 {
+		return nil, opts, fmt.Errorf("-ring must be positive")
+	}
+	headers, err := parseHeaderStack(*headerFlag)
+	if err != nil {
+		return nil, opts, fmt.Errorf("invalid -headers: %w", err)
+	}
+	if *size < headers.MinSize() {
+		return nil, opts, fmt.Errorf("-size %d too small for -headers %s (minimum %d)", *size, headers, headers.MinSize())
+	}
+	payload, err := NewPayloadGenerator(*payloadName, *seed)
+	if err != nil {
+		return nil, opts, err
+	}
+	phases, err := phaseFlags.phases()
+	if err != nil {
+		return nil, opts, err
+	}
+	coord, err := coordFlags.open()
+	if err != nil {
+		return nil, opts, err
+	}
+	defer coord.Close()
+	pinning, err := affinityFlags.pinning()
+	if err != nil {
+		return nil, opts, err
+	}
+
+	bench := NewTCBenchmark(opts.Duration, *size, *flows, action, *direction, *ringSize, opts.Verbose)
+	bench.backend = *backend
+	bench.payload = payload
+	bench.headers = headers
+	bench.result.HeaderStack = headers.String()
+	bench.phases = phases
+	bench.coord = coord
+	bench.pinning = pinning
+	phases.record(bench.result)
+	if err := bench.Run(ctx); err != nil {
+		return nil, opts, err
+	}
+
+	return []*BenchmarkResult{bench.result}, opts, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// TeardownStats reconcile a run's measured events with everything its
+// producers generated. Events still buffered when the measured window
+// closes are drained afterwards without counting toward throughput or
+// latency, so a backlog neither inflates the window nor goes missing.
+type TeardownStats struct {
+	Generated    int64   // Events produced in the run, dropped ones included
+	PostWindow   int64   // Buffered when the window closed, drained uncounted
+	DrainSeconds float64 // From the window's end until the buffers were empty
+}
+
+// recordTeardown stores the final drain's accounting. It must follow
+// RecordDrops; counts that do not add up to generated are an error.
+func (r *BenchmarkResult) recordTeardown(generated, postWindow int64, drain time.Duration) {
+	r.Teardown = &TeardownStats{Generated: generated, PostWindow: postWindow, DrainSeconds: drain.Seconds()}
+	if accounted := r.EventCount + r.DroppedEvents + postWindow; accounted != generated {
+		r.Errors = append(r.Errors, fmt.Sprintf("generated %d events but accounted for %d", generated, accounted))
+	}
+}
+
+// formatTeardown renders the generated events against the measured ones
+func (r *BenchmarkResult) formatTeardown() string {
+	t := r.Teardown
+	if t == nil {
+		return ""
+	}
+	return fmt.Sprintf("Teardown:        %d generated = %d measured + %d dropped + %d drained after the window in %.3fms\n",
+		t.Generated, r.EventCount, r.DroppedEvents, t.PostWindow, t.DrainSeconds*1000)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PhaseTiming is the wall time a result spent in each phase of its run's
+// lifecycle, so runs can be budgeted and harness overhead tracked.
+// Warmup, Measure and Cooldown come from the result's own window; the
+// other phases are the time around it.
+type PhaseTiming struct {
+	SetupSeconds    float64 // Flag parsing, host probing, buffers and any preparation not marked as load or attach
+	LoadSeconds     float64 // Compiling and loading programs, where the benchmark marks it
+	AttachSeconds   float64 // Attaching programs, where the benchmark marks it
+	WarmupSeconds   float64
+	MeasureSeconds  float64
+	CooldownSeconds float64
+	DrainSeconds    float64 // Final drain of events left after the measured window, where tracked
+	TeardownSeconds float64 // From the end of the run's last phase until the benchmark returned
+	ReportSeconds   float64 // Validating and annotating results before they are written
+	TotalSeconds    float64 // Sum of the phases
+}
+
+// Lifecycle phases a benchmark can mark with markPhase. Time before the
+// first mark, and after a mark of lifecycleSetup, counts as setup.
+const (
+	lifecycleSetup  = "setup"
+	lifecycleLoad   = "load"
+	lifecycleAttach = "attach"
+)
+
+// lifecycleMark is the start of a marked phase
+type lifecycleMark struct {
+	phase string
+	at    time.Time
+}
+
+// phaseClock collects the phase marks of one benchmark run
+type phaseClock struct {
+	sync.Mutex
+	start time.Time
+	marks []lifecycleMark
+}
+
+type phaseClockKey struct{}
+
+// withPhaseClock starts timing a run; the benchmark's marks go to the
+// returned clock
+func withPhaseClock(ctx context.Context) (context.Context, *phaseClock) {
+	c := &phaseClock{start: time.Now()}
+	return context.WithValue(ctx, phaseClockKey{}, c), c
+}
+
+// markPhase notes that the benchmark running under ctx enters phase, one
+// of the lifecycle constants. Outside a timed run it does nothing.
+func markPhase(ctx context.Context, phase string) {
+	c, ok := ctx.Value(phaseClockKey{}).(*phaseClock)
+	if !ok {
+		return
+	}
+	c.Lock()
+	c.marks = append(c.marks, lifecycleMark{phase, time.Now()})
+	c.Unlock()
+}
+
+// record fills in the Timing of the results of a run that returned at
+// end. Results are taken in the order they started: the time before each
+// one's warm-up, from the end of the previous one, is its setup, and the
+// time after the last one is its teardown.
+func (c *phaseClock) record(results []*BenchmarkResult, end time.Time) {
+	c.Lock()
+	marks := append([]lifecycleMark(nil), c.marks...)
+	c.Unlock()
+	order := make([]*BenchmarkResult, 0, len(results))
+	for _, r := range results {
+		if !r.StartTime.IsZero() {
+			order = append(order, r)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool { return order[i].StartTime.Before(order[j].StartTime) })
+
+	seconds := func(d time.Duration) float64 { return max(d.Seconds(), 0) }
+	prev := c.start
+	for i, r := range order {
+		t := &PhaseTiming{
+			WarmupSeconds:   r.Warmup,
+			MeasureSeconds:  seconds(r.EndTime.Sub(r.StartTime)),
+			CooldownSeconds: r.Cooldown,
+		}
+		if r.Teardown != nil {
+			t.DrainSeconds = r.Teardown.DrainSeconds
+		}
+		warmupStart := r.StartTime.Add(-time.Duration(r.Warmup * float64(time.Second)))
+		c.split(t, marks, prev, warmupStart)
+		prev = r.EndTime.Add(time.Duration((r.Cooldown + t.DrainSeconds) * float64(time.Second)))
+		if i == len(order)-1 {
+			t.TeardownSeconds = seconds(end.Sub(prev))
+		}
+		r.Timing = t
+		r.Timing.total()
+	}
+}
+
+// split adds the time from from to to as setup, load or attach, as the
+// marks divide it
+func (c *phaseClock) split(t *PhaseTiming, marks []lifecycleMark, from, to time.Time) {
+	add := func(phase string, d time.Duration) {
+		s := max(d.Seconds(), 0)
+		switch phase {
+		case lifecycleLoad:
+			t.LoadSeconds += s
+		case lifecycleAttach:
+			t.AttachSeconds += s
+		default:
+			t.SetupSeconds += s
+		}
+	}
+	phase := lifecycleSetup
+	at := from
+	for _, m := range marks {
+		if !m.at.After(from) {
+			phase = m.phase // In effect when the interval starts
+			continue
+		}
+		if !m.at.Before(to) {
+			break
+		}
+		add(phase, m.at.Sub(at))
+		phase, at = m.phase, m.at
+	}
+	add(phase, to.Sub(at))
+}
+
+// total sums the phases into TotalSeconds
+func (t *PhaseTiming) total() {
+	t.TotalSeconds = t.SetupSeconds + t.LoadSeconds + t.AttachSeconds + t.WarmupSeconds + t.MeasureSeconds +
+		t.CooldownSeconds + t.DrainSeconds + t.TeardownSeconds + t.ReportSeconds
+}
+
+// formatTiming renders the lifecycle breakdown, if recorded
+func (r *BenchmarkResult) formatTiming() string {
+	t := r.Timing
+	if t == nil {
+		return ""
+	}
+	ms := func(s float64) string { return fmt.Sprintf("%.1fms", s*1000) }
+	s := fmt.Sprintf("Timing:          %.3fs total: setup %s", t.TotalSeconds, ms(t.SetupSeconds))
+	if t.LoadSeconds > 0 {
+		s += ", load " + ms(t.LoadSeconds)
+	}
+	if t.AttachSeconds > 0 {
+		s += ", attach " + ms(t.AttachSeconds)
+	}
+	if t.WarmupSeconds > 0 {
+		s += ", warm-up " + ms(t.WarmupSeconds)
+	}
+	s += ", measure " + ms(t.MeasureSeconds)
+	if t.CooldownSeconds > 0 {
+		s += ", cooldown " + ms(t.CooldownSeconds)
+	}
+	if t.DrainSeconds > 0 {
+		s += ", drain " + ms(t.DrainSeconds)
+	}
+	return s + fmt.Sprintf(", teardown %s, report %s\n", ms(t.TeardownSeconds), ms(t.ReportSeconds))
+}
+
+// printTimeBudget prints where the wall time of the results went, per
+// benchmark, so suites can be budgeted. Results without a Timing are
+// left out.
+func printTimeBudget(results []*BenchmarkResult) {
+	type budget struct {
+		runs int
+		sum  PhaseTiming
+	}
+	var order []string
+	byKey := make(map[string]*budget)
+	for _, r := range results {
+		t := r.Timing
+		if t == nil {
+			continue
+		}
+		k := resultKey(r)
+		b := byKey[k]
+		if b == nil {
+			b = &budget{}
+			byKey[k] = b
+			order = append(order, k)
+		}
+		b.runs++
+		s := &b.sum
+		s.SetupSeconds += t.SetupSeconds + t.LoadSeconds + t.AttachSeconds
+		s.WarmupSeconds += t.WarmupSeconds + t.CooldownSeconds
+		s.MeasureSeconds += t.MeasureSeconds
+		s.TeardownSeconds += t.DrainSeconds + t.TeardownSeconds + t.ReportSeconds
+		s.TotalSeconds += t.TotalSeconds
+	}
+	if len(order) == 0 {
+		return
+	}
+	fmt.Printf("\nTime budget (seconds over all runs; setup includes load and attach, teardown drain and report):\n")
+	fmt.Printf("%-48s %5s %10s %10s %10s %10s %10s %9s\n",
+		"Benchmark", "Runs", "Total", "Setup", "Warm/Cool", "Measure", "Teardown", "Measured")
+	var all PhaseTiming
+	for _, k := range order {
+		b := byKey[k]
+		s := b.sum
+		fmt.Printf("%-48s %5d %10.3f %10.3f %10.3f %10.3f %10.3f %8.1f%%\n", k, b.runs, s.TotalSeconds,
+			s.SetupSeconds, s.WarmupSeconds, s.MeasureSeconds, s.TeardownSeconds, share(s.MeasureSeconds, s.TotalSeconds))
+		all.TotalSeconds += s.TotalSeconds
+		all.MeasureSeconds += s.MeasureSeconds
+	}
+	fmt.Printf("%-48s %5s %10.3f %10s %10s %10.3f %10s %8.1f%%\n", "All", "", all.TotalSeconds, "", "",
+		all.MeasureSeconds, "", share(all.MeasureSeconds, all.TotalSeconds))
+}
+
+// share is part as a percentage of whole, 0 when whole is
+func share(part, whole float64) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return part / whole * 100
+}
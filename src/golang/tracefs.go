@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// tracefsMounts are checked in order when locating tracefs
+var tracefsMounts = []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"}
+
+// findTracefs returns the tracefs mount point, identified by the presence of
+// its events directory
+func findTracefs() (string, error) {
+	for _, dir := range tracefsMounts {
+		if _, err := os.Stat(filepath.Join(dir, "events")); err == nil {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("tracefs not mounted (tried %v)", tracefsMounts)
+}
+
+// writeTracefs writes a control string to a tracefs file. Appending matters
+// for kprobe_events/uprobe_events, where truncating would delete every
+// existing probe.
+func writeTracefs(path, data string, appendMode bool) error {
+	flags := os.O_WRONLY
+	if appendMode {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(data); err != nil {
+		f.Close()
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	return f.Close()
+}
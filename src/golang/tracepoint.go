@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// addTracepointFlag registers -tracepoint, the event source of benchmarks
+// whose program attaches to a tracepoint
+func addTracepointFlag(fs *flag.FlagSet) *string {
+	return fs.String("tracepoint", "", "Tracepoint the program attaches to as category:name "+
+		"(e.g. syscalls:sys_enter_openat, sched:sched_switch); checked against tracefs events")
+}
+
+// parseTracepoint splits a tracepoint given as category:name or
+// category/name, the forms used by perf and by the tracefs events tree
+func parseTracepoint(s string) (category, event string, err error) {
+	category, event, ok := strings.Cut(s, ":")
+	if !ok {
+		category, event, ok = strings.Cut(s, "/")
+	}
+	if !ok || category == "" || event == "" || strings.ContainsAny(event, ":/") {
+		return "", "", fmt.Errorf("tracepoint %q is not category:name", s)
+	}
+	return category, event, nil
+}
+
+// resolveTracepoint validates a -tracepoint value and returns it as
+// category:name, or "" when none was given. Without tracefs the name
+// cannot be checked, which is only a warning since the delivery path is
+// simulated either way.
+func resolveTracepoint(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	category, event, err := parseTracepoint(s)
+	if err != nil {
+		return "", err
+	}
+	tp := category + ":" + event
+	root, err := findTracefs()
+	if err != nil {
+		slog.Warn("Cannot validate tracepoint", "tracepoint", tp, "err", err)
+		return tp, nil
+	}
+
+	dir := filepath.Join(root, "events", category)
+	if _, err := os.Stat(dir); err != nil {
+		return "", fmt.Errorf("unknown tracepoint category %q (see %s)", category, filepath.Join(root, "events"))
+	}
+	if _, err := os.Stat(filepath.Join(dir, event, "id")); err != nil {
+		if similar := similarTracepoints(dir, event); len(similar) > 0 {
+			return "", fmt.Errorf("unknown tracepoint %s (did you mean %s?)", tp, strings.Join(similar, ", "))
+		}
+		return "", fmt.Errorf("unknown tracepoint %s", tp)
+	}
+	return tp, nil
+}
+
+// similarTracepoints lists up to five events of the category in dir
+// within a few edits of event, closest first
+func similarTracepoints(dir, event string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	type candidate struct {
+		name     string
+		distance int
+	}
+	var candidates []candidate
+	for _, e := range entries {
+		if d := editDistance(event, e.Name()); e.IsDir() && d <= 3 {
+			candidates = append(candidates, candidate{e.Name(), d})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return candidates[i].name < candidates[j].name
+	})
+	var similar []string
+	for _, c := range candidates[:min(len(candidates), 5)] {
+		similar = append(similar, filepath.Base(dir)+":"+c.name)
+	}
+	return similar
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// programLabel is the program type, with the tracepoint it attaches to
+// when one was selected
+func (r *BenchmarkResult) programLabel() string {
+	if r.Tracepoint == "" {
+		return r.ProgramType
+	}
+	return r.ProgramType + " (" + r.Tracepoint + ")"
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"debug/elf"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uprobeEvent names the tracefs uprobe, created in kprobeGroup
+const uprobeEvent = "uprobe_target"
+
+// defaultUprobeTarget is where src/c/Makefile builds the bundled target
+const defaultUprobeTarget = "build/c/uprobe_target"
+
+// uprobeDriver attaches a uprobe to the target function and drives calls
+// to it at a controlled rate
+type uprobeDriver interface {
+	Attach() error
+	Detach() error
+	// Drive calls the target function n times, paced to rate calls per
+	// second (0 for unlimited), and returns the time the calls took
+	Drive(n, rate int) (time.Duration, error)
+	// Delivered returns the number of probe events delivered since Attach
+	Delivered() (int64, error)
+	Backend() string
+}
+
+// tracefsUprobe probes the bundled target binary through tracefs
+// uprobe_events and runs it as a child process
+type tracefsUprobe struct {
+	root   string
+	target string
+	offset uint64
+}
+
+func (u *tracefsUprobe) Attach() error {
+	def := fmt.Sprintf("p:%s/%s %s:0x%x\n", kprobeGroup, uprobeEvent, u.target, u.offset)
+	if err := writeTracefs(filepath.Join(u.root, "uprobe_events"), def, true); err != nil {
+		return fmt.Errorf("create uprobe: %w", err)
+	}
+	enable := filepath.Join(u.root, "events", kprobeGroup, uprobeEvent, "enable")
+	if err := writeTracefs(enable, "1", false); err != nil {
+		return fmt.Errorf("enable uprobe: %w", err)
+	}
+	return nil
+}
+
+func (u *tracefsUprobe) Detach() error {
+	enable := filepath.Join(u.root, "events", kprobeGroup, uprobeEvent, "enable")
+	if err := writeTracefs(enable, "0", false); err != nil {
+		return fmt.Errorf("disable uprobe: %w", err)
+	}
+	def := fmt.Sprintf("-:%s/%s\n", kprobeGroup, uprobeEvent)
+	if err := writeTracefs(filepath.Join(u.root, "uprobe_events"), def, true); err != nil {
+		return fmt.Errorf("remove uprobe: %w", err)
+	}
+	return nil
+}
+
+// Drive runs the target binary, which reports its own elapsed time so
+// process startup is excluded
+func (u *tracefsUprobe) Drive(n, rate int) (time.Duration, error) {
+	out, err := exec.Command(u.target, strconv.Itoa(n), strconv.Itoa(rate)).Output()
+	if err != nil {
+		return 0, fmt.Errorf("run %s: %w", u.target, err)
+	}
+	v, ok := strings.CutPrefix(strings.TrimSpace(string(out)), "elapsed_ns ")
+	if !ok {
+		return 0, fmt.Errorf("unexpected output from %s: %q", u.target, out)
+	}
+	ns, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected output from %s: %w", u.target, err)
+	}
+	return time.Duration(ns), nil
+}
+
+// Delivered reads the hit count from uprobe_profile, whose lines are
+// "<file> <event> <hits>"
+func (u *tracefsUprobe) Delivered() (int64, error) {
+	f, err := os.Open(filepath.Join(u.root, "uprobe_profile"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[1] == uprobeEvent {
+			return strconv.ParseInt(fields[2], 10, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("uprobe %s not found in uprobe_profile", uprobeEvent)
+}
+
+func (u *tracefsUprobe) Backend() string { return probeBackendTracefs }
+
+// uprobeSink keeps uprobeTargetFunc from being optimized away
+var uprobeSink uint64
+
+// uprobeTargetFunc is the in-process stand-in for bench_uprobe_target()
+//
+//go:noinline
+func uprobeTargetFunc(arg uint64) uint64 {
+	uprobeSink += arg
+	return uprobeSink
+}
+
+// simulatedUprobe calls uprobeTargetFunc in-process and, while attached,
+// emits an Event per call like uprobe_throughput.c would
+type simulatedUprobe struct {
+	attached bool
+	buffer   *EventBuffer
+}
+
+func (u *simulatedUprobe) Attach() error {
+	u.attached = true
+	u.buffer.Start()
+	return nil
+}
+
+func (u *simulatedUprobe) Detach() error {
+	u.attached = false
+	u.buffer.End()
+	return nil
+}
+
+func (u *simulatedUprobe) Drive(n, rate int) (time.Duration, error) {
+	pid := uint32(os.Getpid())
+	var interval time.Duration
+	if rate > 0 {
+		interval = time.Second / time.Duration(rate)
+	}
+
+	start := time.Now()
+	next := start
+	for i := 0; i < n; i++ {
+		if interval > 0 {
+			// Busy-wait pacing, matching the bundled target
+			for time.Now().Before(next) {
+			}
+			next = next.Add(interval)
+		}
+		uprobeTargetFunc(uint64(i))
+		if u.attached {
+			u.buffer.Add(Event{
+				Timestamp: uint64(time.Now().UnixNano()),
+				PID:       pid,
+				EventType: eventTypeUprobe,
+				Data:      uint32(i),
+			})
+		}
+	}
+	return time.Since(start), nil
+}
+
+func (u *simulatedUprobe) Delivered() (int64, error) {
+	return u.buffer.GetEventCount(), nil
+}
+
+func (u *simulatedUprobe) Backend() string { return probeBackendSim }
+
+// elfSymbolOffset returns the file offset of a function symbol, the form
+// uprobe_events expects
+func elfSymbolOffset(path, symbol string) (uint64, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	syms, err := f.Symbols()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, sym := range syms {
+		if sym.Name != symbol || elf.ST_TYPE(sym.Info) != elf.STT_FUNC {
+			continue
+		}
+		for _, prog := range f.Progs {
+			if prog.Type == elf.PT_LOAD && prog.Flags&elf.PF_X != 0 &&
+				sym.Value >= prog.Vaddr && sym.Value < prog.Vaddr+prog.Memsz {
+				return sym.Value - prog.Vaddr + prog.Off, nil
+			}
+		}
+		return 0, fmt.Errorf("%s: symbol %s is not in an executable segment", path, symbol)
+	}
+	return 0, fmt.Errorf("%s: symbol %s not found", path, symbol)
+}
+
+// newUprobeDriver selects a probe backend. auto uses tracefs when it is
+// mounted with uprobe support and the target binary resolves, and falls
+// back to simulation otherwise; the reason is returned for reporting.
+func newUprobeDriver(backend, target, symbol string, buffer *EventBuffer) (uprobeDriver, string, error) {
+	switch backend {
+	case probeBackendSim:
+		return &simulatedUprobe{buffer: buffer}, "", nil
+	case probeBackendTracefs, probeBackendAuto:
+		root, err := findTracefs()
+		if err == nil {
+			_, err = os.Stat(filepath.Join(root, "uprobe_events"))
+		}
+		var offset uint64
+		if err == nil {
+			offset, err = elfSymbolOffset(target, symbol)
+		}
+		if err == nil {
+			abs, absErr := filepath.Abs(target)
+			if absErr != nil {
+				return nil, "", absErr
+			}
+			return &tracefsUprobe{root: root, target: abs, offset: offset}, "", nil
+		}
+		if backend == probeBackendTracefs {
+			return nil, "", err
+		}
+		return &simulatedUprobe{buffer: buffer}, err.Error(), nil
+	}
+	return nil, "", fmt.Errorf("unknown probe backend %q", backend)
+}
+
+// UprobeBenchmark measures uprobe event delivery throughput and the
+// per-call overhead a uprobe adds to the probed function
+type UprobeBenchmark struct {
+	target  string
+	symbol  string
+	calls   int
+	rate    int
+	backend string
+	verbose bool
+}
+
+// NewUprobeBenchmark creates a new benchmark instance
+func NewUprobeBenchmark(target, symbol string, calls, rate int, backend string, verbose bool) *UprobeBenchmark {
+	return &UprobeBenchmark{
+		target:  target,
+		symbol:  symbol,
+		calls:   calls,
+		rate:    rate,
+		backend: backend,
+		verbose: verbose,
+	}
+}
+
+// Run executes the benchmark
+func (b *UprobeBenchmark) Run(ctx context.Context) (*BenchmarkResult, error) {
+	buffer := NewEventBuffer(b.calls)
+	buffer.SetProgress(NewProgress("uprobe"))
+	probe, fallback, err := newUprobeDriver(b.backend, b.target, b.symbol, buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &BenchmarkResult{
+		Name:           "Uprobe Event Delivery",
+		Language:       "Go",
+		ProgramType:    "uprobe",
+		DataMechanism:  "ringbuf",
+		ReaderStrategy: probe.Backend(),
+		Errors:         []string{},
+		Host:           CollectHostInfo(),
+	}
+	if probe.Backend() == probeBackendSim {
+		r.Errors = append(r.Errors, "uprobe simulated in userspace")
+		if fallback != "" {
+			r.Errors = append(r.Errors, "tracefs backend unavailable: "+fallback)
+		}
+	} else {
+		// tracefs uprobes write to the trace buffer, not a BPF ring buffer
+		r.DataMechanism = "tracefs"
+	}
+
+	if b.verbose {
+		PrintBenchmarkHeader("Uprobe Benchmark (Go)")
+	}
+	benchLog(ctx).Info("Probing", "symbol", b.symbol, "backend", probe.Backend(), "calls", b.calls, "rate", formatRate(b.rate))
+
+	startUsage, _ := TakeResourceSnapshot()
+	childStart, _ := TakeChildrenResourceSnapshot()
+	r.StartTime = time.Now()
+
+	unprobedTime, err := probe.Drive(b.calls, b.rate)
+	if err != nil {
+		return nil, err
+	}
+
+	attachStart := time.Now()
+	if err := probe.Attach(); err != nil {
+		return nil, err
+	}
+	attach := NewOperationResult("attach", 1, time.Since(attachStart))
+
+	probedTime, err := probe.Drive(b.calls, b.rate)
+	var delivered int64
+	if err == nil {
+		delivered, err = probe.Delivered()
+	}
+	detachStart := time.Now()
+	if detachErr := probe.Detach(); detachErr != nil && err == nil {
+		err = detachErr
+	}
+	detach := NewOperationResult("detach", 1, time.Since(detachStart))
+	if err != nil {
+		return nil, err
+	}
+
+	r.EndTime = time.Now()
+	endUsage, _ := TakeResourceSnapshot()
+	childEnd, _ := TakeChildrenResourceSnapshot()
+
+	unprobed := NewOperationResult("call_unprobed", int64(b.calls), unprobedTime)
+	probed := NewOperationResult("call_probed", int64(b.calls), probedTime)
+	r.Operations = []OperationResult{attach, detach, unprobed, probed}
+	r.OverheadNs = probed.AvgNs - unprobed.AvgNs
+
+	r.Duration = r.EndTime.Sub(r.StartTime).Seconds()
+	r.EventCount = delivered
+	r.RecordDrops(DropCounts{BufferFull: buffer.GetDroppedCount()})
+	if probedTime > 0 {
+		r.Throughput = float64(delivered) / probedTime.Seconds()
+	}
+	if delivered < int64(b.calls) {
+		r.Errors = append(r.Errors, fmt.Sprintf("%d of %d probed calls produced no event", int64(b.calls)-delivered, b.calls))
+	}
+	if probe.Backend() == probeBackendSim {
+		r.Latency = buffer.GetLatencyStats()
+		r.LatencyHistogram = buffer.GetLatencyHistogram(DefaultHistogramPrecision).Buckets()
+		r.Quality = buffer.GetDataQuality()
+	}
+	r.CPUBudget = NewCPUBudget(startUsage, endUsage, delivered)
+	if probe.Backend() == probeBackendTracefs {
+		// The target runs as a child, so RUSAGE_SELF already excludes it.
+		// Its system time includes the uprobe traps taken on its behalf.
+		gen := NewLoadGeneratorUsage("child", childStart, childEnd, childEnd.MaxRSS)
+		r.LoadGenerator = &gen
+	}
+	r.CPUUsage = r.CPUBudget.CPUPercent(endUsage.Wall.Sub(startUsage.Wall))
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	r.MemoryUsage = ms.Alloc
+
+	return r, nil
+}
+
+// formatRate renders a -rate value for status output
+func formatRate(rate int) string {
+	if rate <= 0 {
+		return "unlimited rate"
+	}
+	return fmt.Sprintf("%d calls/sec", rate)
+}
+
+// runUprobeBenchmark is the entry point of the uprobe subcommand
+func runUprobeBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("uprobe", flag.ExitOnError)
+	common := addBenchFlags(fs, "uprobe_result.json", false)
+	target := fs.String("target", defaultUprobeTarget, "Target binary (built by src/c/Makefile)")
+	symbol := fs.String("func", "bench_uprobe_target", "Function to probe in the target binary")
+	calls := fs.Int("calls", 1000000, "Calls to the probed function per measurement")
+	rate := fs.Int("rate", 0, "Calls per second (0 for unlimited; pacing hides per-call overhead)")
+	backend := fs.String("backend", probeBackendAuto, "Probe backend (auto, tracefs, sim)")
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+	if *calls <= 0 {
+		return nil, opts, fmt.Errorf("-calls must be positive")
+	}
+	if *rate < 0 {
+		return nil, opts, fmt.Errorf("-rate must not be negative")
+	}
+
+	bench := NewUprobeBenchmark(*target, *symbol, *calls, *rate, *backend, opts.Verbose)
+	r, err := bench.Run(ctx)
+	if err != nil {
+		return nil, opts, err
+	}
+
+	return []*BenchmarkResult{r}, opts, nil
+}
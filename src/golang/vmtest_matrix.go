@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KernelRun is the outcome of running a benchmark inside one VM
+type KernelRun struct {
+	Kernel   string // Kernel version label, derived from the image name
+	Image    string // Path to the kernel image
+	Duration float64
+	Results  []*BenchmarkResult
+	Error    string
+}
+
+// VMMatrixRunner boots one vmtest (qemu) VM per kernel image and runs a
+// benchmark inside each. vmtest shares the host root filesystem with the
+// guest, so the running binary and output directory are reachable from
+// inside the VM at the same paths.
+type VMMatrixRunner struct {
+	vmtest    string
+	images    []string
+	benchArgs []string
+	outDir    string
+	timeout   time.Duration
+}
+
+// kernelLabel derives a version label from a kernel image file name, e.g.
+// "bzImage-6.1.55" -> "6.1.55" and "vmlinuz-5.15.0-91-generic" -> "5.15.0-91-generic"
+func kernelLabel(image string) string {
+	base := filepath.Base(image)
+	for _, prefix := range []string{"bzImage-", "vmlinuz-", "Image-", "vmlinux-"} {
+		if v, ok := strings.CutPrefix(base, prefix); ok {
+			return v
+		}
+	}
+	return base
+}
+
+// findKernelImages lists kernel images in a directory
+func findKernelImages(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var images []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() {
+			continue
+		}
+		for _, prefix := range []string{"bzImage", "vmlinuz", "Image", "vmlinux"} {
+			if strings.HasPrefix(name, prefix) {
+				images = append(images, filepath.Join(dir, name))
+				break
+			}
+		}
+	}
+	sort.Strings(images)
+	return images, nil
+}
+
+// LoadResultsFromJSON loads a result file holding either a single result,
+// an array of results, or JSON lines appended by the jsonl output format
+func LoadResultsFromJSON(filename string) ([]*BenchmarkResult, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read result file: %w", err)
+	}
+	var results []*BenchmarkResult
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to parse result file %s: %w", filename, err)
+		}
+		if raw = bytes.TrimSpace(raw); len(raw) > 0 && raw[0] == '[' {
+			var batch []*BenchmarkResult
+			if err := json.Unmarshal(raw, &batch); err != nil {
+				return nil, fmt.Errorf("failed to parse result file %s: %w", filename, err)
+			}
+			results = append(results, batch...)
+			continue
+		}
+		var r BenchmarkResult
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return nil, fmt.Errorf("failed to parse result file %s: %w", filename, err)
+		}
+		results = append(results, &r)
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("result file %s is empty", filename)
+	}
+	normalizeResultTimes(results)
+	return results, nil
+}
+
+// Run executes the benchmark once per kernel image
+func (m *VMMatrixRunner) Run() ([]KernelRun, error) {
+	if _, err := exec.LookPath(m.vmtest); err != nil {
+		return nil, fmt.Errorf("vmtest not found (install from https://github.com/danobi/vmtest): %w", err)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate benchmark binary: %w", err)
+	}
+	outDir, err := filepath.Abs(m.outDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, err
+	}
+
+	var runs []KernelRun
+	for _, image := range m.images {
+		run := KernelRun{Kernel: kernelLabel(image), Image: image}
+		resultFile := filepath.Join(outDir, fmt.Sprintf("result-%s.json", run.Kernel))
+		// A result left from an earlier matrix must not pass for this boot's
+		if err := os.Remove(resultFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to remove stale result: %w", err)
+		}
+
+		guestCmd := append([]string{self}, m.benchArgs...)
+		guestCmd = append(guestCmd, "-o", resultFile)
+
+		slog.Info("Booting kernel", "kernel", run.Kernel)
+
+		start := time.Now()
+		cmd := exec.Command(m.vmtest, "--kernel", image, shellJoin(guestCmd))
+		var output bytes.Buffer
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		err := runWithTimeout(cmd, m.timeout)
+		run.Duration = time.Since(start).Seconds()
+
+		if err != nil {
+			run.Error = fmt.Sprintf("vmtest failed: %v: %s", err, lastLines(output.String(), 5))
+		} else if _, err := os.Stat(resultFile); errors.Is(err, fs.ErrNotExist) {
+			run.Error = fmt.Sprintf("benchmark wrote no result: %s", lastLines(output.String(), 5))
+		} else if run.Results, err = LoadResultsFromJSON(resultFile); err != nil {
+			run.Error = err.Error()
+		}
+
+		if run.Error != "" {
+			slog.Info("Kernel run failed", "kernel", run.Kernel, "err", run.Error)
+		} else {
+			slog.Info("Kernel run completed", "kernel", run.Kernel, "seconds", run.Duration)
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+// runWithTimeout runs cmd, killing it if it exceeds timeout (0 = no limit)
+func runWithTimeout(cmd *exec.Cmd, timeout time.Duration) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if timeout <= 0 {
+		return cmd.Wait()
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		<-done
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+}
+
+// shellJoin quotes arguments for the single command string vmtest expects
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// lastLines returns the final n lines of s
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, " | ")
+}
+
+// printKernelMatrix prints throughput per kernel and benchmark
+func printKernelMatrix(runs []KernelRun) {
+	PrintSeparator()
+	fmt.Printf("%-24s %-40s %15s\n", "Kernel", "Benchmark", "Throughput")
+	for _, run := range runs {
+		if run.Error != "" {
+			fmt.Printf("%-24s %-40s %15s\n", run.Kernel, "-", "FAILED")
+			continue
+		}
+		for _, r := range run.Results {
+			fmt.Printf("%-24s %-40s %15.0f\n", run.Kernel, r.Name, r.Throughput)
+		}
+	}
+	PrintSeparator()
+}
+
+// runVMMatrix is the entry point of the matrix subcommand
+func runVMMatrix(args []string) error {
+	fs := flag.NewFlagSet("matrix", flag.ExitOnError)
+	kernels := fs.String("kernels", "", "Comma-separated kernel images to boot")
+	kernelDir := fs.String("kernel-dir", "", "Directory of kernel images (bzImage-*, vmlinuz-*)")
+	vmtestBin := fs.String("vmtest", "vmtest", "Path to the vmtest binary")
+	bench := fs.String("bench", "ringbuf -d 5", "Benchmark arguments run inside each VM (e.g. \"maps -n 100000\")")
+	outDir := fs.String("outdir", "matrix_results", "Directory for per-kernel result files")
+	timeout := fs.Duration("timeout", 10*time.Minute, "Per-VM timeout")
+	verbose := fs.Bool("v", false, "Verbose output (same as -log-level info)")
+	logLevel := fs.String("log-level", "", "Log records at or above this level: debug, info, warn or error (default info with -v, else warn)")
+	logFormat := fs.String("log-format", logFormatText, "Log format: text status lines, or json records on stderr for machine parsing")
+	output := fs.String("o", "matrix_result.json", "Output JSON file")
+	pretty := fs.Bool("pretty", true, "Pretty-print JSON output")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if _, err := configureLogging(*logLevel, *logFormat, *verbose); err != nil {
+		return err
+	}
+
+	images := splitList(*kernels)
+	if *kernelDir != "" {
+		found, err := findKernelImages(*kernelDir)
+		if err != nil {
+			return err
+		}
+		images = append(images, found...)
+	}
+	if len(images) == 0 {
+		return fmt.Errorf("no kernel images given (use -kernels or -kernel-dir)")
+	}
+
+	runner := &VMMatrixRunner{
+		vmtest:    *vmtestBin,
+		images:    images,
+		benchArgs: strings.Fields(*bench),
+		outDir:    *outDir,
+		timeout:   *timeout,
+	}
+	runs, err := runner.Run()
+	if err != nil {
+		return err
+	}
+
+	if err := saveJSON(*output, runs, *pretty); err != nil {
+		fmt.Printf("Warning: Failed to save result: %v\n", err)
+	}
+	printKernelMatrix(runs)
+	return nil
+}
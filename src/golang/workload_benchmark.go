@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/parlakisik/ebpf_benchmark/src/golang/workloadgen"
+)
+
+// runWorkloadBenchmark is the entry point of the workload subcommand. It
+// runs a workloadgen load on its own and reports the rate it achieved
+// against the rate offered, so a benchmark run beside it in a parallel
+// suite, or an external eBPF consumer, sees a known load.
+func runWorkloadBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("workload", flag.ExitOnError)
+	common := addBenchFlags(fs, "workload_result.json", true)
+	kindName := fs.String("kind", string(workloadgen.Getpid), "Workload (getpid, open-close, read-write, udp, sched)")
+	rate := fs.Int("rate", 10000, "Target operations per second across workers (0 runs flat out)")
+	workers := fs.Int("workers", 1, "Child processes sharing the rate")
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+	kind, err := workloadgen.ParseKind(*kindName)
+	if err != nil {
+		return nil, opts, err
+	}
+	if *rate < 0 {
+		return nil, opts, fmt.Errorf("-rate must not be negative")
+	}
+	if *workers <= 0 {
+		return nil, opts, fmt.Errorf("-workers must be positive")
+	}
+
+	r := &BenchmarkResult{
+		Name:           "Workload Generator",
+		Language:       "Go",
+		ProgramType:    "none",
+		DataMechanism:  string(kind),
+		ReaderStrategy: fmt.Sprintf("workers=%d/rate=%s", *workers, formatOfferedRate(*rate)),
+		Host:           CollectHostInfo(),
+		Errors:         []string{},
+	}
+	if opts.Verbose {
+		PrintBenchmarkHeader("Workload Generator (Go)")
+	}
+	benchLog(ctx).Info("Running workload", "kind", kind, "workers", *workers, "rate", formatOfferedRate(*rate), "duration", opts.Duration)
+
+	childStart, _ := TakeChildrenResourceSnapshot()
+	r.StartTime = time.Now()
+	gen, err := workloadgen.Start(workloadgen.Config{Kind: kind, Rate: *rate, Workers: *workers, Duration: opts.Duration})
+	if err != nil {
+		return nil, opts, err
+	}
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			gen.Stop()
+		case <-finished:
+		}
+	}()
+	res, err := gen.Wait()
+	close(finished)
+	if err != nil {
+		return nil, opts, err
+	}
+	r.EndTime = time.Now()
+	childEnd, _ := TakeChildrenResourceSnapshot()
+	markInterrupted(ctx, r)
+
+	r.Duration = res.Elapsed.Seconds()
+	r.EventCount = res.Operations
+	r.Throughput = res.Achieved
+	usage := NewLoadGeneratorUsage("child", childStart, childEnd, childEnd.MaxRSS)
+	r.LoadGenerator = &usage
+	r.CPUBudget = NewCPUBudget(childStart, childEnd, res.Operations)
+	r.CPUUsage = r.CPUBudget.CPUPercent(res.Elapsed)
+	r.Operations = []OperationResult{NewOperationResult(string(kind), res.Operations, res.Elapsed)}
+	if *rate > 0 && res.Achieved < 0.95*float64(*rate) {
+		r.Errors = append(r.Errors, fmt.Sprintf("achieved %.0f of the %d ops/sec offered", res.Achieved, *rate))
+	}
+	return []*BenchmarkResult{r}, opts, nil
+}
+
+// formatOfferedRate renders a -rate value for result labels
+func formatOfferedRate(rate int) string {
+	if rate <= 0 {
+		return "max"
+	}
+	return fmt.Sprintf("%d/s", rate)
+}
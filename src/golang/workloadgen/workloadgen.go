@@ -0,0 +1,328 @@
+// Package workloadgen drives kernel events from child processes at a
+// target rate, so benchmarks run against a known offered load. Children
+// are re-executions of the current binary, which must call RunChild
+// before anything else in main.
+package workloadgen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// childEnv carries a child's Config; its presence makes RunChild take over
+const childEnv = "EBPF_BENCH_WORKLOADGEN"
+
+// Kind is the operation a workload repeats
+type Kind string
+
+const (
+	Getpid    Kind = "getpid"     // getpid(2), the cheapest syscall entry and exit
+	OpenClose Kind = "open-close" // openat(2) and close(2) of /dev/null
+	ReadWrite Kind = "read-write" // One-byte write(2) and read(2) through a pipe
+	UDP       Kind = "udp"        // A 64-byte datagram over loopback, sent and received
+	Sched     Kind = "sched"      // A pipe round trip between two threads, two context switches
+)
+
+// Kinds lists every workload
+var Kinds = []Kind{Getpid, OpenClose, ReadWrite, UDP, Sched}
+
+// ParseKind parses a workload name
+func ParseKind(s string) (Kind, error) {
+	for _, k := range Kinds {
+		if string(k) == s {
+			return k, nil
+		}
+	}
+	names := make([]string, len(Kinds))
+	for i, k := range Kinds {
+		names[i] = string(k)
+	}
+	return "", fmt.Errorf("unknown workload %q (want %s)", s, strings.Join(names, ", "))
+}
+
+// Config describes a workload
+type Config struct {
+	Kind     Kind
+	Rate     int           // Operations per second across all workers; 0 runs flat out
+	Workers  int           // Child processes, each running its share of Rate
+	Duration time.Duration // How long children run; 0 runs until Stop
+}
+
+// Result is what a workload achieved
+type Result struct {
+	Operations int64   // Completed across all workers
+	PerWorker  []int64 // Completed by each worker
+	Elapsed    time.Duration
+	Achieved   float64 // Operations per second
+}
+
+// Generator is a running workload
+type Generator struct {
+	cfg   Config
+	cmds  []*exec.Cmd
+	outs  []*bytes.Buffer
+	start time.Time
+}
+
+// Start launches the workers of cfg
+func Start(cfg Config) (*Generator, error) {
+	if cfg.Workers <= 0 {
+		return nil, fmt.Errorf("workers must be positive")
+	}
+	if cfg.Rate < 0 {
+		return nil, fmt.Errorf("rate must not be negative")
+	}
+	if _, err := ParseKind(string(cfg.Kind)); err != nil {
+		return nil, err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Generator{cfg: cfg, start: time.Now()}
+	for i := 0; i < cfg.Workers; i++ {
+		share := cfg
+		share.Workers = 1
+		if cfg.Rate > 0 {
+			// Spread the remainder so the shares add up to Rate
+			share.Rate = cfg.Rate / cfg.Workers
+			if i < cfg.Rate%cfg.Workers {
+				share.Rate++
+			}
+		}
+		env, err := json.Marshal(share)
+		if err != nil {
+			return nil, err
+		}
+		out := &bytes.Buffer{}
+		cmd := exec.Command(exe)
+		cmd.Env = append(os.Environ(), childEnv+"="+string(env))
+		cmd.Stdout = out
+		cmd.Stderr = os.Stderr
+		if err := cmd.Start(); err != nil {
+			g.Stop()
+			g.Wait()
+			return nil, fmt.Errorf("start worker %d: %w", i, err)
+		}
+		g.cmds = append(g.cmds, cmd)
+		g.outs = append(g.outs, out)
+	}
+	return g, nil
+}
+
+// Stop asks every worker to finish early; Wait still collects their counts
+func (g *Generator) Stop() {
+	for _, cmd := range g.cmds {
+		cmd.Process.Signal(syscall.SIGTERM)
+	}
+}
+
+// Wait waits for every worker and sums their operations
+func (g *Generator) Wait() (Result, error) {
+	var res Result
+	var firstErr error
+	for i, cmd := range g.cmds {
+		err := cmd.Wait()
+		n, perr := strconv.ParseInt(strings.TrimSpace(g.outs[i].String()), 10, 64)
+		if err == nil && perr != nil {
+			err = fmt.Errorf("unreadable count %q", g.outs[i].String())
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("worker %d: %w", i, err)
+		}
+		res.PerWorker = append(res.PerWorker, n)
+		res.Operations += n
+	}
+	res.Elapsed = time.Since(g.start)
+	if res.Elapsed > 0 {
+		res.Achieved = float64(res.Operations) / res.Elapsed.Seconds()
+	}
+	return res, firstErr
+}
+
+// RunChild runs the workload and exits when the process was started as a
+// worker. Otherwise it returns immediately.
+func RunChild() {
+	env, ok := os.LookupEnv(childEnv)
+	if !ok {
+		return
+	}
+	var cfg Config
+	if err := json.Unmarshal([]byte(env), &cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "workloadgen: bad %s: %v\n", childEnv, err)
+		os.Exit(2)
+	}
+	n, err := run(cfg)
+	fmt.Println(n)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "workloadgen: %s: %v\n", cfg.Kind, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// run repeats the operation of cfg until its duration elapses or the
+// process is signalled, pacing to cfg.Rate, and returns how many it did
+func run(cfg Config) (int64, error) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+	var done atomic.Bool
+	go func() {
+		<-ctx.Done()
+		done.Store(true)
+	}()
+
+	op, cleanup, err := newOp(cfg.Kind)
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup()
+
+	runtime.LockOSThread()
+	start := time.Now()
+	var n int64
+	for !done.Load() {
+		if cfg.Rate > 0 {
+			// Sleep until the next operation is due; run back to back
+			// while behind schedule
+			due := start.Add(time.Duration(float64(n) / float64(cfg.Rate) * float64(time.Second)))
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+				continue
+			}
+		}
+		if err := op(); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// newOp prepares the operation of a workload and returns it with the
+// cleanup of whatever it opened
+func newOp(kind Kind) (op func() error, cleanup func(), err error) {
+	nothing := func() {}
+	switch kind {
+	case Getpid:
+		return func() error { syscall.Getpid(); return nil }, nothing, nil
+
+	case OpenClose:
+		return func() error {
+			fd, err := syscall.Open("/dev/null", syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+			if err != nil {
+				return err
+			}
+			return syscall.Close(fd)
+		}, nothing, nil
+
+	case ReadWrite:
+		var p [2]int
+		if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC); err != nil {
+			return nil, nil, err
+		}
+		buf := []byte{0}
+		return func() error {
+				if _, err := syscall.Write(p[1], buf); err != nil {
+					return err
+				}
+				_, err := syscall.Read(p[0], buf)
+				return err
+			}, func() {
+				syscall.Close(p[0])
+				syscall.Close(p[1])
+			}, nil
+
+	case UDP:
+		return newUDPOp()
+
+	case Sched:
+		return newSchedOp()
+	}
+	return nil, nil, fmt.Errorf("unknown workload %q", kind)
+}
+
+// newUDPOp connects a loopback UDP socket to itself, so every datagram
+// crosses the IP stack out and back in
+func newUDPOp() (func() error, func(), error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { syscall.Close(fd) }
+	loopback := &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}
+	if err := syscall.Bind(fd, loopback); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	self, err := syscall.Getsockname(fd)
+	if err == nil {
+		err = syscall.Connect(fd, self)
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	buf := make([]byte, 64)
+	return func() error {
+		if _, err := syscall.Write(fd, buf); err != nil {
+			return err
+		}
+		_, err := syscall.Read(fd, buf)
+		return err
+	}, cleanup, nil
+}
+
+// newSchedOp starts an echo thread answering over a pipe pair, so every
+// operation blocks once on each side and forces two context switches
+func newSchedOp() (func() error, func(), error) {
+	var ping, pong [2]int
+	if err := syscall.Pipe2(ping[:], syscall.O_CLOEXEC); err != nil {
+		return nil, nil, err
+	}
+	if err := syscall.Pipe2(pong[:], syscall.O_CLOEXEC); err != nil {
+		syscall.Close(ping[0])
+		syscall.Close(ping[1])
+		return nil, nil, err
+	}
+	go func() {
+		runtime.LockOSThread()
+		buf := []byte{0}
+		for {
+			if n, err := syscall.Read(ping[0], buf); err != nil || n == 0 {
+				return
+			}
+			if _, err := syscall.Write(pong[1], buf); err != nil {
+				return
+			}
+		}
+	}()
+	buf := []byte{0}
+	return func() error {
+			if _, err := syscall.Write(ping[1], buf); err != nil {
+				return err
+			}
+			_, err := syscall.Read(pong[0], buf)
+			return err
+		}, func() {
+			syscall.Close(ping[1]) // EOF ends the echo thread
+			syscall.Close(pong[0])
+		}, nil
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// xdpAction mirrors the kernel's enum xdp_action
+type xdpAction uint32
+
+const (
+	xdpAborted xdpAction = iota
+	xdpDrop
+	xdpPass
+	xdpTX
+	xdpRedirect
+)
+
+var xdpActionNames = map[xdpAction]string{
+	xdpAborted:  "aborted",
+	xdpDrop:     "drop",
+	xdpPass:     "pass",
+	xdpTX:       "tx",
+	xdpRedirect: "redirect",
+}
+
+func (a xdpAction) String() string {
+	if name, ok := xdpActionNames[a]; ok {
+		return name
+	}
+	return fmt.Sprintf("action(%d)", uint32(a))
+}
+
+// parseXDPAction parses an -action flag value
+func parseXDPAction(s string) (xdpAction, error) {
+	for a, name := range xdpActionNames {
+		if strings.EqualFold(s, name) {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown XDP action %q (want pass, drop, tx or redirect)", s)
+}
+
+// xdpProgram is a userspace model of xdp_throughput.c: it parses
+// Ethernet/IPv4/UDP headers, counts packets and returns the configured
+// action. With a conntrack table it also tracks every packet's flow, as a
+// stateful load balancer or firewall would.
+type xdpProgram struct {
+	action      xdpAction
+	ct          *ctTable
+	packets     uint64
+	bytes       uint64
+	parseErrors uint64
+}
+
+// Run processes one packet, returning the XDP verdict and the UDP payload
+// offset (0 if the packet could not be parsed)
+func (p *xdpProgram) Run(pkt []byte) (uint32, int) {
+	l3, payload, err := parsePacket(pkt)
+	if err != nil {
+		p.parseErrors++
+		return uint32(xdpPass), 0
+	}
+
+	p.packets++
+	p.bytes += uint64(len(pkt))
+	if p.ct != nil {
+		p.ct.track(pkt, l3, payload, nowNs()) // bpf_ktime_get_ns for the flow's last-seen time
+	}
+	return uint32(p.action), payload
+}
+
+// XDPBenchmark measures XDP packet-processing throughput and per-packet
+// latency: xdp_throughput's program attached to a veth pair, or its
+// userspace model on a simulated pair
+type XDPBenchmark struct {
+	duration   time.Duration
+	backend    string // auto, bpf or sim
+	phases     Phases
+	coord      *coordination // Phase marker channel; nil is an atomic
+	pinning    *cpuPinning   // Consumer and generator CPUs; nil leaves them unpinned
+	packetSize int
+	flows      int
+	headers    *HeaderStack // Layers of the generated frames; nil is IPv4
+	action     xdpAction
+	ringSize   int
+	interfaces []string // Attach points, each a veth end with its own generator
+	conntrack  *ctTable // Flow table shared by the attach points; nil is stateless
+	payload    PayloadGenerator
+	seed       uint64 // Payload seed; attach point i uses seed+i
+	maxSamples int
+	verbose    bool
+	result     *BenchmarkResult
+}
+
+// NewXDPBenchmark creates a new benchmark instance
+func NewXDPBenchmark(duration time.Duration, packetSize, flows int, action xdpAction, ringSize int, verbose bool) *XDPBenchmark {
+	return &XDPBenchmark{
+		duration:   duration,
+		backend:    probeBackendAuto,
+		packetSize: packetSize,
+		flows:      flows,
+		action:     action,
+		ringSize:   ringSize,
+		interfaces: xdpAttachPoints(1, false),
+		maxSamples: 10000000, // Same cap as the ring buffer event buffer
+		verbose:    verbose,
+		result: &BenchmarkResult{
+			Name:           "XDP Packet Processing",
+			Language:       "Go",
+			ProgramType:    "xdp",
+			DataMechanism:  "veth",
+			ReaderStrategy: action.String(), // Run prefixes the backend
+			Errors:         []string{},
+		},
+	}
+}
+
+// Run executes the benchmark until its duration elapses or ctx is done.
+// Each attach point runs its own veth and generator concurrently, as XDP
+// programs on several NICs would. The attached program is shared by every
+// attach point and reports to one ring buffer, which one consumer drains;
+// the model runs one instance and consumer per attach point. The result
+// aggregates them and breaks them down per interface.
+func (b *XDPBenchmark) Run(ctx context.Context) error {
+	n := len(b.interfaces)
+	gens := make([]*PacketGenerator, n)
+	progs := make([]*xdpProgram, n)
+	buffers := make([]*EventBuffer, n)
+	progress := NewProgress("xdp")
+	for i := range b.interfaces {
+		gen, err := NewPacketGenerator(b.packetSize, b.flows)
+		if err != nil {
+			return err
+		}
+		if b.headers != nil {
+			if err := gen.SetHeaders(b.headers); err != nil {
+				return err
+			}
+		}
+		if b.payload != nil {
+			payload := b.payload
+			if i > 0 {
+				if payload, err = NewPayloadGenerator(b.payload.Name(), b.seed+uint64(i)); err != nil {
+					return err
+				}
+			}
+			gen.SetPayload(payload)
+			b.result.Payload = b.payload.Name()
+		}
+		gens[i] = gen
+		progs[i] = &xdpProgram{action: b.action, ct: b.conntrack}
+		buffers[i] = NewEventBuffer(b.maxSamples / n)
+		buffers[i].SetProgress(progress)
+	}
+
+	if b.verbose {
+		PrintBenchmarkHeader("XDP Packet Processing Benchmark (Go)")
+	}
+	benchLog(ctx).Info("Running", "duration", b.duration, "packet_size", b.packetSize,
+		"flows", b.flows, "action", b.action, "interfaces", strings.Join(b.interfaces, ","))
+
+	opts := bpfPacketOptions{
+		points:      b.interfaces,
+		verdict:     uint32(b.action),
+		frameSize:   b.packetSize,
+		unsupported: b.bpfUnsupported(),
+	}
+	if b.conntrack != nil {
+		opts.ctMap, opts.ctEntries = b.conntrack.mapType(), b.conntrack.maxEntries
+	}
+	path, err := openPacketBackend(b.backend, xdpHook, opts)
+	if err != nil {
+		return err
+	}
+	if path != nil {
+		defer path.Close()
+		b.result.ReaderStrategy = probeBackendBPF + "/" + path.mode + "/" + b.result.ReaderStrategy
+	} else {
+		b.result.ReaderStrategy = probeBackendSim + "/" + b.result.ReaderStrategy
+		b.result.Errors = append(b.result.Errors, simPacketNote("xdp"))
+	}
+
+	b.result.Host = CollectHostInfo()
+	// A channel carries one pipeline's phase, so several interfaces each
+	// get a fresh atomic
+	coord := b.coord
+	if n > 1 {
+		coord = nil
+	}
+	pin := b.pinning.newRun()
+	all := make([]pipelineStats, n)
+	var counters bpfPipelineCounters
+	if path != nil {
+		all, counters = runBPFPacketPipeline(ctx, b.phases, coord, pin, b.duration, path, gens, b.maxSamples,
+			eventTypeXDP, buffers)
+	} else {
+		var wg sync.WaitGroup
+		for i := range b.interfaces {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				all[i] = runPacketPipeline(ctx, b.phases, coord, pin, b.duration, gens[i], b.ringSize, b.maxSamples/n,
+					eventTypeXDP, buffers[i], progs[i].Run)
+			}(i)
+		}
+		wg.Wait()
+		for _, prog := range progs {
+			counters.parseErrors += int64(prog.parseErrors)
+		}
+	}
+	stats := mergePipelineStats(all, b.maxSamples)
+	buffer := mergePacketBuffers(buffers)
+
+	b.result.StartTime = stats.start.Wall
+	b.result.EndTime = stats.end.Wall
+
+	fillPacketResult(b.result, stats, buffer, stats.start, stats.end)
+	b.result.Affinity = pin.stats()
+	b.result.Operations = verdictOperations(stats, b.result.Duration, func(v uint32) string {
+		return xdpAction(v).String()
+	})
+	if path != nil {
+		recordBPFPacketCounters(b.result, stats, counters)
+	}
+	if counters.parseErrors > 0 {
+		b.result.Errors = append(b.result.Errors, fmt.Sprintf("%d packets failed to parse", counters.parseErrors))
+	}
+	if n > 1 {
+		var parseErrors []uint64
+		if path == nil {
+			parseErrors = make([]uint64, n)
+			for i, prog := range progs {
+				parseErrors[i] = prog.parseErrors
+			}
+		}
+		b.result.Interfaces = interfaceStats(b.interfaces, all, buffers, parseErrors)
+	}
+	if b.conntrack != nil && path != nil {
+		if b.result.FlowTable, err = path.flowTableStats(b.conntrack.maxEntries); err != nil {
+			return err
+		}
+	} else if b.conntrack != nil {
+		b.result.FlowTable = b.conntrack.stats()
+	}
+
+	return nil
+}
+
+// bpfUnsupported reports why the run's options need the userspace model,
+// or nil when the program can run them
+func (b *XDPBenchmark) bpfUnsupported() error {
+	if b.headers != nil && b.headers.String() != defaultHeaderStack {
+		return fmt.Errorf("the XDP program parses Ethernet/IPv4/UDP only, not -headers %s", b.headers)
+	}
+	return nil
+}
+
+// runXDPBenchmark is the entry point of the xdp subcommand
+func runXDPBenchmark(ctx context.Context, args []string) ([]*BenchmarkResult, benchOptions, error) {
+	fs := flag.NewFlagSet("xdp", flag.ExitOnError)
+	common := addBenchFlags(fs, "xdp_result.json", true)
+	size := fs.Int("size", 64, "Packet size in bytes")
+	flowList := fs.String("flows", "1", "Distinct flows; a comma-separated list such as 1k,100k,1M sweeps them")
+	actionName := fs.String("action", "pass", "XDP action returned by the program (pass, drop, tx, redirect)")
+	ringSize := fs.Int("ring", 1024, "veth ring size in frames")
+	payloadName := fs.String("payload", "syscall", "Payload contents (zeros, random, syscall)")
+	seed := fs.Uint64("seed", 1, "Payload generator seed")
+	pairs := fs.Int("interfaces", 1, "veth pairs to attach to at once, each with its own generator")
+	bothEnds := fs.Bool("both-ends", false, "Attach to both ends of every veth pair")
+	headerFlag := fs.String("headers", defaultHeaderStack, "Headers between the outer Ethernet and UDP (vlan, ipv4, ipv6, vxlan, geneve; e.g. vlan,ipv6)")
+	conntrack := fs.Bool("conntrack", false, "Track every packet's flow in a conntrack map")
+	ctMap := fs.String("ct-map", mapTypeLRUHash, "Conntrack map type (hash, lru_hash)")
+	ctEntries := fs.Int("ct-entries", 1<<20, "Conntrack map size in flows")
+	backend := fs.String("backend", probeBackendAuto, "Packet path backend (auto, bpf, sim)")
+	phaseFlags := addPhaseFlags(fs)
+	coordFlags := addCoordFlags(fs)
+	affinityFlags := addAffinityFlags(fs, true)
+	if err := fs.Parse(args); err != nil {
+		return nil, benchOptions{}, err
+	}
+	opts, err := common.options()
+	if err != nil {
+		return nil, opts, err
+	}
+
+	flows, err := parseFlowCounts(*flowList)
+	if err != nil {
+		return nil, opts, fmt.Errorf("invalid -flows: %w", err)
+	}
+	action, err := parseXDPAction(*actionName)
+	if err != nil {
+		return nil, opts, err
+	}
+	if *ringSize <= 0 {
+		return nil, opts, fmt.Errorf("-ring must be positive")
+	}
+	if *pairs <= 0 {
+		return nil, opts, fmt.Errorf("-interfaces must be positive")
+	}
+	headers, err := parseHeaderStack(*headerFlag)
+	if err != nil {
+		return nil, opts, fmt.Errorf("invalid -headers: %w", err)
+	}
+	if *size < headers.MinSize() {
+		return nil, opts, fmt.Errorf("-size %d too small for -headers %s (minimum %d)", *size, headers, headers.MinSize())
+	}
+	payload, err := NewPayloadGenerator(*payloadName, *seed)
+	if err != nil {
+		return nil, opts, err
+	}
+	phases, err := phaseFlags.phases()
+	if err != nil {
+		return nil, opts, err
+	}
+	coord, err := coordFlags.open()
+	if err != nil {
+		return nil, opts, err
+	}
+	defer coord.Close()
+	pinning, err := affinityFlags.pinning()
+	if err != nil {
+		return nil, opts, err
+	}
+	interfaces := xdpAttachPoints(*pairs, *bothEnds)
+	if coord.m != nil && len(interfaces) > 1 {
+		return nil, opts, fmt.Errorf("-coord pinned-map carries the phase of one generator; use a single interface")
+	}
+
+	// Each flow count is a run of its own with a fresh table
+	var results []*BenchmarkResult
+	for _, n := range flows {
+		bench := NewXDPBenchmark(opts.Duration, *size, n, action, *ringSize, opts.Verbose)
+		bench.backend = *backend
+		bench.interfaces = interfaces
+		bench.headers = headers
+		bench.result.HeaderStack = headers.String()
+		if len(interfaces) > 1 {
+			bench.result.ReaderStrategy += fmt.Sprintf("/ifaces=%d", len(interfaces))
+		}
+		if *conntrack {
+			if bench.conntrack, err = newCTTable(*ctMap, *ctEntries); err != nil {
+				return nil, opts, err
+			}
+			bench.result.ReaderStrategy += "/conntrack"
+		}
+		if len(flows) > 1 || *conntrack {
+			bench.result.ReaderStrategy += "/flows=" + formatFlowCount(n)
+		}
+		bench.payload = payload
+		bench.seed = *seed
+		bench.phases = phases
+		bench.coord = coord
+		bench.pinning = pinning
+		phases.record(bench.result)
+		if err := bench.Run(ctx); err != nil {
+			return nil, opts, err
+		}
+		results = append(results, bench.result)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(results) > 1 {
+		printFlowSweep(results, flows)
+	}
+	return results, opts, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// InterfaceStats are the packets one XDP attach point processed
+type InterfaceStats struct {
+	Interface   string
+	Packets     int64
+	Share       float64 // Of the packets across all interfaces
+	Throughput  float64 // Packets per second
+	Latency     LatencyStats
+	Dropped     int64 // Packets not recorded because the buffer was full
+	ParseErrors uint64
+}
+
+// xdpAttachPoints names the interfaces a run attaches to: one end of each
+// veth pair, or both ends
+func xdpAttachPoints(pairs int, bothEnds bool) []string {
+	var names []string
+	for i := 0; i < pairs; i++ {
+		names = append(names, fmt.Sprintf("veth%da", i))
+		if bothEnds {
+			names = append(names, fmt.Sprintf("veth%db", i))
+		}
+	}
+	return names
+}
+
+// mergePipelineStats combines the runs of concurrent pipelines as one run:
+// counts and generator usage add up, and the measured window spans the
+// earliest start to the latest end
+func mergePipelineStats(all []pipelineStats, maxSamples int) pipelineStats {
+	merged := all[0]
+	if len(all) == 1 {
+		return merged
+	}
+	merged.verdicts = make(map[uint32]int64)
+	merged.samples = nil
+	merged.latency = StreamingLatency{}
+	merged.received, merged.sent = 0, 0
+	var gen LoadGeneratorUsage
+	for _, s := range all {
+		merged.received += s.received
+		merged.sent += s.sent
+		merged.latency.Merge(&s.latency)
+		room := maxSamples - len(merged.samples)
+		merged.samples = append(merged.samples, s.samples[:min(room, len(s.samples))]...)
+		for v, n := range s.verdicts {
+			merged.verdicts[v] += n
+		}
+		merged.interrupted = merged.interrupted || s.interrupted
+		if s.start.Wall.Before(merged.start.Wall) {
+			merged.start = s.start
+		}
+		if s.end.Wall.After(merged.end.Wall) {
+			merged.end = s.end
+		}
+		gen.Source = s.generator.Source
+		gen.UserTimeUs += s.generator.UserTimeUs
+		gen.SystemTimeUs += s.generator.SystemTimeUs
+		gen.CPUPercent += s.generator.CPUPercent
+		gen.MemoryBytes += s.generator.MemoryBytes
+	}
+	merged.generator = gen
+	return merged
+}
+
+// mergePacketBuffers combines the buffers of concurrent pipelines into one
+// ordered by timestamp, spanning all their windows
+func mergePacketBuffers(bufs []*EventBuffer) *EventBuffer {
+	if len(bufs) == 1 {
+		return bufs[0]
+	}
+	total := 0
+	for _, b := range bufs {
+		total += len(b.events)
+	}
+	eb := NewEventBuffer(total)
+	eb.startTime, eb.endTime = bufs[0].startTime, bufs[0].endTime
+	for _, b := range bufs {
+		eb.events = append(eb.events, b.ordered()...)
+		eb.dropped += b.dropped
+		if b.startTime.Before(eb.startTime) {
+			eb.startTime = b.startTime
+		}
+		if b.endTime.After(eb.endTime) {
+			eb.endTime = b.endTime
+		}
+	}
+	sort.SliceStable(eb.events, func(i, j int) bool { return eb.events[i].Timestamp < eb.events[j].Timestamp })
+	return eb
+}
+
+// interfaceStats reports each attach point of a multi-interface run.
+// parseErrors are by attach point; an attached program counts them only
+// in total, so it passes nil.
+func interfaceStats(names []string, all []pipelineStats, bufs []*EventBuffer, parseErrors []uint64) []InterfaceStats {
+	var total int64
+	for _, s := range all {
+		total += s.received
+	}
+	stats := make([]InterfaceStats, len(names))
+	for i, name := range names {
+		s := all[i]
+		st := InterfaceStats{
+			Interface: name,
+			Packets:   s.received,
+			Latency:   s.latency.Stats(),
+			Dropped:   bufs[i].GetDroppedCount(),
+		}
+		if parseErrors != nil {
+			st.ParseErrors = parseErrors[i]
+		}
+		st.Latency.Percentiles = computeLatencyStats(s.samples, DefaultQuantiles).Percentiles
+		if total > 0 {
+			st.Share = float64(s.received) / float64(total)
+		}
+		if d := bufs[i].GetDuration(); d > 0 {
+			st.Throughput = float64(s.received) / d
+		}
+		stats[i] = st
+	}
+	return stats
+}
+
+// formatInterfaces renders the per-interface breakdown, if there is one
+func (r *BenchmarkResult) formatInterfaces() string {
+	if len(r.Interfaces) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Interfaces:      %d attach points\n", len(r.Interfaces))
+	for _, s := range r.Interfaces {
+		p99 := "-"
+		if v, ok := s.Latency.Percentile(0.99); ok {
+			p99 = r.LatencyUnit.Format(float64(v))
+		}
+		fmt.Fprintf(&b, "  %-12s %10d packets (%5.1f%%) %12.0f pps, p99 %s\n",
+			s.Interface, s.Packets, s.Share*100, s.Throughput, p99)
+	}
+	return b.String()
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseYAML parses the block-style YAML subset used by suite configs:
+// nested mappings and sequences, flow sequences and mappings of scalars
+// ([a, b], {k: v}), quoted and plain scalars, and # comments. Anchors,
+// multi-line scalars and multiple documents are not supported.
+//
+// The result uses the same types as encoding/json (map[string]any, []any,
+// string, float64, bool, nil), so callers can re-encode it as JSON and
+// decode it into a struct.
+func parseYAML(data []byte) (any, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(string(data), "\n") {
+		text := stripYAMLComment(strings.TrimRight(raw, " \t\r"))
+		if strings.TrimSpace(text) == "" || text == "---" {
+			continue
+		}
+		if lead := text[:len(text)-len(strings.TrimLeft(text, " \t"))]; strings.Contains(lead, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed in indentation", i+1)
+		}
+		content := strings.TrimLeft(text, " ")
+		lines = append(lines, yamlLine{num: i + 1, indent: len(text) - len(content), text: content})
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	p := &yamlParser{lines: lines}
+	v, err := p.block(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+	}
+	return v, nil
+}
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// block parses the mapping or sequence starting at the current line
+func (p *yamlParser) block(indent int) (any, error) {
+	if isYAMLSeqItem(p.lines[p.pos].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) sequence(indent int) (any, error) {
+	var items []any
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent || !isYAMLSeqItem(l.text) {
+			return nil, fmt.Errorf("line %d: expected sequence item", l.num)
+		}
+		rest := strings.TrimLeft(l.text[1:], " ")
+		switch {
+		case rest == "":
+			// Item is a nested block on the following lines
+			p.pos++
+			if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+				items = append(items, nil)
+				continue
+			}
+			v, err := p.block(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+		case isYAMLMappingEntry(rest):
+			// "- key: value" starts a mapping indented to the key
+			p.lines[p.pos] = yamlLine{num: l.num, indent: l.indent + len(l.text) - len(rest), text: rest}
+			v, err := p.mapping(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+		default:
+			v, err := parseYAMLValue(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", l.num, err)
+			}
+			items = append(items, v)
+			p.pos++
+		}
+	}
+	return items, nil
+}
+
+func (p *yamlParser) mapping(indent int) (any, error) {
+	m := make(map[string]any)
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+		}
+		key, value, ok := splitYAMLMappingEntry(l.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", l.num)
+		}
+		if _, dup := m[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", l.num, key)
+		}
+		p.pos++
+
+		if value != "" {
+			v, err := parseYAMLValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", l.num, err)
+			}
+			m[key] = v
+			continue
+		}
+		// Nested block; sequences may sit at the key's own indentation
+		if p.pos < len(p.lines) {
+			next := p.lines[p.pos]
+			if next.indent > indent || next.indent == indent && isYAMLSeqItem(next.text) {
+				v, err := p.block(next.indent)
+				if err != nil {
+					return nil, err
+				}
+				m[key] = v
+				continue
+			}
+		}
+		m[key] = nil
+	}
+	return m, nil
+}
+
+// isYAMLSeqItem reports whether a line starts a sequence item
+func isYAMLSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func isYAMLMappingEntry(text string) bool {
+	_, _, ok := splitYAMLMappingEntry(text)
+	return ok
+}
+
+// splitYAMLMappingEntry splits "key: value" outside of quotes and flow
+// collections
+func splitYAMLMappingEntry(text string) (string, string, bool) {
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return "", "", false
+	}
+	quote := byte(0)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++ // An escape, perhaps of the quote
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case isYAMLQuoteStart(text, i):
+			quote = c
+		case c == ':' && (i+1 == len(text) || text[i+1] == ' '):
+			key := strings.TrimSpace(text[:i])
+			if key == "" {
+				return "", "", false
+			}
+			if k, err := parseYAMLScalar(key); err == nil {
+				if s, ok := k.(string); ok {
+					key = s
+				}
+			}
+			return key, strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// parseYAMLValue parses an inline value: a scalar or a flow collection
+func parseYAMLValue(text string) (any, error) {
+	switch {
+	case strings.HasPrefix(text, "["):
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("unterminated flow sequence %q", text)
+		}
+		items := []any{}
+		for _, part := range splitYAMLFlow(text[1 : len(text)-1]) {
+			v, err := parseYAMLScalar(part)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+		}
+		return items, nil
+	case strings.HasPrefix(text, "{"):
+		if !strings.HasSuffix(text, "}") {
+			return nil, fmt.Errorf("unterminated flow mapping %q", text)
+		}
+		m := make(map[string]any)
+		for _, part := range splitYAMLFlow(text[1 : len(text)-1]) {
+			key, value, ok := splitYAMLMappingEntry(part)
+			if !ok {
+				return nil, fmt.Errorf("expected \"key: value\" in %q", text)
+			}
+			v, err := parseYAMLScalar(value)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		}
+		return m, nil
+	}
+	return parseYAMLScalar(text)
+}
+
+// splitYAMLFlow splits the inside of a flow collection on commas outside
+// of quotes
+func splitYAMLFlow(text string) []string {
+	var parts []string
+	quote := byte(0)
+	start := 0
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++ // An escape, perhaps of the quote
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case isYAMLQuoteStart(text, i):
+			quote = c
+		case c == ',':
+			parts = append(parts, strings.TrimSpace(text[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(text[start:]); last != "" || len(parts) > 0 {
+		parts = append(parts, last)
+	}
+	return parts
+}
+
+// parseYAMLScalar converts a plain or quoted scalar
+func parseYAMLScalar(text string) (any, error) {
+	if len(text) >= 2 && (text[0] == '"' || text[0] == '\'') {
+		if text[len(text)-1] != text[0] {
+			return nil, fmt.Errorf("unterminated string %s", text)
+		}
+		if text[0] == '"' {
+			return unquoteYAML(text[1 : len(text)-1])
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	}
+	switch text {
+	case "", "~", "null":
+		return nil, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case ".nan", ".NaN", ".NAN":
+		return math.NaN(), nil
+	case ".inf", ".Inf", ".INF", "+.inf", "+.Inf", "+.INF":
+		return math.Inf(1), nil
+	case "-.inf", "-.Inf", "-.INF":
+		return math.Inf(-1), nil
+	}
+	if isYAMLNumber(text) {
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return f, nil
+		}
+	}
+	return text, nil
+}
+
+// isYAMLNumber reports whether text is a decimal number as the YAML core
+// schema writes one, [-+]?(.digits|digits(.digits?)?)([eE][-+]?digits)?.
+// ParseFloat alone would also take inf, nan and hexadecimal floats, which
+// YAML reads as strings.
+func isYAMLNumber(text string) bool {
+	digits := func(s string) int {
+		n := 0
+		for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+			n++
+		}
+		return n
+	}
+	s := text
+	if s != "" && (s[0] == '-' || s[0] == '+') {
+		s = s[1:]
+	}
+	whole := digits(s)
+	s = s[whole:]
+	frac := 0
+	if strings.HasPrefix(s, ".") {
+		frac = digits(s[1:])
+		s = s[1+frac:]
+	}
+	if whole == 0 && frac == 0 {
+		return false
+	}
+	if s != "" && (s[0] == 'e' || s[0] == 'E') {
+		s = s[1:]
+		if s != "" && (s[0] == '-' || s[0] == '+') {
+			s = s[1:]
+		}
+		n := digits(s)
+		if n == 0 {
+			return false
+		}
+		s = s[n:]
+	}
+	return s == ""
+}
+
+// yamlEscapes are the one-character escapes of a double-quoted scalar
+var yamlEscapes = map[byte]string{
+	'0': "\x00", 'a': "\a", 'b': "\b", 't': "\t", '\t': "\t", 'n': "\n",
+	'v': "\v", 'f': "\f", 'r': "\r", 'e': "\x1b", ' ': " ", '"': "\"",
+	'/': "/", '\\': "\\", 'N': "\u0085", '_': "\u00a0", 'L': "\u2028", 'P': "\u2029",
+}
+
+// yamlHexEscapes are the digits taken by the escapes naming a code point
+var yamlHexEscapes = map[byte]int{'x': 2, 'u': 4, 'U': 8}
+
+// unquoteYAML resolves the escapes in the body of a double-quoted scalar.
+// They are not Go's: YAML has \e, \/, \N, \_, \L, \P and an escaped space
+// but neither \' nor octal, and its \x names a code point, not a byte.
+func unquoteYAML(body string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if c == '"' {
+			return "", fmt.Errorf("unescaped quote in %q", body)
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		if i++; i == len(body) {
+			return "", fmt.Errorf("trailing backslash in %q", body)
+		}
+		if s, ok := yamlEscapes[body[i]]; ok {
+			b.WriteString(s)
+			continue
+		}
+		width, ok := yamlHexEscapes[body[i]]
+		if !ok || i+width >= len(body) {
+			return "", fmt.Errorf("invalid escape \\%c in %q", body[i], body)
+		}
+		r, err := strconv.ParseUint(body[i+1:i+1+width], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(r)) {
+			return "", fmt.Errorf("invalid escape \\%s in %q", body[i:i+1+width], body)
+		}
+		b.WriteRune(rune(r))
+		i += width
+	}
+	return b.String(), nil
+}
+
+// isYAMLQuoteStart reports whether s[i] opens a quoted scalar, as opposed
+// to an apostrophe inside a plain one
+func isYAMLQuoteStart(s string, i int) bool {
+	if s[i] != '"' && s[i] != '\'' {
+		return false
+	}
+	return i == 0 || strings.IndexByte(" [{,:", s[i-1]) >= 0
+}
+
+// stripYAMLComment removes a trailing # comment outside of quotes
+func stripYAMLComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++ // An escape, perhaps of the quote
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case isYAMLQuoteStart(line, i):
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' '):
+			return strings.TrimRight(line[:i], " ")
+		}
+	}
+	return line
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// TestParseYAMLDoubleQuoted resolves the escapes YAML has and Go does
+// not, and rejects those Go has and YAML does not
+func TestParseYAMLDoubleQuoted(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{`"plain"`, "plain"},
+		{`"tab\there"`, "tab\there"},
+		{`"a\/b"`, "a/b"},
+		{`"esc\e"`, "esc\x1b"},
+		{`"sp\ ace"`, "sp ace"},
+		{`"\N\_\L\P"`, "\u0085\u00a0\u2028\u2029"},
+		{`"\xe9"`, "é"}, // A code point, where Go's \xe9 is one byte
+		{`"é\U0001F600"`, "é\U0001F600"},
+		{`"say \"hi\""`, `say "hi"`},
+		{`"back\\slash"`, `back\slash`},
+	} {
+		got, err := parseYAMLScalar(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{
+		`"it\'s"`, // Go only
+		`"\101"`,  // Go octal
+		`"\q"`,
+		`"\x4"`,
+		`"\uD800"`,
+		`"end\"`,
+		`"in"side"`,
+	} {
+		if got, err := parseYAMLScalar(in); err == nil {
+			t.Errorf("%s parsed as %q", in, got)
+		}
+	}
+}
+
+// TestParseYAMLEscapedQuote keeps an escaped quote from ending the scalar
+// early, in a mapping value, a flow sequence and before a comment
+func TestParseYAMLEscapedQuote(t *testing.T) {
+	v, err := parseYAML([]byte("name: \"a \\\" # b\" # comment\ntags: [\"x\\\", y\", z]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"name": `a " # b`, "tags": []any{`x", y`, "z"}}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("got %#v, want %#v", v, want)
+	}
+}
+
+// TestParseYAMLFloats takes the core schema's numbers and its .inf and
+// .nan spellings, leaving what only ParseFloat accepts as strings
+func TestParseYAMLFloats(t *testing.T) {
+	for in, want := range map[string]float64{
+		"0":      0,
+		"-12":    -12,
+		"+3.5":   3.5,
+		".5":     0.5,
+		"1.":     1,
+		"2e3":    2000,
+		"1.5E-1": 0.15,
+		".inf":   math.Inf(1),
+		"+.Inf":  math.Inf(1),
+		"-.INF":  math.Inf(-1),
+	} {
+		if got, err := parseYAMLScalar(in); err != nil || got != want {
+			t.Errorf("%s: got %v, %v, want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{".nan", ".NaN", ".NAN"} {
+		if got, _ := parseYAMLScalar(in); !math.IsNaN(got.(float64)) {
+			t.Errorf("%s: got %v, want NaN", in, got)
+		}
+	}
+	for _, in := range []string{"inf", "+Inf", "-infinity", "NaN", ".nAn", ".iNf", "0x1p4", "1_000", "1e", ".", "-", "+-1"} {
+		if got, err := parseYAMLScalar(in); err != nil || got != in {
+			t.Errorf("%s: got %v (%T), %v, want the string", in, got, got, err)
+		}
+	}
+}